@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Values of -anchor, the point in time -min-retention and -max-retention count from
+const (
+	anchorNow    = "now"
+	anchorBackup = "backup"
+)
+
+// validateAnchor checks the -anchor flag value
+func validateAnchor(anchor string) error {
+	switch anchor {
+	case anchorNow, anchorBackup:
+		return nil
+	}
+	return fmt.Errorf("invalid -anchor %q: must be now or backup", anchor)
+}
+
+// retentionTarget is the retain-until an object must already reach, and the
+// retain-until applied when it doesn't
+type retentionTarget struct {
+	requiredUntil time.Time
+	retainUntil   time.Time
+}
+
+// later returns the target reaching furthest of t and other. The zero target
+// is earlier than any other.
+func (t retentionTarget) later(other retentionTarget) retentionTarget {
+	if other.requiredUntil.After(t.requiredUntil) {
+		t.requiredUntil = other.requiredUntil
+	}
+	if other.retainUntil.After(t.retainUntil) {
+		t.retainUntil = other.retainUntil
+	}
+	return t
+}
+
+// backupTarget returns the retention target of the backup m: the periods of
+// its retention class, or the flags', counted from its timestamp with
+// -anchor=backup and from now otherwise. dated is false for a backup whose
+// timestamp -anchor=backup can't determine, which counts from now.
+func (r *refresher) backupTarget(m ManifestInfo) (target retentionTarget, dated bool) {
+	minRetention, maxRetention, classed := r.opts.backupRetention(m)
+	from := r.now
+	if r.opts.anchor == anchorBackup {
+		ts, ok := backupTimestamp(m)
+		if !ok {
+			return r.defaultTarget(), false
+		}
+		from = ts
+	} else if !classed {
+		return r.defaultTarget(), true
+	}
+	return retentionTarget{requiredUntil: minRetention.from(from), retainUntil: maxRetention.from(from)}, true
+}
+
+// needsBackupTargets reports whether backups can differ in retention, with
+// -anchor=backup, retention classes or pins setting a retain-until
+func (r *refresher) needsBackupTargets() bool {
+	return r.opts.anchor == anchorBackup || len(r.opts.retentionClasses) > 0 || r.pins.extendRetention()
+}
+
+// computeBackupTargets computes the retention target of every backup, see
+// backupTarget, raised to the retain-until of its pins, and of their objects: an object shared by several backups
+// gets the latest target among them, so a weekly backup's longer retention
+// isn't cut short by a daily one sharing its SSTables. Manifests are
+// downloaded here and kept for processing; those that fail are reported when
+// processed.
+func (r *refresher) computeBackupTargets(ctx context.Context, manifests []ManifestInfo) {
+	r.manifestTargets = make(map[string]retentionTarget, len(manifests))
+	r.objectTargets = make(map[string]retentionTarget)
+	undated := 0
+	for _, m := range manifests {
+		if ctx.Err() != nil {
+			return
+		}
+		target, dated := r.backupTarget(m)
+		if !dated {
+			slog.Warn("Could not determine backup timestamp, anchoring retention to now", "manifest", m.Key)
+			undated++
+		}
+		// A pin only raises the backup's retention
+		if until := r.pins.retainUntil(m); !until.IsZero() {
+			target = target.later(retentionTarget{requiredUntil: until, retainUntil: until})
+		}
+		r.manifestTargets[m.Key] = target
+
+		manifest, err := r.preloadManifest(ctx, m.Key)
+		if err != nil {
+			continue
+		}
+		mp, err := m.path()
+		if err != nil {
+			continue
+		}
+		hostnamePath := mp.HostnamePath
+		for _, obj := range manifest.Objects {
+			key := resolveObjectKey(hostnamePath, obj.Path)
+			r.objectTargets[key] = r.objectTargets[key].later(target)
+		}
+	}
+	if r.opts.anchor == anchorBackup {
+		slog.Info("Anchored retention to backup timestamps", "manifests", len(manifests), "undated", undated, "objects", len(r.objectTargets))
+		return
+	}
+	slog.Info("Computed backup retention targets", "manifests", len(manifests), "objects", len(r.objectTargets))
+}
+
+// defaultTarget returns the retention target counted from the start of the run
+func (r *refresher) defaultTarget() retentionTarget {
+	return retentionTarget{requiredUntil: r.requiredUntil, retainUntil: r.retainUntil}
+}
+
+// target returns the retention target of key, referenced by manifest: the
+// one computeBackupTargets computed for the object or its backup, or the default
+func (r *refresher) target(manifest, key string) retentionTarget {
+	if target, ok := r.objectTargets[key]; ok {
+		return target
+	}
+	if target, ok := r.manifestTargets[manifest]; ok {
+		return target
+	}
+	return r.defaultTarget()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRunAnchor(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	oldBackup := fmt.Sprintf("medusa-backup-schedule-%d", now.AddDate(0, 0, -60).Unix())
+	newBackup := fmt.Sprintf("medusa-backup-schedule-%d", now.AddDate(0, 0, -10).Unix())
+
+	tests := []struct {
+		anchor string
+		want   map[string]time.Time // retain-until set per key, zero when left untouched
+	}{
+		{
+			anchor: anchorNow,
+			want: map[string]time.Time{
+				"links/host1/data/ks/t/shared.db":                  now.AddDate(0, 0, 30),
+				"links/host1/data/ks/t/old.db":                     now.AddDate(0, 0, 30),
+				"links/host1/data/ks/t/new.db":                     now.AddDate(0, 0, 30),
+				"links/host1/data/ks/t/undated.db":                 now.AddDate(0, 0, 30),
+				"links/host1/" + oldBackup + "/meta/manifest.json": now.AddDate(0, 0, 30),
+				"links/host1/" + newBackup + "/meta/manifest.json": now.AddDate(0, 0, 30),
+			},
+		},
+		{
+			anchor: anchorBackup,
+			want: map[string]time.Time{
+				// Shared with the newer backup, whose requirement wins
+				"links/host1/data/ks/t/shared.db": now.AddDate(0, 0, 20),
+				// The old backup's 30 days are over
+				"links/host1/data/ks/t/old.db": {},
+				"links/host1/data/ks/t/new.db": now.AddDate(0, 0, 20),
+				// Undated backups count from now
+				"links/host1/data/ks/t/undated.db":                 now.AddDate(0, 0, 30),
+				"links/host1/" + oldBackup + "/meta/manifest.json": {},
+				"links/host1/" + newBackup + "/meta/manifest.json": now.AddDate(0, 0, 20),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.anchor, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/"+oldBackup+"/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/old.db"}]}]`
+			bucket.objects["links/host1/"+newBackup+"/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/new.db"}]}]`
+			bucket.objects["links/host1/adhoc/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/undated.db"}]}]`
+			for key := range tt.want {
+				if _, ok := bucket.objects[key]; !ok {
+					bucket.objects[key] = ""
+				}
+			}
+
+			opts := testOptions()
+			opts.anchor = tt.anchor
+			opts.excludeMeta = false
+			r := newRefresher(bucket.client(), opts, now)
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			for key, want := range tt.want {
+				if got := bucket.retention[key]; !got.Equal(want) {
+					t.Errorf("retention of %s = %v, want %v", key, got, want)
+				}
+			}
+			if tt.anchor == anchorBackup && bucket.getCalls != 3 {
+				t.Errorf("run() downloaded manifests %d times, want each once", bucket.getCalls)
+			}
+		})
+	}
+}
+
+func TestRetentionTargetLater(t *testing.T) {
+	early := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := early.AddDate(0, 1, 0)
+
+	got := retentionTarget{requiredUntil: late, retainUntil: early}.later(retentionTarget{requiredUntil: early, retainUntil: late})
+	if !got.requiredUntil.Equal(late) || !got.retainUntil.Equal(late) {
+		t.Errorf("later() = %+v, want both %v", got, late)
+	}
+	if got := (retentionTarget{}).later(got); got != (retentionTarget{requiredUntil: late, retainUntil: late}) {
+		t.Errorf("zero.later() = %+v, want the other target", got)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// STSAPI identifies the principal recorded in the -audit-s3-prefix log
+type STSAPI interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+// auditAttempts is how many times an audit log upload is tried before the
+// run fails
+const auditAttempts = 4
+
+// auditBackoff is the wait before the second upload attempt, doubled before
+// each following one
+var auditBackoff = time.Second
+
+// defaultAuditInterval is how often the audit log is uploaded during a run
+const defaultAuditInterval = 5 * time.Minute
+
+// auditRecord is a line of the audit log: one retention change
+type auditRecord struct {
+	Time           time.Time    `json:"timestamp"`
+	Bucket         string       `json:"bucket"`
+	Key            string       `json:"key"`
+	Action         objectAction `json:"action"` // updated, or reduced by release
+	OldRetainUntil *time.Time   `json:"old_retain_until"`
+	OldMode        string       `json:"old_mode,omitempty"`
+	NewRetainUntil time.Time    `json:"new_retain_until"`
+	Mode           string       `json:"mode"`
+	RunID          string       `json:"run_id"`
+	Principal      string       `json:"principal_arn"`
+}
+
+// auditLog collects the retention changes of a run and uploads them under
+// -audit-s3-prefix. Each upload writes the records collected since the
+// previous one to a new object, so an uploaded object is never rewritten.
+type auditLog struct {
+	bucket    string
+	prefix    string // key prefix of the run's objects
+	runID     string
+	principal string
+	lockMode  types.ObjectLockMode // Object Lock applied to the uploaded objects, "" for none
+	lockFor   retentionPeriod
+
+	mu      sync.Mutex
+	pending []byte // JSON lines not uploaded yet
+	records int    // records in pending
+
+	uploadMu sync.Mutex // serializes uploads, keeping the objects in order
+	uploaded []string   // keys of the uploaded objects
+}
+
+// record adds a retention change to the log
+func (a *auditLog) record(rec auditRecord) {
+	rec.RunID, rec.Principal = a.runID, a.principal
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("Failed to encode audit record", "key", rec.Key, "error", err.Error())
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(append(a.pending, line...), '\n')
+	a.records++
+}
+
+// upload writes the records collected since the last upload to a new object,
+// retrying failures with exponential backoff up to auditAttempts times.
+// Records that couldn't be uploaded are kept for the next upload.
+func (a *auditLog) upload(ctx context.Context, client ReportUploader, now time.Time) error {
+	a.uploadMu.Lock()
+	defer a.uploadMu.Unlock()
+	a.mu.Lock()
+	data, records := a.pending, a.records
+	a.pending, a.records = nil, 0
+	a.mu.Unlock()
+	if records == 0 {
+		return nil
+	}
+
+	key := fmt.Sprintf("%s%05d.jsonl", a.prefix, len(a.uploaded)+1)
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(a.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("application/x-ndjson"),
+	}
+	if a.lockMode != "" {
+		input.ObjectLockMode = a.lockMode
+		input.ObjectLockRetainUntilDate = aws.Time(a.lockFor.from(now))
+		// Object Lock requires an integrity checksum on PutObject
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+	wait := auditBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		input.Body = bytes.NewReader(data)
+		if _, err = client.PutObject(ctx, input); err == nil || attempt == auditAttempts {
+			break
+		}
+		slog.Debug("Retrying audit log upload", "key", key, "attempt", attempt, "error", err.Error())
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wait *= 2
+	}
+	if err != nil {
+		a.mu.Lock()
+		a.pending = append(data, a.pending...)
+		a.records += records
+		a.mu.Unlock()
+		return fmt.Errorf("failed to upload audit log to s3://%s/%s: %w", a.bucket, key, err)
+	}
+	a.uploaded = append(a.uploaded, key)
+	slog.Info("Uploaded audit log", "uri", "s3://"+a.bucket+"/"+key, "records", records)
+	return nil
+}
+
+// recordAudit adds res to the audit log when it changed key's retention
+func (r *refresher) recordAudit(now time.Time, key string, res objectResult) {
+	if r.audit == nil || (res.action != actionUpdated && res.action != actionReduced) || res.retainUntil.IsZero() {
+		return
+	}
+	rec := auditRecord{
+		Time:           now.UTC(),
+		Bucket:         r.opts.bucket,
+		Key:            key,
+		Action:         res.action,
+		NewRetainUntil: res.retainUntil.UTC(),
+		Mode:           string(res.mode),
+	}
+	if res.previous != nil && res.previous.RetainUntil != nil {
+		old := res.previous.RetainUntil.UTC()
+		rec.OldRetainUntil, rec.OldMode = &old, string(res.previous.Mode)
+	}
+	r.audit.record(rec)
+}
+
+// openAudit identifies the caller and starts the -audit-s3-prefix log
+func (r *refresher) openAudit(ctx context.Context) error {
+	opts := r.opts
+	bucket, prefix, err := parseS3URI(strings.TrimSuffix(opts.auditPrefix, "/"))
+	if err != nil {
+		return err
+	}
+	if r.sts == nil {
+		if r.sts, err = newSTSClient(ctx, opts.commonOptions); err != nil {
+			return err
+		}
+	}
+	if r.uploader == nil {
+		if r.uploader, err = newS3Client(ctx, opts.commonOptions); err != nil {
+			return err
+		}
+	}
+	identity, err := r.sts.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("failed to identify the caller for the audit log: %w", err)
+	}
+	r.audit = &auditLog{
+		bucket:    bucket,
+		prefix:    fmt.Sprintf("%s/%s/%s-%s-", prefix, opts.cluster, time.Now().UTC().Format("20060102T150405Z"), r.runID),
+		runID:     r.runID,
+		principal: aws.ToString(identity.Arn),
+		lockMode:  opts.auditLockMode,
+		lockFor:   opts.auditRetention,
+	}
+	if opts.auditRetention.isZero() {
+		r.audit.lockMode = ""
+	}
+	slog.Info("Writing audit log", "uri", fmt.Sprintf("s3://%s/%s*", bucket, r.audit.prefix), "principal", r.audit.principal)
+	return nil
+}
+
+// startAuditUploads uploads the audit log every -audit-upload-interval until
+// the returned func is called. Failed uploads are retried by the next one.
+func (r *refresher) startAuditUploads(ctx context.Context) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(r.opts.auditInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.audit.upload(ctx, r.uploader, time.Now()); err != nil {
+					slog.Warn("Failed to upload audit log, retrying with the next upload", errorAttrs(err)...)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// withAudit runs fn, which changes retention, recording the changes in the
+// -audit-s3-prefix log. The log is uploaded even when fn fails, and failing
+// to upload it fails an otherwise successful run, since the evidence is
+// mandatory. After a failed run the upload failure is only logged.
+func (r *refresher) withAudit(ctx context.Context, fn func() error) error {
+	if r.opts.auditPrefix == "" {
+		return fn()
+	}
+	if err := r.openAudit(ctx); err != nil {
+		return err
+	}
+	stop := func() {}
+	if r.opts.auditInterval > 0 {
+		stop = r.startAuditUploads(ctx)
+	}
+	err := fn()
+	stop()
+
+	// The log is uploaded even when the run was interrupted
+	uploadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+	defer cancel()
+	if uploadErr := r.audit.upload(uploadCtx, r.uploader, time.Now()); uploadErr != nil {
+		if err == nil {
+			return uploadErr
+		}
+		slog.Error("Failed to upload audit log", errorAttrs(uploadErr)...)
+	}
+	return err
+}
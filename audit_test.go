@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// mockSTS answers GetCallerIdentity with arn
+type mockSTS struct {
+	arn string
+	err error
+}
+
+func (m *mockSTS) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String(m.arn), Account: aws.String("123456789012")}, nil
+}
+
+// fastAuditRetries makes audit upload retries immediate for the test
+func fastAuditRetries(t *testing.T) {
+	backoff := auditBackoff
+	auditBackoff = time.Millisecond
+	t.Cleanup(func() { auditBackoff = backoff })
+}
+
+const testPrincipal = "arn:aws:sts::123456789012:assumed-role/medusa-retention/refresher"
+
+// auditedRun runs the refresher over a bucket with one object due for an
+// update and one already retained long enough
+func auditedRun(t *testing.T, opts *options, uploader *mockUploader, identity *mockSTS) (*refresher, error) {
+	t.Helper()
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	bucket.retention["links/host1/data/ks/t/a.db"] = time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC)
+	bucket.retention["links/host1/data/ks/t/b.db"] = time.Now().AddDate(0, 0, 20)
+	opts.excludeMeta = true
+	r := newRefresher(bucket.client(), opts, time.Now())
+	r.uploader, r.sts = uploader, identity
+	return r, r.run(context.Background())
+}
+
+func TestRunWritesAuditLog(t *testing.T) {
+	opts := testOptions()
+	opts.auditPrefix = "s3://audit-bucket/medusa/"
+	opts.auditRetention = retentionPeriod{years: 7}
+	opts.auditLockMode = types.ObjectLockModeCompliance
+	uploader := &mockUploader{}
+	r, err := auditedRun(t, opts, uploader, &mockSTS{arn: testPrincipal})
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if len(uploader.keys) != 1 {
+		t.Fatalf("uploaded %v, want one audit log object", uploader.keys)
+	}
+	key := uploader.keys[0]
+	if !strings.HasPrefix(key, "audit-bucket/medusa/links/") || !strings.HasSuffix(key, "-"+r.runID+"-00001.jsonl") {
+		t.Errorf("uploaded to %s, want medusa/links/[time]-[run id]-00001.jsonl in audit-bucket", key)
+	}
+	in := uploader.inputs[0]
+	if in.ObjectLockMode != types.ObjectLockModeCompliance || in.ChecksumAlgorithm == "" {
+		t.Errorf("audit object lock = %s with checksum %q, want COMPLIANCE", in.ObjectLockMode, in.ChecksumAlgorithm)
+	}
+	if until := aws.ToTime(in.ObjectLockRetainUntilDate); until.Before(time.Now().AddDate(7, 0, -1)) {
+		t.Errorf("audit object retained until %v, want 7 years", until)
+	}
+
+	// Only the changed object is recorded, with every member of the schema
+	lines := strings.Split(strings.TrimSpace(string(uploader.bodies[0])), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("audit log has %d records, want 1:\n%s", len(lines), uploader.bodies[0])
+	}
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("invalid audit record %s: %v", lines[0], err)
+	}
+	var members []string
+	for member := range rec {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	want := []string{"action", "bucket", "key", "mode", "new_retain_until", "old_mode", "old_retain_until", "principal_arn", "run_id", "timestamp"}
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("audit record members = %v, want %v", members, want)
+	}
+	for member, value := range map[string]any{
+		"bucket":           "test-bucket",
+		"key":              "links/host1/data/ks/t/a.db",
+		"action":           "updated",
+		"old_retain_until": "2025-06-02T00:00:00Z",
+		"old_mode":         "GOVERNANCE",
+		"mode":             "GOVERNANCE",
+		"run_id":           r.runID,
+		"principal_arn":    testPrincipal,
+	} {
+		if rec[member] != value {
+			t.Errorf("audit record %s = %v, want %v", member, rec[member], value)
+		}
+	}
+	newUntil, err := time.Parse(time.RFC3339, rec["new_retain_until"].(string))
+	if err != nil || newUntil.Before(time.Now().AddDate(0, 0, 29)) {
+		t.Errorf("audit record new_retain_until = %v, want the -max-retention date", rec["new_retain_until"])
+	}
+}
+
+func TestAuditLogSkipsDryRun(t *testing.T) {
+	opts := testOptions()
+	opts.auditPrefix = "s3://audit-bucket/medusa"
+	opts.dryRun = true
+	uploader := &mockUploader{}
+	if _, err := auditedRun(t, opts, uploader, &mockSTS{arn: testPrincipal}); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(uploader.keys) != 0 {
+		t.Errorf("uploaded %v for a dry run, which changes nothing", uploader.keys)
+	}
+}
+
+func TestAuditLogFailures(t *testing.T) {
+	fastAuditRetries(t)
+	tests := []struct {
+		name     string
+		failures int
+		stsErr   error
+		wantErr  string
+	}{
+		{name: "upload retried", failures: auditAttempts - 1},
+		{name: "upload fails the run", failures: auditAttempts, wantErr: "failed to upload audit log to s3://audit-bucket/medusa/links/"},
+		{name: "unknown caller", stsErr: errors.New("ExpiredToken"), wantErr: "failed to identify the caller for the audit log"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.auditPrefix = "s3://audit-bucket/medusa"
+			uploader := &mockUploader{failures: tt.failures}
+			_, err := auditedRun(t, opts, uploader, &mockSTS{arn: testPrincipal, err: tt.stsErr})
+			if tt.wantErr == "" {
+				if err != nil || len(uploader.keys) != 1 {
+					t.Errorf("run() error = %v, uploaded %v, want the audit log uploaded", err, uploader.keys)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("run() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuditLogUploadsInOrder(t *testing.T) {
+	fastAuditRetries(t)
+	log := &auditLog{bucket: "audit-bucket", prefix: "medusa/links/run-", runID: "run", principal: testPrincipal}
+	uploader := &mockUploader{failures: auditAttempts}
+	now := time.Now()
+
+	log.record(auditRecord{Key: "a.db", Action: actionUpdated})
+	if err := log.upload(context.Background(), uploader, now); err == nil {
+		t.Fatal("upload() succeeded, want the failure")
+	}
+	// Records of a failed upload are kept for the next one
+	log.record(auditRecord{Key: "b.db", Action: actionUpdated})
+	if err := log.upload(context.Background(), uploader, now); err != nil {
+		t.Fatalf("upload() error = %v", err)
+	}
+	log.record(auditRecord{Key: "c.db", Action: actionReduced})
+	if err := log.upload(context.Background(), uploader, now); err != nil {
+		t.Fatalf("upload() error = %v", err)
+	}
+	// Nothing new, nothing uploaded
+	if err := log.upload(context.Background(), uploader, now); err != nil {
+		t.Fatalf("upload() error = %v", err)
+	}
+
+	wantKeys := []string{"audit-bucket/medusa/links/run-00001.jsonl", "audit-bucket/medusa/links/run-00002.jsonl"}
+	if !reflect.DeepEqual(uploader.keys, wantKeys) {
+		t.Fatalf("uploaded %v, want %v", uploader.keys, wantKeys)
+	}
+	var keys []string
+	for _, body := range uploader.bodies {
+		for _, line := range bytes.Split(bytes.TrimSpace(body), []byte("\n")) {
+			var rec auditRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				t.Fatalf("invalid audit record %s: %v", line, err)
+			}
+			if rec.RunID != "run" || rec.Principal != testPrincipal {
+				t.Errorf("record of %s has run %q by %q", rec.Key, rec.RunID, rec.Principal)
+			}
+			keys = append(keys, rec.Key)
+		}
+	}
+	if want := []string{"a.db", "b.db", "c.db"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("audit log records %v, want %v", keys, want)
+	}
+	// Without -audit-retention the objects aren't locked
+	if uploader.inputs[0].ObjectLockMode != "" {
+		t.Errorf("audit object locked in %s", uploader.inputs[0].ObjectLockMode)
+	}
+}
+
+func TestAuditPeriodicUploads(t *testing.T) {
+	opts := testOptions()
+	opts.auditInterval = time.Millisecond
+	uploader := &mockUploader{}
+	r := newRefresher(newFakeBucket().client(), opts, time.Now())
+	r.uploader = uploader
+	r.audit = &auditLog{bucket: "audit-bucket", prefix: "medusa/links/run-", runID: r.runID, principal: testPrincipal}
+	r.audit.record(auditRecord{Key: "a.db", Action: actionUpdated})
+
+	stop := r.startAuditUploads(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		uploader.mu.Lock()
+		uploaded := len(uploader.keys)
+		uploader.mu.Unlock()
+		if uploaded > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("audit log not uploaded during the run")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	if len(uploader.keys) != 1 || !bytes.Contains(uploader.bodies[0], []byte(`"key":"a.db"`)) {
+		t.Errorf("uploaded %v, want the record once", uploader.keys)
+	}
+}
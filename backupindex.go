@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// backupIndex is what Medusa's index/ prefix says about a cluster's backups:
+// index/backup_index/[backup_name]/manifest_[hostname].json per backup and node,
+// and index/latest_backup/[hostname]/backup_name.txt pointing at each node's latest backup
+type backupIndex struct {
+	manifests []ManifestInfo
+	latest    map[string]string // hostname -> latest backup name
+}
+
+// indexPrefix returns the [prefix][cluster]/index/ prefix Medusa keeps its index under
+func indexPrefix(basePrefix, cluster string) string {
+	return basePrefix + cluster + "/index/"
+}
+
+// indexManifestKey builds the manifest key of a backup named in the index
+func indexManifestKey(basePrefix, cluster, hostname, backupName string) string {
+	return basePrefix + cluster + "/" + hostname + "/" + backupName + manifestSuffix
+}
+
+// readBackupIndex reads the backup index and latest backup pointers of a cluster
+func readBackupIndex(ctx context.Context, client S3API, bucket, basePrefix, cluster string) (*backupIndex, error) {
+	prefix := indexPrefix(basePrefix, cluster)
+	idx := &backupIndex{latest: make(map[string]string)}
+
+	backups := prefix + "backup_index/"
+	var continuationToken *string
+	for {
+		resp, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucket),
+			Prefix:            aws.String(backups),
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backup index: %w", err)
+		}
+		for _, obj := range resp.Contents {
+			// [backup_name]/manifest_[hostname].json
+			backupName, file, ok := strings.Cut(strings.TrimPrefix(aws.ToString(obj.Key), backups), "/")
+			if !ok || !strings.HasPrefix(file, "manifest_") || !strings.HasSuffix(file, ".json") {
+				continue
+			}
+			hostname := strings.TrimSuffix(strings.TrimPrefix(file, "manifest_"), ".json")
+			idx.manifests = append(idx.manifests, ManifestInfo{
+				Key:          indexManifestKey(basePrefix, cluster, hostname, backupName),
+				LastModified: aws.ToTime(obj.LastModified),
+				Prefix:       basePrefix,
+			})
+		}
+		if !aws.ToBool(resp.IsTruncated) {
+			break
+		}
+		continuationToken = resp.NextContinuationToken
+	}
+
+	pointers, err := listKeys(ctx, client, bucket, prefix+"latest_backup/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list latest backup pointers: %w", err)
+	}
+	for _, key := range pointers {
+		// [hostname]/backup_name.txt
+		hostname, file, ok := strings.Cut(strings.TrimPrefix(key, prefix+"latest_backup/"), "/")
+		if !ok || file != "backup_name.txt" {
+			continue
+		}
+		name, err := downloadObject(ctx, client, bucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read latest backup of %s: %w", hostname, err)
+		}
+		idx.latest[hostname] = strings.TrimSpace(string(name))
+	}
+	return idx, nil
+}
+
+// discrepancies returns a description of every latest backup pointer naming
+// a backup the backup index doesn't list, ordered by hostname
+func (idx *backupIndex) discrepancies(basePrefix, cluster string) []string {
+	indexed := make(map[string]bool, len(idx.manifests))
+	for _, m := range idx.manifests {
+		indexed[m.Key] = true
+	}
+	var found []string
+	for hostname, backupName := range idx.latest {
+		if !indexed[indexManifestKey(basePrefix, cluster, hostname, backupName)] {
+			found = append(found, fmt.Sprintf("latest backup %q of %s is not in the backup index", backupName, hostname))
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+// latestManifests returns the manifest of each node's latest backup pointer
+func (idx *backupIndex) latestManifests(basePrefix, cluster string) []ManifestInfo {
+	lastModified := make(map[string]time.Time, len(idx.manifests))
+	for _, m := range idx.manifests {
+		lastModified[m.Key] = m.LastModified
+	}
+	var manifests []ManifestInfo
+	for hostname, backupName := range idx.latest {
+		key := indexManifestKey(basePrefix, cluster, hostname, backupName)
+		manifests = append(manifests, ManifestInfo{Key: key, LastModified: lastModified[key], Prefix: basePrefix})
+	}
+	return manifests
+}
+
+// manifestsFromIndex resolves the manifests to process from the backup index.
+// ok is false when the index is absent or inconsistent and the caller should
+// fall back to listing the cluster prefix.
+func manifestsFromIndex(ctx context.Context, client S3API, opts *options) ([]ManifestInfo, bool) {
+	idx, err := readBackupIndex(ctx, client, opts.bucket, opts.prefix, opts.cluster)
+	if err != nil {
+		slog.Warn("Can't read the backup index, falling back to listing", errorAttrs(err)...)
+		return nil, false
+	}
+	if len(idx.manifests) == 0 {
+		slog.Warn("Backup index is empty or absent, falling back to listing", "index", indexPrefix(opts.prefix, opts.cluster))
+		return nil, false
+	}
+	if found := idx.discrepancies(opts.prefix, opts.cluster); len(found) > 0 {
+		for _, d := range found {
+			slog.Warn("Backup index discrepancy", "discrepancy", d)
+		}
+		slog.Warn("Backup index is inconsistent, falling back to listing", "discrepancies", len(found))
+		return nil, false
+	}
+
+	// The latest backup pointers answer -latest-only directly, unless other
+	// filters narrow the backups it should choose from
+	if opts.latestOnly && len(idx.latest) > 0 && opts.backupName == "" && opts.since.IsZero() && opts.until.IsZero() {
+		manifests := idx.latestManifests(opts.prefix, opts.cluster)
+		slog.Info("Found latest backups in backup index", "manifests", len(manifests))
+		return manifests, true
+	}
+	slog.Info("Found manifests in backup index", "manifests", len(idx.manifests))
+	return idx.manifests, true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// indexedBucket returns a bucket with two backups of host1, one of host2 and
+// Medusa's index of them, where host1's latest backup pointer is b2
+func indexedBucket() *fakeBucket {
+	bucket := newFakeBucket()
+	for _, m := range []string{"host1/b1", "host1/b2", "host2/b2"} {
+		bucket.objects["links/"+m+"/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	}
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host2/data/ks/t/a.db"] = ""
+
+	bucket.objects["links/index/backup_index/b1/manifest_host1.json"] = ""
+	bucket.objects["links/index/backup_index/b1/tokenmap_host1.json"] = ""
+	bucket.objects["links/index/backup_index/b2/manifest_host1.json"] = ""
+	bucket.objects["links/index/backup_index/b2/manifest_host2.json"] = ""
+	bucket.objects["links/index/backup_index/b2/finished_host2_1764858600.timestamp"] = ""
+	bucket.objects["links/index/latest_backup/host1/backup_name.txt"] = "b2\n"
+	bucket.objects["links/index/latest_backup/host1/tokenmap.json"] = "{}"
+	bucket.objects["links/index/latest_backup/host2/backup_name.txt"] = "b2"
+	return bucket
+}
+
+// listedPrefixes wraps client to record the prefix of every ListObjectsV2 call
+func listedPrefixes(client *MockS3Client) (*MockS3Client, *[]string) {
+	var prefixes []string
+	list := client.ListObjectsV2Func
+	client.ListObjectsV2Func = func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+		prefixes = append(prefixes, aws.ToString(params.Prefix))
+		return list(ctx, params, optFns...)
+	}
+	return client, &prefixes
+}
+
+func TestReadBackupIndex(t *testing.T) {
+	idx, err := readBackupIndex(context.Background(), indexedBucket().client(), "test-bucket", "", "links")
+	if err != nil {
+		t.Fatalf("readBackupIndex() error = %v", err)
+	}
+
+	want := []string{"links/host1/b1/meta/manifest.json", "links/host1/b2/meta/manifest.json", "links/host2/b2/meta/manifest.json"}
+	got := manifestKeys(idx.manifests)
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readBackupIndex() manifests = %v, want %v", got, want)
+	}
+	if want := map[string]string{"host1": "b2", "host2": "b2"}; !reflect.DeepEqual(idx.latest, want) {
+		t.Errorf("readBackupIndex() latest = %v, want %v", idx.latest, want)
+	}
+	if found := idx.discrepancies("", "links"); len(found) != 0 {
+		t.Errorf("discrepancies() = %v, want none", found)
+	}
+}
+
+func TestRunUseIndex(t *testing.T) {
+	tests := []struct {
+		name          string
+		latestOnly    bool
+		edit          func(b *fakeBucket)
+		wantManifests int
+		wantFallback  bool
+	}{
+		{
+			name:          "backup index",
+			wantManifests: 3,
+		},
+		{
+			name:          "latest backup pointers",
+			latestOnly:    true,
+			wantManifests: 2,
+		},
+		{
+			name: "index absent",
+			edit: func(b *fakeBucket) {
+				for key := range b.objects {
+					if strings.HasPrefix(key, "links/index/") {
+						delete(b.objects, key)
+					}
+				}
+			},
+			wantManifests: 3,
+			wantFallback:  true,
+		},
+		{
+			name:       "pointer to a backup missing from the index",
+			latestOnly: true,
+			edit: func(b *fakeBucket) {
+				b.objects["links/index/latest_backup/host2/backup_name.txt"] = "b3"
+			},
+			wantManifests: 2,
+			wantFallback:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := indexedBucket()
+			if tt.edit != nil {
+				tt.edit(bucket)
+			}
+			client, prefixes := listedPrefixes(bucket.client())
+
+			opts := testOptions()
+			opts.useIndex = true
+			opts.latestOnly = tt.latestOnly
+			opts.dryRun = true
+			r := newRefresher(client, opts, time.Now())
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			if got := r.stats.summary(time.Now()).ManifestsProcessed; got != tt.wantManifests {
+				t.Errorf("manifests processed = %d, want %d", got, tt.wantManifests)
+			}
+			listedCluster := false
+			for _, prefix := range *prefixes {
+				if prefix == "links/" {
+					listedCluster = true
+				}
+			}
+			if listedCluster != tt.wantFallback {
+				t.Errorf("listed the cluster prefix = %v, want %v (prefixes %v)", listedCluster, tt.wantFallback, *prefixes)
+			}
+		})
+	}
+}
+
+func TestIndexLatestManifests(t *testing.T) {
+	idx, err := readBackupIndex(context.Background(), indexedBucket().client(), "test-bucket", "", "links")
+	if err != nil {
+		t.Fatalf("readBackupIndex() error = %v", err)
+	}
+	got := manifestKeys(idx.latestManifests("", "links"))
+	sort.Strings(got)
+	want := []string{"links/host1/b2/meta/manifest.json", "links/host2/b2/meta/manifest.json"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("latestManifests() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// requesterPaysHint is appended to access denied errors of the calls that
+// read -bucket when -requester-pays isn't set
+const requesterPaysHint = "-bucket may be requester pays: retry with -requester-pays"
+
+// bucketS3 wraps the S3API of -bucket, setting the request parameters the
+// bucket's configuration calls for on every call
+type bucketS3 struct {
+	S3API
+	requestPayer  types.RequestPayer // "requester" with -requester-pays
+	bucket        string
+	expectedOwner string // -expected-bucket-owner, checked on calls to bucket only
+	sseC          *sseCustomerKey
+}
+
+// newBucketClient creates the S3 client of -bucket
+func newBucketClient(ctx context.Context, c commonOptions) (S3API, error) {
+	client, err := newS3Client(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	logEndpoint(ctx, client, c.bucket)
+	return wrapBucketClient(client, c), nil
+}
+
+// wrapBucketClient wraps client with the -bucket request parameters of c
+func wrapBucketClient(client S3API, c commonOptions) S3API {
+	return newBucketS3(client, c)
+}
+
+// newBucketS3 returns client with the -bucket request parameters of c
+func newBucketS3(client S3API, c commonOptions) bucketS3 {
+	b := bucketS3{S3API: client, bucket: c.bucket, expectedOwner: c.expectedOwner, sseC: c.sseCKey}
+	if c.requesterPays {
+		b.requestPayer = types.RequestPayerRequester
+	}
+	return b
+}
+
+// bucketWriter wraps a ReportUploader whose objects may be written to
+// -bucket, setting the request parameters of bucketS3 on its calls
+type bucketWriter struct {
+	ReportUploader
+	params bucketS3
+}
+
+// wrapBucketWriter wraps uploader with the -bucket request parameters of c
+func wrapBucketWriter(uploader ReportUploader, c commonOptions) ReportUploader {
+	return bucketWriter{ReportUploader: uploader, params: newBucketS3(nil, c)}
+}
+
+func (w bucketWriter) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return w.ReportUploader.PutObject(ctx, w.params.putObjectInput(params), optFns...)
+}
+
+// owner returns the ExpectedBucketOwner of a call to bucket: the
+// -expected-bucket-owner of -bucket, nil for other buckets such as the
+// -policy-s3-uri one
+func (c bucketS3) owner(bucket *string) *string {
+	if c.expectedOwner == "" || aws.ToString(bucket) != c.bucket {
+		return nil
+	}
+	return aws.String(c.expectedOwner)
+}
+
+// customerKey returns the SSE-C key of a read from bucket: -sse-c-key for
+// -bucket, which Medusa uploads to, nil for other buckets
+func (c bucketS3) customerKey(bucket *string) *sseCustomerKey {
+	if aws.ToString(bucket) != c.bucket {
+		return nil
+	}
+	return c.sseC
+}
+
+// rejectedKey marks an access denied err of a request carrying the SSE-C
+// key with errSSECKeyRejected
+func rejectedKey(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "AccessDenied" || apiErr.ErrorCode() == "Forbidden") {
+		return fmt.Errorf("%w: %w", errSSECKeyRejected, err)
+	}
+	return err
+}
+
+// isAccessDenied reports whether err is an S3 access denied error
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "AccessDenied"
+}
+
+// hintRequesterPays adds requesterPaysHint to an access denied err when
+// -requester-pays isn't set: S3 denies requests to a requester pays bucket
+// that don't agree to pay for them
+func (c bucketS3) hintRequesterPays(err error) error {
+	if err == nil || c.requestPayer != "" || !isAccessDenied(err) {
+		return err
+	}
+	return fmt.Errorf("%w (%s)", err, requesterPaysHint)
+}
+
+func (c bucketS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	out, err := c.S3API.ListObjectsV2(ctx, &in, optFns...)
+	return out, c.hintRequesterPays(err)
+}
+
+func (c bucketS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	// The key is only sent for manifests: other objects of -bucket, such as a
+	// -pins-file, may not be encrypted with it
+	if key := c.customerKey(in.Bucket); key != nil && isManifestKey(aws.ToString(in.Key)) {
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = aws.String(sseCustomerAlgorithm), aws.String(key.key), aws.String(key.keyMD5)
+		out, err := c.S3API.GetObject(ctx, &in, optFns...)
+		return out, rejectedKey(err)
+	}
+	out, err := c.S3API.GetObject(ctx, &in, optFns...)
+	return out, c.hintRequesterPays(err)
+}
+
+func (c bucketS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	if key := c.customerKey(in.Bucket); key != nil {
+		in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = aws.String(sseCustomerAlgorithm), aws.String(key.key), aws.String(key.keyMD5)
+		out, err := c.S3API.HeadObject(ctx, &in, optFns...)
+		return out, rejectedKey(err)
+	}
+	out, err := c.S3API.HeadObject(ctx, &in, optFns...)
+	return out, c.hintRequesterPays(err)
+}
+
+func (c bucketS3) GetObjectRetention(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	return c.S3API.GetObjectRetention(ctx, &in, optFns...)
+}
+
+func (c bucketS3) PutObjectRetention(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	return c.S3API.PutObjectRetention(ctx, &in, optFns...)
+}
+
+func (c bucketS3) GetObjectLegalHold(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error) {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	return c.S3API.GetObjectLegalHold(ctx, &in, optFns...)
+}
+
+func (c bucketS3) PutObjectLegalHold(ctx context.Context, params *s3.PutObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.PutObjectLegalHoldOutput, error) {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	return c.S3API.PutObjectLegalHold(ctx, &in, optFns...)
+}
+
+func (c bucketS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	return c.S3API.PutObject(ctx, c.putObjectInput(params), optFns...)
+}
+
+// putObjectInput returns params with the request parameters of the bucket
+// it writes to
+func (c bucketS3) putObjectInput(params *s3.PutObjectInput) *s3.PutObjectInput {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	return &in
+}
+
+func (c bucketS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	return c.S3API.GetObjectTagging(ctx, &in, optFns...)
+}
+
+func (c bucketS3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	in := *params
+	in.RequestPayer = c.requestPayer
+	in.ExpectedBucketOwner = c.owner(in.Bucket)
+	return c.S3API.PutObjectTagging(ctx, &in, optFns...)
+}
+
+// warnMissingBucketOwner warns that a command changing objects runs without
+// -expected-bucket-owner, which would have S3 reject a mistyped -bucket owned
+// by another account
+func warnMissingBucketOwner(opts *options) {
+	if opts.expectedOwner == "" && !opts.dryRun && providerOf(opts.commonOptions).supports("-expected-bucket-owner") {
+		slog.Warn("Running without -expected-bucket-owner: retention may be changed in a bucket of another account if -bucket is mistyped", "bucket", opts.bucket)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// bucketParams are the -bucket request parameters of a call
+type bucketParams struct {
+	payer types.RequestPayer
+	owner string
+}
+
+// recordParams returns a client recording the -bucket request parameters of
+// each call by operation
+func recordParams(calls map[string]bucketParams) *MockS3Client {
+	return &MockS3Client{
+		ListObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			calls["ListObjectsV2"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.ListObjectsV2Output{}, nil
+		},
+		GetObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			calls["GetObject"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.GetObjectOutput{}, nil
+		},
+		HeadObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			calls["HeadObject"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.HeadObjectOutput{}, nil
+		},
+		GetObjectRetentionFunc: func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+			calls["GetObjectRetention"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.GetObjectRetentionOutput{}, nil
+		},
+		PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+			calls["PutObjectRetention"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.PutObjectRetentionOutput{}, nil
+		},
+		GetObjectLegalHoldFunc: func(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error) {
+			calls["GetObjectLegalHold"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.GetObjectLegalHoldOutput{}, nil
+		},
+		PutObjectLegalHoldFunc: func(ctx context.Context, params *s3.PutObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.PutObjectLegalHoldOutput, error) {
+			calls["PutObjectLegalHold"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.PutObjectLegalHoldOutput{}, nil
+		},
+		PutObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			calls["PutObject"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.PutObjectOutput{}, nil
+		},
+		GetObjectTaggingFunc: func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+			calls["GetObjectTagging"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.GetObjectTaggingOutput{}, nil
+		},
+		PutObjectTaggingFunc: func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+			calls["PutObjectTagging"] = bucketParams{params.RequestPayer, aws.ToString(params.ExpectedBucketOwner)}
+			return &s3.PutObjectTaggingOutput{}, nil
+		},
+	}
+}
+
+// callEveryOperation makes one call of each S3API operation on client
+func callEveryOperation(t *testing.T, client S3API) {
+	t.Helper()
+	ctx := context.Background()
+	bucket, key := aws.String("my-backups"), aws.String("prod/host1/data/ks/t/a.db")
+	var errs []error
+	_, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket})
+	errs = append(errs, err)
+	_, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: key})
+	errs = append(errs, err)
+	_, err = client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: bucket, Key: key})
+	errs = append(errs, err)
+	_, err = client.GetObjectRetention(ctx, &s3.GetObjectRetentionInput{Bucket: bucket, Key: key})
+	errs = append(errs, err)
+	_, err = client.PutObjectRetention(ctx, &s3.PutObjectRetentionInput{Bucket: bucket, Key: key})
+	errs = append(errs, err)
+	_, err = client.GetObjectLegalHold(ctx, &s3.GetObjectLegalHoldInput{Bucket: bucket, Key: key})
+	errs = append(errs, err)
+	_, err = client.PutObjectLegalHold(ctx, &s3.PutObjectLegalHoldInput{Bucket: bucket, Key: key})
+	errs = append(errs, err)
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{Bucket: bucket, Key: key})
+	errs = append(errs, err)
+	_, err = client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: bucket, Key: key})
+	errs = append(errs, err)
+	_, err = client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{Bucket: bucket, Key: key})
+	errs = append(errs, err)
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBucketClientParams(t *testing.T) {
+	operations := []string{"ListObjectsV2", "GetObject", "HeadObject", "GetObjectRetention", "PutObjectRetention", "GetObjectLegalHold", "PutObjectLegalHold", "PutObject", "GetObjectTagging", "PutObjectTagging"}
+	tests := []struct {
+		name string
+		opts commonOptions
+		want bucketParams
+	}{
+		{name: "defaults", opts: commonOptions{bucket: "my-backups"}},
+		{name: "requester pays", opts: commonOptions{bucket: "my-backups", requesterPays: true}, want: bucketParams{payer: types.RequestPayerRequester}},
+		{name: "expected owner", opts: commonOptions{bucket: "my-backups", expectedOwner: "123456789012"}, want: bucketParams{owner: "123456789012"}},
+		{name: "expected owner of another bucket", opts: commonOptions{bucket: "other-backups", expectedOwner: "123456789012"}},
+		{
+			name: "both",
+			opts: commonOptions{bucket: "my-backups", requesterPays: true, expectedOwner: "123456789012"},
+			want: bucketParams{payer: types.RequestPayerRequester, owner: "123456789012"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := map[string]bucketParams{}
+			callEveryOperation(t, wrapBucketClient(recordParams(calls), tt.opts))
+			for _, op := range operations {
+				if got, ok := calls[op]; !ok || got != tt.want {
+					t.Errorf("%s params = %+v, want %+v", op, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketClientRequesterPaysHint(t *testing.T) {
+	denied := &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+	tests := []struct {
+		name          string
+		err           error
+		requesterPays bool
+		wantHint      bool
+	}{
+		{name: "access denied", err: denied, wantHint: true},
+		{name: "access denied with -requester-pays", err: denied, requesterPays: true},
+		{name: "other error", err: &smithy.GenericAPIError{Code: "NoSuchBucket", Message: "The specified bucket does not exist"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &MockS3Client{
+				ListObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return nil, tt.err
+				},
+			}
+			opts := testOptions()
+			opts.requesterPays = tt.requesterPays
+			err := run(context.Background(), wrapBucketClient(client, opts.commonOptions), opts)
+			if err == nil {
+				t.Fatal("run() succeeded, want the listing error")
+			}
+			if got := strings.Contains(err.Error(), "retry with -requester-pays"); got != tt.wantHint {
+				t.Errorf("run() error = %q, want the -requester-pays hint: %v", err, tt.wantHint)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("run() error = %v, want it to wrap %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestWarnMissingBucketOwner(t *testing.T) {
+	tests := []struct {
+		name     string
+		owner    string
+		dryRun   bool
+		wantWarn bool
+	}{
+		{name: "missing", wantWarn: true},
+		{name: "missing on a dry run", dryRun: true},
+		{name: "set", owner: "123456789012"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.expectedOwner, opts.dryRun = tt.owner, tt.dryRun
+			logged := captureLog("text", slog.LevelInfo, func() { warnMissingBucketOwner(opts) })
+			if got := strings.Contains(logged, "without -expected-bucket-owner"); got != tt.wantWarn {
+				t.Errorf("warnMissingBucketOwner() logged %q, want a warning: %v", logged, tt.wantWarn)
+			}
+		})
+	}
+}
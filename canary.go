@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+)
+
+// Outcomes of the -canary phase, in the run summary
+const (
+	canaryRunning   = "running"   // the canary manifest is being processed
+	canaryComplete  = "complete"  // the run stopped after the canary manifest, or it was the only one
+	canaryContinued = "continued" // the rest of the manifests were processed once confirmed
+	canaryDeclined  = "declined"  // the rest of the manifests weren't confirmed
+)
+
+// canaryStats counts the outcomes of the -canary manifest's objects
+type canaryStats struct {
+	manifest string
+	status   string
+	actions  map[objectAction]int
+	counting bool // whether the canary manifest is being processed
+}
+
+// canarySummary is the -canary phase in the run summary: the outcomes of the
+// canary manifest's objects, which the run's counters include
+type canarySummary struct {
+	Manifest            string `json:"manifest"`
+	Status              string `json:"status"`
+	AlreadyCompliant    int    `json:"already_compliant"`
+	Updated             int    `json:"updated"`
+	WouldUpdate         int    `json:"would_update"`
+	Reduced             int    `json:"reduced"`
+	WouldReduce         int    `json:"would_reduce"`
+	Missing             int    `json:"missing"`
+	Errors              int    `json:"errors"`
+	SkippedStorageClass int    `json:"skipped_storage_class"`
+	SkippedMismatched   int    `json:"skipped_mismatched"`
+	Planned             int    `json:"planned"`
+}
+
+// summary returns the counters of the canary phase, nil without -canary
+func (c *canaryStats) summary() *canarySummary {
+	if c == nil {
+		return nil
+	}
+	return &canarySummary{
+		Manifest:            c.manifest,
+		Status:              c.status,
+		AlreadyCompliant:    c.actions[actionSkipped],
+		Updated:             c.actions[actionUpdated],
+		WouldUpdate:         c.actions[actionWouldUpdate],
+		Reduced:             c.actions[actionReduced],
+		WouldReduce:         c.actions[actionWouldReduce],
+		Missing:             c.actions[actionMissing],
+		Errors:              c.actions[actionError],
+		SkippedStorageClass: c.actions[actionSkippedStorageClass],
+		SkippedMismatched:   c.actions[actionSkippedMismatched],
+		Planned:             c.actions[actionPlanned],
+	}
+}
+
+// attrs returns the counters of the canary phase as log attributes
+func (c *canarySummary) attrs() []any {
+	return []any{
+		"manifest", c.Manifest,
+		"status", c.Status,
+		"already_compliant", c.AlreadyCompliant,
+		"updated", c.Updated,
+		"would_update", c.WouldUpdate,
+		"reduced", c.Reduced,
+		"would_reduce", c.WouldReduce,
+		"missing", c.Missing,
+		"errors", c.Errors,
+		"skipped_storage_class", c.SkippedStorageClass,
+		"skipped_mismatched", c.SkippedMismatched,
+		"planned", c.Planned,
+	}
+}
+
+// canaryGroup returns the canary phase as a log group, empty without -canary
+func canaryGroup(name string, c *canarySummary) slog.Attr {
+	if c == nil {
+		return slog.Group(name)
+	}
+	return slog.Group(name, c.attrs()...)
+}
+
+// canaryOutcome is the outcome of an object of the -canary manifest
+type canaryOutcome struct {
+	key string
+	res objectResult
+}
+
+// canaryPhase tracks the -canary manifest, processed before the others
+type canaryPhase struct {
+	manifest string
+	outcomes []canaryOutcome
+	done     bool // whether the canary manifest was processed
+}
+
+// canaryFirst moves the -canary manifest to the front of manifests: the one
+// -manifest-key names, or the newest. It is an error for the named one not to
+// be among them.
+func (r *refresher) canaryFirst(manifests []ManifestInfo) ([]ManifestInfo, error) {
+	if len(manifests) == 0 {
+		return manifests, nil
+	}
+	i := 0
+	if r.opts.canaryKey != "" {
+		i = -1
+		for j, m := range manifests {
+			if m.Key == r.opts.canaryKey {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("-manifest-key %s isn't among the manifests to process: it doesn't exist, was filtered out or is already retained long enough", r.opts.canaryKey)
+		}
+	}
+	canary := manifests[i]
+	ordered := append([]ManifestInfo{canary}, manifests[:i]...)
+	ordered = append(ordered, manifests[i+1:]...)
+
+	r.canary = &canaryPhase{manifest: canary.Key}
+	r.stats.startCanary(canary.Key)
+	slog.Info("Processing a canary manifest first", "manifest", canary.Key, "manifests_left", len(ordered)-1)
+	return ordered, nil
+}
+
+// record keeps the outcome of key while the canary manifest is processed
+func (c *canaryPhase) record(key string, res objectResult) {
+	if c == nil || c.done {
+		return
+	}
+	c.outcomes = append(c.outcomes, canaryOutcome{key: key, res: res})
+}
+
+// endCanary prints the outcomes of the canary manifest's objects and its
+// summary, then decides whether to process the remaining manifests: not with
+// -canary-only, and otherwise once confirmed. Without a terminal to ask on,
+// only -yes continues.
+func (r *refresher) endCanary(remaining int) (proceed bool, err error) {
+	r.canary.done = true
+	writeCanaryOutcomes(r.prompt.out, r.canary.outcomes)
+	sum := r.stats.summary(time.Now()).Canary
+	slog.Info("Canary summary", append(sum.attrs(), "manifests_left", remaining)...)
+
+	if r.opts.canaryOnly || remaining == 0 {
+		r.stats.endCanary(canaryComplete)
+		slog.Info("Canary complete", "manifest", r.canary.manifest, "manifests_left", remaining)
+		return false, nil
+	}
+	if !r.opts.yes {
+		if !r.prompt.tty {
+			r.stats.endCanary(canaryDeclined)
+			return false, errors.New("aborted: the canary manifest was processed and stdin is not a terminal, pass -canary-only to stop after it or -yes to continue")
+		}
+		message := fmt.Sprintf("Processed canary manifest %s. About to process the %d remaining manifests in s3://%s/%s%s/.",
+			r.canary.manifest, remaining, r.opts.bucket, r.opts.prefix, r.opts.cluster)
+		ok, err := confirm(r.prompt.in, r.prompt.out, message)
+		if err != nil {
+			r.stats.endCanary(canaryDeclined)
+			return false, fmt.Errorf("failed to read confirmation: %w", err)
+		}
+		if !ok {
+			r.stats.endCanary(canaryDeclined)
+			return false, errors.New("aborted: the remaining manifests were not confirmed after the canary")
+		}
+	}
+	r.stats.endCanary(canaryContinued)
+	slog.Info("Continuing after the canary manifest", "manifests_left", remaining)
+	return true, nil
+}
+
+// writeCanaryOutcomes writes the outcome of each object of the canary manifest
+// as an aligned table
+func writeCanaryOutcomes(w io.Writer, outcomes []canaryOutcome) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tACTION\tPREVIOUS RETAIN UNTIL\tRETAIN UNTIL\tMODE\tERROR")
+	for _, o := range outcomes {
+		previous, retainUntil, mode, errText := "-", "-", "-", "-"
+		if o.res.previous != nil && o.res.previous.RetainUntil != nil {
+			previous = o.res.previous.RetainUntil.UTC().Format(time.RFC3339)
+		}
+		if !o.res.retainUntil.IsZero() {
+			retainUntil = o.res.retainUntil.UTC().Format(time.RFC3339)
+		}
+		if o.res.mode != "" {
+			mode = string(o.res.mode)
+		}
+		if o.res.err != nil {
+			errText = errorCode(o.res.err)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", o.key, o.res.action, previous, retainUntil, mode, errText)
+	}
+	tw.Flush()
+}
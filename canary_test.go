@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCanaryBucket returns a bucket with an older backup of a.db and a newer
+// one of b.db
+func newCanaryBucket() *fakeBucket {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/b2/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/b.db"}]}]`
+	bucket.modified["links/host1/b1/meta/manifest.json"] = time.Now().AddDate(0, 0, -2)
+	bucket.modified["links/host1/b2/meta/manifest.json"] = time.Now().AddDate(0, 0, -1)
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	return bucket
+}
+
+func TestRunCanary(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        func(opts *options)
+		input       string
+		tty         bool
+		wantErr     string
+		wantUpdated []string
+		wantStatus  string
+	}{
+		{
+			name:        "canary only",
+			opts:        func(opts *options) { opts.canaryOnly = true },
+			wantUpdated: []string{"links/host1/data/ks/t/b.db"},
+			wantStatus:  canaryComplete,
+		},
+		{
+			name:        "confirmed",
+			input:       "yes\n",
+			tty:         true,
+			wantUpdated: []string{"links/host1/data/ks/t/b.db", "links/host1/data/ks/t/a.db"},
+			wantStatus:  canaryContinued,
+		},
+		{
+			name:        "declined",
+			input:       "no\n",
+			tty:         true,
+			wantErr:     "not confirmed",
+			wantUpdated: []string{"links/host1/data/ks/t/b.db"},
+			wantStatus:  canaryDeclined,
+		},
+		{
+			name:        "not a terminal",
+			wantErr:     "pass -canary-only",
+			wantUpdated: []string{"links/host1/data/ks/t/b.db"},
+			wantStatus:  canaryDeclined,
+		},
+		{
+			name:        "yes",
+			opts:        func(opts *options) { opts.yes = true },
+			wantUpdated: []string{"links/host1/data/ks/t/b.db", "links/host1/data/ks/t/a.db"},
+			wantStatus:  canaryContinued,
+		},
+		{
+			name:        "manifest key",
+			opts:        func(opts *options) { opts.canaryKey, opts.canaryOnly = "links/host1/b1/meta/manifest.json", true },
+			wantUpdated: []string{"links/host1/data/ks/t/a.db"},
+			wantStatus:  canaryComplete,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newCanaryBucket()
+			opts := testOptions()
+			opts.canary = true
+			if tt.opts != nil {
+				tt.opts(opts)
+			}
+			var out strings.Builder
+			r := newRefresher(bucket.client(), opts, time.Now())
+			r.prompt = prompt{in: strings.NewReader(tt.input), out: &out, tty: tt.tty}
+			err := r.run(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("run() error = %v, want %q", err, tt.wantErr)
+			}
+
+			if got := bucket.putKeys(); !reflect.DeepEqual(got, tt.wantUpdated) {
+				t.Errorf("updated %v, want %v", got, tt.wantUpdated)
+			}
+			if !strings.Contains(out.String(), tt.wantUpdated[0]+"  updated") {
+				t.Errorf("printed outcomes:\n%s\nwant %s updated", out.String(), tt.wantUpdated[0])
+			}
+			sum := r.stats.summary(time.Now())
+			if sum.Canary == nil {
+				t.Fatal("summary has no canary phase")
+			}
+			if sum.Canary.Status != tt.wantStatus || sum.Canary.Updated != 1 {
+				t.Errorf("canary status = %s with %d updated, want %s with 1", sum.Canary.Status, sum.Canary.Updated, tt.wantStatus)
+			}
+			if sum.Updated != len(tt.wantUpdated) {
+				t.Errorf("updated = %d, want %d", sum.Updated, len(tt.wantUpdated))
+			}
+		})
+	}
+}
+
+func TestRunCanarySingleManifest(t *testing.T) {
+	bucket := newCanaryBucket()
+	delete(bucket.objects, "links/host1/b1/meta/manifest.json")
+	opts := testOptions()
+	opts.canary = true
+	r := newRefresher(bucket.client(), opts, time.Now())
+	// Nothing is left to confirm
+	r.prompt = prompt{in: strings.NewReader(""), out: &strings.Builder{}}
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if got := r.stats.summary(time.Now()).Canary; got == nil || got.Status != canaryComplete {
+		t.Errorf("canary = %+v, want complete", got)
+	}
+}
+
+func TestRunCanaryUnknownManifestKey(t *testing.T) {
+	opts := testOptions()
+	opts.canary, opts.canaryKey = true, "links/host2/b1/meta/manifest.json"
+	bucket := newCanaryBucket()
+	err := newRefresher(bucket.client(), opts, time.Now()).run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "isn't among the manifests to process") {
+		t.Fatalf("run() error = %v, want the canary manifest not found", err)
+	}
+	if len(bucket.puts) != 0 {
+		t.Errorf("updated %v, want nothing", bucket.putKeys())
+	}
+}
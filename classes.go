@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// retentionClass is the retention of the backups whose name matches pattern,
+// set by the retention_classes of a policy. A zero period keeps the cluster's.
+type retentionClass struct {
+	pattern      string
+	minRetention retentionPeriod
+	maxRetention retentionPeriod
+}
+
+// parseRetentionClass parses and checks a retention_classes entry
+func parseRetentionClass(rc retentionClassPolicy) (retentionClass, error) {
+	if rc.Backups == "" {
+		return retentionClass{}, errors.New("retention class without backups")
+	}
+	if err := validateGlob(rc.Backups); err != nil {
+		return retentionClass{}, fmt.Errorf("invalid retention class: %w", err)
+	}
+	class := retentionClass{pattern: rc.Backups}
+	var err error
+	if rc.MinRetention != "" {
+		if class.minRetention, err = parseRetentionPeriod(rc.MinRetention); err != nil {
+			return retentionClass{}, fmt.Errorf("invalid min_retention of retention class %q: %w", rc.Backups, err)
+		}
+	}
+	if rc.MaxRetention != "" {
+		if class.maxRetention, err = parseRetentionPeriod(rc.MaxRetention); err != nil {
+			return retentionClass{}, fmt.Errorf("invalid max_retention of retention class %q: %w", rc.Backups, err)
+		}
+	}
+	if class.minRetention.isZero() && class.maxRetention.isZero() {
+		return retentionClass{}, fmt.Errorf("retention class %q sets no min_retention or max_retention", rc.Backups)
+	}
+	return class, nil
+}
+
+// periods returns the class's retention periods, taking the unset ones from
+// minRetention and maxRetention
+func (c retentionClass) periods(minRetention, maxRetention retentionPeriod) (retentionPeriod, retentionPeriod) {
+	if !c.minRetention.isZero() {
+		minRetention = c.minRetention
+	}
+	if !c.maxRetention.isZero() {
+		maxRetention = c.maxRetention
+	}
+	return minRetention, maxRetention
+}
+
+// backupRetention returns the retention periods of the backup m: those of the
+// first retention class matching its name, or -min-retention and
+// -max-retention. classed is false when no class matches.
+func (opts *options) backupRetention(m ManifestInfo) (minRetention, maxRetention retentionPeriod, classed bool) {
+	if len(opts.retentionClasses) == 0 {
+		return opts.minRetention, opts.maxRetention, false
+	}
+	mp, err := m.path()
+	if err != nil {
+		return opts.minRetention, opts.maxRetention, false
+	}
+	for _, class := range opts.retentionClasses {
+		// path.Match cannot fail since the patterns were validated
+		if ok, _ := path.Match(class.pattern, mp.Backup); ok {
+			minRetention, maxRetention = class.periods(opts.minRetention, opts.maxRetention)
+			return minRetention, maxRetention, true
+		}
+	}
+	return opts.minRetention, opts.maxRetention, false
+}
+
+// validateRetentionClasses checks that every class keeps its min_retention
+// within its max_retention once the cluster's periods fill in the other
+func (opts *options) validateRetentionClasses() error {
+	if len(opts.retentionClasses) == 0 {
+		return nil
+	}
+	if !opts.retainUntil.IsZero() {
+		return errors.New("retention_classes can't be used with -retain-until, which is already an absolute date")
+	}
+	if opts.keysFile != "" {
+		return errors.New("retention_classes can't be used with -keys-file, which reads no backups")
+	}
+	now := time.Now()
+	for _, class := range opts.retentionClasses {
+		minRetention, maxRetention := class.periods(opts.minRetention, opts.maxRetention)
+		if minRetention.from(now).After(maxRetention.from(now)) {
+			return fmt.Errorf("retention class %q: min-retention must be less than or equal to max-retention", class.pattern)
+		}
+	}
+	return nil
+}
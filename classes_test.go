@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionClass(t *testing.T) {
+	tests := []struct {
+		name    string
+		rc      retentionClassPolicy
+		want    retentionClass
+		wantErr string
+	}{
+		{
+			name: "max retention only",
+			rc:   retentionClassPolicy{Backups: "medusa-backup-weekly-*", MaxRetention: "1y"},
+			want: retentionClass{pattern: "medusa-backup-weekly-*", maxRetention: retentionPeriod{years: 1}},
+		},
+		{
+			name: "both periods",
+			rc:   retentionClassPolicy{Backups: "adhoc-*", MinRetention: "30d", MaxRetention: "90d"},
+			want: retentionClass{pattern: "adhoc-*", minRetention: retentionPeriod{days: 30}, maxRetention: retentionPeriod{days: 90}},
+		},
+		{
+			name:    "no backups",
+			rc:      retentionClassPolicy{MaxRetention: "1y"},
+			wantErr: "without backups",
+		},
+		{
+			name:    "invalid glob",
+			rc:      retentionClassPolicy{Backups: "weekly-[", MaxRetention: "1y"},
+			wantErr: "invalid pattern",
+		},
+		{
+			name:    "invalid period",
+			rc:      retentionClassPolicy{Backups: "weekly-*", MaxRetention: "1Y"},
+			wantErr: "max_retention",
+		},
+		{
+			name:    "no periods",
+			rc:      retentionClassPolicy{Backups: "weekly-*"},
+			wantErr: "sets no min_retention or max_retention",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRetentionClass(tt.rc)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseRetentionClass() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRetentionClass() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseRetentionClass() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupRetention(t *testing.T) {
+	opts := testOptions()
+	opts.retentionClasses = []retentionClass{
+		{pattern: "weekly-*", maxRetention: retentionPeriod{days: 90}},
+		{pattern: "weekly-*", maxRetention: retentionPeriod{years: 1}},
+		{pattern: "monthly-*", minRetention: retentionPeriod{days: 60}, maxRetention: retentionPeriod{years: 1}},
+	}
+
+	tests := []struct {
+		backup      string
+		wantMin     retentionPeriod
+		wantMax     retentionPeriod
+		wantClassed bool
+	}{
+		// The first matching class wins, and the flags fill in its unset period
+		{backup: "weekly-1", wantMin: retentionPeriod{days: 7}, wantMax: retentionPeriod{days: 90}, wantClassed: true},
+		{backup: "monthly-1", wantMin: retentionPeriod{days: 60}, wantMax: retentionPeriod{years: 1}, wantClassed: true},
+		{backup: "daily-1", wantMin: retentionPeriod{days: 7}, wantMax: retentionPeriod{days: 30}},
+	}
+
+	for _, tt := range tests {
+		m := ManifestInfo{Key: "links/host1/" + tt.backup + "/meta/manifest.json"}
+		gotMin, gotMax, classed := opts.backupRetention(m)
+		if gotMin != tt.wantMin || gotMax != tt.wantMax || classed != tt.wantClassed {
+			t.Errorf("backupRetention(%s) = %v, %v, %v, want %v, %v, %v",
+				tt.backup, gotMin, gotMax, classed, tt.wantMin, tt.wantMax, tt.wantClassed)
+		}
+	}
+}
+
+func TestValidateRetentionClasses(t *testing.T) {
+	weekly := []retentionClass{{pattern: "weekly-*", maxRetention: retentionPeriod{years: 1}}}
+
+	tests := []struct {
+		name    string
+		setup   func(opts *options)
+		wantErr string
+	}{
+		{name: "valid", setup: func(opts *options) { opts.retentionClasses = weekly }},
+		{
+			name: "min above the cluster's max",
+			setup: func(opts *options) {
+				opts.retentionClasses = []retentionClass{{pattern: "adhoc-*", minRetention: retentionPeriod{days: 60}}}
+			},
+			wantErr: `retention class "adhoc-*"`,
+		},
+		{
+			name: "retain-until",
+			setup: func(opts *options) {
+				opts.retentionClasses = weekly
+				opts.retainUntil = time.Now().AddDate(1, 0, 0)
+			},
+			wantErr: "-retain-until",
+		},
+		{
+			name: "keys file",
+			setup: func(opts *options) {
+				opts.retentionClasses = weekly
+				opts.keysFile = "keys.txt"
+			},
+			wantErr: "-keys-file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			tt.setup(opts)
+			err := opts.validateRetentionClasses()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateRetentionClasses() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateRetentionClasses() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunRetentionClasses(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	bucket := newFakeBucket()
+	// The daily and weekly backups share shared.db
+	bucket.objects["links/host1/medusa-backup-daily-1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/daily.db"}]}]`
+	bucket.objects["links/host1/medusa-backup-weekly-1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/weekly.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/shared.db"] = ""
+	bucket.objects["links/host1/data/ks/t/daily.db"] = ""
+	bucket.objects["links/host1/data/ks/t/weekly.db"] = ""
+
+	opts := testOptions()
+	opts.retentionClasses = []retentionClass{{pattern: "medusa-backup-weekly-*", maxRetention: retentionPeriod{years: 1}}}
+	r := newRefresher(bucket.client(), opts, now)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	want := map[string]time.Time{
+		// The weekly backup's longer retention wins over the daily's
+		"links/host1/data/ks/t/shared.db": now.AddDate(1, 0, 0),
+		"links/host1/data/ks/t/weekly.db": now.AddDate(1, 0, 0),
+		// The unmatched daily backup keeps -max-retention
+		"links/host1/data/ks/t/daily.db": now.AddDate(0, 0, 30),
+	}
+	for key, until := range want {
+		if got := bucket.retention[key]; !got.Equal(until) {
+			t.Errorf("%s retained until %v, want %v", key, got, until)
+		}
+	}
+}
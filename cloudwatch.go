@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// CloudWatchAPI defines the CloudWatch operations used by this tool
+type CloudWatchAPI interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// Metrics published to -cloudwatch-namespace, with Cluster and Bucket
+// dimensions. Their names are relied on by alarms and must not change.
+const (
+	cloudWatchObjectsUpdated     = "ObjectsUpdated"     // objects whose retention or legal hold was changed
+	cloudWatchObjectsFailed      = "ObjectsFailed"      // objects that couldn't be checked or changed
+	cloudWatchObjectsMissing     = "ObjectsMissing"     // objects referenced by a manifest but missing from the bucket
+	cloudWatchManifestsProcessed = "ManifestsProcessed" // manifests whose objects were processed
+	cloudWatchRunDuration        = "RunDurationSeconds" // time since the run started
+)
+
+// cloudWatchMetric is a metric value published to CloudWatch
+type cloudWatchMetric struct {
+	name  string
+	value float64
+	unit  types.StandardUnit
+}
+
+// runCloudWatchMetrics returns the metrics of the run described by sum,
+// which has been running for elapsed
+func runCloudWatchMetrics(sum runSummary, elapsed time.Duration) []cloudWatchMetric {
+	return []cloudWatchMetric{
+		{cloudWatchObjectsUpdated, float64(sum.Updated + sum.Reduced), types.StandardUnitCount},
+		{cloudWatchObjectsFailed, float64(sum.Errors), types.StandardUnitCount},
+		{cloudWatchObjectsMissing, float64(sum.Missing), types.StandardUnitCount},
+		{cloudWatchManifestsProcessed, float64(sum.ManifestsProcessed), types.StandardUnitCount},
+		{cloudWatchRunDuration, elapsed.Seconds(), types.StandardUnitSeconds},
+	}
+}
+
+// cloudWatchDatums returns the metrics of the run described by sum, as of now
+func cloudWatchDatums(sum runSummary, bucket, cluster string, elapsed time.Duration, now time.Time) []types.MetricDatum {
+	dimensions := []types.Dimension{
+		{Name: aws.String("Cluster"), Value: aws.String(cluster)},
+		{Name: aws.String("Bucket"), Value: aws.String(bucket)},
+	}
+	var data []types.MetricDatum
+	for _, m := range runCloudWatchMetrics(sum, elapsed) {
+		data = append(data, types.MetricDatum{
+			MetricName: aws.String(m.name),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(now),
+			Value:      aws.Float64(m.value),
+			Unit:       m.unit,
+		})
+	}
+	return data
+}
+
+// publishCloudWatch publishes the run's metrics as of now to -cloudwatch-namespace
+func (r *refresher) publishCloudWatch(ctx context.Context) error {
+	now := time.Now()
+	_, err := r.cloudwatch.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(r.opts.cwNamespace),
+		MetricData: cloudWatchDatums(r.stats.summary(now), r.opts.bucket, r.opts.cluster, now.Sub(r.stats.start), now),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish CloudWatch metrics: %w", err)
+	}
+	return nil
+}
+
+// startCloudWatch publishes the run's metrics every -cloudwatch-interval
+// until the returned function is called. Failures are logged, the final
+// publication reports them.
+func (r *refresher) startCloudWatch(ctx context.Context) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(r.opts.cwInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.publishCloudWatch(ctx); err != nil {
+					slog.Warn("Failed to publish periodic CloudWatch metrics", errorAttrs(err)...)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// mockCloudWatch records the metrics published to it
+type mockCloudWatch struct {
+	mu     sync.Mutex
+	inputs []*cloudwatch.PutMetricDataInput
+	err    error
+}
+
+func (m *mockCloudWatch) PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inputs = append(m.inputs, params)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func (m *mockCloudWatch) published() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.inputs)
+}
+
+// datumValues returns the published values by metric name, failing unless
+// every datum has the Cluster and Bucket dimensions
+func datumValues(t *testing.T, data []types.MetricDatum) map[string]float64 {
+	t.Helper()
+	values := make(map[string]float64, len(data))
+	for _, d := range data {
+		dims := make(map[string]string)
+		for _, dim := range d.Dimensions {
+			dims[aws.ToString(dim.Name)] = aws.ToString(dim.Value)
+		}
+		if len(dims) != 2 || dims["Cluster"] != "links" || dims["Bucket"] != "test-bucket" {
+			t.Errorf("%s dimensions = %v, want Cluster=links and Bucket=test-bucket", aws.ToString(d.MetricName), dims)
+		}
+		values[aws.ToString(d.MetricName)] = aws.ToFloat64(d.Value)
+	}
+	return values
+}
+
+func TestRunPublishesCloudWatchMetrics(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/backup-1748649600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"},{"path":"data/ks/t/gone.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+
+	opts := testOptions()
+	opts.cwNamespace = "Medusa/Retention"
+	cw := &mockCloudWatch{}
+	r := newRefresher(bucket.client(), opts, time.Now())
+	r.cloudwatch = cw
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if len(cw.inputs) != 1 {
+		t.Fatalf("published %d times, want once at the end of the run", len(cw.inputs))
+	}
+	in := cw.inputs[0]
+	if ns := aws.ToString(in.Namespace); ns != "Medusa/Retention" {
+		t.Errorf("namespace = %q, want Medusa/Retention", ns)
+	}
+	values := datumValues(t, in.MetricData)
+	want := map[string]float64{
+		cloudWatchObjectsUpdated:     2,
+		cloudWatchObjectsFailed:      0,
+		cloudWatchObjectsMissing:     1,
+		cloudWatchManifestsProcessed: 1,
+	}
+	for name, value := range want {
+		if got, ok := values[name]; !ok || got != value {
+			t.Errorf("%s = %v (published %v), want %v", name, got, ok, value)
+		}
+	}
+	if _, ok := values[cloudWatchRunDuration]; !ok || len(values) != 5 {
+		t.Errorf("published %v, want the 5 run metrics", values)
+	}
+	for _, d := range in.MetricData {
+		wantUnit := types.StandardUnitCount
+		if aws.ToString(d.MetricName) == cloudWatchRunDuration {
+			wantUnit = types.StandardUnitSeconds
+		}
+		if d.Unit != wantUnit || d.Timestamp == nil {
+			t.Errorf("%s unit %s, timestamp %v, want %s and a timestamp", aws.ToString(d.MetricName), d.Unit, d.Timestamp, wantUnit)
+		}
+	}
+}
+
+func TestRunCloudWatchFailure(t *testing.T) {
+	opts := testOptions()
+	opts.cwNamespace = "Medusa/Retention"
+	r := newRefresher(newFakeBucket().client(), opts, time.Now())
+	r.cloudwatch = &mockCloudWatch{err: errors.New("AccessDenied")}
+	if err := r.run(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to publish CloudWatch metrics") {
+		t.Errorf("run() error = %v, want the publication failure", err)
+	}
+}
+
+func TestStartCloudWatch(t *testing.T) {
+	opts := testOptions()
+	opts.cwNamespace = "Medusa/Retention"
+	opts.cwInterval = time.Millisecond
+	cw := &mockCloudWatch{}
+	r := newRefresher(newFakeBucket().client(), opts, time.Now())
+	r.cloudwatch = cw
+	stop := r.startCloudWatch(context.Background())
+	deadline := time.Now().Add(5 * time.Second)
+	for cw.published() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stop()
+	n := cw.published()
+	if n < 2 {
+		t.Fatalf("published %d times, want periodic publications", n)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if cw.published() != n {
+		t.Error("published after being stopped")
+	}
+	values := datumValues(t, cw.inputs[0].MetricData)
+	if values[cloudWatchObjectsUpdated] != 0 {
+		t.Errorf("periodic %s = %v, want 0", cloudWatchObjectsUpdated, values[cloudWatchObjectsUpdated])
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// ANSI escape sequences used to color log lines
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+)
+
+// actionColor returns the color of log lines about objects with action, or "" to leave them plain
+func actionColor(action objectAction) string {
+	switch action {
+	case actionUpdated, actionWouldUpdate:
+		return colorGreen
+	case actionReduced, actionWouldReduce:
+		return colorYellow
+	case actionMissing, actionError:
+		return colorRed
+	}
+	return ""
+}
+
+// useColor reports whether stderr logs are colored: only text logs on a
+// terminal, unless disabled with -no-color or the NO_COLOR environment variable
+func useColor(c commonOptions, stderrTTY bool, noColorEnv string) bool {
+	return stderrTTY && !c.noColor && noColorEnv == "" && c.logFormat == "text"
+}
+
+// colorHandler writes text records, coloring each line by the action attribute
+// of the object it is about
+type colorHandler struct {
+	text  slog.Handler // formats into out.buf
+	out   *colorOutput
+	color string // set when the action was added with WithAttrs
+}
+
+// colorOutput is shared by a colorHandler and the handlers derived from it
+type colorOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	w   io.Writer
+}
+
+func newColorHandler(w io.Writer, level slog.Level) *colorHandler {
+	out := &colorOutput{w: w}
+	return &colorHandler{text: slog.NewTextHandler(&out.buf, &slog.HandlerOptions{Level: level}), out: out}
+}
+
+func (h *colorHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *colorHandler) Handle(ctx context.Context, rec slog.Record) error {
+	color := h.color
+	rec.Attrs(func(a slog.Attr) bool {
+		if a.Key == "action" {
+			color = actionColor(objectAction(a.Value.String()))
+			return false
+		}
+		return true
+	})
+
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.buf.Reset()
+	if err := h.text.Handle(ctx, rec); err != nil {
+		return err
+	}
+	line := h.out.buf.Bytes()
+	if color != "" {
+		line = append(append([]byte(color), bytes.TrimSuffix(line, []byte("\n"))...), colorReset+"\n"...)
+	}
+	_, err := h.out.w.Write(line)
+	return err
+}
+
+func (h *colorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	color := h.color
+	for _, a := range attrs {
+		if a.Key == "action" {
+			color = actionColor(objectAction(a.Value.String()))
+		}
+	}
+	return &colorHandler{text: h.text.WithAttrs(attrs), out: h.out, color: color}
+}
+
+func (h *colorHandler) WithGroup(name string) slog.Handler {
+	return &colorHandler{text: h.text.WithGroup(name), out: h.out, color: h.color}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUseColor(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       commonOptions
+		tty     bool
+		noColor string
+		want    bool
+	}{
+		{name: "text on a terminal", c: commonOptions{logFormat: "text"}, tty: true, want: true},
+		{name: "not a terminal", c: commonOptions{logFormat: "text"}},
+		{name: "-no-color", c: commonOptions{logFormat: "text", noColor: true}, tty: true},
+		{name: "NO_COLOR", c: commonOptions{logFormat: "text"}, tty: true, noColor: "1"},
+		{name: "json logs", c: commonOptions{logFormat: "json"}, tty: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := useColor(tt.c, tt.tty, tt.noColor); got != tt.want {
+				t.Errorf("useColor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestColorHandler(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(newColorHandler(&out, slog.LevelInfo))
+
+	logger.Info("[DRY-RUN] Would update retention", "key", "a.db", "action", actionWouldUpdate)
+	logger.Info("[DRY-RUN] Would REDUCE retention", "key", "b.db", "action", actionWouldReduce)
+	logger.Warn("Object not found", "key", "c.db", "action", actionMissing)
+	logger.With("action", actionError).Error("Error checking retention", "key", "d.db")
+	logger.Info("Processing manifest", "manifest", "m.json")
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	wantColors := []string{colorGreen, colorYellow, colorRed, colorRed, ""}
+	if len(lines) != len(wantColors) {
+		t.Fatalf("logged %d lines, want %d:\n%s", len(lines), len(wantColors), out.String())
+	}
+	for i, line := range lines {
+		if wantColors[i] == "" {
+			if strings.Contains(line, "\033[") {
+				t.Errorf("line %q has ANSI codes, want plain", line)
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, wantColors[i]) || !strings.HasSuffix(line, colorReset) {
+			t.Errorf("line %q isn't wrapped in color %q", line, wantColors[i])
+		}
+	}
+}
+
+func TestColorNeverInFiles(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.logFormat = "text"
+	opts.logFile = filepath.Join(dir, "run.log")
+	opts.report = filepath.Join(dir, "report.jsonl")
+
+	var stderr, events bytes.Buffer
+	closeLog, err := setupLogging(&stderr, opts.commonOptions, true)
+	if err != nil {
+		t.Fatalf("setupLogging() error = %v", err)
+	}
+	r := newRefresher(deniedBucket(), opts, time.Now())
+	r.events = newEventStream(&events, "run-1")
+	if err := r.withReport(func() error { return r.run(context.Background()) }); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if err := closeLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(stderr.String(), colorRed) {
+		t.Errorf("stderr has no colored error line:\n%s", stderr.String())
+	}
+	for _, path := range []string{opts.logFile, opts.report} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("\033[")) {
+			t.Errorf("%s has ANSI codes:\n%s", filepath.Base(path), data)
+		}
+	}
+	if strings.Contains(events.String(), "\033[") {
+		t.Errorf("NDJSON events have ANSI codes:\n%s", events.String())
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// command is a subcommand of the CLI
+type command struct {
+	name    string
+	summary string
+	parse   func(args []string) (*options, error)
+	run     func(ctx context.Context, opts *options) error
+	changes bool // whether the command changes objects
+}
+
+// commands lists the available subcommands. The first one is the default
+// when the binary is invoked with flags only.
+var commands = []command{
+	{name: "refresh", summary: "Extend Object Lock retention of backup objects", parse: parseRefreshOptions, run: runRefresh, changes: true},
+	{name: "plan", summary: "Write the retention changes refresh would make to a plan file", parse: parsePlanOptions, run: runPlan},
+	{name: "apply", summary: "Apply the retention changes listed in a plan file", parse: parseApplyOptions, run: runApply, changes: true},
+	{name: "report", summary: "List backups past retention that Medusa could purge, and when their locks expire", parse: parseReportOptions, run: runReport},
+	{name: "who-retains", summary: "List the backups referencing object keys and the retention each requires", parse: parseWhoRetainsOptions, run: runWhoRetains},
+	{name: "release", summary: "Shorten the GOVERNANCE retention left on expired backups' objects so they can be deleted", parse: parseReleaseOptions, run: runRelease, changes: true},
+	{name: "restore", summary: "Set back the retention objects had before the changes recorded in a -rollback-file", parse: parseRestoreOptions, run: runRestore, changes: true},
+	{name: "legal-hold", summary: "Set or release Object Lock legal holds on backup objects", parse: parseLegalHoldOptions, run: runLegalHold, changes: true},
+}
+
+const deprecationNotice = "Warning: running without a subcommand is deprecated, use \"medusa-retention-refresher refresh\" instead"
+
+// commandsUsage lists the available subcommands
+func commandsUsage() string {
+	var b strings.Builder
+	b.WriteString("Usage: medusa-retention-refresher <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "  %-12s %s\n", c.name, c.summary)
+	}
+	b.WriteString("\nRun \"medusa-retention-refresher <command> -h\" to list the flags of a command")
+	return b.String()
+}
+
+// route picks the subcommand named by the first argument and returns the
+// arguments left for it. Arguments starting with a flag are routed to the
+// default command for backward compatibility, which is reported as deprecated.
+func route(args []string) (*command, []string, bool, error) {
+	if len(args) == 0 {
+		return nil, nil, false, errors.New(commandsUsage())
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		return nil, nil, false, errors.New(commandsUsage())
+	}
+	if strings.HasPrefix(args[0], "-") {
+		return &commands[0], args, true, nil
+	}
+	for i := range commands {
+		if commands[i].name == args[0] {
+			return &commands[i], args[1:], false, nil
+		}
+	}
+	return nil, nil, false, fmt.Errorf("unknown command %q\n\n%s", args[0], commandsUsage())
+}
+
+// execute routes args to a subcommand, parses its flags and runs it
+func execute(ctx context.Context, args []string) error {
+	cmd, rest, deprecated, err := route(args)
+	if err != nil {
+		return err
+	}
+	opts, err := cmd.parse(rest)
+	if err != nil {
+		return err
+	}
+	termination.setPath(opts.terminationLog)
+	closeLog, err := setupLogging(stderrStatus, opts.commonOptions, useColor(opts.commonOptions, isTerminal(os.Stderr), os.Getenv("NO_COLOR")))
+	if err != nil {
+		return err
+	}
+	if deprecated {
+		slog.Warn(deprecationNotice)
+	}
+	applyProviderCompat(&opts.commonOptions)
+	if cmd.changes {
+		warnMissingBucketOwner(opts)
+	}
+	if opts.proxyURL != "" {
+		slog.Info("Sending AWS requests through -proxy-url", "proxy", redactURL(opts.proxyURL), "no_proxy", opts.noProxy)
+	}
+	shutdownTracing, err := setupTracing(ctx, opts.otelEndpoint)
+	if err != nil {
+		closeLog()
+		return err
+	}
+	if opts.runID == "" && !opts.runsPerPass() {
+		// Settled before the lock is taken, so that the lock and every
+		// output of the run share it
+		opts.runID = newRunID()
+	}
+	stopLoggingRunID := logRunID(opts.runID)
+	err = withRunLock(ctx, opts, func(ctx context.Context) error { return cmd.run(ctx, opts) })
+	stopLoggingRunID()
+	shutdownTracing()
+	if closeErr := closeLog(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// loadAWSConfig loads the AWS configuration using the shared -region,
+// -profile, -ca-bundle, -tls-min-version and -user-agent-extra flags
+func loadAWSConfig(ctx context.Context, c commonOptions) (aws.Config, error) {
+	var optFns []func(*config.LoadOptions) error
+	if c.region != "" {
+		optFns = append(optFns, config.WithRegion(c.region))
+	}
+	if c.profile != "" {
+		optFns = append(optFns, config.WithSharedConfigProfile(c.profile))
+	}
+	optFns = append(optFns, config.WithAPIOptions([]func(*middleware.Stack) error{addUserAgent(c.userAgentExtra)}))
+	httpClient, err := newAWSHTTPClient(c)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if httpClient != nil {
+		optFns = append(optFns, config.WithHTTPClient(httpClient))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	return cfg, nil
+}
+
+// newS3Client creates an S3 client using the shared -region, -profile,
+// -use-fips, -use-dualstack and -provider-compat flags
+func newS3Client(ctx context.Context, c commonOptions) (*s3.Client, error) {
+	cfg, err := loadAWSConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, withEndpointOptions(c), withProviderErrors(c))
+	if err := checkEndpointOptions(client, c); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// newCloudWatchClient creates a CloudWatch client using the shared -region
+// and -profile flags
+func newCloudWatchClient(ctx context.Context, c commonOptions) (*cloudwatch.Client, error) {
+	cfg, err := loadAWSConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return cloudwatch.NewFromConfig(cfg), nil
+}
+
+// newSESClient creates an SES client using the shared -region and -profile
+// flags
+func newSESClient(ctx context.Context, c commonOptions) (*sesv2.Client, error) {
+	cfg, err := loadAWSConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return sesv2.NewFromConfig(cfg), nil
+}
+
+// newSTSClient creates an STS client using the shared -region and -profile
+// flags
+func newSTSClient(ctx context.Context, c commonOptions) (*sts.Client, error) {
+	cfg, err := loadAWSConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return sts.NewFromConfig(cfg), nil
+}
+
+// newDynamoDBClient creates a DynamoDB client using the shared -region and
+// -profile flags
+func newDynamoDBClient(ctx context.Context, c commonOptions) (*dynamodb.Client, error) {
+	cfg, err := loadAWSConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return dynamodb.NewFromConfig(cfg), nil
+}
+
+// newFirehoseClient creates a Firehose client using the shared -region and
+// -profile flags
+func newFirehoseClient(ctx context.Context, c commonOptions) (*firehose.Client, error) {
+	cfg, err := loadAWSConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return firehose.NewFromConfig(cfg), nil
+}
+
+// newSQSClient creates an SQS client using the shared -region and -profile
+// flags
+func newSQSClient(ctx context.Context, c commonOptions) (*sqs.Client, error) {
+	cfg, err := loadAWSConfig(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return sqs.NewFromConfig(cfg), nil
+}
+
+// runRefresh implements the refresh command
+func runRefresh(ctx context.Context, opts *options) error {
+	client, err := newBucketClient(ctx, opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	if opts.policyURI != "" {
+		if err := applyRetentionPolicy(ctx, client, opts); err != nil {
+			return err
+		}
+	}
+
+	if opts.mode == types.ObjectLockRetentionModeCompliance && !opts.dryRun && !opts.yes {
+		if err := confirmCompliance(); err != nil {
+			return err
+		}
+	}
+
+	if opts.sqsQueueURL != "" {
+		queue, err := newSQSClient(ctx, opts.commonOptions)
+		if err != nil {
+			return err
+		}
+		return newSQSConsumer(queue, client, opts).consume(ctx)
+	}
+	if opts.interval > 0 {
+		return newDaemon(client, opts).loop(ctx)
+	}
+	return run(ctx, client, opts)
+}
+
+// confirmCompliance asks for interactive confirmation before setting COMPLIANCE retention
+func confirmCompliance() error {
+	ok, err := confirm(os.Stdin, os.Stderr, complianceWarning)
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if !ok {
+		return errors.New("aborted: COMPLIANCE mode was not confirmed")
+	}
+	return nil
+}
+
+// runPlan implements the plan command
+func runPlan(ctx context.Context, opts *options) error {
+	client, err := newBucketClient(ctx, opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	if opts.policyURI != "" {
+		if err := applyRetentionPolicy(ctx, client, opts); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	r := newRefresher(client, opts, now)
+	r.plan = newPlan(opts, now)
+	if err := r.runWithReport(ctx); err != nil {
+		return err
+	}
+
+	if err := writePlanFile(opts.planFile, r.plan); err != nil {
+		return err
+	}
+	slog.Info("Wrote plan", "changes", len(r.plan.Changes), "path", opts.planFile)
+	return nil
+}
+
+// runApply implements the apply command
+func runApply(ctx context.Context, opts *options) error {
+	p, err := readPlanFile(opts.planFile)
+	if err != nil {
+		return err
+	}
+	if err := p.validate(opts, time.Now()); err != nil {
+		return err
+	}
+
+	client, err := newBucketClient(ctx, opts.commonOptions)
+	if err != nil {
+		return err
+	}
+
+	if p.hasCompliance() && !opts.dryRun && !opts.yes {
+		if err := confirmCompliance(); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Applying plan", "changes", len(p.Changes), "created_at", p.CreatedAt.Format(time.RFC3339))
+	r := newRefresher(client, opts, time.Now())
+	ctx = withRunID(ctx, r.runID)
+	return r.withReport(func() error {
+		return r.withAudit(ctx, func() error { return r.applyPlan(ctx, p) })
+	})
+}
+
+// runReport implements the report command
+func runReport(ctx context.Context, opts *options) error {
+	client, err := newBucketClient(ctx, opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	if opts.policyURI != "" {
+		if err := applyReleasePolicy(ctx, client, opts); err != nil {
+			return err
+		}
+	}
+
+	candidates, err := findPruneCandidates(ctx, client, opts, time.Now())
+	if err != nil {
+		return err
+	}
+	slog.Info("Found backups past retention", "backups", len(candidates))
+	return writePruneCandidates(os.Stdout, candidates, opts.format)
+}
+
+// runLegalHold implements the legal-hold command
+func runLegalHold(ctx context.Context, opts *options) error {
+	client, err := newBucketClient(ctx, opts.commonOptions)
+	if err != nil {
+		return err
+	}
+
+	return run(ctx, client, opts)
+}
+
+// runRelease implements the release command
+func runRelease(ctx context.Context, opts *options) error {
+	client, err := newBucketClient(ctx, opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	if opts.policyURI != "" {
+		if err := applyReleasePolicy(ctx, client, opts); err != nil {
+			return err
+		}
+	}
+
+	r := newRefresher(client, opts, time.Now())
+	ctx = withRunID(ctx, r.runID)
+	return r.withReport(func() error {
+		return r.withAudit(ctx, func() error { return r.release(ctx) })
+	})
+}
+
+// runRestore implements the restore command
+func runRestore(ctx context.Context, opts *options) error {
+	entries, err := readRollbackFile(opts.restoreFile)
+	if err != nil {
+		return err
+	}
+	if err := validateRollback(entries, opts); err != nil {
+		return err
+	}
+
+	client, err := newBucketClient(ctx, opts.commonOptions)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Restoring retention", "objects", len(entries), "path", opts.restoreFile)
+	r := newRefresher(client, opts, time.Now())
+	ctx = withRunID(ctx, r.runID)
+	return r.withReport(func() error {
+		return r.withAudit(ctx, func() error { return r.restore(ctx, entries) })
+	})
+}
+
+// runWhoRetains implements the who-retains command
+func runWhoRetains(ctx context.Context, opts *options) error {
+	keys := opts.queryKeys
+	if opts.queryKeysFile != "" {
+		listed, invalid, err := loadKeysFile(opts.queryKeysFile)
+		if err != nil {
+			return err
+		}
+		if invalid > 0 {
+			slog.Warn("Skipped invalid keys in -keys-file", "invalid", invalid)
+		}
+		keys = append(keys, listed...)
+	}
+
+	client, err := newBucketClient(ctx, opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	if opts.policyURI != "" {
+		if err := applyRetentionPolicy(ctx, client, opts); err != nil {
+			return err
+		}
+	}
+
+	r := newRefresher(client, opts, time.Now())
+	defer r.logRunID()()
+	results, err := r.whoRetains(withRunID(ctx, r.runID), keys)
+	if err != nil {
+		return err
+	}
+	unreferenced := 0
+	for _, res := range results {
+		if len(res.Backups) == 0 {
+			unreferenced++
+		}
+	}
+	slog.Info("Looked up object keys", "keys", len(results), "unreferenced", unreferenced)
+	return writeKeyReferences(os.Stdout, results, opts.format)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []string
+		wantCommand    string
+		wantRest       []string
+		wantDeprecated bool
+		wantErr        string
+	}{
+		{
+			name:        "refresh",
+			args:        []string{"refresh", "-bucket", "b"},
+			wantCommand: "refresh",
+			wantRest:    []string{"-bucket", "b"},
+		},
+		{
+			name:        "legal-hold",
+			args:        []string{"legal-hold", "-status", "on"},
+			wantCommand: "legal-hold",
+			wantRest:    []string{"-status", "on"},
+		},
+		{
+			name:           "flags only default to refresh",
+			args:           []string{"-bucket", "b", "-cluster", "c"},
+			wantCommand:    "refresh",
+			wantRest:       []string{"-bucket", "b", "-cluster", "c"},
+			wantDeprecated: true,
+		},
+		{
+			name:    "no arguments",
+			args:    nil,
+			wantErr: "Commands:",
+		},
+		{
+			name:    "help",
+			args:    []string{"help"},
+			wantErr: "legal-hold",
+		},
+		{
+			name:    "unknown command",
+			args:    []string{"verify", "-bucket", "b"},
+			wantErr: `unknown command "verify"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, rest, deprecated, err := route(tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("route() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("route() error = %v", err)
+			}
+			if cmd.name != tt.wantCommand {
+				t.Errorf("route() command = %q, want %q", cmd.name, tt.wantCommand)
+			}
+			if !reflect.DeepEqual(rest, tt.wantRest) {
+				t.Errorf("route() rest = %v, want %v", rest, tt.wantRest)
+			}
+			if deprecated != tt.wantDeprecated {
+				t.Errorf("route() deprecated = %v, want %v", deprecated, tt.wantDeprecated)
+			}
+		})
+	}
+}
+
+func TestExecuteDefaultsToRefresh(t *testing.T) {
+	// Without a subcommand the refresh flags must still be accepted; the
+	// missing -cluster fails validation before any AWS call is made
+	err := execute(context.Background(), []string{"-bucket", "b", "-min-retention", "7", "-max-retention", "30"})
+	if err == nil || !strings.Contains(err.Error(), "refresh -bucket") {
+		t.Errorf("execute() error = %v, want the refresh usage", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// complianceWarning is shown before applying COMPLIANCE mode retention
+const complianceWarning = `WARNING: -mode compliance is irreversible.
+Objects locked in COMPLIANCE mode can't be deleted or have their retention
+shortened by anyone, including the root account, until the date passes.`
+
+// confirm prints the message and waits for the user to type "yes"
+func confirm(in io.Reader, out io.Writer, message string) (bool, error) {
+	fmt.Fprintf(out, "%s\nType \"yes\" to continue: ", message)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return strings.TrimSpace(answer) == "yes", nil
+}
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// prompt is where interactive confirmations are read from and printed to
+type prompt struct {
+	in  io.Reader
+	out io.Writer
+	tty bool // whether in is a terminal a person can answer from
+}
+
+// stdPrompt prompts on stderr and reads the answer from stdin
+func stdPrompt() prompt {
+	return prompt{in: os.Stdin, out: os.Stderr, tty: isTerminal(os.Stdin)}
+}
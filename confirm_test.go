@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfirm(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  bool
+	}{
+		{name: "yes", input: "yes\n", want: true},
+		{name: "yes without newline", input: "yes", want: true},
+		{name: "y is not enough", input: "y\n", want: false},
+		{name: "no", input: "no\n", want: false},
+		{name: "empty input", input: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			got, err := confirm(strings.NewReader(tt.input), &out, complianceWarning)
+			if err != nil {
+				t.Fatalf("confirm() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("confirm() = %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(out.String(), "irreversible") {
+				t.Errorf("confirm() did not print the warning, got %q", out.String())
+			}
+		})
+	}
+}
+
+func TestConfirmThreshold(t *testing.T) {
+	// statsBucket references 6 objects across two readable manifests
+	tests := []struct {
+		name       string
+		threshold  int
+		tty        bool
+		input      string
+		yes        bool
+		dryRun     bool
+		wantPrompt bool
+		wantErr    string
+	}{
+		{name: "confirmed on a terminal", threshold: 5, tty: true, input: "yes\n", wantPrompt: true},
+		{name: "declined on a terminal", threshold: 5, tty: true, input: "no\n", wantPrompt: true, wantErr: "not confirmed"},
+		{name: "no terminal", threshold: 5, wantErr: "not a terminal"},
+		{name: "yes flag", threshold: 5, yes: true},
+		{name: "dry-run", threshold: 5, dryRun: true},
+		{name: "below threshold", threshold: 6, tty: true},
+		{name: "disabled", threshold: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.confirmThreshold = tt.threshold
+			opts.yes = tt.yes
+			opts.dryRun = tt.dryRun
+			client, attempted := countingClient(statsBucket())
+
+			var out bytes.Buffer
+			r := newRefresher(client, opts, time.Now())
+			r.prompt = prompt{in: strings.NewReader(tt.input), out: &out, tty: tt.tty}
+			err := r.run(context.Background())
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("run() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				if got := attempted(); len(got) != 0 {
+					t.Errorf("run() touched %v after aborting", got)
+				}
+			} else if err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			prompted := strings.Contains(out.String(), "About to process 6 objects from 3 manifests")
+			if prompted != tt.wantPrompt {
+				t.Errorf("prompt = %q, want prompted %v", out.String(), tt.wantPrompt)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+)
+
+// backupCoverage is how much of one backup the run confirmed protected
+type backupCoverage struct {
+	Manifest   string  `json:"manifest"`
+	Referenced int     `json:"referenced"` // objects of the backup the run attempted
+	Confirmed  int     `json:"confirmed"`  // of those, objects at or above the required retention
+	Coverage   float64 `json:"coverage"`   // percentage of referenced objects confirmed, rounded down to two decimals
+}
+
+// coverageTracker attributes the outcome of every attempted object to the
+// backups referencing it. An object confirmed for one backup is confirmed for
+// every backup sharing it, even if a later attempt for another one failed.
+type coverageTracker struct {
+	manifests []string                       // in processing order
+	keys      map[string]map[string]struct{} // attempted object keys per manifest
+	confirmed map[string]bool                // object keys at or above the required retention
+}
+
+// newCoverageTracker creates an empty coverageTracker
+func newCoverageTracker() *coverageTracker {
+	return &coverageTracker{
+		keys:      make(map[string]map[string]struct{}),
+		confirmed: make(map[string]bool),
+	}
+}
+
+// confirms reports whether action leaves an object at or above the required
+// retention: it already was, or the run updated it
+func confirms(action objectAction) bool {
+	switch action {
+	case actionSkipped, actionUpdated, actionReduced:
+		return true
+	}
+	return false
+}
+
+// record adds the outcome of the object key referenced by manifest. Excluded
+// objects are left out since they're deliberately never touched, and so are
+// -offline plans, which check nothing.
+func (c *coverageTracker) record(manifest, key string, action objectAction) {
+	if manifest == "" || action == actionExcluded || action == actionPlanned {
+		return
+	}
+	keys := c.keys[manifest]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		c.keys[manifest] = keys
+		c.manifests = append(c.manifests, manifest)
+	}
+	keys[key] = struct{}{}
+	if confirms(action) {
+		c.confirmed[key] = true
+	}
+}
+
+// coverage returns the coverage of every backup with an attempted object, in
+// processing order
+func (c *coverageTracker) coverage() []backupCoverage {
+	var backups []backupCoverage
+	for _, manifest := range c.manifests {
+		b := backupCoverage{Manifest: manifest, Referenced: len(c.keys[manifest])}
+		for key := range c.keys[manifest] {
+			if c.confirmed[key] {
+				b.Confirmed++
+			}
+		}
+		// Rounded down so a partial coverage never shows as 100
+		b.Coverage = math.Floor(10000*float64(b.Confirmed)/float64(b.Referenced)) / 100
+		backups = append(backups, b)
+	}
+	return backups
+}
+
+// reportCoverage logs the retention coverage of every processed backup,
+// warning about those below 100%, and records it for the summary
+func (r *refresher) reportCoverage() {
+	backups := r.coverage.coverage()
+	for _, b := range backups {
+		attrs := []any{"manifest", b.Manifest, "referenced", b.Referenced, "confirmed", b.Confirmed, "coverage", fmt.Sprintf("%.2f%%", b.Coverage)}
+		if b.Confirmed < b.Referenced {
+			slog.Warn("Backup retention coverage below 100%", attrs...)
+			continue
+		}
+		slog.Info("Backup retention coverage", attrs...)
+	}
+	r.stats.setBackupCoverage(backups)
+}
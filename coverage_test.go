@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestRunBackupCoverage(t *testing.T) {
+	bucket := newFakeBucket()
+	// b2 is processed first; shared.db fails for it but succeeds for b1
+	bucket.objects["links/host1/medusa-backup-schedule-1710000000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/new.db"},{"path":"data/ks/t/broken.db"}]}]`
+	bucket.objects["links/host1/medusa-backup-schedule-1700000000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/old.db"}]}]`
+	for _, key := range []string{"shared.db", "new.db", "broken.db", "old.db"} {
+		bucket.objects["links/host1/data/ks/t/"+key] = ""
+	}
+
+	client := bucket.client()
+	put := client.PutObjectRetentionFunc
+	sharedAttempts := 0
+	client.PutObjectRetentionFunc = func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+		switch aws.ToString(params.Key) {
+		case "links/host1/data/ks/t/broken.db":
+			return nil, errors.New("AccessDenied")
+		case "links/host1/data/ks/t/shared.db":
+			if sharedAttempts++; sharedAttempts == 1 {
+				return nil, errors.New("SlowDown")
+			}
+		}
+		return put(ctx, params, optFns...)
+	}
+
+	r := newRefresher(client, testOptions(), time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	want := []backupCoverage{
+		{Manifest: "links/host1/medusa-backup-schedule-1710000000/meta/manifest.json", Referenced: 3, Confirmed: 2, Coverage: 66.66},
+		{Manifest: "links/host1/medusa-backup-schedule-1700000000/meta/manifest.json", Referenced: 2, Confirmed: 2, Coverage: 100},
+	}
+	sum := r.stats.summary(time.Now())
+	if !reflect.DeepEqual(sum.BackupCoverage, want) {
+		t.Errorf("summary backup_coverage = %+v, want %+v", sum.BackupCoverage, want)
+	}
+	if got := backupsBelowFullCoverage(sum.BackupCoverage); got != 1 {
+		t.Errorf("backupsBelowFullCoverage() = %d, want 1", got)
+	}
+}
+
+func TestCoverageTracker(t *testing.T) {
+	c := newCoverageTracker()
+	c.record("m1", "a", actionSkipped)
+	c.record("m1", "b", actionWouldUpdate)
+	c.record("m1", "c", actionExcluded)
+	c.record("m1", "d", actionMissing)
+	// Objects outside any manifest, e.g. from -extra-prefixes, belong to no backup
+	c.record("", "e", actionUpdated)
+	// A later confirmation counts for the earlier backup too
+	c.record("m2", "d", actionUpdated)
+
+	want := []backupCoverage{
+		{Manifest: "m1", Referenced: 3, Confirmed: 2, Coverage: 66.66},
+		{Manifest: "m2", Referenced: 1, Confirmed: 1, Coverage: 100},
+	}
+	if got := c.coverage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("coverage() = %+v, want %+v", got, want)
+	}
+}
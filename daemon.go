@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDrainTimeout is how long a pass may go on after SIGTERM
+	defaultDrainTimeout = 5 * time.Minute
+	// defaultMaxFailedPasses is how many passes in a row may fail before the
+	// process exits
+	defaultMaxFailedPasses = 3
+	// intervalJitter is the largest fraction of -interval added to each sleep,
+	// so that replicas started together spread their passes out
+	intervalJitter = 0.1
+)
+
+// manifestCache keeps the downloaded manifests between the passes of
+// -interval: Medusa never changes a manifest once uploaded. It is safe for
+// concurrent use.
+type manifestCache struct {
+	mu        sync.Mutex
+	manifests map[string]*Manifest
+	used      map[string]bool // keys the current pass asked for
+}
+
+func newManifestCache() *manifestCache {
+	return &manifestCache{manifests: make(map[string]*Manifest), used: make(map[string]bool)}
+}
+
+// get returns the cached manifest key, if any
+func (c *manifestCache) get(key string) (*Manifest, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.used[key] = true
+	manifest, ok := c.manifests[key]
+	return manifest, ok
+}
+
+// put caches a downloaded manifest
+func (c *manifestCache) put(key string, manifest *Manifest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.used[key] = true
+	c.manifests[key] = manifest
+}
+
+// endPass drops the manifests the pass didn't ask for, e.g. of backups
+// Medusa purged, so that the cache doesn't grow forever
+func (c *manifestCache) endPass() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.manifests {
+		if !c.used[key] {
+			delete(c.manifests, key)
+		}
+	}
+	c.used = make(map[string]bool)
+}
+
+// daemon runs a refresh every -interval until interrupted
+type daemon struct {
+	opts   *options
+	pass   func(ctx context.Context) error            // runs one pass
+	after  func(d time.Duration) <-chan time.Time     // time.After, replaced in tests
+	sleep  func(interval time.Duration) time.Duration // adds jitter to -interval
+	cache  *manifestCache                             // manifests kept between passes
+	health *daemonHealth                              // follows the passes for -health-listen
+	sts    STSAPI                                     // validates the AWS credentials, created when nil
+}
+
+// newDaemon creates a daemon running passes against client. Every pass is a
+// run of its own, with its own run ID and summary, but shares the S3 client
+// and the downloaded manifests.
+func newDaemon(client S3API, opts *options) *daemon {
+	d := &daemon{
+		opts:   opts,
+		after:  time.After,
+		sleep:  jitter,
+		cache:  newManifestCache(),
+		health: newDaemonHealth(opts.stallTimeout),
+	}
+	d.pass = func(ctx context.Context) error {
+		r := newRefresher(client, opts, time.Now())
+		r.manifests = d.cache
+		d.health.passRunning(r.runID, r.stats)
+		defer d.cache.endPass()
+		return r.runWithReport(ctx)
+	}
+	return d
+}
+
+// jitter returns interval plus up to intervalJitter of it
+func jitter(interval time.Duration) time.Duration {
+	return interval + time.Duration(rand.Int63n(int64(float64(interval)*intervalJitter)+1))
+}
+
+// loop runs passes until ctx is canceled, sleeping -interval between them.
+// Canceling ctx lets the current pass finish, for up to -drain-timeout. It
+// returns an error once -max-failed-passes passes in a row failed, so that
+// the orchestrator restarts the process. The -health-listen probes are
+// served until ctx is canceled.
+func (d *daemon) loop(ctx context.Context) error {
+	if d.opts.healthListen != "" {
+		stop, err := serveHTTP(ctx, "health-listen", d.opts.healthListen, d.health.handler())
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	if err := d.validate(ctx); err != nil {
+		return err
+	}
+	d.health.setReady()
+
+	failed := 0
+	for pass := 1; ; pass++ {
+		slog.Info("Starting pass", "pass", pass)
+		d.health.passStarted(pass)
+		err := d.runPass(ctx)
+		d.health.passEnded(err)
+		if err != nil {
+			failed++
+			slog.Error("Pass failed", append([]any{"pass", pass, "consecutive_failures", failed}, errorAttrs(err)...)...)
+			if failed >= d.opts.maxFailedPasses {
+				return fmt.Errorf("%d passes in a row failed, last: %w", failed, err)
+			}
+		} else {
+			failed = 0
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		wait := d.sleep(d.opts.interval)
+		slog.Info("Waiting for the next pass", "pass", pass+1, "in", wait.Round(time.Second).String())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-d.after(wait):
+		}
+	}
+}
+
+// runPass runs one pass, which isn't interrupted when ctx is canceled until
+// -drain-timeout elapsed. The drain watcher is stopped before it returns, so
+// a cancellation after the pass ended isn't taken for one during it.
+func (d *daemon) runPass(ctx context.Context) error {
+	passCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	watched := make(chan struct{})
+	defer func() {
+		cancel()
+		<-watched
+	}()
+	go func() {
+		defer close(watched)
+		select {
+		case <-passCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		if passCtx.Err() != nil {
+			return
+		}
+		slog.Info("Finishing the current pass before stopping", "drain_timeout", d.opts.drainTimeout.String())
+		select {
+		case <-passCtx.Done():
+		case <-d.after(d.opts.drainTimeout):
+			slog.Warn("Aborting the current pass, -drain-timeout elapsed")
+			cancel()
+		}
+	}()
+	return d.pass(passCtx)
+}
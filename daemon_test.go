@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock stands in for time.After, firing every wait at once and
+// recording it
+type fakeClock struct {
+	mu    sync.Mutex
+	waits []time.Duration
+	fire  func(n int) bool // whether wait n, from 1, fires; all do when nil
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	if c.fire == nil || c.fire(len(c.waits)) {
+		ch <- time.Now()
+	}
+	return ch
+}
+
+// waited returns the waits recorded so far
+func (c *fakeClock) waited() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.waits...)
+}
+
+func TestDaemonReusesManifests(t *testing.T) {
+	bucket := stateBucket()
+	opts := testOptions()
+	opts.interval = time.Hour
+	opts.maxFailedPasses = defaultMaxFailedPasses
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := newDaemon(bucket.client(), opts)
+	d.sts = &mockSTS{arn: testPrincipal}
+	clock := &fakeClock{fire: func(n int) bool {
+		// Stop during the wait after the second pass
+		if n == 2 {
+			cancel()
+			return false
+		}
+		return true
+	}}
+	d.after = clock.after
+	var retained []int
+	pass := d.pass
+	d.pass = func(ctx context.Context) error {
+		err := pass(ctx)
+		bucket.mu.Lock()
+		retained = append(retained, len(bucket.retention))
+		bucket.retention = make(map[string]time.Time)
+		bucket.mu.Unlock()
+		return err
+	}
+	if err := d.loop(ctx); err != nil {
+		t.Fatalf("loop() error = %v", err)
+	}
+
+	if len(retained) != 2 || retained[0] == 0 || retained[1] != retained[0] {
+		t.Fatalf("passes retained %v objects, want 2 passes processing every backup", retained)
+	}
+	// The second pass found the manifests in the cache
+	if bucket.getCalls != 4 {
+		t.Errorf("downloaded manifests %d times, want each of the 4 once", bucket.getCalls)
+	}
+	waits := clock.waited()
+	if len(waits) != 2 {
+		t.Fatalf("waited %v, want once after each pass", waits)
+	}
+	for _, wait := range waits {
+		if wait < opts.interval || wait > opts.interval+opts.interval/10 {
+			t.Errorf("waited %s, want -interval plus up to 10%% jitter", wait)
+		}
+	}
+}
+
+func TestManifestCacheDropsUnusedManifests(t *testing.T) {
+	c := newManifestCache()
+	c.put("a", &Manifest{})
+	c.put("b", &Manifest{})
+	c.endPass()
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("manifest a not cached for the next pass")
+	}
+	c.endPass()
+	if _, ok := c.get("a"); !ok {
+		t.Error("manifest a used by the previous pass dropped")
+	}
+	if _, ok := c.get("b"); ok {
+		t.Error("manifest b unused by the previous pass still cached")
+	}
+}
+
+func TestDaemonFailedPasses(t *testing.T) {
+	failure := errors.New("failed to list objects: AccessDenied")
+	tests := []struct {
+		name       string
+		maxFailed  int
+		results    []error // of each pass, the loop is stopped after the last
+		wantPasses int
+		wantErr    bool
+	}{
+		{
+			name:       "failures interrupted by a success",
+			maxFailed:  2,
+			results:    []error{failure, nil, failure, nil},
+			wantPasses: 4,
+		},
+		{
+			name:       "failures in a row",
+			maxFailed:  3,
+			results:    []error{nil, failure, failure, failure, nil},
+			wantPasses: 4,
+			wantErr:    true,
+		},
+		{
+			name:       "first pass failing",
+			maxFailed:  1,
+			results:    []error{failure, nil},
+			wantPasses: 1,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.interval = time.Minute
+			opts.maxFailedPasses = tt.maxFailed
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			d := newDaemon(newFakeBucket().client(), opts)
+			d.sts = &mockSTS{arn: testPrincipal}
+			d.after = (&fakeClock{}).after
+			passes := 0
+			d.pass = func(context.Context) error {
+				passes++
+				if passes == len(tt.results) {
+					cancel()
+				}
+				return tt.results[passes-1]
+			}
+			err := d.loop(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loop() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, failure) {
+				t.Errorf("loop() error = %v, want the last pass's error", err)
+			}
+			if passes != tt.wantPasses {
+				t.Errorf("ran %d passes, want %d", passes, tt.wantPasses)
+			}
+		})
+	}
+}
+
+func TestDaemonDrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		drainEnds bool // whether -drain-timeout elapses before the pass ends
+		wantErr   string
+	}{
+		{name: "pass finished"},
+		{name: "pass aborted", drainEnds: true, wantErr: "2 passes in a row failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.interval = time.Hour
+			opts.drainTimeout = time.Minute
+			opts.maxFailedPasses = 2
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			d := newDaemon(newFakeBucket().client(), opts)
+			d.sts = &mockSTS{arn: testPrincipal}
+			drain := make(chan time.Time)
+			d.after = func(wait time.Duration) <-chan time.Time {
+				if wait == opts.drainTimeout {
+					return drain
+				}
+				return (&fakeClock{}).after(wait)
+			}
+			passes := 0
+			d.pass = func(passCtx context.Context) error {
+				passes++
+				if passes == 1 {
+					return errors.New("failed to list objects: SlowDown")
+				}
+				// SIGTERM arrives during the second pass
+				cancel()
+				if tt.drainEnds {
+					close(drain)
+					<-passCtx.Done()
+					return passCtx.Err()
+				}
+				select {
+				case <-passCtx.Done():
+					t.Error("pass interrupted before -drain-timeout")
+				case <-time.After(50 * time.Millisecond):
+				}
+				return nil
+			}
+			err := d.loop(ctx)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("loop() error = %v, want %q", err, tt.wantErr)
+			}
+			if passes != 2 {
+				t.Errorf("ran %d passes, want none after SIGTERM", passes)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// droppedTable is a table found in older backups of a host but not in its
+// newest processed backup, usually because it was dropped in Cassandra
+type droppedTable struct {
+	Host       string     `json:"host"`
+	Keyspace   string     `json:"keyspace"`
+	Table      string     `json:"table"`
+	LastBackup string     `json:"last_backup"`          // newest backup that has the table
+	LastTaken  *time.Time `json:"last_taken,omitempty"` // when that backup was taken, if known
+	Bytes      int64      `json:"bytes"`                // manifest sizes of its unique objects in the older backups
+}
+
+// backupTables holds the tables of one processed backup
+type backupTables struct {
+	backup string
+	taken  time.Time // zero when the backup is undated
+	tables map[tableKey]bool
+}
+
+// tableTracker records the tables of every processed backup per host, to
+// find the tables a host's newest backup no longer has
+type tableTracker struct {
+	backups map[string][]backupTables     // per host, in processing order, so newest first
+	bytes   map[string]map[tableKey]int64 // per host, bytes of the unique objects of each table
+	seen    map[string]struct{}           // object keys already counted
+}
+
+// newTableTracker creates an empty tableTracker
+func newTableTracker() *tableTracker {
+	return &tableTracker{
+		backups: make(map[string][]backupTables),
+		bytes:   make(map[string]map[tableKey]int64),
+		seen:    make(map[string]struct{}),
+	}
+}
+
+// record adds the tables of the processed manifest m, whose data files are
+// stored under hostnamePath. Secondary index SSTables count for their table.
+func (t *tableTracker) record(m ManifestInfo, manifest *Manifest, hostnamePath string) {
+	mp, err := m.path()
+	if err != nil {
+		return
+	}
+	host := mp.Host
+	b := backupTables{backup: mp.Backup, tables: make(map[tableKey]bool)}
+	if taken, ok := backupTimestamp(m); ok {
+		b.taken = taken
+	}
+	bytes := t.bytes[host]
+	if bytes == nil {
+		bytes = make(map[tableKey]int64)
+		t.bytes[host] = bytes
+	}
+	for _, obj := range manifest.Objects {
+		k := tableKey{keyspace: obj.Keyspace, table: obj.ColumnFamily}
+		b.tables[k] = true
+		key := resolveObjectKey(hostnamePath, obj.Path)
+		if _, ok := t.seen[key]; ok {
+			continue
+		}
+		t.seen[key] = struct{}{}
+		bytes[k] += obj.Size
+	}
+	t.backups[host] = append(t.backups[host], b)
+}
+
+// dropped returns the tables of each host's older backups that its newest
+// backup doesn't have, by host, keyspace and table. The bytes count the
+// table's objects across all of the host's backups, none of which the newest
+// backup references since it doesn't have the table.
+func (t *tableTracker) dropped() []droppedTable {
+	var dropped []droppedTable
+	for host, backups := range t.backups {
+		newest := backups[0].tables
+		reported := make(map[tableKey]bool)
+		for _, b := range backups[1:] {
+			for k := range b.tables {
+				if newest[k] || reported[k] {
+					continue
+				}
+				reported[k] = true
+				d := droppedTable{Host: host, Keyspace: k.keyspace, Table: k.table, LastBackup: b.backup, Bytes: t.bytes[host][k]}
+				if !b.taken.IsZero() {
+					taken := b.taken.UTC()
+					d.LastTaken = &taken
+				}
+				dropped = append(dropped, d)
+			}
+		}
+	}
+	sort.Slice(dropped, func(i, j int) bool {
+		if dropped[i].Host != dropped[j].Host {
+			return dropped[i].Host < dropped[j].Host
+		}
+		if dropped[i].Keyspace != dropped[j].Keyspace {
+			return dropped[i].Keyspace < dropped[j].Keyspace
+		}
+		return dropped[i].Table < dropped[j].Table
+	})
+	return dropped
+}
+
+// reportDroppedTables logs the tables missing from the newest backup of their
+// host and records them for the summary. Nothing is changed for them.
+func (r *refresher) reportDroppedTables() {
+	dropped := r.tables.dropped()
+	for _, d := range dropped {
+		slog.Warn("Table is missing from the newest backup of its host", "host", d.Host, "keyspace", d.Keyspace, "table", d.Table, "last_backup", d.LastBackup, "bytes", d.Bytes)
+	}
+	r.stats.setDroppedTables(dropped)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunDroppedTables(t *testing.T) {
+	bucket := newFakeBucket()
+	// host1 dropped app.sessions between its two backups, and app.legacy before them
+	bucket.objects["links/host1/medusa-backup-schedule-1700000000/meta/manifest.json"] = `[` +
+		`{"keyspace":"app","columnfamily":"users","objects":[{"path":"data/app/users/1.db","size":100}]},` +
+		`{"keyspace":"app","columnfamily":"sessions","objects":[{"path":"data/app/sessions/1.db","size":40},{"path":"data/app/sessions/.sessions_user_idx/nb-1-big-Data.db","size":5}]}]`
+	bucket.objects["links/host1/medusa-backup-schedule-1690000000/meta/manifest.json"] = `[` +
+		`{"keyspace":"app","columnfamily":"sessions","objects":[{"path":"data/app/sessions/1.db","size":40},{"path":"data/app/sessions/0.db","size":20}]},` +
+		`{"keyspace":"app","columnfamily":"legacy","objects":[{"path":"data/app/legacy/1.db","size":7}]}]`
+	bucket.objects["links/host1/medusa-backup-schedule-1710000000/meta/manifest.json"] = `[` +
+		`{"keyspace":"app","columnfamily":"users","objects":[{"path":"data/app/users/1.db","size":100},{"path":"data/app/users/2.db","size":10}]}]`
+	// host2 still has sessions in its only backup
+	bucket.objects["links/host2/medusa-backup-schedule-1710000000/meta/manifest.json"] = `[` +
+		`{"keyspace":"app","columnfamily":"sessions","objects":[{"path":"data/app/sessions/9.db","size":1}]}]`
+	for _, key := range []string{
+		"links/host1/data/app/users/1.db",
+		"links/host1/data/app/users/2.db",
+		"links/host1/data/app/sessions/0.db",
+		"links/host1/data/app/sessions/1.db",
+		"links/host1/data/app/sessions/.sessions_user_idx/nb-1-big-Data.db",
+		"links/host1/data/app/legacy/1.db",
+		"links/host2/data/app/sessions/9.db",
+	} {
+		bucket.objects[key] = ""
+	}
+
+	opts := testOptions()
+	opts.dryRun = true
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	sessionsTaken := time.Unix(1700000000, 0).UTC()
+	legacyTaken := time.Unix(1690000000, 0).UTC()
+	want := []droppedTable{
+		{Host: "host1", Keyspace: "app", Table: "legacy", LastBackup: "medusa-backup-schedule-1690000000", LastTaken: &legacyTaken, Bytes: 7},
+		// The index SSTable and the file only the oldest backup has count too
+		{Host: "host1", Keyspace: "app", Table: "sessions", LastBackup: "medusa-backup-schedule-1700000000", LastTaken: &sessionsTaken, Bytes: 65},
+	}
+	if got := r.stats.summary(time.Now()).DroppedTables; !reflect.DeepEqual(got, want) {
+		t.Errorf("summary dropped_tables = %+v, want %+v", got, want)
+	}
+	// Report-only: the dropped tables' objects are still processed
+	if got := r.stats.summary(time.Now()).UniqueObjects; got != 7 {
+		t.Errorf("summary unique_objects = %d, want 7", got)
+	}
+}
+
+func TestTableTrackerSingleBackup(t *testing.T) {
+	tracker := newTableTracker()
+	m := ManifestInfo{Key: "links/host1/b1/meta/manifest.json"}
+	tracker.record(m, &Manifest{Objects: []ManifestObject{{Path: "data/app/users/1.db", Keyspace: "app", ColumnFamily: "users"}}}, "links/host1/")
+	if got := tracker.dropped(); got != nil {
+		t.Errorf("dropped() = %+v, want none for a host with one backup", got)
+	}
+}
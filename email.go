@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	sestypes "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// SESAPI defines the SES operations used by this tool
+type SESAPI interface {
+	SendEmail(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error)
+}
+
+// ReportUploader uploads reports too large to attach to -ses-report-s3-uri
+type ReportUploader interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// sesMaxAttachment is the largest report attached to the email. Base64
+// grows it by a third, which keeps the message under SES's 10 MB default.
+const sesMaxAttachment = 7 << 20
+
+// emailAttachment is a file attached to an email
+type emailAttachment struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// emailMessage is an email with an optional attachment
+type emailMessage struct {
+	from       string
+	to         []string
+	subject    string
+	body       string
+	attachment *emailAttachment
+}
+
+// buildMIME encodes msg as a MIME message dated now: a multipart/mixed
+// message with a quoted-printable text body and a base64 attachment
+func buildMIME(msg emailMessage, now time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", msg.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(msg.to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build email: %w", err)
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(msg.body, "\n", "\r\n"))); err != nil {
+		return nil, fmt.Errorf("failed to build email: %w", err)
+	}
+	if err := qp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to build email: %w", err)
+	}
+
+	if a := msg.attachment; a != nil {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(a.contentType, map[string]string{"name": a.name})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to build email: %w", err)
+		}
+		// Lines of encoded data must not exceed 76 characters
+		encoded := base64.StdEncoding.EncodeToString(a.data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to build email: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// reportContentType returns the MIME type of a -report file in format
+func reportContentType(format string) string {
+	if format == "csv" {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+// reportEmail returns the email reporting the run, which failed with runErr
+// when not nil, as of now. The -report file is attached up to maxAttachment
+// bytes; a larger one is uploaded to -ses-report-s3-uri, when set, and the
+// body says where to find it.
+func (r *refresher) reportEmail(ctx context.Context, runErr error, now time.Time, maxAttachment int64) (emailMessage, error) {
+	opts := r.opts
+	status := "succeeded"
+	if runErr != nil {
+		status = "failed"
+	}
+	msg := emailMessage{
+		from:    opts.sesFrom,
+		to:      opts.sesTo,
+		subject: fmt.Sprintf("Medusa retention refresh of %s %s", opts.cluster, status),
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "The Medusa retention refresh of cluster %s in bucket %s %s at %s.\n\n", opts.cluster, opts.bucket, status, now.UTC().Format(time.RFC3339))
+	if runErr != nil {
+		fmt.Fprintf(&body, "Error: %s\n\n", runErr)
+	}
+
+	if opts.report != "" {
+		data, err := os.ReadFile(opts.report)
+		if err != nil {
+			return emailMessage{}, fmt.Errorf("failed to read report: %w", err)
+		}
+		name := filepath.Base(opts.report)
+		switch {
+		case int64(len(data)) <= maxAttachment:
+			msg.attachment = &emailAttachment{name: name, contentType: reportContentType(opts.reportFormat), data: data}
+			fmt.Fprintf(&body, "The report of every processed object is attached as %s (%d bytes).\n\n", name, len(data))
+		case opts.sesReportURI != "":
+			uri, err := r.uploadReport(ctx, data, now)
+			if err != nil {
+				return emailMessage{}, err
+			}
+			fmt.Fprintf(&body, "The report of every processed object (%d bytes) is too large to attach, above %d bytes. It was uploaded to %s.\n\n", len(data), maxAttachment, uri)
+		default:
+			host, _ := os.Hostname()
+			fmt.Fprintf(&body, "The report of every processed object (%d bytes) is too large to attach, above %d bytes. It was written to %s on %s.\n\n", len(data), maxAttachment, opts.report, host)
+		}
+	}
+
+	summary, err := json.MarshalIndent(r.stats.summary(now), "", "  ")
+	if err != nil {
+		return emailMessage{}, fmt.Errorf("failed to encode summary: %w", err)
+	}
+	fmt.Fprintf(&body, "Summary:\n%s\n", summary)
+	msg.body = body.String()
+	return msg, nil
+}
+
+// uploadReport uploads the -report file contents under the -ses-report-s3-uri
+// prefix, named after the cluster and now, and returns its URI
+func (r *refresher) uploadReport(ctx context.Context, data []byte, now time.Time) (string, error) {
+	bucket, prefix, err := parseS3URI(strings.TrimSuffix(r.opts.sesReportURI, "/"))
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s/%s-%s%s", prefix, r.opts.cluster, now.UTC().Format("20060102T150405Z"), filepath.Ext(r.opts.report))
+	_, err = r.uploader.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(reportContentType(r.opts.reportFormat)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload report: %w", err)
+	}
+	return "s3://" + bucket + "/" + key, nil
+}
+
+// emailReport emails the run's summary and -report file from -ses-from to
+// -ses-to, returning runErr, or the email's error when the run succeeded. A
+// failed email after a failed run is only logged.
+func (r *refresher) emailReport(ctx context.Context, runErr error) error {
+	// The email is sent even when the run was interrupted
+	emailCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+	defer cancel()
+
+	err := func() error {
+		now := time.Now()
+		msg, err := r.reportEmail(emailCtx, runErr, now, sesMaxAttachment)
+		if err != nil {
+			return err
+		}
+		raw, err := buildMIME(msg, now)
+		if err != nil {
+			return err
+		}
+		_, err = r.ses.SendEmail(emailCtx, &sesv2.SendEmailInput{
+			FromEmailAddress: aws.String(msg.from),
+			Destination:      &sestypes.Destination{ToAddresses: msg.to},
+			Content:          &sestypes.EmailContent{Raw: &sestypes.RawMessage{Data: raw}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to send email: %w", err)
+		}
+		return nil
+	}()
+	if err == nil {
+		slog.Info("Emailed report", "to", strings.Join(r.opts.sesTo, ","))
+		return runErr
+	}
+	if runErr != nil {
+		slog.Error("Failed to email report", errorAttrs(err)...)
+		return runErr
+	}
+	return err
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+)
+
+// mockSES records the emails sent through it
+type mockSES struct {
+	inputs []*sesv2.SendEmailInput
+	err    error
+}
+
+func (m *mockSES) SendEmail(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error) {
+	m.inputs = append(m.inputs, params)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sesv2.SendEmailOutput{MessageId: aws.String("id")}, nil
+}
+
+// mockUploader records the objects uploaded to it, failing the first
+// failures calls
+type mockUploader struct {
+	mu       sync.Mutex
+	keys     []string
+	bodies   [][]byte
+	inputs   []*s3.PutObjectInput
+	calls    int
+	failures int
+}
+
+func (m *mockUploader) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.calls <= m.failures {
+		return nil, errors.New("InternalError: We encountered an internal error. Please try again.")
+	}
+	body, _ := io.ReadAll(params.Body)
+	m.keys = append(m.keys, aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key))
+	m.bodies = append(m.bodies, body)
+	m.inputs = append(m.inputs, params)
+	return &s3.PutObjectOutput{}, nil
+}
+
+// mimePart is a decoded part of a MIME message
+type mimePart struct {
+	contentType string
+	filename    string
+	data        []byte
+}
+
+// parseMIME parses a multipart/mixed message, decoding its parts, and
+// fails on lines longer than RFC 5322 allows
+func parseMIME(t *testing.T, raw []byte) (*mail.Message, []mimePart) {
+	t.Helper()
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 {
+			t.Fatalf("line of %d characters", len(line))
+		}
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, want multipart/mixed", msg.Header.Get("Content-Type"))
+	}
+
+	var parts []mimePart
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid part: %v", err)
+		}
+		encoded, _ := io.ReadAll(p)
+		var data []byte
+		switch enc := p.Header.Get("Content-Transfer-Encoding"); enc {
+		case "base64":
+			for _, line := range strings.Split(strings.TrimSpace(string(encoded)), "\r\n") {
+				if len(line) > 76 {
+					t.Errorf("base64 line of %d characters, want at most 76", len(line))
+				}
+			}
+			if data, err = base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", "")); err != nil {
+				t.Fatalf("invalid base64 part: %v", err)
+			}
+		case "quoted-printable":
+			data, _ = io.ReadAll(quotedprintable.NewReader(bytes.NewReader(encoded)))
+		default:
+			t.Fatalf("part encoded as %q", enc)
+		}
+		_, disposition, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		parts = append(parts, mimePart{contentType: contentType, filename: disposition["filename"], data: data})
+	}
+	return msg, parts
+}
+
+func TestBuildMIME(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	report := bytes.Repeat([]byte(`{"key":"links/host1/data/ks/t/a.db","action":"updated"}`+"\n"), 20)
+	msg := emailMessage{
+		from:       "refresher@example.com",
+		to:         []string{"compliance@example.com", "ops@example.com"},
+		subject:    "Medusa retention refresh of links succeeded",
+		body:       "The refresh succeeded.\nSummary: é",
+		attachment: &emailAttachment{name: "report.json", contentType: "application/x-ndjson", data: report},
+	}
+	raw, err := buildMIME(msg, now)
+	if err != nil {
+		t.Fatalf("buildMIME() error = %v", err)
+	}
+	parsed, parts := parseMIME(t, raw)
+	for header, want := range map[string]string{
+		"From":         "refresher@example.com",
+		"To":           "compliance@example.com, ops@example.com",
+		"Subject":      "Medusa retention refresh of links succeeded",
+		"Date":         "Sun, 01 Jun 2025 12:00:00 +0000",
+		"Mime-Version": "1.0",
+	} {
+		if got := parsed.Header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+	if len(parts) != 2 {
+		t.Fatalf("message has %d parts, want 2", len(parts))
+	}
+	if parts[0].contentType != "text/plain" || string(parts[0].data) != "The refresh succeeded.\r\nSummary: é" {
+		t.Errorf("body part = %s %q", parts[0].contentType, parts[0].data)
+	}
+	if parts[1].contentType != "application/x-ndjson" || parts[1].filename != "report.json" || !bytes.Equal(parts[1].data, report) {
+		t.Errorf("attachment = %s %q, %d bytes, want the report", parts[1].contentType, parts[1].filename, len(parts[1].data))
+	}
+
+	// Without an attachment, only the body is sent
+	msg.attachment = nil
+	raw, err = buildMIME(msg, now)
+	if err != nil {
+		t.Fatalf("buildMIME() error = %v", err)
+	}
+	if _, parts := parseMIME(t, raw); len(parts) != 1 {
+		t.Errorf("message has %d parts, want only the body", len(parts))
+	}
+}
+
+func TestReportEmail(t *testing.T) {
+	report := strings.Repeat(`{"key":"links/host1/data/ks/t/a.db","action":"updated"}`+"\n", 10)
+	tests := []struct {
+		name          string
+		maxAttachment int64
+		reportURI     string
+		runErr        error
+		wantAttached  bool
+		wantUploaded  string
+		wantBody      []string
+	}{
+		{
+			name:          "attached",
+			maxAttachment: sesMaxAttachment,
+			wantAttached:  true,
+			wantBody:      []string{"links in bucket test-bucket succeeded", "attached as report.json", `"manifests_found"`},
+		},
+		{
+			name:          "too large, uploaded",
+			maxAttachment: 100,
+			reportURI:     "s3://evidence/medusa/",
+			wantUploaded:  "evidence/medusa/links-20250601T120000Z.json",
+			wantBody:      []string{"too large to attach, above 100 bytes", "uploaded to s3://evidence/medusa/links-20250601T120000Z.json"},
+		},
+		{
+			name:          "too large, kept locally",
+			maxAttachment: 100,
+			wantBody:      []string{"too large to attach, above 100 bytes", "It was written to "},
+		},
+		{
+			name:          "failed run",
+			maxAttachment: sesMaxAttachment,
+			runErr:        errors.New("run interrupted"),
+			wantAttached:  true,
+			wantBody:      []string{"failed at", "Error: run interrupted"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.sesFrom, opts.sesTo = "refresher@example.com", stringList{"compliance@example.com"}
+			opts.report = filepath.Join(t.TempDir(), "report.json")
+			opts.reportFormat = "json"
+			opts.sesReportURI = tt.reportURI
+			if err := os.WriteFile(opts.report, []byte(report), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			uploader := &mockUploader{}
+			r := newRefresher(newFakeBucket().client(), opts, time.Now())
+			r.uploader = uploader
+
+			msg, err := r.reportEmail(context.Background(), tt.runErr, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC), tt.maxAttachment)
+			if err != nil {
+				t.Fatalf("reportEmail() error = %v", err)
+			}
+			if (msg.attachment != nil) != tt.wantAttached {
+				t.Errorf("attached = %v, want %v", msg.attachment != nil, tt.wantAttached)
+			}
+			if tt.wantAttached && string(msg.attachment.data) != report {
+				t.Errorf("attachment differs from the report")
+			}
+			if tt.wantUploaded == "" && len(uploader.keys) != 0 {
+				t.Errorf("uploaded %v, want nothing", uploader.keys)
+			}
+			if tt.wantUploaded != "" && (len(uploader.keys) != 1 || uploader.keys[0] != tt.wantUploaded || string(uploader.bodies[0]) != report) {
+				t.Errorf("uploaded %v, want the report at %s", uploader.keys, tt.wantUploaded)
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(msg.body, want) {
+					t.Errorf("body missing %q:\n%s", want, msg.body)
+				}
+			}
+
+			// The message always builds
+			raw, err := buildMIME(msg, time.Now())
+			if err != nil {
+				t.Fatalf("buildMIME() error = %v", err)
+			}
+			wantParts := 1
+			if tt.wantAttached {
+				wantParts = 2
+			}
+			if _, parts := parseMIME(t, raw); len(parts) != wantParts {
+				t.Errorf("message has %d parts, want %d", len(parts), wantParts)
+			}
+		})
+	}
+}
+
+func TestRunEmailsReport(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+
+	opts := testOptions()
+	opts.sesFrom, opts.sesTo = "refresher@example.com", stringList{"compliance@example.com"}
+	opts.report = filepath.Join(t.TempDir(), "report.csv")
+	opts.reportFormat = "csv"
+	ses := &mockSES{}
+	r := newRefresher(bucket.client(), opts, time.Now())
+	r.ses = ses
+	if err := r.runWithReport(context.Background()); err != nil {
+		t.Fatalf("runWithReport() error = %v", err)
+	}
+
+	if len(ses.inputs) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(ses.inputs))
+	}
+	in := ses.inputs[0]
+	if aws.ToString(in.FromEmailAddress) != "refresher@example.com" || strings.Join(in.Destination.ToAddresses, ",") != "compliance@example.com" {
+		t.Errorf("email from %s to %v", aws.ToString(in.FromEmailAddress), in.Destination.ToAddresses)
+	}
+	_, parts := parseMIME(t, in.Content.Raw.Data)
+	if len(parts) != 2 {
+		t.Fatalf("email has %d parts, want the body and the report", len(parts))
+	}
+	// The report was complete when attached
+	written, _ := os.ReadFile(opts.report)
+	if parts[1].contentType != "text/csv" || !bytes.Equal(parts[1].data, written) || !strings.Contains(string(written), "links/host1/data/ks/t/a.db") {
+		t.Errorf("attachment %s:\n%s\nwant the report:\n%s", parts[1].contentType, parts[1].data, written)
+	}
+
+	// A failed email fails an otherwise successful run
+	ses.err = errors.New("MessageRejected")
+	r = newRefresher(bucket.client(), opts, time.Now())
+	r.ses = ses
+	if err := r.runWithReport(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to send email") {
+		t.Errorf("runWithReport() error = %v, want the email failure", err)
+	}
+}
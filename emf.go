@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// defaultEMFNamespace is the CloudWatch namespace of the -emf metrics
+const defaultEMFNamespace = "MedusaRetentionRefresher"
+
+// emfMaxDimensions is the most dimensions an EMF dimension set may have
+const emfMaxDimensions = 30
+
+// Metrics of the -emf-progress records
+const (
+	emfObjectsProcessed = "ObjectsProcessed" // objects processed so far
+	emfObjectsPerSecond = "ObjectsPerSecond" // objects processed per second so far
+)
+
+// emfMetadata is the _aws member of an Embedded Metric Format record, telling
+// CloudWatch which of the record's members are metrics and dimensions
+type emfMetadata struct {
+	Timestamp         int64                `json:"Timestamp"` // milliseconds since the epoch
+	CloudWatchMetrics []emfMetricDirective `json:"CloudWatchMetrics"`
+}
+
+// emfMetricDirective lists the metrics of a record and their dimensions
+type emfMetricDirective struct {
+	Namespace  string                `json:"Namespace"`
+	Dimensions [][]string            `json:"Dimensions"`
+	Metrics    []emfMetricDefinition `json:"Metrics"`
+}
+
+// emfMetricDefinition names a metric member of a record and its unit
+type emfMetricDefinition struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// parseEMFDimensions parses -emf-dimensions entries of the form name=value
+func parseEMFDimensions(entries []string) ([]metricLabel, error) {
+	var dims []metricLabel
+	seen := map[string]bool{"Cluster": true, "Bucket": true}
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid -emf-dimensions entry %q: expected name=value", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("invalid -emf-dimensions entry %q: dimension %s is already set", entry, name)
+		}
+		seen[name] = true
+		dims = append(dims, metricLabel{name, value})
+	}
+	if len(seen) > emfMaxDimensions {
+		return nil, fmt.Errorf("-emf-dimensions sets %d dimensions, at most %d are allowed besides Cluster and Bucket", len(dims), emfMaxDimensions-2)
+	}
+	return dims, nil
+}
+
+// emfAttrs returns the log attributes turning a JSON log record into
+// Embedded Metric Format metrics, in -emf-namespace with Cluster, Bucket and
+// -emf-dimensions dimensions. The record's other members are left alone.
+func (r *refresher) emfAttrs(metrics []cloudWatchMetric, now time.Time) []any {
+	dims := append([]metricLabel{{"Cluster", r.opts.cluster}, {"Bucket", r.opts.bucket}}, r.opts.emfDims...)
+	directive := emfMetricDirective{Namespace: r.opts.emfNamespace, Dimensions: [][]string{{}}}
+	var members []any
+	for _, d := range dims {
+		directive.Dimensions[0] = append(directive.Dimensions[0], d.name)
+		members = append(members, d.name, d.value)
+	}
+	for _, m := range metrics {
+		directive.Metrics = append(directive.Metrics, emfMetricDefinition{Name: m.name, Unit: string(m.unit)})
+		members = append(members, m.name, m.value)
+	}
+	metadata := emfMetadata{Timestamp: now.UnixMilli(), CloudWatchMetrics: []emfMetricDirective{directive}}
+	return append([]any{"_aws", metadata}, members...)
+}
+
+// emfSummaryAttrs returns the -emf attributes of the run summary record
+func (r *refresher) emfSummaryAttrs(sum runSummary, now time.Time) []any {
+	if !r.opts.emf {
+		return nil
+	}
+	return r.emfAttrs(runCloudWatchMetrics(sum, now.Sub(r.stats.start)), now)
+}
+
+// emfProgressAttrs returns the -emf-progress attributes of a progress record
+func (r *refresher) emfProgressAttrs(p progressSnapshot, now time.Time) []any {
+	if !r.opts.emfProgress {
+		return nil
+	}
+	return r.emfAttrs([]cloudWatchMetric{
+		{emfObjectsProcessed, float64(p.objects), types.StandardUnitCount},
+		{emfObjectsPerSecond, p.rate(), types.StandardUnitCountSecond},
+	}, now)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// emfUnits are the units the Embedded Metric Format accepts
+var emfUnits = map[string]bool{
+	"Seconds": true, "Microseconds": true, "Milliseconds": true,
+	"Bytes": true, "Kilobytes": true, "Megabytes": true, "Gigabytes": true, "Terabytes": true,
+	"Bits": true, "Kilobits": true, "Megabits": true, "Gigabits": true, "Terabits": true,
+	"Percent": true, "Count": true,
+	"Bytes/Second": true, "Kilobytes/Second": true, "Megabytes/Second": true, "Gigabytes/Second": true, "Terabytes/Second": true,
+	"Bits/Second": true, "Kilobits/Second": true, "Megabits/Second": true, "Gigabits/Second": true, "Terabits/Second": true,
+	"Count/Second": true, "None": true,
+}
+
+// logRecords decodes JSON log lines, failing on any line that isn't a JSON object
+func logRecords(t *testing.T, logs string) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	scanner := bufio.NewScanner(strings.NewReader(logs))
+	for scanner.Scan() {
+		var rec map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid log line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// checkEMF checks that rec is a valid Embedded Metric Format record and
+// returns its metric values by name
+func checkEMF(t *testing.T, rec map[string]any) map[string]float64 {
+	t.Helper()
+	metadata, ok := rec["_aws"].(map[string]any)
+	if !ok {
+		t.Fatalf("record %v has no _aws object", rec)
+	}
+	ts, ok := metadata["Timestamp"].(float64)
+	if !ok || ts != math.Trunc(ts) || ts <= 0 {
+		t.Errorf("_aws.Timestamp = %v, want milliseconds since the epoch", metadata["Timestamp"])
+	}
+	directives, ok := metadata["CloudWatchMetrics"].([]any)
+	if !ok || len(directives) == 0 {
+		t.Fatalf("_aws.CloudWatchMetrics = %v, want a non-empty array", metadata["CloudWatchMetrics"])
+	}
+
+	values := make(map[string]float64)
+	for _, d := range directives {
+		directive, ok := d.(map[string]any)
+		if !ok {
+			t.Fatalf("directive %v isn't an object", d)
+		}
+		if ns, _ := directive["Namespace"].(string); ns == "" {
+			t.Errorf("directive Namespace = %v, want a non-empty string", directive["Namespace"])
+		}
+		sets, ok := directive["Dimensions"].([]any)
+		if !ok {
+			t.Fatalf("directive Dimensions = %v, want an array", directive["Dimensions"])
+		}
+		for _, s := range sets {
+			set, ok := s.([]any)
+			if !ok || len(set) == 0 || len(set) > emfMaxDimensions {
+				t.Fatalf("dimension set %v, want 1 to %d names", s, emfMaxDimensions)
+			}
+			for _, name := range set {
+				key, _ := name.(string)
+				if _, ok := rec[key].(string); !ok {
+					t.Errorf("dimension %v has no string member in the record", name)
+				}
+			}
+		}
+		metrics, ok := directive["Metrics"].([]any)
+		if !ok || len(metrics) == 0 || len(metrics) > 100 {
+			t.Fatalf("directive Metrics = %v, want 1 to 100 metrics", directive["Metrics"])
+		}
+		for _, m := range metrics {
+			def, _ := m.(map[string]any)
+			name, _ := def["Name"].(string)
+			value, ok := rec[name].(float64)
+			if !ok {
+				t.Errorf("metric %v has no numeric member in the record", m)
+			}
+			if unit, ok := def["Unit"].(string); ok && !emfUnits[unit] {
+				t.Errorf("metric %s unit = %q, not a CloudWatch unit", name, unit)
+			}
+			values[name] = value
+		}
+	}
+	return values
+}
+
+func TestEMFSummary(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+
+	opts := testOptions()
+	opts.logFormat = "json"
+	opts.emf = true
+	opts.emfNamespace = "Medusa"
+	opts.emfDims = []metricLabel{{"Environment", "prod"}}
+	r := newRefresher(bucket.client(), opts, time.Now())
+	logs := captureLog("json", slog.LevelInfo, func() {
+		if err := r.run(context.Background()); err != nil {
+			t.Fatalf("run() error = %v", err)
+		}
+	})
+
+	var summary map[string]any
+	for _, rec := range logRecords(t, logs) {
+		switch rec["msg"] {
+		case "Run summary":
+			summary = rec
+		default:
+			if _, ok := rec["_aws"]; ok {
+				t.Errorf("%q record has EMF metadata", rec["msg"])
+			}
+		}
+	}
+	if summary == nil {
+		t.Fatalf("no run summary logged:\n%s", logs)
+	}
+	values := checkEMF(t, summary)
+	want := map[string]float64{
+		cloudWatchObjectsUpdated:     2,
+		cloudWatchObjectsFailed:      0,
+		cloudWatchObjectsMissing:     0,
+		cloudWatchManifestsProcessed: 1,
+	}
+	for name, v := range want {
+		if got, ok := values[name]; !ok || got != v {
+			t.Errorf("metric %s = %v, want %v", name, got, v)
+		}
+	}
+	if _, ok := values[cloudWatchRunDuration]; !ok {
+		t.Errorf("no %s metric", cloudWatchRunDuration)
+	}
+	directive := summary["_aws"].(map[string]any)["CloudWatchMetrics"].([]any)[0].(map[string]any)
+	if ns := directive["Namespace"]; ns != "Medusa" {
+		t.Errorf("namespace = %v, want Medusa", ns)
+	}
+	for name, v := range map[string]string{"Cluster": "links", "Bucket": "test-bucket", "Environment": "prod"} {
+		if summary[name] != v {
+			t.Errorf("dimension %s = %v, want %s", name, summary[name], v)
+		}
+	}
+	// Plain JSON log consumers still find the usual members
+	if summary["updated"] != float64(2) || summary["elapsed"] == nil {
+		t.Errorf("summary lost its plain members: %v", summary)
+	}
+}
+
+func TestEMFProgress(t *testing.T) {
+	opts := testOptions()
+	opts.emf, opts.emfProgress = true, true
+	opts.emfNamespace = defaultEMFNamespace
+	r := newRefresher(newFakeBucket().client(), opts, time.Now())
+	p := progressSnapshot{objects: 30, totalObjects: 100, elapsed: 10 * time.Second}
+
+	logs := captureLog("json", slog.LevelInfo, func() { logProgress(p, r.emfProgressAttrs(p, time.Now())...) })
+	records := logRecords(t, logs)
+	if len(records) != 1 {
+		t.Fatalf("logged %d records, want 1", len(records))
+	}
+	values := checkEMF(t, records[0])
+	if values[emfObjectsProcessed] != 30 || values[emfObjectsPerSecond] != 3 {
+		t.Errorf("progress metrics = %v, want 30 objects at 3 per second", values)
+	}
+
+	// Without -emf-progress, progress records are plain
+	opts.emfProgress = false
+	if attrs := r.emfProgressAttrs(p, time.Now()); attrs != nil {
+		t.Errorf("emfProgressAttrs() = %v without -emf-progress, want none", attrs)
+	}
+}
+
+func TestParseEMFDimensions(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    []metricLabel
+		wantErr string
+	}{
+		{entries: nil},
+		{entries: []string{"Environment=prod", " Team = data "}, want: []metricLabel{{"Environment", "prod"}, {"Team", "data"}}},
+		{entries: []string{"Environment"}, wantErr: "expected name=value"},
+		{entries: []string{"=prod"}, wantErr: "expected name=value"},
+		{entries: []string{"Team=a", "Team=b"}, wantErr: "already set"},
+		{entries: []string{"Bucket=other"}, wantErr: "already set"},
+	}
+	for _, tt := range tests {
+		got, err := parseEMFDimensions(tt.entries)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseEMFDimensions(%q) error = %v, want %q", tt.entries, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseEMFDimensions(%q) error = %v", tt.entries, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseEMFDimensions(%q) = %v, want %v", tt.entries, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseEMFDimensions(%q) = %v, want %v", tt.entries, got, tt.want)
+			}
+		}
+	}
+}
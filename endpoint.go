@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// errCustomEndpoint rejects -use-fips and -use-dualstack with an endpoint
+// that isn't AWS's
+var errCustomEndpoint = errors.New("-use-fips and -use-dualstack can't be used with a custom S3 endpoint (AWS_ENDPOINT_URL_S3, AWS_ENDPOINT_URL or endpoint_url in the -profile config)")
+
+// withEndpointOptions sets the S3 endpoint variants of -use-fips and
+// -use-dualstack
+func withEndpointOptions(c commonOptions) func(*s3.Options) {
+	return func(o *s3.Options) {
+		if c.useFIPS {
+			o.EndpointOptions.UseFIPSEndpoint = aws.FIPSEndpointStateEnabled
+		}
+		if c.useDualStack {
+			o.EndpointOptions.UseDualStackEndpoint = aws.DualStackEndpointStateEnabled
+		}
+	}
+}
+
+// checkEndpointOptions rejects -use-fips and -use-dualstack on a client
+// with a custom endpoint, which the SDK would otherwise refuse at the first
+// request
+func checkEndpointOptions(client *s3.Client, c commonOptions) error {
+	if (c.useFIPS || c.useDualStack) && client.Options().BaseEndpoint != nil {
+		return errCustomEndpoint
+	}
+	return nil
+}
+
+// logEndpoint logs the endpoint S3 requests to bucket are sent to, and
+// whether it is a FIPS, dual-stack or custom one
+func logEndpoint(ctx context.Context, client *s3.Client, bucket string) {
+	o := client.Options()
+	params := s3.EndpointParameters{
+		Bucket:         aws.String(bucket),
+		Region:         aws.String(o.Region),
+		UseFIPS:        aws.Bool(o.EndpointOptions.UseFIPSEndpoint == aws.FIPSEndpointStateEnabled),
+		UseDualStack:   aws.Bool(o.EndpointOptions.UseDualStackEndpoint == aws.DualStackEndpointStateEnabled),
+		Endpoint:       o.BaseEndpoint,
+		ForcePathStyle: aws.Bool(o.UsePathStyle),
+	}
+	attrs := []any{"region", o.Region, "fips", *params.UseFIPS, "dualstack", *params.UseDualStack, "custom", o.BaseEndpoint != nil}
+	endpoint, err := o.EndpointResolverV2.ResolveEndpoint(ctx, params)
+	if err != nil {
+		slog.Warn("Failed to resolve the S3 endpoint", append(attrs, "error", err.Error())...)
+		return
+	}
+	slog.Info("Resolved S3 endpoint", append([]any{"url", endpoint.URI.String()}, attrs...)...)
+}
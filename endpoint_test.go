@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestNewS3ClientEndpointOptions(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	tests := []struct {
+		name          string
+		opts          commonOptions
+		endpointURL   string
+		wantFIPS      aws.FIPSEndpointState
+		wantDualStack aws.DualStackEndpointState
+		wantURL       string
+		wantErr       error
+	}{
+		{
+			name:    "defaults",
+			opts:    commonOptions{region: "us-gov-west-1"},
+			wantURL: "https://my-backups.s3.us-gov-west-1.amazonaws.com",
+		},
+		{
+			name:     "fips",
+			opts:     commonOptions{region: "us-gov-west-1", useFIPS: true},
+			wantFIPS: aws.FIPSEndpointStateEnabled,
+			wantURL:  "https://my-backups.s3-fips.us-gov-west-1.amazonaws.com",
+		},
+		{
+			name:          "dualstack",
+			opts:          commonOptions{region: "eu-west-1", useDualStack: true},
+			wantDualStack: aws.DualStackEndpointStateEnabled,
+			wantURL:       "https://my-backups.s3.dualstack.eu-west-1.amazonaws.com",
+		},
+		{
+			name:          "fips and dualstack",
+			opts:          commonOptions{region: "us-gov-west-1", useFIPS: true, useDualStack: true},
+			wantFIPS:      aws.FIPSEndpointStateEnabled,
+			wantDualStack: aws.DualStackEndpointStateEnabled,
+			wantURL:       "https://my-backups.s3-fips.dualstack.us-gov-west-1.amazonaws.com",
+		},
+		{
+			name:        "custom endpoint",
+			opts:        commonOptions{region: "eu-west-1"},
+			endpointURL: "https://s3.storage.internal",
+			wantURL:     "https://my-backups.s3.storage.internal",
+		},
+		{
+			name:        "fips with custom endpoint",
+			opts:        commonOptions{region: "us-gov-west-1", useFIPS: true},
+			endpointURL: "https://s3.storage.internal",
+			wantErr:     errCustomEndpoint,
+		},
+		{
+			name:        "dualstack with custom endpoint",
+			opts:        commonOptions{region: "eu-west-1", useDualStack: true},
+			endpointURL: "https://s3.storage.internal",
+			wantErr:     errCustomEndpoint,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_ENDPOINT_URL_S3", tt.endpointURL)
+			client, err := newS3Client(context.Background(), tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("newS3Client() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			o := client.Options()
+			if o.EndpointOptions.UseFIPSEndpoint != tt.wantFIPS || o.EndpointOptions.UseDualStackEndpoint != tt.wantDualStack {
+				t.Errorf("EndpointOptions = %+v, want FIPS %v and dual-stack %v", o.EndpointOptions, tt.wantFIPS, tt.wantDualStack)
+			}
+			logged := captureLog("text", slog.LevelInfo, func() { logEndpoint(context.Background(), client, "my-backups") })
+			if !strings.Contains(logged, "Resolved S3 endpoint") || !strings.Contains(logged, "url="+tt.wantURL+" ") {
+				t.Errorf("logEndpoint() logged %q, want %s", logged, tt.wantURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// Error classes attached to logged errors
+const (
+	errorClassAccessDenied = "access_denied"
+	errorClassNotFound     = "not_found"
+	errorClassThrottled    = "throttled"
+	errorClassCanceled     = "canceled"
+	errorClassProxy        = "proxy"
+	errorClassEncryption   = "encryption"
+	errorClassOther        = "other"
+)
+
+// exitStaleBackups is the exit status of a run failed by -fail-on-stale-backups,
+// so monitoring can tell stale backups apart from a failed refresh (status 1)
+const exitStaleBackups = 3
+
+// exitLocked is the exit status of a run that didn't start because another
+// one holds -lock-key, so schedulers can tell it apart from a failed run
+const exitLocked = 4
+
+// exitError is an error that ends the process with a specific exit status
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// exitCode returns the exit status for an error returned by execute
+func exitCode(err error) int {
+	var exit *exitError
+	if errors.As(err, &exit) {
+		return exit.code
+	}
+	return 1
+}
+
+// errorDetails describes an error for logs and reports: its class and, for
+// errors of an AWS response, the request IDs AWS support asks for and the
+// HTTP status
+type errorDetails struct {
+	class             string
+	requestID         string
+	extendedRequestID string // S3's x-amz-id-2 host ID
+	httpStatus        int
+}
+
+// describeError returns the details of err
+func describeError(err error) errorDetails {
+	d := errorDetails{class: errorClass(err)}
+	var withRequestID interface{ ServiceRequestID() string }
+	if errors.As(err, &withRequestID) {
+		d.requestID = withRequestID.ServiceRequestID()
+	}
+	var withHostID interface{ ServiceHostID() string }
+	if errors.As(err, &withHostID) {
+		d.extendedRequestID = withHostID.ServiceHostID()
+	}
+	var withStatus interface{ HTTPStatusCode() int }
+	if errors.As(err, &withStatus) {
+		d.httpStatus = withStatus.HTTPStatusCode()
+	}
+	return d
+}
+
+// errorClass classifies err by its S3 error code in the -provider-compat
+// table of the client it came from, falling back to the error text for
+// errors that don't carry one
+func errorClass(err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return errorClassCanceled
+	}
+	if errors.Is(err, errSSECKeyRejected) {
+		return errorClassEncryption
+	}
+
+	if strings.Contains(err.Error(), "proxyconnect") {
+		return errorClassProxy
+	}
+	var apiErr smithy.APIError
+	// Objects encrypted with SSE-C can't be read without the key
+	if errors.As(err, &apiErr) && strings.Contains(apiErr.ErrorMessage(), "Server Side Encryption") {
+		return errorClassEncryption
+	}
+
+	code, provider := errorCode(err), errorProvider(err)
+	switch {
+	case matchesCode(code, provider.accessDenied):
+		return errorClassAccessDenied
+	case matchesCode(code, provider.notFound):
+		return errorClassNotFound
+	case matchesCode(code, provider.throttled):
+		return errorClassThrottled
+	}
+	return errorClassOther
+}
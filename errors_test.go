@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "api access denied", err: &smithy.GenericAPIError{Code: "AccessDenied"}, want: errorClassAccessDenied},
+		{name: "wrapped api not found", err: fmt.Errorf("failed to get object: %w", &smithy.GenericAPIError{Code: "NoSuchKey"}), want: errorClassNotFound},
+		{name: "api throttled", err: &smithy.GenericAPIError{Code: "SlowDown"}, want: errorClassThrottled},
+		{name: "plain text", err: errors.New("AccessDenied: Access Denied"), want: errorClassAccessDenied},
+		{name: "canceled", err: fmt.Errorf("request failed: %w", context.Canceled), want: errorClassCanceled},
+		{name: "proxy", err: errors.New("proxyconnect tcp: dial tcp 10.0.0.1:3128: connect: connection refused"), want: errorClassProxy},
+		{name: "other", err: errors.New("connection reset by peer"), want: errorClassOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorClass(tt.err); got != tt.want {
+				t.Errorf("errorClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// s3ResponseError returns the error of a PutObjectRetention S3 answers with
+// status, headers and body
+func s3ResponseError(t *testing.T, status int, headers map[string]string, body string) error {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	cfg, err := loadAWSConfig(context.Background(), commonOptions{region: "eu-west-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.RetryMaxAttempts = 1
+		o.HTTPClient = httpClientFunc(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			for name, value := range headers {
+				header.Set(name, value)
+			}
+			return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+		})
+	})
+	_, err = client.PutObjectRetention(context.Background(), &s3.PutObjectRetentionInput{Bucket: aws.String("my-backups"), Key: aws.String("prod/host1/data/ks/t/a.db")})
+	if err == nil {
+		t.Fatal("PutObjectRetention() succeeded")
+	}
+	return fmt.Errorf("failed to put object retention: %w", err)
+}
+
+// httpClientFunc is an aws.HTTPClient answering with a function
+type httpClientFunc func(req *http.Request) (*http.Response, error)
+
+func (f httpClientFunc) Do(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestDescribeError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  func(t *testing.T) error
+		want errorDetails
+	}{
+		{
+			name: "access denied",
+			err: func(t *testing.T) error {
+				return s3ResponseError(t, http.StatusForbidden,
+					map[string]string{"x-amz-request-id": "4442587FB7D0A2F9", "x-amz-id-2": "vlR7PnpV2Ce81l0PRw6jlUpck7Jo5ZsQjryTjKlc5aLWGVHPZLj5NeC6qMa0emYBDXOo6QBU0Wo="},
+					`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message><RequestId>4442587FB7D0A2F9</RequestId><HostId>vlR7PnpV2Ce81l0PRw6jlUpck7Jo5ZsQjryTjKlc5aLWGVHPZLj5NeC6qMa0emYBDXOo6QBU0Wo=</HostId></Error>`)
+			},
+			want: errorDetails{class: errorClassAccessDenied, requestID: "4442587FB7D0A2F9", extendedRequestID: "vlR7PnpV2Ce81l0PRw6jlUpck7Jo5ZsQjryTjKlc5aLWGVHPZLj5NeC6qMa0emYBDXOo6QBU0Wo=", httpStatus: http.StatusForbidden},
+		},
+		{
+			name: "throttled",
+			err: func(t *testing.T) error {
+				return s3ResponseError(t, http.StatusServiceUnavailable,
+					map[string]string{"x-amz-request-id": "0A49CE4060975EAC", "x-amz-id-2": "MzRISOwyjmnup0A49CE4060975EAC"},
+					`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`)
+			},
+			want: errorDetails{class: errorClassThrottled, requestID: "0A49CE4060975EAC", extendedRequestID: "MzRISOwyjmnup0A49CE4060975EAC", httpStatus: http.StatusServiceUnavailable},
+		},
+		{
+			name: "not an AWS response",
+			err:  func(t *testing.T) error { return errors.New("connection reset by peer") },
+			want: errorDetails{class: errorClassOther},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.err(t)
+			if got := describeError(err); got != tt.want {
+				t.Errorf("describeError(%v) = %+v, want %+v", err, got, tt.want)
+			}
+
+			data, jsonErr := json.Marshal(newReportRecord(time.Now(), "", "prod/host1/data/ks/t/a.db", objectResult{action: actionError, err: err}))
+			if jsonErr != nil {
+				t.Fatal(jsonErr)
+			}
+			var rec map[string]any
+			if err := json.Unmarshal(data, &rec); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want.requestID == "" {
+				if _, ok := rec["request_id"]; ok {
+					t.Errorf("report record = %s, want no request_id", data)
+				}
+				return
+			}
+			if rec["request_id"] != tt.want.requestID || rec["extended_request_id"] != tt.want.extendedRequestID || rec["http_status"] != float64(tt.want.httpStatus) {
+				t.Errorf("report record = %s, want the request IDs and status", data)
+			}
+		})
+	}
+}
+
+func TestErrorAttrsRequestIDs(t *testing.T) {
+	err := s3ResponseError(t, http.StatusForbidden, map[string]string{"x-amz-request-id": "4442587FB7D0A2F9", "x-amz-id-2": "vlR7PnpV2Ce81l0PRw6j"}, `<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+	logged := captureLog("json", 0, func() { slog.Error("Error updating retention", errorAttrs(err)...) })
+	for _, want := range []string{`"error_class":"access_denied"`, `"request_id":"4442587FB7D0A2F9"`, `"extended_request_id":"vlR7PnpV2Ce81l0PRw6j"`, `"http_status":403`} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("logged %s, want %s", logged, want)
+		}
+	}
+}
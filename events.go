@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Lifecycle events emitted with -output ndjson. Object events are named
+// after the object action, e.g. object_updated or object_skipped.
+const (
+	eventManifestStarted = "manifest_started"
+	eventRunSummary      = "run_summary"
+)
+
+// manifestEvent is emitted when processing of a manifest starts
+type manifestEvent struct {
+	Event    string    `json:"event"`
+	RunID    string    `json:"run_id"`
+	Time     time.Time `json:"time"`
+	Manifest string    `json:"manifest"`
+}
+
+// objectEvent is emitted for every processed object and carries the same
+// fields as a -report record
+type objectEvent struct {
+	Event string `json:"event"`
+	RunID string `json:"run_id"`
+	reportRecord
+}
+
+// summaryEvent is emitted once at the end of a run
+type summaryEvent struct {
+	Event string    `json:"event"`
+	RunID string    `json:"run_id"`
+	Time  time.Time `json:"time"`
+	runSummary
+}
+
+// eventStream writes lifecycle events as newline-delimited JSON to w, and to
+// -firehose-stream when set. It is safe for concurrent use.
+type eventStream struct {
+	mu       sync.Mutex
+	w        io.Writer // nil when only sending to -firehose-stream
+	runID    string
+	failed   bool
+	firehose *firehoseBatcher // nil without -firehose-stream
+}
+
+func newEventStream(w io.Writer, runID string) *eventStream {
+	return &eventStream{w: w, runID: runID}
+}
+
+// emit writes one event. Only the first write error is logged so a closed
+// stdout doesn't flood the logs.
+func (e *eventStream) emit(ev any) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		slog.Error("Error encoding event", "error", err.Error())
+		return
+	}
+	line = append(line, '\n')
+	if e.firehose != nil {
+		e.firehose.add(line)
+	}
+	if e.w == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.w.Write(line); err != nil && !e.failed {
+		e.failed = true
+		slog.Error("Error writing event", "error", err.Error())
+	}
+}
+
+func (e *eventStream) manifestStarted(now time.Time, manifest string) {
+	e.emit(manifestEvent{Event: eventManifestStarted, RunID: e.runID, Time: now.UTC(), Manifest: manifest})
+}
+
+func (e *eventStream) object(rec reportRecord) {
+	e.emit(objectEvent{Event: "object_" + string(rec.Action), RunID: e.runID, reportRecord: rec})
+}
+
+func (e *eventStream) summary(now time.Time, sum runSummary) {
+	e.emit(summaryEvent{Event: eventRunSummary, RunID: e.runID, Time: now.UTC(), runSummary: sum})
+}
+
+// keyPrinter writes the keys changed by a run to stdout, one bare key per
+// line and each key once, for -print-updated
+type keyPrinter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	printed map[string]struct{}
+}
+
+func newKeyPrinter(w io.Writer) *keyPrinter {
+	return &keyPrinter{w: w, printed: make(map[string]struct{})}
+}
+
+// print writes key if action changed, or would change in dry-run mode, its retention or legal hold
+func (p *keyPrinter) print(key string, action objectAction) {
+	switch action {
+	case actionUpdated, actionWouldUpdate, actionReduced, actionWouldReduce:
+	default:
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.printed[key]; ok {
+		return
+	}
+	p.printed[key] = struct{}{}
+	fmt.Fprintln(p.w, key)
+}
+
+// validateOutput checks the -output flag value and that only one option writes to stdout
+func validateOutput(output string, printUpdated bool) error {
+	if output != "" && output != "ndjson" {
+		return fmt.Errorf("invalid -output %q: must be ndjson", output)
+	}
+	if output != "" && printUpdated {
+		return errors.New("-output and -print-updated both write to stdout")
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStream(t *testing.T) {
+	var out bytes.Buffer
+	r := newRefresher(statsBucket(), testOptions(), time.Now())
+	r.events = newEventStream(&out, "run-1")
+
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	required := map[string][]string{
+		"manifest_started": {"event", "run_id", "time", "manifest"},
+		"object_updated":   {"event", "run_id", "time", "key", "manifest", "action", "previous_retain_until", "new_retain_until", "mode"},
+		"object_skipped":   {"event", "run_id", "time", "key", "manifest", "action", "previous_retain_until", "new_retain_until", "mode"},
+		"object_missing":   {"event", "run_id", "time", "key", "manifest", "action"},
+		"object_error":     {"event", "run_id", "time", "key", "manifest", "action", "error", "error_class"},
+		"run_summary":      {"event", "run_id", "time", "manifests_found", "updated", "errors", "errors_by_class", "elapsed"},
+	}
+
+	seen := make(map[string]int)
+	var last string
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var ev map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("event %q is not JSON: %v", scanner.Text(), err)
+		}
+		name, _ := ev["event"].(string)
+		if ev["run_id"] != "run-1" {
+			t.Errorf("event %v has run_id %v, want run-1", ev, ev["run_id"])
+		}
+		for _, field := range required[name] {
+			if _, ok := ev[field]; !ok {
+				t.Errorf("%s event %v lacks %q", name, ev, field)
+			}
+		}
+		seen[name]++
+		last = name
+	}
+
+	for name := range required {
+		if seen[name] == 0 {
+			t.Errorf("no %s event emitted, got %v", name, seen)
+		}
+	}
+	if seen["manifest_started"] != 3 || seen["run_summary"] != 1 {
+		t.Errorf("events = %v, want 3 manifest_started and 1 run_summary", seen)
+	}
+	if last != "run_summary" {
+		t.Errorf("last event = %q, want run_summary", last)
+	}
+}
+
+func TestPrintUpdated(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dry-run=%v", dryRun), func(t *testing.T) {
+			var stdout bytes.Buffer
+			opts := testOptions()
+			opts.dryRun = dryRun
+			r := newRefresher(statsBucket(), opts, time.Now())
+			r.updated = newKeyPrinter(&stdout)
+
+			stderr := captureLog("text", slog.LevelInfo, func() {
+				if err := r.run(context.Background()); err != nil {
+					t.Fatalf("run() error = %v", err)
+				}
+			})
+
+			// a.db is shared by two backups but listed once
+			want := []string{"links/host1/data/ks/t/a.db", "links/host1/data/ks/t/c.db"}
+			got := strings.Fields(stdout.String())
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, want) || strings.Count(stdout.String(), "\n") != len(want) {
+				t.Errorf("stdout = %q, want only the keys %v", stdout.String(), want)
+			}
+			for _, msg := range []string{"Processing manifest", "Object not found", "Run summary"} {
+				if !strings.Contains(stderr, msg) {
+					t.Errorf("logs lack %q:\n%s", msg, stderr)
+				}
+			}
+		})
+	}
+}
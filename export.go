@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exportedObject is one -export-objects line: an object of a backup with its
+// full key resolved the way the refresh resolves it
+type exportedObject struct {
+	Manifest string `json:"manifest"`
+	Key      string `json:"key"`
+	Size     int64  `json:"size"`
+	Keyspace string `json:"keyspace"`
+	Table    string `json:"table"`
+	Index    string `json:"index,omitempty"`
+}
+
+// objectExport writes the objects of every processed backup for
+// -export-objects, either all to one file or to one file per backup
+type objectExport struct {
+	path string
+	dir  bool     // one [hostname]/[backup_name].jsonl file per backup under path
+	f    *os.File // the single file, nil when dir is set
+	enc  *json.Encoder
+
+	manifests, objects int // written so far
+}
+
+// isExportDir reports whether the -export-objects value names a directory:
+// it ends in a slash or is an existing directory
+func isExportDir(path string) bool {
+	if strings.HasSuffix(path, "/") || strings.HasSuffix(path, string(filepath.Separator)) {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// openObjectExport prepares path for -export-objects, creating the file or
+// the directory
+func openObjectExport(path string) (*objectExport, error) {
+	e := &objectExport{path: path, dir: isExportDir(path)}
+	if e.dir {
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create export directory: %w", err)
+		}
+		return e, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export file: %w", err)
+	}
+	e.f, e.enc = f, json.NewEncoder(f)
+	return e, nil
+}
+
+// export writes every object of the manifest m, whose data files are stored
+// under hostnamePath, as listed and regardless of the object filters
+func (e *objectExport) export(m ManifestInfo, manifest *Manifest, hostnamePath string) error {
+	e.manifests++
+	e.objects += len(manifest.Objects)
+	if !e.dir {
+		return encodeObjects(e.enc, m, manifest, hostnamePath)
+	}
+	mp, err := m.path()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(e.path, mp.Host, mp.Backup+".jsonl")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create export directory: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %w", err)
+	}
+	if err := encodeObjects(json.NewEncoder(f), m, manifest, hostnamePath); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close export file: %w", err)
+	}
+	return nil
+}
+
+// encodeObjects writes one exportedObject line per object of manifest
+func encodeObjects(enc *json.Encoder, m ManifestInfo, manifest *Manifest, hostnamePath string) error {
+	for _, obj := range manifest.Objects {
+		line := exportedObject{
+			Manifest: m.Key,
+			Key:      resolveObjectKey(hostnamePath, obj.Path),
+			Size:     obj.Size,
+			Keyspace: obj.Keyspace,
+			Table:    obj.ColumnFamily,
+			Index:    obj.Index,
+		}
+		if err := enc.Encode(line); err != nil {
+			return fmt.Errorf("failed to write exported objects: %w", err)
+		}
+	}
+	return nil
+}
+
+// close closes the single export file, once
+func (e *objectExport) close() error {
+	if e.f == nil {
+		return nil
+	}
+	f := e.f
+	e.f = nil
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close export file: %w", err)
+	}
+	return nil
+}
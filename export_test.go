@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readExport reads the exportedObject lines of an -export-objects file
+func readExport(t *testing.T, path string) []exportedObject {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open export: %v", err)
+	}
+	defer f.Close()
+	var objects []exportedObject
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var obj exportedObject
+		if err := json.Unmarshal(scanner.Bytes(), &obj); err != nil {
+			t.Fatalf("invalid export line %q: %v", scanner.Text(), err)
+		}
+		objects = append(objects, obj)
+	}
+	return objects
+}
+
+func TestExportObjects(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		data   string
+	}{
+		{
+			name: "old format",
+			// Paths are relative to [prefix][cluster]/[hostname]/
+			data: `[{"keyspace":"app","columnfamily":"users","objects":[
+				{"path":"data/app/users-1a2b/nb-1-big-Data.db","size":100},
+				{"path":"data/app/users-1a2b/.users_email_idx/nb-2-big-Data.db","size":20}]}]`,
+		},
+		{
+			name: "new format",
+			// Paths already include [prefix][cluster]/[hostname]/
+			data: `[{"keyspace":"app","columnfamily":"users","objects":[
+				{"path":"links/host1/data/app/users-1a2b/nb-1-big-Data.db","size":100},
+				{"path":"links/host1/data/app/users-1a2b/.users_email_idx/nb-2-big-Data.db","size":20}]}]`,
+		},
+		{
+			name:   "old format with prefix",
+			prefix: "backups/",
+			data: `[{"keyspace":"app","columnfamily":"users","objects":[
+				{"path":"data/app/users-1a2b/nb-1-big-Data.db","size":100},
+				{"path":"data/app/users-1a2b/.users_email_idx/nb-2-big-Data.db","size":20}]}]`,
+		},
+		{
+			name:   "new format with prefix",
+			prefix: "backups/",
+			data: `[{"keyspace":"app","columnfamily":"users","objects":[
+				{"path":"backups/links/host1/data/app/users-1a2b/nb-1-big-Data.db","size":100},
+				{"path":"backups/links/host1/data/app/users-1a2b/.users_email_idx/nb-2-big-Data.db","size":20}]}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest, err := parseManifest([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("parseManifest() error = %v", err)
+			}
+			m := ManifestInfo{Key: tt.prefix + "links/host1/backup1/meta/manifest.json", Prefix: tt.prefix}
+			hostnamePath := tt.prefix + "links/host1/"
+			want := []exportedObject{
+				{Manifest: m.Key, Key: hostnamePath + "data/app/users-1a2b/nb-1-big-Data.db", Size: 100, Keyspace: "app", Table: "users"},
+				{Manifest: m.Key, Key: hostnamePath + "data/app/users-1a2b/.users_email_idx/nb-2-big-Data.db", Size: 20, Keyspace: "app", Table: "users", Index: "users_email_idx"},
+			}
+
+			path := filepath.Join(t.TempDir(), "objects.jsonl")
+			e, err := openObjectExport(path)
+			if err != nil {
+				t.Fatalf("openObjectExport() error = %v", err)
+			}
+			if err := e.export(m, manifest, hostnamePath); err != nil {
+				t.Fatalf("export() error = %v", err)
+			}
+			if err := e.close(); err != nil {
+				t.Fatalf("close() error = %v", err)
+			}
+			if got := readExport(t, path); !reflect.DeepEqual(got, want) {
+				t.Errorf("exported %+v, want %+v", got, want)
+			}
+
+			// A directory gets one file per backup
+			dir := t.TempDir()
+			e, err = openObjectExport(dir)
+			if err != nil {
+				t.Fatalf("openObjectExport() error = %v", err)
+			}
+			if err := e.export(m, manifest, hostnamePath); err != nil {
+				t.Fatalf("export() error = %v", err)
+			}
+			if got := readExport(t, filepath.Join(dir, "host1", "backup1.jsonl")); !reflect.DeepEqual(got, want) {
+				t.Errorf("exported %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestIsExportDir(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: dir, want: true},
+		{path: filepath.Join(dir, "new") + "/", want: true},
+		{path: filepath.Join(dir, "objects.jsonl"), want: false},
+	}
+	for _, tt := range tests {
+		if got := isExportDir(tt.path); got != tt.want {
+			t.Errorf("isExportDir(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRunExportObjectsOffline(t *testing.T) {
+	opts := testOptions()
+	opts.localManifests = localManifestsDir
+	opts.offline = true
+	opts.dryRun = true
+	opts.exportObjects = t.TempDir() + "/"
+	// Objects are exported before the object filters
+	opts.filter.components = stringList{"Index.db"}
+
+	r := newRefresher(offlineClient(t), opts, time.Now())
+	r.offline = newOfflinePlan(io.Discard)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		host, backup string
+		keys         []string
+	}{
+		{host: "host1", backup: "medusa-backup-schedule-1710000000", keys: []string{
+			"links/host1/data/app/users/nb-1-big-Data.db",
+			"links/host1/data/app/users/nb-2-big-Data.db",
+		}},
+		{host: "host2", backup: "medusa-backup-schedule-1710000000", keys: []string{
+			"links/host2/data/app/users/nb-7-big-Data.db",
+		}},
+		{host: "host1", backup: "medusa-backup-schedule-1700000000", keys: []string{
+			"links/host1/data/app/users/nb-1-big-Data.db",
+			"links/host1/data/app/users/nb-1-big-Index.db",
+		}},
+	} {
+		var keys []string
+		for _, obj := range readExport(t, filepath.Join(opts.exportObjects, tt.host, tt.backup+".jsonl")) {
+			keys = append(keys, obj.Key)
+			if obj.Keyspace != "app" || obj.Table != "users" || obj.Size == 0 {
+				t.Errorf("exported %+v, want the keyspace, table and size of the manifest", obj)
+			}
+		}
+		if !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("exported %s/%s keys %v, want %v", tt.host, tt.backup, keys, tt.keys)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// normalizeExtraPrefix checks an -extra-prefixes entry, which is relative to
+// each host's [prefix][cluster]/[hostname]/ directory, and ends it in a slash
+func normalizeExtraPrefix(prefix string) (string, error) {
+	if strings.HasPrefix(prefix, "/") {
+		return "", fmt.Errorf("-extra-prefixes %q must be relative to the host directory", prefix)
+	}
+	cleaned := path.Clean(prefix)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("-extra-prefixes %q must be below the host directory", prefix)
+	}
+	return cleaned + "/", nil
+}
+
+// hostPaths keeps the manifests' [prefix][cluster]/[hostname]/ directories
+// in the order they're first seen
+type hostPaths struct {
+	paths []string
+	seen  map[string]bool
+}
+
+// add records hostnamePath unless it was already seen
+func (h *hostPaths) add(hostnamePath string) {
+	if h.seen == nil {
+		h.seen = make(map[string]bool)
+	}
+	if h.seen[hostnamePath] {
+		return
+	}
+	h.seen[hostnamePath] = true
+	h.paths = append(h.paths, hostnamePath)
+}
+
+// refreshExtraPrefixes applies the retention policy to every object under
+// the -extra-prefixes of each processed host, e.g. commitlog archives that no
+// manifest references. Objects are counted per prefix; -older-than/-newer-than
+// skips are added to skippedByFilter.
+func (r *refresher) refreshExtraPrefixes(ctx context.Context, hosts []string, skippedByFilter map[string]int) {
+	for _, hostnamePath := range hosts {
+		for _, extra := range r.opts.extraPrefixes {
+			if r.stopErr(ctx) != nil || r.limitReached() {
+				return
+			}
+			prefix := hostnamePath + extra
+			var keys []string
+			err := listObjects(ctx, r.client, r.opts.bucket, prefix, func(obj types.Object) {
+				key := aws.ToString(obj.Key)
+				r.index[key] = objectInfo{StorageClass: obj.StorageClass, LastModified: aws.ToTime(obj.LastModified), Size: aws.ToInt64(obj.Size), ETag: aws.ToString(obj.ETag)}
+				keys = append(keys, key)
+			})
+			if err != nil {
+				slog.Error("Error listing extra prefix", append([]any{"prefix", prefix}, errorAttrs(err)...)...)
+				r.stats.extraPrefixFailed()
+				continue
+			}
+			slog.Info("Processing extra prefix", "prefix", prefix, "objects", len(keys))
+			for _, key := range keys {
+				if r.stopErr(ctx) != nil {
+					return
+				}
+				if r.excluded("", key) {
+					continue
+				}
+				if reason := r.lastModifiedSkipReason(ctx, key); reason != "" {
+					skippedByFilter[reason]++
+					r.stats.objectFiltered(reason)
+					continue
+				}
+				if !r.take() {
+					return
+				}
+				r.stats.extraPrefixObject(extra, r.refreshObject(ctx, "", key))
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestNormalizeExtraPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{prefix: "commitlog", want: "commitlog/"},
+		{prefix: "commitlog/", want: "commitlog/"},
+		{prefix: "archive//commitlog/", want: "archive/commitlog/"},
+		{prefix: "/commitlog", wantErr: true},
+		{prefix: "../other-host/commitlog", wantErr: true},
+		{prefix: ".", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			got, err := normalizeExtraPrefix(tt.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeExtraPrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeExtraPrefix() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunExtraPrefixes(t *testing.T) {
+	now := time.Now()
+	bucket := newFakeBucket()
+	// Both backups of host1 share its commitlog archive, which is processed once
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/b2/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/commitlog/CommitLog-7-1.log"] = ""
+	bucket.objects["links/host1/commitlog/CommitLog-7-2.log"] = ""
+	bucket.objects["links/host1/commitlog/CommitLog-7-0.log"] = ""
+	bucket.modified["links/host1/commitlog/CommitLog-7-0.log"] = now.AddDate(0, 0, -90)
+	// host2 has no processed backup, so its archive isn't touched
+	bucket.objects["links/host2/commitlog/CommitLog-7-1.log"] = ""
+
+	opts := testOptions()
+	opts.extraPrefixes = stringList{"commitlog/"}
+	opts.newerThan = now.AddDate(0, 0, -30)
+	r := newRefresher(bucket.client(), opts, now)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	// The fake bucket lists in no particular order
+	got := bucket.putKeys()
+	sort.Strings(got)
+	want := []string{
+		"links/host1/commitlog/CommitLog-7-1.log",
+		"links/host1/commitlog/CommitLog-7-2.log",
+		"links/host1/data/ks/t/a.db",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("updated %v, want %v", got, want)
+	}
+	sum := r.stats.summary(time.Now())
+	if want := map[string]int{"commitlog/": 2}; !reflect.DeepEqual(sum.ExtraPrefixObjects, want) {
+		t.Errorf("summary extra_prefix_objects = %v, want %v", sum.ExtraPrefixObjects, want)
+	}
+	if want := map[string]int{string(actionUpdated): 2}; !reflect.DeepEqual(sum.ExtraPrefixActions, want) {
+		t.Errorf("summary extra_prefix_actions = %v, want %v", sum.ExtraPrefixActions, want)
+	}
+	if got := sum.SkippedByFilter["newer-than"]; got != 1 {
+		t.Errorf("summary skipped_by_filter[newer-than] = %d, want 1", got)
+	}
+}
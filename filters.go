@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stringList is a flag.Value collecting comma-separated values from repeated flags
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// byteSize is a flag.Value holding a size in bytes, written as a plain number
+// or with a binary K, M, G or T suffix (optionally followed by "iB" or "B")
+type byteSize int64
+
+var sizeUnits = map[string]int64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+var sizeValue = regexp.MustCompile(`^(\d+)\s*([KMGT]?)(?:I?B)?$`)
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	m := sizeValue.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if m == nil {
+		return fmt.Errorf("invalid size %q: expected bytes or a K, M, G or T suffix", value)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q: %w", value, err)
+	}
+	unit := sizeUnits[m[2]]
+	if n > math.MaxInt64/unit {
+		return fmt.Errorf("invalid size %q: too large", value)
+	}
+	*s = byteSize(n * unit)
+	return nil
+}
+
+// validateGlob checks that a filter pattern is a valid glob
+func validateGlob(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+// filterManifestsByBackupName keeps the manifests whose backup name matches pattern.
+// The pattern is either an exact backup name or a glob such as "adhoc-*".
+// It returns the kept manifests and the number of manifests filtered out.
+func filterManifestsByBackupName(manifests []ManifestInfo, pattern string) ([]ManifestInfo, int, error) {
+	if err := validateGlob(pattern); err != nil {
+		return nil, 0, err
+	}
+
+	var kept []ManifestInfo
+	filtered := 0
+	for _, m := range manifests {
+		mp, err := m.path()
+		if err != nil {
+			filtered++
+			continue
+		}
+		// path.Match cannot fail here since the pattern was validated above
+		if ok, _ := path.Match(pattern, mp.Backup); ok {
+			kept = append(kept, m)
+		} else {
+			filtered++
+		}
+	}
+
+	return kept, filtered, nil
+}
+
+// parseTimeBound parses a -since/-until value: an RFC3339 timestamp, a date
+// (2006-01-02), or a duration such as "720h" meaning that long before now
+func parseTimeBound(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC3339, YYYY-MM-DD or a duration like 720h", value)
+	}
+	if d < 0 {
+		return time.Time{}, fmt.Errorf("invalid time %q: duration must not be negative", value)
+	}
+	return now.Add(-d), nil
+}
+
+// parseBackupNameTimestamp extracts the epoch embedded at the end of a Medusa
+// backup name, e.g. medusa-backup-schedule-1764858600
+func parseBackupNameTimestamp(backupName string) (time.Time, bool) {
+	suffix := backupName[strings.LastIndex(backupName, "-")+1:]
+	if len(suffix) != 10 {
+		return time.Time{}, false
+	}
+	epoch, err := strconv.ParseInt(suffix, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(epoch, 0).UTC(), true
+}
+
+// backupTimestamp determines when a backup was taken, preferring the epoch in
+// the backup name and falling back to the manifest's LastModified
+func backupTimestamp(m ManifestInfo) (time.Time, bool) {
+	if mp, err := m.path(); err == nil {
+		if t, ok := parseBackupNameTimestamp(mp.Backup); ok {
+			return t, true
+		}
+	}
+	if !m.LastModified.IsZero() {
+		return m.LastModified, true
+	}
+	return time.Time{}, false
+}
+
+// filterManifestsByTime keeps the manifests whose backup timestamp falls within
+// [since, until]; a zero bound is open. Backups without a determinable timestamp
+// are returned separately in undated and kept unless excludeUndated is set.
+func filterManifestsByTime(manifests []ManifestInfo, since, until time.Time, excludeUndated bool) (kept []ManifestInfo, filtered int, undated []ManifestInfo) {
+	for _, m := range manifests {
+		ts, ok := backupTimestamp(m)
+		if !ok {
+			undated = append(undated, m)
+			if excludeUndated {
+				filtered++
+			} else {
+				kept = append(kept, m)
+			}
+			continue
+		}
+		if (!since.IsZero() && ts.Before(since)) || (!until.IsZero() && ts.After(until)) {
+			filtered++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept, filtered, undated
+}
+
+// filterExpiredManifests drops the manifests of backups taken at least their
+// max retention, from maxRetention, before now, whose retention is over.
+// Undated backups are kept.
+func filterExpiredManifests(manifests []ManifestInfo, maxRetention func(ManifestInfo) retentionPeriod, now time.Time) (kept, expired []ManifestInfo) {
+	for _, m := range manifests {
+		if ts, ok := backupTimestamp(m); ok && !maxRetention(m).from(ts).After(now) {
+			expired = append(expired, m)
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept, expired
+}
+
+// sortManifestsNewestFirst orders manifests by backup timestamp, newest
+// first. Undated backups sort last; ties are ordered by key.
+func sortManifestsNewestFirst(manifests []ManifestInfo) {
+	sort.SliceStable(manifests, func(i, j int) bool {
+		ti, iok := backupTimestamp(manifests[i])
+		tj, jok := backupTimestamp(manifests[j])
+		if iok != jok {
+			return iok
+		}
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return manifests[i].Key < manifests[j].Key
+	})
+}
+
+// latestPerHost keeps the newest manifest of each hostname and returns the
+// chosen backup name per hostname
+func latestPerHost(manifests []ManifestInfo) ([]ManifestInfo, map[string]string) {
+	kept, chosen, _ := keepLastPerHost(manifests, 1)
+	latest := make(map[string]string, len(chosen))
+	for host, backups := range chosen {
+		latest[host] = backups[0]
+	}
+	return kept, latest
+}
+
+// keepLastPerHost keeps the n newest manifests of each hostname, ordered by
+// sortManifestsNewestFirst. It returns the kept backup names per hostname,
+// newest first, and how many backups of each hostname were skipped.
+// Manifests whose key has no hostname are kept so they are reported later.
+func keepLastPerHost(manifests []ManifestInfo, n int) ([]ManifestInfo, map[string][]string, map[string]int) {
+	sorted := append([]ManifestInfo(nil), manifests...)
+	sortManifestsNewestFirst(sorted)
+
+	var kept []ManifestInfo
+	chosen := make(map[string][]string)
+	skipped := make(map[string]int)
+	for _, m := range sorted {
+		mp, err := m.path()
+		if err != nil {
+			kept = append(kept, m)
+			continue
+		}
+		host := mp.Host
+		if len(chosen[host]) >= n {
+			skipped[host]++
+			continue
+		}
+		chosen[host] = append(chosen[host], mp.Backup)
+		kept = append(kept, m)
+	}
+	return kept, chosen, skipped
+}
+
+// capManifests keeps the first max manifests and returns how many were dropped
+func capManifests(manifests []ManifestInfo, max int) ([]ManifestInfo, int) {
+	if max <= 0 || len(manifests) <= max {
+		return manifests, 0
+	}
+	return manifests[:max], len(manifests) - max
+}
+
+// tableIDSuffix matches the table ID Medusa appends to the columnfamily name
+var tableIDSuffix = regexp.MustCompile(`-[0-9a-f]{32}$`)
+
+// matchesAny reports whether value matches any of the glob patterns
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// systemKeyspaces are the Cassandra keyspaces rebuilt on restore, skipped with -exclude-system-keyspaces
+var systemKeyspaces = []string{"system", "system_schema", "system_auth", "system_distributed", "system_traces", "system_views", "system_virtual_schema"}
+
+// objectFilter selects manifest objects by the keyspace and table of their
+// manifest entry and by the size the manifest records for them
+type objectFilter struct {
+	includeKeyspaces stringList
+	excludeKeyspaces stringList
+	includeTables    stringList
+	excludeTables    stringList
+	excludeSystem    bool
+	minSize          byteSize   // 0 for no lower bound
+	maxSize          byteSize   // 0 for no upper bound
+	components       stringList // SSTable components to process, empty for all
+}
+
+// filterReasons lists every object filter, as counted in skipped_by_filter,
+// in the order skips are logged
+var filterReasons = []string{"exclude-system-keyspaces", "include-keyspace", "exclude-keyspace", "include-table", "exclude-table", "min-size", "max-size", "components", "older-than", "newer-than"}
+
+// validate checks that every filter pattern is a valid glob and the size bounds are ordered
+func (f *objectFilter) validate() error {
+	for _, patterns := range []stringList{f.includeKeyspaces, f.excludeKeyspaces, f.includeTables, f.excludeTables} {
+		for _, pattern := range patterns {
+			if err := validateGlob(pattern); err != nil {
+				return err
+			}
+		}
+	}
+	if f.minSize > 0 && f.maxSize > 0 && f.minSize > f.maxSize {
+		return fmt.Errorf("-min-size %d is above -max-size %d", f.minSize, f.maxSize)
+	}
+	if slices.Contains(f.components, allComponents) {
+		if len(f.components) > 1 {
+			return fmt.Errorf("-components %q can't list components besides %q", f.components.String(), allComponents)
+		}
+		f.components = nil
+	}
+	return nil
+}
+
+// allComponents is the -components value selecting every SSTable component
+const allComponents = "all"
+
+// sstableComponent returns the component of an SSTable file, e.g. Data.db for
+// nb-1-big-Data.db, mc-1-big-Data.db, the legacy ks-table-ka-1-Data.db, or a
+// secondary index's .table_idx/nb-1-big-Data.db. Every naming style ends the
+// file name with -<component>.
+func sstableComponent(objectPath string) (string, bool) {
+	name := path.Base(objectPath)
+	i := strings.LastIndex(name, "-")
+	if i < 0 || i == len(name)-1 {
+		return "", false
+	}
+	return name[i+1:], true
+}
+
+// matchesComponent reports whether the SSTable at objectPath is one of
+// components, written with or without the extension (Data.db or Data).
+// Files that aren't named like an SSTable match none.
+func matchesComponent(components []string, objectPath string) bool {
+	component, ok := sstableComponent(objectPath)
+	if !ok {
+		return false
+	}
+	bare := strings.TrimSuffix(component, path.Ext(component))
+	for _, c := range components {
+		if strings.EqualFold(c, component) || strings.EqualFold(c, bare) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesTable matches a columnfamily both with and without its table ID suffix,
+// so "users" matches "users-cb752354d0f211f0bde0457410cd7650"
+func matchesTable(patterns []string, columnFamily string) bool {
+	return matchesAny(patterns, columnFamily) || matchesAny(patterns, tableIDSuffix.ReplaceAllString(columnFamily, ""))
+}
+
+// skipReason returns the name of the filter that excludes obj, or "" when obj should be processed.
+// Filtering uses the keyspace/columnfamily of the manifest entry, never the object path;
+// only -components looks at the file name.
+// Objects without a recorded size are unknown to the size filters and kept.
+func (f *objectFilter) skipReason(obj ManifestObject) string {
+	if f.excludeSystem && matchesAny(systemKeyspaces, obj.Keyspace) {
+		return "exclude-system-keyspaces"
+	}
+	if len(f.includeKeyspaces) > 0 && !matchesAny(f.includeKeyspaces, obj.Keyspace) {
+		return "include-keyspace"
+	}
+	if matchesAny(f.excludeKeyspaces, obj.Keyspace) {
+		return "exclude-keyspace"
+	}
+	if len(f.includeTables) > 0 && !matchesTable(f.includeTables, obj.ColumnFamily) {
+		return "include-table"
+	}
+	if matchesTable(f.excludeTables, obj.ColumnFamily) {
+		return "exclude-table"
+	}
+	if obj.Size > 0 {
+		if f.minSize > 0 && obj.Size < int64(f.minSize) {
+			return "min-size"
+		}
+		if f.maxSize > 0 && obj.Size > int64(f.maxSize) {
+			return "max-size"
+		}
+	}
+	if len(f.components) > 0 && !matchesComponent(f.components, obj.Path) {
+		return "components"
+	}
+	return ""
+}
+
+// keyExclusions holds the -exclude-keys-file entries: full object keys, and
+// key prefixes written with a trailing '*'
+type keyExclusions struct {
+	keys     map[string]struct{}
+	prefixes []string
+}
+
+// newKeyExclusions splits entries into exact keys and prefixes
+func newKeyExclusions(entries []string) *keyExclusions {
+	e := &keyExclusions{keys: make(map[string]struct{})}
+	for _, entry := range entries {
+		if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+			e.prefixes = append(e.prefixes, prefix)
+			continue
+		}
+		e.keys[entry] = struct{}{}
+	}
+	return e
+}
+
+// match reports whether key is excluded
+func (e *keyExclusions) match(key string) bool {
+	if e == nil {
+		return false
+	}
+	if _, ok := e.keys[key]; ok {
+		return true
+	}
+	for _, prefix := range e.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
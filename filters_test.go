@@ -0,0 +1,778 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// manifestInfos builds undated ManifestInfo values from manifest keys
+func manifestInfos(keys ...string) []ManifestInfo {
+	infos := make([]ManifestInfo, len(keys))
+	for i, key := range keys {
+		infos[i] = ManifestInfo{Key: key}
+	}
+	return infos
+}
+
+// manifestKeys returns the keys of the given manifests
+func manifestKeys(manifests []ManifestInfo) []string {
+	var keys []string
+	for _, m := range manifests {
+		keys = append(keys, m.Key)
+	}
+	return keys
+}
+
+func TestManifestBackupName(t *testing.T) {
+	tests := []struct {
+		name        string
+		manifestKey string
+		prefix      string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "scheduled backup",
+			manifestKey: "links/links-us-default-sts-8/medusa-backup-schedule-1764858600/meta/manifest.json",
+			want:        "medusa-backup-schedule-1764858600",
+		},
+		{
+			name:        "adhoc backup",
+			manifestKey: "cluster1/host1/adhoc-before-upgrade/meta/manifest.json",
+			want:        "adhoc-before-upgrade",
+		},
+		{
+			name:        "too few segments",
+			manifestKey: "a/b/c",
+			wantErr:     true,
+		},
+		{
+			name:        "under a prefix",
+			manifestKey: "backups/prod/cluster1/host1/adhoc-before-upgrade/meta/manifest.json",
+			prefix:      "backups/prod/",
+			want:        "adhoc-before-upgrade",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractHostnamePath(tt.manifestKey, tt.prefix, 0)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("extractHostnamePath() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.Backup != tt.want {
+				t.Errorf("extractHostnamePath() backup = %v, want %v", got.Backup, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterManifestsByBackupName(t *testing.T) {
+	manifests := manifestInfos(
+		"links/host1/medusa-backup-schedule-1764858600/meta/manifest.json",
+		"links/host2/medusa-backup-schedule-1764858600/meta/manifest.json",
+		"links/host1/medusa-backup-schedule-1764945000/meta/manifest.json",
+		"links/host1/adhoc-before-upgrade/meta/manifest.json",
+		"links/host2/adhoc-2024-05-01/meta/manifest.json",
+	)
+
+	tests := []struct {
+		name         string
+		pattern      string
+		want         []string
+		wantFiltered int
+		wantErr      bool
+	}{
+		{
+			name:    "exact scheduled backup across all nodes",
+			pattern: "medusa-backup-schedule-1764858600",
+			want: []string{
+				"links/host1/medusa-backup-schedule-1764858600/meta/manifest.json",
+				"links/host2/medusa-backup-schedule-1764858600/meta/manifest.json",
+			},
+			wantFiltered: 3,
+		},
+		{
+			name:    "glob for adhoc backups",
+			pattern: "adhoc-*",
+			want: []string{
+				"links/host1/adhoc-before-upgrade/meta/manifest.json",
+				"links/host2/adhoc-2024-05-01/meta/manifest.json",
+			},
+			wantFiltered: 3,
+		},
+		{
+			name:    "glob for scheduled backups",
+			pattern: "medusa-backup-schedule-*",
+			want: []string{
+				"links/host1/medusa-backup-schedule-1764858600/meta/manifest.json",
+				"links/host2/medusa-backup-schedule-1764858600/meta/manifest.json",
+				"links/host1/medusa-backup-schedule-1764945000/meta/manifest.json",
+			},
+			wantFiltered: 2,
+		},
+		{
+			name:         "no match",
+			pattern:      "weekly-*",
+			want:         nil,
+			wantFiltered: 5,
+		},
+		{
+			name:    "invalid glob",
+			pattern: "adhoc-[",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, filtered, err := filterManifestsByBackupName(manifests, tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("filterManifestsByBackupName() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(manifestKeys(got), tt.want) {
+				t.Errorf("filterManifestsByBackupName() = %v, want %v", manifestKeys(got), tt.want)
+			}
+			if filtered != tt.wantFiltered {
+				t.Errorf("filterManifestsByBackupName() filtered = %d, want %d", filtered, tt.wantFiltered)
+			}
+		})
+	}
+}
+
+func TestParseTimeBound(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "RFC3339",
+			value: "2025-01-02T03:04:05Z",
+			want:  time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		{
+			name:  "date only",
+			value: "2025-01-02",
+			want:  time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "relative duration",
+			value: "720h",
+			want:  now.Add(-720 * time.Hour),
+		},
+		{
+			name:    "negative duration",
+			value:   "-24h",
+			wantErr: true,
+		},
+		{
+			name:    "garbage",
+			value:   "last week",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTimeBound(tt.value, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseTimeBound() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseTimeBound() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupTimestamp(t *testing.T) {
+	lastModified := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		manifest ManifestInfo
+		want     time.Time
+		wantOK   bool
+	}{
+		{
+			name:     "epoch in backup name",
+			manifest: ManifestInfo{Key: "links/host1/medusa-backup-schedule-1764858600/meta/manifest.json", LastModified: lastModified},
+			want:     time.Unix(1764858600, 0),
+			wantOK:   true,
+		},
+		{
+			name:     "falls back to LastModified",
+			manifest: ManifestInfo{Key: "links/host1/adhoc-before-upgrade/meta/manifest.json", LastModified: lastModified},
+			want:     lastModified,
+			wantOK:   true,
+		},
+		{
+			name:     "numeric suffix that is not an epoch",
+			manifest: ManifestInfo{Key: "links/host1/adhoc-2024-05-01/meta/manifest.json", LastModified: lastModified},
+			want:     lastModified,
+			wantOK:   true,
+		},
+		{
+			name:     "undetermined",
+			manifest: ManifestInfo{Key: "links/host1/adhoc-before-upgrade/meta/manifest.json"},
+			wantOK:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := backupTimestamp(tt.manifest)
+			if ok != tt.wantOK {
+				t.Errorf("backupTimestamp() ok = %v, want %v", ok, tt.wantOK)
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("backupTimestamp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterManifestsByTime(t *testing.T) {
+	// 1764858600 = 2025-12-04T14:30:00Z
+	nameDated := ManifestInfo{Key: "links/host1/medusa-backup-schedule-1764858600/meta/manifest.json"}
+	modDated := ManifestInfo{Key: "links/host1/adhoc-before-upgrade/meta/manifest.json", LastModified: time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC)}
+	undated := ManifestInfo{Key: "links/host2/adhoc-unknown/meta/manifest.json"}
+	manifests := []ManifestInfo{nameDated, modDated, undated}
+
+	tests := []struct {
+		name           string
+		since          time.Time
+		until          time.Time
+		excludeUndated bool
+		want           []string
+		wantFiltered   int
+	}{
+		{
+			name:         "since keeps newer name-dated backup",
+			since:        time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC),
+			want:         []string{nameDated.Key, undated.Key},
+			wantFiltered: 1,
+		},
+		{
+			name:         "until keeps older LastModified-dated backup",
+			until:        time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC),
+			want:         []string{modDated.Key, undated.Key},
+			wantFiltered: 1,
+		},
+		{
+			name:         "since boundary is inclusive",
+			since:        time.Unix(1764858600, 0),
+			want:         []string{nameDated.Key, undated.Key},
+			wantFiltered: 1,
+		},
+		{
+			name:         "until boundary is inclusive",
+			until:        time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC),
+			want:         []string{modDated.Key, undated.Key},
+			wantFiltered: 1,
+		},
+		{
+			name:         "one second past the window",
+			since:        time.Unix(1764858601, 0),
+			want:         []string{undated.Key},
+			wantFiltered: 2,
+		},
+		{
+			name:           "undated excluded on request",
+			since:          time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+			excludeUndated: true,
+			want:           []string{nameDated.Key, modDated.Key},
+			wantFiltered:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, filtered, gotUndated := filterManifestsByTime(manifests, tt.since, tt.until, tt.excludeUndated)
+			if !reflect.DeepEqual(manifestKeys(got), tt.want) {
+				t.Errorf("filterManifestsByTime() = %v, want %v", manifestKeys(got), tt.want)
+			}
+			if filtered != tt.wantFiltered {
+				t.Errorf("filterManifestsByTime() filtered = %d, want %d", filtered, tt.wantFiltered)
+			}
+			if len(gotUndated) != 1 || gotUndated[0].Key != undated.Key {
+				t.Errorf("filterManifestsByTime() undated = %v, want [%s]", manifestKeys(gotUndated), undated.Key)
+			}
+		})
+	}
+}
+
+func TestFilterExpiredManifests(t *testing.T) {
+	// 1764858600 = 2025-12-04T14:30:00Z
+	nameDated := ManifestInfo{Key: "links/host1/medusa-backup-schedule-1764858600/meta/manifest.json"}
+	modDated := ManifestInfo{Key: "links/host1/adhoc-before-upgrade/meta/manifest.json", LastModified: time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC)}
+	undated := ManifestInfo{Key: "links/host2/adhoc-unknown/meta/manifest.json"}
+	manifests := []ManifestInfo{nameDated, modDated, undated}
+	period := retentionPeriod{days: 30}
+
+	tests := []struct {
+		name        string
+		now         time.Time
+		want        []string
+		wantExpired []string
+	}{
+		{
+			name: "both within retention",
+			now:  time.Date(2025, 11, 30, 0, 0, 0, 0, time.UTC),
+			want: []string{nameDated.Key, modDated.Key, undated.Key},
+		},
+		{
+			name:        "LastModified-dated backup expired",
+			now:         time.Date(2025, 12, 10, 0, 0, 0, 0, time.UTC),
+			want:        []string{nameDated.Key, undated.Key},
+			wantExpired: []string{modDated.Key},
+		},
+		{
+			name:        "one second before expiry",
+			now:         time.Unix(1764858600, 0).AddDate(0, 0, 30).Add(-time.Second),
+			want:        []string{nameDated.Key, undated.Key},
+			wantExpired: []string{modDated.Key},
+		},
+		{
+			name:        "expires when retention ends",
+			now:         time.Unix(1764858600, 0).AddDate(0, 0, 30),
+			want:        []string{undated.Key},
+			wantExpired: []string{nameDated.Key, modDated.Key},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, expired := filterExpiredManifests(manifests, func(ManifestInfo) retentionPeriod { return period }, tt.now)
+			if !reflect.DeepEqual(manifestKeys(got), tt.want) {
+				t.Errorf("filterExpiredManifests() = %v, want %v", manifestKeys(got), tt.want)
+			}
+			if !reflect.DeepEqual(manifestKeys(expired), tt.wantExpired) {
+				t.Errorf("filterExpiredManifests() expired = %v, want %v", manifestKeys(expired), tt.wantExpired)
+			}
+		})
+	}
+}
+
+func TestSortManifestsNewestFirst(t *testing.T) {
+	manifests := []ManifestInfo{
+		{Key: "links/host1/adhoc-undated/meta/manifest.json"},
+		{Key: "links/host1/medusa-backup-schedule-1700000000/meta/manifest.json"},
+		{Key: "links/host2/adhoc-before-upgrade/meta/manifest.json", LastModified: time.Unix(1750000000, 0)},
+		{Key: "links/host1/medusa-backup-schedule-1764858600/meta/manifest.json"},
+		{Key: "links/host2/medusa-backup-schedule-1764858600/meta/manifest.json"},
+	}
+
+	sortManifestsNewestFirst(manifests)
+
+	want := []string{
+		"links/host1/medusa-backup-schedule-1764858600/meta/manifest.json",
+		"links/host2/medusa-backup-schedule-1764858600/meta/manifest.json",
+		"links/host2/adhoc-before-upgrade/meta/manifest.json",
+		"links/host1/medusa-backup-schedule-1700000000/meta/manifest.json",
+		"links/host1/adhoc-undated/meta/manifest.json",
+	}
+	for i, m := range manifests {
+		if m.Key != want[i] {
+			t.Errorf("sortManifestsNewestFirst()[%d] = %q, want %q", i, m.Key, want[i])
+		}
+	}
+}
+
+func TestLatestPerHost(t *testing.T) {
+	tests := []struct {
+		name      string
+		manifests []ManifestInfo
+		want      map[string]string
+	}{
+		{
+			name: "epoch in backup name",
+			manifests: []ManifestInfo{
+				{Key: "links/host1/medusa-backup-schedule-1700000000/meta/manifest.json", LastModified: time.Unix(1790000000, 0)},
+				{Key: "links/host1/medusa-backup-schedule-1764858600/meta/manifest.json", LastModified: time.Unix(1600000000, 0)},
+			},
+			want: map[string]string{"host1": "medusa-backup-schedule-1764858600"},
+		},
+		{
+			name: "falls back to LastModified",
+			manifests: []ManifestInfo{
+				{Key: "links/host1/adhoc-before-upgrade/meta/manifest.json", LastModified: time.Unix(1750000000, 0)},
+				{Key: "links/host1/adhoc-after-upgrade/meta/manifest.json", LastModified: time.Unix(1760000000, 0)},
+				{Key: "links/host1/adhoc-undated/meta/manifest.json"},
+			},
+			want: map[string]string{"host1": "adhoc-after-upgrade"},
+		},
+		{
+			name: "tie picks the first backup by key",
+			manifests: []ManifestInfo{
+				{Key: "links/host1/nightly-b/meta/manifest.json", LastModified: time.Unix(1750000000, 0)},
+				{Key: "links/host1/nightly-a/meta/manifest.json", LastModified: time.Unix(1750000000, 0)},
+			},
+			want: map[string]string{"host1": "nightly-a"},
+		},
+		{
+			name: "hosts with a single backup",
+			manifests: []ManifestInfo{
+				{Key: "links/host1/medusa-backup-schedule-1700000000/meta/manifest.json"},
+				{Key: "links/host2/medusa-backup-schedule-1764858600/meta/manifest.json"},
+				{Key: "links/host2/medusa-backup-schedule-1700000000/meta/manifest.json"},
+				{Key: "links/host3/adhoc-undated/meta/manifest.json"},
+			},
+			want: map[string]string{
+				"host1": "medusa-backup-schedule-1700000000",
+				"host2": "medusa-backup-schedule-1764858600",
+				"host3": "adhoc-undated",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, chosen := latestPerHost(tt.manifests)
+			if !reflect.DeepEqual(chosen, tt.want) {
+				t.Errorf("latestPerHost() chose %v, want %v", chosen, tt.want)
+			}
+			if len(kept) != len(tt.want) {
+				t.Errorf("latestPerHost() kept %d manifests, want %d", len(kept), len(tt.want))
+			}
+			for _, m := range kept {
+				parts := strings.Split(m.Key, "/")
+				if tt.want[parts[1]] != parts[2] {
+					t.Errorf("latestPerHost() kept %q", m.Key)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepLastPerHost(t *testing.T) {
+	manifests := manifestInfos(
+		"links/host1/medusa-backup-schedule-1700000000/meta/manifest.json",
+		"links/host1/medusa-backup-schedule-1710000000/meta/manifest.json",
+		"links/host1/medusa-backup-schedule-1720000000/meta/manifest.json",
+		"links/host1/medusa-backup-schedule-1730000000/meta/manifest.json",
+		"links/host1/medusa-backup-schedule-1740000000/meta/manifest.json",
+		"links/host2/medusa-backup-schedule-1705000000/meta/manifest.json",
+		"links/host2/medusa-backup-schedule-1745000000/meta/manifest.json",
+		"links/host3/medusa-backup-schedule-1715000000/meta/manifest.json",
+	)
+
+	kept, chosen, skipped := keepLastPerHost(manifests, 2)
+
+	wantChosen := map[string][]string{
+		"host1": {"medusa-backup-schedule-1740000000", "medusa-backup-schedule-1730000000"},
+		"host2": {"medusa-backup-schedule-1745000000", "medusa-backup-schedule-1705000000"},
+		"host3": {"medusa-backup-schedule-1715000000"},
+	}
+	if !reflect.DeepEqual(chosen, wantChosen) {
+		t.Errorf("keepLastPerHost() chose %v, want %v", chosen, wantChosen)
+	}
+	if want := map[string]int{"host1": 3}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("keepLastPerHost() skipped %v, want %v", skipped, want)
+	}
+	if len(kept) != 5 || kept[0].Key != "links/host2/medusa-backup-schedule-1745000000/meta/manifest.json" {
+		t.Errorf("keepLastPerHost() kept %v, want 5 manifests newest first", kept)
+	}
+}
+
+func TestCapManifests(t *testing.T) {
+	manifests := []ManifestInfo{{Key: "a"}, {Key: "b"}, {Key: "c"}}
+
+	tests := []struct {
+		max         int
+		wantKept    int
+		wantDropped int
+	}{
+		{max: 0, wantKept: 3},
+		{max: 2, wantKept: 2, wantDropped: 1},
+		{max: 3, wantKept: 3},
+		{max: 10, wantKept: 3},
+	}
+
+	for _, tt := range tests {
+		kept, dropped := capManifests(manifests, tt.max)
+		if len(kept) != tt.wantKept || dropped != tt.wantDropped {
+			t.Errorf("capManifests(%d) kept %d, dropped %d, want %d and %d", tt.max, len(kept), dropped, tt.wantKept, tt.wantDropped)
+		}
+		if len(kept) > 0 && kept[0].Key != "a" {
+			t.Errorf("capManifests(%d) kept %v, want the first manifests", tt.max, kept)
+		}
+	}
+}
+
+func TestKeyExclusionsMatch(t *testing.T) {
+	e := newKeyExclusions([]string{"links/host1/data/ks/t/a.db", "links/host2/data/*"})
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "links/host1/data/ks/t/a.db", want: true},
+		{key: "links/host1/data/ks/t/a.db.bak", want: false},
+		{key: "links/host1/data/ks/t/b.db", want: false},
+		{key: "links/host2/data/ks/t/c.db", want: true},
+		{key: "links/host2/meta/schema.cql", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := e.match(tt.key); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+	var none *keyExclusions
+	if none.match("links/host1/data/ks/t/a.db") {
+		t.Error("nil exclusions matched a key")
+	}
+}
+
+func TestStringList(t *testing.T) {
+	var l stringList
+	if err := l.Set("system, system_auth"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := l.Set("staging_*,"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	want := stringList{"system", "system_auth", "staging_*"}
+	if !reflect.DeepEqual(l, want) {
+		t.Errorf("stringList = %v, want %v", l, want)
+	}
+}
+
+func TestObjectFilterSkipReason(t *testing.T) {
+	// The path deliberately disagrees with the entry fields to prove the filter uses the latter
+	obj := func(keyspace, columnFamily string) ManifestObject {
+		return ManifestObject{
+			Path:         "cluster/host/data/prod/orders-00000000000000000000000000000000/mc-1-big-Data.db",
+			Keyspace:     keyspace,
+			ColumnFamily: columnFamily,
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter objectFilter
+		obj    ManifestObject
+		want   string
+	}{
+		{
+			name:   "no filters keeps everything",
+			filter: objectFilter{},
+			obj:    obj("staging", "users-cb752354d0f211f0bde0457410cd7650"),
+			want:   "",
+		},
+		{
+			name:   "exclude keyspace uses entry keyspace",
+			filter: objectFilter{excludeKeyspaces: stringList{"staging"}},
+			obj:    obj("staging", "users-cb752354d0f211f0bde0457410cd7650"),
+			want:   "exclude-keyspace",
+		},
+		{
+			name:   "exclude keyspace ignores keyspace in path",
+			filter: objectFilter{excludeKeyspaces: stringList{"prod"}},
+			obj:    obj("staging", "users-cb752354d0f211f0bde0457410cd7650"),
+			want:   "",
+		},
+		{
+			name:   "include keyspace glob",
+			filter: objectFilter{includeKeyspaces: stringList{"prod_*"}},
+			obj:    obj("staging", "users-cb752354d0f211f0bde0457410cd7650"),
+			want:   "include-keyspace",
+		},
+		{
+			name:   "include table matches name without table ID",
+			filter: objectFilter{includeTables: stringList{"users"}},
+			obj:    obj("staging", "users-cb752354d0f211f0bde0457410cd7650"),
+			want:   "",
+		},
+		{
+			name:   "include table rejects other tables",
+			filter: objectFilter{includeTables: stringList{"users"}},
+			obj:    obj("staging", "orders-cb752354d0f211f0bde0457410cd7650"),
+			want:   "include-table",
+		},
+		{
+			name:   "exclude table glob",
+			filter: objectFilter{excludeTables: stringList{"tmp_*"}},
+			obj:    obj("prod", "tmp_import-cb752354d0f211f0bde0457410cd7650"),
+			want:   "exclude-table",
+		},
+		{
+			name:   "system keyspaces kept by default",
+			filter: objectFilter{},
+			obj:    obj("system_schema", "tables-afddfb9dbc1e30688056eed6c302ba09"),
+			want:   "",
+		},
+		{
+			name:   "exclude system keyspaces",
+			filter: objectFilter{excludeSystem: true},
+			obj:    obj("system_auth", "roles-5bc52802de2535edaeab188eecebb090"),
+			want:   "exclude-system-keyspaces",
+		},
+		{
+			name:   "exclude system keyspaces keeps user keyspaces",
+			filter: objectFilter{excludeSystem: true},
+			obj:    obj("systemic", "users-cb752354d0f211f0bde0457410cd7650"),
+			want:   "",
+		},
+		{
+			name:   "exclude keyspace extends the system list",
+			filter: objectFilter{excludeSystem: true, excludeKeyspaces: stringList{"reaper_db"}},
+			obj:    obj("reaper_db", "repair_run-cb752354d0f211f0bde0457410cd7650"),
+			want:   "exclude-keyspace",
+		},
+		{
+			name:   "keyspace filters take precedence over table filters",
+			filter: objectFilter{excludeKeyspaces: stringList{"staging"}, excludeTables: stringList{"users"}},
+			obj:    obj("staging", "users-cb752354d0f211f0bde0457410cd7650"),
+			want:   "exclude-keyspace",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.skipReason(tt.obj); got != tt.want {
+				t.Errorf("skipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestObjectFilterValidate(t *testing.T) {
+	f := objectFilter{excludeTables: stringList{"users["}}
+	if err := f.validate(); err == nil {
+		t.Error("validate() expected error for invalid glob")
+	}
+	f = objectFilter{minSize: 100, maxSize: 10}
+	if err := f.validate(); err == nil {
+		t.Error("validate() expected error for -min-size above -max-size")
+	}
+}
+
+func TestObjectFilterSizes(t *testing.T) {
+	sized := func(size int64) ManifestObject {
+		return ManifestObject{Path: "data/ks/t/nb-1-big-Data.db", Size: size, Keyspace: "ks", ColumnFamily: "t"}
+	}
+
+	tests := []struct {
+		name   string
+		filter objectFilter
+		obj    ManifestObject
+		want   string
+	}{
+		{name: "below min", filter: objectFilter{minSize: 1024}, obj: sized(1023), want: "min-size"},
+		{name: "at min", filter: objectFilter{minSize: 1024}, obj: sized(1024), want: ""},
+		{name: "at max", filter: objectFilter{maxSize: 1024}, obj: sized(1024), want: ""},
+		{name: "above max", filter: objectFilter{maxSize: 1024}, obj: sized(1025), want: "max-size"},
+		{name: "within both", filter: objectFilter{minSize: 10, maxSize: 20}, obj: sized(15), want: ""},
+		{name: "unknown size kept by min", filter: objectFilter{minSize: 1024}, obj: sized(0), want: ""},
+		{name: "unknown size kept by max", filter: objectFilter{maxSize: 1024}, obj: sized(0), want: ""},
+		{name: "keyspace filter checked first", filter: objectFilter{minSize: 1024, excludeKeyspaces: stringList{"ks"}}, obj: sized(1), want: "exclude-keyspace"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.skipReason(tt.obj); got != tt.want {
+				t.Errorf("skipReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSTableComponents(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		want     string
+		selected bool
+	}{
+		{name: "nb", path: "data/ks/t-cb752354d0f211f0bde0457410cd7650/nb-1-big-Data.db", want: "Data.db", selected: true},
+		{name: "mc", path: "data/ks/t-cb752354d0f211f0bde0457410cd7650/mc-12-big-Index.db", want: "Index.db", selected: true},
+		{name: "uuid generation", path: "data/ks/t-cb752354d0f211f0bde0457410cd7650/nb-3g1o_0pme_1wmg02g9i68imsj1u3-big-Statistics.db", want: "Statistics.db", selected: true},
+		{name: "legacy", path: "data/ks/t/ks-t-ka-3-Data.db", want: "Data.db", selected: true},
+		{name: "secondary index", path: "data/ks/t-cb752354d0f211f0bde0457410cd7650/.t_email_idx/nb-2-big-Index.db", want: "Index.db", selected: true},
+		{name: "digest", path: "data/ks/t-cb752354d0f211f0bde0457410cd7650/nb-1-big-Digest.crc32", want: "Digest.crc32"},
+		{name: "toc", path: "data/ks/t-cb752354d0f211f0bde0457410cd7650/.t_email_idx/nb-2-big-TOC.txt", want: "TOC.txt"},
+		{name: "not an sstable", path: "data/ks/t/schema.cql"},
+	}
+
+	f := objectFilter{components: stringList{"Data.db", "index.db", "Statistics"}}
+	if err := f.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := sstableComponent(tt.path); got != tt.want {
+				t.Errorf("sstableComponent(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+			want := "components"
+			if tt.selected {
+				want = ""
+			}
+			obj := ManifestObject{Path: tt.path, Keyspace: "ks", ColumnFamily: "t"}
+			if got := f.skipReason(obj); got != want {
+				t.Errorf("skipReason() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestComponentsAll(t *testing.T) {
+	f := objectFilter{components: stringList{"all"}}
+	if err := f.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	if got := f.skipReason(ManifestObject{Path: "data/ks/t/nb-1-big-TOC.txt"}); got != "" {
+		t.Errorf("skipReason() = %q with -components all, want none", got)
+	}
+	f = objectFilter{components: stringList{"all", "Data.db"}}
+	if err := f.validate(); err == nil {
+		t.Error("validate() expected error for all with other components")
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    byteSize
+		wantErr bool
+	}{
+		{value: "0", want: 0},
+		{value: "1500", want: 1500},
+		{value: "64K", want: 64 << 10},
+		{value: "64M", want: 64 << 20},
+		{value: "10MiB", want: 10 << 20},
+		{value: "2gb", want: 2 << 30},
+		{value: "1T", want: 1 << 40},
+		{value: "-5", wantErr: true},
+		{value: "1.5G", wantErr: true},
+		{value: "10P", wantErr: true},
+		{value: "99999999999T", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var got byteSize
+			err := got.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Set() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// FirehoseAPI delivers the -firehose-stream events
+type FirehoseAPI interface {
+	PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error)
+}
+
+// PutRecordBatch limits
+const (
+	firehoseMaxRecords     = 500
+	firehoseMaxBatchBytes  = 4 << 20
+	firehoseMaxRecordBytes = 1000 << 10
+)
+
+// firehoseAttempts is how many times records are put before they're counted
+// as failed
+const firehoseAttempts = 3
+
+// firehoseBackoff is the wait before putting failed records again, doubled
+// before each following attempt
+var firehoseBackoff = 500 * time.Millisecond
+
+// firehoseBatcher batches events into PutRecordBatch calls to a Firehose
+// stream. It is safe for concurrent use.
+type firehoseBatcher struct {
+	client FirehoseAPI
+	stream string
+
+	mu      sync.Mutex
+	records [][]byte // events not put yet
+	size    int      // bytes in records
+
+	putMu  sync.Mutex // serializes puts
+	failed int        // events that couldn't be delivered
+}
+
+func newFirehoseBatcher(client FirehoseAPI, stream string) *firehoseBatcher {
+	return &firehoseBatcher{client: client, stream: stream}
+}
+
+// add queues an event, a JSON line, putting the queued events first when it
+// doesn't fit in their batch
+func (f *firehoseBatcher) add(line []byte) {
+	if len(line) > firehoseMaxRecordBytes {
+		slog.Warn("Dropped event too large for -firehose-stream", "bytes", len(line))
+		f.putMu.Lock()
+		f.failed++
+		f.putMu.Unlock()
+		return
+	}
+	f.mu.Lock()
+	var full [][]byte
+	if len(f.records) == firehoseMaxRecords || f.size+len(line) > firehoseMaxBatchBytes {
+		full = f.take()
+	}
+	f.records = append(f.records, line)
+	f.size += len(line)
+	f.mu.Unlock()
+	if full != nil {
+		f.put(full)
+	}
+}
+
+// take returns the queued events, emptying the queue. f.mu must be held.
+func (f *firehoseBatcher) take() [][]byte {
+	records := f.records
+	f.records, f.size = nil, 0
+	return records
+}
+
+// flush puts the queued events, returning how many events failed so far
+func (f *firehoseBatcher) flush() int {
+	f.mu.Lock()
+	records := f.take()
+	f.mu.Unlock()
+	if len(records) > 0 {
+		f.put(records)
+	}
+	f.putMu.Lock()
+	defer f.putMu.Unlock()
+	return f.failed
+}
+
+// put delivers a batch of events, putting the records Firehose failed again
+// with exponential backoff up to firehoseAttempts times. Events still not
+// delivered are counted.
+func (f *firehoseBatcher) put(records [][]byte) {
+	f.putMu.Lock()
+	defer f.putMu.Unlock()
+	// Events are delivered even when the run was interrupted
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+
+	wait := firehoseBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if records, err = f.putBatch(ctx, records); len(records) == 0 || attempt == firehoseAttempts {
+			break
+		}
+		slog.Debug("Retrying -firehose-stream records", "records", len(records), "attempt", attempt)
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wait *= 2
+	}
+	if len(records) == 0 {
+		return
+	}
+	f.failed += len(records)
+	attrs := []any{"stream", f.stream, "records", len(records)}
+	if err != nil {
+		attrs = append(attrs, errorAttrs(err)...)
+	}
+	slog.Warn("Failed to deliver events to -firehose-stream", attrs...)
+}
+
+// putBatch makes one PutRecordBatch call, returning the records that failed
+func (f *firehoseBatcher) putBatch(ctx context.Context, records [][]byte) ([][]byte, error) {
+	input := &firehose.PutRecordBatchInput{
+		DeliveryStreamName: aws.String(f.stream),
+		Records:            make([]fhtypes.Record, len(records)),
+	}
+	for i, data := range records {
+		input.Records[i] = fhtypes.Record{Data: data}
+	}
+	out, err := f.client.PutRecordBatch(ctx, input)
+	if err != nil {
+		return records, fmt.Errorf("failed to put records to -firehose-stream %s: %w", f.stream, err)
+	}
+	if aws.ToInt32(out.FailedPutCount) == 0 {
+		return nil, nil
+	}
+	var failed [][]byte
+	var lastErr error
+	for i, res := range out.RequestResponses {
+		if res.ErrorCode != nil && i < len(records) {
+			failed = append(failed, records[i])
+			lastErr = fmt.Errorf("%s: %s", aws.ToString(res.ErrorCode), aws.ToString(res.ErrorMessage))
+		}
+	}
+	return failed, lastErr
+}
+
+// startFirehose sends the run's events to -firehose-stream as well as to the
+// -output stream, if any
+func (r *refresher) startFirehose(ctx context.Context) error {
+	if r.firehose == nil {
+		client, err := newFirehoseClient(ctx, r.opts.commonOptions)
+		if err != nil {
+			return err
+		}
+		r.firehose = client
+	}
+	if r.events == nil {
+		r.events = newEventStream(nil, r.runID)
+	}
+	r.events.firehose = newFirehoseBatcher(r.firehose, r.opts.firehoseStream)
+	return nil
+}
+
+// checkFirehose returns runErr, or with -firehose-required an error when
+// events couldn't be delivered to -firehose-stream
+func (r *refresher) checkFirehose(runErr error) error {
+	if runErr != nil || !r.opts.firehoseRequired || r.events == nil || r.events.firehose == nil {
+		return runErr
+	}
+	if failed := r.events.firehose.flush(); failed > 0 {
+		return fmt.Errorf("failed to deliver %d events to -firehose-stream %s", failed, r.opts.firehoseStream)
+	}
+	return nil
+}
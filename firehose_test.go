@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/firehose"
+	fhtypes "github.com/aws/aws-sdk-go-v2/service/firehose/types"
+)
+
+// mockFirehose records the PutRecordBatch calls, failing the records listed
+// in failures that many times
+type mockFirehose struct {
+	mu       sync.Mutex
+	calls    [][][]byte
+	failures map[string]int // by record data
+	err      error          // fails every call when set
+}
+
+func (m *mockFirehose) PutRecordBatch(ctx context.Context, params *firehose.PutRecordBatchInput, optFns ...func(*firehose.Options)) (*firehose.PutRecordBatchOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records [][]byte
+	out := &firehose.PutRecordBatchOutput{FailedPutCount: aws.Int32(0)}
+	for _, record := range params.Records {
+		records = append(records, record.Data)
+		if m.failures[string(record.Data)] > 0 {
+			m.failures[string(record.Data)]--
+			*out.FailedPutCount++
+			out.RequestResponses = append(out.RequestResponses, fhtypes.PutRecordBatchResponseEntry{
+				ErrorCode:    aws.String("ServiceUnavailableException"),
+				ErrorMessage: aws.String("Slow down."),
+			})
+			continue
+		}
+		out.RequestResponses = append(out.RequestResponses, fhtypes.PutRecordBatchResponseEntry{RecordId: aws.String("id")})
+	}
+	m.calls = append(m.calls, records)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return out, nil
+}
+
+// sizes returns the number of records of each call
+func (m *mockFirehose) sizes() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sizes := make([]int, len(m.calls))
+	for i, call := range m.calls {
+		sizes[i] = len(call)
+	}
+	return sizes
+}
+
+// records returns the data of every record put, retried ones included
+func (m *mockFirehose) records() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var records []string
+	for _, call := range m.calls {
+		for _, record := range call {
+			records = append(records, string(record))
+		}
+	}
+	return records
+}
+
+func withoutFirehoseBackoff(t *testing.T) {
+	backoff := firehoseBackoff
+	firehoseBackoff = time.Millisecond
+	t.Cleanup(func() { firehoseBackoff = backoff })
+}
+
+func TestFirehoseBatchLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		lines      int
+		bytes      int
+		wantSizes  []int
+		wantFailed int
+	}{
+		{
+			name:      "record limit",
+			lines:     1201,
+			bytes:     100,
+			wantSizes: []int{500, 500, 201},
+		},
+		{
+			name:      "size limit",
+			lines:     10,
+			bytes:     900 << 10,
+			wantSizes: []int{4, 4, 2},
+		},
+		{
+			name:       "records too large dropped",
+			lines:      3,
+			bytes:      firehoseMaxRecordBytes + 1,
+			wantFailed: 3,
+		},
+		{
+			name: "nothing to put",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockFirehose{}
+			f := newFirehoseBatcher(client, "medusa-retention-events")
+			for i := 0; i < tt.lines; i++ {
+				f.add(bytes.Repeat([]byte{'x'}, tt.bytes))
+			}
+			if failed := f.flush(); failed != tt.wantFailed {
+				t.Errorf("flush() = %d failed, want %d", failed, tt.wantFailed)
+			}
+			if got := client.sizes(); len(got)+len(tt.wantSizes) > 0 && !reflect.DeepEqual(got, tt.wantSizes) {
+				t.Errorf("batches of %v records, want %v", got, tt.wantSizes)
+			}
+			for i, call := range client.calls {
+				size := 0
+				for _, record := range call {
+					size += len(record)
+				}
+				if size > firehoseMaxBatchBytes {
+					t.Errorf("batch %d has %d bytes, over the %d limit", i, size, firehoseMaxBatchBytes)
+				}
+			}
+		})
+	}
+}
+
+func TestFirehoseRetriesFailedRecords(t *testing.T) {
+	withoutFirehoseBackoff(t)
+	tests := []struct {
+		name        string
+		failures    map[string]int
+		err         error
+		wantRecords []string
+		wantFailed  int
+	}{
+		{
+			name:        "delivered",
+			wantRecords: []string{"a", "b", "c"},
+		},
+		{
+			name:        "failed records retried",
+			failures:    map[string]int{"b": 2},
+			wantRecords: []string{"a", "b", "c", "b", "b"},
+		},
+		{
+			name:        "records still failing counted",
+			failures:    map[string]int{"a": 1, "c": firehoseAttempts},
+			wantRecords: []string{"a", "b", "c", "a", "c", "c"},
+			wantFailed:  1,
+		},
+		{
+			name:        "call failing",
+			err:         errors.New("AccessDeniedException"),
+			wantRecords: []string{"a", "b", "c", "a", "b", "c", "a", "b", "c"},
+			wantFailed:  3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockFirehose{failures: tt.failures, err: tt.err}
+			f := newFirehoseBatcher(client, "medusa-retention-events")
+			for _, line := range []string{"a", "b", "c"} {
+				f.add([]byte(line))
+			}
+			if failed := f.flush(); failed != tt.wantFailed {
+				t.Errorf("flush() = %d failed, want %d", failed, tt.wantFailed)
+			}
+			if got := client.records(); !reflect.DeepEqual(got, tt.wantRecords) {
+				t.Errorf("put %v, want %v", got, tt.wantRecords)
+			}
+		})
+	}
+}
+
+func TestRunSendsEventsToFirehose(t *testing.T) {
+	client := &mockFirehose{}
+	opts := testOptions()
+	opts.firehoseStream = "medusa-retention-events"
+	r := newRefresher(statsBucket(), opts, time.Now())
+	r.firehose = client
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	records := client.records()
+	seen := make(map[string]int)
+	for _, record := range records {
+		if !strings.HasSuffix(record, "\n") {
+			t.Errorf("record %q isn't a JSON line", record)
+		}
+		var ev map[string]any
+		if err := json.Unmarshal([]byte(record), &ev); err != nil {
+			t.Fatalf("record %q is not JSON: %v", record, err)
+		}
+		if ev["run_id"] != r.runID {
+			t.Errorf("event %v has run_id %v, want %s", ev, ev["run_id"], r.runID)
+		}
+		seen[fmt.Sprint(ev["event"])]++
+	}
+	if seen["manifest_started"] != 3 || seen["run_summary"] != 1 || seen["object_updated"] == 0 {
+		t.Errorf("events = %v, want the -output ndjson events", seen)
+	}
+	if last := records[len(records)-1]; !strings.Contains(last, `"run_summary"`) {
+		t.Errorf("last event = %q, want run_summary", last)
+	}
+}
+
+func TestRunFirehoseFailures(t *testing.T) {
+	withoutFirehoseBackoff(t)
+	tests := []struct {
+		name     string
+		required bool
+		wantErr  bool
+	}{
+		{name: "counted"},
+		{name: "required", required: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			opts := testOptions()
+			opts.firehoseStream = "medusa-retention-events"
+			opts.firehoseRequired = tt.required
+			r := newRefresher(statsBucket(), opts, time.Now())
+			r.events = newEventStream(&out, "run-1")
+			r.firehose = &mockFirehose{err: errors.New("ResourceNotFoundException")}
+			err := r.run(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if sum := r.stats.summary(time.Now()); sum.FirehoseFailed == 0 {
+				t.Error("summary firehose_failed_events = 0, want the undelivered events counted")
+			}
+			if !strings.Contains(out.String(), `"run_summary"`) {
+				t.Error("-output events not written when -firehose-stream fails")
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// backupForecast is when a backup's protection lapses if the refresher stops
+// running: the earliest retain-until among its objects
+type backupForecast struct {
+	Manifest     string     `json:"manifest"`
+	Objects      int        `json:"objects"`       // objects whose retention the run learned
+	LapsesAt     *time.Time `json:"lapses_at"`     // earliest retain-until, null when an object has no retention
+	LapseObjects int        `json:"lapse_objects"` // objects retained only until LapsesAt
+}
+
+// forecastTracker records the retain-until each backup's objects are left
+// with after the run
+type forecastTracker struct {
+	manifests []string                         // in processing order
+	until     map[string]map[string]*time.Time // retain-until by object key, per manifest; nil for no retention
+}
+
+// newForecastTracker creates an empty forecastTracker
+func newForecastTracker() *forecastTracker {
+	return &forecastTracker{until: make(map[string]map[string]*time.Time)}
+}
+
+// retainedUntil returns the retain-until res leaves an object with: the date
+// the run set, else the one it observed, which a dry run leaves in place. ok
+// is false when the run didn't learn the object's retention.
+func retainedUntil(res objectResult) (until *time.Time, ok bool) {
+	switch res.action {
+	case actionUpdated, actionReduced:
+		until := res.retainUntil
+		return &until, true
+	case actionSkipped, actionWouldUpdate, actionWouldReduce:
+		if res.previous == nil {
+			return nil, false
+		}
+		return res.previous.RetainUntil, true
+	}
+	return nil, false
+}
+
+// record adds the outcome of the object key referenced by manifest
+func (f *forecastTracker) record(manifest, key string, res objectResult) {
+	until, ok := retainedUntil(res)
+	if manifest == "" || !ok {
+		return
+	}
+	keys := f.until[manifest]
+	if keys == nil {
+		keys = make(map[string]*time.Time)
+		f.until[manifest] = keys
+		f.manifests = append(f.manifests, manifest)
+	}
+	keys[key] = until
+}
+
+// forecast returns the forecast of every backup with an object of known
+// retention, soonest lapse first. Backups with an unprotected object come first.
+func (f *forecastTracker) forecast() []backupForecast {
+	var backups []backupForecast
+	for _, manifest := range f.manifests {
+		b := backupForecast{Manifest: manifest, Objects: len(f.until[manifest])}
+		unprotected := 0
+		for _, until := range f.until[manifest] {
+			switch {
+			case until == nil:
+				unprotected++
+			case b.LapsesAt == nil || until.Before(*b.LapsesAt):
+				t := until.UTC()
+				b.LapsesAt = &t
+				b.LapseObjects = 1
+			case until.Equal(*b.LapsesAt):
+				b.LapseObjects++
+			}
+		}
+		if unprotected > 0 {
+			b.LapsesAt, b.LapseObjects = nil, unprotected
+		}
+		backups = append(backups, b)
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		a, b := backups[i].LapsesAt, backups[j].LapsesAt
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a.Before(*b)
+	})
+	return backups
+}
+
+// validateForecastFormat checks the -expiry-forecast-format flag value
+func validateForecastFormat(format string) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("invalid -expiry-forecast-format %q: must be table or json", format)
+	}
+	return nil
+}
+
+// writeForecast writes backups as an aligned table or a JSON array
+func writeForecast(w io.Writer, backups []backupForecast, format string) error {
+	if format == "json" {
+		if backups == nil {
+			backups = []backupForecast{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(backups)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MANIFEST\tLAPSES AT\tOBJECTS AT THAT DATE\tOBJECTS")
+	for _, b := range backups {
+		lapses := "unprotected"
+		if b.LapsesAt != nil {
+			lapses = b.LapsesAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", b.Manifest, lapses, b.LapseObjects, b.Objects)
+	}
+	return tw.Flush()
+}
+
+// writeExpiryForecast writes the -expiry-forecast file for the processed backups
+func (r *refresher) writeExpiryForecast() error {
+	backups := r.forecast.forecast()
+	f, err := os.Create(r.opts.expiryForecast)
+	if err != nil {
+		return fmt.Errorf("failed to create expiry forecast: %w", err)
+	}
+	if err := writeForecast(f, backups, r.opts.forecastFormat); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write expiry forecast: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close expiry forecast: %w", err)
+	}
+	slog.Info("Wrote expiry forecast", "path", r.opts.expiryForecast, "backups", len(backups))
+	return nil
+}
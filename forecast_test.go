@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiryForecast(t *testing.T) {
+	jan := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	midFeb := feb.AddDate(0, 0, 14)
+	observed := func(action objectAction, until *time.Time) objectResult {
+		return objectResult{action: action, previous: &ObjectRetention{RetainUntil: until}}
+	}
+
+	f := newForecastTracker()
+	// b1 keeps its observed dates: two objects lapse in February
+	f.record("b1", "a", observed(actionSkipped, &mar))
+	f.record("b1", "b", observed(actionWouldUpdate, &feb))
+	f.record("b1", "c", observed(actionSkipped, &feb))
+	// b2's January object was updated to March, leaving its other object the earliest
+	f.record("b2", "a", observed(actionSkipped, &mar))
+	f.record("b2", "d", objectResult{action: actionUpdated, previous: &ObjectRetention{RetainUntil: &jan}, retainUntil: mar})
+	f.record("b2", "e", observed(actionSkipped, &midFeb))
+	// b3 has an object without any retention, so it's already unprotected
+	f.record("b3", "f", observed(actionSkipped, &jan))
+	f.record("b3", "g", observed(actionWouldUpdate, nil))
+	// Outcomes that tell nothing about the retention are left out
+	f.record("b4", "h", objectResult{action: actionError})
+	f.record("b4", "i", objectResult{action: actionMissing})
+	f.record("b1", "j", objectResult{action: actionSkipped})
+	f.record("", "k", observed(actionSkipped, &jan))
+
+	want := []backupForecast{
+		{Manifest: "b3", Objects: 2, LapseObjects: 1},
+		{Manifest: "b1", Objects: 3, LapsesAt: &feb, LapseObjects: 2},
+		{Manifest: "b2", Objects: 3, LapsesAt: &midFeb, LapseObjects: 1},
+	}
+	if got := f.forecast(); !reflect.DeepEqual(got, want) {
+		t.Errorf("forecast() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteForecast(t *testing.T) {
+	feb := time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)
+	backups := []backupForecast{
+		{Manifest: "links/host1/b2/meta/manifest.json", Objects: 3, LapseObjects: 1},
+		{Manifest: "links/host1/b1/meta/manifest.json", Objects: 3, LapsesAt: &feb, LapseObjects: 2},
+	}
+
+	var table bytes.Buffer
+	if err := writeForecast(&table, backups, "table"); err != nil {
+		t.Fatalf("writeForecast() error = %v", err)
+	}
+	want := "MANIFEST                           LAPSES AT             OBJECTS AT THAT DATE  OBJECTS\n" +
+		"links/host1/b2/meta/manifest.json  unprotected           1                     3\n" +
+		"links/host1/b1/meta/manifest.json  2025-02-01T00:00:00Z  2                     3\n"
+	if table.String() != want {
+		t.Errorf("table =\n%s\nwant\n%s", table.String(), want)
+	}
+
+	var out bytes.Buffer
+	if err := writeForecast(&out, nil, "json"); err != nil {
+		t.Fatalf("writeForecast() error = %v", err)
+	}
+	if strings.TrimSpace(out.String()) != "[]" {
+		t.Errorf("json = %q, want an empty array", out.String())
+	}
+}
+
+func TestRunExpiryForecast(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	early, late := now.AddDate(0, 0, 3), now.AddDate(0, 0, 60)
+
+	tests := []struct {
+		name   string
+		dryRun bool
+		want   time.Time
+	}{
+		// The object expiring within -min-retention only would be updated
+		{name: "dry run", dryRun: true, want: early},
+		// It was updated to -max-retention, before the other object's date
+		{name: "run", want: now.AddDate(0, 0, 30)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+			bucket.objects["links/host1/data/ks/t/a.db"] = ""
+			bucket.objects["links/host1/data/ks/t/b.db"] = ""
+			bucket.retention["links/host1/data/ks/t/a.db"] = early
+			bucket.retention["links/host1/data/ks/t/b.db"] = late
+
+			opts := testOptions()
+			opts.dryRun = tt.dryRun
+			opts.expiryForecast = filepath.Join(t.TempDir(), "forecast.json")
+			opts.forecastFormat = "json"
+			r := newRefresher(bucket.client(), opts, now)
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			data, err := os.ReadFile(opts.expiryForecast)
+			if err != nil {
+				t.Fatalf("failed to read forecast: %v", err)
+			}
+			var got []backupForecast
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("invalid forecast %s: %v", data, err)
+			}
+			if len(got) != 1 || got[0].LapsesAt == nil || !got[0].LapsesAt.Equal(tt.want) || got[0].LapseObjects != 1 || got[0].Objects != 2 {
+				t.Errorf("forecast = %s, want b1 lapsing at %s with 1 of 2 objects", data, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// Newest backup ages recorded for hosts whose age can't be told
+const (
+	freshnessNoBackups = "none"
+	freshnessUndated   = "undated"
+)
+
+// hostFreshness is the newest backup of a host
+type hostFreshness struct {
+	Host   string
+	Backup string    // "" when the host has no backup
+	Taken  time.Time // zero when the host has no dated backup
+	Age    time.Duration
+	Stale  bool // older than -max-backup-age, or no backup at all
+}
+
+// age formats the age of the host's newest backup for the summary
+func (h hostFreshness) age() string {
+	switch {
+	case h.Backup == "":
+		return freshnessNoBackups
+	case h.Taken.IsZero():
+		return freshnessUndated
+	}
+	return formatAge(h.Age)
+}
+
+// newestBackups returns the newest backup of each host of manifests, sorted
+// by hostname. A host whose backups are all undated reports one of them with
+// a zero Taken.
+func newestBackups(manifests []ManifestInfo, now time.Time) []hostFreshness {
+	newest := make(map[string]hostFreshness)
+	for _, m := range manifests {
+		mp, err := m.path()
+		if err != nil {
+			continue
+		}
+		h, seen := newest[mp.Host]
+		taken, dated := backupTimestamp(m)
+		if seen && (!dated || !taken.After(h.Taken)) {
+			continue
+		}
+		h = hostFreshness{Host: mp.Host, Backup: mp.Backup}
+		if dated {
+			h.Taken, h.Age = taken, now.Sub(taken)
+		}
+		newest[mp.Host] = h
+	}
+
+	hosts := make([]hostFreshness, 0, len(newest))
+	for _, h := range newest {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+// checkFreshness records the age of each host's newest backup for the
+// summary. With -max-backup-age, it warns about the hosts whose newest
+// backup is older, or that have none, and about the cluster when none of its
+// hosts has a recent backup, so a run re-protecting old backups can't hide
+// that new ones stopped being taken. Hosts skipped by -stale-host-days are
+// left out.
+func (r *refresher) checkFreshness(ctx context.Context, manifests []ManifestInfo) error {
+	maxAge := r.opts.maxBackupAge
+	hosts := newestBackups(manifests, r.now)
+	if maxAge > 0 {
+		empty, err := r.hostsWithoutBackups(ctx, manifests)
+		if err != nil {
+			return err
+		}
+		for _, hostname := range empty {
+			if !r.stats.isStaleHost(hostname) {
+				hosts = append(hosts, hostFreshness{Host: hostname})
+			}
+		}
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	}
+
+	// An undated backup may be recent, so it keeps its host and the cluster fresh
+	clusterStale := false
+	if maxAge > 0 {
+		clusterStale = true
+		for i := range hosts {
+			h := &hosts[i]
+			h.Stale = h.Backup == "" || (!h.Taken.IsZero() && h.Age > maxAge)
+			if !h.Stale {
+				clusterStale = false
+				continue
+			}
+			slog.Warn("Stale backups: the newest backup of the host is older than -max-backup-age", "host", h.Host, "newest_backup", h.Backup, "age", h.age(), "max_backup_age", maxAge)
+		}
+	}
+	if clusterStale {
+		slog.Warn("Stale backups: no backup of the cluster is newer than -max-backup-age", "cluster", r.opts.cluster, "hosts", len(hosts), "max_backup_age", maxAge)
+	}
+	r.stats.setFreshness(hosts, clusterStale)
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewestBackups(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	manifests := []ManifestInfo{
+		{Key: "links/host1/backup-1748563200/meta/manifest.json"}, // 2025-05-30
+		{Key: "links/host1/backup-1748649600/meta/manifest.json"}, // 2025-05-31
+		{Key: "links/host1/adhoc/meta/manifest.json"},
+		{Key: "links/host2/adhoc/meta/manifest.json"},
+	}
+	got := newestBackups(manifests, now)
+	want := []hostFreshness{
+		{Host: "host1", Backup: "backup-1748649600", Taken: time.Unix(1748649600, 0), Age: 24 * time.Hour},
+		{Host: "host2", Backup: "adhoc"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("newestBackups() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Host != want[i].Host || got[i].Backup != want[i].Backup || !got[i].Taken.Equal(want[i].Taken) || got[i].Age != want[i].Age {
+			t.Errorf("newestBackups()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if age := got[0].age(); age != "1d0h" {
+		t.Errorf("host1 age = %q, want 1d0h", age)
+	}
+	if age := got[1].age(); age != freshnessUndated {
+		t.Errorf("host2 age = %q, want %s", age, freshnessUndated)
+	}
+}
+
+func TestRunBackupFreshness(t *testing.T) {
+	now := time.Now()
+	backup := func(host string, age time.Duration) string {
+		return fmt.Sprintf("links/%s/medusa-backup-schedule-%d/meta/manifest.json", host, now.Add(-age).Unix())
+	}
+
+	tests := []struct {
+		name           string
+		objects        []string
+		maxAge         time.Duration
+		fail           bool
+		wantAges       map[string]string
+		wantStaleHosts []string
+		wantCluster    bool
+		wantErr        bool
+	}{
+		{
+			name:     "fresh",
+			objects:  []string{backup("host1", time.Hour), backup("host2", 2*time.Hour)},
+			maxAge:   36 * time.Hour,
+			fail:     true,
+			wantAges: map[string]string{"host1": "0d1h", "host2": "0d2h"},
+		},
+		{
+			// Warned about and listed in the summary, but the run succeeds
+			name:           "stale host",
+			objects:        []string{backup("host1", time.Hour), backup("host2", 72*time.Hour)},
+			maxAge:         36 * time.Hour,
+			wantAges:       map[string]string{"host1": "0d1h", "host2": "3d0h"},
+			wantStaleHosts: []string{"host2"},
+		},
+		{
+			name:           "fail on stale host",
+			objects:        []string{backup("host1", time.Hour), backup("host2", 72*time.Hour)},
+			maxAge:         36 * time.Hour,
+			fail:           true,
+			wantAges:       map[string]string{"host1": "0d1h", "host2": "3d0h"},
+			wantStaleHosts: []string{"host2"},
+			wantErr:        true,
+		},
+		{
+			// host3's backups were all purged, only data files are left
+			name:           "host without backups",
+			objects:        []string{backup("host1", time.Hour), "links/host3/data/ks/t/c.db"},
+			maxAge:         36 * time.Hour,
+			fail:           true,
+			wantAges:       map[string]string{"host1": "0d1h", "host3": freshnessNoBackups},
+			wantStaleHosts: []string{"host3"},
+			wantErr:        true,
+		},
+		{
+			name:           "whole cluster stale",
+			objects:        []string{backup("host1", 48*time.Hour), backup("host2", 72*time.Hour)},
+			maxAge:         36 * time.Hour,
+			fail:           true,
+			wantAges:       map[string]string{"host1": "2d0h", "host2": "3d0h"},
+			wantStaleHosts: []string{"host1", "host2"},
+			wantCluster:    true,
+			wantErr:        true,
+		},
+		{
+			name:        "cluster without backups",
+			maxAge:      36 * time.Hour,
+			fail:        true,
+			wantCluster: true,
+			wantErr:     true,
+		},
+		{
+			// Ages are reported without -max-backup-age, and nothing is stale
+			name:     "no max backup age",
+			objects:  []string{backup("host1", 72*time.Hour)},
+			wantAges: map[string]string{"host1": "3d0h"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			for _, key := range tt.objects {
+				bucket.objects[key] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+			}
+			opts := testOptions()
+			opts.maxBackupAge = tt.maxAge
+			opts.failOnStale = tt.fail
+			r := newRefresher(bucket.client(), opts, now)
+			err := r.run(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				var exit *exitError
+				if !errors.As(err, &exit) || exitCode(err) != exitStaleBackups {
+					t.Errorf("run() error = %v, want exit status %d", err, exitStaleBackups)
+				}
+			}
+
+			sum := r.stats.summary(time.Now())
+			if !reflect.DeepEqual(sum.NewestBackupAges, tt.wantAges) {
+				t.Errorf("summary newest_backup_ages = %v, want %v", sum.NewestBackupAges, tt.wantAges)
+			}
+			if !reflect.DeepEqual(sum.StaleBackupHosts, tt.wantStaleHosts) {
+				t.Errorf("summary stale_backup_hosts = %v, want %v", sum.StaleBackupHosts, tt.wantStaleHosts)
+			}
+			if sum.ClusterBackupStale != tt.wantCluster {
+				t.Errorf("summary cluster_backup_stale = %v, want %v", sum.ClusterBackupStale, tt.wantCluster)
+			}
+			// Stale backups are still processed
+			if len(tt.objects) > 0 && sum.ManifestsProcessed == 0 {
+				t.Error("run() processed no manifest")
+			}
+		})
+	}
+}
+
+func TestRunFreshnessIgnoresStaleHostDays(t *testing.T) {
+	now := time.Now()
+	bucket := newFakeBucket()
+	bucket.objects[fmt.Sprintf("links/host1/medusa-backup-schedule-%d/meta/manifest.json", now.Add(-time.Hour).Unix())] = `[]`
+	// Decommissioned hosts skipped by -stale-host-days aren't stale backups
+	bucket.objects[fmt.Sprintf("links/host2/medusa-backup-schedule-%d/meta/manifest.json", now.AddDate(-1, 0, 0).Unix())] = `[]`
+	bucket.objects["links/host3/data/ks/t/c.db"] = ""
+
+	opts := testOptions()
+	opts.staleHostDays = 30
+	opts.maxBackupAge = 36 * time.Hour
+	opts.failOnStale = true
+	r := newRefresher(bucket.client(), opts, now)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	sum := r.stats.summary(time.Now())
+	if want := map[string]string{"host1": "0d1h"}; !reflect.DeepEqual(sum.NewestBackupAges, want) {
+		t.Errorf("summary newest_backup_ages = %v, want %v", sum.NewestBackupAges, want)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// defaultStallTimeout is how long a pass may go without processing anything
+// before /healthz fails
+const defaultStallTimeout = 30 * time.Minute
+
+// Pass states reported by /status
+const (
+	passStarting = "starting" // validating the configuration, before the first pass
+	passRunning  = "running"
+	passWaiting  = "waiting" // for the next pass
+)
+
+// daemonHealth follows the -interval passes for the -health-listen probes. It
+// is safe for concurrent use.
+type daemonHealth struct {
+	stallTimeout time.Duration
+	now          func() time.Time // time.Now, replaced in tests
+
+	mu         sync.Mutex
+	ready      bool
+	pass       int
+	runID      string
+	stats      *runStats // of the running pass, nil between passes
+	started    time.Time // of the running pass
+	processed  int       // objects and manifests processed when last checked
+	progressed time.Time // when processed last changed
+	lastEnded  time.Time
+	lastErr    error
+	failed     int // passes in a row that failed
+}
+
+func newDaemonHealth(stallTimeout time.Duration) *daemonHealth {
+	return &daemonHealth{stallTimeout: stallTimeout, now: time.Now}
+}
+
+// setReady records that the configuration and AWS credentials were validated
+func (h *daemonHealth) setReady() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = true
+}
+
+// passStarted records the start of a pass
+func (h *daemonHealth) passStarted(pass int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pass, h.runID, h.stats = pass, "", nil
+	h.started, h.progressed, h.processed = h.now(), h.now(), 0
+}
+
+// passRunning records the run of the current pass, whose stats /status reports
+func (h *daemonHealth) passRunning(runID string, stats *runStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runID, h.stats = runID, stats
+}
+
+// passEnded records the outcome of the current pass
+func (h *daemonHealth) passEnded(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stats, h.started = nil, time.Time{}
+	h.lastEnded, h.lastErr = h.now(), err
+	if err != nil {
+		h.failed++
+	} else {
+		h.failed = 0
+	}
+}
+
+// stalled returns how long the running pass hasn't processed anything, when
+// longer than the stall timeout. h.mu must be held.
+func (h *daemonHealth) stalled() (time.Duration, bool) {
+	if h.started.IsZero() || h.stallTimeout <= 0 {
+		return 0, false
+	}
+	now := h.now()
+	if h.stats != nil {
+		p := h.stats.progress(now)
+		if processed := p.objects + p.manifests; processed != h.processed {
+			h.processed, h.progressed = processed, now
+		}
+	}
+	idle := now.Sub(h.progressed)
+	return idle, idle > h.stallTimeout
+}
+
+// passStatus is the /status document
+type passStatus struct {
+	State               string     `json:"state"`
+	Pass                int        `json:"pass"`
+	RunID               string     `json:"run_id,omitempty"`
+	StartedAt           *time.Time `json:"started_at,omitempty"`
+	Elapsed             string     `json:"elapsed,omitempty"`
+	Objects             int        `json:"objects"`
+	TotalObjects        int        `json:"total_objects"`
+	Manifests           int        `json:"manifests"`
+	TotalManifests      int        `json:"total_manifests"`
+	ObjectsPerSecond    float64    `json:"objects_per_second"`
+	LastPassEndedAt     *time.Time `json:"last_pass_ended_at,omitempty"`
+	LastPassError       string     `json:"last_pass_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
+// status returns the progress of the running pass, or the outcome of the
+// last one
+func (h *daemonHealth) status() passStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := passStatus{State: passWaiting, Pass: h.pass, RunID: h.runID, ConsecutiveFailures: h.failed}
+	switch {
+	case !h.started.IsZero():
+		s.State = passRunning
+		started := h.started
+		s.StartedAt = &started
+		s.Elapsed = h.now().Sub(started).Round(time.Second).String()
+	case h.pass == 0:
+		s.State = passStarting
+	}
+	if h.stats != nil {
+		p := h.stats.progress(h.now())
+		s.Objects, s.TotalObjects = p.objects, p.totalObjects
+		s.Manifests, s.TotalManifests = p.manifests, p.totalManifests
+		s.ObjectsPerSecond = p.rate()
+	}
+	if !h.lastEnded.IsZero() {
+		ended := h.lastEnded
+		s.LastPassEndedAt = &ended
+	}
+	if h.lastErr != nil {
+		s.LastPassError = h.lastErr.Error()
+	}
+	return s
+}
+
+// handler serves /healthz, /readyz and /status
+func (h *daemonHealth) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		h.mu.Lock()
+		idle, stalled := h.stalled()
+		pass := h.pass
+		h.mu.Unlock()
+		if stalled {
+			http.Error(w, fmt.Sprintf("pass %d processed nothing for %s, above -stall-timeout", pass, idle.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		h.mu.Lock()
+		ready := h.ready
+		h.mu.Unlock()
+		if !ready {
+			http.Error(w, "AWS credentials not validated yet", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(h.status()); err != nil {
+			slog.Debug("Failed to serve status", "error", err.Error())
+		}
+	})
+	return mux
+}
+
+// validate checks that the AWS credentials resolve to a principal before the
+// first pass. -offline runs make no AWS calls, so there's nothing to check.
+func (d *daemon) validate(ctx context.Context) error {
+	if d.opts.offline {
+		return nil
+	}
+	if d.sts == nil {
+		client, err := newSTSClient(ctx, d.opts.commonOptions)
+		if err != nil {
+			return err
+		}
+		d.sts = client
+	}
+	identity, err := d.sts.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("failed to validate AWS credentials: %w", err)
+	}
+	slog.Info("Validated AWS credentials", "principal", aws.ToString(identity.Arn))
+	return nil
+}
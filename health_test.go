@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// probe requests path from h's handler, returning the status code and body
+func probe(h *daemonHealth, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	h.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHealthHandlers(t *testing.T) {
+	start := time.Date(2025, 6, 1, 2, 0, 0, 0, time.UTC)
+	now := start
+	h := newDaemonHealth(10 * time.Minute)
+	h.now = func() time.Time { return now }
+	stats := newRunStats(start)
+
+	steps := []struct {
+		name       string
+		do         func()
+		wantLive   int
+		wantReady  int
+		wantStatus passStatus
+	}{
+		{
+			name:       "starting",
+			do:         func() {},
+			wantLive:   http.StatusOK,
+			wantReady:  http.StatusServiceUnavailable,
+			wantStatus: passStatus{State: passStarting},
+		},
+		{
+			name: "pass progressing",
+			do: func() {
+				h.setReady()
+				h.passStarted(1)
+				h.passRunning("run-1", stats)
+				stats.setTotalObjects(10)
+				now = now.Add(8 * time.Minute)
+				stats.record(actionUpdated)
+			},
+			wantLive:   http.StatusOK,
+			wantReady:  http.StatusOK,
+			wantStatus: passStatus{State: passRunning, Pass: 1, RunID: "run-1", Elapsed: "8m0s", Objects: 1, TotalObjects: 10},
+		},
+		{
+			name: "pass stalled",
+			do: func() {
+				now = now.Add(11 * time.Minute)
+			},
+			wantLive:   http.StatusServiceUnavailable,
+			wantReady:  http.StatusOK,
+			wantStatus: passStatus{State: passRunning, Pass: 1, RunID: "run-1", Elapsed: "19m0s", Objects: 1, TotalObjects: 10},
+		},
+		{
+			name: "stalled pass progressing again",
+			do: func() {
+				stats.record(actionSkipped)
+			},
+			wantLive:   http.StatusOK,
+			wantReady:  http.StatusOK,
+			wantStatus: passStatus{State: passRunning, Pass: 1, RunID: "run-1", Elapsed: "19m0s", Objects: 2, TotalObjects: 10},
+		},
+		{
+			name: "waiting after a failed pass",
+			do: func() {
+				h.passEnded(errors.New("failed to list objects: AccessDenied"))
+				now = now.Add(time.Hour)
+			},
+			wantLive:   http.StatusOK,
+			wantReady:  http.StatusOK,
+			wantStatus: passStatus{State: passWaiting, Pass: 1, RunID: "run-1", LastPassError: "failed to list objects: AccessDenied", ConsecutiveFailures: 1},
+		},
+		{
+			name: "next pass discovering manifests for long",
+			do: func() {
+				h.passStarted(2)
+				now = now.Add(15 * time.Minute)
+			},
+			wantLive:   http.StatusServiceUnavailable,
+			wantReady:  http.StatusOK,
+			wantStatus: passStatus{State: passRunning, Pass: 2, Elapsed: "15m0s", LastPassError: "failed to list objects: AccessDenied", ConsecutiveFailures: 1},
+		},
+	}
+	for _, step := range steps {
+		step.do()
+		if code, body := probe(h, "/healthz"); code != step.wantLive {
+			t.Errorf("%s: /healthz = %d %q, want %d", step.name, code, body, step.wantLive)
+		}
+		if code, body := probe(h, "/readyz"); code != step.wantReady {
+			t.Errorf("%s: /readyz = %d %q, want %d", step.name, code, body, step.wantReady)
+		}
+		code, body := probe(h, "/status")
+		var got passStatus
+		if err := json.Unmarshal([]byte(body), &got); code != http.StatusOK || err != nil {
+			t.Fatalf("%s: /status = %d %q, want JSON", step.name, code, body)
+		}
+		got.StartedAt, got.LastPassEndedAt, got.ObjectsPerSecond = nil, nil, 0
+		if got != step.wantStatus {
+			t.Errorf("%s: /status = %+v, want %+v", step.name, got, step.wantStatus)
+		}
+	}
+}
+
+func TestHealthNeverStallsWithoutTimeout(t *testing.T) {
+	now := time.Now()
+	h := newDaemonHealth(0)
+	h.now = func() time.Time { return now }
+	h.passStarted(1)
+	now = now.Add(24 * time.Hour)
+	if code, body := probe(h, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d %q, want ok with -stall-timeout 0", code, body)
+	}
+}
+
+// get fetches path from the server at addr
+func get(addr, path string) (int, string, error) {
+	resp, err := http.Get("http://" + addr + path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+func TestDaemonServesHealth(t *testing.T) {
+	opts := testOptions()
+	opts.interval = time.Hour
+	opts.maxFailedPasses = defaultMaxFailedPasses
+	opts.healthListen = freeAddress(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := newDaemon(newFakeBucket().client(), opts)
+	d.sts = &mockSTS{arn: testPrincipal}
+	d.pass = func(context.Context) error {
+		defer cancel()
+		if code, body, err := get(opts.healthListen, "/readyz"); err != nil || code != http.StatusOK {
+			t.Errorf("/readyz = %d %q %v during the pass, want ok", code, body, err)
+		}
+		if _, body, err := get(opts.healthListen, "/status"); err != nil || !strings.Contains(body, `"state":"running"`) {
+			t.Errorf("/status = %q %v during the pass, want it running", body, err)
+		}
+		return nil
+	}
+	if err := d.loop(ctx); err != nil {
+		t.Fatalf("loop() error = %v", err)
+	}
+	if _, _, err := get(opts.healthListen, "/healthz"); err == nil {
+		t.Error("probes still served once the context was canceled")
+	}
+}
+
+func TestDaemonValidatesCredentials(t *testing.T) {
+	opts := testOptions()
+	opts.interval = time.Hour
+	opts.maxFailedPasses = defaultMaxFailedPasses
+	d := newDaemon(newFakeBucket().client(), opts)
+	d.sts = &mockSTS{err: errors.New("ExpiredToken")}
+	d.pass = func(context.Context) error {
+		t.Error("pass ran with invalid credentials")
+		return nil
+	}
+	if err := d.loop(context.Background()); err == nil || !strings.Contains(err.Error(), "failed to validate AWS credentials") {
+		t.Errorf("loop() error = %v, want the credentials rejected", err)
+	}
+	if code, _ := probe(d.health, "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz = %d, want not ready", code)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Signals pinged to -healthcheck-url, appended to its path; success pings
+// the URL itself
+const (
+	healthcheckStart = "start"
+	healthcheckFail  = "fail"
+)
+
+// healthcheckTimeout bounds each -healthcheck-url request, so that a slow
+// monitoring service barely holds the run up
+const healthcheckTimeout = 10 * time.Second
+
+// healthcheckAttempts is how many times a ping is sent before giving up on
+// 5xx responses and network errors
+const healthcheckAttempts = 3
+
+// healthcheckBackoff is the wait before the second attempt, doubled before
+// each following one
+var healthcheckBackoff = time.Second
+
+// healthcheckURL returns the URL signal is pinged at: base with /signal
+// appended to its path, or base itself for success
+func healthcheckURL(base, signal string) string {
+	u, err := url.Parse(base)
+	if err != nil || signal == "" {
+		return base
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + signal
+	u.RawPath = ""
+	return u.String()
+}
+
+// pingOnce sends one ping: a GET without body, a POST with it
+func pingOnce(ctx context.Context, client *http.Client, target string, body []byte) error {
+	method := http.MethodGet
+	if body != nil {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errWebhookRejected, err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	if resp.StatusCode/100 != 5 {
+		return fmt.Errorf("%w: %w", errWebhookRejected, err)
+	}
+	return err
+}
+
+// pingHealthcheck pings -healthcheck-url with signal, retrying 5xx responses
+// and network errors with exponential backoff. Failures are only logged:
+// monitoring never changes the run's outcome.
+func (r *refresher) pingHealthcheck(ctx context.Context, signal string, body []byte) {
+	target := healthcheckURL(r.opts.healthcheckURL, signal)
+	client := &http.Client{Timeout: healthcheckTimeout}
+	wait := healthcheckBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = pingOnce(ctx, client, target, body); err == nil {
+			slog.Debug("Pinged -healthcheck-url", "url", redactURL(target))
+			return
+		}
+		if errors.Is(err, errWebhookRejected) || attempt == healthcheckAttempts {
+			break
+		}
+		slog.Debug("Retrying -healthcheck-url", "url", redactURL(target), "attempt", attempt, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(wait):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wait *= 2
+	}
+	slog.Warn("Failed to ping -healthcheck-url", "url", redactURL(target), "error", err.Error())
+}
+
+// finishHealthcheck pings -healthcheck-url with the run's outcome, runErr,
+// and its summary as the body
+func (r *refresher) finishHealthcheck(ctx context.Context, runErr error) {
+	signal := ""
+	if runErr != nil {
+		signal = healthcheckFail
+	}
+	body, err := json.Marshal(r.webhookPayload(runErr, time.Now()))
+	if err != nil {
+		slog.Warn("Failed to encode -healthcheck-url summary", "error", err.Error())
+		body = []byte{}
+	}
+	// The outcome is pinged even when the run was interrupted
+	r.pingHealthcheck(context.WithoutCancel(ctx), signal, body)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// healthcheckPing is a request received by a healthcheckServer
+type healthcheckPing struct {
+	method string
+	path   string
+	body   []byte
+}
+
+// healthcheckServer records pings, answering them with the given statuses in
+// turn, then 200
+type healthcheckServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	pings    []healthcheckPing
+}
+
+func newHealthcheckServer(statuses ...int) *healthcheckServer {
+	s := &healthcheckServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.pings = append(s.pings, healthcheckPing{method: req.Method, path: req.URL.RequestURI(), body: body})
+		if len(s.statuses) > 0 {
+			status := s.statuses[0]
+			s.statuses = s.statuses[1:]
+			http.Error(w, http.StatusText(status), status)
+		}
+	}))
+	return s
+}
+
+func fastHealthcheckRetries(t *testing.T) {
+	backoff := healthcheckBackoff
+	healthcheckBackoff = time.Millisecond
+	t.Cleanup(func() { healthcheckBackoff = backoff })
+}
+
+func TestHealthcheckURL(t *testing.T) {
+	tests := []struct {
+		base   string
+		signal string
+		want   string
+	}{
+		{"https://hc-ping.com/0f1e2d3c", healthcheckStart, "https://hc-ping.com/0f1e2d3c/start"},
+		{"https://hc-ping.com/0f1e2d3c/", healthcheckFail, "https://hc-ping.com/0f1e2d3c/fail"},
+		{"https://hc-ping.com/0f1e2d3c", "", "https://hc-ping.com/0f1e2d3c"},
+		{"https://monitor.example.com/ping/medusa?create=1", healthcheckFail, "https://monitor.example.com/ping/medusa/fail?create=1"},
+	}
+	for _, tt := range tests {
+		if got := healthcheckURL(tt.base, tt.signal); got != tt.want {
+			t.Errorf("healthcheckURL(%q, %q) = %q, want %q", tt.base, tt.signal, got, tt.want)
+		}
+	}
+}
+
+func TestRunPingsHealthcheck(t *testing.T) {
+	fastHealthcheckRetries(t)
+	tests := []struct {
+		name      string
+		listErr   error
+		statuses  []int
+		wantPaths []string
+		wantErr   bool
+	}{
+		{
+			name:      "success",
+			wantPaths: []string{"/ping/medusa/start", "/ping/medusa"},
+		},
+		{
+			name:      "failure",
+			listErr:   errors.New("AccessDenied"),
+			wantPaths: []string{"/ping/medusa/start", "/ping/medusa/fail"},
+			wantErr:   true,
+		},
+		{
+			name:      "pings retried",
+			statuses:  []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+			wantPaths: []string{"/ping/medusa/start", "/ping/medusa/start", "/ping/medusa/start", "/ping/medusa"},
+		},
+		{
+			name:      "pings failing",
+			statuses:  []int{http.StatusNotFound, 500, 500, 500},
+			wantPaths: []string{"/ping/medusa/start", "/ping/medusa", "/ping/medusa", "/ping/medusa"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newHealthcheckServer(tt.statuses...)
+			defer s.Close()
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+			bucket.objects["links/host1/data/ks/t/a.db"] = ""
+			client := bucket.client()
+			if tt.listErr != nil {
+				client.ListObjectsV2Func = func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return nil, tt.listErr
+				}
+			}
+			opts := testOptions()
+			opts.healthcheckURL = s.URL + "/ping/medusa"
+			err := newRefresher(client, opts, time.Now()).run(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if len(s.pings) != len(tt.wantPaths) {
+				t.Fatalf("got %d pings %v, want %v", len(s.pings), s.pings, tt.wantPaths)
+			}
+			for i, ping := range s.pings {
+				if ping.path != tt.wantPaths[i] {
+					t.Errorf("ping %d to %s, want %s", i, ping.path, tt.wantPaths[i])
+				}
+			}
+			start, end := s.pings[0], s.pings[len(s.pings)-1]
+			if start.method != http.MethodGet || len(start.body) != 0 {
+				t.Errorf("start ping = %s with %q, want a GET without body", start.method, start.body)
+			}
+			var payload map[string]any
+			if err := json.Unmarshal(end.body, &payload); end.method != http.MethodPost || err != nil {
+				t.Fatalf("end ping = %s with %q, want the summary posted", end.method, end.body)
+			}
+			if payload["event"] != eventRunSummary || payload["success"] != !tt.wantErr {
+				t.Errorf("end ping summary = %v, want the run_summary of the run", payload)
+			}
+			if _, ok := payload["error"]; ok != tt.wantErr {
+				t.Errorf("end ping summary error = %v, want it only for a failed run", payload["error"])
+			}
+		})
+	}
+}
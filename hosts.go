@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// defaultHostnamePattern matches the statefulset pod names k8ssandra runs
+// Cassandra nodes as, <cluster>-<dc>-<rack>-sts-<ordinal>, e.g. links-us-default-sts-8
+const defaultHostnamePattern = `^(?P<cluster>.+)-(?P<dc>[^-]+)-(?P<rack>[^-]+)-sts-\d+$`
+
+// hostFilter selects the hosts a run operates on by -hostname-regex and -dc
+type hostFilter struct {
+	pattern *regexp.Regexp // nil when neither flag is set
+	dcs     stringList
+}
+
+// compile sets up the filter from the -hostname-regex value, falling back to
+// the statefulset pattern when only -dc is set
+func (f *hostFilter) compile(expr string) error {
+	if expr == "" {
+		if len(f.dcs) == 0 {
+			return nil
+		}
+		expr = defaultHostnamePattern
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid -hostname-regex: %w", err)
+	}
+	if len(f.dcs) > 0 && pattern.SubexpIndex("dc") < 0 {
+		return fmt.Errorf("-dc needs a -hostname-regex with a (?P<dc>...) group, got %q", expr)
+	}
+	f.pattern = pattern
+	return nil
+}
+
+// active reports whether hosts are filtered
+func (f *hostFilter) active() bool {
+	return f.pattern != nil
+}
+
+// match reports whether hostname is selected, and the datacenter captured
+// by the pattern's dc group, "" when it has none
+func (f *hostFilter) match(hostname string) (string, bool) {
+	groups := f.pattern.FindStringSubmatch(hostname)
+	if groups == nil {
+		return "", false
+	}
+	var dc string
+	if i := f.pattern.SubexpIndex("dc"); i >= 0 {
+		dc = groups[i]
+	}
+	if len(f.dcs) > 0 && !slices.Contains(f.dcs, dc) {
+		return dc, false
+	}
+	return dc, true
+}
+
+// manifestHostname returns the hostname segment of a manifest key
+func manifestHostname(m ManifestInfo) (string, bool) {
+	mp, err := m.path()
+	if err != nil {
+		return "", false
+	}
+	return mp.Host, true
+}
+
+// filterManifestsByHost keeps the manifests of hosts f selects
+func filterManifestsByHost(manifests []ManifestInfo, f *hostFilter) ([]ManifestInfo, int) {
+	var kept []ManifestInfo
+	for _, m := range manifests {
+		hostname, ok := manifestHostname(m)
+		if !ok {
+			continue
+		}
+		if _, ok := f.match(hostname); ok {
+			kept = append(kept, m)
+		}
+	}
+	return kept, len(manifests) - len(kept)
+}
+
+// listHostnames lists the hostname directories under [basePrefix][cluster]/
+func listHostnames(ctx context.Context, client S3API, bucket, basePrefix, cluster string) ([]string, error) {
+	prefix := basePrefix + cluster + "/"
+	var hostnames []string
+	var continuationToken *string
+	for {
+		resp, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucket),
+			Prefix:            aws.String(prefix),
+			Delimiter:         aws.String("/"),
+			ContinuationToken: continuationToken,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list hostnames: %w", err)
+		}
+		for _, p := range resp.CommonPrefixes {
+			hostname := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(p.Prefix), prefix), "/")
+			if hostname != "" {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		if !aws.ToBool(resp.IsTruncated) {
+			return hostnames, nil
+		}
+		continuationToken = resp.NextContinuationToken
+	}
+}
+
+// findHostManifests finds the manifests of the hosts -hostname-regex and -dc
+// select, listing only their directories instead of the whole cluster prefix
+func findHostManifests(ctx context.Context, client S3API, opts *options, index objectIndex) ([]ManifestInfo, error) {
+	hostnames, err := listHostnames(ctx, client, opts.bucket, opts.prefix, opts.cluster)
+	if err != nil {
+		return nil, err
+	}
+	var manifests []ManifestInfo
+	selected := 0
+	for _, hostname := range hostnames {
+		if _, ok := opts.hosts.match(hostname); !ok {
+			continue
+		}
+		selected++
+		found, err := listManifests(ctx, client, opts.bucket, opts.prefix, opts.prefix+opts.cluster+"/"+hostname+"/", index)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, found...)
+	}
+	slog.Info("Listed hosts selected by -hostname-regex/-dc", "hosts", len(hostnames), "selected", selected)
+	return manifests, nil
+}
+
+// recordHostDCs records the datacenter of every selected manifest's host, for
+// the summary and the report
+func (r *refresher) recordHostDCs(manifests []ManifestInfo) {
+	if r.opts.hosts.pattern.SubexpIndex("dc") < 0 {
+		return
+	}
+	dcs := make(map[string]string)
+	for _, m := range manifests {
+		hostname, ok := manifestHostname(m)
+		if !ok {
+			continue
+		}
+		dc, _ := r.opts.hosts.match(hostname)
+		dcs[hostname] = dc
+		r.manifestDCs[m.Key] = dc
+	}
+	r.stats.setHostDCs(dcs)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostFilterMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		regex    string
+		dcs      []string
+		hostname string
+		wantDC   string
+		wantOK   bool
+	}{
+		{name: "statefulset us", dcs: []string{"us"}, hostname: "links-us-default-sts-8", wantDC: "us", wantOK: true},
+		{name: "statefulset eu not selected", dcs: []string{"us"}, hostname: "links-eu-default-sts-3", wantDC: "eu"},
+		{name: "several dcs", dcs: []string{"us", "eu"}, hostname: "links-eu-default-sts-3", wantDC: "eu", wantOK: true},
+		{name: "cluster name with dashes", dcs: []string{"ap"}, hostname: "prod-links-ap-rack2-sts-12", wantDC: "ap", wantOK: true},
+		{name: "not a statefulset pod", dcs: []string{"us"}, hostname: "cassandra-node-1"},
+		{name: "custom regex with dc", regex: `^(?P<dc>dc\d)-node\d+$`, dcs: []string{"dc2"}, hostname: "dc2-node7", wantDC: "dc2", wantOK: true},
+		{name: "custom regex without -dc", regex: `^links-(?P<dc>[a-z]+)-`, hostname: "links-eu-default-sts-3", wantDC: "eu", wantOK: true},
+		{name: "custom regex without dc group", regex: `-sts-[0-3]$`, hostname: "links-us-default-sts-2", wantOK: true},
+		{name: "custom regex no match", regex: `-sts-[0-3]$`, hostname: "links-us-default-sts-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := hostFilter{dcs: tt.dcs}
+			if err := f.compile(tt.regex); err != nil {
+				t.Fatalf("compile() error = %v", err)
+			}
+			dc, ok := f.match(tt.hostname)
+			if dc != tt.wantDC || ok != tt.wantOK {
+				t.Errorf("match(%q) = %q, %v, want %q, %v", tt.hostname, dc, ok, tt.wantDC, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestHostFilterCompile(t *testing.T) {
+	var f hostFilter
+	if err := f.compile(""); err != nil || f.active() {
+		t.Errorf("compile(\"\") = %v, active %v, want an inactive filter", err, f.active())
+	}
+	if err := (&hostFilter{}).compile("links-("); err == nil || !strings.Contains(err.Error(), "-hostname-regex") {
+		t.Errorf("compile() error = %v, want an invalid -hostname-regex error", err)
+	}
+	if err := (&hostFilter{dcs: stringList{"us"}}).compile(`-sts-\d+$`); err == nil || !strings.Contains(err.Error(), "(?P<dc>...)") {
+		t.Errorf("compile() error = %v, want an error about the missing dc group", err)
+	}
+}
+
+func TestRunDCFilter(t *testing.T) {
+	bucket := newFakeBucket()
+	for _, host := range []string{"links-us-default-sts-0", "links-us-default-sts-1", "links-eu-default-sts-0"} {
+		bucket.objects["links/"+host+"/medusa-backup-schedule-1764858600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+		bucket.objects["links/"+host+"/data/ks/t/a.db"] = ""
+	}
+
+	opts := testOptions()
+	opts.report = filepath.Join(t.TempDir(), "report.jsonl")
+	opts.hosts.dcs = stringList{"us"}
+	if err := opts.hosts.compile(""); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.withReport(func() error { return r.run(context.Background()) }); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	wantUpdated := []string{"links/links-us-default-sts-0/data/ks/t/a.db", "links/links-us-default-sts-1/data/ks/t/a.db"}
+	if got := bucket.putKeys(); !reflect.DeepEqual(sortedCopy(got), wantUpdated) {
+		t.Errorf("updated %v, want %v", got, wantUpdated)
+	}
+	// Only the selected hosts' directories are listed in full
+	listed := sortedCopy(bucket.listed)
+	if want := []string{"links/links-us-default-sts-0/", "links/links-us-default-sts-1/"}; !reflect.DeepEqual(listed, want) {
+		t.Errorf("listed %v, want %v", listed, want)
+	}
+
+	wantDCs := map[string]string{"links-us-default-sts-0": "us", "links-us-default-sts-1": "us"}
+	if got := r.stats.summary(time.Now()).HostDCs; !reflect.DeepEqual(got, wantDCs) {
+		t.Errorf("summary host_dcs = %v, want %v", got, wantDCs)
+	}
+	for _, rec := range readReport(t, opts.report) {
+		if rec["dc"] != "us" {
+			t.Errorf("report record %v has dc %v, want us", rec, rec["dc"])
+		}
+	}
+}
+
+func TestRunHostnameRegexWithManifestsFile(t *testing.T) {
+	bucket := newFakeBucket()
+	var keys []string
+	for _, host := range []string{"links-us-default-sts-0", "links-eu-default-sts-0"} {
+		key := "links/" + host + "/medusa-backup-schedule-1764858600/meta/manifest.json"
+		keys = append(keys, key)
+		bucket.objects[key] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+		bucket.objects["links/"+host+"/data/ks/t/a.db"] = ""
+	}
+
+	opts := testOptions()
+	opts.manifestsFile = filepath.Join(t.TempDir(), "manifests.txt")
+	if err := os.WriteFile(opts.manifestsFile, []byte(strings.Join(keys, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := opts.hosts.compile(`^links-eu-`); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	if err := run(context.Background(), bucket.client(), opts); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if got, want := bucket.putKeys(), []string{"links/links-eu-default-sts-0/data/ks/t/a.db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("updated %v, want %v", got, want)
+	}
+}
+
+// sortedCopy returns a sorted copy of keys
+func sortedCopy(keys []string) []string {
+	c := append([]string(nil), keys...)
+	sort.Strings(c)
+	return c
+}
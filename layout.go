@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultPathDepth is Medusa's [cluster]/[hostname]/[backup_name] layout
+const defaultPathDepth = 2
+
+// pathDepth is the -path-depth flag: how many segments of a manifest key below
+// -prefix come before the backup name, e.g. 3 for [cluster]/[dc]/[hostname].
+// The zero value is defaultPathDepth.
+type pathDepth int
+
+// autoPathDepth locates the backup name as the directory holding
+// meta/manifest.json instead of at a fixed depth
+const autoPathDepth pathDepth = -1
+
+// segments returns the number of segments before the backup name, or -1 for
+// autoPathDepth
+func (d pathDepth) segments() int {
+	if d == 0 {
+		return defaultPathDepth
+	}
+	return int(d)
+}
+
+func (d *pathDepth) String() string {
+	if *d == autoPathDepth {
+		return "auto"
+	}
+	return strconv.Itoa(d.segments())
+}
+
+func (d *pathDepth) Set(value string) error {
+	if value == "auto" {
+		*d = autoPathDepth
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < defaultPathDepth {
+		return fmt.Errorf("must be auto or a number of segments of at least %d ([cluster]/[hostname])", defaultPathDepth)
+	}
+	*d = pathDepth(n)
+	return nil
+}
+
+// manifestPath is what a manifest key tells about its backup
+type manifestPath struct {
+	Cluster      string
+	Host         string // the segment just before the backup name, e.g. a pod name or FQDN
+	Backup       string
+	HostnamePath string // [prefix][cluster]/.../[hostname]/, where the host's data files are stored
+}
+
+// extractHostnamePath splits a manifest key below prefix into its cluster,
+// hostname and backup name, depth segments in. With autoPathDepth the backup
+// is the directory holding meta/manifest.json(.gz), and other keys, accepted
+// with -force-manifest, fall back to defaultPathDepth.
+func extractHostnamePath(manifestKey, prefix string, depth pathDepth) (manifestPath, error) {
+	rel, ok := strings.CutPrefix(manifestKey, prefix)
+	if !ok {
+		return manifestPath{}, fmt.Errorf("manifest path %s is not under prefix %s", manifestKey, prefix)
+	}
+	parts := strings.Split(rel, "/")
+	n := depth.segments()
+	if depth == autoPathDepth {
+		n = defaultPathDepth
+		if isManifestKey(manifestKey) {
+			n = len(parts) - 3
+		}
+	}
+	// The backup directory holds at least the manifest
+	if n < defaultPathDepth || len(parts) < n+2 {
+		return manifestPath{}, fmt.Errorf("invalid manifest path: %s", manifestKey)
+	}
+	return manifestPath{
+		Cluster:      parts[0],
+		Host:         parts[n-1],
+		Backup:       parts[n],
+		HostnamePath: prefix + strings.Join(parts[:n], "/") + "/",
+	}, nil
+}
+
+// id identifies the backup as [cluster]/[hostname]/[backup_name]
+func (p manifestPath) id() string {
+	return p.Cluster + "/" + p.Host + "/" + p.Backup
+}
+
+// path splits the key of m with the -path-depth it was found with
+func (m ManifestInfo) path() (manifestPath, error) {
+	return extractHostnamePath(m.Key, m.Prefix, m.Depth)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestExtractHostnamePathLayouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		manifestKey string
+		prefix      string
+		depth       pathDepth
+		want        manifestPath
+		wantErr     bool
+	}{
+		{
+			name:        "cluster and hostname",
+			manifestKey: "links/links-us-default-sts-8/medusa-backup-schedule-1764858600/meta/manifest.json",
+			want:        manifestPath{Cluster: "links", Host: "links-us-default-sts-8", Backup: "medusa-backup-schedule-1764858600", HostnamePath: "links/links-us-default-sts-8/"},
+		},
+		{
+			name:        "FQDN hostname",
+			manifestKey: "links/cassandra-0.cassandra.svc.cluster.local/backup1/meta/manifest.json",
+			want:        manifestPath{Cluster: "links", Host: "cassandra-0.cassandra.svc.cluster.local", Backup: "backup1", HostnamePath: "links/cassandra-0.cassandra.svc.cluster.local/"},
+		},
+		{
+			name:        "datacenter level",
+			manifestKey: "backups/links/us-east/host1/backup1/meta/manifest.json.gz",
+			prefix:      "backups/",
+			depth:       3,
+			want:        manifestPath{Cluster: "links", Host: "host1", Backup: "backup1", HostnamePath: "backups/links/us-east/host1/"},
+		},
+		{
+			name:        "datacenter level missing a segment",
+			manifestKey: "links/host1/backup1",
+			depth:       3,
+			wantErr:     true,
+		},
+		{
+			name:        "auto with cluster and hostname",
+			manifestKey: "links/host1/backup1/meta/manifest.json",
+			depth:       autoPathDepth,
+			want:        manifestPath{Cluster: "links", Host: "host1", Backup: "backup1", HostnamePath: "links/host1/"},
+		},
+		{
+			name:        "auto with datacenter level and FQDN hostname",
+			manifestKey: "links/us-east/cassandra-0.cassandra.svc.cluster.local/backup1/meta/manifest.json",
+			depth:       autoPathDepth,
+			want:        manifestPath{Cluster: "links", Host: "cassandra-0.cassandra.svc.cluster.local", Backup: "backup1", HostnamePath: "links/us-east/cassandra-0.cassandra.svc.cluster.local/"},
+		},
+		{
+			name:        "auto with a forced key",
+			manifestKey: "links/host1/backup1/manifest-copy.json",
+			depth:       autoPathDepth,
+			want:        manifestPath{Cluster: "links", Host: "host1", Backup: "backup1", HostnamePath: "links/host1/"},
+		},
+		{
+			name:        "auto without a hostname",
+			manifestKey: "links/backup1/meta/manifest.json",
+			depth:       autoPathDepth,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractHostnamePath(tt.manifestKey, tt.prefix, tt.depth)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractHostnamePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("extractHostnamePath() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathDepthFlag(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    pathDepth
+		wantErr bool
+	}{
+		{value: "2", want: 2},
+		{value: "3", want: 3},
+		{value: "auto", want: autoPathDepth},
+		{value: "1", wantErr: true},
+		{value: "deep", wantErr: true},
+	}
+	for _, tt := range tests {
+		var d pathDepth
+		err := d.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && d != tt.want {
+			t.Errorf("Set(%q) = %d, want %d", tt.value, d, tt.want)
+		}
+	}
+
+	var d pathDepth
+	if got := d.String(); got != "2" {
+		t.Errorf("String() = %q for the zero value, want 2", got)
+	}
+}
+
+func TestRunNestedLayout(t *testing.T) {
+	for _, depth := range []pathDepth{3, autoPathDepth} {
+		t.Run(depth.String(), func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["links/us-east/host1.example.com/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+			bucket.objects["links/us-east/host1.example.com/data/ks/t/a.db"] = ""
+			bucket.objects["links/eu-west/host2.example.com/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"links/eu-west/host2.example.com/data/ks/t/b.db"}]}]`
+			bucket.objects["links/eu-west/host2.example.com/data/ks/t/b.db"] = ""
+			bucket.objects["links/eu-west/host3.example.com/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/c.db"}]}]`
+			bucket.objects["links/eu-west/host3.example.com/data/ks/t/c.db"] = ""
+
+			opts := testOptions()
+			opts.pathDepth = depth
+			// Hostnames aren't directly below the cluster, so they're matched
+			// after listing it
+			opts.hosts.pattern = regexp.MustCompile(`^host[12]\.`)
+			r := newRefresher(bucket.client(), opts, time.Now())
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			got := bucket.putKeys()
+			sort.Strings(got)
+			want := []string{
+				"links/eu-west/host2.example.com/data/ks/t/b.db",
+				"links/us-east/host1.example.com/data/ks/t/a.db",
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("updated %v, want %v", got, want)
+			}
+		})
+	}
+}
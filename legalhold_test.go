@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestParseLegalHoldStatus(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    types.ObjectLockLegalHoldStatus
+		wantErr bool
+	}{
+		{value: "on", want: types.ObjectLockLegalHoldStatusOn},
+		{value: "OFF", want: types.ObjectLockLegalHoldStatusOff},
+		{value: "true", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseLegalHoldStatus(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLegalHoldStatus() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseLegalHoldStatus() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// legalHoldBucket returns a bucket with two backups of one host, both referencing one shared object
+func legalHoldBucket() *fakeBucket {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/adhoc-1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]},{"keyspace":"other","columnfamily":"t","objects":[{"path":"data/other/t/b.db"}]}]`
+	bucket.objects["links/host1/nightly-1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/c.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/other/t/b.db"] = ""
+	bucket.objects["links/host1/data/ks/t/c.db"] = ""
+	return bucket
+}
+
+func legalHoldOptions(status types.ObjectLockLegalHoldStatus) *options {
+	return &options{
+		commonOptions: commonOptions{bucket: "test-bucket", cluster: "links"},
+		legalHold:     status,
+		excludeMeta:   true,
+	}
+}
+
+func TestRunLegalHoldWithFilters(t *testing.T) {
+	bucket := legalHoldBucket()
+
+	opts := legalHoldOptions(types.ObjectLockLegalHoldStatusOn)
+	opts.backupName = "adhoc-*"
+	opts.filter.includeKeyspaces = stringList{"ks"}
+
+	if err := run(context.Background(), bucket.client(), opts); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(bucket.puts) != 0 {
+		t.Errorf("run() changed retention on %d objects, want legal holds only", len(bucket.puts))
+	}
+	if len(bucket.holdPuts) != 1 || bucket.holds["links/host1/data/ks/t/a.db"] != types.ObjectLockLegalHoldStatusOn {
+		t.Errorf("run() set holds %v, want only links/host1/data/ks/t/a.db", bucket.holds)
+	}
+}
+
+func TestRunLegalHoldIdempotent(t *testing.T) {
+	bucket := legalHoldBucket()
+	bucket.holds["links/host1/data/ks/t/a.db"] = types.ObjectLockLegalHoldStatusOn
+
+	opts := legalHoldOptions(types.ObjectLockLegalHoldStatusOn)
+	r := newRefresher(bucket.client(), opts, time.Now())
+
+	if got := r.refreshObject(context.Background(), "", "links/host1/data/ks/t/a.db"); got != actionSkipped {
+		t.Errorf("refreshObject() = %q for a held object, want %q", got, actionSkipped)
+	}
+	if got := r.refreshObject(context.Background(), "", "links/host1/data/ks/t/c.db"); got != actionUpdated {
+		t.Errorf("refreshObject() = %q for an object without a hold, want %q", got, actionUpdated)
+	}
+	if got := r.refreshObject(context.Background(), "", "links/host1/data/ks/t/c.db"); got != actionSkipped {
+		t.Errorf("refreshObject() = %q on the second pass, want %q", got, actionSkipped)
+	}
+	if len(bucket.holdPuts) != 1 {
+		t.Errorf("refreshObject() sent %d PutObjectLegalHold calls, want 1", len(bucket.holdPuts))
+	}
+}
+
+func TestRunLegalHoldDryRun(t *testing.T) {
+	bucket := legalHoldBucket()
+
+	opts := legalHoldOptions(types.ObjectLockLegalHoldStatusOff)
+	opts.dryRun = true
+	bucket.holds["links/host1/data/ks/t/a.db"] = types.ObjectLockLegalHoldStatusOn
+
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if got := r.refreshObject(context.Background(), "", "links/host1/data/ks/t/a.db"); got != actionWouldUpdate {
+		t.Errorf("refreshObject() = %q, want %q", got, actionWouldUpdate)
+	}
+	if got := r.refreshObject(context.Background(), "", "links/host1/data/ks/t/c.db"); got != actionSkipped {
+		t.Errorf("refreshObject() = %q for an object without a hold, want %q", got, actionSkipped)
+	}
+	if len(bucket.holdPuts) != 0 {
+		t.Errorf("refreshObject() sent %d PutObjectLegalHold calls in dry-run mode", len(bucket.holdPuts))
+	}
+}
+
+func TestApplyLegalHoldPermissionErrors(t *testing.T) {
+	accessDenied := errors.New("AccessDenied: Access Denied")
+
+	tests := []struct {
+		name   string
+		client *MockS3Client
+	}{
+		{
+			name: "get denied",
+			client: &MockS3Client{
+				GetObjectLegalHoldFunc: func(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error) {
+					return nil, accessDenied
+				},
+			},
+		},
+		{
+			name: "put denied",
+			client: &MockS3Client{
+				GetObjectLegalHoldFunc: func(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error) {
+					return &s3.GetObjectLegalHoldOutput{LegalHold: &types.ObjectLockLegalHold{Status: types.ObjectLockLegalHoldStatusOff}}, nil
+				},
+				PutObjectLegalHoldFunc: func(ctx context.Context, params *s3.PutObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.PutObjectLegalHoldOutput, error) {
+					return nil, accessDenied
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRefresher(tt.client, legalHoldOptions(types.ObjectLockLegalHoldStatusOn), time.Now())
+			if got := r.refreshObject(context.Background(), "", "links/host1/data/ks/t/a.db"); got != actionError {
+				t.Errorf("refreshObject() = %q, want %q", got, actionError)
+			}
+			if r.stats.actions[actionError] != 1 {
+				t.Errorf("counts[error] = %d, want 1", r.stats.actions[actionError])
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// findLocalManifests finds the manifests in dir, a directory laid out like
+// the bucket below -prefix: [cluster]/[hostname]/[backup_name]/meta/manifest.json.
+// Keys are the files' paths relative to dir, below basePrefix, and their
+// LastModified is the file's modification time.
+func findLocalManifests(dir, basePrefix, cluster string, depth pathDepth) ([]ManifestInfo, error) {
+	root := filepath.Join(dir, cluster)
+	backupPaths := make(map[string]time.Time)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := basePrefix + filepath.ToSlash(rel)
+		if !isManifestKey(key) {
+			return nil
+		}
+		if _, err := extractHostnamePath(key, basePrefix, depth); err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		backupPaths[key] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -local-manifests: %w", err)
+	}
+	return manifestsFromKeys(backupPaths, basePrefix), nil
+}
+
+// readLocalManifest reads and parses the manifest stored at key from dir
+func readLocalManifest(dir, basePrefix, key string) (*Manifest, error) {
+	rel, ok := strings.CutPrefix(key, basePrefix)
+	if !ok {
+		return nil, fmt.Errorf("manifest path %s is not under prefix %s", key, basePrefix)
+	}
+	body, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	data, err := decompressManifest(body, gzipHinted(key, "", ""))
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// offlinePlan prints each object key once with the retention dates it
+// requires, for -offline runs that can't check the current retention
+type offlinePlan struct {
+	mu      sync.Mutex
+	w       io.Writer
+	printed map[string]struct{}
+}
+
+func newOfflinePlan(w io.Writer) *offlinePlan {
+	return &offlinePlan{w: w, printed: make(map[string]struct{})}
+}
+
+// print writes key with the date its retention must reach and the date it
+// would be set to, tab-separated. Keys shared by several backups are printed
+// for the first, newest, one.
+func (p *offlinePlan) print(key string, target retentionTarget) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.printed[key]; ok {
+		return
+	}
+	p.printed[key] = struct{}{}
+	fmt.Fprintf(p.w, "%s\t%s\t%s\n", key, target.requiredUntil.UTC().Format(time.RFC3339), target.retainUntil.UTC().Format(time.RFC3339))
+}
+
+// planOffline records key as planned with its retention target instead of
+// checking it against S3
+func (r *refresher) planOffline(manifest, key string) {
+	target := r.target(manifest, key)
+	r.offline.print(key, target)
+	r.recordResult(manifest, key, objectResult{action: actionPlanned, retainUntil: target.retainUntil, mode: r.opts.mode})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// localManifestsDir holds a dump of the links cluster's manifests laid out like the bucket
+var localManifestsDir = filepath.Join("testdata", "local")
+
+// offlineClient fails the test on any S3 call
+func offlineClient(t *testing.T) *MockS3Client {
+	fail := func(op string) {
+		t.Helper()
+		t.Errorf("unexpected %s call in an offline run", op)
+	}
+	return &MockS3Client{
+		ListObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			fail("ListObjectsV2")
+			return &s3.ListObjectsV2Output{}, nil
+		},
+		GetObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			fail("GetObject")
+			return &s3.GetObjectOutput{}, nil
+		},
+		GetObjectRetentionFunc: func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+			fail("GetObjectRetention")
+			return &s3.GetObjectRetentionOutput{}, nil
+		},
+		PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+			fail("PutObjectRetention")
+			return &s3.PutObjectRetentionOutput{}, nil
+		},
+		HeadObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			fail("HeadObject")
+			return &s3.HeadObjectOutput{}, nil
+		},
+	}
+}
+
+func TestFindLocalManifests(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+	}{
+		{name: "no prefix"},
+		// The directory holds what is below -prefix in the bucket
+		{name: "prefix", prefix: "backups/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifests, err := findLocalManifests(localManifestsDir, tt.prefix, "links", 0)
+			if err != nil {
+				t.Fatalf("findLocalManifests() error = %v", err)
+			}
+			keys := manifestKeys(manifests)
+			sort.Strings(keys)
+			want := []string{
+				tt.prefix + "links/host1/medusa-backup-schedule-1700000000/meta/manifest.json",
+				tt.prefix + "links/host1/medusa-backup-schedule-1710000000/meta/manifest.json.gz",
+				tt.prefix + "links/host2/medusa-backup-schedule-1710000000/meta/manifest.json",
+			}
+			if !reflect.DeepEqual(keys, want) {
+				t.Errorf("findLocalManifests() = %v, want %v", keys, want)
+			}
+			for _, m := range manifests {
+				if m.Prefix != tt.prefix || m.LastModified.IsZero() {
+					t.Errorf("findLocalManifests() manifest %+v, want prefix %q and the file's modification time", m, tt.prefix)
+				}
+			}
+		})
+	}
+
+	if _, err := findLocalManifests(localManifestsDir, "", "other-cluster", 0); err == nil {
+		t.Error("findLocalManifests() expected error for a cluster missing from the directory")
+	}
+}
+
+func TestRunOffline(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	opts := testOptions()
+	opts.localManifests = localManifestsDir
+	opts.offline = true
+	opts.dryRun = true
+	opts.excludeMeta = false
+	opts.report = filepath.Join(t.TempDir(), "report.jsonl")
+
+	r := newRefresher(offlineClient(t), opts, now)
+	var out bytes.Buffer
+	r.offline = newOfflinePlan(&out)
+	if err := r.withReport(func() error { return r.run(context.Background()) }); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	const required, retain = "2024-06-08T00:00:00Z", "2024-07-01T00:00:00Z"
+	want := []string{
+		// nb-1-big-Data.db is shared by both backups of host1 and printed once
+		"links/host1/data/app/users/nb-1-big-Data.db\t" + required + "\t" + retain,
+		"links/host1/data/app/users/nb-2-big-Data.db\t" + required + "\t" + retain,
+		"links/host2/data/app/users/nb-7-big-Data.db\t" + required + "\t" + retain,
+		"links/host1/data/app/users/nb-1-big-Index.db\t" + required + "\t" + retain,
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("offline plan =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	sum := r.stats.summary(now)
+	if sum.Planned != 5 || sum.ManifestsProcessed != 3 {
+		t.Errorf("summary planned = %d, manifests_processed = %d, want 5 and 3", sum.Planned, sum.ManifestsProcessed)
+	}
+	for _, rec := range readReport(t, opts.report) {
+		if rec["action"] != string(actionPlanned) || rec["new_retain_until"] != retain {
+			t.Errorf("report record %v, want a planned record retained until %s", rec, retain)
+		}
+	}
+}
+
+func TestRunLocalManifests(t *testing.T) {
+	bucket := newFakeBucket()
+	for _, key := range []string{
+		"links/host1/data/app/users/nb-1-big-Data.db",
+		"links/host1/data/app/users/nb-1-big-Index.db",
+		"links/host1/data/app/users/nb-2-big-Data.db",
+		"links/host2/data/app/users/nb-7-big-Data.db",
+	} {
+		bucket.objects[key] = ""
+	}
+
+	opts := testOptions()
+	opts.localManifests = localManifestsDir
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	// Retention is checked and updated in S3, but the manifests aren't read from it
+	got := bucket.putKeys()
+	sort.Strings(got)
+	want := []string{
+		"links/host1/data/app/users/nb-1-big-Data.db",
+		"links/host1/data/app/users/nb-1-big-Index.db",
+		"links/host1/data/app/users/nb-2-big-Data.db",
+		"links/host2/data/app/users/nb-7-big-Data.db",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("updated %v, want %v", got, want)
+	}
+	if bucket.getCalls != 0 || bucket.listCalls != 0 {
+		t.Errorf("made %d GetObject and %d ListObjectsV2 calls, want none", bucket.getCalls, bucket.listCalls)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// defaultLockTTL is the -lock-ttl default: how long a lock may go without
+// heartbeat before another run takes it over
+const defaultLockTTL = 15 * time.Minute
+
+// lockAttempts is how many times the lock is looked up and written before
+// giving up when other runs keep changing it
+const lockAttempts = 3
+
+// errLockHeld is returned when another run holds -lock-key
+var errLockHeld = errors.New("another run holds -lock-key")
+
+// errLockLost cancels a run whose -lock-key was taken over or could no longer
+// be renewed
+var errLockLost = errors.New("lost -lock-key")
+
+// LockAPI defines the S3 operations of the -lock-key lock
+type LockAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// lockRecord is the JSON body of the -lock-key object, identifying its holder
+// by its run ID
+type lockRecord struct {
+	RunID       string    `json:"run_id"`
+	Hostname    string    `json:"hostname"`
+	PID         int       `json:"pid"`
+	StartedAt   time.Time `json:"started_at"`
+	HeartbeatAt time.Time `json:"heartbeat_at"`
+}
+
+// runLock is the -lock-key lock of the process
+type runLock struct {
+	client        LockAPI
+	bucket        string
+	key           string
+	ttl           time.Duration
+	expectedOwner *string
+	requestPayer  types.RequestPayer
+	now           func() time.Time
+	attrs         []any // the run ID, when the default logger doesn't add it
+
+	mu     sync.Mutex
+	record lockRecord
+	etag   string // of the lock object as last written by the process
+	lost   bool   // taken over by another run, or not renewed within ttl
+}
+
+// newRunLock returns the -lock-key lock of opts, which lives in -bucket
+// unless it is an s3:// URI. It records -run-id, settled before the lock is
+// taken, or with -interval and -sqs-queue-url, whose passes and messages each
+// get their own run ID, a new ID for the process.
+func newRunLock(client LockAPI, opts *options) (*runLock, error) {
+	bucket, key := opts.bucket, opts.lockKey
+	if strings.HasPrefix(key, "s3://") {
+		var err error
+		if bucket, key, err = parseS3URI(key); err != nil {
+			return nil, fmt.Errorf("invalid -lock-key: %w", err)
+		}
+	}
+	hostname, _ := os.Hostname()
+	runID := opts.runID
+	if runID == "" {
+		runID = newRunID()
+	}
+	l := &runLock{
+		client: client,
+		bucket: bucket,
+		key:    key,
+		ttl:    opts.lockTTL,
+		now:    time.Now,
+		record: lockRecord{RunID: runID, Hostname: hostname, PID: os.Getpid()},
+	}
+	if loggedRunID != runID {
+		l.attrs = []any{"run_id", runID}
+	}
+	// The -bucket request parameters don't apply to a lock in another bucket
+	if bucket == opts.bucket {
+		if opts.expectedOwner != "" {
+			l.expectedOwner = aws.String(opts.expectedOwner)
+		}
+		if opts.requesterPays {
+			l.requestPayer = types.RequestPayerRequester
+		}
+	}
+	return l, nil
+}
+
+// uri returns the S3 URI of the lock object
+func (l *runLock) uri() string {
+	return "s3://" + l.bucket + "/" + l.key
+}
+
+// isPreconditionFailed reports whether err rejects a conditional write
+// because the object changed, or was written concurrently
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	}
+	return false
+}
+
+// write writes the lock record, only if the object is absent when ifMatch is
+// "", or only if its ETag is still ifMatch otherwise
+func (l *runLock) write(ctx context.Context, ifMatch string) error {
+	body, err := json.Marshal(l.record)
+	if err != nil {
+		return fmt.Errorf("failed to encode -lock-key: %w", err)
+	}
+	input := &s3.PutObjectInput{
+		Bucket:              aws.String(l.bucket),
+		Key:                 aws.String(l.key),
+		Body:                bytes.NewReader(body),
+		ContentType:         aws.String("application/json"),
+		ExpectedBucketOwner: l.expectedOwner,
+		RequestPayer:        l.requestPayer,
+		// Object Lock requires an integrity checksum on PutObject
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	}
+	if ifMatch == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(ifMatch)
+	}
+	out, err := l.client.PutObject(ctx, input)
+	if err != nil {
+		return err
+	}
+	l.etag = aws.ToString(out.ETag)
+	return nil
+}
+
+// read returns the lock record another run wrote, with the ETag and the time
+// of its last write. A record that can't be decoded is returned empty.
+func (l *runLock) read(ctx context.Context) (lockRecord, string, time.Time, error) {
+	out, err := l.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket:              aws.String(l.bucket),
+		Key:                 aws.String(l.key),
+		ExpectedBucketOwner: l.expectedOwner,
+		RequestPayer:        l.requestPayer,
+	})
+	if err != nil {
+		return lockRecord{}, "", time.Time{}, err
+	}
+	defer out.Body.Close()
+	var rec lockRecord
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return lockRecord{}, "", time.Time{}, fmt.Errorf("failed to read -lock-key %s: %w", l.uri(), err)
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		slog.Warn("Failed to decode -lock-key", "lock", l.uri(), "error", err.Error())
+	}
+	return rec, aws.ToString(out.ETag), aws.ToTime(out.LastModified), nil
+}
+
+// acquire takes the lock: it creates the lock object unless it exists, and
+// takes it over when its holder hasn't renewed it for ttl
+func (l *runLock) acquire(ctx context.Context) error {
+	now := l.now()
+	l.record.StartedAt, l.record.HeartbeatAt = now, now
+	for attempt := 1; ; attempt++ {
+		err := l.write(ctx, "")
+		if err == nil {
+			slog.Info("Acquired -lock-key", append(l.attrs, "lock", l.uri(), "ttl", l.ttl.String())...)
+			return nil
+		}
+		if !isPreconditionFailed(err) || attempt == lockAttempts {
+			return fmt.Errorf("failed to acquire -lock-key %s: %w", l.uri(), err)
+		}
+
+		holder, etag, written, err := l.read(ctx)
+		if err != nil && isNoSuchKey(err) {
+			// Released in the meantime
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read -lock-key %s: %w", l.uri(), err)
+		}
+		age := l.now().Sub(written)
+		if age < l.ttl {
+			return &exitError{code: exitLocked, err: fmt.Errorf("%w %s: run_id %s on %s (pid %d) started at %s, last heartbeat %s ago",
+				errLockHeld, l.uri(), holder.RunID, holder.Hostname, holder.PID, holder.StartedAt.Format(time.RFC3339), age.Round(time.Second))}
+		}
+		slog.Warn("Taking over stale -lock-key", append(l.attrs, "lock", l.uri(), "holder_run_id", holder.RunID, "holder_hostname", holder.Hostname,
+			"started_at", holder.StartedAt.Format(time.RFC3339), "heartbeat_age", age.Round(time.Second).String(), "ttl", l.ttl.String())...)
+		err = l.write(ctx, etag)
+		if err == nil {
+			slog.Info("Acquired -lock-key", append(l.attrs, "lock", l.uri(), "ttl", l.ttl.String())...)
+			return nil
+		}
+		if !isPreconditionFailed(err) {
+			return fmt.Errorf("failed to take over -lock-key %s: %w", l.uri(), err)
+		}
+		// Another run renewed or took over the lock first
+	}
+}
+
+// heartbeat renews the lock, reporting errLockLost once it was taken over or
+// couldn't be renewed for ttl, when another run may have taken it over
+func (l *runLock) heartbeat(ctx context.Context, lastRenewed time.Time) (time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.record.HeartbeatAt = now
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+	err := l.write(ctx, l.etag)
+	switch {
+	case err == nil:
+		return now, nil
+	case isPreconditionFailed(err):
+		l.lost = true
+		return lastRenewed, fmt.Errorf("%w %s: another run took it over", errLockLost, l.uri())
+	case now.Sub(lastRenewed) >= l.ttl:
+		l.lost = true
+		return lastRenewed, fmt.Errorf("%w %s: not renewed for -lock-ttl %s: %w", errLockLost, l.uri(), l.ttl, err)
+	}
+	slog.Warn("Failed to renew -lock-key", append(l.attrs, "lock", l.uri(), "error", err.Error())...)
+	return lastRenewed, nil
+}
+
+// hold renews the lock every third of ttl until stop is called. The returned
+// context is canceled with errLockLost when the lock is lost.
+func (l *runLock) hold(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		renewed := l.now()
+		// Interrupted runs may still finish their work, e.g. the -interval
+		// pass drained on SIGTERM, so the lock is renewed until stop
+		renewCtx := context.WithoutCancel(ctx)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			var err error
+			if renewed, err = l.heartbeat(renewCtx, renewed); err != nil {
+				slog.Error("Stopping the run", append(l.attrs, "error", err.Error())...)
+				cancel(err)
+				return
+			}
+		}
+	}()
+	return ctx, func() {
+		close(done)
+		<-stopped
+		cancel(nil)
+	}
+}
+
+// release deletes the lock unless it was lost. It runs even when ctx was
+// canceled, e.g. by a signal.
+func (l *runLock) release(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+	defer cancel()
+	_, err := l.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:              aws.String(l.bucket),
+		Key:                 aws.String(l.key),
+		ExpectedBucketOwner: l.expectedOwner,
+		RequestPayer:        l.requestPayer,
+	})
+	if err != nil {
+		slog.Warn("Failed to release -lock-key, it expires after -lock-ttl", append(l.attrs, "lock", l.uri(), "ttl", l.ttl.String(), "error", err.Error())...)
+		return
+	}
+	slog.Info("Released -lock-key", append(l.attrs, "lock", l.uri())...)
+}
+
+// withRunLock runs fn holding -lock-key, when set. fn's context is canceled
+// when the lock is lost. Dry runs take it too: they make as many requests and
+// log as much as the runs they would overlap.
+func withRunLock(ctx context.Context, opts *options, fn func(ctx context.Context) error) error {
+	if opts.lockKey == "" {
+		return fn(ctx)
+	}
+	client, err := newS3Client(ctx, opts.commonOptions)
+	if err != nil {
+		return err
+	}
+	return runLocked(ctx, client, opts, fn)
+}
+
+// runLocked runs fn holding the -lock-key lock of client
+func runLocked(ctx context.Context, client LockAPI, opts *options, fn func(ctx context.Context) error) error {
+	l, err := newRunLock(client, opts)
+	if err != nil {
+		return err
+	}
+	if err := l.acquire(ctx); err != nil {
+		return err
+	}
+	defer l.release(ctx)
+	lockedCtx, stop := l.hold(ctx)
+	defer stop()
+	err = fn(lockedCtx)
+	if cause := context.Cause(lockedCtx); errors.Is(cause, errLockLost) {
+		if err == nil {
+			// The run stopped early without an error of its own
+			return cause
+		}
+		return fmt.Errorf("%w: %w", cause, err)
+	}
+	return err
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeLockObject is an object of fakeLockStore
+type fakeLockObject struct {
+	body     []byte
+	etag     string
+	modified time.Time
+}
+
+// fakeLockStore serves the lock objects with S3's conditional write semantics
+type fakeLockStore struct {
+	mu      sync.Mutex
+	objects map[string]fakeLockObject // bucket/key -> object
+	puts    []s3.PutObjectInput
+	deletes int
+}
+
+func newFakeLockStore() *fakeLockStore {
+	return &fakeLockStore{objects: make(map[string]fakeLockObject)}
+}
+
+// set stores body as bucket/key, last written at modified
+func (f *fakeLockStore) set(bucket, key string, body []byte, modified time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sum := md5.Sum(body)
+	f.objects[bucket+"/"+key] = fakeLockObject{body: body, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modified: modified}
+}
+
+// record returns the lock record stored as bucket/key
+func (f *fakeLockStore) record(t *testing.T, bucket, key string) (lockRecord, bool) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[bucket+"/"+key]
+	if !ok {
+		return lockRecord{}, false
+	}
+	var rec lockRecord
+	if err := json.Unmarshal(obj.body, &rec); err != nil {
+		t.Fatalf("lock object %s isn't a lock record: %v", obj.body, err)
+	}
+	return rec, true
+}
+
+func (f *fakeLockStore) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key)]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(obj.body)), ETag: aws.String(obj.etag), LastModified: aws.Time(obj.modified)}, nil
+}
+
+func (f *fakeLockStore) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.puts = append(f.puts, *params)
+	id := aws.ToString(params.Bucket) + "/" + aws.ToString(params.Key)
+	obj, exists := f.objects[id]
+	f.mu.Unlock()
+	switch {
+	case aws.ToString(params.IfNoneMatch) == "*" && exists,
+		params.IfMatch != nil && (!exists || obj.etag != aws.ToString(params.IfMatch)):
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	f.set(aws.ToString(params.Bucket), aws.ToString(params.Key), body, time.Now())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &s3.PutObjectOutput{ETag: aws.String(f.objects[id].etag)}, nil
+}
+
+func (f *fakeLockStore) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deletes++
+	delete(f.objects, aws.ToString(params.Bucket)+"/"+aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// lockOptions returns the options of a run holding key
+func lockOptions(key string, ttl time.Duration) *options {
+	opts := testOptions()
+	opts.bucket, opts.lockKey, opts.lockTTL = "my-backups", key, ttl
+	return opts
+}
+
+// holderRecord returns the JSON record of another run's lock
+func holderRecord(t *testing.T) []byte {
+	t.Helper()
+	body, err := json.Marshal(lockRecord{RunID: "other-run", Hostname: "cron-1", PID: 42, StartedAt: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestRunLockAcquire(t *testing.T) {
+	store := newFakeLockStore()
+	opts := lockOptions("locks/prod.json", time.Hour)
+	opts.expectedOwner, opts.requesterPays = "123456789012", true
+	opts.runID = "nightly-1"
+
+	var heldRecord lockRecord
+	err := runLocked(context.Background(), store, opts, func(ctx context.Context) error {
+		rec, ok := store.record(t, "my-backups", "locks/prod.json")
+		if !ok {
+			t.Fatal("no lock object while running")
+		}
+		heldRecord = rec
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("runLocked() error = %v", err)
+	}
+	if heldRecord.RunID != "nightly-1" || heldRecord.Hostname == "" || heldRecord.PID == 0 || heldRecord.StartedAt.IsZero() {
+		t.Errorf("lock record = %+v, want its holder identified", heldRecord)
+	}
+	put := store.puts[0]
+	if aws.ToString(put.IfNoneMatch) != "*" || put.IfMatch != nil {
+		t.Errorf("PutObject If-None-Match = %v, If-Match = %v, want a write only if absent", aws.ToString(put.IfNoneMatch), put.IfMatch)
+	}
+	if aws.ToString(put.ExpectedBucketOwner) != "123456789012" || put.RequestPayer != types.RequestPayerRequester || put.ChecksumAlgorithm == "" {
+		t.Errorf("PutObject = %+v, want the -bucket request parameters and a checksum", put)
+	}
+	if _, ok := store.record(t, "my-backups", "locks/prod.json"); ok || store.deletes != 1 {
+		t.Errorf("lock object left after the run, %d deletes", store.deletes)
+	}
+}
+
+func TestRunLockLogsRunID(t *testing.T) {
+	tests := []struct {
+		name  string
+		runID string // settled by execute, "" for -interval and -sqs-queue-url
+	}{
+		{name: "run", runID: "nightly-1"},
+		{name: "runs per pass"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeLockStore()
+			opts := lockOptions("locks/prod.json", time.Hour)
+			opts.runID = tt.runID
+			var rec lockRecord
+			logged := captureLog("json", slog.LevelInfo, func() {
+				defer logRunID(opts.runID)()
+				err := runLocked(context.Background(), store, opts, func(ctx context.Context) error {
+					rec, _ = store.record(t, "my-backups", "locks/prod.json")
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("runLocked() error = %v", err)
+				}
+			})
+			if rec.RunID == "" || (tt.runID != "" && rec.RunID != tt.runID) {
+				t.Fatalf("lock run_id = %q, want %q", rec.RunID, tt.runID)
+			}
+			lines := strings.Split(strings.TrimSpace(logged), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("logged %q, want the lock acquired and released", logged)
+			}
+			for _, line := range lines {
+				if n := strings.Count(line, `"run_id":`); n != 1 || !strings.Contains(line, `"run_id":"`+rec.RunID+`"`) {
+					t.Errorf("log record %s has run_id %d times, want %s once", line, n, rec.RunID)
+				}
+			}
+		})
+	}
+}
+
+func TestRunLockOtherBucket(t *testing.T) {
+	store := newFakeLockStore()
+	opts := lockOptions("s3://ops-locks/medusa/prod.json", time.Hour)
+	opts.expectedOwner, opts.requesterPays = "123456789012", true
+	if err := runLocked(context.Background(), store, opts, func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatalf("runLocked() error = %v", err)
+	}
+	put := store.puts[0]
+	if aws.ToString(put.Bucket) != "ops-locks" || aws.ToString(put.Key) != "medusa/prod.json" {
+		t.Errorf("lock written to s3://%s/%s, want s3://ops-locks/medusa/prod.json", aws.ToString(put.Bucket), aws.ToString(put.Key))
+	}
+	if put.ExpectedBucketOwner != nil || put.RequestPayer != "" {
+		t.Errorf("PutObject = %+v, want no -bucket request parameters for another bucket", put)
+	}
+}
+
+func TestRunLockContention(t *testing.T) {
+	store := newFakeLockStore()
+	store.set("my-backups", "locks/prod.json", holderRecord(t), time.Now().Add(-5*time.Minute))
+
+	ran := false
+	err := runLocked(context.Background(), store, lockOptions("locks/prod.json", 15*time.Minute), func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+	if !errors.Is(err, errLockHeld) || exitCode(err) != exitLocked {
+		t.Fatalf("runLocked() error = %v (exit code %d), want %v with exit code %d", err, exitCode(err), errLockHeld, exitLocked)
+	}
+	if !strings.Contains(err.Error(), "other-run on cron-1 (pid 42)") {
+		t.Errorf("error = %q, want the holder", err)
+	}
+	if ran {
+		t.Error("ran without the lock")
+	}
+	if rec, _ := store.record(t, "my-backups", "locks/prod.json"); rec.RunID != "other-run" || store.deletes != 0 {
+		t.Errorf("lock = %+v after %d deletes, want the holder's left alone", rec, store.deletes)
+	}
+}
+
+func TestRunLockStaleTakeover(t *testing.T) {
+	store := newFakeLockStore()
+	store.set("my-backups", "locks/prod.json", holderRecord(t), time.Now().Add(-20*time.Minute))
+	stale := store.objects["my-backups/locks/prod.json"].etag
+
+	var rec lockRecord
+	logged := captureLog("text", slog.LevelInfo, func() {
+		err := runLocked(context.Background(), store, lockOptions("locks/prod.json", 15*time.Minute), func(ctx context.Context) error {
+			rec, _ = store.record(t, "my-backups", "locks/prod.json")
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("runLocked() error = %v", err)
+		}
+	})
+	if rec.RunID == "" || rec.RunID == "other-run" {
+		t.Errorf("lock = %+v while running, want it taken over", rec)
+	}
+	if !strings.Contains(logged, "Taking over stale -lock-key") || !strings.Contains(logged, "holder_run_id=other-run") {
+		t.Errorf("logged %q, want a takeover warning naming the holder", logged)
+	}
+	if last := store.puts[len(store.puts)-1]; aws.ToString(last.IfMatch) != stale {
+		t.Errorf("takeover If-Match = %v, want the stale lock's ETag %s", aws.ToString(last.IfMatch), stale)
+	}
+}
+
+func TestRunLockHeartbeat(t *testing.T) {
+	store := newFakeLockStore()
+	err := runLocked(context.Background(), store, lockOptions("locks/prod.json", 30*time.Millisecond), func(ctx context.Context) error {
+		time.Sleep(100 * time.Millisecond)
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("runLocked() error = %v", err)
+	}
+	renewals := 0
+	for _, put := range store.puts[1:] {
+		if put.IfMatch == nil {
+			t.Errorf("heartbeat PutObject without If-Match")
+		}
+		renewals++
+	}
+	if renewals == 0 {
+		t.Error("lock never renewed")
+	}
+}
+
+func TestRunLockLost(t *testing.T) {
+	store := newFakeLockStore()
+	err := runLocked(context.Background(), store, lockOptions("locks/prod.json", 30*time.Millisecond), func(ctx context.Context) error {
+		// Another run takes the lock over
+		store.set("my-backups", "locks/prod.json", holderRecord(t), time.Now())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+			return errors.New("run not stopped")
+		}
+	})
+	if !errors.Is(err, errLockLost) {
+		t.Fatalf("runLocked() error = %v, want %v", err, errLockLost)
+	}
+	if rec, _ := store.record(t, "my-backups", "locks/prod.json"); rec.RunID != "other-run" || store.deletes != 0 {
+		t.Errorf("lock = %+v after %d deletes, want the new holder's left alone", rec, store.deletes)
+	}
+}
+
+func TestRunLockReleaseOnSignal(t *testing.T) {
+	store := newFakeLockStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	err := runLocked(ctx, store, lockOptions("locks/prod.json", time.Hour), func(ctx context.Context) error {
+		cancel()
+		<-ctx.Done()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("runLocked() error = %v", err)
+	}
+	if _, ok := store.record(t, "my-backups", "locks/prod.json"); ok {
+		t.Error("lock object left after an interrupted run")
+	}
+}
+
+func TestWithRunLockWithoutKey(t *testing.T) {
+	opts := testOptions()
+	ran := false
+	if err := withRunLock(context.Background(), opts, func(ctx context.Context) error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("withRunLock() = %v, ran: %v, want the run run without a lock", err, ran)
+	}
+}
+
+func TestRunLockDryRunContention(t *testing.T) {
+	store := newFakeLockStore()
+	store.set("my-backups", "locks/prod.json", holderRecord(t), time.Now())
+	opts := lockOptions("locks/prod.json", 15*time.Minute)
+	opts.dryRun = true
+	err := runLocked(context.Background(), store, opts, func(ctx context.Context) error {
+		t.Error("dry run ran while another run holds the lock")
+		return nil
+	})
+	if !errors.Is(err, errLockHeld) {
+		t.Fatalf("runLocked() error = %v, want %v", err, errLockHeld)
+	}
+}
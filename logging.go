@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// newLogger creates the logger for a run writing text or JSON records to w
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	return slog.New(newHandler(w, format, level))
+}
+
+// newHandler creates a handler writing text or JSON records to w
+func newHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// setupLogging makes stderr, and the -log-file when set, the destination of
+// the default logger. Text records on stderr are colored by action when color
+// is set; the log file never is. The returned function flushes and closes the
+// log file and restores logging to stderr only.
+func setupLogging(stderr io.Writer, c commonOptions, color bool) (func() error, error) {
+	stderrHandler := newHandler(stderr, c.logFormat, c.logLevel)
+	if color && c.logFormat == "text" {
+		stderrHandler = newColorHandler(stderr, c.logLevel)
+	}
+	slog.SetDefault(slog.New(stderrHandler))
+	if c.logFile == "" {
+		return func() error { return nil }, nil
+	}
+
+	f, err := openLogFile(c.logFile)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(slog.New(fanoutHandler{stderrHandler, newHandler(f, c.logFormat, c.logLevel)}))
+	return func() error {
+		slog.SetDefault(slog.New(stderrHandler))
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to flush log file: %w", err)
+		}
+		return f.Close()
+	}, nil
+}
+
+// fanoutHandler sends every record to each of its handlers
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, rec slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, rec.Level) {
+			errs = append(errs, h.Handle(ctx, rec.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanoutHandler, len(f))
+	for i, h := range f {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	out := make(fanoutHandler, len(f))
+	for i, h := range f {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// loggedRunID is the run ID the default logger adds to records, "" when none
+var loggedRunID string
+
+// logRunID makes the default logger add id to every record until the returned
+// function is called. A logger already adding id is left as it is, so the ID
+// execute settles isn't added again by the run.
+func logRunID(id string) func() {
+	if id == "" || id == loggedRunID {
+		return func() {}
+	}
+	prev, prevID := slog.Default(), loggedRunID
+	slog.SetDefault(prev.With("run_id", id))
+	loggedRunID = id
+	return func() {
+		slog.SetDefault(prev)
+		loggedRunID = prevID
+	}
+}
+
+// logRunID makes the default logger add the run ID to every record of the run
+func (r *refresher) logRunID() func() {
+	return logRunID(r.runID)
+}
+
+// openLogFile opens the -log-file for appending, creating it and its parent directories
+func openLogFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log file directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return f, nil
+}
+
+// validateLogFormat checks the -log-format flag value
+func validateLogFormat(format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("invalid -log-format %q: must be text or json", format)
+	}
+	return nil
+}
+
+// logObject logs an event about a single object. Every per-object event
+// carries the key, the manifest referencing it (when known) and the action.
+func logObject(level slog.Level, msg, manifest, key string, action objectAction, attrs ...any) {
+	args := []any{"key", key}
+	if manifest != "" {
+		args = append(args, "manifest", manifest)
+	}
+	args = append(args, "action", string(action))
+	slog.Log(context.Background(), level, msg, append(args, attrs...)...)
+}
+
+// errorAttrs returns the attributes describing err
+func errorAttrs(err error) []any {
+	d := describeError(err)
+	attrs := []any{"error", err.Error(), "error_class", d.class}
+	if d.requestID != "" {
+		attrs = append(attrs, "request_id", d.requestID)
+	}
+	if d.extendedRequestID != "" {
+		attrs = append(attrs, "extended_request_id", d.extendedRequestID)
+	}
+	if d.httpStatus != 0 {
+		attrs = append(attrs, "http_status", d.httpStatus)
+	}
+	return attrs
+}
+
+// retentionChangeAttrs returns the attributes describing a retention change.
+// Objects without retention are reported with old_retain_until and old_mode "none".
+func retentionChangeAttrs(current *ObjectRetention, retainUntil time.Time, mode types.ObjectLockRetentionMode) []any {
+	oldUntil, oldMode := "none", "none"
+	if current != nil && current.RetainUntil != nil {
+		oldUntil = current.RetainUntil.UTC().Format(time.RFC3339)
+		if current.Mode != "" {
+			oldMode = string(current.Mode)
+		}
+	}
+	return []any{
+		"old_retain_until", oldUntil,
+		"new_retain_until", retainUntil.UTC().Format(time.RFC3339),
+		"old_mode", oldMode,
+		"new_mode", string(mode),
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// captureLog runs fn with the default logger writing to a buffer and returns what was logged
+func captureLog(format string, level slog.Level, fn func()) string {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(newLogger(&buf, format, level))
+
+	fn()
+	return buf.String()
+}
+
+// deniedBucket returns a bucket with one manifest referencing two objects
+// and one object whose retention can't be read
+func deniedBucket() *MockS3Client {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"},{"path":"data/ks/t/denied.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	client := bucket.client()
+	getRetention := client.GetObjectRetentionFunc
+	client.GetObjectRetentionFunc = func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+		if aws.ToString(params.Key) == "links/host1/data/ks/t/denied.db" {
+			return nil, errors.New("AccessDenied")
+		}
+		return getRetention(ctx, params, optFns...)
+	}
+	return client
+}
+
+func TestLogLevelPerObjectLines(t *testing.T) {
+	tests := []struct {
+		level         slog.Level
+		wantPerObject bool
+		wantSummary   bool
+		wantErrors    bool
+	}{
+		{level: slog.LevelDebug, wantPerObject: true, wantSummary: true, wantErrors: true},
+		{level: slog.LevelInfo, wantSummary: true, wantErrors: true},
+		{level: slog.LevelError, wantErrors: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			r := newRefresher(deniedBucket(), testOptions(), time.Now())
+			out := captureLog("text", tt.level, func() {
+				if err := r.run(context.Background()); err != nil {
+					t.Fatalf("run() error = %v", err)
+				}
+			})
+
+			if r.stats.actions[actionUpdated] != 2 || r.stats.actions[actionError] != 1 {
+				t.Errorf("counts = %v, want 2 updated and 1 error", r.stats.actions)
+			}
+			if got := strings.Contains(out, "Updated retention"); got != tt.wantPerObject {
+				t.Errorf("per-object lines logged = %v, want %v:\n%s", got, tt.wantPerObject, out)
+			}
+			if got := strings.Contains(out, "updated=2"); got != tt.wantSummary {
+				t.Errorf("summary logged = %v, want %v:\n%s", got, tt.wantSummary, out)
+			}
+			if got := strings.Contains(out, "Error checking retention"); got != tt.wantErrors {
+				t.Errorf("errors logged = %v, want %v:\n%s", got, tt.wantErrors, out)
+			}
+		})
+	}
+}
+
+func TestRetentionChangeAttrs(t *testing.T) {
+	newUntil := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	behind := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		current *ObjectRetention
+		mode    types.ObjectLockRetentionMode
+		want    []any
+	}{
+		{
+			name:    "no retention set",
+			current: &ObjectRetention{},
+			mode:    types.ObjectLockRetentionModeGovernance,
+			want:    []any{"old_retain_until", "none", "new_retain_until", "2025-04-01T00:00:00Z", "old_mode", "none", "new_mode", "GOVERNANCE"},
+		},
+		{
+			name:    "behind retention",
+			current: &ObjectRetention{RetainUntil: &behind, Mode: types.ObjectLockRetentionModeGovernance},
+			mode:    types.ObjectLockRetentionModeGovernance,
+			want:    []any{"old_retain_until", "2025-01-02T00:00:00Z", "new_retain_until", "2025-04-01T00:00:00Z", "old_mode", "GOVERNANCE", "new_mode", "GOVERNANCE"},
+		},
+		{
+			name:    "mode upgrade",
+			current: &ObjectRetention{RetainUntil: &behind, Mode: types.ObjectLockRetentionModeGovernance},
+			mode:    types.ObjectLockRetentionModeCompliance,
+			want:    []any{"old_retain_until", "2025-01-02T00:00:00Z", "new_retain_until", "2025-04-01T00:00:00Z", "old_mode", "GOVERNANCE", "new_mode", "COMPLIANCE"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retentionChangeAttrs(tt.current, newUntil, tt.mode); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("retentionChangeAttrs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshObjectLogsRetentionChange(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	bucket.retention["links/host1/data/ks/t/b.db"] = time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	opts := testOptions()
+	opts.dryRun = true
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newRefresher(bucket.client(), opts, now)
+	out := captureLog("text", slog.LevelInfo, func() {
+		r.refreshObject(context.Background(), "", "links/host1/data/ks/t/a.db")
+		r.refreshObject(context.Background(), "", "links/host1/data/ks/t/b.db")
+	})
+
+	for _, want := range []string{
+		`msg="[DRY-RUN] Would update retention" key=links/host1/data/ks/t/a.db action=would_update old_retain_until=none new_retain_until=2025-01-31T00:00:00Z old_mode=none new_mode=GOVERNANCE`,
+		`msg="[DRY-RUN] Would update retention" key=links/host1/data/ks/t/b.db action=would_update old_retain_until=2025-01-02T00:00:00Z new_retain_until=2025-01-31T00:00:00Z old_mode=GOVERNANCE new_mode=GOVERNANCE`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output missing %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestJSONLogFields(t *testing.T) {
+	r := newRefresher(deniedBucket(), testOptions(), time.Now())
+	out := captureLog("json", slog.LevelDebug, func() {
+		if err := r.run(context.Background()); err != nil {
+			t.Fatalf("run() error = %v", err)
+		}
+	})
+
+	records := make(map[string]map[string]any)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		records[record["msg"].(string)] = record
+	}
+
+	tests := []struct {
+		msg        string
+		wantFields []string
+	}{
+		{
+			msg:        "Updated retention",
+			wantFields: []string{"action", "key", "level", "manifest", "msg", "new_mode", "new_retain_until", "old_mode", "old_retain_until", "run_id", "time"},
+		},
+		{
+			msg:        "Error checking retention",
+			wantFields: []string{"action", "error", "error_class", "key", "level", "manifest", "msg", "run_id", "time"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			record, ok := records[tt.msg]
+			if !ok {
+				t.Fatalf("no %q record in:\n%s", tt.msg, out)
+			}
+			var fields []string
+			for field := range record {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+			}
+			if record["manifest"] != "links/host1/b1/meta/manifest.json" {
+				t.Errorf("manifest = %v", record["manifest"])
+			}
+		})
+	}
+	if class := records["Error checking retention"]["error_class"]; class != errorClassAccessDenied {
+		t.Errorf("error_class = %v, want %q", class, errorClassAccessDenied)
+	}
+}
+
+func TestSetupLoggingLogFile(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	opts := testOptions()
+	opts.logFormat = "json"
+	opts.logFile = filepath.Join(t.TempDir(), "logs", "run.log")
+
+	var stderr bytes.Buffer
+	closeLog, err := setupLogging(&stderr, opts.commonOptions, false)
+	if err != nil {
+		t.Fatalf("setupLogging() error = %v", err)
+	}
+	if err := run(context.Background(), deniedBucket(), opts); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if err := closeLog(); err != nil {
+		t.Fatalf("closing the log file: %v", err)
+	}
+	slog.Info("Done")
+
+	data, err := os.ReadFile(opts.logFile)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !strings.Contains(string(data), "Error checking retention") {
+		t.Errorf("log file lacks the error line:\n%s", data)
+	}
+	var last map[string]any
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || last["msg"] != "Run summary" {
+		t.Errorf("last log file record = %s, want the run summary", lines[len(lines)-1])
+	}
+	if !strings.HasPrefix(stderr.String(), string(data)) || !strings.Contains(stderr.String(), `"msg":"Done"`) {
+		t.Errorf("stderr = %q, want the same records followed by later ones", stderr.String())
+	}
+}
+
+func TestSetupLoggingLogFileError(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	opts := testOptions()
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts.logFile = filepath.Join(blocker, "run.log")
+
+	if _, err := setupLogging(io.Discard, opts.commonOptions, false); err == nil {
+		t.Error("setupLogging() error = nil for a log file under a regular file")
+	}
+}
@@ -2,16 +2,15 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"flag"
 	"fmt"
 	"io"
-	"log"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
@@ -22,51 +21,82 @@ type S3API interface {
 	GetObjectRetention(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error)
 	PutObjectRetention(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error)
 	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
-}
-
-// ManifestEntry represents a keyspace/table entry in the manifest
-type ManifestEntry struct {
-	Keyspace     string           `json:"keyspace"`
-	ColumnFamily string           `json:"columnfamily"`
-	Objects      []ManifestObject `json:"objects"`
+	GetObjectLegalHold(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error)
+	PutObjectLegalHold(ctx context.Context, params *s3.PutObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.PutObjectLegalHoldOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
 }
 
 // ManifestObject represents an object entry in the manifest
 type ManifestObject struct {
-	Path string `json:"path"`
-	MD5  string `json:"MD5"`
-	Size int64  `json:"size"`
+	Path         string
+	MD5          string
+	Size         int64
+	KMSKeyID     string // set by schema v2 manifests
+	StorageClass string // storage class hint of schema v2 manifests
+
+	// Keyspace and ColumnFamily are copied from the enclosing manifest entry,
+	// except that SSTables of a secondary index belong to the indexed table
+	Keyspace     string
+	ColumnFamily string
+	Index        string // secondary index of the SSTable, "" for the table's own
 }
 
 // Manifest represents the parsed manifest - a flat list of all object paths
 type Manifest struct {
 	Objects []ManifestObject
+	Schema  string // schema version the manifest was written in, see manifestSchemaV1
 }
 
-// extractHostnamePath extracts [cluster]/[hostname]/ from a manifest key
-func extractHostnamePath(manifestKey string) (string, error) {
-	parts := strings.Split(manifestKey, "/")
-	if len(parts) < 4 {
-		return "", fmt.Errorf("invalid manifest path: %s", manifestKey)
-	}
-	return parts[0] + "/" + parts[1] + "/", nil
+// ManifestInfo describes a manifest found during discovery
+type ManifestInfo struct {
+	Key          string
+	LastModified time.Time // zero when unknown
+	Prefix       string    // -prefix the key lives under, "" for the bucket root
+	Depth        pathDepth // -path-depth of the key below Prefix
 }
 
-// parseManifest parses manifest JSON data
-// Medusa manifests are arrays of keyspace entries, each containing objects
-func parseManifest(data []byte) (*Manifest, error) {
-	var entries []ManifestEntry
-	if err := json.Unmarshal(data, &entries); err != nil {
-		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+// objectInfo is what the discovery listing or a HeadObject call reported about an object
+type objectInfo struct {
+	StorageClass types.ObjectStorageClass
+	LastModified time.Time // zero when unknown
+	Size         int64
+	ETag         string // as S3 reports it, quoted
+}
+
+// objectIndex maps the keys seen while listing the cluster prefix or looked
+// up with HeadObject to their details
+type objectIndex map[string]objectInfo
+
+// normalizePrefix turns a -prefix value into "" or a key prefix ending in a
+// single slash, so "backups/prod", "/backups/prod/" and "backups/prod/" match
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
 	}
+	return prefix + "/"
+}
 
-	// Flatten all objects from all keyspace entries
-	var allObjects []ManifestObject
-	for _, entry := range entries {
-		allObjects = append(allObjects, entry.Objects...)
+// needsRetentionReduction determines if GOVERNANCE retention exceeds the target and
+// may be shortened. COMPLIANCE retention can never be shortened.
+func needsRetentionReduction(current *ObjectRetention, retainUntil time.Time) bool {
+	if current == nil || current.RetainUntil == nil || current.Mode != types.ObjectLockRetentionModeGovernance {
+		return false
 	}
+	return current.RetainUntil.After(retainUntil)
+}
 
-	return &Manifest{Objects: allObjects}, nil
+// resolveObjectKey builds the full S3 key of a manifest object.
+// New-format manifests already include the hostname prefix in the path,
+// old-format manifests use paths relative to [prefix][cluster]/[hostname]/.
+func resolveObjectKey(hostnamePath, objectPath string) string {
+	if strings.HasPrefix(objectPath, hostnamePath) {
+		return objectPath
+	}
+	return hostnamePath + objectPath
 }
 
 // needsRetentionUpdate determines if retention should be updated based on current and required dates
@@ -78,102 +108,89 @@ func needsRetentionUpdate(currentRetention *time.Time, requiredUntil time.Time)
 }
 
 func main() {
-	bucket := flag.String("bucket", "", "S3 bucket name")
-	cluster := flag.String("cluster", "", "Cluster name")
-	minRetentionDays := flag.Int("min-retention", 0, "Minimum retention threshold in days - objects expiring before this will be updated")
-	maxRetentionDays := flag.Int("max-retention", 0, "Maximum retention in days - target retention when updating objects")
-	dryRun := flag.Bool("dry-run", false, "Dry run mode - don't actually update retention")
-	flag.Parse()
-
-	if *bucket == "" || *cluster == "" || *minRetentionDays <= 0 || *maxRetentionDays <= 0 {
-		log.Fatal("Usage: go run main.go -bucket <bucket> -cluster <cluster> -min-retention <days> -max-retention <days> [-dry-run]")
-	}
-
-	if *minRetentionDays > *maxRetentionDays {
-		log.Fatal("min-retention must be less than or equal to max-retention")
-	}
-
-	ctx := context.Background()
-
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		log.Fatalf("Failed to load AWS config: %v", err)
-	}
-
-	client := s3.NewFromConfig(cfg)
-
-	// Find all manifests matching the pattern: [cluster]/[hostname]/[last-backup]/meta/manifest.json
-	manifests, err := findManifests(ctx, client, *bucket, *cluster)
-	if err != nil {
-		log.Fatalf("Failed to find manifests: %v", err)
-	}
-
-	log.Printf("Found %d manifests", len(manifests))
+	// Interrupting a run stops it after the current object and still logs the summary
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := runMain(ctx, func(ctx context.Context) error {
+		return execute(ctx, os.Args[1:])
+	})
+	stop()
+	os.Exit(code)
+}
 
-	minRetentionThreshold := time.Now().AddDate(0, 0, *minRetentionDays)
-	retentionUntil := time.Now().AddDate(0, 0, *maxRetentionDays)
+// findManifests finds all manifest.json files matching the pattern under
+// [basePrefix][cluster]/, where basePrefix is a normalized -prefix. Every
+// other listed object is recorded in index unless it is nil.
+func findManifests(ctx context.Context, client S3API, bucket, basePrefix, cluster string, index objectIndex) ([]ManifestInfo, error) {
+	// List all objects under cluster prefix to find hostnames
+	return listManifests(ctx, client, bucket, basePrefix, basePrefix+cluster+"/", index)
+}
 
-	for _, manifestKey := range manifests {
-		log.Printf("Processing manifest: %s", manifestKey)
+// listManifests finds the manifests under prefix, a directory below
+// basePrefix, recording every other listed object in index unless it is nil
+func listManifests(ctx context.Context, client S3API, bucket, basePrefix, prefix string, index objectIndex) ([]ManifestInfo, error) {
+	// Track unique hostname/backup combinations
+	backupPaths := make(map[string]time.Time)
 
-		manifest, err := downloadManifest(ctx, client, *bucket, manifestKey)
+	var continuationToken *string
+	for {
+		resp, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucket),
+			Prefix:            aws.String(prefix),
+			ContinuationToken: continuationToken,
+		})
 		if err != nil {
-			log.Printf("Error downloading manifest %s: %v", manifestKey, err)
-			continue
+			return nil, fmt.Errorf("failed to list objects: %w", err)
 		}
 
-		// Extract hostname path from manifest key: [cluster]/[hostname]/
-		// Data files are stored in a shared directory: [cluster]/[hostname]/data/
-		hostnamePath, err := extractHostnamePath(manifestKey)
-		if err != nil {
-			log.Printf("Invalid manifest path: %s", manifestKey)
-			continue
+		for _, obj := range resp.Contents {
+			key := *obj.Key
+			// Look for manifest.json and manifest.json.gz files
+			if isManifestKey(key) {
+				backupPaths[key] = aws.ToTime(obj.LastModified)
+			} else if index != nil {
+				index[key] = objectInfo{StorageClass: obj.StorageClass, LastModified: aws.ToTime(obj.LastModified), Size: aws.ToInt64(obj.Size), ETag: aws.ToString(obj.ETag)}
+			}
 		}
 
-		for _, obj := range manifest.Objects {
-			// Check if path already includes the hostname prefix (new manifest format)
-			// or if it's a relative path that needs the prefix (old format)
-			var objectKey string
-			if strings.HasPrefix(obj.Path, hostnamePath) {
-				objectKey = obj.Path
-			} else {
-				objectKey = hostnamePath + obj.Path
-			}
+		if !aws.ToBool(resp.IsTruncated) {
+			break
+		}
+		continuationToken = resp.NextContinuationToken
+	}
 
-			needsUpdate, err := checkRetention(ctx, client, *bucket, objectKey, minRetentionThreshold)
-			if err != nil {
-				log.Printf("Error checking retention for %s: %v", objectKey, err)
-				continue
-			}
+	return manifestsFromKeys(backupPaths, basePrefix), nil
+}
 
-			if needsUpdate {
-				if *dryRun {
-					log.Printf("[DRY-RUN] Would update retention for: %s", objectKey)
-				} else {
-					err = updateRetention(ctx, client, *bucket, objectKey, retentionUntil)
-					if err != nil {
-						log.Printf("Error updating retention for %s: %v", objectKey, err)
-					} else {
-						log.Printf("Updated retention for: %s (until %s)", objectKey, retentionUntil.Format(time.RFC3339))
-					}
-				}
+// manifestsFromKeys turns the found manifest keys, with their LastModified,
+// into the manifests below basePrefix. A backup with both is read from the
+// uncompressed manifest.
+func manifestsFromKeys(backupPaths map[string]time.Time, basePrefix string) []ManifestInfo {
+	var manifests []ManifestInfo
+	for path, lastModified := range backupPaths {
+		if gz, ok := strings.CutSuffix(path, ".gz"); ok {
+			if _, ok := backupPaths[gz]; ok {
+				continue
 			}
 		}
+		manifests = append(manifests, ManifestInfo{Key: path, LastModified: lastModified, Prefix: basePrefix})
 	}
-
-	log.Println("Done")
+	return manifests
 }
 
-// findManifests finds all manifest.json files matching the pattern
-func findManifests(ctx context.Context, client S3API, bucket, cluster string) ([]string, error) {
-	var manifests []string
-
-	// List all objects under cluster prefix to find hostnames
-	prefix := cluster + "/"
-
-	// Track unique hostname/backup combinations
-	backupPaths := make(map[string]bool)
+// listKeys lists the keys of every object under prefix
+func listKeys(ctx context.Context, client S3API, bucket, prefix string) ([]string, error) {
+	var keys []string
+	err := listObjects(ctx, client, bucket, prefix, func(obj types.Object) {
+		keys = append(keys, aws.ToString(obj.Key))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
 
+// listObjects calls fn for every object under prefix, in listing order
+func listObjects(ctx context.Context, client S3API, bucket, prefix string, fn func(obj types.Object)) error {
 	var continuationToken *string
 	for {
 		resp, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
@@ -182,31 +199,38 @@ func findManifests(ctx context.Context, client S3API, bucket, cluster string) ([
 			ContinuationToken: continuationToken,
 		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to list objects: %w", err)
+			return fmt.Errorf("failed to list objects: %w", err)
 		}
-
 		for _, obj := range resp.Contents {
-			key := *obj.Key
-			// Look for manifest.json files
-			if strings.HasSuffix(key, "/meta/manifest.json") {
-				backupPaths[key] = true
-			}
+			fn(obj)
 		}
-
 		if !aws.ToBool(resp.IsTruncated) {
-			break
+			return nil
 		}
 		continuationToken = resp.NextContinuationToken
 	}
+}
 
-	for path := range backupPaths {
-		manifests = append(manifests, path)
+// downloadObject downloads the body of an object
+func downloadObject(ctx context.Context, client S3API, bucket, key string) ([]byte, error) {
+	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
 	}
+	defer resp.Body.Close()
 
-	return manifests, nil
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	return body, nil
 }
 
-// downloadManifest downloads and parses a manifest.json file
+// downloadManifest downloads and parses a manifest.json file, decompressing
+// gzipped manifests
 func downloadManifest(ctx context.Context, client S3API, bucket, key string) (*Manifest, error) {
 	resp, err := client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
@@ -221,43 +245,87 @@ func downloadManifest(ctx context.Context, client S3API, bucket, key string) (*M
 	if err != nil {
 		return nil, fmt.Errorf("failed to read body: %w", err)
 	}
-
+	hinted := gzipHinted(key, aws.ToString(resp.ContentEncoding), aws.ToString(resp.ContentType))
+	if body, err = decompressManifest(body, hinted); err != nil {
+		return nil, err
+	}
 	return parseManifest(body)
 }
 
-// checkRetention checks if an object's retention needs to be updated
-func checkRetention(ctx context.Context, client S3API, bucket, key string, requiredUntil time.Time) (bool, error) {
+// headObject looks up the storage class, LastModified, size and ETag of an object.
+// ok is false when the object doesn't exist.
+func headObject(ctx context.Context, client S3API, bucket, key string) (objectInfo, bool, error) {
+	resp, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		// Missing objects are reported by the retention check
+		if errorClass(err) == errorClassNotFound {
+			return objectInfo{}, false, nil
+		}
+		return objectInfo{}, false, fmt.Errorf("failed to head object: %w", err)
+	}
+	return objectInfo{
+		StorageClass: types.ObjectStorageClass(resp.StorageClass),
+		LastModified: aws.ToTime(resp.LastModified),
+		Size:         aws.ToInt64(resp.ContentLength),
+		ETag:         aws.ToString(resp.ETag),
+	}, true, nil
+}
+
+// ObjectRetention is an object's current Object Lock retention
+type ObjectRetention struct {
+	RetainUntil *time.Time // nil when no retention is set
+	Mode        types.ObjectLockRetentionMode
+	Missing     bool // the object doesn't exist
+}
+
+// checkRetention checks if an object's retention needs to be updated and returns
+// the retention currently set on it. Under COMPLIANCE mode, objects still locked
+// in GOVERNANCE mode need an update even when their date is sufficient.
+func checkRetention(ctx context.Context, client S3API, bucket, key string, requiredUntil time.Time, mode types.ObjectLockRetentionMode) (*ObjectRetention, bool, error) {
 	resp, err := client.GetObjectRetention(ctx, &s3.GetObjectRetentionInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
 		// If there's no retention set or object doesn't exist, we need to set it
-		if strings.Contains(err.Error(), "NoSuchObjectLockConfiguration") ||
-			strings.Contains(err.Error(), "ObjectLockConfigurationNotFoundError") ||
-			strings.Contains(err.Error(), "NoSuchKey") {
-			return true, nil
+		if isNoLock(err) {
+			return &ObjectRetention{}, true, nil
 		}
-		return false, err
+		if isNoSuchKey(err) {
+			return &ObjectRetention{Missing: true}, true, nil
+		}
+		return nil, false, err
 	}
 
-	var currentRetention *time.Time
+	current := &ObjectRetention{}
 	if resp.Retention != nil && resp.Retention.RetainUntilDate != nil {
-		currentRetention = resp.Retention.RetainUntilDate
+		current.RetainUntil = resp.Retention.RetainUntilDate
+		current.Mode = resp.Retention.Mode
+		if mode == types.ObjectLockRetentionModeCompliance && current.Mode != mode {
+			return current, true, nil
+		}
 	}
 
-	return needsRetentionUpdate(currentRetention, requiredUntil), nil
+	return current, needsRetentionUpdate(current.RetainUntil, requiredUntil), nil
 }
 
-// updateRetention sets the retention for an object
-func updateRetention(ctx context.Context, client S3API, bucket, key string, retainUntil time.Time) error {
-	_, err := client.PutObjectRetention(ctx, &s3.PutObjectRetentionInput{
+// updateRetention sets the retention for an object in the given mode.
+// bypassGovernance is required to shorten GOVERNANCE mode retention.
+func updateRetention(ctx context.Context, client S3API, bucket, key string, retainUntil time.Time, mode types.ObjectLockRetentionMode, bypassGovernance bool) error {
+	input := &s3.PutObjectRetentionInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 		Retention: &types.ObjectLockRetention{
-			Mode:            types.ObjectLockRetentionModeGovernance,
+			Mode:            mode,
 			RetainUntilDate: aws.Time(retainUntil),
 		},
-	})
+	}
+	if bypassGovernance {
+		input.BypassGovernanceRetention = aws.Bool(true)
+	}
+	_, err := client.PutObjectRetention(ctx, input)
 	return err
 }
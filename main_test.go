@@ -20,6 +20,12 @@ type MockS3Client struct {
 	GetObjectFunc         func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	GetObjectRetentionFunc func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error)
 	PutObjectRetentionFunc func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error)
+	GetObjectLegalHoldFunc func(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error)
+	PutObjectLegalHoldFunc func(ctx context.Context, params *s3.PutObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.PutObjectLegalHoldOutput, error)
+	HeadObjectFunc         func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObjectFunc          func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObjectTaggingFunc   func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTaggingFunc   func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
 }
 
 func (m *MockS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
@@ -50,12 +56,55 @@ func (m *MockS3Client) PutObjectRetention(ctx context.Context, params *s3.PutObj
 	return nil, errors.New("PutObjectRetention not implemented")
 }
 
+func (m *MockS3Client) GetObjectLegalHold(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error) {
+	if m.GetObjectLegalHoldFunc != nil {
+		return m.GetObjectLegalHoldFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("GetObjectLegalHold not implemented")
+}
+
+func (m *MockS3Client) PutObjectLegalHold(ctx context.Context, params *s3.PutObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.PutObjectLegalHoldOutput, error) {
+	if m.PutObjectLegalHoldFunc != nil {
+		return m.PutObjectLegalHoldFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("PutObjectLegalHold not implemented")
+}
+
+func (m *MockS3Client) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if m.HeadObjectFunc != nil {
+		return m.HeadObjectFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("HeadObject not implemented")
+}
+
+func (m *MockS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if m.PutObjectFunc != nil {
+		return m.PutObjectFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("PutObject not implemented")
+}
+
+func (m *MockS3Client) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	if m.GetObjectTaggingFunc != nil {
+		return m.GetObjectTaggingFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("GetObjectTagging not implemented")
+}
+
+func (m *MockS3Client) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	if m.PutObjectTaggingFunc != nil {
+		return m.PutObjectTaggingFunc(ctx, params, optFns...)
+	}
+	return nil, errors.New("PutObjectTagging not implemented")
+}
+
 // Unit Tests for extractHostnamePath
 
 func TestExtractHostnamePath(t *testing.T) {
 	tests := []struct {
 		name        string
 		manifestKey string
+		prefix      string
 		want        string
 		wantErr     bool
 	}{
@@ -87,22 +136,66 @@ func TestExtractHostnamePath(t *testing.T) {
 			manifestKey: "",
 			wantErr:     true,
 		},
+		{
+			name:        "under a prefix",
+			manifestKey: "backups/links/host1/backup-001/meta/manifest.json",
+			prefix:      "backups/",
+			want:        "backups/links/host1/",
+		},
+		{
+			name:        "under a nested prefix",
+			manifestKey: "backups/prod/links/host1/backup-001/meta/manifest.json",
+			prefix:      "backups/prod/",
+			want:        "backups/prod/links/host1/",
+		},
+		{
+			name:        "outside the prefix",
+			manifestKey: "links/host1/backup-001/meta/manifest.json",
+			prefix:      "backups/prod/",
+			wantErr:     true,
+		},
+		{
+			name:        "too few segments below the prefix",
+			manifestKey: "backups/prod/links/meta/manifest.json",
+			prefix:      "backups/prod/",
+			wantErr:     true,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := extractHostnamePath(tt.manifestKey)
+			got, err := extractHostnamePath(tt.manifestKey, tt.prefix, 0)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("extractHostnamePath() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if got != tt.want {
-				t.Errorf("extractHostnamePath() = %v, want %v", got, tt.want)
+			if got.HostnamePath != tt.want {
+				t.Errorf("extractHostnamePath() = %v, want %v", got.HostnamePath, tt.want)
 			}
 		})
 	}
 }
 
+func TestNormalizePrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{prefix: "", want: ""},
+		{prefix: "/", want: ""},
+		{prefix: "backups", want: "backups/"},
+		{prefix: "backups/prod", want: "backups/prod/"},
+		{prefix: "backups/prod/", want: "backups/prod/"},
+		{prefix: "/backups/prod//", want: "backups/prod/"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizePrefix(tt.prefix); got != tt.want {
+			t.Errorf("normalizePrefix(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
 // Unit Tests for parseManifest
 
 func TestParseManifest(t *testing.T) {
@@ -182,6 +275,29 @@ func TestParseManifest(t *testing.T) {
 	}
 }
 
+func TestParseManifestKeepsKeyspaceAndTable(t *testing.T) {
+	data := []byte(`[{"keyspace":"ks1","columnfamily":"table1","objects":[{"path":"a.db"},{"path":"b.db"}]},{"keyspace":"ks2","columnfamily":"table2","objects":[{"path":"c.db"}]}]`)
+
+	got, err := parseManifest(data)
+	if err != nil {
+		t.Fatalf("parseManifest() error = %v", err)
+	}
+
+	want := []ManifestObject{
+		{Path: "a.db", Keyspace: "ks1", ColumnFamily: "table1"},
+		{Path: "b.db", Keyspace: "ks1", ColumnFamily: "table1"},
+		{Path: "c.db", Keyspace: "ks2", ColumnFamily: "table2"},
+	}
+	if len(got.Objects) != len(want) {
+		t.Fatalf("parseManifest() got %d objects, want %d", len(got.Objects), len(want))
+	}
+	for i, obj := range got.Objects {
+		if obj != want[i] {
+			t.Errorf("parseManifest() object[%d] = %+v, want %+v", i, obj, want[i])
+		}
+	}
+}
+
 // Unit Tests for needsRetentionUpdate
 
 func TestNeedsRetentionUpdate(t *testing.T) {
@@ -339,7 +455,7 @@ func TestFindManifests(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mock := tt.setupMock()
-			got, err := findManifests(ctx, mock, tt.bucket, tt.cluster)
+			got, err := findManifests(ctx, mock, tt.bucket, "", tt.cluster, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("findManifests() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -350,7 +466,7 @@ func TestFindManifests(t *testing.T) {
 			// Convert to map for comparison since order is not guaranteed
 			gotMap := make(map[string]bool)
 			for _, m := range got {
-				gotMap[m] = true
+				gotMap[m.Key] = true
 			}
 			wantMap := make(map[string]bool)
 			for _, m := range tt.want {
@@ -369,6 +485,28 @@ func TestFindManifests(t *testing.T) {
 	}
 }
 
+func TestFindManifestsRecordsLastModified(t *testing.T) {
+	lastModified := time.Date(2025, 11, 1, 0, 0, 0, 0, time.UTC)
+	mock := &MockS3Client{
+		ListObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				Contents: []types.Object{
+					{Key: aws.String("links/host1/adhoc-before-upgrade/meta/manifest.json"), LastModified: aws.Time(lastModified)},
+				},
+				IsTruncated: aws.Bool(false),
+			}, nil
+		},
+	}
+
+	got, err := findManifests(context.Background(), mock, "test-bucket", "", "links", nil)
+	if err != nil {
+		t.Fatalf("findManifests() error = %v", err)
+	}
+	if len(got) != 1 || !got[0].LastModified.Equal(lastModified) {
+		t.Errorf("findManifests() = %v, want LastModified %v", got, lastModified)
+	}
+}
+
 func TestDownloadManifest(t *testing.T) {
 	ctx := context.Background()
 
@@ -566,7 +704,7 @@ func TestCheckRetention(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mock := tt.setupMock()
-			got, err := checkRetention(ctx, mock, tt.bucket, tt.key, requiredUntil)
+			_, got, err := checkRetention(ctx, mock, tt.bucket, tt.key, requiredUntil, types.ObjectLockRetentionModeGovernance)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("checkRetention() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -578,6 +716,45 @@ func TestCheckRetention(t *testing.T) {
 	}
 }
 
+func TestCheckRetentionModeMismatch(t *testing.T) {
+	ctx := context.Background()
+	requiredUntil := time.Now().Add(30 * 24 * time.Hour)
+	futureRetention := time.Now().Add(60 * 24 * time.Hour)
+
+	retentionIn := func(mode types.ObjectLockRetentionMode) *MockS3Client {
+		return &MockS3Client{
+			GetObjectRetentionFunc: func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+				return &s3.GetObjectRetentionOutput{
+					Retention: &types.ObjectLockRetention{Mode: mode, RetainUntilDate: aws.Time(futureRetention)},
+				}, nil
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		current types.ObjectLockRetentionMode
+		mode    types.ObjectLockRetentionMode
+		want    bool
+	}{
+		{name: "governance object under compliance mode", current: types.ObjectLockRetentionModeGovernance, mode: types.ObjectLockRetentionModeCompliance, want: true},
+		{name: "compliance object under compliance mode", current: types.ObjectLockRetentionModeCompliance, mode: types.ObjectLockRetentionModeCompliance, want: false},
+		{name: "compliance object under governance mode", current: types.ObjectLockRetentionModeCompliance, mode: types.ObjectLockRetentionModeGovernance, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got, err := checkRetention(ctx, retentionIn(tt.current), "test-bucket", "cluster/host/data/file.db", requiredUntil, tt.mode)
+			if err != nil {
+				t.Fatalf("checkRetention() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("checkRetention() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestUpdateRetention(t *testing.T) {
 	ctx := context.Background()
 	retainUntil := time.Now().Add(30 * 24 * time.Hour)
@@ -586,6 +763,7 @@ func TestUpdateRetention(t *testing.T) {
 		name      string
 		bucket    string
 		key       string
+		mode      types.ObjectLockRetentionMode
 		setupMock func() *MockS3Client
 		wantErr   bool
 	}{
@@ -593,6 +771,7 @@ func TestUpdateRetention(t *testing.T) {
 			name:   "updates retention successfully",
 			bucket: "test-bucket",
 			key:    "cluster/host/data/file.db",
+			mode:   types.ObjectLockRetentionModeGovernance,
 			setupMock: func() *MockS3Client {
 				return &MockS3Client{
 					PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
@@ -612,10 +791,28 @@ func TestUpdateRetention(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:   "updates retention in compliance mode",
+			bucket: "test-bucket",
+			key:    "cluster/host/data/file.db",
+			mode:   types.ObjectLockRetentionModeCompliance,
+			setupMock: func() *MockS3Client {
+				return &MockS3Client{
+					PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+						if params.Retention.Mode != types.ObjectLockRetentionModeCompliance {
+							return nil, errors.New("wrong mode")
+						}
+						return &s3.PutObjectRetentionOutput{}, nil
+					},
+				}
+			},
+			wantErr: false,
+		},
 		{
 			name:   "access denied error",
 			bucket: "test-bucket",
 			key:    "cluster/host/data/file.db",
+			mode:   types.ObjectLockRetentionModeGovernance,
 			setupMock: func() *MockS3Client {
 				return &MockS3Client{
 					PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
@@ -629,6 +826,7 @@ func TestUpdateRetention(t *testing.T) {
 			name:   "object lock not enabled",
 			bucket: "test-bucket",
 			key:    "cluster/host/data/file.db",
+			mode:   types.ObjectLockRetentionModeGovernance,
 			setupMock: func() *MockS3Client {
 				return &MockS3Client{
 					PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
@@ -643,7 +841,7 @@ func TestUpdateRetention(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mock := tt.setupMock()
-			err := updateRetention(ctx, mock, tt.bucket, tt.key, retainUntil)
+			err := updateRetention(ctx, mock, tt.bucket, tt.key, retainUntil, tt.mode, false)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("updateRetention() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -651,6 +849,52 @@ func TestUpdateRetention(t *testing.T) {
 	}
 }
 
+func TestUpdateRetentionBypassGovernance(t *testing.T) {
+	for _, bypass := range []bool{false, true} {
+		var got *s3.PutObjectRetentionInput
+		mock := &MockS3Client{
+			PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+				got = params
+				return &s3.PutObjectRetentionOutput{}, nil
+			},
+		}
+		err := updateRetention(context.Background(), mock, "test-bucket", "cluster/host/data/file.db", time.Now(), types.ObjectLockRetentionModeGovernance, bypass)
+		if err != nil {
+			t.Fatalf("updateRetention() error = %v", err)
+		}
+		if aws.ToBool(got.BypassGovernanceRetention) != bypass {
+			t.Errorf("updateRetention(bypass=%v) BypassGovernanceRetention = %v", bypass, got.BypassGovernanceRetention)
+		}
+	}
+}
+
+func TestNeedsRetentionReduction(t *testing.T) {
+	target := time.Now().Add(30 * 24 * time.Hour)
+	later := target.Add(24 * time.Hour)
+	earlier := target.Add(-24 * time.Hour)
+
+	tests := []struct {
+		name    string
+		current *ObjectRetention
+		want    bool
+	}{
+		{name: "nil retention", current: nil, want: false},
+		{name: "no retention set", current: &ObjectRetention{}, want: false},
+		{name: "governance beyond target", current: &ObjectRetention{RetainUntil: &later, Mode: types.ObjectLockRetentionModeGovernance}, want: true},
+		{name: "governance before target", current: &ObjectRetention{RetainUntil: &earlier, Mode: types.ObjectLockRetentionModeGovernance}, want: false},
+		{name: "governance equal to target", current: &ObjectRetention{RetainUntil: &target, Mode: types.ObjectLockRetentionModeGovernance}, want: false},
+		{name: "compliance beyond target", current: &ObjectRetention{RetainUntil: &later, Mode: types.ObjectLockRetentionModeCompliance}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := needsRetentionReduction(tt.current, target); got != tt.want {
+				t.Errorf("needsRetentionReduction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 // Test parsing the sample manifest file
 func TestParseSampleManifest(t *testing.T) {
 	data, err := os.ReadFile("sample_manifest.json")
@@ -711,17 +955,11 @@ func TestObjectPathConstruction(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			hostnamePath, err := extractHostnamePath(tt.manifestKey)
+			mp, err := extractHostnamePath(tt.manifestKey, "", 0)
 			if err != nil {
 				t.Fatalf("extractHostnamePath() error = %v", err)
 			}
-			// Replicate the logic from main.go
-			var objectKey string
-			if strings.HasPrefix(tt.objectPath, hostnamePath) {
-				objectKey = tt.objectPath
-			} else {
-				objectKey = hostnamePath + tt.objectPath
-			}
+			objectKey := resolveObjectKey(mp.HostnamePath, tt.objectPath)
 			if objectKey != tt.expectedPath {
 				t.Errorf("object path = %v, want %v", objectKey, tt.expectedPath)
 			}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Manifest schema versions parseManifest recognizes
+const (
+	// manifestSchemaV1 lists keyspace entries whose objects have a path, MD5 and size
+	manifestSchemaV1 = "v1"
+	// manifestSchemaV2 is v1 with per-object KMS keys or storage class
+	// hints, written by newer Medusa releases
+	manifestSchemaV2 = "v2"
+)
+
+// errUnknownManifestLayout is returned for manifests whose structure matches no
+// known schema version, as opposed to invalid JSON
+var errUnknownManifestLayout = errors.New("unrecognized manifest layout")
+
+// rawManifestEntry is a keyspace entry as any schema version writes it.
+// Objects is a pointer so a missing list can be told apart from an empty one.
+type rawManifestEntry struct {
+	Keyspace     string               `json:"keyspace"`
+	ColumnFamily string               `json:"columnfamily"`
+	Objects      *[]rawManifestObject `json:"objects"`
+}
+
+// rawManifestObject is an object entry as any schema version writes it.
+// Fields of future versions are ignored.
+type rawManifestObject struct {
+	Path         *string `json:"path"`
+	MD5          string  `json:"MD5"`
+	Size         int64   `json:"size"`
+	KMSKeyID     string  `json:"kms_key_id"`    // v2
+	StorageClass string  `json:"storage_class"` // v2
+}
+
+// parseManifest parses manifest JSON data of any known schema version into a
+// flat list of objects and records the version in Schema.
+// Medusa manifests are arrays of keyspace entries, each containing objects.
+func parseManifest(data []byte) (*Manifest, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] != '[' {
+		return nil, fmt.Errorf("%w: expected a list of keyspace entries, got %s", errUnknownManifestLayout, jsonKind(trimmed[0]))
+	}
+	var entries []rawManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("%w: %s is a JSON %s", errUnknownManifestLayout, typeErr.Field, typeErr.Value)
+		}
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	// Flatten all objects from all keyspace entries, keeping the keyspace/table they belong to
+	manifest := &Manifest{Schema: manifestSchemaV1}
+	for i, entry := range entries {
+		if entry.Objects == nil {
+			return nil, fmt.Errorf("%w: entry %d (%s.%s) has no objects", errUnknownManifestLayout, i, entry.Keyspace, entry.ColumnFamily)
+		}
+		for j, raw := range *entry.Objects {
+			if raw.Path == nil {
+				return nil, fmt.Errorf("%w: object %d of %s.%s has no path", errUnknownManifestLayout, j, entry.Keyspace, entry.ColumnFamily)
+			}
+			if raw.KMSKeyID != "" || raw.StorageClass != "" {
+				manifest.Schema = manifestSchemaV2
+			}
+			obj := ManifestObject{
+				Path:         *raw.Path,
+				MD5:          raw.MD5,
+				Size:         raw.Size,
+				KMSKeyID:     raw.KMSKeyID,
+				StorageClass: raw.StorageClass,
+				Keyspace:     entry.Keyspace,
+				ColumnFamily: entry.ColumnFamily,
+			}
+			attributeIndex(&obj)
+			manifest.Objects = append(manifest.Objects, obj)
+		}
+	}
+	return manifest, nil
+}
+
+// secondaryIndexPath splits the path of an SSTable stored in a secondary index
+// directory, <table>/.<index>/<file> as in
+// data/ks/users-cb752354d0f211f0bde0457410cd7650/.users_email_idx/nb-1-big-Data.db,
+// into the table directory and the index name
+func secondaryIndexPath(objectPath string) (table, index string, ok bool) {
+	parts := strings.Split(objectPath, "/")
+	if len(parts) < 3 {
+		return "", "", false
+	}
+	dir, table := parts[len(parts)-2], parts[len(parts)-3]
+	if len(dir) < 2 || dir[0] != '.' || table == "" || table[0] == '.' {
+		return "", "", false
+	}
+	return table, dir[1:], true
+}
+
+// attributeIndex sets the index of an SSTable in a secondary index directory
+// and attributes it to the indexed table. Manifests may record the index as
+// the columnfamily, e.g. .users_email_idx or users.users_email_idx; table
+// names can't contain dots, so those are replaced by the table directory.
+func attributeIndex(obj *ManifestObject) {
+	table, index, ok := secondaryIndexPath(obj.Path)
+	if !ok {
+		return
+	}
+	obj.Index = index
+	if obj.ColumnFamily == "" || strings.Contains(obj.ColumnFamily, ".") {
+		obj.ColumnFamily = table
+	}
+}
+
+// jsonKind names the JSON value starting with c, for layout errors
+func jsonKind(c byte) string {
+	switch c {
+	case '{':
+		return "an object"
+	case '"':
+		return "a string"
+	case 't', 'f':
+		return "a boolean"
+	case 'n':
+		return "null"
+	default:
+		return "a number"
+	}
+}
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gzipHinted reports whether the key suffix, Content-Encoding or Content-Type
+// of a manifest says it is gzip-compressed
+func gzipHinted(key, contentEncoding, contentType string) bool {
+	if strings.HasSuffix(key, ".gz") {
+		return true
+	}
+	for _, enc := range strings.Split(contentEncoding, ",") {
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") {
+			return true
+		}
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case "application/gzip", "application/x-gzip":
+		return true
+	}
+	return false
+}
+
+// decompressManifest returns the manifest JSON of body, gunzipping it when it
+// starts with the gzip magic bytes or hinted is set. A hinted body that isn't
+// gzip is returned as is, since the HTTP client may already have decoded a
+// Content-Encoding: gzip response.
+func decompressManifest(body []byte, hinted bool) ([]byte, error) {
+	if !bytes.HasPrefix(body, gzipMagic) {
+		if hinted {
+			slog.Debug("Manifest marked as gzip is not compressed, reading it as is")
+		}
+		return body, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress manifest: %w", err)
+	}
+	defer zr.Close()
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress manifest: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestParseManifestSchemas(t *testing.T) {
+	const (
+		dataPath  = "links/links-us-default-sts-0/data/links/clicks-cb752354d0f211f0bde0457410cd7650/nb-1-big-Data.db"
+		indexPath = "links/links-us-default-sts-0/data/links/clicks-cb752354d0f211f0bde0457410cd7650/nb-1-big-Index.db"
+		table     = "clicks-cb752354d0f211f0bde0457410cd7650"
+	)
+
+	tests := []struct {
+		fixture    string
+		wantSchema string
+		want       []ManifestObject
+	}{
+		{
+			fixture:    "v1.json",
+			wantSchema: manifestSchemaV1,
+			want: []ManifestObject{
+				{Path: dataPath, MD5: "5d05c4c7ecafccdf1b4f1d06c4c3032e", Size: 4821, Keyspace: "links", ColumnFamily: table},
+				{Path: indexPath, MD5: "0cc175b9c0f1b6a831c399e269772661", Size: 120, Keyspace: "links", ColumnFamily: table},
+			},
+		},
+		{
+			// Fields no known version writes are ignored
+			fixture:    "v1-future-fields.json",
+			wantSchema: manifestSchemaV1,
+			want: []ManifestObject{
+				{Path: dataPath, MD5: "5d05c4c7ecafccdf1b4f1d06c4c3032e", Size: 4821, Keyspace: "links", ColumnFamily: table},
+			},
+		},
+		{
+			fixture:    "v2.json",
+			wantSchema: manifestSchemaV2,
+			want: []ManifestObject{
+				{
+					Path: dataPath, MD5: "5d05c4c7ecafccdf1b4f1d06c4c3032e", Size: 4821,
+					KMSKeyID:     "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+					StorageClass: "STANDARD_IA",
+					Keyspace:     "links", ColumnFamily: table,
+				},
+				{Path: indexPath, MD5: "0cc175b9c0f1b6a831c399e269772661", Size: 120, Keyspace: "links", ColumnFamily: table},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "manifests", tt.fixture))
+			if err != nil {
+				t.Fatalf("failed to read fixture: %v", err)
+			}
+			got, err := parseManifest(data)
+			if err != nil {
+				t.Fatalf("parseManifest() error = %v", err)
+			}
+			if got.Schema != tt.wantSchema {
+				t.Errorf("parseManifest() schema = %q, want %q", got.Schema, tt.wantSchema)
+			}
+			if !reflect.DeepEqual(got.Objects, tt.want) {
+				t.Errorf("parseManifest() objects = %+v, want %+v", got.Objects, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseManifestUnknownLayouts(t *testing.T) {
+	tests := []struct {
+		fixture string
+		wantErr string
+	}{
+		{fixture: "unknown-top-level-object.json", wantErr: "expected a list of keyspace entries, got an object"},
+		{fixture: "unknown-no-objects.json", wantErr: "entry 0 (links.clicks) has no objects"},
+		{fixture: "unknown-no-path.json", wantErr: "object 0 of links.clicks has no path"},
+		{fixture: "unknown-objects-not-list.json", wantErr: "objects is a JSON object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "manifests", tt.fixture))
+			if err != nil {
+				t.Fatalf("failed to read fixture: %v", err)
+			}
+			_, err = parseManifest(data)
+			if !errors.Is(err, errUnknownManifestLayout) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseManifest() error = %v, want an unrecognized layout error mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Broken JSON is a parse error, not a layout the tool doesn't know
+	if _, err := parseManifest([]byte(`[{"keyspace": "links",`)); err == nil || errors.Is(err, errUnknownManifestLayout) {
+		t.Errorf("parseManifest() error = %v, want a JSON parse error", err)
+	}
+}
+
+func TestParseManifestSecondaryIndexes(t *testing.T) {
+	const (
+		table    = "users-cb752354d0f211f0bde0457410cd7650"
+		tableDir = "links/links-us-default-sts-0/data/app/" + table
+	)
+
+	tests := []struct {
+		name             string
+		columnFamily     string
+		path             string
+		wantColumnFamily string
+		wantIndex        string
+	}{
+		{name: "table sstable", columnFamily: table, path: tableDir + "/nb-1-big-Data.db", wantColumnFamily: table},
+		{name: "index under the table entry", columnFamily: table, path: tableDir + "/.users_email_idx/nb-1-big-Data.db", wantColumnFamily: table, wantIndex: "users_email_idx"},
+		{name: "index directory as columnfamily", columnFamily: ".users_email_idx", path: tableDir + "/.users_email_idx/nb-2-big-Index.db", wantColumnFamily: table, wantIndex: "users_email_idx"},
+		{name: "qualified index as columnfamily", columnFamily: "users.users_email_idx", path: tableDir + "/.users_email_idx/mc-3-big-Data.db", wantColumnFamily: table, wantIndex: "users_email_idx"},
+		{name: "relative path", columnFamily: table, path: "data/app/" + table + "/.users_country_idx/nb-1-big-Statistics.db", wantColumnFamily: table, wantIndex: "users_country_idx"},
+		{name: "hidden file in the table directory", columnFamily: table, path: tableDir + "/.nb-1-big-Data.db", wantColumnFamily: table},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := fmt.Sprintf(`[{"keyspace":"app","columnfamily":%q,"objects":[{"path":%q,"size":10}]}]`, tt.columnFamily, tt.path)
+			got, err := parseManifest([]byte(data))
+			if err != nil {
+				t.Fatalf("parseManifest() error = %v", err)
+			}
+			want := ManifestObject{Path: tt.path, Size: 10, Keyspace: "app", ColumnFamily: tt.wantColumnFamily, Index: tt.wantIndex}
+			if !reflect.DeepEqual(got.Objects, []ManifestObject{want}) {
+				t.Errorf("parseManifest() objects = %+v, want %+v", got.Objects, want)
+			}
+		})
+	}
+}
+
+func TestRunManifestSchemas(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/b2/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/b.db","storage_class":"STANDARD_IA"}]}]`
+	bucket.objects["links/host2/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db","kms_key_id":"alias/backups"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	bucket.objects["links/host2/data/ks/t/a.db"] = ""
+
+	opts := testOptions()
+	opts.dryRun = true
+	opts.report = filepath.Join(t.TempDir(), "report.jsonl")
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.withReport(func() error { return r.run(context.Background()) }); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	want := map[string]int{manifestSchemaV1: 1, manifestSchemaV2: 2}
+	if got := r.stats.summary(time.Now()).ManifestsBySchema; !reflect.DeepEqual(got, want) {
+		t.Errorf("summary manifests_by_schema = %v, want %v", got, want)
+	}
+	for _, rec := range readReport(t, opts.report) {
+		wantSchema := manifestSchemaV2
+		if rec["manifest"] == "links/host1/b1/meta/manifest.json" {
+			wantSchema = manifestSchemaV1
+		}
+		if rec["manifest_schema"] != wantSchema {
+			t.Errorf("report record %v has manifest_schema %v, want %q", rec, rec["manifest_schema"], wantSchema)
+		}
+	}
+}
+
+// gzipped returns data compressed with gzip
+func gzipped(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDownloadGzipManifest(t *testing.T) {
+	const manifest = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db","size":10}]}]`
+	compressed := gzipped(t, manifest)
+
+	tests := []struct {
+		name            string
+		key             string
+		body            []byte
+		contentEncoding string
+		contentType     string
+		wantErr         string
+	}{
+		{name: "key suffix", key: "links/host1/b1/meta/manifest.json.gz", body: compressed},
+		{name: "content encoding", key: "links/host1/b1/meta/manifest.json", body: compressed, contentEncoding: "gzip"},
+		{name: "content type", key: "links/host1/b1/meta/manifest.json", body: compressed, contentType: "application/x-gzip"},
+		{name: "magic bytes", key: "links/host1/b1/meta/manifest.json", body: compressed, contentType: "application/json"},
+		// The HTTP client may already have decoded the body
+		{name: "content encoding on a decoded body", key: "links/host1/b1/meta/manifest.json", body: []byte(manifest), contentEncoding: "gzip"},
+		{name: "plain", key: "links/host1/b1/meta/manifest.json", body: []byte(manifest)},
+		{name: "corrupted stream", key: "links/host1/b1/meta/manifest.json.gz", body: compressed[:len(compressed)-10], wantErr: "failed to decompress manifest"},
+		{name: "corrupted header", key: "links/host1/b1/meta/manifest.json", body: append([]byte{0x1f, 0x8b, 0x00}, compressed[3:]...), wantErr: "failed to decompress manifest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &MockS3Client{
+				GetObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+					out := &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(tt.body))}
+					if tt.contentEncoding != "" {
+						out.ContentEncoding = aws.String(tt.contentEncoding)
+					}
+					if tt.contentType != "" {
+						out.ContentType = aws.String(tt.contentType)
+					}
+					return out, nil
+				},
+			}
+			got, err := downloadManifest(context.Background(), mock, "test-bucket", tt.key)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("downloadManifest() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadManifest() error = %v", err)
+			}
+			want := []ManifestObject{{Path: "data/ks/t/a.db", Size: 10, Keyspace: "ks", ColumnFamily: "t"}}
+			if !reflect.DeepEqual(got.Objects, want) {
+				t.Errorf("downloadManifest() objects = %+v, want %+v", got.Objects, want)
+			}
+		})
+	}
+}
+
+func TestFindGzipManifests(t *testing.T) {
+	mock := &MockS3Client{
+		ListObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{
+				Contents: []types.Object{
+					{Key: aws.String("links/host1/b1/meta/manifest.json.gz")},
+					// b2 has both, and is read from the uncompressed manifest
+					{Key: aws.String("links/host1/b2/meta/manifest.json")},
+					{Key: aws.String("links/host1/b2/meta/manifest.json.gz")},
+					{Key: aws.String("links/host1/b3/meta/manifest.json.bak")},
+					{Key: aws.String("links/host1/data/ks/t/a.db.gz")},
+				},
+				IsTruncated: aws.Bool(false),
+			}, nil
+		},
+	}
+
+	got, err := findManifests(context.Background(), mock, "test-bucket", "", "links", nil)
+	if err != nil {
+		t.Fatalf("findManifests() error = %v", err)
+	}
+	keys := manifestKeys(got)
+	sort.Strings(keys)
+	want := []string{"links/host1/b1/meta/manifest.json.gz", "links/host1/b2/meta/manifest.json"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("findManifests() = %v, want %v", keys, want)
+	}
+
+	if err := validateManifestKey("links/host1/b1/meta/manifest.json.gz", "", 0, false); err != nil {
+		t.Errorf("validateManifestKey() error = %v for a gzipped manifest", err)
+	}
+	if dir, ok := metaPrefix("links/host1/b1/meta/manifest.json.gz"); !ok || dir != "links/host1/b1/meta/" {
+		t.Errorf("metaPrefix() = %q, %v, want links/host1/b1/meta/", dir, ok)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// markerName is the name of the refreshed marker in a backup's meta/ directory
+const markerName = ".retention-refreshed.json"
+
+// markerGrace is how much longer than required a marker must show a backup
+// retained to be skipped, so the backup is checked again, and its objects
+// extended, a day before they would fall short
+const markerGrace = 24 * time.Hour
+
+// refreshedMarker is the marker written next to the manifest of a backup whose
+// objects all reached the retention it records
+type refreshedMarker struct {
+	RetainUntil time.Time                     `json:"retain_until"` // earliest retain-until of the backup's objects
+	Mode        types.ObjectLockRetentionMode `json:"mode"`         // GOVERNANCE unless every object is in COMPLIANCE
+	RunID       string                        `json:"run_id"`
+	UpdatedAt   time.Time                     `json:"updated_at"`
+}
+
+// markerKey returns the key of the refreshed marker of manifestKey. ok is
+// false for forced manifest keys outside meta/, which get no marker.
+func markerKey(manifestKey string) (string, bool) {
+	prefix, ok := metaPrefix(manifestKey)
+	if !ok {
+		return "", false
+	}
+	return prefix + markerName, true
+}
+
+// isMarkerKey reports whether key is a refreshed marker
+func isMarkerKey(key string) bool {
+	return path.Base(key) == markerName
+}
+
+// usesMarkers reports whether the run reads and writes refreshed markers:
+// the retention a legal-hold run leaves unchanged isn't recorded, and
+// -offline runs make no S3 calls
+func (r *refresher) usesMarkers() bool {
+	return r.opts.legalHold == "" && r.offline == nil
+}
+
+// readMarker returns the refreshed marker of manifestKey, nil when it has none
+func (r *refresher) readMarker(ctx context.Context, manifestKey string) (*refreshedMarker, error) {
+	key, ok := markerKey(manifestKey)
+	if !ok {
+		return nil, nil
+	}
+	out, err := r.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(r.opts.bucket), Key: aws.String(key)})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, err
+	}
+	var marker refreshedMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", key, err)
+	}
+	if marker.RetainUntil.IsZero() {
+		return nil, fmt.Errorf("failed to decode %s: no retain_until", key)
+	}
+	return &marker, nil
+}
+
+// skipMarkedBackups leaves out the manifests whose refreshed marker shows
+// their backup retained at least markerGrace longer than now required, in a
+// mode at least as strict, and no longer than -allow-reduce allows, without
+// downloading them. Backups whose marker
+// can't be read are processed.
+func (r *refresher) skipMarkedBackups(ctx context.Context, manifests []ManifestInfo) []ManifestInfo {
+	kept := manifests[:0]
+	skipped := 0
+	for _, m := range manifests {
+		if r.stopErr(ctx) != nil {
+			// The rest is left to the processing loop, which stops too
+			kept = append(kept, m)
+			continue
+		}
+		marker, err := r.readMarker(ctx, m.Key)
+		if err != nil {
+			slog.Warn("Failed to read refreshed marker, processing the backup", append([]any{"manifest", m.Key}, errorAttrs(err)...)...)
+		}
+		if marker != nil && r.retainedEnough(m, marker.RetainUntil, marker.Mode, markerGrace) {
+			slog.Debug("Skipped backup retained long enough per its refreshed marker", "manifest", m.Key, "retain_until", marker.RetainUntil, "run_id", marker.RunID)
+			skipped++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	if skipped > 0 {
+		slog.Info("Skipped backups retained long enough per their refreshed markers", "skipped", skipped, "remaining", len(kept))
+		r.stats.addManifestsUpToDate(skipped)
+	}
+	return kept
+}
+
+// writeMarker writes the refreshed marker of m once every one of its objects
+// was retained. Failures are only logged: the backup is processed again by
+// the next run.
+func (r *refresher) writeMarker(ctx context.Context, m ManifestInfo) {
+	key, ok := markerKey(m.Key)
+	if !ok {
+		return
+	}
+	until, mode, ok := r.retained.reached(m.Key)
+	if !ok {
+		return
+	}
+	if err := r.putMarker(ctx, key, until, mode); err != nil {
+		slog.Warn("Failed to write refreshed marker, the backup will be processed again by the next run", append([]any{"manifest", m.Key}, errorAttrs(err)...)...)
+		return
+	}
+	slog.Debug("Wrote refreshed marker", "manifest", m.Key, "retain_until", until, "mode", mode)
+}
+
+// putMarker writes the refreshed marker key recording until and mode
+func (r *refresher) putMarker(ctx context.Context, key string, until time.Time, mode types.ObjectLockRetentionMode) error {
+	body, err := json.Marshal(refreshedMarker{RetainUntil: until.UTC(), Mode: mode, RunID: r.runID, UpdatedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	_, err = r.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(r.opts.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+		// Object Lock requires an integrity checksum on PutObject
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	})
+	return err
+}
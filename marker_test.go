@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// markedBucket returns a bucket with one backup of one object, and a client
+// storing the objects it's sent
+func markedBucket() (*fakeBucket, *MockS3Client) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	client := bucket.client()
+	client.PutObjectFunc = func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(params.Body)
+		if err != nil {
+			return nil, err
+		}
+		bucket.mu.Lock()
+		defer bucket.mu.Unlock()
+		bucket.objects[aws.ToString(params.Key)] = string(body)
+		return &s3.PutObjectOutput{}, nil
+	}
+	return bucket, client
+}
+
+// setMarker stores the refreshed marker of manifest
+func setMarker(t *testing.T, bucket *fakeBucket, manifest string, marker refreshedMarker) {
+	t.Helper()
+	data, err := json.Marshal(marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := markerKey(manifest)
+	bucket.objects[key] = string(data)
+}
+
+func TestMarkerKey(t *testing.T) {
+	tests := []struct {
+		manifest string
+		want     string
+	}{
+		{"links/host1/b1/meta/manifest.json", "links/host1/b1/meta/.retention-refreshed.json"},
+		{"backups/prod/links/host1/b1/meta/manifest.json.gz", "backups/prod/links/host1/b1/meta/.retention-refreshed.json"},
+		{"links/host1/b1/manifest-copy.json", ""},
+	}
+	for _, tt := range tests {
+		got, ok := markerKey(tt.manifest)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("markerKey(%q) = %q, %v, want %q", tt.manifest, got, ok, tt.want)
+		}
+		if ok && !isMarkerKey(got) {
+			t.Errorf("isMarkerKey(%q) = false", got)
+		}
+	}
+}
+
+func TestRunWritesRefreshedMarkers(t *testing.T) {
+	bucket, client := markedBucket()
+	// host2's object is missing, so its backup isn't retained
+	bucket.objects["links/host2/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/b.db"}]}]`
+	bucket.retention["links/host1/data/ks/t/a.db"] = time.Now().Add(24 * time.Hour)
+
+	r := newRefresher(client, testOptions(), time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	var marker refreshedMarker
+	if err := json.Unmarshal([]byte(bucket.objects["links/host1/b1/meta/.retention-refreshed.json"]), &marker); err != nil {
+		t.Fatalf("no refreshed marker of host1's backup: %v", err)
+	}
+	if set := bucket.retention["links/host1/data/ks/t/a.db"]; !marker.RetainUntil.Equal(set) {
+		t.Errorf("marker retain_until = %s, want the retain-until set, %s", marker.RetainUntil, set)
+	}
+	if marker.Mode != types.ObjectLockRetentionModeGovernance || marker.RunID != r.runID || marker.UpdatedAt.IsZero() {
+		t.Errorf("marker = %+v, want GOVERNANCE of run %s", marker, r.runID)
+	}
+	if _, ok := bucket.objects["links/host2/b1/meta/.retention-refreshed.json"]; ok {
+		t.Error("marked host2's backup, whose object is missing")
+	}
+}
+
+func TestRunDryRunWritesNoMarker(t *testing.T) {
+	bucket, client := markedBucket()
+	opts := testOptions()
+	opts.dryRun = true
+	if err := newRefresher(client, opts, time.Now()).run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if _, ok := bucket.objects["links/host1/b1/meta/.retention-refreshed.json"]; ok {
+		t.Error("dry run wrote a refreshed marker")
+	}
+}
+
+func TestRunSkipsMarkedBackups(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		marker      refreshedMarker
+		body        string // marker body instead of marker
+		opts        func(opts *options)
+		wantSkipped bool
+	}{
+		{
+			name:        "retained long enough",
+			marker:      refreshedMarker{RetainUntil: now.AddDate(0, 0, 29), Mode: types.ObjectLockRetentionModeGovernance},
+			wantSkipped: true,
+		},
+		{
+			name:        "compliance marker",
+			marker:      refreshedMarker{RetainUntil: now.AddDate(0, 0, 29), Mode: types.ObjectLockRetentionModeCompliance},
+			wantSkipped: true,
+		},
+		{
+			name:   "-ignore-markers",
+			marker: refreshedMarker{RetainUntil: now.AddDate(0, 0, 29), Mode: types.ObjectLockRetentionModeGovernance},
+			opts:   func(opts *options) { opts.ignoreMarkers = true },
+		},
+		{
+			name:   "within the grace",
+			marker: refreshedMarker{RetainUntil: now.AddDate(0, 0, 7).Add(12 * time.Hour), Mode: types.ObjectLockRetentionModeGovernance},
+		},
+		{
+			name:   "retention target increased",
+			marker: refreshedMarker{RetainUntil: now.AddDate(0, 0, 29), Mode: types.ObjectLockRetentionModeGovernance},
+			opts: func(opts *options) {
+				opts.minRetention, opts.maxRetention = retentionPeriod{days: 60}, retentionPeriod{days: 90}
+			},
+		},
+		{
+			name:   "compliance now required",
+			marker: refreshedMarker{RetainUntil: now.AddDate(0, 0, 29), Mode: types.ObjectLockRetentionModeGovernance},
+			opts:   func(opts *options) { opts.mode = types.ObjectLockRetentionModeCompliance },
+		},
+		{
+			name:   "-allow-reduce of a longer marker",
+			marker: refreshedMarker{RetainUntil: now.AddDate(1, 0, 0), Mode: types.ObjectLockRetentionModeGovernance},
+			opts:   func(opts *options) { opts.allowReduce, opts.bypassGovernance = true, true },
+		},
+		{
+			name:        "-allow-reduce of a compliance marker",
+			marker:      refreshedMarker{RetainUntil: now.AddDate(1, 0, 0), Mode: types.ObjectLockRetentionModeCompliance},
+			opts:        func(opts *options) { opts.allowReduce, opts.bypassGovernance = true, true },
+			wantSkipped: true,
+		},
+		{
+			name: "unreadable marker",
+			body: `{"retain_until":`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, client := markedBucket()
+			setMarker(t, bucket, "links/host1/b1/meta/manifest.json", tt.marker)
+			if tt.body != "" {
+				bucket.objects["links/host1/b1/meta/.retention-refreshed.json"] = tt.body
+			}
+			opts := testOptions()
+			opts.yes = true
+			if tt.opts != nil {
+				tt.opts(opts)
+			}
+			r := newRefresher(client, opts, now)
+			logged := captureLog("text", slog.LevelInfo, func() {
+				if err := r.run(context.Background()); err != nil {
+					t.Fatalf("run() error = %v", err)
+				}
+			})
+
+			skipped := bucket.getCalls == 0
+			if skipped != tt.wantSkipped {
+				t.Errorf("downloaded the manifest %d times, want the backup skipped: %v", bucket.getCalls, tt.wantSkipped)
+			}
+			if got := r.stats.summary(time.Now()).ManifestsUpToDate; (got == 1) != tt.wantSkipped {
+				t.Errorf("manifests_up_to_date = %d, want the backup skipped: %v", got, tt.wantSkipped)
+			}
+			if tt.wantSkipped && len(bucket.puts) != 0 {
+				t.Errorf("run() updated %v of a skipped backup", bucket.putKeys())
+			}
+			if tt.body != "" && !strings.Contains(logged, "Failed to read refreshed marker") {
+				t.Errorf("logged %q, want the unreadable marker reported", logged)
+			}
+		})
+	}
+}
+
+func TestRunReducesMarkedBackups(t *testing.T) {
+	now := time.Now()
+	overExtended := now.AddDate(1, 0, 0)
+	bucket, client := markedBucket()
+	bucket.retention["links/host1/data/ks/t/a.db"] = overExtended
+	setMarker(t, bucket, "links/host1/b1/meta/manifest.json", refreshedMarker{RetainUntil: overExtended, Mode: types.ObjectLockRetentionModeGovernance})
+	opts := testOptions()
+	opts.yes = true
+	opts.allowReduce, opts.bypassGovernance = true, true
+	r := newRefresher(client, opts, now)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	sum := r.stats.summary(time.Now())
+	if sum.ManifestsUpToDate != 0 || sum.Reduced != 1 {
+		t.Errorf("manifests_up_to_date = %d, reduced = %d, want the marked backup reduced", sum.ManifestsUpToDate, sum.Reduced)
+	}
+	if got := bucket.retention["links/host1/data/ks/t/a.db"]; !got.Equal(r.retainUntil) {
+		t.Errorf("retention = %v, want it reduced to %v", got, r.retainUntil)
+	}
+	var marker refreshedMarker
+	if err := json.Unmarshal([]byte(bucket.objects["links/host1/b1/meta/.retention-refreshed.json"]), &marker); err != nil || marker.RetainUntil.After(r.retainUntil) {
+		t.Errorf("marker = %+v, want it rewritten with the reduced date", marker)
+	}
+}
+
+func TestRunMetaSkipsMarker(t *testing.T) {
+	bucket, client := markedBucket()
+	setMarker(t, bucket, "links/host1/b1/meta/manifest.json", refreshedMarker{RetainUntil: time.Now().Add(time.Hour), Mode: types.ObjectLockRetentionModeGovernance})
+	opts := testOptions()
+	opts.excludeMeta = false
+	if err := newRefresher(client, opts, time.Now()).run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	for _, key := range bucket.putKeys() {
+		if isMarkerKey(key) {
+			t.Errorf("set the retention of the refreshed marker %s", key)
+		}
+	}
+	if len(bucket.puts) != 2 {
+		t.Errorf("run() updated %v, want the manifest and the data file", bucket.putKeys())
+	}
+}
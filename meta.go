@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// metaPrefix returns the [prefix][cluster]/[hostname]/[backup_name]/meta/ directory
+// holding a manifest and the rest of the backup's metadata (schema.cql,
+// tokenmap.json, ...). ok is false for forced manifest keys outside meta/.
+func metaPrefix(manifestKey string) (string, bool) {
+	dir, ok := strings.CutSuffix(manifestKey, manifestSuffix)
+	if !ok {
+		if dir, ok = strings.CutSuffix(manifestKey, gzipManifestSuffix); !ok {
+			return "", false
+		}
+	}
+	return dir + "/meta/", true
+}
+
+// refreshMeta refreshes every object in the meta/ directory of a backup,
+// including the manifest itself, which a restore needs as much as the data
+// files. It returns false when the directory couldn't be listed.
+func (r *refresher) refreshMeta(ctx context.Context, manifestKey string) bool {
+	prefix, ok := metaPrefix(manifestKey)
+	if !ok {
+		slog.Debug("Not refreshing meta files of a manifest outside meta/", "manifest", manifestKey)
+		return true
+	}
+	keys, err := listKeys(ctx, r.client, r.opts.bucket, prefix)
+	if err != nil {
+		slog.Error("Error listing backup meta files", append([]any{"manifest", manifestKey}, errorAttrs(err)...)...)
+		return false
+	}
+	for _, key := range keys {
+		if r.stopErr(ctx) != nil {
+			break
+		}
+		// The refreshed marker is rewritten by every run that changes it
+		if isMarkerKey(key) || r.excluded(manifestKey, key) {
+			continue
+		}
+		if !r.take() {
+			break
+		}
+		r.stats.metaObject()
+		r.refreshObject(ctx, manifestKey, key)
+	}
+	return true
+}
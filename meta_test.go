@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMetaPrefix(t *testing.T) {
+	tests := []struct {
+		manifestKey string
+		want        string
+		wantOK      bool
+	}{
+		{manifestKey: "links/host1/b1/meta/manifest.json", want: "links/host1/b1/meta/", wantOK: true},
+		{manifestKey: "backups/prod/links/host1/b1/meta/manifest.json", want: "backups/prod/links/host1/b1/meta/", wantOK: true},
+		{manifestKey: "links/host1/b1/meta/manifest.json.bak"},
+	}
+
+	for _, tt := range tests {
+		got, ok := metaPrefix(tt.manifestKey)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("metaPrefix(%q) = %q, %v, want %q, %v", tt.manifestKey, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestRunRefreshesMeta(t *testing.T) {
+	tests := []struct {
+		name        string
+		excludeMeta bool
+		wantUpdated []string
+		wantMeta    int
+	}{
+		{
+			name: "meta files refreshed",
+			wantUpdated: []string{
+				"links/host1/b1/meta/manifest.json",
+				"links/host1/b1/meta/schema.cql",
+				"links/host1/b1/meta/tokenmap.json",
+				"links/host1/data/ks/t/a.db",
+			},
+			wantMeta: 3,
+		},
+		{
+			name:        "exclude-meta",
+			excludeMeta: true,
+			wantUpdated: []string{"links/host1/data/ks/t/a.db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+			bucket.objects["links/host1/b1/meta/schema.cql"] = ""
+			bucket.objects["links/host1/b1/meta/tokenmap.json"] = ""
+			bucket.objects["links/host1/b2/meta/manifest.json"] = `[]`
+			bucket.objects["links/host1/b2/meta/schema.cql"] = ""
+			bucket.objects["links/host1/data/ks/t/a.db"] = ""
+
+			opts := testOptions()
+			opts.manifestKey = "links/host1/b1/meta/manifest.json"
+			opts.excludeMeta = tt.excludeMeta
+			r := newRefresher(bucket.client(), opts, time.Now())
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			got := bucket.putKeys()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantUpdated) {
+				t.Errorf("run() updated %v, want %v", got, tt.wantUpdated)
+			}
+			sum := r.stats.summary(time.Now())
+			if sum.MetaObjects != tt.wantMeta || sum.ObjectsReferenced != 1 {
+				t.Errorf("summary meta_objects = %d, objects_referenced = %d, want %d and 1", sum.MetaObjects, sum.ObjectsReferenced, tt.wantMeta)
+			}
+		})
+	}
+}
+
+func TestRunMetaListingError(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	client := bucket.client()
+	client.ListObjectsV2Func = nil
+
+	opts := testOptions()
+	opts.manifestKey = "links/host1/b1/meta/manifest.json"
+	opts.excludeMeta = false
+	r := newRefresher(client, opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if got := bucket.putKeys(); !reflect.DeepEqual(got, []string{"links/host1/data/ks/t/a.db"}) {
+		t.Errorf("run() updated %v, want the data file", got)
+	}
+	if sum := r.stats.summary(time.Now()); sum.ManifestsFailed != 1 {
+		t.Errorf("summary manifests_failed = %d, want the unlisted meta directory to fail the manifest", sum.ManifestsFailed)
+	}
+}
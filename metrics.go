@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics written to -metrics-textfile and pushed to -pushgateway-url at the
+// end of a run, in the Prometheus text exposition format. Their names and
+// labels are relied on by alerts and dashboards and must not change. Every
+// sample has a cluster label (-cluster); newest_backup_age_seconds also has
+// a host label. Counters count the one run they describe.
+const (
+	// metricObjectsUpdated counts objects whose retention or legal hold was
+	// changed; -dry-run changes nothing and reports 0
+	metricObjectsUpdated = "medusa_retention_refresher_objects_updated_total"
+	// metricObjectsFailed counts objects that couldn't be checked or changed
+	metricObjectsFailed = "medusa_retention_refresher_objects_failed_total"
+	// metricManifestsProcessed counts manifests whose objects were processed
+	metricManifestsProcessed = "medusa_retention_refresher_manifests_processed_total"
+	// metricRunDuration is how long the run took
+	metricRunDuration = "medusa_retention_refresher_run_duration_seconds"
+	// metricNewestBackupAge is the age of each host's newest backup, for
+	// hosts whose newest backup is dated
+	metricNewestBackupAge = "medusa_retention_refresher_newest_backup_age_seconds"
+	// metricLastRun is when the run ended, as a Unix timestamp
+	metricLastRun = "medusa_retention_refresher_last_run_timestamp_seconds"
+	// metricLastRunSuccess is 1 when the run succeeded, 0 when it failed
+	metricLastRunSuccess = "medusa_retention_refresher_last_run_success"
+)
+
+// metricsJob is the job label of the metrics pushed to -pushgateway-url
+const metricsJob = "medusa_retention_refresher"
+
+// pushTimeout bounds exporting the metrics to -pushgateway-url and
+// -cloudwatch-namespace, notifying -slack-webhook-url and each -webhook-url
+// attempt, which happen even after the run was interrupted
+const pushTimeout = 30 * time.Second
+
+// metricLabel is a label name and value of a sample
+type metricLabel struct {
+	name, value string
+}
+
+// metricSample is a value of a metric with its labels
+type metricSample struct {
+	labels []metricLabel
+	value  float64
+}
+
+// metric is a metric family: its name, help, type and samples
+type metric struct {
+	name    string
+	help    string
+	kind    string // counter or gauge
+	samples []metricSample
+}
+
+// runMetrics returns the metrics of a run described by sum, with the newest
+// backup of each host, that ran from start to end
+func runMetrics(cluster string, sum runSummary, hosts []hostFreshness, succeeded bool, start, end time.Time) []metric {
+	clusterLabels := []metricLabel{{"cluster", cluster}}
+	single := func(name, help, kind string, value float64) metric {
+		return metric{name: name, help: help, kind: kind, samples: []metricSample{{labels: clusterLabels, value: value}}}
+	}
+	success := 0.0
+	if succeeded {
+		success = 1
+	}
+
+	ages := metric{name: metricNewestBackupAge, help: "Age of the newest backup of each host.", kind: "gauge"}
+	for _, h := range hosts {
+		if h.Taken.IsZero() {
+			continue
+		}
+		ages.samples = append(ages.samples, metricSample{
+			labels: []metricLabel{{"cluster", cluster}, {"host", h.Host}},
+			value:  h.Age.Seconds(),
+		})
+	}
+
+	return []metric{
+		single(metricObjectsUpdated, "Objects whose retention or legal hold the run changed.", "counter", float64(sum.Updated+sum.Reduced)),
+		single(metricObjectsFailed, "Objects the run failed to check or change.", "counter", float64(sum.Errors)),
+		single(metricManifestsProcessed, "Manifests whose objects the run processed.", "counter", float64(sum.ManifestsProcessed)),
+		single(metricRunDuration, "Duration of the run.", "gauge", end.Sub(start).Seconds()),
+		ages,
+		single(metricLastRun, "Time the run ended.", "gauge", float64(end.Unix())),
+		single(metricLastRunSuccess, "Whether the run succeeded.", "gauge", success),
+	}
+}
+
+// writeMetrics writes metrics in the Prometheus text exposition format.
+// Metrics without samples are left out.
+func writeMetrics(w io.Writer, metrics []metric) error {
+	var b strings.Builder
+	for _, m := range metrics {
+		if len(m.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, s := range m.samples {
+			b.WriteString(m.name)
+			if len(s.labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range s.labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", l.name, escapeLabelValue(l.value))
+				}
+				b.WriteByte('}')
+			}
+			fmt.Fprintf(&b, " %s\n", strconv.FormatFloat(s.value, 'f', -1, 64))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// escapeLabelValue escapes a label value for the text exposition format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writeMetricsTextfile replaces path with body atomically, so node_exporter's
+// textfile collector never reads a partial file
+func writeMetricsTextfile(path string, body []byte) error {
+	dir := filepath.Dir(path)
+	// node_exporter only reads *.prom files, so the temporary file is ignored
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create metrics file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace metrics file: %w", err)
+	}
+	return nil
+}
+
+// pushMetrics replaces the metrics of the job and cluster grouping on the
+// Pushgateway at gatewayURL with body
+func pushMetrics(ctx context.Context, client *http.Client, gatewayURL, cluster string, body []byte) error {
+	target := strings.TrimSuffix(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(metricsJob) + "/cluster/" + url.PathEscape(cluster)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to push metrics: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// exportMetrics writes the run's metrics to -metrics-textfile, pushes them
+// to -pushgateway-url and publishes them to -cloudwatch-namespace, returning
+// runErr, or the export's error when the run succeeded. A failed export after
+// a failed run is only logged.
+func (r *refresher) exportMetrics(ctx context.Context, runErr error) error {
+	opts := r.opts
+	// Metrics are exported even when the run was interrupted
+	exportCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+	defer cancel()
+
+	var err error
+	if opts.metricsTextfile != "" || opts.pushgatewayURL != "" {
+		now := time.Now()
+		var buf bytes.Buffer
+		err = writeMetrics(&buf, runMetrics(opts.cluster, r.stats.summary(now), r.stats.freshness(), runErr == nil, r.stats.start, now))
+		if err == nil && opts.metricsTextfile != "" {
+			if err = writeMetricsTextfile(opts.metricsTextfile, buf.Bytes()); err == nil {
+				slog.Info("Wrote metrics", "file", opts.metricsTextfile)
+			}
+		}
+		if err == nil && opts.pushgatewayURL != "" {
+			if err = pushMetrics(exportCtx, http.DefaultClient, opts.pushgatewayURL, opts.cluster, buf.Bytes()); err == nil {
+				slog.Info("Pushed metrics", "url", opts.pushgatewayURL)
+			}
+		}
+	}
+	if err == nil && r.cloudwatch != nil {
+		if err = r.publishCloudWatch(exportCtx); err == nil {
+			slog.Info("Published CloudWatch metrics", "namespace", opts.cwNamespace)
+		}
+	}
+	if err == nil {
+		return runErr
+	}
+	if runErr != nil {
+		slog.Error("Failed to export metrics", errorAttrs(err)...)
+		return runErr
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(90 * time.Second)
+	sum := runSummary{Updated: 12, Reduced: 1, WouldUpdate: 5, Errors: 2, ManifestsProcessed: 3}
+	hosts := []hostFreshness{
+		{Host: "host1", Backup: "b2", Taken: start.Add(-time.Hour), Age: time.Hour},
+		{Host: "host2", Backup: "adhoc"},
+		{Host: "host3"},
+	}
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, runMetrics(`prod "a"`, sum, hosts, true, start, end)); err != nil {
+		t.Fatalf("writeMetrics() error = %v", err)
+	}
+	want := `# HELP medusa_retention_refresher_objects_updated_total Objects whose retention or legal hold the run changed.
+# TYPE medusa_retention_refresher_objects_updated_total counter
+medusa_retention_refresher_objects_updated_total{cluster="prod \"a\""} 13
+# HELP medusa_retention_refresher_objects_failed_total Objects the run failed to check or change.
+# TYPE medusa_retention_refresher_objects_failed_total counter
+medusa_retention_refresher_objects_failed_total{cluster="prod \"a\""} 2
+# HELP medusa_retention_refresher_manifests_processed_total Manifests whose objects the run processed.
+# TYPE medusa_retention_refresher_manifests_processed_total counter
+medusa_retention_refresher_manifests_processed_total{cluster="prod \"a\""} 3
+# HELP medusa_retention_refresher_run_duration_seconds Duration of the run.
+# TYPE medusa_retention_refresher_run_duration_seconds gauge
+medusa_retention_refresher_run_duration_seconds{cluster="prod \"a\""} 90
+# HELP medusa_retention_refresher_newest_backup_age_seconds Age of the newest backup of each host.
+# TYPE medusa_retention_refresher_newest_backup_age_seconds gauge
+medusa_retention_refresher_newest_backup_age_seconds{cluster="prod \"a\"",host="host1"} 3600
+# HELP medusa_retention_refresher_last_run_timestamp_seconds Time the run ended.
+# TYPE medusa_retention_refresher_last_run_timestamp_seconds gauge
+medusa_retention_refresher_last_run_timestamp_seconds{cluster="prod \"a\""} 1748736090
+# HELP medusa_retention_refresher_last_run_success Whether the run succeeded.
+# TYPE medusa_retention_refresher_last_run_success gauge
+medusa_retention_refresher_last_run_success{cluster="prod \"a\""} 1
+`
+	if buf.String() != want {
+		t.Errorf("writeMetrics() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteMetricsTextfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "refresher.prom")
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMetricsTextfile(path, []byte("new\n")); err != nil {
+		t.Fatalf("writeMetricsTextfile() error = %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != "new\n" {
+		t.Errorf("metrics file = %q, %v, want %q", got, err, "new\n")
+	}
+	// The temporary file is renamed over the target
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("metrics dir holds %d files, want 1", len(entries))
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	var method, path, contentType, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		method, path, contentType = req.Method, req.URL.Path, req.Header.Get("Content-Type")
+		b, _ := io.ReadAll(req.Body)
+		body = string(b)
+		if strings.Contains(path, "broken") {
+			http.Error(w, "pushed metrics are invalid", http.StatusBadRequest)
+		}
+	}))
+	defer gateway.Close()
+
+	if err := pushMetrics(context.Background(), gateway.Client(), gateway.URL+"/", "links", []byte("m 1\n")); err != nil {
+		t.Fatalf("pushMetrics() error = %v", err)
+	}
+	if method != http.MethodPut || path != "/metrics/job/medusa_retention_refresher/cluster/links" {
+		t.Errorf("pushed with %s %s, want PUT to the job and cluster grouping", method, path)
+	}
+	if !strings.HasPrefix(contentType, "text/plain") || body != "m 1\n" {
+		t.Errorf("pushed %q as %q", body, contentType)
+	}
+
+	err := pushMetrics(context.Background(), gateway.Client(), gateway.URL, "broken", []byte("m 1\n"))
+	if err == nil || !strings.Contains(err.Error(), "pushed metrics are invalid") {
+		t.Errorf("pushMetrics() error = %v, want the gateway's response", err)
+	}
+}
+
+func TestRunExportsMetrics(t *testing.T) {
+	var pushed string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		pushed = string(b)
+	}))
+	defer gateway.Close()
+
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/backup-1748649600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+
+	opts := testOptions()
+	opts.metricsTextfile = filepath.Join(t.TempDir(), "refresher.prom")
+	opts.pushgatewayURL = gateway.URL
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	written, err := os.ReadFile(opts.metricsTextfile)
+	if err != nil {
+		t.Fatalf("failed to read metrics file: %v", err)
+	}
+	if string(written) != pushed {
+		t.Errorf("pushed metrics differ from the textfile:\n%s\nvs\n%s", pushed, written)
+	}
+	for _, line := range []string{
+		`medusa_retention_refresher_objects_updated_total{cluster="links"} 2`,
+		`medusa_retention_refresher_manifests_processed_total{cluster="links"} 1`,
+		`medusa_retention_refresher_newest_backup_age_seconds{cluster="links",host="host1"} `,
+		`medusa_retention_refresher_last_run_success{cluster="links"} 1`,
+	} {
+		if !strings.Contains(string(written), line) {
+			t.Errorf("metrics missing %q:\n%s", line, written)
+		}
+	}
+}
+
+func TestExportMetricsErrors(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer gateway.Close()
+
+	opts := testOptions()
+	opts.pushgatewayURL = gateway.URL
+	r := newRefresher(newFakeBucket().client(), opts, time.Now())
+	if err := r.exportMetrics(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "failed to push metrics") {
+		t.Errorf("exportMetrics() error = %v, want the push failure", err)
+	}
+	// The run's own failure wins over the export's
+	runErr := errors.New("run failed")
+	if err := r.exportMetrics(context.Background(), runErr); err != runErr {
+		t.Errorf("exportMetrics() error = %v, want %v", err, runErr)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Metrics served on -metrics-listen while a run is in progress, besides
+// metricManifestsProcessed. Like the exported run metrics, their names and
+// labels must not change, and every sample has a cluster label.
+const (
+	// metricObjectsInFlight is the number of objects being processed
+	metricObjectsInFlight = "medusa_retention_refresher_objects_in_flight"
+	// metricObjectsProcessed counts processed objects by action: updated,
+	// would_update, skipped (already compliant), missing, error, ...
+	metricObjectsProcessed = "medusa_retention_refresher_objects_processed_total"
+	// metricErrors counts failed objects by error class: access_denied,
+	// not_found, throttled, canceled or other
+	metricErrors = "medusa_retention_refresher_errors_total"
+	// metricManifestsFailed counts manifests that couldn't be loaded
+	metricManifestsFailed = "medusa_retention_refresher_manifests_failed_total"
+	// metricCurrentManifest is 1 for the manifest being processed, in its
+	// manifest label, and absent between manifests
+	metricCurrentManifest = "medusa_retention_refresher_current_manifest"
+)
+
+// metricsShutdownTimeout bounds waiting for in-progress requests when the
+// -metrics-listen or -health-listen server stops
+const metricsShutdownTimeout = 5 * time.Second
+
+// liveStats is what -metrics-listen exposes of a run in progress
+type liveStats struct {
+	inFlight           int
+	currentManifest    string
+	actions            map[string]int
+	errorsByClass      map[string]int
+	manifestsProcessed int
+	manifestsFailed    int
+}
+
+// liveMetrics returns the metrics of a run in progress
+func liveMetrics(cluster string, live liveStats) []metric {
+	clusterLabels := []metricLabel{{"cluster", cluster}}
+	byLabel := func(name, help, label string, counts map[string]int) metric {
+		m := metric{name: name, help: help, kind: "counter"}
+		values := make([]string, 0, len(counts))
+		for value := range counts {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			m.samples = append(m.samples, metricSample{
+				labels: []metricLabel{{"cluster", cluster}, {label, value}},
+				value:  float64(counts[value]),
+			})
+		}
+		return m
+	}
+
+	current := metric{name: metricCurrentManifest, help: "Manifest being processed.", kind: "gauge"}
+	if live.currentManifest != "" {
+		current.samples = []metricSample{{labels: []metricLabel{{"cluster", cluster}, {"manifest", live.currentManifest}}, value: 1}}
+	}
+
+	return []metric{
+		{name: metricObjectsInFlight, help: "Objects being processed.", kind: "gauge", samples: []metricSample{{labels: clusterLabels, value: float64(live.inFlight)}}},
+		byLabel(metricObjectsProcessed, "Objects processed by action.", "action", live.actions),
+		byLabel(metricErrors, "Failed objects by error class.", "class", live.errorsByClass),
+		{name: metricManifestsProcessed, help: "Manifests whose objects the run processed.", kind: "counter", samples: []metricSample{{labels: clusterLabels, value: float64(live.manifestsProcessed)}}},
+		{name: metricManifestsFailed, help: "Manifests the run failed to load.", kind: "counter", samples: []metricSample{{labels: clusterLabels, value: float64(live.manifestsFailed)}}},
+		current,
+	}
+}
+
+// metricsHandler serves the live metrics of the run counted by stats
+func metricsHandler(cluster string, stats *runStats) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writeMetrics(w, liveMetrics(cluster, stats.live())); err != nil {
+			slog.Debug("Failed to serve metrics", "error", err.Error())
+		}
+	})
+	return mux
+}
+
+// serveMetrics serves the run's live metrics on -metrics-listen until ctx is
+// canceled or the returned function is called, which waits for the server
+// to stop
+func (r *refresher) serveMetrics(ctx context.Context) (func(), error) {
+	return serveHTTP(ctx, "metrics-listen", r.opts.metricsListen, metricsHandler(r.opts.cluster, r.stats))
+}
+
+// serveHTTP serves handler on address, the value of the -flag flag, until ctx
+// is canceled or the returned function is called, which waits for the server
+// to stop
+func serveHTTP(ctx context.Context, flag, address string, handler http.Handler) (func(), error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on -%s: %w", flag, err)
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	slog.Info("Serving -"+flag, "address", ln.Addr().String())
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server failed", "flag", flag, "error", err.Error())
+		}
+	}()
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestLiveMetrics(t *testing.T) {
+	live := liveStats{
+		inFlight:           1,
+		currentManifest:    "links/host1/b1/meta/manifest.json",
+		actions:            map[string]int{"updated": 3, "error": 1},
+		errorsByClass:      map[string]int{"throttled": 1},
+		manifestsProcessed: 2,
+	}
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, liveMetrics("links", live)); err != nil {
+		t.Fatalf("writeMetrics() error = %v", err)
+	}
+	want := `# HELP medusa_retention_refresher_objects_in_flight Objects being processed.
+# TYPE medusa_retention_refresher_objects_in_flight gauge
+medusa_retention_refresher_objects_in_flight{cluster="links"} 1
+# HELP medusa_retention_refresher_objects_processed_total Objects processed by action.
+# TYPE medusa_retention_refresher_objects_processed_total counter
+medusa_retention_refresher_objects_processed_total{cluster="links",action="error"} 1
+medusa_retention_refresher_objects_processed_total{cluster="links",action="updated"} 3
+# HELP medusa_retention_refresher_errors_total Failed objects by error class.
+# TYPE medusa_retention_refresher_errors_total counter
+medusa_retention_refresher_errors_total{cluster="links",class="throttled"} 1
+# HELP medusa_retention_refresher_manifests_processed_total Manifests whose objects the run processed.
+# TYPE medusa_retention_refresher_manifests_processed_total counter
+medusa_retention_refresher_manifests_processed_total{cluster="links"} 2
+# HELP medusa_retention_refresher_manifests_failed_total Manifests the run failed to load.
+# TYPE medusa_retention_refresher_manifests_failed_total counter
+medusa_retention_refresher_manifests_failed_total{cluster="links"} 0
+# HELP medusa_retention_refresher_current_manifest Manifest being processed.
+# TYPE medusa_retention_refresher_current_manifest gauge
+medusa_retention_refresher_current_manifest{cluster="links",manifest="links/host1/b1/meta/manifest.json"} 1
+`
+	if buf.String() != want {
+		t.Errorf("live metrics =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+// freeAddress returns a local address nothing listens on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// scrape fetches the /metrics page served at addr
+func scrape(addr string) (string, error) {
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestRunServesMetrics(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/backup-1748649600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/backup-1748563200/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/c.db"},{"path":"data/ks/t/gone.db"}]}]`
+	for _, name := range []string{"a", "b", "c"} {
+		bucket.objects["links/host1/data/ks/t/"+name+".db"] = ""
+	}
+
+	opts := testOptions()
+	opts.metricsListen = freeAddress(t)
+	client := bucket.client()
+	put := client.PutObjectRetentionFunc
+	// Scraped while the third object, the first of the older backup, is being updated
+	var midRun string
+	client.PutObjectRetentionFunc = func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+		if len(bucket.puts) == 2 {
+			body, err := scrape(opts.metricsListen)
+			if err != nil {
+				t.Errorf("failed to scrape metrics mid-run: %v", err)
+			}
+			midRun = body
+		}
+		return put(ctx, params, optFns...)
+	}
+
+	r := newRefresher(client, opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	for _, line := range []string{
+		`medusa_retention_refresher_objects_in_flight{cluster="links"} 1`,
+		`medusa_retention_refresher_objects_processed_total{cluster="links",action="updated"} 2`,
+		`medusa_retention_refresher_manifests_processed_total{cluster="links"} 1`,
+		`medusa_retention_refresher_current_manifest{cluster="links",manifest="links/host1/backup-1748563200/meta/manifest.json"} 1`,
+	} {
+		if !strings.Contains(midRun, line) {
+			t.Errorf("mid-run metrics missing %q:\n%s", line, midRun)
+		}
+	}
+	if strings.Contains(midRun, "errors_total{") {
+		t.Errorf("mid-run metrics count errors before any:\n%s", midRun)
+	}
+
+	// The missing object is counted once processed, as scraped from the handler
+	rec := httptest.NewRecorder()
+	metricsHandler("links", r.stats).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `action="missing"} 1`) || !strings.Contains(body, `objects_in_flight{cluster="links"} 0`) {
+		t.Errorf("final metrics =\n%s", body)
+	}
+	if _, err := scrape(opts.metricsListen); err == nil {
+		t.Error("metrics still served after the run")
+	}
+}
+
+func TestServeMetricsStopsWithContext(t *testing.T) {
+	opts := testOptions()
+	opts.metricsListen = freeAddress(t)
+	r := newRefresher(newFakeBucket().client(), opts, time.Now())
+	ctx, cancel := context.WithCancel(context.Background())
+	stop, err := r.serveMetrics(ctx)
+	if err != nil {
+		t.Fatalf("serveMetrics() error = %v", err)
+	}
+	if _, err := scrape(opts.metricsListen); err != nil {
+		t.Fatalf("failed to scrape metrics: %v", err)
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := scrape(opts.metricsListen); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("metrics still served after the context was canceled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	// A busy address fails the run up front
+	stop, err = r.serveMetrics(context.Background())
+	if err != nil {
+		t.Fatalf("serveMetrics() error = %v", err)
+	}
+	defer stop()
+	if _, err := r.serveMetrics(context.Background()); err == nil {
+		t.Error("serveMetrics() on a busy address succeeded")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// orphanRecord is the -orphan-report entry of a data file no backup references
+type orphanRecord struct {
+	Key          string    `json:"key"`
+	Host         string    `json:"host"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// groupByHost groups manifests by the hostname path their data files live
+// under, returning the hostname paths in order. Manifests whose key has no
+// hostname are left out.
+func groupByHost(manifests []ManifestInfo) (map[string][]ManifestInfo, []string) {
+	groups := make(map[string][]ManifestInfo)
+	for _, m := range manifests {
+		mp, err := m.path()
+		if err != nil {
+			continue
+		}
+		hostnamePath := mp.HostnamePath
+		groups[hostnamePath] = append(groups[hostnamePath], m)
+	}
+	hosts := make([]string, 0, len(groups))
+	for host := range groups {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return groups, hosts
+}
+
+// findOrphans lists the data/ directory of hostnamePath and returns the
+// objects that none of manifests references
+func (r *refresher) findOrphans(ctx context.Context, hostnamePath string, manifests []ManifestInfo) ([]orphanRecord, error) {
+	referenced := make(map[string]struct{})
+	for _, m := range manifests {
+		manifest, ok := r.loaded[m.Key]
+		if !ok {
+			var err error
+			if manifest, err = r.fetchManifest(ctx, m.Key); err != nil {
+				return nil, fmt.Errorf("failed to download manifest %s: %w", m.Key, err)
+			}
+		}
+		for _, obj := range manifest.Objects {
+			referenced[resolveObjectKey(hostnamePath, obj.Path)] = struct{}{}
+		}
+	}
+
+	host := path.Base(strings.TrimSuffix(hostnamePath, "/"))
+	var orphans []orphanRecord
+	err := listObjects(ctx, r.client, r.opts.bucket, hostnamePath+"data/", func(obj types.Object) {
+		key := aws.ToString(obj.Key)
+		if _, ok := referenced[key]; ok {
+			return
+		}
+		orphans = append(orphans, orphanRecord{
+			Key:          key,
+			Host:         host,
+			Size:         aws.ToInt64(obj.Size),
+			LastModified: aws.ToTime(obj.LastModified).UTC(),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// reportOrphans writes the -orphan-report: one JSON line per data file that no
+// backup of its host references. Every discovered backup counts, not only the
+// selected ones. A host with a manifest that can't be read is skipped, since
+// the files only that backup references would be reported as orphans.
+// Nothing is changed on the orphans.
+func (r *refresher) reportOrphans(ctx context.Context, manifests []ManifestInfo) error {
+	f, err := os.Create(r.opts.orphanReport)
+	if err != nil {
+		return fmt.Errorf("failed to create orphan report: %w", err)
+	}
+	enc := json.NewEncoder(f)
+
+	groups, hosts := groupByHost(manifests)
+	total, totalBytes := 0, int64(0)
+	for _, hostnamePath := range hosts {
+		if ctx.Err() != nil {
+			break
+		}
+		orphans, err := r.findOrphans(ctx, hostnamePath, groups[hostnamePath])
+		if err != nil {
+			slog.Error("Skipping orphan detection for host", append([]any{"host", hostnamePath}, errorAttrs(err)...)...)
+			continue
+		}
+		var bytes int64
+		for _, o := range orphans {
+			if err := enc.Encode(o); err != nil {
+				f.Close()
+				return fmt.Errorf("failed to write orphan report: %w", err)
+			}
+			bytes += o.Size
+		}
+		if len(orphans) > 0 {
+			slog.Warn("Found data files no backup references", "host", hostnamePath, "objects", len(orphans), "bytes", bytes)
+		}
+		r.stats.addOrphans(len(orphans), bytes)
+		total += len(orphans)
+		totalBytes += bytes
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close orphan report: %w", err)
+	}
+	slog.Info("Wrote orphan report", "path", r.opts.orphanReport, "hosts", len(hosts), "objects", total, "bytes", totalBytes)
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// readOrphanReport decodes the records of an -orphan-report file, ordered by key
+func readOrphanReport(t *testing.T, path string) []orphanRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open orphan report: %v", err)
+	}
+	defer f.Close()
+	var records []orphanRecord
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var rec orphanRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("failed to decode orphan report: %v", err)
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+func TestRunOrphanReport(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	bucket := newFakeBucket()
+	// host1's older backup is not selected by -latest-only, but still references b.db
+	bucket.objects["links/host1/medusa-backup-schedule-1700000000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/medusa-backup-schedule-1764858600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/c.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	bucket.objects["links/host1/data/ks/t/c.db"] = ""
+	bucket.objects["links/host1/data/ks/t/purged.db"] = "12345"
+	bucket.objects["links/host1/data/ks/t/failed-upload.db"] = "123"
+	bucket.modified["links/host1/data/ks/t/purged.db"] = modified
+	bucket.objects["links/host2/medusa-backup-schedule-1764858600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/d.db"}]}]`
+	bucket.objects["links/host2/data/ks/t/d.db"] = ""
+	bucket.objects["links/host2/data/ks/t/old.db"] = "1"
+	// host3's manifest can't be read, so none of its files can be called orphans
+	bucket.objects["links/host3/medusa-backup-schedule-1764858600/meta/manifest.json"] = `not json`
+	bucket.objects["links/host3/data/ks/t/e.db"] = ""
+
+	opts := testOptions()
+	opts.dryRun = true
+	opts.latestOnly = true
+	opts.orphanReport = filepath.Join(t.TempDir(), "orphans.json")
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	want := []orphanRecord{
+		{Key: "links/host1/data/ks/t/failed-upload.db", Host: "host1", Size: 3},
+		{Key: "links/host1/data/ks/t/purged.db", Host: "host1", Size: 5, LastModified: modified},
+		{Key: "links/host2/data/ks/t/old.db", Host: "host2", Size: 1},
+	}
+	if got := readOrphanReport(t, opts.orphanReport); !reflect.DeepEqual(got, want) {
+		t.Errorf("orphan report = %+v, want %+v", got, want)
+	}
+	sum := r.stats.summary(time.Now())
+	if sum.OrphanedObjects != 3 || sum.OrphanedBytes != 9 {
+		t.Errorf("summary orphaned_objects = %d, orphaned_bytes = %d, want 3 and 9", sum.OrphanedObjects, sum.OrphanedBytes)
+	}
+	if len(bucket.puts) != 0 {
+		t.Errorf("run() changed retention of %v", bucket.putKeys())
+	}
+}
+
+func TestGroupByHost(t *testing.T) {
+	manifests := []ManifestInfo{
+		{Key: "links/host2/b1/meta/manifest.json"},
+		{Key: "links/host1/b1/meta/manifest.json"},
+		{Key: "links/host1/b2/meta/manifest.json"},
+		{Key: "backups/links/host1/b1/meta/manifest.json", Prefix: "backups/"},
+		{Key: "invalid"},
+	}
+
+	groups, hosts := groupByHost(manifests)
+	wantHosts := []string{"backups/links/host1/", "links/host1/", "links/host2/"}
+	if !reflect.DeepEqual(hosts, wantHosts) {
+		t.Errorf("groupByHost() hosts = %v, want %v", hosts, wantHosts)
+	}
+	if got := manifestKeys(groups["links/host1/"]); !reflect.DeepEqual(got, []string{"links/host1/b1/meta/manifest.json", "links/host1/b2/meta/manifest.json"}) {
+		t.Errorf("groupByHost() links/host1/ = %v", got)
+	}
+}
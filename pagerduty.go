@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// -page-on failure classes
+const (
+	pageFatal          = "fatal"           // the run failed
+	pageThreshold      = "threshold"       // more objects failed than -page-error-threshold
+	pageMissingObjects = "missing-objects" // objects referenced by a manifest are missing
+)
+
+// pagerDutyMaxSummary is the longest incident summary PagerDuty accepts
+const pagerDutyMaxSummary = 1024
+
+// pagerDutyEvent is a PagerDuty Events API v2 event
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"` // trigger or resolve
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// pagerDutyPayload describes the incident of a trigger event
+type pagerDutyPayload struct {
+	Summary       string         `json:"summary"`
+	Source        string         `json:"source"`
+	Severity      string         `json:"severity"`
+	Component     string         `json:"component"`
+	Group         string         `json:"group"`
+	Class         string         `json:"class"`
+	CustomDetails map[string]any `json:"custom_details"`
+}
+
+// pagerDutyState is the -pagerduty-state-file record of an open incident
+type pagerDutyState struct {
+	DedupKey    string    `json:"dedup_key"`
+	TriggeredAt time.Time `json:"triggered_at"`
+	Reasons     []string  `json:"reasons"`
+}
+
+// pagerDutyDedupKey returns the dedup key of the incidents of cluster in
+// bucket, so every failing run updates the same incident
+func pagerDutyDedupKey(bucket, cluster string) string {
+	return "medusa-retention-refresher/" + bucket + "/" + cluster
+}
+
+// validatePageOn checks the -page-on failure classes
+func validatePageOn(classes []string) error {
+	for _, class := range classes {
+		switch class {
+		case pageFatal, pageThreshold, pageMissingObjects:
+		default:
+			return fmt.Errorf("invalid -page-on class %q: expected fatal, threshold or missing-objects", class)
+		}
+	}
+	return nil
+}
+
+// pageReasons returns why the run described by sum, which failed with runErr
+// when not nil, should page, for the -page-on classes
+func (opts *options) pageReasons(sum runSummary, runErr error) []string {
+	var reasons []string
+	for _, class := range opts.pageOn {
+		switch {
+		case class == pageFatal && runErr != nil:
+			reasons = append(reasons, "run failed: "+runErr.Error())
+		case class == pageThreshold && sum.Errors > opts.pageErrorThreshold:
+			reasons = append(reasons, fmt.Sprintf("%d objects failed, above -page-error-threshold %d", sum.Errors, opts.pageErrorThreshold))
+		case class == pageMissingObjects && sum.Missing > 0:
+			reasons = append(reasons, fmt.Sprintf("%d objects referenced by manifests are missing", sum.Missing))
+		}
+	}
+	return reasons
+}
+
+// sendPagerDuty sends ev to the Events API
+func sendPagerDuty(ctx context.Context, client *http.Client, ev pagerDutyEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("failed to encode PagerDuty event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pagerDutyEventsURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send PagerDuty event: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send PagerDuty event: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to send PagerDuty event: %s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// readPagerDutyState reads the open incident recorded in path, nil when none
+func readPagerDutyState(path string) (*pagerDutyState, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PagerDuty state: %w", err)
+	}
+	var state pagerDutyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse PagerDuty state %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// writePagerDutyState records the open incident in path
+func writePagerDutyState(path string, state pagerDutyState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode PagerDuty state: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write PagerDuty state: %w", err)
+	}
+	return nil
+}
+
+// notifyPagerDuty triggers a PagerDuty incident when the run failed in a way
+// -page-on pages for, and resolves the incident recorded in
+// -pagerduty-state-file when it didn't. PagerDuty failures are logged, they
+// don't change the run's outcome.
+func (r *refresher) notifyPagerDuty(ctx context.Context, runErr error) {
+	opts := r.opts
+	if opts.pagerDutyKey == "" {
+		return
+	}
+	// The page is sent even when the run was interrupted
+	pageCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+	defer cancel()
+	if err := r.page(pageCtx, runErr, time.Now()); err != nil {
+		slog.Error("Failed to notify PagerDuty", errorAttrs(err)...)
+	}
+}
+
+// page sends the trigger or resolve event of the run as of now
+func (r *refresher) page(ctx context.Context, runErr error, now time.Time) error {
+	opts := r.opts
+	dedupKey := pagerDutyDedupKey(opts.bucket, opts.cluster)
+	sum := r.stats.summary(now)
+	reasons := opts.pageReasons(sum, runErr)
+
+	if len(reasons) == 0 {
+		if opts.pagerDutyState == "" {
+			return nil
+		}
+		state, err := readPagerDutyState(opts.pagerDutyState)
+		if err != nil || state == nil {
+			return err
+		}
+		ev := pagerDutyEvent{RoutingKey: opts.pagerDutyKey, EventAction: "resolve", DedupKey: state.DedupKey}
+		if err := sendPagerDuty(ctx, http.DefaultClient, ev); err != nil {
+			return err
+		}
+		slog.Info("Resolved PagerDuty incident", "dedup_key", state.DedupKey)
+		if err := os.Remove(opts.pagerDutyState); err != nil {
+			return fmt.Errorf("failed to remove PagerDuty state: %w", err)
+		}
+		return nil
+	}
+
+	summary := []rune(fmt.Sprintf("Medusa retention refresh of %s in s3://%s: %s", opts.cluster, opts.bucket, reasons[0]))
+	if len(summary) > pagerDutyMaxSummary {
+		summary = append(summary[:pagerDutyMaxSummary-1], '…')
+	}
+	source, _ := os.Hostname()
+	if source == "" {
+		source = "medusa-retention-refresher"
+	}
+	ev := pagerDutyEvent{
+		RoutingKey:  opts.pagerDutyKey,
+		EventAction: "trigger",
+		DedupKey:    dedupKey,
+		Payload: &pagerDutyPayload{
+			Summary:   string(summary),
+			Source:    source,
+			Severity:  "critical",
+			Component: "medusa-retention-refresher",
+			Group:     opts.cluster,
+			Class:     "retention-refresh",
+			CustomDetails: map[string]any{
+				"reasons": reasons,
+				"summary": sum,
+			},
+		},
+	}
+	if err := sendPagerDuty(ctx, http.DefaultClient, ev); err != nil {
+		return err
+	}
+	slog.Warn("Triggered PagerDuty incident", "dedup_key", dedupKey, "reasons", reasons)
+	if opts.pagerDutyState == "" {
+		return nil
+	}
+	return writePagerDutyState(opts.pagerDutyState, pagerDutyState{DedupKey: dedupKey, TriggeredAt: now.UTC(), Reasons: reasons})
+}
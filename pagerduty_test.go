@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockPagerDuty is an Events API endpoint recording the events sent to it
+type mockPagerDuty struct {
+	mu     sync.Mutex
+	events []pagerDutyEvent
+	status int
+}
+
+// newMockPagerDuty serves the Events API for the test
+func newMockPagerDuty(t *testing.T) *mockPagerDuty {
+	m := &mockPagerDuty{status: http.StatusAccepted}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var ev pagerDutyEvent
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Errorf("invalid PagerDuty event %s: %v", body, err)
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.events = append(m.events, ev)
+		w.WriteHeader(m.status)
+		io.WriteString(w, `{"status":"success","message":"Event processed"}`)
+	}))
+	url := pagerDutyEventsURL
+	pagerDutyEventsURL = srv.URL + "/v2/enqueue"
+	t.Cleanup(func() {
+		srv.Close()
+		pagerDutyEventsURL = url
+	})
+	return m
+}
+
+// take returns the events received since the last call
+func (m *mockPagerDuty) take() []pagerDutyEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := m.events
+	m.events = nil
+	return events
+}
+
+func TestPageReasons(t *testing.T) {
+	tests := []struct {
+		name      string
+		pageOn    []string
+		threshold int
+		sum       runSummary
+		runErr    error
+		want      []string
+	}{
+		{name: "success", pageOn: []string{pageFatal, pageThreshold, pageMissingObjects}},
+		{name: "fatal", pageOn: []string{pageFatal}, runErr: errors.New("failed to list manifests"), want: []string{"run failed: failed to list manifests"}},
+		{name: "fatal not paged", pageOn: []string{pageMissingObjects}, runErr: errors.New("failed to list manifests")},
+		{name: "threshold", pageOn: []string{pageThreshold}, threshold: 10, sum: runSummary{Errors: 11}, want: []string{"11 objects failed, above -page-error-threshold 10"}},
+		{name: "below threshold", pageOn: []string{pageThreshold}, threshold: 10, sum: runSummary{Errors: 10}},
+		{name: "missing objects", pageOn: []string{pageFatal, pageMissingObjects}, sum: runSummary{Missing: 2}, want: []string{"2 objects referenced by manifests are missing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.pageOn, opts.pageErrorThreshold = tt.pageOn, tt.threshold
+			if got := opts.pageReasons(tt.sum, tt.runErr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pageReasons() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunPagesAndResolves(t *testing.T) {
+	pd := newMockPagerDuty(t)
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	state := filepath.Join(t.TempDir(), "pagerduty.json")
+	runOnce := func(fail bool) error {
+		opts := testOptions()
+		opts.pagerDutyKey = "R0UT1NGK3Y"
+		opts.pagerDutyState = state
+		opts.pageOn = stringList{pageFatal}
+		if fail {
+			// A pin matching no backup fails the run
+			bucket.objects["ops/pins.txt"] = "links/host9/backup1\n"
+			opts.pinsFile = "s3://test-bucket/ops/pins.txt"
+		}
+		return newRefresher(bucket.client(), opts, time.Now()).run(context.Background())
+	}
+	wantDedupKey := "medusa-retention-refresher/test-bucket/links"
+
+	// A failed run triggers an incident and records it
+	if err := runOnce(true); err == nil {
+		t.Fatal("run() succeeded, want the unmatched pin failure")
+	}
+	events := pd.take()
+	if len(events) != 1 {
+		t.Fatalf("sent %d events, want a trigger", len(events))
+	}
+	ev := events[0]
+	if ev.EventAction != "trigger" || ev.RoutingKey != "R0UT1NGK3Y" || ev.DedupKey != wantDedupKey {
+		t.Errorf("event = %s to %s with dedup key %s", ev.EventAction, ev.RoutingKey, ev.DedupKey)
+	}
+	if ev.Payload == nil || ev.Payload.Severity != "critical" || ev.Payload.Source == "" || !strings.Contains(ev.Payload.Summary, "links/host9/backup1") {
+		t.Fatalf("trigger payload = %+v", ev.Payload)
+	}
+	if _, ok := ev.Payload.CustomDetails["summary"]; !ok {
+		t.Errorf("trigger has no run summary: %v", ev.Payload.CustomDetails)
+	}
+	recorded, err := readPagerDutyState(state)
+	if err != nil || recorded == nil || recorded.DedupKey != wantDedupKey {
+		t.Fatalf("state = %+v, %v, want the open incident", recorded, err)
+	}
+
+	// Failing again updates the same incident
+	runOnce(true)
+	if events := pd.take(); len(events) != 1 || events[0].DedupKey != wantDedupKey {
+		t.Errorf("second failure sent %+v, want a trigger of the same incident", events)
+	}
+
+	// The next successful run resolves it
+	delete(bucket.objects, "ops/pins.txt")
+	if err := runOnce(false); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	events = pd.take()
+	if len(events) != 1 || events[0].EventAction != "resolve" || events[0].DedupKey != wantDedupKey || events[0].Payload != nil {
+		t.Fatalf("sent %+v, want a resolve of the incident", events)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Errorf("state file still exists after the resolve: %v", err)
+	}
+
+	// Without an open incident, success sends nothing
+	runOnce(false)
+	if events := pd.take(); len(events) != 0 {
+		t.Errorf("sent %+v without an open incident", events)
+	}
+}
+
+func TestRunPagesMissingObjects(t *testing.T) {
+	pd := newMockPagerDuty(t)
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/gone.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+
+	opts := testOptions()
+	opts.pagerDutyKey = "R0UT1NGK3Y"
+	opts.pageOn = stringList{pageMissingObjects}
+	if err := newRefresher(bucket.client(), opts, time.Now()).run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	events := pd.take()
+	if len(events) != 1 || events[0].EventAction != "trigger" || !strings.Contains(events[0].Payload.Summary, "1 objects referenced by manifests are missing") {
+		t.Errorf("sent %+v, want a trigger for the missing object", events)
+	}
+}
+
+func TestPagerDutyFailureKeepsOutcome(t *testing.T) {
+	pd := newMockPagerDuty(t)
+	pd.status = http.StatusBadRequest
+	state := filepath.Join(t.TempDir(), "pagerduty.json")
+
+	opts := testOptions()
+	opts.pagerDutyKey = "R0UT1NGK3Y"
+	opts.pagerDutyState = state
+	opts.pageOn = stringList{pageFatal}
+	r := newRefresher(newFakeBucket().client(), opts, time.Now())
+	runErr := errors.New("failed to list manifests")
+	if err := r.page(context.Background(), runErr, time.Now()); err == nil || !strings.Contains(err.Error(), "400 Bad Request") {
+		t.Errorf("page() error = %v, want the rejected event", err)
+	}
+	// An incident PagerDuty didn't accept isn't recorded as open
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Errorf("state file written for a rejected trigger: %v", err)
+	}
+	// The run's outcome doesn't change
+	if err := r.run(context.Background()); err != nil {
+		t.Errorf("run() error = %v, want nil despite PagerDuty failing", err)
+	}
+}
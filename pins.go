@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// backupPin is a -pins-file entry: a backup that is always processed and,
+// when retainUntil is set, retained until at least that date
+type backupPin struct {
+	id          string    // [cluster]/[hostname]/[backup_name], or [backup_name] for every host
+	retainUntil time.Time // zero to apply the normal retention only
+	matched     int       // discovered backups the pin matched
+}
+
+// backupPins are the -pins-file entries, nil when not set
+type backupPins []*backupPin
+
+// parsePins reads a newline-delimited pin list: a backup identifier per line,
+// optionally followed by a retain-until date (RFC3339 or YYYY-MM-DD). Blank
+// lines and # comments are skipped.
+func parsePins(r io.Reader) (backupPins, error) {
+	lines, err := readKeyList(r)
+	if err != nil {
+		return nil, err
+	}
+	var pins backupPins
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid pin %q: expected a backup and an optional retain-until date", line)
+		}
+		pin := &backupPin{id: strings.Trim(fields[0], "/")}
+		if n := strings.Count(pin.id, "/"); pin.id == "" || (n != 0 && n != 2) {
+			return nil, fmt.Errorf("invalid pin %q: expected [cluster]/[hostname]/[backup_name] or [backup_name]", fields[0])
+		}
+		if len(fields) == 2 {
+			if pin.retainUntil, err = time.Parse(time.RFC3339, fields[1]); err != nil {
+				if pin.retainUntil, err = time.Parse(time.DateOnly, fields[1]); err != nil {
+					return nil, fmt.Errorf("invalid retain-until of pin %q: expected RFC3339 or YYYY-MM-DD", pin.id)
+				}
+			}
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// loadPins reads the -pins-file of opts, a local file or an s3:// URI. A pin
+// retain-until reaching beyond -retention-cap fails, like -retain-until.
+func loadPins(ctx context.Context, client S3API, opts *options, now time.Time) (backupPins, error) {
+	path := opts.pinsFile
+	var data []byte
+	var err error
+	if strings.HasPrefix(path, "s3://") {
+		bucket, key, err := parseS3URI(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err = downloadObject(ctx, client, bucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", path, err)
+		}
+	} else if data, err = os.ReadFile(path); err != nil {
+		return nil, err
+	}
+	pins, err := parsePins(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for _, pin := range pins {
+		if pin.retainUntil.IsZero() {
+			continue
+		}
+		if !pin.retainUntil.After(now) {
+			slog.Warn("Pin retain-until already passed, applying the normal retention", "pin", pin.id, "retain_until", pin.retainUntil.Format(time.RFC3339))
+			continue
+		}
+		if err := opts.checkRetainUntil(fmt.Sprintf("pin %q", pin.id), pin.retainUntil, now); err != nil {
+			return nil, err
+		}
+	}
+	return pins, nil
+}
+
+// matches reports whether the pin covers the backup at mp
+func (p *backupPin) matches(mp manifestPath) bool {
+	if !strings.Contains(p.id, "/") {
+		return p.id == mp.Backup
+	}
+	return p.id == mp.id()
+}
+
+// split separates the manifests of pinned backups from the others, counting
+// each pin's matches
+func (pins backupPins) split(manifests []ManifestInfo) (pinned, rest []ManifestInfo) {
+	for _, m := range manifests {
+		isPinned := false
+		if mp, err := m.path(); err == nil {
+			for _, pin := range pins {
+				if pin.matches(mp) {
+					pin.matched++
+					isPinned = true
+				}
+			}
+		}
+		if isPinned {
+			pinned = append(pinned, m)
+		} else {
+			rest = append(rest, m)
+		}
+	}
+	return pinned, rest
+}
+
+// pinned reports whether a pin covers the backup m
+func (pins backupPins) pinned(m ManifestInfo) bool {
+	mp, err := m.path()
+	if err != nil {
+		return false
+	}
+	for _, pin := range pins {
+		if pin.matches(mp) {
+			return true
+		}
+	}
+	return false
+}
+
+// retainUntil returns the latest retain-until the pins matching m require,
+// or the zero time
+func (pins backupPins) retainUntil(m ManifestInfo) time.Time {
+	var until time.Time
+	mp, err := m.path()
+	if err != nil {
+		return until
+	}
+	for _, pin := range pins {
+		if pin.matches(mp) && pin.retainUntil.After(until) {
+			until = pin.retainUntil
+		}
+	}
+	return until
+}
+
+// extendRetention reports whether any pin sets a retain-until
+func (pins backupPins) extendRetention() bool {
+	for _, pin := range pins {
+		if !pin.retainUntil.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// unmatched returns the pins that matched no discovered backup
+func (pins backupPins) unmatched() []string {
+	var ids []string
+	for _, pin := range pins {
+		if pin.matched == 0 {
+			ids = append(ids, pin.id)
+		}
+	}
+	return ids
+}
+
+// setAsidePinned removes the pinned backups from manifests so the selection
+// filters don't drop them, and reports the pins matching none
+func (r *refresher) setAsidePinned(manifests []ManifestInfo) (pinned, rest []ManifestInfo) {
+	pinned, rest = r.pins.split(manifests)
+	for _, m := range pinned {
+		slog.Info("Pinned backup, processing it regardless of selection filters", "manifest", m.Key)
+	}
+	unmatched := r.pins.unmatched()
+	for _, id := range unmatched {
+		slog.Error("Pin matches no discovered backup, it isn't protected", "pin", id)
+	}
+	r.stats.setPins(len(pinned), unmatched)
+	return pinned, rest
+}
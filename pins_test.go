@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePins(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    []backupPin
+		wantErr string
+	}{
+		{
+			name: "pins",
+			doc:  "# before the migration\nlinks/host1/backup-1\n\nbackup-2 2026-01-01\n/links/host2/backup-3/ 2026-01-01T12:00:00Z\n",
+			want: []backupPin{
+				{id: "links/host1/backup-1"},
+				{id: "backup-2", retainUntil: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+				{id: "links/host2/backup-3", retainUntil: time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:    "host without cluster",
+			doc:     "host1/backup-1\n",
+			wantErr: "invalid pin",
+		},
+		{
+			name:    "invalid date",
+			doc:     "backup-1 next-week\n",
+			wantErr: "retain-until",
+		},
+		{
+			name:    "extra field",
+			doc:     "backup-1 2026-01-01 compliance\n",
+			wantErr: "invalid pin",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins, err := parsePins(strings.NewReader(tt.doc))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePins() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePins() error = %v", err)
+			}
+			var got []backupPin
+			for _, pin := range pins {
+				got = append(got, *pin)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePins() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitPinned(t *testing.T) {
+	manifests := []ManifestInfo{
+		{Key: "links/host1/backup-1/meta/manifest.json"},
+		{Key: "links/host2/backup-1/meta/manifest.json"},
+		{Key: "links/host1/backup-2/meta/manifest.json"},
+		{Key: "links/host2/backup-3/meta/manifest.json"},
+	}
+	pins := backupPins{
+		// A backup name pins it on every host
+		{id: "backup-1"},
+		{id: "links/host1/backup-2"},
+		// The host doesn't match
+		{id: "links/host1/backup-3"},
+		{id: "other/host1/backup-2"},
+	}
+
+	pinned, rest := pins.split(manifests)
+	if want := manifests[:3]; !reflect.DeepEqual(pinned, want) {
+		t.Errorf("pinned = %v, want %v", pinned, want)
+	}
+	if want := manifests[3:]; !reflect.DeepEqual(rest, want) {
+		t.Errorf("rest = %v, want %v", rest, want)
+	}
+	if got, want := pins.unmatched(), []string{"links/host1/backup-3", "other/host1/backup-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unmatched() = %v, want %v", got, want)
+	}
+}
+
+func TestRunPins(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	pinUntil := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	bucket := newFakeBucket()
+	// backup-1735689600 (2025-01-01) is past -max-retention and older than
+	// -since and -keep-last would keep, but it's pinned
+	bucket.objects["links/host1/backup-1735689600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/old.db"},{"path":"data/ks/t/shared.db"}]}]`
+	bucket.objects["links/host1/backup-1748649600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/new.db"},{"path":"data/ks/t/shared.db"}]}]`
+	bucket.objects["links/host1/backup-1748563200/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/skipped.db"}]}]`
+	for _, name := range []string{"old", "shared", "new", "skipped"} {
+		bucket.objects["links/host1/data/ks/t/"+name+".db"] = ""
+	}
+	bucket.objects["ops/pins.txt"] = "backup-1735689600 2026-01-01\n"
+
+	opts := testOptions()
+	opts.refreshExpired = false
+	opts.since = now.AddDate(0, 0, -7)
+	opts.keepLast = 1
+	opts.pinsFile = "s3://test-bucket/ops/pins.txt"
+	r := newRefresher(bucket.client(), opts, now)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	got := bucket.putKeys()
+	sort.Strings(got)
+	want := []string{
+		"links/host1/data/ks/t/new.db",
+		"links/host1/data/ks/t/old.db",
+		"links/host1/data/ks/t/shared.db",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("updated %v, want %v", got, want)
+	}
+	// The pin's requirement is higher than -max-retention, and covers the
+	// object the pinned backup shares
+	for _, key := range []string{"links/host1/data/ks/t/old.db", "links/host1/data/ks/t/shared.db"} {
+		if until := bucket.retention[key]; !until.Equal(pinUntil) {
+			t.Errorf("%s retained until %v, want the pin's %v", key, until, pinUntil)
+		}
+	}
+	if until := bucket.retention["links/host1/data/ks/t/new.db"]; !until.Equal(now.AddDate(0, 0, 30)) {
+		t.Errorf("new.db retained until %v, want -max-retention", until)
+	}
+	if sum := r.stats.summary(now); sum.BackupsPinned != 1 || len(sum.UnmatchedPins) != 0 {
+		t.Errorf("summary pinned %d, unmatched %v, want 1 and none", sum.BackupsPinned, sum.UnmatchedPins)
+	}
+}
+
+func TestRunUnmatchedPin(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/backup1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["ops/pins.txt"] = "links/host9/backup1\n"
+
+	opts := testOptions()
+	opts.pinsFile = "s3://test-bucket/ops/pins.txt"
+	r := newRefresher(bucket.client(), opts, time.Now())
+	err := r.run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "links/host9/backup1") {
+		t.Fatalf("run() error = %v, want it to name the unmatched pin", err)
+	}
+	// The other backups are still processed
+	if got := bucket.putKeys(); len(got) != 1 {
+		t.Errorf("updated %v, want a.db", got)
+	}
+	if sum := r.stats.summary(time.Now()); !reflect.DeepEqual(sum.UnmatchedPins, []string{"links/host9/backup1"}) {
+		t.Errorf("summary unmatched_pins = %v", sum.UnmatchedPins)
+	}
+}
+
+func TestRunPinBeyondRetentionCap(t *testing.T) {
+	tests := []struct {
+		name    string
+		ignore  bool
+		wantErr string
+	}{
+		{name: "capped", wantErr: `pin "backup1" sets retain-until 2206-01-01T00:00:00Z, beyond -retention-cap 10y`},
+		{name: "ignored", ignore: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/backup1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+			bucket.objects["links/host1/data/ks/t/a.db"] = ""
+			// A mistyped year
+			bucket.objects["ops/pins.txt"] = "backup1 2206-01-01\n"
+
+			opts := testOptions()
+			opts.pinsFile = "s3://test-bucket/ops/pins.txt"
+			opts.retentionCap, opts.ignoreRetentionCap = defaultRetentionCap, tt.ignore
+			err := newRefresher(bucket.client(), opts, time.Now()).run(context.Background())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("run() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("run() error = %v, want %q", err, tt.wantErr)
+			}
+			if len(bucket.puts) != 0 {
+				t.Errorf("updated %v, want nothing", bucket.putKeys())
+			}
+		})
+	}
+}
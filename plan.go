@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// planVersion is the version of the plan file format
+const planVersion = 1
+
+// plan is the list of retention changes written by the plan command and
+// executed by the apply command
+type plan struct {
+	Version   int          `json:"version"`
+	Bucket    string       `json:"bucket"`
+	Prefix    string       `json:"prefix,omitempty"`
+	Cluster   string       `json:"cluster"`
+	CreatedAt time.Time    `json:"created_at"`
+	Changes   []planChange `json:"changes"`
+
+	seen map[string]bool
+}
+
+// planChange is a single planned PutObjectRetention call
+type planChange struct {
+	Key                string                        `json:"key"`
+	CurrentRetainUntil *time.Time                    `json:"current_retain_until,omitempty"`
+	CurrentMode        types.ObjectLockRetentionMode `json:"current_mode,omitempty"`
+	RetainUntil        time.Time                     `json:"retain_until"`
+	Mode               types.ObjectLockRetentionMode `json:"mode"`
+	BypassGovernance   bool                          `json:"bypass_governance,omitempty"`
+}
+
+// newPlan creates an empty plan for the bucket, prefix and cluster in opts
+func newPlan(opts *options, now time.Time) *plan {
+	return &plan{
+		Version:   planVersion,
+		Bucket:    opts.bucket,
+		Prefix:    opts.prefix,
+		Cluster:   opts.cluster,
+		CreatedAt: now.UTC(),
+		Changes:   []planChange{},
+		seen:      make(map[string]bool),
+	}
+}
+
+// add records a change. Data files shared across backups are only planned once.
+func (p *plan) add(key string, current *ObjectRetention, retainUntil time.Time, mode types.ObjectLockRetentionMode, reduce bool) {
+	if p.seen[key] {
+		return
+	}
+	p.seen[key] = true
+	p.Changes = append(p.Changes, planChange{
+		Key:                key,
+		CurrentRetainUntil: current.RetainUntil,
+		CurrentMode:        current.Mode,
+		RetainUntil:        retainUntil.UTC(),
+		Mode:               mode,
+		BypassGovernance:   reduce,
+	})
+}
+
+// writePlan encodes p as indented JSON
+func writePlan(w io.Writer, p *plan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+// writePlanFile writes p to path, or to stdout when path is "-"
+func writePlanFile(path string, p *plan) error {
+	if path == "-" {
+		return writePlan(os.Stdout, p)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create plan file: %w", err)
+	}
+	if err := writePlan(f, p); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write plan file: %w", err)
+	}
+	return f.Close()
+}
+
+// readPlan decodes a plan written by writePlan
+func readPlan(r io.Reader) (*plan, error) {
+	var p plan
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("failed to parse plan: %w", err)
+	}
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("unsupported plan version %d", p.Version)
+	}
+	return &p, nil
+}
+
+// readPlanFile reads the plan stored at path
+func readPlanFile(path string) (*plan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plan file: %w", err)
+	}
+	defer f.Close()
+	return readPlan(f)
+}
+
+// validate checks that p was made for the bucket, prefix and cluster in opts and isn't stale
+func (p *plan) validate(opts *options, now time.Time) error {
+	if p.Bucket != opts.bucket || p.Cluster != opts.cluster {
+		return fmt.Errorf("plan was made for bucket %q cluster %q, not bucket %q cluster %q", p.Bucket, p.Cluster, opts.bucket, opts.cluster)
+	}
+	if p.Prefix != opts.prefix {
+		return fmt.Errorf("plan was made for prefix %q, not %q", p.Prefix, opts.prefix)
+	}
+	if age := now.Sub(p.CreatedAt); age > opts.maxPlanAge {
+		return fmt.Errorf("plan is %s old, older than -max-plan-age %s", age.Round(time.Second), opts.maxPlanAge)
+	}
+	return nil
+}
+
+// hasCompliance reports whether the plan sets any COMPLIANCE retention
+func (p *plan) hasCompliance() bool {
+	for _, c := range p.Changes {
+		if c.Mode == types.ObjectLockRetentionModeCompliance {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPlan executes exactly the changes listed in p without re-checking
+// the current retention of the objects
+func (r *refresher) applyPlan(ctx context.Context, p *plan) error {
+	defer r.finish()
+	r.stats.setTotalObjects(len(p.Changes))
+	r.startProgress()
+
+	for _, c := range p.Changes {
+		if r.reportErr != nil {
+			return r.reportErr
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("apply interrupted: %w", ctx.Err())
+		}
+		r.stats.objectReferenced(c.Key)
+		r.recordResult("", c.Key, r.applyChange(ctx, p.Bucket, c))
+	}
+	return r.reportErr
+}
+
+// applyChange issues the PutObjectRetention call of a planned change
+func (r *refresher) applyChange(ctx context.Context, bucket string, c planChange) objectResult {
+	current := &ObjectRetention{RetainUntil: c.CurrentRetainUntil, Mode: c.CurrentMode}
+	change := retentionChangeAttrs(current, c.RetainUntil, c.Mode)
+	res := objectResult{previous: current, retainUntil: c.RetainUntil, mode: c.Mode}
+
+	if r.opts.dryRun {
+		res.action = actionWouldUpdate
+		if c.BypassGovernance {
+			res.action = actionWouldReduce
+		}
+		logObject(slog.LevelInfo, "[DRY-RUN] Would apply retention", "", c.Key, res.action, change...)
+		return res
+	}
+
+	if res.err = r.recordRollback(c.Key, current, c.RetainUntil, c.Mode); res.err != nil {
+		return objectError("Error recording previous retention", "", c.Key, res, change...)
+	}
+	if res.err = updateRetention(ctx, r.client, bucket, c.Key, c.RetainUntil, c.Mode, c.BypassGovernance); res.err != nil {
+		if errorClass(res.err) == errorClassNotFound {
+			return objectMissing("", c.Key)
+		}
+		return objectError("Error updating retention", "", c.Key, res, change...)
+	}
+
+	res.action = actionUpdated
+	if c.BypassGovernance {
+		res.action = actionReduced
+	}
+	logObject(slog.LevelDebug, "Applied retention", "", c.Key, res.action, change...)
+	return res
+}
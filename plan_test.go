@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestPlanRoundTrip(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	behind := time.Date(2025, 6, 3, 0, 0, 0, 0, time.UTC)
+	target := time.Date(2025, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	p := newPlan(testOptions(), now)
+	p.add("links/host1/data/ks/t/a.db", &ObjectRetention{}, target, types.ObjectLockRetentionModeGovernance, false)
+	p.add("links/host1/data/ks/t/b.db", &ObjectRetention{RetainUntil: &behind, Mode: types.ObjectLockRetentionModeGovernance}, target, types.ObjectLockRetentionModeGovernance, false)
+	p.add("links/host1/data/ks/t/a.db", &ObjectRetention{}, target, types.ObjectLockRetentionModeGovernance, false)
+
+	var buf bytes.Buffer
+	if err := writePlan(&buf, p); err != nil {
+		t.Fatalf("writePlan() error = %v", err)
+	}
+	got, err := readPlan(&buf)
+	if err != nil {
+		t.Fatalf("readPlan() error = %v", err)
+	}
+
+	want := []planChange{
+		{Key: "links/host1/data/ks/t/a.db", RetainUntil: target, Mode: types.ObjectLockRetentionModeGovernance},
+		{Key: "links/host1/data/ks/t/b.db", CurrentRetainUntil: &behind, CurrentMode: types.ObjectLockRetentionModeGovernance, RetainUntil: target, Mode: types.ObjectLockRetentionModeGovernance},
+	}
+	if !reflect.DeepEqual(got.Changes, want) {
+		t.Errorf("readPlan() changes = %+v, want %+v", got.Changes, want)
+	}
+	if got.Bucket != "test-bucket" || got.Cluster != "links" || !got.CreatedAt.Equal(now) {
+		t.Errorf("readPlan() = bucket %q cluster %q created %v", got.Bucket, got.Cluster, got.CreatedAt)
+	}
+}
+
+func TestReadPlanRejectsUnknownVersion(t *testing.T) {
+	if _, err := readPlan(strings.NewReader(`{"version": 2}`)); err == nil {
+		t.Error("readPlan() accepted an unknown version")
+	}
+}
+
+func TestRefresherRecordsPlan(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/b2/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	bucket.retention["links/host1/data/ks/t/b.db"] = time.Now().AddDate(1, 0, 0)
+
+	opts := testOptions()
+	opts.dryRun = true
+	r := newRefresher(bucket.client(), opts, time.Now())
+	r.plan = newPlan(opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if len(bucket.puts) != 0 {
+		t.Errorf("planning made %d puts", len(bucket.puts))
+	}
+	if len(r.plan.Changes) != 1 || r.plan.Changes[0].Key != "links/host1/data/ks/t/a.db" {
+		t.Errorf("plan changes = %+v, want only links/host1/data/ks/t/a.db once", r.plan.Changes)
+	}
+}
+
+func TestApplyPlanIssuesPlannedPuts(t *testing.T) {
+	target := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := newPlan(testOptions(), time.Now())
+	p.add("links/host1/data/ks/t/a.db", &ObjectRetention{}, target, types.ObjectLockRetentionModeGovernance, false)
+	p.add("links/host1/data/ks/t/b.db", &ObjectRetention{}, target, types.ObjectLockRetentionModeCompliance, false)
+	p.add("links/host1/data/ks/t/c.db", &ObjectRetention{}, target, types.ObjectLockRetentionModeGovernance, true)
+
+	var puts []*s3.PutObjectRetentionInput
+	client := &MockS3Client{
+		// Apply must not re-check retention, so GetObjectRetention is left unimplemented
+		PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+			puts = append(puts, params)
+			return &s3.PutObjectRetentionOutput{}, nil
+		},
+	}
+
+	r := newRefresher(client, testOptions(), time.Now())
+	if err := r.applyPlan(context.Background(), p); err != nil {
+		t.Fatalf("applyPlan() error = %v", err)
+	}
+
+	if len(puts) != len(p.Changes) {
+		t.Fatalf("applyPlan() made %d puts, want %d", len(puts), len(p.Changes))
+	}
+	for i, c := range p.Changes {
+		put := puts[i]
+		if aws.ToString(put.Bucket) != "test-bucket" || aws.ToString(put.Key) != c.Key {
+			t.Errorf("put %d = %s/%s, want test-bucket/%s", i, aws.ToString(put.Bucket), aws.ToString(put.Key), c.Key)
+		}
+		if put.Retention.Mode != c.Mode || !aws.ToTime(put.Retention.RetainUntilDate).Equal(c.RetainUntil) {
+			t.Errorf("put %d retention = %s until %v, want %s until %v", i, put.Retention.Mode, aws.ToTime(put.Retention.RetainUntilDate), c.Mode, c.RetainUntil)
+		}
+		if aws.ToBool(put.BypassGovernanceRetention) != c.BypassGovernance {
+			t.Errorf("put %d BypassGovernanceRetention = %v, want %v", i, aws.ToBool(put.BypassGovernanceRetention), c.BypassGovernance)
+		}
+	}
+	if r.stats.actions[actionUpdated] != 2 || r.stats.actions[actionReduced] != 1 {
+		t.Errorf("counts = %v, want 2 updated and 1 reduced", r.stats.actions)
+	}
+}
+
+func TestApplyPlanErrors(t *testing.T) {
+	p := newPlan(testOptions(), time.Now())
+	p.add("links/host1/data/ks/t/a.db", &ObjectRetention{}, time.Now().AddDate(0, 1, 0), types.ObjectLockRetentionModeGovernance, false)
+
+	client := &MockS3Client{
+		PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+			return nil, errors.New("AccessDenied")
+		},
+	}
+	r := newRefresher(client, testOptions(), time.Now())
+	if err := r.applyPlan(context.Background(), p); err != nil {
+		t.Fatalf("applyPlan() error = %v", err)
+	}
+	if r.stats.actions[actionError] != 1 {
+		t.Errorf("counts = %v, want 1 error", r.stats.actions)
+	}
+}
+
+func TestPlanValidate(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		bucket  string
+		prefix  string
+		cluster string
+		age     time.Duration
+		wantErr string
+	}{
+		{name: "fresh plan", bucket: "test-bucket", cluster: "links", age: time.Hour},
+		{name: "other bucket", bucket: "other", cluster: "links", age: time.Hour, wantErr: "bucket"},
+		{name: "other cluster", bucket: "test-bucket", cluster: "other", age: time.Hour, wantErr: "cluster"},
+		{name: "other prefix", bucket: "test-bucket", prefix: "backups/", cluster: "links", age: time.Hour, wantErr: "prefix"},
+		{name: "stale plan", bucket: "test-bucket", cluster: "links", age: 25 * time.Hour, wantErr: "-max-plan-age"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPlan(testOptions(), now.Add(-tt.age))
+			opts := &options{commonOptions: commonOptions{bucket: tt.bucket, prefix: tt.prefix, cluster: tt.cluster}, maxPlanAge: 24 * time.Hour}
+			err := p.validate(opts, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validate() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clusterPolicy is the retention a -policy-s3-uri document sets for the
+// clusters matching its name or glob. Unset fields keep their flag values.
+type clusterPolicy struct {
+	MinRetention string `yaml:"min_retention"`
+	MaxRetention string `yaml:"max_retention"`
+	Mode         string `yaml:"mode"`
+	Anchor       string `yaml:"anchor"`
+
+	RetentionClasses []retentionClassPolicy `yaml:"retention_classes"`
+}
+
+// retentionClassPolicy is a retention_classes entry of a cluster policy: the
+// retention of the backups whose name matches the Backups glob, e.g. weekly
+// backups kept longer than daily ones. Unset fields keep the cluster's.
+type retentionClassPolicy struct {
+	Backups      string `yaml:"backups"`
+	MinRetention string `yaml:"min_retention"`
+	MaxRetention string `yaml:"max_retention"`
+}
+
+// retentionPolicy is a -policy-s3-uri document: a JSON or YAML mapping of
+// cluster names or globs to their retention
+type retentionPolicy struct {
+	Clusters map[string]clusterPolicy `yaml:"clusters"`
+}
+
+// parseS3URI splits an s3://bucket/key URI
+func parseS3URI(uri string) (string, string, error) {
+	rest, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("invalid S3 URI %q: must start with s3://", uri)
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return "", "", fmt.Errorf("invalid S3 URI %q: expected s3://bucket/key", uri)
+	}
+	return bucket, key, nil
+}
+
+// parsePolicy decodes and validates a policy document. JSON is accepted as
+// the subset of YAML it is; unknown fields are rejected to catch typos.
+func parsePolicy(data []byte) (*retentionPolicy, error) {
+	var p retentionPolicy
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// validate checks every cluster policy, so a mistake for one cluster fails
+// the runs of all of them rather than only when it matches
+func (p *retentionPolicy) validate() error {
+	if len(p.Clusters) == 0 {
+		return errors.New("policy has no clusters")
+	}
+	for pattern, cp := range p.Clusters {
+		if err := validateGlob(pattern); err != nil {
+			return fmt.Errorf("invalid policy cluster: %w", err)
+		}
+		var applied options
+		if err := cp.applyTo(&applied); err != nil {
+			return fmt.Errorf("invalid policy for cluster %q: %w", pattern, err)
+		}
+		if applied.hasRetention() {
+			if err := applied.validateRetention(); err != nil {
+				return fmt.Errorf("invalid policy for cluster %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// match returns the policy of cluster and the pattern it was found under. An
+// exact name wins over globs, and among globs the one with the most literal
+// characters, ties broken by pattern order.
+func (p *retentionPolicy) match(cluster string) (string, clusterPolicy, bool) {
+	if cp, ok := p.Clusters[cluster]; ok {
+		return cluster, cp, true
+	}
+	var matches []string
+	for pattern := range p.Clusters {
+		if ok, _ := path.Match(pattern, cluster); ok {
+			matches = append(matches, pattern)
+		}
+	}
+	if len(matches) == 0 {
+		return "", clusterPolicy{}, false
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if li, lj := globLiterals(matches[i]), globLiterals(matches[j]); li != lj {
+			return li > lj
+		}
+		return matches[i] < matches[j]
+	})
+	return matches[0], p.Clusters[matches[0]], true
+}
+
+// globLiterals counts the characters of pattern that aren't * or ? wildcards
+func globLiterals(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+// applyTo overrides the retention flags in opts with the fields the policy sets.
+// A max_retention replaces -retain-until.
+// Retention classes are checked in the order listed; the first matching a
+// backup's name applies to it.
+func (cp clusterPolicy) applyTo(opts *options) error {
+	var err error
+	if cp.MinRetention != "" {
+		if opts.minRetention, err = parseRetentionPeriod(cp.MinRetention); err != nil {
+			return fmt.Errorf("invalid min_retention: %w", err)
+		}
+	}
+	if cp.MaxRetention != "" {
+		if opts.maxRetention, err = parseRetentionPeriod(cp.MaxRetention); err != nil {
+			return fmt.Errorf("invalid max_retention: %w", err)
+		}
+		opts.retainUntil = time.Time{}
+	}
+	if cp.Mode != "" {
+		if opts.mode, err = parseRetentionMode(cp.Mode); err != nil {
+			return err
+		}
+	}
+	if cp.Anchor != "" {
+		if err := validateAnchor(cp.Anchor); err != nil {
+			return err
+		}
+		opts.anchor = cp.Anchor
+	}
+	if len(cp.RetentionClasses) > 0 {
+		opts.retentionClasses = nil
+		for _, rc := range cp.RetentionClasses {
+			class, err := parseRetentionClass(rc)
+			if err != nil {
+				return err
+			}
+			opts.retentionClasses = append(opts.retentionClasses, class)
+		}
+	}
+	return nil
+}
+
+// matchRetentionPolicy downloads the -policy-s3-uri document and returns the
+// policy matching -cluster and its pattern, ok false when none does
+func matchRetentionPolicy(ctx context.Context, client S3API, opts *options) (pattern string, cp clusterPolicy, ok bool, err error) {
+	bucket, key, err := parseS3URI(opts.policyURI)
+	if err != nil {
+		return "", clusterPolicy{}, false, err
+	}
+	data, err := downloadObject(ctx, client, bucket, key)
+	if err != nil {
+		return "", clusterPolicy{}, false, fmt.Errorf("failed to download policy %s: %w", opts.policyURI, err)
+	}
+	p, err := parsePolicy(data)
+	if err != nil {
+		return "", clusterPolicy{}, false, fmt.Errorf("invalid policy %s: %w", opts.policyURI, err)
+	}
+	pattern, cp, ok = p.match(opts.cluster)
+	return pattern, cp, ok, nil
+}
+
+// applyRetentionPolicy downloads the -policy-s3-uri document and applies the
+// policy matching -cluster to opts. Clusters without a policy fall back to the
+// retention flags, which must then be set.
+func applyRetentionPolicy(ctx context.Context, client S3API, opts *options) error {
+	pattern, cp, ok, err := matchRetentionPolicy(ctx, client, opts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if !opts.hasRetention() {
+			return fmt.Errorf("no policy in %s matches cluster %q and no -min-retention/-max-retention or -retain-until fallback is set", opts.policyURI, opts.cluster)
+		}
+		slog.Warn("No policy matches cluster, using the retention flags", "policy", opts.policyURI, "cluster", opts.cluster)
+		return nil
+	}
+
+	if err := cp.applyTo(opts); err != nil {
+		return fmt.Errorf("invalid policy for cluster %q: %w", pattern, err)
+	}
+	if !opts.hasRetention() {
+		return fmt.Errorf("policy for cluster %q sets no complete retention and no -min-retention/-max-retention fallback is set", pattern)
+	}
+	if err := opts.validateRetention(); err != nil {
+		return fmt.Errorf("policy for cluster %q: %w", pattern, err)
+	}
+	slog.Info("Applied retention policy", "policy", opts.policyURI, "cluster", opts.cluster, "matched", pattern,
+		"min_retention", opts.minRetention.String(), "max_retention", opts.maxRetention.String(), "mode", string(opts.mode), "anchor", opts.anchor)
+	return nil
+}
+
+// applyReleasePolicy applies the max_retention and retention classes of the
+// -policy-s3-uri policy matching -cluster to opts, which decide which backups
+// release and report consider expired. Clusters without a policy keep -max-retention.
+func applyReleasePolicy(ctx context.Context, client S3API, opts *options) error {
+	pattern, cp, ok, err := matchRetentionPolicy(ctx, client, opts)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		slog.Warn("No policy matches cluster, using -max-retention", "policy", opts.policyURI, "cluster", opts.cluster)
+		return nil
+	}
+	if err := cp.applyTo(opts); err != nil {
+		return fmt.Errorf("invalid policy for cluster %q: %w", pattern, err)
+	}
+	slog.Info("Applied retention policy", "policy", opts.policyURI, "cluster", opts.cluster, "matched", pattern,
+		"max_retention", opts.maxRetention.String(), "retention_classes", len(opts.retentionClasses))
+	return nil
+}
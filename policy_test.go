@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestParseS3URI(t *testing.T) {
+	tests := []struct {
+		uri        string
+		wantBucket string
+		wantKey    string
+		wantErr    bool
+	}{
+		{uri: "s3://ops/retention/policy.yaml", wantBucket: "ops", wantKey: "retention/policy.yaml"},
+		{uri: "s3://ops/policy.json", wantBucket: "ops", wantKey: "policy.json"},
+		{uri: "ops/policy.json", wantErr: true},
+		{uri: "s3://ops", wantErr: true},
+		{uri: "s3://ops/", wantErr: true},
+		{uri: "s3:///policy.json", wantErr: true},
+		{uri: "s3://ops/retention/", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		bucket, key, err := parseS3URI(tt.uri)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseS3URI(%q) error = %v, wantErr %v", tt.uri, err, tt.wantErr)
+			continue
+		}
+		if bucket != tt.wantBucket || key != tt.wantKey {
+			t.Errorf("parseS3URI(%q) = %q, %q, want %q, %q", tt.uri, bucket, key, tt.wantBucket, tt.wantKey)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{
+			name: "json",
+			doc:  `{"clusters": {"prod-*": {"min_retention": "7d", "max_retention": "30d", "mode": "compliance"}}}`,
+		},
+		{
+			name: "yaml",
+			doc:  "clusters:\n  prod-*:\n    min_retention: 7d\n    max_retention: 30d\n  staging:\n    max_retention: 14d\n    anchor: backup\n",
+		},
+		{
+			name:    "unknown field",
+			doc:     `{"clusters": {"prod": {"max_retention_days": 30}}}`,
+			wantErr: "max_retention_days",
+		},
+		{
+			name:    "no clusters",
+			doc:     `{"clusters": {}}`,
+			wantErr: "no clusters",
+		},
+		{
+			name:    "invalid glob",
+			doc:     `{"clusters": {"prod-[": {"max_retention": "30d"}}}`,
+			wantErr: "invalid pattern",
+		},
+		{
+			name:    "invalid retention",
+			doc:     `{"clusters": {"prod": {"max_retention": "3M"}}}`,
+			wantErr: "max_retention",
+		},
+		{
+			name:    "min above max",
+			doc:     `{"clusters": {"prod": {"min_retention": "60d", "max_retention": "30d"}}}`,
+			wantErr: "min-retention",
+		},
+		{
+			name:    "invalid mode",
+			doc:     `{"clusters": {"prod": {"mode": "strict"}}}`,
+			wantErr: "-mode",
+		},
+		{
+			name:    "invalid anchor",
+			doc:     `{"clusters": {"prod": {"anchor": "manifest"}}}`,
+			wantErr: "-anchor",
+		},
+		{
+			name: "retention classes",
+			doc:  "clusters:\n  prod-*:\n    min_retention: 7d\n    max_retention: 30d\n    retention_classes:\n      - backups: medusa-backup-weekly-*\n        max_retention: 1y\n",
+		},
+		{
+			name:    "retention class without periods",
+			doc:     `{"clusters": {"prod": {"max_retention": "30d", "retention_classes": [{"backups": "weekly-*"}]}}}`,
+			wantErr: "sets no min_retention or max_retention",
+		},
+		{
+			name:    "retention class min above max",
+			doc:     `{"clusters": {"prod": {"min_retention": "7d", "max_retention": "30d", "retention_classes": [{"backups": "weekly-*", "min_retention": "60d"}]}}}`,
+			wantErr: `retention class "weekly-*"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePolicy([]byte(tt.doc))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("parsePolicy() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parsePolicy() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetentionPolicyMatch(t *testing.T) {
+	p := &retentionPolicy{Clusters: map[string]clusterPolicy{
+		"*":            {MaxRetention: "7d"},
+		"prod-*":       {MaxRetention: "30d"},
+		"prod-eu-*":    {MaxRetention: "60d"},
+		"prod-?u-*":    {MaxRetention: "45d"},
+		"prod-billing": {MaxRetention: "1y"},
+	}}
+
+	tests := []struct {
+		cluster string
+		want    string
+	}{
+		// An exact name wins over every glob
+		{cluster: "prod-billing", want: "prod-billing"},
+		// The glob with the most literal characters wins
+		{cluster: "prod-eu-west", want: "prod-eu-*"},
+		{cluster: "prod-xu-1", want: "prod-?u-*"},
+		{cluster: "prod-ap-south", want: "prod-*"},
+		{cluster: "staging", want: "*"},
+	}
+
+	for _, tt := range tests {
+		got, cp, ok := p.match(tt.cluster)
+		if !ok || got != tt.want || !reflect.DeepEqual(cp, p.Clusters[tt.want]) {
+			t.Errorf("match(%q) = %q, %+v, %v, want %q", tt.cluster, got, cp, ok, tt.want)
+		}
+	}
+
+	if _, _, ok := (&retentionPolicy{Clusters: map[string]clusterPolicy{"prod-*": {}}}).match("staging"); ok {
+		t.Error("match(staging) matched prod-*")
+	}
+}
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	const doc = "clusters:\n  links:\n    min_retention: 14d\n    max_retention: 90d\n    mode: compliance\n  web-*:\n    max_retention: 60d\n"
+
+	tests := []struct {
+		name        string
+		cluster     string
+		flags       func(opts *options)
+		wantMin     retentionPeriod
+		wantMax     retentionPeriod
+		wantMode    types.ObjectLockRetentionMode
+		wantErr     string
+		wantNoUntil bool
+	}{
+		{
+			name:    "policy overrides flags",
+			cluster: "links",
+			flags: func(opts *options) {
+				opts.minRetention, opts.maxRetention = retentionPeriod{days: 7}, retentionPeriod{days: 30}
+			},
+			wantMin:  retentionPeriod{days: 14},
+			wantMax:  retentionPeriod{days: 90},
+			wantMode: types.ObjectLockRetentionModeCompliance,
+		},
+		{
+			name:     "policy without min-retention keeps the flag",
+			cluster:  "web-frontend",
+			flags:    func(opts *options) { opts.minRetention = retentionPeriod{days: 7} },
+			wantMin:  retentionPeriod{days: 7},
+			wantMax:  retentionPeriod{days: 60},
+			wantMode: types.ObjectLockRetentionModeGovernance,
+		},
+		{
+			name:    "incomplete policy without fallback",
+			cluster: "web-frontend",
+			wantErr: "no complete retention",
+		},
+		{
+			name:    "policy replaces retain-until",
+			cluster: "links",
+			flags: func(opts *options) {
+				opts.retainUntil = time.Now().AddDate(1, 0, 0)
+			},
+			wantMin:     retentionPeriod{days: 14},
+			wantMax:     retentionPeriod{days: 90},
+			wantMode:    types.ObjectLockRetentionModeCompliance,
+			wantNoUntil: true,
+		},
+		{
+			name:    "no policy falls back to flags",
+			cluster: "analytics",
+			flags: func(opts *options) {
+				opts.minRetention, opts.maxRetention = retentionPeriod{days: 7}, retentionPeriod{days: 30}
+			},
+			wantMin:  retentionPeriod{days: 7},
+			wantMax:  retentionPeriod{days: 30},
+			wantMode: types.ObjectLockRetentionModeGovernance,
+		},
+		{
+			name:    "no policy and no fallback",
+			cluster: "analytics",
+			wantErr: `no policy in s3://ops/retention.yaml matches cluster "analytics"`,
+		},
+		{
+			name:    "policy mode conflicts with flags",
+			cluster: "links",
+			flags:   func(opts *options) { opts.allowReduce, opts.bypassGovernance = true, true },
+			wantErr: "-allow-reduce",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["retention.yaml"] = doc
+
+			opts := &options{
+				commonOptions: commonOptions{bucket: "test-bucket", cluster: tt.cluster},
+				mode:          types.ObjectLockRetentionModeGovernance,
+				policyURI:     "s3://ops/retention.yaml",
+			}
+			if tt.flags != nil {
+				tt.flags(opts)
+			}
+			err := applyRetentionPolicy(context.Background(), bucket.client(), opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("applyRetentionPolicy() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyRetentionPolicy() error = %v", err)
+			}
+			if opts.minRetention != tt.wantMin || opts.maxRetention != tt.wantMax || opts.mode != tt.wantMode {
+				t.Errorf("applyRetentionPolicy() min = %v, max = %v, mode = %s, want %v, %v, %s",
+					opts.minRetention, opts.maxRetention, opts.mode, tt.wantMin, tt.wantMax, tt.wantMode)
+			}
+			if tt.wantNoUntil && !opts.retainUntil.IsZero() {
+				t.Errorf("applyRetentionPolicy() kept -retain-until %v", opts.retainUntil)
+			}
+		})
+	}
+}
+
+func TestApplyRetentionPolicyMissingDocument(t *testing.T) {
+	opts := testOptions()
+	opts.policyURI = "s3://ops/missing.yaml"
+	err := applyRetentionPolicy(context.Background(), newFakeBucket().client(), opts)
+	if err == nil || !strings.Contains(err.Error(), "failed to download policy") {
+		t.Errorf("applyRetentionPolicy() error = %v, want a download error", err)
+	}
+}
+
+func TestApplyReleasePolicy(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["retention.yaml"] = `clusters:
+  links:
+    min_retention: 7d
+    max_retention: 60d
+    retention_classes:
+      - backups: "weekly-*"
+        max_retention: 1y
+`
+	for _, cluster := range []string{"links", "analytics"} {
+		t.Run(cluster, func(t *testing.T) {
+			opts := releaseOptions()
+			opts.cluster, opts.policyURI = cluster, "s3://ops/retention.yaml"
+			if err := applyReleasePolicy(context.Background(), bucket.client(), opts); err != nil {
+				t.Fatalf("applyReleasePolicy() error = %v", err)
+			}
+			want := retentionPeriod{days: 30}
+			if cluster == "links" {
+				want = retentionPeriod{days: 60}
+			}
+			if opts.maxRetention != want {
+				t.Errorf("max retention = %v, want %v", opts.maxRetention, want)
+			}
+			if got := len(opts.retentionClasses); (got == 1) != (cluster == "links") {
+				t.Errorf("applyReleasePolicy() set %d retention classes for %s", got, cluster)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressBarInterval is how often the TTY progress bar is redrawn
+	progressBarInterval = 200 * time.Millisecond
+	// progressLogInterval is how often progress is logged without a TTY progress bar
+	progressLogInterval = 30 * time.Second
+	// progressBarWidth is the number of cells of the progress bar
+	progressBarWidth = 30
+)
+
+// statusWriter passes log output through to a terminal while keeping a
+// status line, such as the progress bar, drawn below it. The status line is
+// cleared before each write and redrawn after it so they never interleave.
+type statusWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	status string
+}
+
+func newStatusWriter(w io.Writer) *statusWriter {
+	return &statusWriter{w: w}
+}
+
+// stderrStatus is the writer every log line goes through, see execute
+var stderrStatus = newStatusWriter(os.Stderr)
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == "" {
+		return s.w.Write(p)
+	}
+	io.WriteString(s.w, "\r\033[K")
+	n, err := s.w.Write(p)
+	io.WriteString(s.w, s.status)
+	return n, err
+}
+
+// setStatus replaces the status line, or removes it when line is empty
+func (s *statusWriter) setStatus(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = line
+	io.WriteString(s.w, "\r\033[K"+line)
+}
+
+// progressSnapshot holds the counters progress is reported from
+type progressSnapshot struct {
+	objects        int // objects processed
+	totalObjects   int // objects to process, 0 when unknown
+	manifests      int // manifests processed or failed
+	totalManifests int
+	elapsed        time.Duration
+}
+
+// rate returns the objects processed per second
+func (p progressSnapshot) rate() float64 {
+	if p.elapsed <= 0 {
+		return 0
+	}
+	return float64(p.objects) / p.elapsed.Seconds()
+}
+
+// renderProgress formats a single-line progress bar. The bar tracks objects
+// when their total is known and manifests otherwise.
+func renderProgress(p progressSnapshot) string {
+	done, total, unit := p.objects, p.totalObjects, "objects"
+	if total == 0 {
+		done, total, unit = p.manifests, p.totalManifests, "manifests"
+	}
+	fraction := 0.0
+	if total > 0 {
+		fraction = float64(done) / float64(total)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * progressBarWidth)
+
+	line := fmt.Sprintf("[%s%s] %5.1f%% %d/%d %s", strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled), fraction*100, done, total, unit)
+	if unit == "manifests" {
+		line += fmt.Sprintf(" %d objects", p.objects)
+	}
+	return line + fmt.Sprintf(" %.1f obj/s", p.rate())
+}
+
+// logProgress logs a progress line, used when there is no TTY to draw a bar on
+func logProgress(p progressSnapshot, extra ...any) {
+	attrs := []any{
+		"objects", p.objects,
+		"total_objects", p.totalObjects,
+		"manifests", p.manifests,
+		"total_manifests", p.totalManifests,
+		"objects_per_second", fmt.Sprintf("%.1f", p.rate()),
+	}
+	slog.Info("Progress", append(attrs, extra...)...)
+}
+
+// startProgress reports progress until r.stopProgress is called: as a
+// progress bar on r.status when set, and as periodic log lines otherwise
+func (r *refresher) startProgress() {
+	if r.stopProgress != nil {
+		return
+	}
+	interval := progressLogInterval
+	if r.status != nil {
+		interval = progressBarInterval
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				p := r.stats.progress(now)
+				if r.status != nil {
+					r.status.setStatus(renderProgress(p))
+				} else {
+					logProgress(p, r.emfProgressAttrs(p, now)...)
+				}
+			}
+		}
+	}()
+
+	r.stopProgress = func() {
+		close(done)
+		wg.Wait()
+		if r.status != nil {
+			r.status.setStatus("")
+		}
+		r.stopProgress = nil
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRenderProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		p    progressSnapshot
+		want string
+	}{
+		{
+			name: "start",
+			p:    progressSnapshot{totalObjects: 200},
+			want: "[------------------------------]   0.0% 0/200 objects 0.0 obj/s",
+		},
+		{
+			name: "half",
+			p:    progressSnapshot{objects: 100, totalObjects: 200, elapsed: 4 * time.Second},
+			want: "[###############---------------]  50.0% 100/200 objects 25.0 obj/s",
+		},
+		{
+			name: "fraction",
+			p:    progressSnapshot{objects: 1, totalObjects: 3, elapsed: time.Second},
+			want: "[##########--------------------]  33.3% 1/3 objects 1.0 obj/s",
+		},
+		{
+			name: "done",
+			p:    progressSnapshot{objects: 200, totalObjects: 200, elapsed: 10 * time.Second},
+			want: "[##############################] 100.0% 200/200 objects 20.0 obj/s",
+		},
+		{
+			name: "over the total is capped",
+			p:    progressSnapshot{objects: 250, totalObjects: 200, elapsed: 10 * time.Second},
+			want: "[##############################] 100.0% 250/200 objects 25.0 obj/s",
+		},
+		{
+			name: "unknown object total tracks manifests",
+			p:    progressSnapshot{objects: 1234, manifests: 3, totalManifests: 4, elapsed: 2 * time.Second},
+			want: "[######################--------]  75.0% 3/4 manifests 1234 objects 617.0 obj/s",
+		},
+		{
+			name: "nothing to do",
+			p:    progressSnapshot{},
+			want: "[------------------------------]   0.0% 0/0 manifests 0 objects 0.0 obj/s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderProgress(tt.p); got != tt.want {
+				t.Errorf("renderProgress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	var out bytes.Buffer
+	s := newStatusWriter(&out)
+
+	s.Write([]byte("before\n"))
+	s.setStatus("[bar]")
+	s.Write([]byte("WARN line\n"))
+	s.setStatus("")
+	s.Write([]byte("after\n"))
+
+	want := "before\n" + "\r\033[K[bar]" + "\r\033[KWARN line\n[bar]" + "\r\033[K" + "after\n"
+	if out.String() != want {
+		t.Errorf("statusWriter output = %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// S3 implementations -provider-compat accepts
+const (
+	providerAWS   = "aws"
+	providerMinIO = "minio"
+	providerCeph  = "ceph"
+)
+
+// providerCompat describes how an S3 implementation reports errors, as
+// error codes, and the flags it doesn't implement
+type providerCompat struct {
+	accessDenied []string
+	notFound     []string
+	throttled    []string
+	noLock       []errorMatch // retention or legal hold lookups of an object without any
+	noSuchKey    []string     // lookups of a missing object
+	unsupported  []string     // flags disabled with a warning
+}
+
+// errorMatch matches an S3 error by its code and, when message is set, by a
+// message containing it
+type errorMatch struct {
+	code    string
+	message string
+}
+
+// providers are the -provider-compat tables. MinIO and Ceph RGW report most
+// errors as S3 does, but with codes of their own for a few cases, and don't
+// implement the AWS-only request options.
+var providers = map[string]providerCompat{
+	providerAWS: {
+		accessDenied: []string{"AccessDenied", "Forbidden"},
+		notFound:     []string{"NoSuchKey", "NotFound", "NoSuchBucket"},
+		throttled:    []string{"SlowDown", "Throttling", "ThrottlingException", "RequestThrottled", "RequestLimitExceeded", "TooManyRequests"},
+		noLock:       []errorMatch{{code: "NoSuchObjectLockConfiguration"}, {code: "ObjectLockConfigurationNotFoundError"}},
+		noSuchKey:    []string{"NoSuchKey"},
+	},
+	providerMinIO: {
+		accessDenied: []string{"AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch"},
+		notFound:     []string{"NoSuchKey", "NotFound", "NoSuchBucket", "NoSuchVersion"},
+		throttled:    []string{"SlowDown", "Throttling", "RequestThrottled", "TooManyRequests", "XMinioServerNotInitialized"},
+		noLock:       []errorMatch{{code: "NoSuchObjectLockConfiguration"}, {code: "ObjectLockConfigurationNotFoundError"}},
+		noSuchKey:    []string{"NoSuchKey", "NoSuchVersion"},
+		unsupported:  []string{"-requester-pays", "-expected-bucket-owner", "-use-fips", "-use-dualstack"},
+	},
+	providerCeph: {
+		accessDenied: []string{"AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch"},
+		notFound:     []string{"NoSuchKey", "NotFound", "NoSuchBucket"},
+		throttled:    []string{"SlowDown", "Throttling", "TooManyRequests", "ServiceUnavailable"},
+		// RGW answers InvalidRequest for objects without retention or legal
+		// hold, and for requests it rejects, such as on a bucket without
+		// Object Lock
+		noLock: []errorMatch{
+			{code: "NoSuchObjectLockConfiguration"},
+			{code: "ObjectLockConfigurationNotFoundError"},
+			{code: "InvalidRequest", message: "retention"},
+			{code: "InvalidRequest", message: "legal hold"},
+		},
+		noSuchKey:   []string{"NoSuchKey"},
+		unsupported: []string{"-expected-bucket-owner", "-use-fips", "-use-dualstack"},
+	},
+}
+
+// compatFlag is a flag a provider may not implement
+type compatFlag struct {
+	set   func(c *commonOptions) bool
+	clear func(c *commonOptions)
+}
+
+// compatFlags are the flags providerCompat.unsupported can name
+var compatFlags = map[string]compatFlag{
+	"-requester-pays": {
+		set:   func(c *commonOptions) bool { return c.requesterPays },
+		clear: func(c *commonOptions) { c.requesterPays = false },
+	},
+	"-expected-bucket-owner": {
+		set:   func(c *commonOptions) bool { return c.expectedOwner != "" },
+		clear: func(c *commonOptions) { c.expectedOwner = "" },
+	},
+	"-use-fips": {
+		set:   func(c *commonOptions) bool { return c.useFIPS },
+		clear: func(c *commonOptions) { c.useFIPS = false },
+	},
+	"-use-dualstack": {
+		set:   func(c *commonOptions) bool { return c.useDualStack },
+		clear: func(c *commonOptions) { c.useDualStack = false },
+	},
+}
+
+// supports reports whether the provider implements flag
+func (p providerCompat) supports(flag string) bool {
+	for _, name := range p.unsupported {
+		if name == flag {
+			return false
+		}
+	}
+	return true
+}
+
+// validateProvider checks a -provider-compat value
+func validateProvider(name string) error {
+	if _, ok := providers[name]; !ok {
+		names := make([]string, 0, len(providers))
+		for name := range providers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("invalid -provider-compat %q: must be one of %s", name, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// providerOf returns the -provider-compat table of c, AWS's when unset
+func providerOf(c commonOptions) providerCompat {
+	if p, ok := providers[c.providerCompat]; ok {
+		return p
+	}
+	return providers[providerAWS]
+}
+
+// applyProviderCompat disables the flags of c its -provider-compat provider
+// doesn't implement
+func applyProviderCompat(c *commonOptions) {
+	if c.providerCompat != providerAWS {
+		slog.Info("Using S3 provider compatibility", "provider", c.providerCompat)
+	}
+	for _, name := range providerOf(*c).unsupported {
+		if flag := compatFlags[name]; flag.set(c) {
+			slog.Warn("Disabled "+name+": not supported by the S3 provider", "provider", c.providerCompat)
+			flag.clear(c)
+		}
+	}
+}
+
+// providerError is an error of an S3 client for a -provider-compat other
+// than AWS, carrying the provider's table so that it is classified by it
+type providerError struct {
+	err      error
+	provider providerCompat
+}
+
+func (e *providerError) Error() string { return e.err.Error() }
+
+func (e *providerError) Unwrap() error { return e.err }
+
+// withProviderErrors has the errors of an S3 client carry the
+// -provider-compat table of c
+func withProviderErrors(c commonOptions) func(*s3.Options) {
+	return func(o *s3.Options) {
+		if c.providerCompat == "" || c.providerCompat == providerAWS {
+			return
+		}
+		provider := providerOf(c)
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ProviderErrors", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+				out, metadata, err := next.HandleInitialize(ctx, in)
+				if err != nil {
+					err = &providerError{err: err, provider: provider}
+				}
+				return out, metadata, err
+			}), middleware.Before)
+		})
+	}
+}
+
+// errorProvider returns the -provider-compat table of the client err came
+// from, AWS's for errors that don't carry one
+func errorProvider(err error) providerCompat {
+	var pErr *providerError
+	if errors.As(err, &pErr) {
+		return pErr.provider
+	}
+	return providers[providerAWS]
+}
+
+// errorCode returns the S3 error code of err, or for errors that don't carry
+// one, its text up to the first colon, as in "AccessDenied: Access Denied"
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	code, _, _ := strings.Cut(err.Error(), ":")
+	return code
+}
+
+// matchesCode reports whether code is one of codes
+func matchesCode(code string, codes []string) bool {
+	for _, c := range codes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
+
+// isNoLock reports whether err is the answer of the provider it came from to
+// a retention or legal hold lookup of an object without any
+func isNoLock(err error) bool {
+	code := errorCode(err)
+	var message string
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		message = strings.ToLower(apiErr.ErrorMessage())
+	}
+	for _, m := range errorProvider(err).noLock {
+		if code == m.code && strings.Contains(message, m.message) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNoSuchKey reports whether err is the answer of the provider it came from
+// to a lookup of a missing object
+func isNoSuchKey(err error) bool {
+	return matchesCode(errorCode(err), errorProvider(err).noSuchKey)
+}
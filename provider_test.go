@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fromProvider makes err an error of a -provider-compat name client
+func fromProvider(name string, err error) error {
+	if name == providerAWS {
+		return err
+	}
+	return &providerError{err: err, provider: providers[name]}
+}
+
+func TestProviderErrorClass(t *testing.T) {
+	tests := []struct {
+		provider string
+		err      error
+		want     string
+	}{
+		{providerAWS, &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}, errorClassAccessDenied},
+		{providerAWS, &smithy.GenericAPIError{Code: "SlowDown", Message: "Please reduce your request rate."}, errorClassThrottled},
+		{providerAWS, &smithy.GenericAPIError{Code: "ThrottlingException"}, errorClassThrottled},
+		{providerAWS, &smithy.GenericAPIError{Code: "AccessDeniedOnPolicy"}, errorClassOther},
+		{providerAWS, &smithy.GenericAPIError{Code: "NoSuchBucketPolicy"}, errorClassOther},
+		{providerAWS, &smithy.GenericAPIError{Code: "InvalidAccessKeyId"}, errorClassOther},
+		{providerMinIO, &smithy.GenericAPIError{Code: "InvalidAccessKeyId", Message: "The Access Key Id you provided does not exist in our records."}, errorClassAccessDenied},
+		{providerMinIO, &smithy.GenericAPIError{Code: "SignatureDoesNotMatch"}, errorClassAccessDenied},
+		{providerMinIO, &smithy.GenericAPIError{Code: "XMinioServerNotInitialized", Message: "Server not initialized, please try again."}, errorClassThrottled},
+		{providerMinIO, &smithy.GenericAPIError{Code: "NoSuchVersion"}, errorClassNotFound},
+		{providerCeph, &smithy.GenericAPIError{Code: "ServiceUnavailable"}, errorClassThrottled},
+		{providerCeph, &smithy.GenericAPIError{Code: "NoSuchBucket"}, errorClassNotFound},
+		{providerCeph, &smithy.GenericAPIError{Code: "InvalidRequest"}, errorClassOther},
+	}
+	for _, tt := range tests {
+		if got := errorClass(fromProvider(tt.provider, tt.err)); got != tt.want {
+			t.Errorf("%s: errorClass(%v) = %s, want %s", tt.provider, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestProviderMissingRetention(t *testing.T) {
+	tests := []struct {
+		provider    string
+		err         error
+		wantMissing bool
+		wantErr     bool
+	}{
+		{provider: providerAWS, err: &smithy.GenericAPIError{Code: "NoSuchObjectLockConfiguration", Message: "The specified object does not have a ObjectLock configuration"}},
+		{provider: providerAWS, err: &smithy.GenericAPIError{Code: "NoSuchKey"}, wantMissing: true},
+		{provider: providerAWS, err: &smithy.GenericAPIError{Code: "InvalidRequest", Message: "Bucket is missing Object Lock Configuration"}, wantErr: true},
+		{provider: providerMinIO, err: &smithy.GenericAPIError{Code: "NoSuchObjectLockConfiguration", Message: "The specified object does not have a ObjectLock configuration"}},
+		{provider: providerMinIO, err: &smithy.GenericAPIError{Code: "NoSuchVersion"}, wantMissing: true},
+		{provider: providerMinIO, err: &smithy.GenericAPIError{Code: "InvalidRequest", Message: "No retention configuration on this object"}, wantErr: true},
+		{provider: providerCeph, err: &smithy.GenericAPIError{Code: "InvalidRequest", Message: "No retention configuration on this object"}},
+		{provider: providerCeph, err: &smithy.GenericAPIError{Code: "InvalidRequest", Message: "bucket object lock not enabled"}, wantErr: true},
+		{provider: providerCeph, err: &smithy.GenericAPIError{Code: "InvalidRequestHeader", Message: "retention"}, wantErr: true},
+		{provider: providerCeph, err: &smithy.GenericAPIError{Code: "AccessDenied"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		client := &MockS3Client{
+			GetObjectRetentionFunc: func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+				return nil, fromProvider(tt.provider, tt.err)
+			},
+		}
+		current, needsUpdate, err := checkRetention(context.Background(), client, "b", "k", time.Now(), types.ObjectLockRetentionModeGovernance)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkRetention(%v) error = %v, want error: %v", tt.provider, tt.err, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (!needsUpdate || current.RetainUntil != nil || current.Missing != tt.wantMissing) {
+			t.Errorf("%s: checkRetention(%v) = %+v, %v, want no retention, missing: %v", tt.provider, tt.err, current, needsUpdate, tt.wantMissing)
+		}
+	}
+}
+
+func TestApplyProviderCompat(t *testing.T) {
+	c := commonOptions{providerCompat: providerMinIO, requesterPays: true, expectedOwner: "123456789012", useDualStack: true}
+	logged := captureLog("text", slog.LevelInfo, func() { applyProviderCompat(&c) })
+
+	if c.requesterPays || c.expectedOwner != "" || c.useDualStack {
+		t.Errorf("options = %+v, want the flags MinIO lacks disabled", c)
+	}
+	for _, flag := range []string{"-requester-pays", "-expected-bucket-owner", "-use-dualstack"} {
+		if !strings.Contains(logged, "Disabled "+flag+": not supported by the S3 provider") {
+			t.Errorf("logged %q, want %s disabled", logged, flag)
+		}
+	}
+	if strings.Contains(logged, "-use-fips") {
+		t.Errorf("logged %q, want nothing of the unset -use-fips", logged)
+	}
+
+	opts := testOptions()
+	opts.commonOptions = c
+	if logged := captureLog("text", slog.LevelInfo, func() { warnMissingBucketOwner(opts) }); logged != "" {
+		t.Errorf("warnMissingBucketOwner() logged %q for MinIO, which has no bucket owner check", logged)
+	}
+}
+
+func TestS3ClientProviderErrors(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_MAX_ATTEMPTS", "1")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `<Error><Code>InvalidRequest</Code><Message>No retention configuration on this object</Message></Error>`)
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_S3", server.URL)
+
+	tests := []struct {
+		provider string
+		wantErr  bool
+	}{
+		{provider: providerAWS, wantErr: true},
+		{provider: providerMinIO, wantErr: true},
+		{provider: providerCeph},
+	}
+	for _, tt := range tests {
+		client, err := newS3Client(context.Background(), commonOptions{region: "eu-west-1", providerCompat: tt.provider})
+		if err != nil {
+			t.Fatalf("newS3Client() error = %v", err)
+		}
+		current, _, err := checkRetention(context.Background(), client, "my-backups", "k", time.Now(), types.ObjectLockRetentionModeGovernance)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkRetention() error = %v, want error: %v", tt.provider, err, tt.wantErr)
+			continue
+		}
+		if err == nil && current.RetainUntil != nil {
+			t.Errorf("%s: checkRetention() = %+v, want no retention", tt.provider, current)
+		}
+	}
+}
+
+func TestValidateProvider(t *testing.T) {
+	for name := range providers {
+		if err := validateProvider(name); err != nil {
+			t.Errorf("validateProvider(%q) = %v", name, err)
+		}
+		for _, flag := range providers[name].unsupported {
+			if _, ok := compatFlags[flag]; !ok {
+				t.Errorf("%s disables %s, which compatFlags doesn't know", name, flag)
+			}
+		}
+	}
+	if err := validateProvider("wasabi"); err == nil || !strings.Contains(err.Error(), "aws, ceph, minio") {
+		t.Errorf("validateProvider(wasabi) = %v, want the providers listed", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxySchemes are the -proxy-url schemes the HTTP transport supports
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks5": true}
+
+// validateProxyURL checks a -proxy-url value
+func validateProxyURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || !proxySchemes[u.Scheme] || u.Host == "" {
+		return fmt.Errorf("invalid -proxy-url %q: must be an http, https or socks5 URL", redactURL(value))
+	}
+	return nil
+}
+
+// proxyFunc returns the transport's Proxy function for -proxy-url and
+// -no-proxy. It ignores the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables, so a run's proxy is only set by its flags.
+func proxyFunc(proxyURL, noProxy string) func(*http.Request) (*url.URL, error) {
+	cfg := httpproxy.Config{HTTPProxy: proxyURL, HTTPSProxy: proxyURL, NoProxy: noProxy}
+	proxy := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// proxyConnectError fails a CONNECT the -proxy-url proxy refused, naming the
+// proxy and the target, e.g. for missing credentials (407)
+func proxyConnectError(ctx context.Context, proxy *url.URL, req *http.Request, resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	return fmt.Errorf("proxyconnect %s: CONNECT to %s refused: %s", redactURL(proxy.String()), req.Host, resp.Status)
+}
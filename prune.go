@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// pruneCandidate is a backup past its retention that Medusa could purge once
+// the locks on its exclusive objects, those neither a newer backup of the
+// host nor one still within its retention references, have expired
+type pruneCandidate struct {
+	Host                string     `json:"host"`
+	Backup              string     `json:"backup"`
+	Manifest            string     `json:"manifest"`
+	Taken               time.Time  `json:"taken"`
+	ExclusiveObjects    int        `json:"exclusive_objects"`
+	LockedObjects       int        `json:"locked_objects"`
+	EarliestRetainUntil *time.Time `json:"earliest_retain_until"` // first lock still protecting an exclusive object, nil when none is
+	LatestRetainUntil   *time.Time `json:"latest_retain_until"`   // when the last exclusive object can be deleted, nil when none is locked
+	Errors              int        `json:"errors"`
+}
+
+// validatePruneFormat checks the report command's -format flag value
+func validatePruneFormat(format string) error {
+	if format != "table" && format != "json" {
+		return fmt.Errorf("invalid -format %q: must be table or json", format)
+	}
+	return nil
+}
+
+// findPruneCandidates lists, per host, the backups taken longer than the
+// max_retention of their retention class, or -max-retention, before now with
+// the retention still protecting their exclusive objects. Backups pinned in
+// -pins-file are never listed. Undated backups and hosts with an unreadable
+// manifest are skipped, since their age or exclusive objects can't be
+// determined.
+func findPruneCandidates(ctx context.Context, client S3API, opts *options, now time.Time) ([]pruneCandidate, error) {
+	var pins backupPins
+	if opts.pinsFile != "" {
+		var err error
+		if pins, err = loadPins(ctx, client, opts, now); err != nil {
+			return nil, fmt.Errorf("failed to read -pins-file: %w", err)
+		}
+		slog.Info("Loaded pins from -pins-file", "pins", len(pins))
+	}
+	manifests, err := resolveManifests(ctx, client, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	if pins != nil {
+		// A pin matching nothing may be a typo listing its backup as prunable
+		pins.split(manifests)
+		if unmatched := pins.unmatched(); len(unmatched) > 0 {
+			return nil, fmt.Errorf("%d pins in -pins-file match no discovered backup: %s", len(unmatched), strings.Join(unmatched, ", "))
+		}
+	}
+
+	var candidates []pruneCandidate
+	groups, hosts := groupByHost(manifests)
+	for _, hostnamePath := range hosts {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		hostCandidates, err := hostPruneCandidates(ctx, client, opts, pins, hostnamePath, groups[hostnamePath], now)
+		if err != nil {
+			slog.Error("Skipping host", append([]any{"host", hostnamePath}, errorAttrs(err)...)...)
+			continue
+		}
+		candidates = append(candidates, hostCandidates...)
+	}
+	return candidates, nil
+}
+
+// hostPruneCandidates walks the backups of one host newest first, so every
+// expired backup's exclusive objects are the ones no newer backup referenced,
+// leaving out those a backup within its retention references
+func hostPruneCandidates(ctx context.Context, client S3API, opts *options, pins backupPins, hostnamePath string, manifests []ManifestInfo, now time.Time) ([]pruneCandidate, error) {
+	sortManifestsNewestFirst(manifests)
+	keys := make([][]string, len(manifests))
+	kept := make(map[string]struct{}) // objects of backups within their retention
+	for i, m := range manifests {
+		manifest, err := downloadManifest(ctx, client, opts.bucket, m.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download manifest %s: %w", m.Key, err)
+		}
+		for _, obj := range manifest.Objects {
+			keys[i] = append(keys[i], resolveObjectKey(hostnamePath, obj.Path))
+		}
+		if !backupExpired(opts, pins, m, now) {
+			for _, key := range keys[i] {
+				kept[key] = struct{}{}
+			}
+		}
+	}
+
+	newer := make(map[string]struct{})
+	var candidates []pruneCandidate
+	for i, m := range manifests {
+		var exclusive []string
+		for _, key := range keys[i] {
+			if _, ok := newer[key]; ok {
+				continue
+			}
+			newer[key] = struct{}{}
+			if _, ok := kept[key]; !ok {
+				exclusive = append(exclusive, key)
+			}
+		}
+
+		taken, ok := backupTimestamp(m)
+		if !ok {
+			slog.Warn("Could not determine backup timestamp", "manifest", m.Key)
+			continue
+		}
+		if !backupExpired(opts, pins, m, now) {
+			continue
+		}
+		mp, err := m.path()
+		if err != nil {
+			return nil, err
+		}
+		c := pruneCandidate{Host: mp.Host, Backup: mp.Backup, Manifest: m.Key, Taken: taken.UTC()}
+		c.addLocks(ctx, client, opts.bucket, exclusive, now)
+		candidates = append(candidates, c)
+	}
+	return candidates, nil
+}
+
+// addLocks records the retention still protecting the exclusive objects at now
+func (c *pruneCandidate) addLocks(ctx context.Context, client S3API, bucket string, exclusive []string, now time.Time) {
+	for _, key := range exclusive {
+		current, _, err := checkRetention(ctx, client, bucket, key, time.Time{}, "")
+		if err != nil {
+			slog.Error("Error checking retention", append([]any{"manifest", c.Manifest, "key", key}, errorAttrs(err)...)...)
+			c.Errors++
+			continue
+		}
+		if current.Missing {
+			continue
+		}
+		c.ExclusiveObjects++
+		until := current.RetainUntil
+		if until == nil || !until.After(now) {
+			continue
+		}
+		c.LockedObjects++
+		if c.EarliestRetainUntil == nil || until.Before(*c.EarliestRetainUntil) {
+			c.EarliestRetainUntil = until
+		}
+		if c.LatestRetainUntil == nil || until.After(*c.LatestRetainUntil) {
+			c.LatestRetainUntil = until
+		}
+	}
+}
+
+// writePruneCandidates writes candidates as an aligned table or a JSON array
+func writePruneCandidates(w io.Writer, candidates []pruneCandidate, format string) error {
+	if format == "json" {
+		if candidates == nil {
+			candidates = []pruneCandidate{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(candidates)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tBACKUP\tTAKEN\tEXCLUSIVE\tLOCKED\tEARLIEST RETAIN UNTIL\tLATEST RETAIN UNTIL\tERRORS")
+	for _, c := range candidates {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%d\n", c.Host, c.Backup, c.Taken.Format(time.RFC3339),
+			c.ExclusiveObjects, c.LockedObjects, formatPruneTime(c.EarliestRetainUntil), formatPruneTime(c.LatestRetainUntil), c.Errors)
+	}
+	return tw.Flush()
+}
+
+// formatPruneTime formats an optional retain-until date, "-" when unset
+func formatPruneTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindPruneCandidates(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	soon := now.AddDate(0, 0, 5)
+	later := now.AddDate(0, 0, 10)
+
+	bucket := newFakeBucket()
+	// host1's backups share SSTables: a.db is in the two older backups, b.db in the two newer ones
+	bucket.objects["links/host1/medusa-backup-schedule-1700000000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/x.db"},{"path":"data/ks/t/z.db"}]}]`
+	bucket.objects["links/host1/medusa-backup-schedule-1710000000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/medusa-backup-schedule-1717000000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/b.db"},{"path":"data/ks/t/c.db"}]}]`
+	for key, until := range map[string]time.Time{
+		"links/host1/data/ks/t/a.db": soon,
+		"links/host1/data/ks/t/b.db": later.AddDate(1, 0, 0),
+		"links/host1/data/ks/t/c.db": later.AddDate(1, 0, 0),
+		"links/host1/data/ks/t/x.db": later,
+		"links/host1/data/ks/t/z.db": now.AddDate(0, 0, -1),
+	} {
+		bucket.objects[key] = ""
+		bucket.retention[key] = until
+	}
+	// host2's only backup is expired and nothing locks its files anymore
+	bucket.objects["links/host2/medusa-backup-schedule-1700000000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/y.db"},{"path":"data/ks/t/gone.db"}]}]`
+	bucket.objects["links/host2/data/ks/t/y.db"] = ""
+
+	opts := testOptions()
+	got, err := findPruneCandidates(context.Background(), bucket.client(), opts, now)
+	if err != nil {
+		t.Fatalf("findPruneCandidates() error = %v", err)
+	}
+
+	want := []pruneCandidate{
+		{
+			Host:     "host1",
+			Backup:   "medusa-backup-schedule-1710000000",
+			Manifest: "links/host1/medusa-backup-schedule-1710000000/meta/manifest.json",
+			Taken:    time.Unix(1710000000, 0).UTC(),
+			// b.db is shared with the newest backup, which is within retention
+			ExclusiveObjects:    1,
+			LockedObjects:       1,
+			EarliestRetainUntil: &soon,
+			LatestRetainUntil:   &soon,
+		},
+		{
+			Host:     "host1",
+			Backup:   "medusa-backup-schedule-1700000000",
+			Manifest: "links/host1/medusa-backup-schedule-1700000000/meta/manifest.json",
+			Taken:    time.Unix(1700000000, 0).UTC(),
+			// a.db is shared with the newer backup, and z.db's lock has expired
+			ExclusiveObjects:    2,
+			LockedObjects:       1,
+			EarliestRetainUntil: &later,
+			LatestRetainUntil:   &later,
+		},
+		{
+			Host:             "host2",
+			Backup:           "medusa-backup-schedule-1700000000",
+			Manifest:         "links/host2/medusa-backup-schedule-1700000000/meta/manifest.json",
+			Taken:            time.Unix(1700000000, 0).UTC(),
+			ExclusiveObjects: 1,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findPruneCandidates() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWritePruneCandidates(t *testing.T) {
+	until := time.Date(2024, 6, 6, 0, 0, 0, 0, time.UTC)
+	candidates := []pruneCandidate{
+		{Host: "host1", Backup: "b1", Manifest: "links/host1/b1/meta/manifest.json", Taken: time.Date(2024, 3, 9, 0, 0, 0, 0, time.UTC), ExclusiveObjects: 2, LockedObjects: 1, EarliestRetainUntil: &until, LatestRetainUntil: &until},
+		{Host: "host2", Backup: "b2", Manifest: "links/host2/b2/meta/manifest.json", Taken: time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC), ExclusiveObjects: 1},
+	}
+
+	var table bytes.Buffer
+	if err := writePruneCandidates(&table, candidates, "table"); err != nil {
+		t.Fatalf("writePruneCandidates(table) error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "HOST") {
+		t.Fatalf("writePruneCandidates(table) = %q, want a header and 2 rows", table.String())
+	}
+	if fields := strings.Fields(lines[1]); !reflect.DeepEqual(fields, []string{"host1", "b1", "2024-03-09T00:00:00Z", "2", "1", "2024-06-06T00:00:00Z", "2024-06-06T00:00:00Z", "0"}) {
+		t.Errorf("writePruneCandidates(table) row = %q", fields)
+	}
+	if fields := strings.Fields(lines[2]); fields[5] != "-" || fields[6] != "-" {
+		t.Errorf("writePruneCandidates(table) unlocked row = %q, want - for the retain-until dates", fields)
+	}
+
+	var out bytes.Buffer
+	if err := writePruneCandidates(&out, candidates, "json"); err != nil {
+		t.Fatalf("writePruneCandidates(json) error = %v", err)
+	}
+	var decoded []pruneCandidate
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("writePruneCandidates(json) wrote invalid JSON: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, candidates) {
+		t.Errorf("writePruneCandidates(json) = %+v, want %+v", decoded, candidates)
+	}
+
+	out.Reset()
+	if err := writePruneCandidates(&out, nil, "json"); err != nil || strings.TrimSpace(out.String()) != "[]" {
+		t.Errorf("writePruneCandidates(json) without candidates = %q, %v, want []", out.String(), err)
+	}
+}
+
+func TestFindPruneCandidatesKeepsLongerRetainedBackups(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	weeklyClass := func(t *testing.T, opts *options) {
+		opts.retentionClasses = []retentionClass{{pattern: "weekly-*", maxRetention: retentionPeriod{years: 1}}}
+	}
+	pinsFile := func(pins string) func(t *testing.T, opts *options) {
+		return func(t *testing.T, opts *options) {
+			opts.pinsFile = filepath.Join(t.TempDir(), "pins.txt")
+			if err := os.WriteFile(opts.pinsFile, []byte(pins), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, opts *options)
+		want    map[string]int // exclusive objects by listed backup
+		wantErr string
+	}{
+		{
+			// With both backups expired, a.db counts toward the newer daily one only
+			name:  "no class",
+			setup: func(t *testing.T, opts *options) {},
+			want:  map[string]int{"backup-1745000000": 2, "weekly-1738368000": 1},
+		},
+		{
+			// The weekly backup is kept a year by its class, so a.db is not exclusive to the daily one
+			name:  "weekly class",
+			setup: weeklyClass,
+			want:  map[string]int{"backup-1745000000": 1},
+		},
+		{
+			name:  "pinned",
+			setup: pinsFile("links/host1/weekly-1738368000\n"),
+			want:  map[string]int{"backup-1745000000": 1},
+		},
+		{
+			name:    "pin matching nothing",
+			setup:   pinsFile("links/host1/weekly-1700000000\n"),
+			wantErr: "match no discovered backup",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/weekly-1738368000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/w.db"}]}]`
+			bucket.objects["links/host1/backup-1745000000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/d.db"}]}]`
+			bucket.objects["links/host1/backup-1748700000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/n.db"}]}]`
+			for _, key := range []string{"a.db", "w.db", "d.db", "n.db"} {
+				bucket.objects["links/host1/data/ks/t/"+key] = ""
+			}
+			opts := testOptions()
+			tt.setup(t, opts)
+
+			got, err := findPruneCandidates(context.Background(), bucket.client(), opts, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("findPruneCandidates() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("findPruneCandidates() error = %v", err)
+			}
+			listed := map[string]int{}
+			for _, c := range got {
+				listed[c.Backup] = c.ExclusiveObjects
+			}
+			if !reflect.DeepEqual(listed, tt.want) {
+				t.Errorf("listed %v, want %v", listed, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// manifestSuffix is the key suffix of every Medusa backup manifest
+const manifestSuffix = "/meta/manifest.json"
+
+// gzipManifestSuffix is the key suffix of a gzip-compressed manifest
+const gzipManifestSuffix = manifestSuffix + ".gz"
+
+// isManifestKey reports whether key is a manifest.json or manifest.json.gz
+// in a backup's meta/ directory
+func isManifestKey(key string) bool {
+	return strings.HasSuffix(key, manifestSuffix) || strings.HasSuffix(key, gzipManifestSuffix)
+}
+
+// validateManifestKey checks that key is a usable manifest key under prefix
+// with the given -path-depth. Keys not ending in /meta/manifest.json(.gz) are
+// only accepted when force is set.
+func validateManifestKey(key, prefix string, depth pathDepth, force bool) error {
+	if _, err := extractHostnamePath(key, prefix, depth); err != nil {
+		return err
+	}
+	if !force && !isManifestKey(key) {
+		return fmt.Errorf("%s does not end in %s or %s (use -force-manifest to process it anyway)", key, manifestSuffix, gzipManifestSuffix)
+	}
+	return nil
+}
+
+// readKeyList reads a newline-delimited list of keys, skipping blank lines and # comments
+func readKeyList(r io.Reader) ([]string, error) {
+	var keys []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// readKeyListFile reads a key list from path, or from stdin when path is "-"
+func readKeyListFile(path string) ([]string, error) {
+	if path == "-" {
+		return readKeyList(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readKeyList(f)
+}
+
+// loadManifestsFile reads the manifest keys listed in path. Invalid keys are
+// reported and dropped without aborting the batch.
+func loadManifestsFile(path, prefix string, depth pathDepth, force bool) ([]ManifestInfo, int, error) {
+	keys, err := readKeyListFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read manifests file: %w", err)
+	}
+
+	var manifests []ManifestInfo
+	invalid := 0
+	for _, key := range keys {
+		if err := validateManifestKey(key, prefix, depth, force); err != nil {
+			slog.Warn("Skipping invalid manifest key", "manifest", key, "error", err.Error())
+			invalid++
+			continue
+		}
+		manifests = append(manifests, ManifestInfo{Key: key, Prefix: prefix, Depth: depth})
+	}
+	return manifests, invalid, nil
+}
+
+// resolveManifests returns the manifests to process: the single -manifest-key,
+// the keys listed in -manifests-file, or everything discovered under the cluster prefix,
+// narrowed to the hosts -hostname-regex and -dc select.
+// Discovery records the other objects it lists in index.
+func resolveManifests(ctx context.Context, client S3API, opts *options, index objectIndex) ([]ManifestInfo, error) {
+	manifests, err := discoverManifests(ctx, client, opts, index)
+	if err != nil {
+		return nil, err
+	}
+	for i := range manifests {
+		manifests[i].Depth = opts.pathDepth
+	}
+	if !opts.hosts.active() {
+		return manifests, nil
+	}
+	// Discovery only lists the selected hosts, but -manifest-key,
+	// -manifests-file, -s3-event, -local-manifests, -use-index and a
+	// -path-depth other than [cluster]/[hostname] return every host
+	manifests, filtered := filterManifestsByHost(manifests, &opts.hosts)
+	if filtered > 0 {
+		slog.Info("Filtered manifests by -hostname-regex/-dc", "filtered", filtered, "remaining", len(manifests))
+	}
+	return manifests, nil
+}
+
+// discoverManifests returns the manifests named by -manifest-key,
+// -manifests-file or -s3-event, or found in -local-manifests, the backup index or by
+// listing the cluster prefix
+func discoverManifests(ctx context.Context, client S3API, opts *options, index objectIndex) ([]ManifestInfo, error) {
+	if opts.manifestKey != "" {
+		slog.Info("Using manifest from -manifest-key", "manifest", opts.manifestKey)
+		return []ManifestInfo{{Key: opts.manifestKey, Prefix: opts.prefix, Depth: opts.pathDepth}}, nil
+	}
+
+	if opts.localManifests != "" {
+		manifests, err := findLocalManifests(opts.localManifests, opts.prefix, opts.cluster, opts.pathDepth)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Found manifests in -local-manifests", "dir", opts.localManifests, "manifests", len(manifests))
+		return manifests, nil
+	}
+
+	if opts.manifestsFile != "" {
+		manifests, invalid, err := loadManifestsFile(opts.manifestsFile, opts.prefix, opts.pathDepth, opts.forceManifest)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Loaded manifests from -manifests-file", "manifests", len(manifests), "invalid", invalid)
+		return manifests, nil
+	}
+
+	if opts.s3Event != "" {
+		manifests, invalid, err := loadS3Event(opts)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("Loaded manifests from -s3-event", "manifests", len(manifests), "invalid", invalid)
+		return manifests, nil
+	}
+
+	if opts.useIndex {
+		if manifests, ok := manifestsFromIndex(ctx, client, opts); ok {
+			return manifests, nil
+		}
+	}
+
+	// Find all manifests matching the pattern: [prefix][cluster]/[hostname]/[last-backup]/meta/manifest.json
+	var manifests []ManifestInfo
+	var err error
+	// Hostnames can only be listed when they're directly below the cluster
+	if opts.hosts.active() && opts.pathDepth.segments() == defaultPathDepth {
+		manifests, err = findHostManifests(ctx, client, opts, index)
+	} else {
+		manifests, err = findManifests(ctx, client, opts.bucket, opts.prefix, opts.cluster, index)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find manifests: %w", err)
+	}
+	slog.Info("Found manifests", "manifests", len(manifests))
+	return manifests, nil
+}
+
+// selectManifests applies the manifest-level filters
+func (r *refresher) selectManifests(manifests []ManifestInfo) ([]ManifestInfo, error) {
+	opts := r.opts
+	if opts.backupName != "" {
+		var filtered int
+		var err error
+		manifests, filtered, err = filterManifestsByBackupName(manifests, opts.backupName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to filter manifests: %w", err)
+		}
+		slog.Info("Filtered manifests by -backup-name", "pattern", opts.backupName, "filtered", filtered, "remaining", len(manifests))
+	}
+
+	if !opts.since.IsZero() || !opts.until.IsZero() {
+		var filtered int
+		var undated []ManifestInfo
+		manifests, filtered, undated = filterManifestsByTime(manifests, opts.since, opts.until, opts.excludeUndated)
+		for _, m := range undated {
+			slog.Warn("Could not determine backup timestamp", "manifest", m.Key)
+		}
+		slog.Info("Filtered manifests by -since/-until", "filtered", filtered, "undated", len(undated), "remaining", len(manifests))
+	}
+
+	if !opts.refreshExpired && !opts.maxRetention.isZero() {
+		var expired []ManifestInfo
+		manifests, expired = filterExpiredManifests(manifests, func(m ManifestInfo) retentionPeriod {
+			_, maxRetention, _ := opts.backupRetention(m)
+			return maxRetention
+		}, r.now)
+		for _, m := range expired {
+			slog.Debug("Skipping expired backup", "manifest", m.Key)
+		}
+		if len(expired) > 0 {
+			slog.Info("Skipped backups older than -max-retention", "expired", len(expired), "remaining", len(manifests))
+		}
+		r.stats.addManifestsExpired(len(expired))
+	}
+
+	if opts.latestOnly {
+		var chosen map[string]string
+		before := len(manifests)
+		manifests, chosen = latestPerHost(manifests)
+		hosts := make([]string, 0, len(chosen))
+		for host := range chosen {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			slog.Info("Selected latest backup", "host", host, "backup", chosen[host])
+		}
+		slog.Info("Filtered manifests by -latest-only", "filtered", before-len(manifests), "remaining", len(manifests))
+		r.stats.setLatestBackups(chosen)
+	}
+
+	if opts.keepLast > 0 {
+		var chosen map[string][]string
+		var skipped map[string]int
+		before := len(manifests)
+		manifests, chosen, skipped = keepLastPerHost(manifests, opts.keepLast)
+		hosts := make([]string, 0, len(chosen))
+		for host := range chosen {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			slog.Info("Kept last backups", "host", host, "kept", len(chosen[host]), "skipped", skipped[host])
+		}
+		slog.Info("Filtered manifests by -keep-last", "keep_last", opts.keepLast, "filtered", before-len(manifests), "remaining", len(manifests))
+	}
+
+	if opts.hosts.active() {
+		r.recordHostDCs(manifests)
+	}
+	sortManifestsNewestFirst(manifests)
+	return manifests, nil
+}
+
+// objectAction describes the outcome of refreshing a single object
+type objectAction string
+
+const (
+	actionUpdated             objectAction = "updated"
+	actionWouldUpdate         objectAction = "would_update"
+	actionReduced             objectAction = "reduced"
+	actionWouldReduce         objectAction = "would_reduce"
+	actionSkipped             objectAction = "skipped"
+	actionMissing             objectAction = "missing"
+	actionError               objectAction = "error"
+	actionExcluded            objectAction = "excluded"
+	actionSkippedStorageClass objectAction = "skipped_storage_class"
+	actionSkippedMismatched   objectAction = "skipped_mismatched"
+	actionPlanned             objectAction = "planned" // -offline, retention not checked
+	actionNotRestorable       objectAction = "not_restorable"
+)
+
+// refresher applies the retention policy to individual objects
+type refresher struct {
+	client          S3API
+	opts            *options
+	now             time.Time // start of the run, which retention is counted from
+	requiredUntil   time.Time // objects retained until before this are updated
+	retainUntil     time.Time // retain-until applied when updating
+	stats           *runStats
+	report          reporter     // -report file, nil when not requested
+	reportErr       error        // first error writing the report or the -rollback-file, which stops the run
+	rollback        *rollbackLog // -rollback-file, nil when not requested
+	events          *eventStream // -output ndjson events, nil when not requested
+	updated         *keyPrinter  // -print-updated listing, nil when not requested
+	taken           atomic.Int64 // objects attempted, for -limit
+	prompt          prompt
+	loaded          map[string]*Manifest       // manifests downloaded ahead of processing, by -anchor=backup or -confirm-threshold
+	status          *statusWriter              // terminal to draw the progress bar on, nil to log progress instead
+	exclusions      *keyExclusions             // -exclude-keys-file entries, nil when not set
+	index           objectIndex                // objects seen by the discovery listing
+	objectTargets   map[string]retentionTarget // -anchor=backup or retention class targets by object key, nil otherwise
+	manifestTargets map[string]retentionTarget // -anchor=backup or retention class targets by manifest key, nil otherwise
+	stopProgress    func()                     // stops progress reporting, nil when not started
+	plan            *plan                      // records changes for the plan command, which runs in dry-run mode
+	schemas         map[string]string          // schema version of each loaded manifest, by key
+	manifestDCs     map[string]string          // datacenter of each selected manifest's host, by key, with -dc or a dc group in -hostname-regex
+	tables          *tableTracker              // tables of the processed backups, for the dropped table report
+	coverage        *coverageTracker           // outcomes of the attempted objects per backup
+	sharing         *sharingTracker            // backups referencing each object, per host
+	offline         *offlinePlan               // -offline listing of the planned keys, nil otherwise
+	forecast        *forecastTracker           // retention left on each backup's objects for -expiry-forecast, nil otherwise
+	pins            backupPins                 // -pins-file entries, nil when not set
+	cloudwatch      CloudWatchAPI              // publishes -cloudwatch-namespace metrics, nil when not set
+	ses             SESAPI                     // sends the -ses-to email, nil when not set
+	uploader        ReportUploader             // uploads reports too large to email to -ses-report-s3-uri, and the audit log
+	sts             STSAPI                     // identifies the caller for the audit log, nil when not needed
+	audit           *auditLog                  // -audit-s3-prefix log, nil when not requested
+	dynamodb        DynamoDBAPI                // reads and records -state-dynamodb-table, nil when not needed
+	state           *stateTable                // -state-dynamodb-table records, nil when not requested
+	retained        *backupRetention           // retention reached per manifest for the refreshed markers, nil when none are written
+	tags            *objectTagger              // -tag-objects and -trust-tags object tags, nil when neither is set
+	firehose        FirehoseAPI                // delivers the -firehose-stream events, nil when not needed
+	manifests       *manifestCache             // manifests kept between -interval passes, nil otherwise
+	canary          *canaryPhase               // -canary manifest, processed first, nil otherwise
+	runID           string                     // identifies the run in logs, reports, events, webhooks, markers, tags and the audit log
+}
+
+// newRefresher creates a refresher with retention dates computed relative to now.
+// With -retain-until, objects retained until before that date are updated to it,
+// unless -min-retention narrows the threshold.
+func newRefresher(client S3API, opts *options, now time.Time) *refresher {
+	r := &refresher{
+		client:        traceS3(client),
+		opts:          opts,
+		now:           now,
+		requiredUntil: opts.minRetention.from(now),
+		retainUntil:   opts.maxRetention.from(now),
+		stats:         newRunStats(time.Now()),
+		prompt:        stdPrompt(),
+		index:         make(objectIndex),
+		schemas:       make(map[string]string),
+		manifestDCs:   make(map[string]string),
+		tables:        newTableTracker(),
+		coverage:      newCoverageTracker(),
+		sharing:       newSharingTracker(),
+		runID:         opts.runID,
+	}
+	if r.runID == "" {
+		r.runID = newRunID()
+	}
+	if !opts.noProgress && opts.logFormat != "json" && isTerminal(os.Stderr) {
+		r.status = stderrStatus
+	}
+	r.stats.topTables = opts.topTables
+	if opts.output == "ndjson" {
+		r.events = newEventStream(os.Stdout, r.runID)
+	}
+	if opts.printUpdated {
+		r.updated = newKeyPrinter(os.Stdout)
+	}
+	if opts.offline {
+		r.offline = newOfflinePlan(os.Stdout)
+	}
+	if opts.expiryForecast != "" {
+		r.forecast = newForecastTracker()
+	}
+	if r.usesMarkers() && !opts.dryRun {
+		r.retained = newBackupRetention()
+	}
+	r.tags = newObjectTagger(r.client, opts, r.runID)
+	if !opts.retainUntil.IsZero() {
+		r.retainUntil = opts.retainUntil
+		if opts.minRetention.isZero() {
+			r.requiredUntil = opts.retainUntil
+		}
+	}
+	return r
+}
+
+// objectResult is the outcome of processing a single object
+type objectResult struct {
+	action       objectAction
+	previous     *ObjectRetention // retention before processing, nil when unknown
+	retainUntil  time.Time        // retain-until set or planned, zero when unchanged
+	mode         types.ObjectLockRetentionMode
+	storageClass types.ObjectStorageClass // "" when not known
+	err          error
+}
+
+// refreshObject checks an object's retention and extends it when needed,
+// or applies the requested legal hold status for the legal-hold command.
+// manifest is the manifest referencing the object, empty when unknown.
+func (r *refresher) refreshObject(ctx context.Context, manifest, key string) objectAction {
+	r.stats.objectStarted()
+	defer r.stats.objectFinished()
+	ctx, span := r.startObjectSpan(ctx, manifest, key)
+	defer span.End()
+	var res objectResult
+	class, err := r.storageClass(ctx, key)
+	switch {
+	case err != nil:
+		res = objectError("Error checking storage class", manifest, key, objectResult{err: err})
+	case r.skipsStorageClass(class):
+		logObject(slog.LevelDebug, "Skipped object in storage class", manifest, key, actionSkippedStorageClass, "storage_class", string(class))
+		res = objectResult{action: actionSkippedStorageClass}
+	case r.opts.legalHold != "":
+		res = r.applyLegalHold(ctx, manifest, key)
+	default:
+		res = r.refresh(ctx, manifest, key)
+	}
+	res.storageClass = class
+	span.SetAttributes(attribute.String("action", string(res.action)))
+	if res.err != nil {
+		span.SetStatus(codes.Error, res.err.Error())
+	}
+	return r.recordResult(manifest, key, res)
+}
+
+// recordResult counts the outcome of processing an object and writes it to the -report file
+func (r *refresher) recordResult(manifest, key string, res objectResult) objectAction {
+	r.stats.record(res.action)
+	r.canary.record(key, res)
+	r.coverage.record(manifest, key, res.action)
+	if r.forecast != nil {
+		r.forecast.record(manifest, key, res)
+	}
+	if res.storageClass != "" {
+		r.stats.recordStorageClass(string(res.storageClass))
+	}
+	if res.err != nil {
+		r.stats.recordErrorClass(errorClass(res.err))
+		r.stats.recordFirstError(key, res.err)
+	}
+	now := time.Now()
+	r.recordAudit(now, key, res)
+	if r.state != nil {
+		r.state.record(manifest, res)
+	}
+	if r.retained != nil {
+		r.retained.record(manifest, res)
+	}
+	rec := newReportRecord(now, manifest, key, res)
+	rec.ManifestSchema = r.schemas[manifest]
+	rec.DC = r.manifestDCs[manifest]
+	rec.RunID = r.runID
+	if r.events != nil {
+		r.events.object(rec)
+	}
+	if r.updated != nil {
+		r.updated.print(key, res.action)
+	}
+	if r.report != nil && r.reportErr == nil {
+		if err := r.report.write(rec); err != nil {
+			slog.Error("Error writing report", "error", err.Error())
+			r.reportErr = fmt.Errorf("failed to write report: %w", err)
+		}
+	}
+	return res.action
+}
+
+// lookupObject returns what the discovery listing saw of key. Objects it
+// didn't see are looked up with HeadObject when head is set, and remembered.
+// ok is false when nothing is known, including when the object doesn't exist.
+func (r *refresher) lookupObject(ctx context.Context, key string, head bool) (objectInfo, bool, error) {
+	if info, ok := r.index[key]; ok {
+		return info, true, nil
+	}
+	if !head {
+		return objectInfo{}, false, nil
+	}
+	info, ok, err := headObject(ctx, r.client, r.opts.bucket, key)
+	if ok {
+		r.index[key] = info
+	}
+	return info, ok, err
+}
+
+// lastModifiedSkipReason returns the -older-than/-newer-than filter that
+// excludes key, or "" when it should be processed. Objects whose LastModified
+// can't be determined are processed and counted.
+func (r *refresher) lastModifiedSkipReason(ctx context.Context, key string) string {
+	if r.opts.olderThan.IsZero() && r.opts.newerThan.IsZero() {
+		return ""
+	}
+	info, ok, err := r.lookupObject(ctx, key, true)
+	if err == nil && !ok {
+		return ""
+	}
+	if err != nil || info.LastModified.IsZero() {
+		attrs := []any{"key", key}
+		if err != nil {
+			attrs = append(attrs, errorAttrs(err)...)
+		}
+		slog.Debug("LastModified unknown, processing object", attrs...)
+		r.stats.lastModifiedUnknown()
+		return ""
+	}
+	if !r.opts.olderThan.IsZero() && !info.LastModified.Before(r.opts.olderThan) {
+		return "older-than"
+	}
+	if !r.opts.newerThan.IsZero() && !info.LastModified.After(r.opts.newerThan) {
+		return "newer-than"
+	}
+	return ""
+}
+
+// excluded records key as excluded when -exclude-keys-file lists it, before
+// any S3 call is made for it
+func (r *refresher) excluded(manifest, key string) bool {
+	if !r.exclusions.match(key) {
+		return false
+	}
+	logObject(slog.LevelDebug, "Excluded object", manifest, key, actionExcluded)
+	r.recordResult(manifest, key, objectResult{action: actionExcluded})
+	return true
+}
+
+// take reserves one of the -limit objects before processing an object,
+// reporting false once all of them were taken
+func (r *refresher) take() bool {
+	if r.opts.limit <= 0 {
+		return true
+	}
+	if r.taken.Add(1) <= int64(r.opts.limit) {
+		return true
+	}
+	r.limitReached()
+	return false
+}
+
+// limitReached reports whether -limit objects were attempted, logging it once
+func (r *refresher) limitReached() bool {
+	if r.opts.limit <= 0 || r.taken.Load() < int64(r.opts.limit) {
+		return false
+	}
+	if r.stats.hitLimit() {
+		slog.Info("Object limit reached, not scheduling more objects", "limit", r.opts.limit)
+	}
+	return true
+}
+
+// stopErr returns why processing must stop early: the context was canceled
+// or the -report file can no longer be written. It returns nil otherwise.
+func (r *refresher) stopErr(ctx context.Context) error {
+	if r.reportErr != nil {
+		return r.reportErr
+	}
+	return ctx.Err()
+}
+
+// objectError logs a failure to process an object
+func objectError(msg, manifest, key string, res objectResult, attrs ...any) objectResult {
+	logObject(slog.LevelError, msg, manifest, key, actionError, append(attrs, errorAttrs(res.err)...)...)
+	res.action = actionError
+	return res
+}
+
+// objectMissing logs an object referenced by a manifest that doesn't exist
+func objectMissing(manifest, key string) objectResult {
+	logObject(slog.LevelWarn, "Object not found", manifest, key, actionMissing)
+	return objectResult{action: actionMissing}
+}
+
+func (r *refresher) refresh(ctx context.Context, manifest, key string) objectResult {
+	target := r.target(manifest, key)
+	if !target.retainUntil.After(r.now) {
+		// With -anchor=backup, the retention of old backups may already be over
+		logObject(slog.LevelDebug, "Retention target already passed", manifest, key, actionSkipped, "retain_until", target.retainUntil)
+		return objectResult{action: actionSkipped}
+	}
+	var tags []types.Tag
+	tagsKnown := false
+	if r.tags != nil && r.tags.trust {
+		var current *ObjectRetention
+		if current, tags, tagsKnown = r.retainedPerTags(ctx, key, target); current != nil {
+			logObject(slog.LevelDebug, "Skipped object retained long enough per its tags", manifest, key, actionSkipped, "retain_until", *current.RetainUntil)
+			return objectResult{action: actionSkipped, previous: current}
+		}
+	}
+	current, needsUpdate, err := checkRetention(ctx, r.client, r.opts.bucket, key, target.requiredUntil, r.opts.mode)
+	if err != nil {
+		return objectError("Error checking retention", manifest, key, objectResult{err: err})
+	}
+	if current.Missing {
+		return objectMissing(manifest, key)
+	}
+	res := objectResult{previous: current}
+
+	// Reductions require both -allow-reduce and -bypass-governance
+	reduce := !needsUpdate && r.opts.allowReduce && r.opts.bypassGovernance && needsRetentionReduction(current, target.retainUntil)
+	if !needsUpdate && !reduce {
+		res.action = actionSkipped
+		return res
+	}
+
+	// COMPLIANCE retention can't be downgraded to GOVERNANCE, only extended
+	mode := r.opts.mode
+	if current.Mode == types.ObjectLockRetentionModeCompliance {
+		mode = current.Mode
+	}
+	res.retainUntil, res.mode = target.retainUntil, mode
+
+	if r.plan != nil {
+		r.plan.add(key, current, target.retainUntil, mode, reduce)
+	}
+
+	change := retentionChangeAttrs(current, target.retainUntil, mode)
+	if r.opts.dryRun {
+		if reduce {
+			res.action = actionWouldReduce
+			logObject(slog.LevelInfo, "[DRY-RUN] Would REDUCE retention", manifest, key, res.action, change...)
+			return res
+		}
+		res.action = actionWouldUpdate
+		logObject(slog.LevelInfo, "[DRY-RUN] Would update retention", manifest, key, res.action, change...)
+		return res
+	}
+
+	if res.err = r.recordRollback(key, current, target.retainUntil, mode); res.err != nil {
+		return objectError("Error recording previous retention", manifest, key, res, change...)
+	}
+	if res.err = updateRetention(ctx, r.client, r.opts.bucket, key, target.retainUntil, mode, reduce); res.err != nil {
+		return objectError("Error updating retention", manifest, key, res, change...)
+	}
+	if r.tags != nil {
+		r.tags.tag(ctx, manifest, key, tags, tagsKnown, target.retainUntil, mode)
+	}
+	if reduce {
+		res.action = actionReduced
+		logObject(slog.LevelDebug, "REDUCED retention", manifest, key, res.action, change...)
+		return res
+	}
+	res.action = actionUpdated
+	logObject(slog.LevelDebug, "Updated retention", manifest, key, res.action, change...)
+	return res
+}
+
+// validateObjectKey checks that key can name an object
+func validateObjectKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("empty key")
+	}
+	if strings.HasSuffix(key, "/") {
+		return fmt.Errorf("%s ends in / and is not an object key", key)
+	}
+	return nil
+}
+
+// loadKeysFile reads the object keys listed in path. Invalid keys are
+// reported and dropped without aborting the batch.
+func loadKeysFile(path string) ([]string, int, error) {
+	keys, err := readKeyListFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read keys file: %w", err)
+	}
+
+	var valid []string
+	invalid := 0
+	for _, key := range keys {
+		if err := validateObjectKey(key); err != nil {
+			slog.Warn("Skipping invalid object key", "error", err.Error())
+			invalid++
+			continue
+		}
+		valid = append(valid, key)
+	}
+	return valid, invalid, nil
+}
+
+// run refreshes retention for every object referenced by the selected manifests,
+// or for the objects listed in -keys-file
+func run(ctx context.Context, client S3API, opts *options) error {
+	r := newRefresher(client, opts, time.Now())
+	return r.runWithReport(ctx)
+}
+
+// needsCountConfirmation reports whether -confirm-threshold may require
+// confirmation before the run writes anything. Dry runs never prompt.
+func (r *refresher) needsCountConfirmation() bool {
+	return r.opts.confirmThreshold > 0 && !r.opts.dryRun && !r.opts.yes
+}
+
+// countObjects downloads manifests to count the objects the run will process,
+// keeping them for processing. Manifests that fail to download aren't counted
+// and are retried, and reported, when processed.
+func (r *refresher) countObjects(ctx context.Context, manifests []ManifestInfo) int {
+	count := 0
+	for _, m := range manifests {
+		if ctx.Err() != nil {
+			break
+		}
+		manifest, err := r.preloadManifest(ctx, m.Key)
+		if err != nil {
+			continue
+		}
+		mp, err := m.path()
+		if err != nil {
+			continue
+		}
+		hostnamePath := mp.HostnamePath
+		for _, obj := range manifest.Objects {
+			if r.opts.filter.skipReason(obj) == "" && !r.exclusions.match(resolveObjectKey(hostnamePath, obj.Path)) {
+				count++
+			}
+		}
+	}
+	if r.opts.limit > 0 && count > r.opts.limit {
+		count = r.opts.limit
+	}
+	return count
+}
+
+// preloadManifest downloads a manifest ahead of processing and keeps it for loadManifest
+func (r *refresher) preloadManifest(ctx context.Context, key string) (*Manifest, error) {
+	if manifest, ok := r.loaded[key]; ok {
+		return manifest, nil
+	}
+	manifest, err := r.fetchManifest(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if r.loaded == nil {
+		r.loaded = make(map[string]*Manifest)
+	}
+	r.loaded[key] = manifest
+	return manifest, nil
+}
+
+// loadManifest returns a manifest downloaded by preloadManifest, or downloads it
+func (r *refresher) loadManifest(ctx context.Context, key string) (*Manifest, error) {
+	if manifest, ok := r.loaded[key]; ok {
+		delete(r.loaded, key)
+		return manifest, nil
+	}
+	return r.fetchManifest(ctx, key)
+}
+
+// fetchManifest downloads a manifest, or reads it from -local-manifests
+func (r *refresher) fetchManifest(ctx context.Context, key string) (*Manifest, error) {
+	if r.opts.localManifests != "" {
+		return readLocalManifest(r.opts.localManifests, r.opts.prefix, key)
+	}
+	if r.manifests == nil {
+		return downloadManifest(ctx, r.client, r.opts.bucket, key)
+	}
+	if manifest, ok := r.manifests.get(key); ok {
+		return manifest, nil
+	}
+	manifest, err := downloadManifest(ctx, r.client, r.opts.bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	r.manifests.put(key, manifest)
+	return manifest, nil
+}
+
+// confirmObjectCount asks for confirmation before processing more than
+// -confirm-threshold objects. Without a terminal to ask on, the run is aborted.
+func (r *refresher) confirmObjectCount(objects, manifests int) error {
+	if objects <= r.opts.confirmThreshold {
+		return nil
+	}
+	if !r.prompt.tty {
+		return fmt.Errorf("aborted: %d objects exceed -confirm-threshold %d and stdin is not a terminal, pass -yes to proceed", objects, r.opts.confirmThreshold)
+	}
+	message := fmt.Sprintf("About to process %d objects from %d manifests in s3://%s/%s%s/, above -confirm-threshold %d.",
+		objects, manifests, r.opts.bucket, r.opts.prefix, r.opts.cluster, r.opts.confirmThreshold)
+	ok, err := confirm(r.prompt.in, r.prompt.out, message)
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if !ok {
+		return errors.New("aborted: object count was not confirmed")
+	}
+	return nil
+}
+
+// finish logs the run summary and emits it as the last event
+func (r *refresher) finish() {
+	if r.stopProgress != nil {
+		r.stopProgress()
+	}
+	if r.events != nil && r.events.firehose != nil {
+		// The summary counts the events that couldn't be delivered so far
+		r.stats.setFirehoseFailed(r.events.firehose.flush())
+	}
+	now := time.Now()
+	sum := r.stats.summary(now)
+	sum.log(r.emfSummaryAttrs(sum, now)...)
+	termination.setSummary(r.runID, sum)
+	if r.events != nil {
+		r.events.summary(now, sum)
+		if r.events.firehose != nil {
+			r.events.firehose.flush()
+		}
+	}
+}
+
+func (r *refresher) run(ctx context.Context) (err error) {
+	defer r.logRunID()()
+	ctx = withRunID(ctx, r.runID)
+	ctx, span := tracer().Start(ctx, "run", trace.WithAttributes(
+		attribute.String("cluster", r.opts.cluster),
+		attribute.String("aws.s3.bucket", r.opts.bucket),
+		attribute.Bool("dry_run", r.opts.dryRun),
+	))
+	// The span covers the notifications, and ends with the run's outcome
+	defer func() { endSpan(span, err) }()
+	// PagerDuty is paged last, of the run's final outcome
+	defer func() { r.notifyPagerDuty(ctx, err) }()
+	// The healthcheck is pinged the run's final outcome
+	if r.opts.healthcheckURL != "" {
+		defer func() { r.finishHealthcheck(ctx, err) }()
+		r.pingHealthcheck(ctx, healthcheckStart, nil)
+	}
+	// Slack is notified of the run's final outcome
+	defer func() { r.notifySlack(ctx, err) }()
+	// Webhooks are posted the run's outcome before Slack, which reports a
+	// failure of a -webhook-required one
+	defer func() { err = r.notifyWebhooks(ctx, err) }()
+	// The summary object is uploaded before the notifications, which report
+	// its failure
+	defer func() { err = r.uploadSummary(ctx, err) }()
+	// Metrics are exported once the summary is logged
+	defer func() { err = r.exportMetrics(ctx, err) }()
+	// Events are all delivered once the summary is emitted
+	defer func() { err = r.checkFirehose(err) }()
+	// The summary is logged even when the run fails or is interrupted
+	defer r.finish()
+	if r.opts.firehoseStream != "" {
+		if err = r.startFirehose(ctx); err != nil {
+			return err
+		}
+	}
+	if r.opts.metricsListen != "" {
+		stop, err := r.serveMetrics(ctx)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	if r.opts.cwNamespace != "" {
+		if r.cloudwatch == nil {
+			if r.cloudwatch, err = newCloudWatchClient(ctx, r.opts.commonOptions); err != nil {
+				return err
+			}
+		}
+		if r.opts.cwInterval > 0 {
+			defer r.startCloudWatch(ctx)()
+		}
+	}
+	err = r.withAudit(ctx, func() error { return r.process(ctx) })
+	if err == nil && r.reportErr != nil {
+		err = r.reportErr
+	}
+	if err == nil && r.opts.strictMD5 {
+		if n := r.stats.totalMD5Mismatches(); n > 0 {
+			err = fmt.Errorf("%d objects don't match the MD5 in their manifest (-strict-md5)", n)
+		}
+	}
+	if err == nil {
+		if unmatched := r.pins.unmatched(); len(unmatched) > 0 {
+			err = fmt.Errorf("%d pins in -pins-file match no discovered backup: %s", len(unmatched), strings.Join(unmatched, ", "))
+		}
+	}
+	if err == nil && ctx.Err() != nil {
+		err = fmt.Errorf("run interrupted: %w", ctx.Err())
+	}
+	if err == nil && r.opts.failOnStale {
+		if hosts, cluster := r.stats.staleBackups(); len(hosts) > 0 {
+			err = &exitError{code: exitStaleBackups, err: fmt.Errorf("%d hosts have no backup within -max-backup-age %s: %s", len(hosts), r.opts.maxBackupAge, strings.Join(hosts, ", "))}
+		} else if cluster {
+			err = &exitError{code: exitStaleBackups, err: fmt.Errorf("cluster %s has no backup within -max-backup-age %s", r.opts.cluster, r.opts.maxBackupAge)}
+		}
+	}
+	return err
+}
+
+// process walks the selected manifests, or -keys-file, and processes each object.
+// It stops early when ctx is canceled.
+func (r *refresher) process(ctx context.Context) error {
+	client, opts := r.client, r.opts
+	// The retention is counted from the start of the run, which a pass of
+	// -interval may begin long after the flags were checked
+	if opts.legalHold == "" {
+		if err := opts.checkRetainUntils(r.now); err != nil {
+			return err
+		}
+	}
+	if opts.excludeKeysFile != "" {
+		entries, err := readKeyListFile(opts.excludeKeysFile)
+		if err != nil {
+			return fmt.Errorf("failed to read -exclude-keys-file: %w", err)
+		}
+		r.exclusions = newKeyExclusions(entries)
+		slog.Info("Loaded exclusions from -exclude-keys-file", "keys", len(r.exclusions.keys), "prefixes", len(r.exclusions.prefixes))
+	}
+	if opts.keysFile != "" {
+		return r.runKeys(ctx)
+	}
+	if opts.pinsFile != "" {
+		pins, err := loadPins(ctx, client, opts, r.now)
+		if err != nil {
+			return fmt.Errorf("failed to read -pins-file: %w", err)
+		}
+		r.pins = pins
+		slog.Info("Loaded pins from -pins-file", "pins", len(pins))
+	}
+	if opts.stateTable != "" {
+		if err := r.openState(ctx); err != nil {
+			return err
+		}
+		// Backups processed before an error or interrupt are still recorded
+		defer r.state.flush(context.WithoutCancel(ctx))
+	}
+
+	manifests, err := resolveManifests(ctx, client, opts, r.index)
+	if err != nil {
+		return err
+	}
+	if opts.orphanReport != "" {
+		if err := r.reportOrphans(ctx, manifests); err != nil {
+			return err
+		}
+	}
+	// Pinned backups skip -stale-host-days and the selection filters
+	var pinned []ManifestInfo
+	if r.pins != nil {
+		pinned, manifests = r.setAsidePinned(manifests)
+	}
+
+	if opts.staleHostDays > 0 {
+		if manifests, err = r.skipStaleHosts(ctx, manifests); err != nil {
+			return err
+		}
+	}
+
+	if err := r.checkFreshness(ctx, append(manifests, pinned...)); err != nil {
+		return err
+	}
+
+	manifests, err = r.selectManifests(manifests)
+	if err != nil {
+		return err
+	}
+	manifests, capped := capManifests(manifests, opts.maxManifests)
+	if capped > 0 {
+		slog.Info("Capped manifests by -max-manifests", "max", opts.maxManifests, "skipped", capped)
+		r.stats.addManifestsCapped(capped)
+	}
+	if len(pinned) > 0 {
+		manifests = append(manifests, pinned...)
+		sortManifestsNewestFirst(manifests)
+	}
+	r.stats.addManifestsFound(len(manifests))
+
+	if r.needsBackupTargets() {
+		r.computeBackupTargets(ctx, manifests)
+	}
+	if r.state != nil {
+		manifests = r.skipRecordedBackups(ctx, manifests)
+	}
+	if r.usesMarkers() && !opts.ignoreMarkers {
+		manifests = r.skipMarkedBackups(ctx, manifests)
+	}
+	if opts.canary {
+		if manifests, err = r.canaryFirst(manifests); err != nil {
+			return err
+		}
+	}
+	if r.needsCountConfirmation() {
+		count := r.countObjects(ctx, manifests)
+		if err := r.confirmObjectCount(count, len(manifests)); err != nil {
+			return err
+		}
+		r.stats.setTotalObjects(count)
+	}
+	r.startProgress()
+
+	var export *objectExport
+	if opts.exportObjects != "" {
+		if export, err = openObjectExport(opts.exportObjects); err != nil {
+			return err
+		}
+		defer export.close()
+	}
+	var rindex *reverseIndex
+	if opts.reverseIndex != "" {
+		if rindex, err = openReverseIndex(opts.reverseIndex, manifests); err != nil {
+			return err
+		}
+		defer rindex.close()
+	}
+
+	skippedByFilter := make(map[string]int)
+	var hosts hostPaths
+	for i, m := range manifests {
+		if r.stopErr(ctx) != nil || r.limitReached() {
+			break
+		}
+		if i == 1 && r.canary != nil {
+			proceed, err := r.endCanary(len(manifests) - 1)
+			if err != nil {
+				return err
+			}
+			if !proceed {
+				break
+			}
+		}
+		manifestKey := m.Key
+		slog.Info("Processing manifest", "manifest", manifestKey)
+		r.stats.setCurrentManifest(manifestKey)
+		if r.events != nil {
+			r.events.manifestStarted(time.Now(), manifestKey)
+		}
+		ctx, span := tracer().Start(ctx, "manifest", trace.WithAttributes(attribute.String("manifest", manifestKey)))
+
+		manifest, err := r.loadManifest(ctx, manifestKey)
+		if err != nil {
+			slog.Error("Error downloading manifest", append([]any{"manifest", manifestKey}, errorAttrs(err)...)...)
+			r.stats.manifestDone(true)
+			endSpan(span, err)
+			continue
+		}
+		span.SetAttributes(attribute.String("schema", manifest.Schema), attribute.Int("objects", len(manifest.Objects)))
+		slog.Debug("Loaded manifest", "manifest", manifestKey, "schema", manifest.Schema, "objects", len(manifest.Objects))
+		r.stats.manifestLoaded(manifest.Schema)
+		r.schemas[manifestKey] = manifest.Schema
+
+		// Extract hostname path from manifest key: [prefix][cluster]/[hostname]/
+		// Data files are stored in a shared directory: [prefix][cluster]/[hostname]/data/
+		mp, err := m.path()
+		if err != nil {
+			slog.Error("Invalid manifest path", "manifest", manifestKey)
+			r.stats.manifestDone(true)
+			endSpan(span, err)
+			continue
+		}
+		hostnamePath := mp.HostnamePath
+		r.tables.record(m, manifest, hostnamePath)
+		r.sharing.record(m, manifest, hostnamePath)
+		hosts.add(hostnamePath)
+		if export != nil {
+			if err := export.export(m, manifest, hostnamePath); err != nil {
+				endSpan(span, err)
+				return err
+			}
+		}
+		if rindex != nil {
+			if err := rindex.add(m, manifest, hostnamePath); err != nil {
+				endSpan(span, err)
+				return err
+			}
+		}
+
+		// A backup is only recorded in -state-dynamodb-table, and marked
+		// refreshed, when all its objects were processed
+		partial := false
+		for _, obj := range manifest.Objects {
+			if r.stopErr(ctx) != nil {
+				break
+			}
+			if reason := opts.filter.skipReason(obj); reason != "" {
+				skippedByFilter[reason]++
+				r.stats.objectFiltered(reason)
+				partial = true
+				continue
+			}
+
+			key := resolveObjectKey(hostnamePath, obj.Path)
+			if r.excluded(manifestKey, key) {
+				partial = true
+				continue
+			}
+			objCtx := r.objectContext(ctx, key)
+			if reason := r.lastModifiedSkipReason(objCtx, key); reason != "" {
+				skippedByFilter[reason]++
+				r.stats.objectFiltered(reason)
+				partial = true
+				continue
+			}
+			if !r.take() {
+				break
+			}
+			r.stats.manifestObjectReferenced(key, obj)
+			if r.offline != nil {
+				r.planOffline(manifestKey, key)
+				continue
+			}
+			// Both checks run so each mismatch is reported
+			sizeMismatched := r.sizeMismatched(objCtx, manifestKey, key, obj.Size)
+			md5Mismatched := r.md5Mismatched(objCtx, manifestKey, key, obj.MD5)
+			if (sizeMismatched || md5Mismatched) && opts.skipMismatched {
+				logObject(slog.LevelDebug, "Skipped object that doesn't match the manifest", manifestKey, key, actionSkippedMismatched)
+				r.recordResult(manifestKey, key, objectResult{action: actionSkippedMismatched})
+				continue
+			}
+			r.refreshObject(ctx, manifestKey, key)
+		}
+		if n := r.stats.manifestSizeMismatches(manifestKey); n > 0 {
+			slog.Warn("Backup integrity: objects don't match the sizes in the manifest", "manifest", manifestKey, "mismatches", n)
+		}
+		if n := r.stats.manifestMD5Mismatches(manifestKey); n > 0 {
+			slog.Warn("Backup integrity: objects don't match the MD5s in the manifest", "manifest", manifestKey, "mismatches", n)
+		}
+
+		failed := false
+		// Meta files are only known from a listing, which -offline doesn't make
+		if !opts.excludeMeta && r.offline == nil && r.stopErr(ctx) == nil && !r.limitReached() {
+			failed = !r.refreshMeta(ctx, manifestKey)
+		}
+		r.stats.manifestDone(failed)
+		if failed {
+			span.SetStatus(codes.Error, "failed to list meta files")
+		}
+		if r.state != nil && !failed && !partial && !opts.dryRun && r.stopErr(ctx) == nil && !r.limitReached() {
+			if r.state.backupDone(m) {
+				r.state.flush(ctx)
+			}
+		}
+		if r.retained != nil && !failed && !partial && r.stopErr(ctx) == nil && !r.limitReached() {
+			r.writeMarker(ctx, m)
+		}
+		span.End()
+	}
+	if r.canary != nil && !r.canary.done && r.stopErr(ctx) == nil {
+		// The canary was the only manifest, or -limit was reached in it
+		if _, err := r.endCanary(0); err != nil {
+			return err
+		}
+	}
+	r.stats.setCurrentManifest("")
+	if len(opts.extraPrefixes) > 0 {
+		r.refreshExtraPrefixes(ctx, hosts.paths, skippedByFilter)
+	}
+	if export != nil {
+		if err := export.close(); err != nil {
+			return err
+		}
+		slog.Info("Exported backup objects", "path", opts.exportObjects, "manifests", export.manifests, "objects", export.objects)
+	}
+	if rindex != nil {
+		if err := rindex.close(); err != nil {
+			return err
+		}
+		slog.Info("Wrote reverse index", "path", opts.reverseIndex, "objects", rindex.objects)
+	}
+
+	for _, reason := range filterReasons {
+		if skippedByFilter[reason] > 0 {
+			slog.Info("Skipped objects by filter", "filter", "-"+reason, "objects", skippedByFilter[reason])
+		}
+	}
+	r.reportDroppedTables()
+	r.reportCoverage()
+	r.reportSharing()
+	if r.forecast != nil {
+		if err := r.writeExpiryForecast(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runKeys refreshes retention for the object keys listed in -keys-file,
+// bypassing manifest discovery entirely
+func (r *refresher) runKeys(ctx context.Context) error {
+	keys, invalid, err := loadKeysFile(r.opts.keysFile)
+	if err != nil {
+		return err
+	}
+	slog.Info("Loaded object keys from -keys-file", "keys", len(keys), "invalid", invalid)
+
+	if r.needsCountConfirmation() {
+		count := len(keys)
+		if r.opts.limit > 0 && count > r.opts.limit {
+			count = r.opts.limit
+		}
+		if err := r.confirmObjectCount(count, 0); err != nil {
+			return err
+		}
+	}
+	r.stats.setTotalObjects(len(keys))
+	r.startProgress()
+
+	for _, key := range keys {
+		if r.stopErr(ctx) != nil {
+			break
+		}
+		if r.excluded("", key) {
+			continue
+		}
+		if reason := r.lastModifiedSkipReason(r.objectContext(ctx, key), key); reason != "" {
+			r.stats.objectFiltered(reason)
+			continue
+		}
+		if !r.take() {
+			break
+		}
+		r.stats.objectReferenced(key)
+		r.refreshObject(ctx, "", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,948 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeBucket is an in-memory bucket backing a MockS3Client for end-to-end run tests
+type fakeBucket struct {
+	mu        sync.Mutex
+	objects   map[string]string    // key -> body
+	retention map[string]time.Time // key -> RetainUntilDate
+	listCalls int
+	listed    []string // prefixes listed in full, without a delimiter
+	getCalls  int      // refreshed markers aside
+	puts      []*s3.PutObjectRetentionInput
+	holds     map[string]types.ObjectLockLegalHoldStatus // key -> legal hold status
+	holdPuts  []*s3.PutObjectLegalHoldInput
+	classes   map[string]types.ObjectStorageClass // key -> storage class, STANDARD when unset
+	modified  map[string]time.Time                // key -> LastModified, unknown when unset
+	etags     map[string]string                   // key -> ETag, the quoted MD5 of the body when unset
+	headCalls int
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{
+		objects:   make(map[string]string),
+		retention: make(map[string]time.Time),
+		holds:     make(map[string]types.ObjectLockLegalHoldStatus),
+		classes:   make(map[string]types.ObjectStorageClass),
+		modified:  make(map[string]time.Time),
+		etags:     make(map[string]string),
+	}
+}
+
+// client returns a MockS3Client serving the bucket contents
+func (b *fakeBucket) client() *MockS3Client {
+	return &MockS3Client{
+		ListObjectsV2Func: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.listCalls++
+			prefix, delimiter := aws.ToString(params.Prefix), aws.ToString(params.Delimiter)
+			if delimiter == "" {
+				b.listed = append(b.listed, prefix)
+			}
+			out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+			common := make(map[string]bool)
+			for key, body := range b.objects {
+				if delimiter != "" && strings.HasPrefix(key, prefix) {
+					if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+						if p := key[:len(prefix)+i+len(delimiter)]; !common[p] {
+							common[p] = true
+							out.CommonPrefixes = append(out.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(p)})
+						}
+						continue
+					}
+				}
+				if strings.HasPrefix(key, prefix) {
+					obj := types.Object{Key: aws.String(key), StorageClass: b.classes[key], Size: aws.Int64(int64(len(body))), ETag: aws.String(b.etag(key, body))}
+					if modified, ok := b.modified[key]; ok {
+						obj.LastModified = aws.Time(modified)
+					}
+					out.Contents = append(out.Contents, obj)
+				}
+			}
+			return out, nil
+		},
+		GetObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if !isMarkerKey(aws.ToString(params.Key)) {
+				b.getCalls++
+			}
+			body, ok := b.objects[aws.ToString(params.Key)]
+			if !ok {
+				return nil, errors.New("NoSuchKey")
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+		GetObjectRetentionFunc: func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			key := aws.ToString(params.Key)
+			if _, ok := b.objects[key]; !ok {
+				return nil, errors.New("NoSuchKey")
+			}
+			until, ok := b.retention[key]
+			if !ok {
+				return nil, errors.New("NoSuchObjectLockConfiguration")
+			}
+			return &s3.GetObjectRetentionOutput{
+				Retention: &types.ObjectLockRetention{
+					Mode:            types.ObjectLockRetentionModeGovernance,
+					RetainUntilDate: aws.Time(until),
+				},
+			}, nil
+		},
+		PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			key := aws.ToString(params.Key)
+			if _, ok := b.objects[key]; !ok {
+				return nil, errors.New("NoSuchKey")
+			}
+			b.puts = append(b.puts, params)
+			b.retention[key] = aws.ToTime(params.Retention.RetainUntilDate)
+			return &s3.PutObjectRetentionOutput{}, nil
+		},
+		GetObjectLegalHoldFunc: func(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error) {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			key := aws.ToString(params.Key)
+			if _, ok := b.objects[key]; !ok {
+				return nil, errors.New("NoSuchKey")
+			}
+			status, ok := b.holds[key]
+			if !ok {
+				return nil, errors.New("NoSuchObjectLockConfiguration")
+			}
+			return &s3.GetObjectLegalHoldOutput{LegalHold: &types.ObjectLockLegalHold{Status: status}}, nil
+		},
+		PutObjectLegalHoldFunc: func(ctx context.Context, params *s3.PutObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.PutObjectLegalHoldOutput, error) {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			key := aws.ToString(params.Key)
+			if _, ok := b.objects[key]; !ok {
+				return nil, errors.New("NoSuchKey")
+			}
+			b.holdPuts = append(b.holdPuts, params)
+			b.holds[key] = params.LegalHold.Status
+			return &s3.PutObjectLegalHoldOutput{}, nil
+		},
+		HeadObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.headCalls++
+			key := aws.ToString(params.Key)
+			body, ok := b.objects[key]
+			if !ok {
+				return nil, errors.New("NotFound")
+			}
+			out := &s3.HeadObjectOutput{StorageClass: types.StorageClass(b.classes[key]), ContentLength: aws.Int64(int64(len(body))), ETag: aws.String(b.etag(key, body))}
+			if modified, ok := b.modified[key]; ok {
+				out.LastModified = aws.Time(modified)
+			}
+			return out, nil
+		},
+	}
+}
+
+// etag returns the ETag of key, which S3 computes as the MD5 of single-part uploads
+func (b *fakeBucket) etag(key, body string) string {
+	if etag, ok := b.etags[key]; ok {
+		return etag
+	}
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum([]byte(body))))
+}
+
+// putKeys returns the keys of all PutObjectRetention calls in order
+func (b *fakeBucket) putKeys() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for _, put := range b.puts {
+		keys = append(keys, aws.ToString(put.Key))
+	}
+	return keys
+}
+
+// testOptions returns valid options for run tests
+func testOptions() *options {
+	return &options{
+		commonOptions: commonOptions{bucket: "test-bucket", cluster: "links"},
+		minRetention:  retentionPeriod{days: 7},
+		maxRetention:  retentionPeriod{days: 30},
+		mode:          types.ObjectLockRetentionModeGovernance,
+		// Most tests count data file updates; meta files are covered by TestRunRefreshesMeta
+		excludeMeta: true,
+		// Test backups are named after fixed, long past dates; expiry is covered by TestRunSkipsExpiredBackups
+		refreshExpired: true,
+	}
+}
+
+func TestValidateManifestKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		force   bool
+		wantErr bool
+	}{
+		{
+			name: "valid manifest key",
+			key:  "links/host1/medusa-backup-schedule-1764858600/meta/manifest.json",
+		},
+		{
+			name:    "wrong suffix",
+			key:     "links/host1/medusa-backup-schedule-1764858600/meta/manifest.json.bak",
+			wantErr: true,
+		},
+		{
+			name:  "wrong suffix with force",
+			key:   "links/host1/medusa-backup-schedule-1764858600/meta/manifest.json.bak",
+			force: true,
+		},
+		{
+			name:    "too few segments even with force",
+			key:     "links/manifest.json",
+			force:   true,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateManifestKey(tt.key, "", 0, tt.force)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateManifestKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunSingleManifestKey(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/backup1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/backup2/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+
+	opts := testOptions()
+	opts.manifestKey = "links/host1/backup1/meta/manifest.json"
+
+	if err := run(context.Background(), bucket.client(), opts); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if bucket.listCalls != 0 {
+		t.Errorf("run() listed the bucket %d times, want discovery to be bypassed", bucket.listCalls)
+	}
+	if got := bucket.putKeys(); len(got) != 1 || got[0] != "links/host1/data/ks/t/a.db" {
+		t.Errorf("run() updated %v, want only links/host1/data/ks/t/a.db", got)
+	}
+}
+
+func TestReadKeyList(t *testing.T) {
+	input := "# comment\n\nkey1\n  key2  \n#key3\n"
+	got, err := readKeyList(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("readKeyList() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{"key1", "key2"}) {
+		t.Errorf("readKeyList() = %v, want [key1 key2]", got)
+	}
+}
+
+func TestLoadManifestsFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		force       bool
+		want        []string
+		wantInvalid int
+	}{
+		{
+			name: "invalid keys are reported and skipped",
+			want: []string{
+				"links/host1/medusa-backup-schedule-1764858600/meta/manifest.json",
+				"links/host2/medusa-backup-schedule-1764858600/meta/manifest.json",
+				"links/host1/adhoc-before-upgrade/meta/manifest.json",
+			},
+			wantInvalid: 2,
+		},
+		{
+			name:  "force accepts non-manifest suffix",
+			force: true,
+			want: []string{
+				"links/host1/medusa-backup-schedule-1764858600/meta/manifest.json",
+				"links/host2/medusa-backup-schedule-1764858600/meta/manifest.json",
+				"links/host3/medusa-backup-schedule-1764858600/meta/schema.cql",
+				"links/host1/adhoc-before-upgrade/meta/manifest.json",
+			},
+			wantInvalid: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, invalid, err := loadManifestsFile("testdata/manifests.txt", "", 0, tt.force)
+			if err != nil {
+				t.Fatalf("loadManifestsFile() error = %v", err)
+			}
+			if !reflect.DeepEqual(manifestKeys(got), tt.want) {
+				t.Errorf("loadManifestsFile() = %v, want %v", manifestKeys(got), tt.want)
+			}
+			if invalid != tt.wantInvalid {
+				t.Errorf("loadManifestsFile() invalid = %d, want %d", invalid, tt.wantInvalid)
+			}
+		})
+	}
+}
+
+func TestLoadManifestsFileMissing(t *testing.T) {
+	if _, _, err := loadManifestsFile("testdata/does-not-exist.txt", "", 0, false); err == nil {
+		t.Error("loadManifestsFile() expected error for missing file")
+	}
+}
+
+func TestRunManifestsFileWithFilterAndDryRun(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/medusa-backup-schedule-1764858600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+
+	opts := testOptions()
+	opts.manifestsFile = "testdata/manifests.txt"
+	opts.backupName = "medusa-backup-schedule-*"
+	opts.dryRun = true
+
+	if err := run(context.Background(), bucket.client(), opts); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if bucket.listCalls != 0 {
+		t.Errorf("run() listed the bucket %d times, want discovery to be bypassed", bucket.listCalls)
+	}
+	if got := bucket.putKeys(); len(got) != 0 {
+		t.Errorf("run() updated %v in dry-run mode", got)
+	}
+}
+
+func TestLoadKeysFile(t *testing.T) {
+	got, invalid, err := loadKeysFile("testdata/keys.txt")
+	if err != nil {
+		t.Fatalf("loadKeysFile() error = %v", err)
+	}
+	want := []string{"links/host1/data/ks/t/a.db", "links/host1/data/ks/t/b.db", "links/host2/data/ks/t/c.db"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadKeysFile() = %v, want %v", got, want)
+	}
+	if invalid != 1 {
+		t.Errorf("loadKeysFile() invalid = %d, want 1", invalid)
+	}
+}
+
+func TestRunKeysFileBypassesManifests(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	bucket.objects["links/host2/data/ks/t/c.db"] = ""
+	// b.db is already retained long enough
+	bucket.retention["links/host1/data/ks/t/b.db"] = time.Now().AddDate(0, 0, 60)
+
+	opts := testOptions()
+	opts.keysFile = "testdata/keys.txt"
+
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.runKeys(context.Background()); err != nil {
+		t.Fatalf("runKeys() error = %v", err)
+	}
+
+	if bucket.listCalls != 0 || bucket.getCalls != 0 {
+		t.Errorf("runKeys() made %d list and %d get calls, want the manifest path bypassed", bucket.listCalls, bucket.getCalls)
+	}
+	if !reflect.DeepEqual(bucket.putKeys(), []string{"links/host1/data/ks/t/a.db", "links/host2/data/ks/t/c.db"}) {
+		t.Errorf("runKeys() updated %v", bucket.putKeys())
+	}
+	if r.stats.actions[actionUpdated] != 2 || r.stats.actions[actionSkipped] != 1 {
+		t.Errorf("runKeys() counts = %v, want 2 updated and 1 skipped", r.stats.actions)
+	}
+}
+
+func TestRunKeysFileDryRun(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+
+	opts := testOptions()
+	opts.keysFile = "testdata/keys.txt"
+	opts.dryRun = true
+
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.runKeys(context.Background()); err != nil {
+		t.Fatalf("runKeys() error = %v", err)
+	}
+
+	if len(bucket.puts) != 0 {
+		t.Errorf("runKeys() updated %v in dry-run mode", bucket.putKeys())
+	}
+	// b.db and c.db don't exist
+	if r.stats.actions[actionWouldUpdate] != 1 || r.stats.actions[actionMissing] != 2 {
+		t.Errorf("runKeys() counts = %v, want 1 would update and 2 missing", r.stats.actions)
+	}
+}
+
+func TestNewRefresherRetainUntil(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	litigation := time.Date(2027, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	opts := &options{commonOptions: commonOptions{bucket: "test-bucket", cluster: "links"}, retainUntil: litigation}
+	r := newRefresher(nil, opts, now)
+	if !r.retainUntil.Equal(litigation) || !r.requiredUntil.Equal(litigation) {
+		t.Errorf("newRefresher() retainUntil = %v, requiredUntil = %v, want both %v", r.retainUntil, r.requiredUntil, litigation)
+	}
+
+	opts.minRetention = retentionPeriod{days: 7}
+	r = newRefresher(nil, opts, now)
+	if !r.retainUntil.Equal(litigation) || !r.requiredUntil.Equal(now.AddDate(0, 0, 7)) {
+		t.Errorf("newRefresher() with -min-retention retainUntil = %v, requiredUntil = %v", r.retainUntil, r.requiredUntil)
+	}
+}
+
+func TestRefreshObjectReduction(t *testing.T) {
+	key := "links/host1/data/ks/t/a.db"
+	overExtended := time.Now().AddDate(0, 0, 365)
+
+	tests := []struct {
+		name             string
+		allowReduce      bool
+		bypassGovernance bool
+		dryRun           bool
+		want             objectAction
+		wantPut          bool
+	}{
+		{name: "never reduces without flags", want: actionSkipped},
+		{name: "allow-reduce alone doesn't reduce", allowReduce: true, want: actionSkipped},
+		{name: "bypass-governance alone doesn't reduce", bypassGovernance: true, want: actionSkipped},
+		{name: "reduces with both flags", allowReduce: true, bypassGovernance: true, want: actionReduced, wantPut: true},
+		{name: "dry-run marks reduction", allowReduce: true, bypassGovernance: true, dryRun: true, want: actionWouldReduce},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects[key] = ""
+			bucket.retention[key] = overExtended
+
+			opts := testOptions()
+			opts.allowReduce = tt.allowReduce
+			opts.bypassGovernance = tt.bypassGovernance
+			opts.dryRun = tt.dryRun
+
+			r := newRefresher(bucket.client(), opts, time.Now())
+			if got := r.refreshObject(context.Background(), "", key); got != tt.want {
+				t.Errorf("refreshObject() = %v, want %v", got, tt.want)
+			}
+
+			if !tt.wantPut {
+				if len(bucket.puts) != 0 {
+					t.Errorf("refreshObject() made %d puts, want none", len(bucket.puts))
+				}
+				if !bucket.retention[key].Equal(overExtended) {
+					t.Errorf("retention lowered to %v without permission", bucket.retention[key])
+				}
+				return
+			}
+			if len(bucket.puts) != 1 || !aws.ToBool(bucket.puts[0].BypassGovernanceRetention) {
+				t.Fatalf("refreshObject() puts = %v, want one put with BypassGovernanceRetention", bucket.puts)
+			}
+			if !bucket.retention[key].Equal(r.retainUntil) {
+				t.Errorf("retention = %v, want %v", bucket.retention[key], r.retainUntil)
+			}
+		})
+	}
+}
+
+// countingClient wraps client to record the keys whose retention was checked
+func countingClient(client *MockS3Client) (*MockS3Client, func() []string) {
+	var mu sync.Mutex
+	var keys []string
+	getRetention := client.GetObjectRetentionFunc
+	client.GetObjectRetentionFunc = func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+		mu.Lock()
+		keys = append(keys, aws.ToString(params.Key))
+		mu.Unlock()
+		return getRetention(ctx, params, optFns...)
+	}
+	return client, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), keys...)
+	}
+}
+
+func TestRunLimit(t *testing.T) {
+	// statsBucket references 6 objects across two readable manifests
+	tests := []struct {
+		name      string
+		limit     int
+		dryRun    bool
+		exclude   string
+		keysFile  string
+		want      int
+		wantLimit bool
+	}{
+		{name: "stops within a manifest", limit: 1, want: 1, wantLimit: true},
+		{name: "spans manifests", limit: 5, want: 5, wantLimit: true},
+		{name: "dry-run", limit: 3, dryRun: true, want: 3, wantLimit: true},
+		{name: "filtered objects don't count", limit: 2, exclude: "ks", want: 0},
+		{name: "keys file", limit: 1, keysFile: "testdata/keys.txt", want: 1, wantLimit: true},
+		{name: "above the object count", limit: 100, want: 6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.limit = tt.limit
+			opts.dryRun = tt.dryRun
+			opts.keysFile = tt.keysFile
+			if tt.exclude != "" {
+				opts.filter.excludeKeyspaces = stringList{tt.exclude}
+			}
+			client, attempted := countingClient(statsBucket())
+
+			r := newRefresher(client, opts, time.Now())
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if got := attempted(); len(got) != tt.want {
+				t.Errorf("run() attempted %v, want %d objects", got, tt.want)
+			}
+			if r.stats.objectsReferenced != tt.want {
+				t.Errorf("objects referenced = %d, want %d", r.stats.objectsReferenced, tt.want)
+			}
+			if r.stats.limitReached != tt.wantLimit {
+				t.Errorf("limitReached = %v, want %v", r.stats.limitReached, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestTakeConcurrent(t *testing.T) {
+	opts := testOptions()
+	opts.limit = 10
+	r := newRefresher(newFakeBucket().client(), opts, time.Now())
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r.take() {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if taken != 10 {
+		t.Errorf("take() granted %d objects, want exactly 10", taken)
+	}
+	if !r.stats.limitReached {
+		t.Error("take() didn't record that the limit was reached")
+	}
+}
+
+func TestRunMaxManifests(t *testing.T) {
+	bucket := newFakeBucket()
+	for _, backup := range []string{"medusa-backup-schedule-1700000000", "medusa-backup-schedule-1764858600", "medusa-backup-schedule-1750000000", "adhoc-undated"} {
+		bucket.objects["links/host1/"+backup+"/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/` + backup + `.db"}]}]`
+		bucket.objects["links/host1/data/ks/t/"+backup+".db"] = ""
+	}
+
+	opts := testOptions()
+	opts.maxManifests = 2
+	opts.since = time.Unix(1710000000, 0)
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	// The undated backup survives -since but sorts last, so the two newest dated backups are processed, newest first
+	want := []string{"links/host1/data/ks/t/medusa-backup-schedule-1764858600.db", "links/host1/data/ks/t/medusa-backup-schedule-1750000000.db"}
+	if got := bucket.putKeys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("run() updated %v, want %v", got, want)
+	}
+	if r.stats.manifestsFound != 2 || r.stats.manifestsCapped != 1 {
+		t.Errorf("manifests found = %d, capped = %d, want 2 and 1", r.stats.manifestsFound, r.stats.manifestsCapped)
+	}
+}
+
+func TestRunLatestOnly(t *testing.T) {
+	bucket := newFakeBucket()
+	for _, backup := range []string{"host1/medusa-backup-schedule-1700000000", "host1/medusa-backup-schedule-1764858600", "host2/medusa-backup-schedule-1750000000"} {
+		bucket.objects["links/"+backup+"/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/` + strings.Split(backup, "/")[1] + `.db"}]}]`
+	}
+
+	opts := testOptions()
+	opts.latestOnly = true
+	opts.dryRun = true
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	want := map[string]string{"host1": "medusa-backup-schedule-1764858600", "host2": "medusa-backup-schedule-1750000000"}
+	if got := r.stats.summary(time.Now()).LatestBackups; !reflect.DeepEqual(got, want) {
+		t.Errorf("summary latest backups = %v, want %v", got, want)
+	}
+	if r.stats.manifestsProcessed != 2 {
+		t.Errorf("manifests processed = %d, want the latest of each host", r.stats.manifestsProcessed)
+	}
+}
+
+func TestRunKeepLastAfterTimeFilter(t *testing.T) {
+	bucket := newFakeBucket()
+	for _, backup := range []string{"medusa-backup-schedule-1700000000", "medusa-backup-schedule-1710000000", "medusa-backup-schedule-1720000000", "medusa-backup-schedule-1790000000"} {
+		bucket.objects["links/host1/"+backup+"/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/` + backup + `.db"}]}]`
+		bucket.objects["links/host1/data/ks/t/"+backup+".db"] = ""
+	}
+
+	opts := testOptions()
+	opts.keepLast = 2
+	opts.until = time.Unix(1750000000, 0)
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	// -until drops the newest backup first, then the two newest remaining are kept
+	want := []string{"links/host1/data/ks/t/medusa-backup-schedule-1720000000.db", "links/host1/data/ks/t/medusa-backup-schedule-1710000000.db"}
+	if got := bucket.putKeys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("run() updated %v, want %v", got, want)
+	}
+}
+
+func TestRunExcludeSystemKeyspaces(t *testing.T) {
+	for _, exclude := range []bool{false, true} {
+		t.Run(fmt.Sprintf("exclude=%v", exclude), func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"system","columnfamily":"local","objects":[{"path":"data/system/local/a.db"}]},{"keyspace":"system_schema","columnfamily":"tables","objects":[{"path":"data/system_schema/tables/b.db"}]},{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/c.db"}]}]`
+
+			opts := testOptions()
+			opts.dryRun = true
+			opts.filter.excludeSystem = exclude
+			r := newRefresher(bucket.client(), opts, time.Now())
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			wantProcessed, wantSkipped := 3, 0
+			if exclude {
+				wantProcessed, wantSkipped = 1, 2
+			}
+			if r.stats.objectsReferenced != wantProcessed {
+				t.Errorf("objects referenced = %d, want %d", r.stats.objectsReferenced, wantProcessed)
+			}
+			if got := r.stats.summary(time.Now()).SkippedByFilter["exclude-system-keyspaces"]; got != wantSkipped {
+				t.Errorf("summary skipped_by_filter = %d, want %d", got, wantSkipped)
+			}
+		})
+	}
+}
+
+func TestCountObjectsReusesManifests(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+
+	opts := testOptions()
+	opts.confirmThreshold = 1
+	r := newRefresher(bucket.client(), opts, time.Now())
+	r.prompt = prompt{in: strings.NewReader("yes\n"), out: io.Discard, tty: true}
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if bucket.getCalls != 1 {
+		t.Errorf("run() downloaded the manifest %d times, want once", bucket.getCalls)
+	}
+	if len(bucket.puts) != 2 {
+		t.Errorf("run() updated %v, want both objects", bucket.putKeys())
+	}
+}
+
+func TestRunExcludeKeysFile(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]},{"keyspace":"other","columnfamily":"t","objects":[{"path":"data/other/t/c.db"},{"path":"data/other/t/d.db"}]}]`
+	for _, key := range []string{"a.db", "b.db"} {
+		bucket.objects["links/host1/data/ks/t/"+key] = ""
+	}
+	for _, key := range []string{"c.db", "d.db"} {
+		bucket.objects["links/host1/data/other/t/"+key] = ""
+	}
+	client, calls := countingClient(bucket.client())
+
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.excludeKeysFile = filepath.Join(dir, "exclude.txt")
+	opts.report = filepath.Join(dir, "report.jsonl")
+	exclusions := "# keep these untouched\nlinks/host1/data/ks/t/a.db\nlinks/host1/data/other/*\n"
+	if err := os.WriteFile(opts.excludeKeysFile, []byte(exclusions), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := run(context.Background(), client, opts); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(bucket.putKeys(), []string{"links/host1/data/ks/t/b.db"}) {
+		t.Errorf("run() updated %v, want only the key not excluded", bucket.putKeys())
+	}
+	for _, key := range calls() {
+		if key != "links/host1/data/ks/t/b.db" {
+			t.Errorf("run() read the retention of excluded key %s", key)
+		}
+	}
+	excluded := 0
+	for _, record := range readReport(t, opts.report) {
+		if record["action"] == string(actionExcluded) {
+			excluded++
+		}
+	}
+	if excluded != 3 {
+		t.Errorf("report has %d excluded records, want 3", excluded)
+	}
+}
+
+func TestRunExcludeKeysFileMissing(t *testing.T) {
+	bucket := newFakeBucket()
+	opts := testOptions()
+	opts.excludeKeysFile = filepath.Join(t.TempDir(), "missing.txt")
+
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err == nil || !strings.Contains(err.Error(), "-exclude-keys-file") {
+		t.Errorf("run() error = %v, want a -exclude-keys-file error", err)
+	}
+	if bucket.listCalls != 0 {
+		t.Errorf("run() listed the bucket %d times before failing", bucket.listCalls)
+	}
+}
+
+func TestRunWithPrefix(t *testing.T) {
+	for _, prefix := range []string{"backups/prod", "backups/prod/"} {
+		t.Run(prefix, func(t *testing.T) {
+			bucket := newFakeBucket()
+			// an old-format manifest with relative paths and a new-format one with full keys
+			bucket.objects["backups/prod/links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+			bucket.objects["backups/prod/links/host2/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"backups/prod/links/host2/data/ks/t/b.db"}]}]`
+			bucket.objects["links/host3/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/c.db"}]}]`
+			bucket.objects["backups/prod/links/host1/data/ks/t/a.db"] = ""
+			bucket.objects["backups/prod/links/host2/data/ks/t/b.db"] = ""
+			bucket.objects["links/host3/data/ks/t/c.db"] = ""
+
+			args := []string{"-bucket", "test-bucket", "-prefix", prefix, "-cluster", "links", "-min-retention", "7", "-max-retention", "30", "-backup-name", "b1", "-exclude-meta"}
+			opts, err := parseRefreshOptions(args)
+			if err != nil {
+				t.Fatalf("parseRefreshOptions() error = %v", err)
+			}
+			if err := run(context.Background(), bucket.client(), opts); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			want := []string{"backups/prod/links/host1/data/ks/t/a.db", "backups/prod/links/host2/data/ks/t/b.db"}
+			if got := bucket.putKeys(); !reflect.DeepEqual(got, want) {
+				t.Errorf("run() updated %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRunLastModifiedFilters(t *testing.T) {
+	now := time.Now()
+	ago := func(days int) time.Time { return now.AddDate(0, 0, -days) }
+
+	tests := []struct {
+		name        string
+		keysFile    bool
+		olderThan   time.Time
+		newerThan   time.Time
+		wantUpdated []string
+		wantSkipped map[string]int
+		wantUnknown int
+	}{
+		{
+			name:        "older-than",
+			olderThan:   ago(60),
+			wantUpdated: []string{"links/host1/data/ks/t/old.db", "links/host1/data/ks/t/unknown.db"},
+			wantSkipped: map[string]int{"older-than": 2},
+			wantUnknown: 1,
+		},
+		{
+			name:        "newer-than",
+			newerThan:   ago(60),
+			wantUpdated: []string{"links/host1/data/ks/t/mid.db", "links/host1/data/ks/t/new.db", "links/host1/data/ks/t/unknown.db"},
+			wantSkipped: map[string]int{"newer-than": 1},
+			wantUnknown: 1,
+		},
+		{
+			name:        "window",
+			olderThan:   ago(7),
+			newerThan:   ago(60),
+			wantUpdated: []string{"links/host1/data/ks/t/mid.db", "links/host1/data/ks/t/unknown.db"},
+			wantSkipped: map[string]int{"older-than": 1, "newer-than": 1},
+			wantUnknown: 1,
+		},
+		{
+			name:        "keys file looks objects up",
+			keysFile:    true,
+			olderThan:   ago(60),
+			wantUpdated: []string{"links/host1/data/ks/t/old.db", "links/host1/data/ks/t/unknown.db"},
+			wantSkipped: map[string]int{"older-than": 2},
+			wantUnknown: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/old.db"},{"path":"data/ks/t/mid.db"},{"path":"data/ks/t/new.db"},{"path":"data/ks/t/unknown.db"}]}]`
+			keys := []string{"links/host1/data/ks/t/old.db", "links/host1/data/ks/t/mid.db", "links/host1/data/ks/t/new.db", "links/host1/data/ks/t/unknown.db"}
+			for _, key := range keys {
+				bucket.objects[key] = ""
+			}
+			bucket.modified["links/host1/data/ks/t/old.db"] = ago(90)
+			bucket.modified["links/host1/data/ks/t/mid.db"] = ago(30)
+			bucket.modified["links/host1/data/ks/t/new.db"] = ago(1)
+
+			opts := testOptions()
+			opts.olderThan, opts.newerThan = tt.olderThan, tt.newerThan
+			if tt.keysFile {
+				opts.keysFile = filepath.Join(t.TempDir(), "keys.txt")
+				if err := os.WriteFile(opts.keysFile, []byte(strings.Join(keys, "\n")), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := newRefresher(bucket.client(), opts, now)
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			got := bucket.putKeys()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.wantUpdated) {
+				t.Errorf("run() updated %v, want %v", got, tt.wantUpdated)
+			}
+			sum := r.stats.summary(time.Now())
+			if !reflect.DeepEqual(sum.SkippedByFilter, tt.wantSkipped) {
+				t.Errorf("summary skipped_by_filter = %v, want %v", sum.SkippedByFilter, tt.wantSkipped)
+			}
+			if sum.LastModifiedUnknown != tt.wantUnknown {
+				t.Errorf("summary last_modified_unknown = %d, want %d", sum.LastModifiedUnknown, tt.wantUnknown)
+			}
+			wantHeads := 0
+			if tt.keysFile {
+				wantHeads = len(keys)
+			}
+			if bucket.headCalls != wantHeads {
+				t.Errorf("run() made %d HeadObject calls, want %d", bucket.headCalls, wantHeads)
+			}
+		})
+	}
+}
+
+func TestRunSkipsExpiredBackups(t *testing.T) {
+	// 1764858600 = 2025-12-04T14:30:00Z, the newer backup was taken 20 days later
+	taken := time.Unix(1764858600, 0)
+	const oldManifest = "links/host1/medusa-backup-schedule-1764858600/meta/manifest.json"
+	const newManifest = "links/host1/medusa-backup-schedule-1766586600/meta/manifest.json"
+
+	tests := []struct {
+		name           string
+		now            time.Time
+		refreshExpired bool
+		want           []string
+		wantExpired    int
+	}{
+		{
+			name: "old backup one second before it expires",
+			now:  taken.AddDate(0, 0, 30).Add(-time.Second),
+			want: []string{"links/host1/data/ks/t/shared.db", "links/host1/data/ks/t/new.db", "links/host1/data/ks/t/old.db"},
+		},
+		{
+			// The shared object is still protected through the newer backup
+			name:        "old backup aged out by the next run",
+			now:         taken.AddDate(0, 0, 31),
+			want:        []string{"links/host1/data/ks/t/shared.db", "links/host1/data/ks/t/new.db"},
+			wantExpired: 1,
+		},
+		{
+			name:           "refresh-expired",
+			now:            taken.AddDate(0, 0, 31),
+			refreshExpired: true,
+			want:           []string{"links/host1/data/ks/t/shared.db", "links/host1/data/ks/t/new.db", "links/host1/data/ks/t/old.db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects[oldManifest] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/old.db"}]}]`
+			bucket.objects[newManifest] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/new.db"}]}]`
+			for _, name := range []string{"shared", "old", "new"} {
+				bucket.objects["links/host1/data/ks/t/"+name+".db"] = ""
+			}
+
+			opts := testOptions()
+			opts.refreshExpired = tt.refreshExpired
+			r := newRefresher(bucket.client(), opts, tt.now)
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			// Backups are processed newest first, so the shared object is updated once
+			if got := bucket.putKeys(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("run() updated %v, want %v", got, tt.want)
+			}
+			if got := r.stats.summary(time.Now()).ManifestsExpired; got != tt.wantExpired {
+				t.Errorf("summary manifests_expired = %d, want %d", got, tt.wantExpired)
+			}
+		})
+	}
+}
+
+func TestRunRefusesPastRetainUntil(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+
+	opts := testOptions()
+	opts.minRetention, opts.maxRetention = retentionPeriod{}, retentionPeriod{}
+	opts.retainUntil = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	// The run starts after -retain-until, e.g. with a clock set wrong
+	r := newRefresher(bucket.client(), opts, time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC))
+	err := r.run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "not in the future") {
+		t.Fatalf("run() error = %v, want the retain-until refused", err)
+	}
+	if len(bucket.puts) != 0 {
+		t.Errorf("updated %v, want nothing", bucket.putKeys())
+	}
+}
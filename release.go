@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// releaseMargin is how far ahead of now release shortens retention at the
+// earliest, since S3 rejects a retain-until that isn't in the future
+const releaseMargin = time.Minute
+
+// releaseFilterReason is the skipped_by_filter reason of the objects a backup
+// still within its retention, or pinned, references, which release never touches
+const releaseFilterReason = "referenced_by_retained_backup"
+
+// errComplianceRelease is the error of objects locked in COMPLIANCE mode,
+// whose retention nobody can shorten
+var errComplianceRelease = errors.New("COMPLIANCE retention can't be shortened")
+
+// releaseObject is an object release may shorten the retention of, with the
+// manifest it was found through ("" for -orphan-report keys)
+type releaseObject struct {
+	manifest string
+	key      string
+}
+
+// readReleaseReport reads the -from-report file: the JSON array the report
+// command writes with -format json, whose backups' manifests are returned, or
+// an -orphan-report, one JSON object per line, whose keys are returned
+func readReleaseReport(path string) (manifests, keys []string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("[")) {
+		var candidates []pruneCandidate
+		if err := json.Unmarshal(data, &candidates); err != nil {
+			return nil, nil, fmt.Errorf("invalid report: %w", err)
+		}
+		for _, c := range candidates {
+			manifests = append(manifests, c.Manifest)
+		}
+		return manifests, nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var o orphanRecord
+		if err := dec.Decode(&o); err != nil {
+			return nil, nil, fmt.Errorf("invalid orphan report: %w", err)
+		}
+		if err := validateObjectKey(o.Key); err != nil {
+			return nil, nil, fmt.Errorf("invalid orphan report: %w", err)
+		}
+		keys = append(keys, o.Key)
+	}
+	return nil, keys, nil
+}
+
+// expired reports whether the backup m is past its retention, see
+// backupExpired
+func (r *refresher) expired(m ManifestInfo) bool {
+	return backupExpired(r.opts, r.pins, m, r.now)
+}
+
+// backupExpired reports whether the backup m was taken at least the
+// max_retention of its retention class, or -max-retention, before now.
+// Undated backups and those pinned in pins never are.
+func backupExpired(opts *options, pins backupPins, m ManifestInfo, now time.Time) bool {
+	if pins.pinned(m) {
+		return false
+	}
+	ts, ok := backupTimestamp(m)
+	_, maxRetention, _ := opts.backupRetention(m)
+	return ok && !maxRetention.from(ts).After(now)
+}
+
+// selectReleased returns the discovered backups named by -backup or the
+// -from-report report, and the orphaned keys the report lists. Naming a
+// backup that isn't discovered, is pinned or is still within its retention
+// fails.
+func (r *refresher) selectReleased(manifests []ManifestInfo) ([]ManifestInfo, []string, error) {
+	var reportManifests, keys []string
+	if r.opts.releaseReport != "" {
+		var err error
+		if reportManifests, keys, err = readReleaseReport(r.opts.releaseReport); err != nil {
+			return nil, nil, fmt.Errorf("failed to read -from-report: %w", err)
+		}
+	}
+
+	byKey := make(map[string]ManifestInfo, len(manifests))
+	byID := make(map[string][]ManifestInfo)
+	for _, m := range manifests {
+		byKey[m.Key] = m
+		if mp, err := m.path(); err == nil {
+			byID[mp.id()] = append(byID[mp.id()], m)
+		}
+	}
+
+	var released []ManifestInfo
+	for _, id := range r.opts.releaseBackups {
+		found, ok := byID[id]
+		if !ok {
+			return nil, nil, fmt.Errorf("no manifest found for backup %s; release the objects of a purged backup from an -orphan-report with -from-report", id)
+		}
+		released = append(released, found...)
+	}
+	for _, key := range reportManifests {
+		m, ok := byKey[key]
+		if !ok {
+			slog.Warn("Manifest from the report no longer exists, release its objects from an -orphan-report", "manifest", key)
+			continue
+		}
+		released = append(released, m)
+	}
+
+	seen := make(map[string]bool)
+	var unique []ManifestInfo
+	for _, m := range released {
+		if seen[m.Key] {
+			continue
+		}
+		seen[m.Key] = true
+		if r.pins.pinned(m) {
+			return nil, nil, fmt.Errorf("backup %s is pinned in -pins-file and can't be released", m.Key)
+		}
+		if !r.expired(m) {
+			return nil, nil, fmt.Errorf("backup %s is within -max-retention or its retention class, or undated, and can't be released", m.Key)
+		}
+		unique = append(unique, m)
+	}
+	return unique, keys, nil
+}
+
+// releaseObjects returns the objects of the released backups and the
+// orphaned keys, in key order, leaving out every object a pinned backup or
+// one within its retention references. Those backups' manifests must all be read, since
+// an unreadable one could reference any object.
+func (r *refresher) releaseObjects(ctx context.Context, manifests, released []ManifestInfo, orphaned []string) ([]releaseObject, error) {
+	retained := make(map[string]struct{})
+	for _, m := range manifests {
+		if r.expired(m) {
+			continue
+		}
+		keys, err := r.manifestObjectKeys(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			retained[key] = struct{}{}
+		}
+	}
+
+	objects := make(map[string]string)
+	for _, m := range released {
+		keys, err := r.manifestObjectKeys(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			objects[key] = m.Key
+		}
+	}
+	for _, key := range orphaned {
+		if _, ok := objects[key]; !ok {
+			objects[key] = ""
+		}
+	}
+
+	var result []releaseObject
+	for key, manifest := range objects {
+		if _, ok := retained[key]; ok {
+			logObject(slog.LevelDebug, "Skipping object a retained backup references", manifest, key, actionSkipped)
+			r.stats.objectFiltered(releaseFilterReason)
+			continue
+		}
+		result = append(result, releaseObject{manifest: manifest, key: key})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].key < result[j].key })
+	return result, nil
+}
+
+// manifestObjectKeys returns the keys of the objects m references
+func (r *refresher) manifestObjectKeys(ctx context.Context, m ManifestInfo) ([]string, error) {
+	manifest, err := r.fetchManifest(ctx, m.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download manifest %s: %w", m.Key, err)
+	}
+	mp, err := m.path()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(manifest.Objects))
+	for _, obj := range manifest.Objects {
+		keys = append(keys, resolveObjectKey(mp.HostnamePath, obj.Path))
+	}
+	return keys, nil
+}
+
+// releaseUntil returns the retain-until release shortens retention to:
+// -retain-until, or the earliest date S3 accepts when that's sooner
+func (r *refresher) releaseUntil() time.Time {
+	earliest := r.now.Add(releaseMargin)
+	if r.opts.releaseUntil.After(earliest) {
+		return r.opts.releaseUntil
+	}
+	return earliest
+}
+
+// confirmRelease asks for confirmation before shortening the retention of
+// objects. Without a terminal to ask on, the run is aborted.
+func (r *refresher) confirmRelease(objects int, until time.Time) error {
+	if r.opts.dryRun || r.opts.yes || objects == 0 {
+		return nil
+	}
+	if !r.prompt.tty {
+		return fmt.Errorf("aborted: release would shorten the retention of up to %d objects and stdin is not a terminal, pass -yes to proceed", objects)
+	}
+	message := fmt.Sprintf("About to shorten the GOVERNANCE retention of up to %d objects in s3://%s/ to %s, bypassing governance.",
+		objects, r.opts.bucket, until.Format(time.RFC3339))
+	ok, err := confirm(r.prompt.in, r.prompt.out, message)
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if !ok {
+		return errors.New("aborted: release was not confirmed")
+	}
+	return nil
+}
+
+// release shortens the GOVERNANCE retention of the objects of expired
+// backups, and of orphaned objects, to releaseUntil
+func (r *refresher) release(ctx context.Context) error {
+	defer r.finish()
+	if r.opts.pinsFile != "" {
+		pins, err := loadPins(ctx, r.client, r.opts, r.now)
+		if err != nil {
+			return fmt.Errorf("failed to read -pins-file: %w", err)
+		}
+		r.pins = pins
+		slog.Info("Loaded pins from -pins-file", "pins", len(pins))
+	}
+	manifests, err := resolveManifests(ctx, r.client, r.opts, nil)
+	if err != nil {
+		return err
+	}
+	if r.pins != nil {
+		// A pin matching nothing may be a typo leaving its backup unprotected
+		r.pins.split(manifests)
+		if unmatched := r.pins.unmatched(); len(unmatched) > 0 {
+			return fmt.Errorf("%d pins in -pins-file match no discovered backup: %s", len(unmatched), strings.Join(unmatched, ", "))
+		}
+	}
+	released, orphaned, err := r.selectReleased(manifests)
+	if err != nil {
+		return err
+	}
+	objects, err := r.releaseObjects(ctx, manifests, released, orphaned)
+	if err != nil {
+		return err
+	}
+	until := r.releaseUntil()
+	slog.Info("Releasing retention", "backups", len(released), "orphaned_keys", len(orphaned), "objects", len(objects), "retain_until", until.Format(time.RFC3339))
+	if err := r.confirmRelease(len(objects), until); err != nil {
+		return err
+	}
+
+	r.stats.setTotalObjects(len(objects))
+	r.startProgress()
+	for _, obj := range objects {
+		if r.reportErr != nil {
+			return r.reportErr
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("release interrupted: %w", ctx.Err())
+		}
+		r.stats.objectReferenced(obj.key)
+		r.recordResult(obj.manifest, obj.key, r.releaseObject(ctx, obj, until))
+	}
+	return r.reportErr
+}
+
+// releaseObject shortens an object's retention to until when it reaches beyond
+func (r *refresher) releaseObject(ctx context.Context, obj releaseObject, until time.Time) objectResult {
+	current, _, err := checkRetention(ctx, r.client, r.opts.bucket, obj.key, time.Time{}, "")
+	if err != nil {
+		return objectError("Error checking retention", obj.manifest, obj.key, objectResult{err: err})
+	}
+	if current.Missing {
+		return objectMissing(obj.manifest, obj.key)
+	}
+	res := objectResult{previous: current}
+	if current.RetainUntil == nil || !current.RetainUntil.After(until) {
+		res.action = actionSkipped
+		return res
+	}
+	if current.Mode == types.ObjectLockRetentionModeCompliance {
+		res.err = errComplianceRelease
+		return objectError("Can't release object", obj.manifest, obj.key, res)
+	}
+
+	res.retainUntil, res.mode = until, types.ObjectLockRetentionModeGovernance
+	change := retentionChangeAttrs(current, until, res.mode)
+	if r.opts.dryRun {
+		res.action = actionWouldReduce
+		logObject(slog.LevelInfo, "[DRY-RUN] Would shorten retention", obj.manifest, obj.key, res.action, change...)
+		return res
+	}
+	if res.err = r.recordRollback(obj.key, current, until, res.mode); res.err != nil {
+		return objectError("Error recording previous retention", obj.manifest, obj.key, res, change...)
+	}
+	if res.err = updateRetention(ctx, r.client, r.opts.bucket, obj.key, until, res.mode, true); res.err != nil {
+		return objectError("Error shortening retention", obj.manifest, obj.key, res, change...)
+	}
+	res.action = actionReduced
+	logObject(slog.LevelDebug, "Shortened retention", obj.manifest, obj.key, res.action, change...)
+	return res
+}
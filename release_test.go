@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestReadReleaseReport(t *testing.T) {
+	tests := []struct {
+		name          string
+		doc           string
+		wantManifests []string
+		wantKeys      []string
+		wantErr       bool
+	}{
+		{
+			name:          "report json",
+			doc:           `[{"host":"host1","backup":"b1","manifest":"links/host1/b1/meta/manifest.json"},{"host":"host2","backup":"b1","manifest":"links/host2/b1/meta/manifest.json"}]`,
+			wantManifests: []string{"links/host1/b1/meta/manifest.json", "links/host2/b1/meta/manifest.json"},
+		},
+		{
+			name:     "orphan report",
+			doc:      "{\"key\":\"links/host1/data/ks/t/a.db\",\"host\":\"host1\"}\n{\"key\":\"links/host1/data/ks/t/b.db\",\"host\":\"host1\"}\n",
+			wantKeys: []string{"links/host1/data/ks/t/a.db", "links/host1/data/ks/t/b.db"},
+		},
+		{name: "empty"},
+		{name: "orphan without key", doc: `{"host":"host1"}`, wantErr: true},
+		{name: "invalid json", doc: `[{"manifest":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "report.json")
+			if err := os.WriteFile(path, []byte(tt.doc), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			manifests, keys, err := readReleaseReport(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readReleaseReport() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(manifests, tt.wantManifests) || !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("readReleaseReport() = %v, %v, want %v, %v", manifests, keys, tt.wantManifests, tt.wantKeys)
+			}
+		})
+	}
+}
+
+// releaseBucket holds an expired backup (2025-01-01) sharing an object with
+// a recent one (2025-05-31) and an undated one, all retained until 2026
+func releaseBucket(locked time.Time) *fakeBucket {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/backup-1735689600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/old.db"},{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/adhoc.db"}]}]`
+	bucket.objects["links/host1/backup-1748649600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/new.db"}]}]`
+	bucket.objects["links/host1/adhoc/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/adhoc.db"}]}]`
+	for _, name := range []string{"old", "shared", "new", "adhoc", "orphan"} {
+		key := "links/host1/data/ks/t/" + name + ".db"
+		bucket.objects[key] = ""
+		bucket.retention[key] = locked
+	}
+	return bucket
+}
+
+func releaseOptions() *options {
+	return &options{
+		commonOptions:  commonOptions{bucket: "test-bucket", cluster: "links"},
+		maxRetention:   retentionPeriod{days: 30},
+		releaseBackups: stringList{"links/host1/backup-1735689600"},
+		allowReduce:    true,
+		yes:            true,
+	}
+}
+
+func TestRelease(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	locked := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, opts *options)
+		wantPuts   []string
+		wantUntil  time.Time
+		wantAction objectAction
+	}{
+		{
+			// Only old.db: shared.db and adhoc.db are referenced by backups
+			// within -max-retention or undated
+			name:       "backup",
+			wantPuts:   []string{"links/host1/data/ks/t/old.db"},
+			wantUntil:  now.Add(releaseMargin),
+			wantAction: actionReduced,
+		},
+		{
+			name:       "dry run",
+			setup:      func(t *testing.T, opts *options) { opts.dryRun, opts.allowReduce = true, false },
+			wantAction: actionWouldReduce,
+		},
+		{
+			name: "retain-until",
+			setup: func(t *testing.T, opts *options) {
+				opts.releaseUntil = time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)
+			},
+			wantPuts:   []string{"links/host1/data/ks/t/old.db"},
+			wantUntil:  time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC),
+			wantAction: actionReduced,
+		},
+		{
+			name: "orphan report",
+			setup: func(t *testing.T, opts *options) {
+				path := filepath.Join(t.TempDir(), "orphans.json")
+				doc := "{\"key\":\"links/host1/data/ks/t/orphan.db\"}\n{\"key\":\"links/host1/data/ks/t/new.db\"}\n"
+				if err := os.WriteFile(path, []byte(doc), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				opts.releaseBackups, opts.releaseReport = nil, path
+			},
+			wantPuts:   []string{"links/host1/data/ks/t/orphan.db"},
+			wantUntil:  now.Add(releaseMargin),
+			wantAction: actionReduced,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := releaseBucket(locked)
+			opts := releaseOptions()
+			if tt.setup != nil {
+				tt.setup(t, opts)
+			}
+			r := newRefresher(bucket.client(), opts, now)
+			if err := r.release(context.Background()); err != nil {
+				t.Fatalf("release() error = %v", err)
+			}
+
+			if got := bucket.putKeys(); !reflect.DeepEqual(got, tt.wantPuts) {
+				t.Fatalf("shortened %v, want %v", got, tt.wantPuts)
+			}
+			for _, put := range bucket.puts {
+				if !aws.ToBool(put.BypassGovernanceRetention) {
+					t.Errorf("%s shortened without BypassGovernanceRetention", aws.ToString(put.Key))
+				}
+				if until := aws.ToTime(put.Retention.RetainUntilDate); !until.Equal(tt.wantUntil) {
+					t.Errorf("%s shortened to %v, want %v", aws.ToString(put.Key), until, tt.wantUntil)
+				}
+			}
+			sum := r.stats.summary(now)
+			if got := sum.Reduced + sum.WouldReduce; got != 1 || r.stats.actions[tt.wantAction] != 1 {
+				t.Errorf("summary reduced %d, would_reduce %d, want 1 %s", sum.Reduced, sum.WouldReduce, tt.wantAction)
+			}
+			for _, key := range []string{"shared", "new", "adhoc"} {
+				if until := bucket.retention["links/host1/data/ks/t/"+key+".db"]; !until.Equal(locked) {
+					t.Errorf("%s.db retained until %v, want it untouched", key, until)
+				}
+			}
+		})
+	}
+}
+
+func TestReleaseRefusesRetainedBackups(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		backup  string
+		wantErr string
+	}{
+		{name: "within max retention", backup: "links/host1/backup-1748649600", wantErr: "within -max-retention"},
+		{name: "undated", backup: "links/host1/adhoc", wantErr: "or undated"},
+		{name: "not found", backup: "links/host1/backup-1700000000", wantErr: "no manifest found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := releaseBucket(now.AddDate(1, 0, 0))
+			opts := releaseOptions()
+			opts.releaseBackups = stringList{"links/host1/backup-1735689600", tt.backup}
+			r := newRefresher(bucket.client(), opts, now)
+			err := r.release(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("release() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+			if len(bucket.puts) != 0 {
+				t.Errorf("release() shortened %v before failing", bucket.putKeys())
+			}
+		})
+	}
+}
+
+func TestReleaseConfirmation(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		input    string
+		tty      bool
+		wantErr  string
+		wantPuts int
+	}{
+		{name: "confirmed", input: "yes\n", tty: true, wantPuts: 1},
+		{name: "declined", input: "no\n", tty: true, wantErr: "not confirmed"},
+		{name: "no terminal", wantErr: "pass -yes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := releaseBucket(now.AddDate(1, 0, 0))
+			opts := releaseOptions()
+			opts.yes = false
+			r := newRefresher(bucket.client(), opts, now)
+			r.prompt = prompt{in: strings.NewReader(tt.input), out: io.Discard, tty: tt.tty}
+			err := r.release(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("release() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("release() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+			if len(bucket.puts) != tt.wantPuts {
+				t.Errorf("release() shortened %v, want %d objects", bucket.putKeys(), tt.wantPuts)
+			}
+		})
+	}
+}
+
+func TestReleaseKeepsLongerRetainedBackups(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	locked := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	weeklyClass := func(maxRetention retentionPeriod) func(t *testing.T, opts *options) {
+		return func(t *testing.T, opts *options) {
+			opts.retentionClasses = []retentionClass{{pattern: "weekly-*", maxRetention: maxRetention}}
+		}
+	}
+	pinsFile := func(pins string) func(t *testing.T, opts *options) {
+		return func(t *testing.T, opts *options) {
+			opts.pinsFile = filepath.Join(t.TempDir(), "pins.txt")
+			if err := os.WriteFile(opts.pinsFile, []byte(pins), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, opts *options)
+		backups  stringList
+		wantPuts []string
+		wantErr  string
+	}{
+		{
+			// The weekly backup of 2025-02-01 is kept a year by its class
+			name:    "weekly class",
+			setup:   weeklyClass(retentionPeriod{years: 1}),
+			backups: stringList{"links/host1/backup-1735689600"},
+		},
+		{
+			name:     "expired weekly class",
+			setup:    weeklyClass(retentionPeriod{days: 90}),
+			backups:  stringList{"links/host1/backup-1735689600"},
+			wantPuts: []string{"links/host1/data/ks/t/old.db"},
+		},
+		{
+			name:    "pinned",
+			setup:   pinsFile("links/host1/weekly-1738368000\n"),
+			backups: stringList{"links/host1/backup-1735689600"},
+		},
+		{
+			name:    "releasing a weekly backup",
+			setup:   weeklyClass(retentionPeriod{years: 1}),
+			backups: stringList{"links/host1/weekly-1738368000"},
+			wantErr: "within -max-retention or its retention class",
+		},
+		{
+			name:    "releasing a pinned backup",
+			setup:   pinsFile("weekly-1738368000\n"),
+			backups: stringList{"links/host1/weekly-1738368000"},
+			wantErr: "is pinned in -pins-file",
+		},
+		{
+			name:    "pin matching nothing",
+			setup:   pinsFile("links/host1/weekly-1700000000\n"),
+			backups: stringList{"links/host1/backup-1735689600"},
+			wantErr: "match no discovered backup",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := releaseBucket(locked)
+			// A weekly backup past -max-retention shares old.db with the released daily one
+			bucket.objects["links/host1/weekly-1738368000/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/old.db"}]}]`
+			opts := releaseOptions()
+			opts.releaseBackups = tt.backups
+			tt.setup(t, opts)
+			r := newRefresher(bucket.client(), opts, now)
+			err := r.release(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("release() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("release() error = %v, want it to mention %q", err, tt.wantErr)
+			}
+			if got := bucket.putKeys(); !reflect.DeepEqual(got, tt.wantPuts) {
+				t.Errorf("shortened %v, want %v", got, tt.wantPuts)
+			}
+			if tt.wantErr == "" && tt.wantPuts == nil {
+				if got := r.stats.summary(now).SkippedByFilter[releaseFilterReason]; got != 3 {
+					t.Errorf("skipped %d objects of retained backups, want 3", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// reportRecord is the -report entry of one processed object
+type reportRecord struct {
+	Time                time.Time    `json:"time"`
+	Key                 string       `json:"key"`
+	Manifest            string       `json:"manifest,omitempty"`
+	Action              objectAction `json:"action"`
+	PreviousRetainUntil *time.Time   `json:"previous_retain_until"`
+	NewRetainUntil      *time.Time   `json:"new_retain_until"`
+	Mode                string       `json:"mode,omitempty"`
+	Error               string       `json:"error,omitempty"`
+	ErrorClass          string       `json:"error_class,omitempty"`
+	RequestID           string       `json:"request_id,omitempty"`
+	ExtendedRequestID   string       `json:"extended_request_id,omitempty"`
+	HTTPStatus          int          `json:"http_status,omitempty"`
+	StorageClass        string       `json:"storage_class,omitempty"`
+	ManifestSchema      string       `json:"manifest_schema,omitempty"`
+	DC                  string       `json:"dc,omitempty"`
+	RunID               string       `json:"run_id"`
+}
+
+// newReportRecord builds the report entry of an object processed at now.
+// Mode is the mode set or planned, or the current mode when unchanged.
+func newReportRecord(now time.Time, manifest, key string, res objectResult) reportRecord {
+	rec := reportRecord{
+		Time:         now.UTC(),
+		Key:          key,
+		Manifest:     manifest,
+		Action:       res.action,
+		Mode:         string(res.mode),
+		StorageClass: string(res.storageClass),
+	}
+	if res.previous != nil {
+		rec.PreviousRetainUntil = res.previous.RetainUntil
+		if rec.Mode == "" {
+			rec.Mode = string(res.previous.Mode)
+		}
+	}
+	if !res.retainUntil.IsZero() {
+		retainUntil := res.retainUntil.UTC()
+		rec.NewRetainUntil = &retainUntil
+	}
+	if res.err != nil {
+		d := describeError(res.err)
+		rec.Error = res.err.Error()
+		rec.ErrorClass, rec.RequestID, rec.ExtendedRequestID, rec.HTTPStatus = d.class, d.requestID, d.extendedRequestID, d.httpStatus
+	}
+	return rec
+}
+
+// reporter writes the per-object records of a -report file
+type reporter interface {
+	write(rec reportRecord) error
+	Close() error
+}
+
+// jsonReporter writes one JSON object per line, so an interrupted run
+// still leaves every record written so far readable
+type jsonReporter struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func newJSONReporter(w io.WriteCloser) *jsonReporter {
+	return &jsonReporter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (j *jsonReporter) write(rec reportRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(rec)
+}
+
+func (j *jsonReporter) Close() error {
+	return j.w.Close()
+}
+
+// reportHeader lists the CSV report columns, matching the JSON field names
+var reportHeader = []string{"time", "key", "manifest", "action", "previous_retain_until", "new_retain_until", "mode", "error", "error_class", "storage_class", "manifest_schema", "dc", "run_id"}
+
+// csvReporter writes a header row and one row per object. Every row is
+// flushed as it is written so large runs don't buffer the report.
+type csvReporter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+	cw *csv.Writer
+}
+
+func newCSVReporter(w io.WriteCloser) (*csvReporter, error) {
+	c := &csvReporter{w: w, cw: csv.NewWriter(w)}
+	if err := c.writeRow(reportHeader); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *csvReporter) write(rec reportRecord) error {
+	return c.writeRow([]string{
+		rec.Time.Format(time.RFC3339),
+		rec.Key,
+		rec.Manifest,
+		string(rec.Action),
+		formatReportTime(rec.PreviousRetainUntil),
+		formatReportTime(rec.NewRetainUntil),
+		rec.Mode,
+		rec.Error,
+		rec.ErrorClass,
+		rec.StorageClass,
+		rec.ManifestSchema,
+		rec.DC,
+		rec.RunID,
+	})
+}
+
+func (c *csvReporter) writeRow(row []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.cw.Write(row); err != nil {
+		return err
+	}
+	c.cw.Flush()
+	return c.cw.Error()
+}
+
+func (c *csvReporter) Close() error {
+	return c.w.Close()
+}
+
+// formatReportTime formats an optional report timestamp, empty when unset
+func formatReportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// validateReportFormat checks the -report-format flag value
+func validateReportFormat(format string) error {
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("invalid -report-format %q: must be json or csv", format)
+	}
+	return nil
+}
+
+// openReport creates the -report file at path in the given format
+func openReport(path, format string) (reporter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create report: %w", err)
+	}
+	if format != "csv" {
+		return newJSONReporter(f), nil
+	}
+	rep, err := newCSVReporter(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write report header: %w", err)
+	}
+	return rep, nil
+}
+
+// withReport runs fn with the -report file open, when one was requested, and
+// the -rollback-file
+func (r *refresher) withReport(fn func() error) (err error) {
+	defer r.logRunID()()
+	if r.opts.report == "" {
+		return r.withRollback(fn)
+	}
+	if r.report, err = openReport(r.opts.report, r.opts.reportFormat); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := r.report.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close report: %w", closeErr)
+		}
+		r.report = nil
+	}()
+	slog.Info("Writing report", "path", r.opts.report, "format", r.opts.reportFormat)
+	return r.withRollback(fn)
+}
+
+// runWithReport runs the refresher with the -report file open, then emails
+// the report from -ses-from when set
+func (r *refresher) runWithReport(ctx context.Context) error {
+	if r.opts.sesFrom == "" {
+		return r.withReport(func() error { return r.run(ctx) })
+	}
+	if r.ses == nil {
+		client, err := newSESClient(ctx, r.opts.commonOptions)
+		if err != nil {
+			return err
+		}
+		r.ses = client
+	}
+	if r.uploader == nil && r.opts.sesReportURI != "" {
+		client, err := newS3Client(ctx, r.opts.commonOptions)
+		if err != nil {
+			return err
+		}
+		r.uploader = client
+	}
+	err := r.withReport(func() error { return r.run(ctx) })
+	return r.emailReport(ctx, err)
+}
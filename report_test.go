@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// readReport decodes every line of a -report file, keeping the raw fields
+// to check which ones are present
+func readReport(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open report: %v", err)
+	}
+	defer f.Close()
+
+	var records []map[string]any
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("report line %q is not JSON: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	return records
+}
+
+func recordFields(rec map[string]any) string {
+	var fields []string
+	for k := range rec {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ",")
+}
+
+func TestReportRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+		want   map[string]string // "action key" -> sorted fields
+	}{
+		{
+			name: "refresh",
+			want: map[string]string{
+				"updated links/host1/data/ks/t/a.db":       "action,key,manifest,manifest_schema,mode,new_retain_until,previous_retain_until,run_id,storage_class,time",
+				"skipped links/host1/data/ks/t/a.db":       "action,key,manifest,manifest_schema,mode,new_retain_until,previous_retain_until,run_id,storage_class,time",
+				"skipped links/host1/data/ks/t/b.db":       "action,key,manifest,manifest_schema,mode,new_retain_until,previous_retain_until,run_id,storage_class,time",
+				"missing links/host1/data/ks/t/missing.db": "action,key,manifest,manifest_schema,new_retain_until,previous_retain_until,run_id,time",
+				"error links/host1/data/ks/t/denied.db":    "action,error,error_class,key,manifest,manifest_schema,new_retain_until,previous_retain_until,run_id,storage_class,time",
+				"updated links/host1/data/ks/t/c.db":       "action,key,manifest,manifest_schema,mode,new_retain_until,previous_retain_until,run_id,storage_class,time",
+			},
+		},
+		{
+			name:   "dry-run",
+			dryRun: true,
+			want: map[string]string{
+				"would_update links/host1/data/ks/t/a.db":  "action,key,manifest,manifest_schema,mode,new_retain_until,previous_retain_until,run_id,storage_class,time",
+				"skipped links/host1/data/ks/t/b.db":       "action,key,manifest,manifest_schema,mode,new_retain_until,previous_retain_until,run_id,storage_class,time",
+				"missing links/host1/data/ks/t/missing.db": "action,key,manifest,manifest_schema,new_retain_until,previous_retain_until,run_id,time",
+				"error links/host1/data/ks/t/denied.db":    "action,error,error_class,key,manifest,manifest_schema,new_retain_until,previous_retain_until,run_id,storage_class,time",
+				"would_update links/host1/data/ks/t/c.db":  "action,key,manifest,manifest_schema,mode,new_retain_until,previous_retain_until,run_id,storage_class,time",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.dryRun = tt.dryRun
+			opts.report = filepath.Join(t.TempDir(), "report.jsonl")
+
+			if err := run(context.Background(), statsBucket(), opts); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			records := readReport(t, opts.report)
+			got := make(map[string]string)
+			for _, rec := range records {
+				got[rec["action"].(string)+" "+rec["key"].(string)] = recordFields(rec)
+
+				if _, err := time.Parse(time.RFC3339, rec["time"].(string)); err != nil {
+					t.Errorf("record %v has an invalid time: %v", rec, err)
+				}
+				if !strings.HasSuffix(rec["manifest"].(string), "/meta/manifest.json") {
+					t.Errorf("record %v has manifest %q", rec, rec["manifest"])
+				}
+				switch rec["action"] {
+				case "updated", "would_update":
+					if rec["new_retain_until"] == nil || rec["mode"] != "GOVERNANCE" {
+						t.Errorf("record %v lacks the new retention", rec)
+					}
+				case "skipped":
+					if rec["new_retain_until"] != nil || rec["previous_retain_until"] == nil {
+						t.Errorf("record %v of a compliant object should only carry the current retention", rec)
+					}
+				case "error":
+					if rec["error_class"] != errorClassAccessDenied {
+						t.Errorf("record %v has error_class %v, want %q", rec, rec["error_class"], errorClassAccessDenied)
+					}
+				}
+			}
+			for k, fields := range tt.want {
+				if got[k] != fields {
+					t.Errorf("record %q fields = %q, want %q", k, got[k], fields)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("report records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportInterrupted(t *testing.T) {
+	opts := testOptions()
+	opts.report = filepath.Join(t.TempDir(), "report.jsonl")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newRefresher(statsBucket(), opts, time.Now())
+	err := r.withReport(func() error {
+		r.refreshObject(ctx, "", "links/host1/data/ks/t/a.db")
+		cancel()
+		return r.run(ctx)
+	})
+	if err == nil {
+		t.Fatal("withReport() error = nil for an interrupted run")
+	}
+
+	records := readReport(t, opts.report)
+	if len(records) != 1 || records[0]["action"] != "updated" {
+		t.Errorf("report = %v, want the record written before the interruption", records)
+	}
+}
+
+func TestReportCreateError(t *testing.T) {
+	opts := testOptions()
+	opts.report = filepath.Join(t.TempDir(), "missing", "report.jsonl")
+
+	err := run(context.Background(), statsBucket(), opts)
+	if err == nil || !strings.Contains(err.Error(), "failed to create report") {
+		t.Errorf("run() error = %v, want a report creation error", err)
+	}
+}
+
+// nopCloser adapts a bytes.Buffer to io.WriteCloser
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func TestCSVReportGolden(t *testing.T) {
+	now := time.Date(2025, 1, 1, 2, 0, 0, 0, time.UTC)
+	previous := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	next := time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC)
+	governance := &ObjectRetention{RetainUntil: &previous, Mode: types.ObjectLockRetentionModeGovernance}
+	manifest := "links/host1/b1/meta/manifest.json"
+
+	results := []struct {
+		key string
+		res objectResult
+	}{
+		{"links/host1/data/ks/t/a.db", objectResult{action: actionUpdated, previous: governance, retainUntil: next, mode: types.ObjectLockRetentionModeGovernance, storageClass: types.ObjectStorageClassStandard}},
+		{"links/host1/data/ks/t/b.db", objectResult{action: actionWouldUpdate, previous: &ObjectRetention{}, retainUntil: next, mode: types.ObjectLockRetentionModeGovernance}},
+		{"links/host1/data/ks/t/c.db", objectResult{action: actionReduced, previous: governance, retainUntil: next, mode: types.ObjectLockRetentionModeGovernance}},
+		{"links/host1/data/ks/t/d.db", objectResult{action: actionWouldReduce, previous: governance, retainUntil: next, mode: types.ObjectLockRetentionModeGovernance}},
+		{"links/host1/data/ks/t/e.db", objectResult{action: actionSkipped, previous: governance}},
+		{"links/host1/data/ks/t/f.db", objectResult{action: actionSkippedStorageClass, storageClass: types.ObjectStorageClassDeepArchive}},
+		{"links/host1/data/ks/t/missing.db", objectResult{action: actionMissing}},
+		{"links/host1/data/ks/t/with,comma.db", objectResult{action: actionError, previous: governance, err: errors.New("AccessDenied: Access Denied")}},
+		{`links/host1/data/ks/t/with"quote".db`, objectResult{action: actionError, err: errors.New("SlowDown: Please reduce your request rate, \"retry\"")}},
+	}
+
+	var buf bytes.Buffer
+	rep, err := newCSVReporter(nopCloser{&buf})
+	if err != nil {
+		t.Fatalf("newCSVReporter() error = %v", err)
+	}
+	for _, r := range results {
+		rec := newReportRecord(now, manifest, r.key, r.res)
+		rec.RunID = "01JA2B3C4D5E6F7G8H9J0KMNPQ"
+		if err := rep.write(rec); err != nil {
+			t.Fatalf("write() error = %v", err)
+		}
+	}
+
+	want, err := os.ReadFile("testdata/report.golden.csv")
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if buf.String() != string(want) {
+		t.Errorf("CSV report mismatch\ngot:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	// The escaped rows must read back to the original keys
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse CSV report: %v", err)
+	}
+	if len(rows) != len(results)+1 {
+		t.Fatalf("CSV report has %d rows, want a header and %d records", len(rows), len(results))
+	}
+	for i, r := range results {
+		if rows[i+1][1] != r.key {
+			t.Errorf("row %d key = %q, want %q", i+1, rows[i+1][1], r.key)
+		}
+	}
+}
+
+func TestRunCSVReport(t *testing.T) {
+	opts := testOptions()
+	opts.report = filepath.Join(t.TempDir(), "report.csv")
+	opts.reportFormat = "csv"
+
+	if err := run(context.Background(), statsBucket(), opts); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	f, err := os.Open(opts.report)
+	if err != nil {
+		t.Fatalf("failed to open report: %v", err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to parse CSV report: %v", err)
+	}
+	if strings.Join(rows[0], ",") != strings.Join(reportHeader, ",") {
+		t.Errorf("CSV header = %v, want %v", rows[0], reportHeader)
+	}
+	if len(rows) != 7 {
+		t.Errorf("CSV report has %d rows, want a header and 6 records", len(rows))
+	}
+}
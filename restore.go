@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Reasons the retention recorded in a -rollback-file can't be restored
+const (
+	notRestorableNoRetention = "the object had no retention, which can't be removed"
+	notRestorableExpired     = "the previous retain-until has passed"
+	notRestorableCompliance  = "COMPLIANCE retention can't be shortened or downgraded"
+	notRestorableReduce      = "undoing the extension shortens GOVERNANCE retention, which requires -allow-reduce"
+)
+
+// validateRollback checks that entries were recorded for -bucket
+func validateRollback(entries []rollbackEntry, opts *options) error {
+	for _, e := range entries {
+		if e.Bucket != opts.bucket {
+			return fmt.Errorf("-rollback-file records objects of bucket %q, not -bucket %q", e.Bucket, opts.bucket)
+		}
+	}
+	return nil
+}
+
+// confirmRestore asks for confirmation before restoring retention with
+// -allow-reduce, which may shorten it. Without a terminal to ask on, the run
+// is aborted.
+func (r *refresher) confirmRestore(objects int) error {
+	if !r.opts.allowReduce || r.opts.dryRun || r.opts.yes || objects == 0 {
+		return nil
+	}
+	if !r.prompt.tty {
+		return fmt.Errorf("aborted: restore may shorten the retention of up to %d objects and stdin is not a terminal, pass -yes to proceed", objects)
+	}
+	message := fmt.Sprintf("About to restore the retention of up to %d objects in s3://%s/, shortening GOVERNANCE retention where it was extended, bypassing governance.",
+		objects, r.opts.bucket)
+	ok, err := confirm(r.prompt.in, r.prompt.out, message)
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if !ok {
+		return errors.New("aborted: restore was not confirmed")
+	}
+	return nil
+}
+
+// restore sets back the retention the objects of entries had before the
+// changes recorded in the -rollback-file, where still possible
+func (r *refresher) restore(ctx context.Context, entries []rollbackEntry) error {
+	defer r.finish()
+	if err := r.confirmRestore(len(entries)); err != nil {
+		return err
+	}
+	r.stats.setTotalObjects(len(entries))
+	r.startProgress()
+	// The -tag-objects tags of shortened objects are rewritten, so that
+	// -trust-tags doesn't skip them
+	r.tags = &objectTagger{client: r.client, bucket: r.opts.bucket, runID: r.runID, write: !r.opts.dryRun}
+
+	shortened := make(map[string]objectResult)
+	defer func() { r.lowerBackupRecords(context.WithoutCancel(ctx), shortened) }()
+	for _, e := range entries {
+		if r.reportErr != nil {
+			return r.reportErr
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("restore interrupted: %w", ctx.Err())
+		}
+		r.stats.objectReferenced(e.Key)
+		res := r.restoreObject(ctx, e)
+		r.recordResult("", e.Key, res)
+		if res.action == actionReduced {
+			shortened[e.Key] = res
+		}
+	}
+	return r.reportErr
+}
+
+// lowerBackupRecords lowers the refreshed markers and -state-dynamodb-table
+// items of the backups of the hosts whose objects were shortened to the
+// earliest retain-until restored there, so that the next refresh doesn't skip
+// them. Failures are only logged.
+func (r *refresher) lowerBackupRecords(ctx context.Context, shortened map[string]objectResult) {
+	if len(shortened) == 0 {
+		return
+	}
+	manifests, err := findManifests(ctx, r.client, r.opts.bucket, r.opts.prefix, r.opts.cluster, nil)
+	if err != nil {
+		slog.Warn("Failed to list the backups of the restored objects, run the next refresh with -ignore-markers", errorAttrs(err)...)
+		return
+	}
+	restored := newBackupRetention()
+	var affected []ManifestInfo
+	for _, m := range manifests {
+		mp, err := m.path()
+		if err != nil {
+			continue
+		}
+		for key, res := range shortened {
+			if strings.HasPrefix(key, mp.HostnamePath) {
+				restored.record(m.Key, res)
+			}
+		}
+		if _, _, ok := restored.reached(m.Key); ok {
+			affected = append(affected, m)
+		}
+	}
+
+	for _, m := range affected {
+		until, mode, _ := restored.reached(m.Key)
+		marker, err := r.readMarker(ctx, m.Key)
+		if err != nil || marker == nil || !marker.RetainUntil.After(until) {
+			continue
+		}
+		key, _ := markerKey(m.Key)
+		if err := r.putMarker(ctx, key, until, weakerMode(marker.Mode, mode)); err != nil {
+			slog.Warn("Failed to lower the refreshed marker of a restored backup, run the next refresh with -ignore-markers", append([]any{"manifest", m.Key}, errorAttrs(err)...)...)
+			continue
+		}
+		slog.Debug("Lowered refreshed marker of restored backup", "manifest", m.Key, "retain_until", until)
+	}
+
+	if r.opts.stateTable == "" {
+		return
+	}
+	if err := r.openState(ctx); err != nil {
+		slog.Warn("Failed to open -state-dynamodb-table, delete the items of the restored backups", errorAttrs(err)...)
+		return
+	}
+	r.state.overwrite = true
+	states, err := r.state.read(ctx, affected)
+	if err != nil {
+		slog.Warn("Failed to read -state-dynamodb-table, delete the items of the restored backups", errorAttrs(err)...)
+		return
+	}
+	for _, m := range affected {
+		until, mode, _ := restored.reached(m.Key)
+		if state, ok := states[m.Key]; ok && state.retainUntil.After(until) {
+			state.retainUntil, state.mode = until.UTC(), weakerMode(state.mode, mode)
+			r.state.queue(state)
+		}
+	}
+	r.state.flush(ctx)
+}
+
+// weakerMode returns GOVERNANCE unless both a and b are COMPLIANCE
+func weakerMode(a, b types.ObjectLockRetentionMode) types.ObjectLockRetentionMode {
+	if a == types.ObjectLockRetentionModeCompliance && b == types.ObjectLockRetentionModeCompliance {
+		return a
+	}
+	return types.ObjectLockRetentionModeGovernance
+}
+
+// restoreReason returns why the retention current can't be set back to
+// previous, "" when it can. shorten reports whether restoring it shortens
+// the retention, which bypasses governance.
+func (r *refresher) restoreReason(current, previous *ObjectRetention) (reason string, shorten bool) {
+	if previous.RetainUntil == nil {
+		return notRestorableNoRetention, false
+	}
+	if !previous.RetainUntil.After(r.now) {
+		return notRestorableExpired, false
+	}
+	shorten = current.RetainUntil != nil && previous.RetainUntil.Before(*current.RetainUntil)
+	if current.Mode == types.ObjectLockRetentionModeCompliance && (shorten || previous.Mode != current.Mode) {
+		return notRestorableCompliance, shorten
+	}
+	if shorten && !r.opts.allowReduce {
+		return notRestorableReduce, shorten
+	}
+	return "", shorten
+}
+
+// restoreObject sets back the retention key had before the change e recorded
+func (r *refresher) restoreObject(ctx context.Context, e rollbackEntry) objectResult {
+	current, _, err := checkRetention(ctx, r.client, r.opts.bucket, e.Key, time.Time{}, "")
+	if err != nil {
+		return objectError("Error checking retention", "", e.Key, objectResult{err: err})
+	}
+	if current.Missing {
+		return objectMissing("", e.Key)
+	}
+	res := objectResult{previous: current}
+	previous := e.previous()
+	if current.RetainUntil != nil && previous.RetainUntil != nil && current.RetainUntil.Equal(*previous.RetainUntil) && current.Mode == previous.Mode {
+		logObject(slog.LevelDebug, "Retention already restored", "", e.Key, actionSkipped)
+		res.action = actionSkipped
+		return res
+	}
+	reason, shorten := r.restoreReason(current, previous)
+	if reason != "" {
+		res.action = actionNotRestorable
+		logObject(slog.LevelWarn, "Can't restore retention", "", e.Key, res.action, "reason", reason, "changed_by_run", e.RunID)
+		return res
+	}
+
+	res.retainUntil, res.mode = *previous.RetainUntil, previous.Mode
+	change := retentionChangeAttrs(current, res.retainUntil, res.mode)
+	if r.opts.dryRun {
+		res.action = actionWouldUpdate
+		if shorten {
+			res.action = actionWouldReduce
+		}
+		logObject(slog.LevelInfo, "[DRY-RUN] Would restore retention", "", e.Key, res.action, change...)
+		return res
+	}
+	if res.err = updateRetention(ctx, r.client, r.opts.bucket, e.Key, res.retainUntil, res.mode, shorten); res.err != nil {
+		return objectError("Error restoring retention", "", e.Key, res, change...)
+	}
+	res.action = actionUpdated
+	if shorten {
+		res.action = actionReduced
+		r.retagRestored(ctx, e.Key, res.retainUntil, res.mode)
+	}
+	logObject(slog.LevelDebug, "Restored retention", "", e.Key, res.action, change...)
+	return res
+}
+
+// retagRestored rewrites the -tag-objects tags of key, when it has them, to
+// the retention restored
+func (r *refresher) retagRestored(ctx context.Context, key string, until time.Time, mode types.ObjectLockRetentionMode) {
+	if r.tags == nil {
+		return
+	}
+	if tags, known := r.tags.read(ctx, key); known && tagged(tags) != nil {
+		r.tags.tag(ctx, "", key, tags, true, until, mode)
+	}
+}
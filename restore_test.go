@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestRestoreReason(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	governance := func(until time.Time) *ObjectRetention {
+		return &ObjectRetention{RetainUntil: aws.Time(until), Mode: types.ObjectLockRetentionModeGovernance}
+	}
+	compliance := func(until time.Time) *ObjectRetention {
+		return &ObjectRetention{RetainUntil: aws.Time(until), Mode: types.ObjectLockRetentionModeCompliance}
+	}
+	tests := []struct {
+		name        string
+		current     *ObjectRetention
+		previous    *ObjectRetention
+		allowReduce bool
+		wantReason  string
+		wantShorten bool
+	}{
+		{name: "undo extension", current: governance(now.AddDate(0, 0, 30)), previous: governance(now.AddDate(0, 0, 7)), allowReduce: true, wantShorten: true},
+		{name: "undo extension without -allow-reduce", current: governance(now.AddDate(0, 0, 30)), previous: governance(now.AddDate(0, 0, 7)), wantReason: notRestorableReduce, wantShorten: true},
+		{name: "undo reduction", current: governance(now.AddDate(0, 0, 1)), previous: governance(now.AddDate(0, 0, 30))},
+		{name: "no previous retention", current: governance(now.AddDate(0, 0, 30)), previous: &ObjectRetention{}, allowReduce: true, wantReason: notRestorableNoRetention},
+		{name: "previous retention passed", current: governance(now.AddDate(0, 0, 30)), previous: governance(now.AddDate(0, 0, -1)), allowReduce: true, wantReason: notRestorableExpired},
+		{name: "compliance extension", current: compliance(now.AddDate(0, 0, 30)), previous: compliance(now.AddDate(0, 0, 7)), allowReduce: true, wantReason: notRestorableCompliance, wantShorten: true},
+		{name: "compliance mode change", current: compliance(now.AddDate(0, 0, 30)), previous: governance(now.AddDate(0, 0, 30)), allowReduce: true, wantReason: notRestorableCompliance},
+		{name: "upgrade to compliance", current: governance(now.AddDate(0, 0, 7)), previous: compliance(now.AddDate(0, 0, 30))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.allowReduce = tt.allowReduce
+			r := newRefresher(&MockS3Client{}, opts, now)
+			reason, shorten := r.restoreReason(tt.current, tt.previous)
+			if reason != tt.wantReason || shorten != tt.wantShorten {
+				t.Errorf("restoreReason() = %q, %v, want %q, %v", reason, shorten, tt.wantReason, tt.wantShorten)
+			}
+		})
+	}
+}
+
+func TestRestore(t *testing.T) {
+	tests := []struct {
+		name              string
+		allowReduce       bool
+		dryRun            bool
+		wantRestored      bool
+		wantNotRestorable int
+	}{
+		{name: "allow reduce", allowReduce: true, wantRestored: true, wantNotRestorable: 1},
+		{name: "without allow reduce", wantNotRestorable: 2},
+		{name: "dry run", allowReduce: true, dryRun: true, wantNotRestorable: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			until := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+			bucket := rollbackBucket(until)
+			path := filepath.Join(t.TempDir(), "rollback.jsonl")
+			opts := testOptions()
+			opts.rollbackFile = path
+			if err := newRefresher(bucket.client(), opts, time.Now()).runWithReport(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			extended := bucket.retention["links/host1/data/ks/t/a.db"]
+
+			entries, err := readRollbackFile(path)
+			if err != nil {
+				t.Fatalf("readRollbackFile() error = %v", err)
+			}
+			restoreOpts := testOptions()
+			restoreOpts.allowReduce, restoreOpts.dryRun, restoreOpts.yes = tt.allowReduce, tt.dryRun, true
+			r := newRefresher(bucket.client(), restoreOpts, time.Now())
+			if err := r.restore(context.Background(), entries); err != nil {
+				t.Fatalf("restore() error = %v", err)
+			}
+
+			want := extended
+			if tt.wantRestored {
+				want = until
+			}
+			if got := bucket.retention["links/host1/data/ks/t/a.db"]; !got.Equal(want) {
+				t.Errorf("a.db retained until %s, want %s", got, want)
+			}
+			last := bucket.puts[len(bucket.puts)-1]
+			if tt.wantRestored && !aws.ToBool(last.BypassGovernanceRetention) {
+				t.Error("restore shortened a.db's retention without bypassing governance")
+			}
+			if got := r.stats.summary(time.Now()).NotRestorable; got != tt.wantNotRestorable {
+				t.Errorf("not_restorable = %d, want %d", got, tt.wantNotRestorable)
+			}
+		})
+	}
+}
+
+func TestRefreshAfterRestore(t *testing.T) {
+	until := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	bucket, client := newTaggedBucket()
+	bucket.retention["links/host1/data/ks/t/a.db"] = until
+	client.PutObjectFunc = func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		body, err := io.ReadAll(params.Body)
+		if err != nil {
+			return nil, err
+		}
+		bucket.mu.Lock()
+		defer bucket.mu.Unlock()
+		bucket.objects[aws.ToString(params.Key)] = string(body)
+		return &s3.PutObjectOutput{}, nil
+	}
+	db := &mockDynamoDB{}
+	refresh := func(opts *options) *refresher {
+		t.Helper()
+		opts.tagObjects, opts.trustTags, opts.stateTable, opts.yes = true, true, "medusa-retention", true
+		r := newRefresher(client, opts, time.Now())
+		r.dynamodb = db
+		if err := r.runWithReport(context.Background()); err != nil {
+			t.Fatalf("runWithReport() error = %v", err)
+		}
+		return r
+	}
+
+	// A refresh over-extends the backup, and the extension is restored
+	path := filepath.Join(t.TempDir(), "rollback.jsonl")
+	opts := testOptions()
+	opts.maxRetention, opts.rollbackFile = retentionPeriod{days: 365}, path
+	refresh(opts)
+	entries, err := readRollbackFile(path)
+	if err != nil {
+		t.Fatalf("readRollbackFile() error = %v", err)
+	}
+	restoreOpts := testOptions()
+	restoreOpts.allowReduce, restoreOpts.yes, restoreOpts.stateTable = true, true, "medusa-retention"
+	r := newRefresher(client, restoreOpts, time.Now())
+	r.dynamodb = db
+	if err := r.restore(context.Background(), entries); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if got := bucket.retention["links/host1/data/ks/t/a.db"]; !got.Equal(until) {
+		t.Fatalf("a.db retained until %s after restore, want %s", got, until)
+	}
+	var marker refreshedMarker
+	if err := json.Unmarshal([]byte(bucket.objects["links/host1/b1/meta/.retention-refreshed.json"]), &marker); err != nil || !marker.RetainUntil.Equal(until) {
+		t.Errorf("marker = %+v, want it lowered to %s", marker, until)
+	}
+	if got := stateString(db.items["links/host1/b1"], stateRetainUntil); got != until.UTC().Format(time.RFC3339) {
+		t.Errorf("recorded retain_until %q, want it lowered to %s", got, until)
+	}
+	if tags := tagged(bucket.tags["links/host1/data/ks/t/a.db"]); tags == nil || !tags.RetainUntil.Equal(until) {
+		t.Errorf("a.db tagged %+v, want the restored date", tags)
+	}
+
+	// The next refresh extends the restored object again
+	r = refresh(testOptions())
+	if got := bucket.retention["links/host1/data/ks/t/a.db"]; !got.Equal(r.retainUntil) {
+		t.Errorf("a.db retained until %s after the next refresh, want it extended to %s", got, r.retainUntil)
+	}
+}
+
+func TestRestoreConfirmation(t *testing.T) {
+	now := time.Now()
+	entries := []rollbackEntry{{Bucket: "test-bucket", Key: "links/host1/data/ks/t/a.db", PreviousRetainUntil: aws.Time(now.Add(time.Hour)), PreviousMode: types.ObjectLockRetentionModeGovernance}}
+	opts := testOptions()
+	opts.allowReduce = true
+	r := newRefresher(rollbackBucket(now.AddDate(0, 0, 30)).client(), opts, now)
+	r.prompt = prompt{in: strings.NewReader(""), out: io.Discard}
+	if err := r.restore(context.Background(), entries); err == nil || !strings.Contains(err.Error(), "pass -yes") {
+		t.Errorf("restore() error = %v, want it to require -yes without a terminal", err)
+	}
+}
+
+func TestValidateRollback(t *testing.T) {
+	entries := []rollbackEntry{{Bucket: "test-bucket", Key: "k1"}, {Bucket: "other-bucket", Key: "k2"}}
+	if err := validateRollback(entries[:1], testOptions()); err != nil {
+		t.Errorf("validateRollback() error = %v", err)
+	}
+	if err := validateRollback(entries, testOptions()); err == nil || !strings.Contains(err.Error(), "other-bucket") {
+		t.Errorf("validateRollback() error = %v, want the other bucket rejected", err)
+	}
+}
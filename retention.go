@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionPeriod is a retention length in calendar units (applied with
+// AddDate so months and years follow the calendar) plus a fixed duration
+type retentionPeriod struct {
+	years    int
+	months   int
+	days     int
+	duration time.Duration
+}
+
+// calendarPeriod matches suffixed retention values such as 90d, 12w, 6m or 1y
+var calendarPeriod = regexp.MustCompile(`^(\d+)([dwmy])$`)
+
+// parseRetentionPeriod parses a retention value: a bare integer (days, for
+// compatibility), a suffixed calendar value (90d, 12w, 6m for months, 1y) or
+// a Go duration such as 2160h. Zero, negative and ambiguous values are rejected.
+func parseRetentionPeriod(value string) (retentionPeriod, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "-") {
+		return retentionPeriod{}, fmt.Errorf("invalid retention %q: must not be negative", value)
+	}
+	if strings.Contains(value, "M") {
+		return retentionPeriod{}, fmt.Errorf("invalid retention %q: use m for months or a Go duration in hours like 720h", value)
+	}
+
+	var p retentionPeriod
+	if n, err := strconv.Atoi(value); err == nil {
+		p.days = n
+	} else if m := calendarPeriod.FindStringSubmatch(value); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return retentionPeriod{}, fmt.Errorf("invalid retention %q: %w", value, err)
+		}
+		switch m[2] {
+		case "d":
+			p.days = n
+		case "w":
+			p.days = 7 * n
+		case "m":
+			p.months = n
+		case "y":
+			p.years = n
+		}
+	} else if d, err := time.ParseDuration(value); err == nil {
+		if d < time.Hour {
+			return retentionPeriod{}, fmt.Errorf("invalid retention %q: durations shorter than an hour are almost certainly a mistake (m means months, e.g. 6m)", value)
+		}
+		p.duration = d
+	} else {
+		return retentionPeriod{}, fmt.Errorf("invalid retention %q: expected days (30), a suffixed value (90d, 12w, 6m, 1y) or a Go duration (2160h)", value)
+	}
+
+	if p.isZero() {
+		return retentionPeriod{}, fmt.Errorf("invalid retention %q: must be greater than zero", value)
+	}
+	return p, nil
+}
+
+// from returns t advanced by the retention period
+func (p retentionPeriod) from(t time.Time) time.Time {
+	return t.AddDate(p.years, p.months, p.days).Add(p.duration)
+}
+
+// isZero reports whether the period is unset
+func (p retentionPeriod) isZero() bool {
+	return p == retentionPeriod{}
+}
+
+// String formats the period the way it would be written on the command line
+func (p *retentionPeriod) String() string {
+	switch {
+	case p.isZero():
+		return ""
+	case p.years != 0 && p.months == 0 && p.days == 0 && p.duration == 0:
+		return strconv.Itoa(p.years) + "y"
+	case p.months != 0 && p.years == 0 && p.days == 0 && p.duration == 0:
+		return strconv.Itoa(p.months) + "m"
+	case p.days != 0 && p.years == 0 && p.months == 0 && p.duration == 0:
+		return strconv.Itoa(p.days) + "d"
+	case p.duration != 0 && p.years == 0 && p.months == 0 && p.days == 0:
+		return p.duration.String()
+	}
+	return fmt.Sprintf("%dy%dm%dd+%s", p.years, p.months, p.days, p.duration)
+}
+
+// Set implements flag.Value
+func (p *retentionPeriod) Set(value string) error {
+	parsed, err := parseRetentionPeriod(value)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// defaultRetentionCap is how far from now a retain-until may reach without
+// -ignore-retention-cap, which a mistyped period or clock easily exceeds
+var defaultRetentionCap = retentionPeriod{years: 10}
+
+// checkRetainUntils checks the retain-until dates the retention settings
+// compute as of now: that of -retain-until or -max-retention, and those of
+// the retention classes, which override them for some backups
+func (opts *options) checkRetainUntils(now time.Time) error {
+	if !opts.hasRetention() {
+		// Left to a -policy-s3-uri document, checked once applied
+		return nil
+	}
+	if opts.retainUntil.IsZero() {
+		if err := opts.checkRetainUntil("-max-retention", opts.maxRetention.from(now), now); err != nil {
+			return err
+		}
+	} else if err := opts.checkRetainUntil("-retain-until", opts.retainUntil, now); err != nil {
+		return err
+	}
+	for _, class := range opts.retentionClasses {
+		_, maxRetention := class.periods(opts.minRetention, opts.maxRetention)
+		if err := opts.checkRetainUntil(fmt.Sprintf("retention class %q", class.pattern), maxRetention.from(now), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRetainUntil checks that until, the retain-until source sets, is in the
+// future and, unless -ignore-retention-cap is set, within -retention-cap of now.
+// A retain-until in the past changes nothing while the run reports success.
+func (opts *options) checkRetainUntil(source string, until, now time.Time) error {
+	if !until.After(now) {
+		return fmt.Errorf("%s sets retain-until %s, which is not in the future", source, until.UTC().Format(time.RFC3339))
+	}
+	if opts.retentionCap.isZero() || opts.ignoreRetentionCap {
+		return nil
+	}
+	if limit := opts.retentionCap.from(now); until.After(limit) {
+		return fmt.Errorf("%s sets retain-until %s, beyond -retention-cap %s (%s), pass -ignore-retention-cap if intended",
+			source, until.UTC().Format(time.RFC3339), opts.retentionCap.String(), limit.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// parseRetainUntil parses an absolute -retain-until value, either an RFC3339
+// timestamp or a date (midnight UTC), and checks that it lies in the future
+func parseRetainUntil(value string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, value); err != nil {
+			return time.Time{}, fmt.Errorf("invalid date %q: expected RFC3339 or YYYY-MM-DD", value)
+		}
+	}
+	if !t.After(now) {
+		return time.Time{}, fmt.Errorf("%s is not in the future", t.Format(time.RFC3339))
+	}
+	return t, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetainUntil(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:  "RFC3339",
+			value: "2027-03-31T17:00:00Z",
+			want:  time.Date(2027, 3, 31, 17, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "RFC3339 with offset",
+			value: "2027-03-31T17:00:00+02:00",
+			want:  time.Date(2027, 3, 31, 15, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "date only",
+			value: "2027-03-31",
+			want:  time.Date(2027, 3, 31, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "past date",
+			value:   "2024-01-01",
+			wantErr: true,
+		},
+		{
+			name:    "exactly now",
+			value:   "2025-06-01T12:00:00Z",
+			wantErr: true,
+		},
+		{
+			name:    "not a date",
+			value:   "90d",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRetainUntil(tt.value, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRetainUntil() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseRetainUntil() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRetainUntils(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		opts    options
+		wantErr string
+	}{
+		{
+			name: "max-retention",
+			opts: options{minRetention: retentionPeriod{days: 7}, maxRetention: retentionPeriod{days: 30}, retentionCap: defaultRetentionCap},
+		},
+		{
+			name:    "max-retention beyond the cap",
+			opts:    options{minRetention: retentionPeriod{days: 7}, maxRetention: retentionPeriod{years: 11}, retentionCap: defaultRetentionCap},
+			wantErr: "-max-retention sets retain-until 2036-06-01T12:00:00Z, beyond -retention-cap 10y (2035-06-01T12:00:00Z)",
+		},
+		{
+			name: "cap ignored",
+			opts: options{minRetention: retentionPeriod{days: 7}, maxRetention: retentionPeriod{years: 11}, retentionCap: defaultRetentionCap, ignoreRetentionCap: true},
+		},
+		{
+			name: "no cap",
+			opts: options{minRetention: retentionPeriod{days: 7}, maxRetention: retentionPeriod{years: 11}},
+		},
+		{
+			name: "retain-until",
+			opts: options{retainUntil: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), retentionCap: defaultRetentionCap},
+		},
+		{
+			// e.g. a -retain-until checked against a clock that has since moved on
+			name:    "retain-until passed",
+			opts:    options{retainUntil: time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC), retentionCap: defaultRetentionCap},
+			wantErr: "-retain-until sets retain-until 2025-05-01T00:00:00Z, which is not in the future",
+		},
+		{
+			name:    "retain-until exactly now",
+			opts:    options{retainUntil: now, retentionCap: defaultRetentionCap},
+			wantErr: "not in the future",
+		},
+		{
+			name:    "retain-until beyond the cap",
+			opts:    options{retainUntil: time.Date(2099, 12, 31, 0, 0, 0, 0, time.UTC), retentionCap: defaultRetentionCap},
+			wantErr: "beyond -retention-cap",
+		},
+		{
+			name: "retention class beyond the cap",
+			opts: options{
+				minRetention:     retentionPeriod{days: 7},
+				maxRetention:     retentionPeriod{days: 30},
+				retentionClasses: []retentionClass{{pattern: "weekly-*", maxRetention: retentionPeriod{years: 20}}},
+				retentionCap:     retentionPeriod{years: 5},
+			},
+			wantErr: `retention class "weekly-*" sets retain-until 2045-06-01T12:00:00Z, beyond -retention-cap 5y`,
+		},
+		{
+			name: "retention class within the cap",
+			opts: options{
+				minRetention:     retentionPeriod{days: 7},
+				maxRetention:     retentionPeriod{days: 30},
+				retentionClasses: []retentionClass{{pattern: "weekly-*", maxRetention: retentionPeriod{years: 1}}},
+				retentionCap:     retentionPeriod{years: 5},
+			},
+		},
+		{
+			name: "retention left to a policy",
+			opts: options{retentionCap: defaultRetentionCap},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.checkRetainUntils(now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkRetainUntils() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkRetainUntils() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRetentionPeriod(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    retentionPeriod
+		wantErr bool
+	}{
+		{name: "bare integer is days", value: "30", want: retentionPeriod{days: 30}},
+		{name: "surrounding whitespace", value: " 30 ", want: retentionPeriod{days: 30}},
+		{name: "days suffix", value: "90d", want: retentionPeriod{days: 90}},
+		{name: "weeks suffix", value: "13w", want: retentionPeriod{days: 91}},
+		{name: "months suffix", value: "6m", want: retentionPeriod{months: 6}},
+		{name: "years suffix", value: "1y", want: retentionPeriod{years: 1}},
+		{name: "go duration in hours", value: "2160h", want: retentionPeriod{duration: 2160 * time.Hour}},
+		{name: "compound go duration", value: "1h30m", want: retentionPeriod{duration: 90 * time.Minute}},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "zero days", value: "0d", wantErr: true},
+		{name: "negative integer", value: "-30", wantErr: true},
+		{name: "negative duration", value: "-720h", wantErr: true},
+		{name: "uppercase M is ambiguous", value: "6M", wantErr: true},
+		{name: "seconds are too short", value: "30s", wantErr: true},
+		{name: "fractional days", value: "1.5d", wantErr: true},
+		{name: "unknown suffix", value: "6mo", wantErr: true},
+		{name: "empty", value: "", wantErr: true},
+		{name: "garbage", value: "forever", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRetentionPeriod(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRetentionPeriod(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseRetentionPeriod(%q) = %+v, want %+v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionPeriodFrom(t *testing.T) {
+	start := time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		period retentionPeriod
+		want   time.Time
+	}{
+		{name: "days", period: retentionPeriod{days: 30}, want: time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{name: "months follow the calendar", period: retentionPeriod{months: 1}, want: time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{name: "years", period: retentionPeriod{years: 1}, want: time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{name: "duration", period: retentionPeriod{duration: 48 * time.Hour}, want: time.Date(2025, 2, 2, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.period.from(start); !got.Equal(tt.want) {
+				t.Errorf("from() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionPeriodString(t *testing.T) {
+	for _, value := range []string{"90d", "6m", "1y", "2160h0m0s"} {
+		p, err := parseRetentionPeriod(value)
+		if err != nil {
+			t.Fatalf("parseRetentionPeriod(%q) error = %v", value, err)
+		}
+		if got := p.String(); got != value {
+			t.Errorf("String() = %q, want %q", got, value)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// reverseIndexRecord is one -reverse-index line: an object with every
+// processed backup referencing it
+type reverseIndexRecord struct {
+	Key      string   `json:"key"`
+	Size     int64    `json:"size"`
+	Backups  []string `json:"backups"` // manifest keys, in processing order
+	Keyspace string   `json:"keyspace"`
+	Table    string   `json:"table"`
+	Index    string   `json:"index,omitempty"`
+}
+
+// reverseIndex writes the -reverse-index file host by host: a host's objects
+// are written as soon as its last selected backup is processed, so only the
+// hosts still in progress are held in memory
+type reverseIndex struct {
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+
+	hostOf  map[string]string                         // hostname path of each selected manifest, by key
+	pending map[string]int                            // selected backups left to process, per hostname path
+	hosts   map[string]map[string]*reverseIndexRecord // records by key, per hostname path in progress
+	objects int                                       // records written so far
+}
+
+// openReverseIndex creates the -reverse-index file for the selected manifests
+func openReverseIndex(path string, manifests []ManifestInfo) (*reverseIndex, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reverse index: %w", err)
+	}
+	x := &reverseIndex{
+		f:       f,
+		w:       bufio.NewWriter(f),
+		hostOf:  make(map[string]string, len(manifests)),
+		pending: make(map[string]int),
+		hosts:   make(map[string]map[string]*reverseIndexRecord),
+	}
+	x.enc = json.NewEncoder(x.w)
+	for _, m := range manifests {
+		if mp, err := m.path(); err == nil {
+			x.hostOf[m.Key] = mp.HostnamePath
+			x.pending[mp.HostnamePath]++
+		}
+	}
+	return x, nil
+}
+
+// add records the objects of the processed manifest m, whose data files are
+// stored under hostnamePath, and writes its host's objects once it was the
+// host's last selected backup
+func (x *reverseIndex) add(m ManifestInfo, manifest *Manifest, hostnamePath string) error {
+	records := x.hosts[hostnamePath]
+	if records == nil {
+		records = make(map[string]*reverseIndexRecord)
+		x.hosts[hostnamePath] = records
+	}
+	for _, obj := range manifest.Objects {
+		key := resolveObjectKey(hostnamePath, obj.Path)
+		rec := records[key]
+		if rec == nil {
+			rec = &reverseIndexRecord{Key: key, Keyspace: obj.Keyspace, Table: obj.ColumnFamily, Index: obj.Index}
+			records[key] = rec
+		}
+		// An object listed twice in a manifest is referenced once
+		if n := len(rec.Backups); n == 0 || rec.Backups[n-1] != m.Key {
+			rec.Backups = append(rec.Backups, m.Key)
+		}
+		if obj.Size > 0 {
+			rec.Size = obj.Size
+		}
+	}
+
+	if host, ok := x.hostOf[m.Key]; ok {
+		x.pending[host]--
+		if x.pending[host] <= 0 {
+			return x.flush(host)
+		}
+	}
+	return nil
+}
+
+// flush writes the records of hostnamePath in key order and forgets them
+func (x *reverseIndex) flush(hostnamePath string) error {
+	records := x.hosts[hostnamePath]
+	delete(x.hosts, hostnamePath)
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := x.enc.Encode(records[key]); err != nil {
+			return fmt.Errorf("failed to write reverse index: %w", err)
+		}
+		x.objects++
+	}
+	return nil
+}
+
+// close writes the hosts whose backups weren't all processed, e.g. when the
+// run stopped early, and closes the file, once
+func (x *reverseIndex) close() error {
+	if x.f == nil {
+		return nil
+	}
+	f := x.f
+	x.f = nil
+	hosts := make([]string, 0, len(x.hosts))
+	for host := range x.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		if err := x.flush(host); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := x.w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write reverse index: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close reverse index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readReverseIndex decodes a -reverse-index file, failing on any line that
+// isn't a JSON object
+func readReverseIndex(t *testing.T, path string) []reverseIndexRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open reverse index: %v", err)
+	}
+	defer f.Close()
+	var records []reverseIndexRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec reverseIndexRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid reverse index line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("failed to read reverse index: %v", err)
+	}
+	return records
+}
+
+func TestReverseIndex(t *testing.T) {
+	manifests := []ManifestInfo{
+		{Key: "links/host1/b2/meta/manifest.json"},
+		{Key: "links/host2/b2/meta/manifest.json"},
+		{Key: "links/host1/b1/meta/manifest.json"},
+	}
+	objects := map[string]string{
+		"links/host1/b2/meta/manifest.json": `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db","size":10},{"path":"data/ks/t/new.db","size":5}]}]`,
+		"links/host2/b2/meta/manifest.json": `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db","size":7}]}]`,
+		"links/host1/b1/meta/manifest.json": `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db","size":10},{"path":"data/ks/t/old.db","size":3},{"path":"data/ks/t/old.db","size":3}]}]`,
+	}
+
+	path := filepath.Join(t.TempDir(), "reverse.jsonl")
+	x, err := openReverseIndex(path, manifests)
+	if err != nil {
+		t.Fatalf("openReverseIndex() error = %v", err)
+	}
+	for _, m := range manifests {
+		manifest, err := parseManifest([]byte(objects[m.Key]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp, _ := m.path()
+		if err := x.add(m, manifest, mp.HostnamePath); err != nil {
+			t.Fatalf("add() error = %v", err)
+		}
+		// host2 is written as soon as its only backup is processed
+		if m.Key == "links/host2/b2/meta/manifest.json" && x.objects != 1 {
+			t.Errorf("after host2's last backup, wrote %d records, want 1", x.objects)
+		}
+	}
+	if len(x.hosts) != 0 {
+		t.Errorf("hosts %v still held after their last backup", x.hosts)
+	}
+	if err := x.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+
+	want := []reverseIndexRecord{
+		{Key: "links/host2/data/ks/t/shared.db", Size: 7, Backups: []string{"links/host2/b2/meta/manifest.json"}, Keyspace: "ks", Table: "t"},
+		{Key: "links/host1/data/ks/t/new.db", Size: 5, Backups: []string{"links/host1/b2/meta/manifest.json"}, Keyspace: "ks", Table: "t"},
+		{Key: "links/host1/data/ks/t/old.db", Size: 3, Backups: []string{"links/host1/b1/meta/manifest.json"}, Keyspace: "ks", Table: "t"},
+		{Key: "links/host1/data/ks/t/shared.db", Size: 10, Backups: []string{"links/host1/b2/meta/manifest.json", "links/host1/b1/meta/manifest.json"}, Keyspace: "ks", Table: "t"},
+	}
+	if got := readReverseIndex(t, path); !reflect.DeepEqual(got, want) {
+		t.Errorf("reverse index = %+v, want %+v", got, want)
+	}
+}
+
+func TestRunReverseIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, opts *options) *refresher
+	}{
+		{
+			name: "dry run",
+			setup: func(t *testing.T, opts *options) *refresher {
+				bucket := newFakeBucket()
+				bucket.objects["links/host1/b2/meta/manifest.json"] = `[{"keyspace":"app","columnfamily":"users","objects":[{"path":"data/app/users/a.db","size":1},{"path":"data/app/users/b.db","size":2}]}]`
+				bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"app","columnfamily":"users","objects":[{"path":"data/app/users/a.db","size":1}]}]`
+				bucket.objects["links/host1/data/app/users/a.db"] = "a"
+				bucket.objects["links/host1/data/app/users/b.db"] = "bb"
+				opts.dryRun = true
+				return newRefresher(bucket.client(), opts, time.Now())
+			},
+		},
+		{
+			name: "offline",
+			setup: func(t *testing.T, opts *options) *refresher {
+				opts.localManifests = localManifestsDir
+				opts.offline = true
+				opts.dryRun = true
+				r := newRefresher(offlineClient(t), opts, time.Now())
+				r.offline = newOfflinePlan(io.Discard)
+				return r
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.reverseIndex = filepath.Join(t.TempDir(), "reverse.jsonl")
+			r := tt.setup(t, opts)
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			records := readReverseIndex(t, opts.reverseIndex)
+			if len(records) == 0 {
+				t.Fatal("reverse index is empty")
+			}
+			shared, unique := 0, 0
+			seen := make(map[string]bool)
+			for _, rec := range records {
+				if seen[rec.Key] {
+					t.Errorf("%s listed twice", rec.Key)
+				}
+				seen[rec.Key] = true
+				switch len(rec.Backups) {
+				case 0:
+					t.Errorf("%s has no backups", rec.Key)
+				case 1:
+					unique++
+				default:
+					shared++
+				}
+			}
+			if shared == 0 || unique == 0 {
+				t.Errorf("reverse index has %d shared and %d unique objects, want both", shared, unique)
+			}
+		})
+	}
+}
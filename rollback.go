@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// rollbackEntry is a line of the -rollback-file: the retention an object had
+// before a run changed it, recorded before the change is made
+type rollbackEntry struct {
+	Bucket              string                        `json:"bucket"`
+	Key                 string                        `json:"key"`
+	PreviousRetainUntil *time.Time                    `json:"previous_retain_until"` // null when the object had no retention
+	PreviousMode        types.ObjectLockRetentionMode `json:"previous_mode,omitempty"`
+	RetainUntil         time.Time                     `json:"retain_until"`
+	Mode                types.ObjectLockRetentionMode `json:"mode"`
+	RunID               string                        `json:"run_id"`
+	ChangedAt           time.Time                     `json:"changed_at"`
+}
+
+// previous returns the retention the object had before the change
+func (e rollbackEntry) previous() *ObjectRetention {
+	return &ObjectRetention{RetainUntil: e.PreviousRetainUntil, Mode: e.PreviousMode}
+}
+
+// rollbackLog appends entries to the -rollback-file, one JSON line each,
+// written as a whole so that an interrupted run leaves a readable file
+type rollbackLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openRollbackLog opens path for appending, so that a rerun of an interrupted
+// run keeps the entries of the objects it already changed
+func openRollbackLog(path string) (*rollbackLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open -rollback-file: %w", err)
+	}
+	return &rollbackLog{file: f}, nil
+}
+
+// write appends e to the file
+func (l *rollbackLog) write(e rollbackEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close flushes the file to disk and closes it
+func (l *rollbackLog) Close() error {
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// withRollback runs fn with the -rollback-file open, when one was requested.
+// Dry runs change nothing and don't write it.
+func (r *refresher) withRollback(fn func() error) (err error) {
+	if r.opts.rollbackFile == "" || r.opts.dryRun {
+		return fn()
+	}
+	if r.rollback, err = openRollbackLog(r.opts.rollbackFile); err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := r.rollback.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close -rollback-file: %w", closeErr)
+		}
+		r.rollback = nil
+	}()
+	slog.Info("Recording previous retention", "path", r.opts.rollbackFile)
+	return fn()
+}
+
+// recordRollback records the retention of key before it is changed to
+// retainUntil in mode. Failing to record it stops the run, since a change
+// that isn't recorded can't be rolled back.
+func (r *refresher) recordRollback(key string, current *ObjectRetention, retainUntil time.Time, mode types.ObjectLockRetentionMode) error {
+	if r.rollback == nil {
+		return nil
+	}
+	entry := rollbackEntry{
+		Bucket:              r.opts.bucket,
+		Key:                 key,
+		PreviousRetainUntil: current.RetainUntil,
+		PreviousMode:        current.Mode,
+		RetainUntil:         retainUntil.UTC(),
+		Mode:                mode,
+		RunID:               r.runID,
+		ChangedAt:           time.Now().UTC(),
+	}
+	if err := r.rollback.write(entry); err != nil {
+		err = fmt.Errorf("failed to write -rollback-file: %w", err)
+		if r.reportErr == nil {
+			r.reportErr = err
+		}
+		return err
+	}
+	return nil
+}
+
+// readRollbackFile reads the entries of a -rollback-file, keeping the first
+// one of each key: the retention the object had before the earliest recorded
+// change. A last line cut short by an interrupted run is ignored.
+func readRollbackFile(path string) ([]rollbackEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open -rollback-file: %w", err)
+	}
+	defer f.Close()
+	return readRollback(f)
+}
+
+// readRollback decodes the entries of a -rollback-file read from r
+func readRollback(r io.Reader) ([]rollbackEntry, error) {
+	var entries []rollbackEntry
+	seen := make(map[string]bool)
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read -rollback-file: %w", err)
+		}
+		complete := err == nil
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			var e rollbackEntry
+			if decodeErr := json.Unmarshal(data, &e); decodeErr != nil {
+				if !complete {
+					slog.Warn("Ignoring the incomplete last line of -rollback-file", "line", line)
+					break
+				}
+				return nil, fmt.Errorf("invalid -rollback-file line %d: %w", line, decodeErr)
+			}
+			if err := validateObjectKey(e.Key); err != nil {
+				return nil, fmt.Errorf("invalid -rollback-file line %d: %w", line, err)
+			}
+			if !seen[e.Key] {
+				seen[e.Key] = true
+				entries = append(entries, e)
+			}
+		}
+		if !complete {
+			break
+		}
+	}
+	return entries, nil
+}
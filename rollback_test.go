@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// rollbackBucket returns a bucket with one backup of two objects: a.db
+// retained until until, b.db without retention
+func rollbackBucket(until time.Time) *fakeBucket {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	bucket.retention["links/host1/data/ks/t/a.db"] = until
+	return bucket
+}
+
+func TestRunRecordsRollback(t *testing.T) {
+	until := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	bucket := rollbackBucket(until)
+	path := filepath.Join(t.TempDir(), "rollback.jsonl")
+	// Entries of an earlier run are kept
+	earlier := `{"bucket":"test-bucket","key":"links/host1/data/ks/t/c.db","previous_retain_until":null,"retain_until":"2030-01-01T00:00:00Z","mode":"GOVERNANCE","run_id":"earlier","changed_at":"2026-01-01T00:00:00Z"}` + "\n"
+	if err := os.WriteFile(path, []byte(earlier), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.rollbackFile = path
+
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.runWithReport(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	entries, err := readRollbackFile(path)
+	if err != nil {
+		t.Fatalf("readRollbackFile() error = %v", err)
+	}
+	if len(entries) != 3 || entries[0].RunID != "earlier" {
+		t.Fatalf("entries = %+v, want the earlier one and one per updated object", entries)
+	}
+	byKey := make(map[string]rollbackEntry)
+	for _, e := range entries[1:] {
+		byKey[e.Key] = e
+		if e.Bucket != "test-bucket" || e.RunID != r.runID || e.Mode != types.ObjectLockRetentionModeGovernance || !e.RetainUntil.Equal(bucket.retention[e.Key]) {
+			t.Errorf("entry = %+v, want the GOVERNANCE retention run %s set", e, r.runID)
+		}
+	}
+	if a := byKey["links/host1/data/ks/t/a.db"]; a.PreviousRetainUntil == nil || !a.PreviousRetainUntil.Equal(until) || a.PreviousMode != types.ObjectLockRetentionModeGovernance {
+		t.Errorf("a.db entry = %+v, want previous GOVERNANCE until %s", a, until)
+	}
+	if b, ok := byKey["links/host1/data/ks/t/b.db"]; !ok || b.PreviousRetainUntil != nil {
+		t.Errorf("b.db entry = %+v, want no previous retention", b)
+	}
+}
+
+func TestRunDryRunWritesNoRollback(t *testing.T) {
+	bucket := rollbackBucket(time.Now().Add(time.Hour))
+	path := filepath.Join(t.TempDir(), "rollback.jsonl")
+	opts := testOptions()
+	opts.rollbackFile, opts.dryRun = path, true
+	if err := newRefresher(bucket.client(), opts, time.Now()).runWithReport(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote -rollback-file: %v", err)
+	}
+}
+
+func TestReadRollback(t *testing.T) {
+	const (
+		first  = `{"bucket":"b","key":"k1","previous_retain_until":"2026-01-01T00:00:00Z","previous_mode":"GOVERNANCE","retain_until":"2026-02-01T00:00:00Z","mode":"GOVERNANCE","run_id":"r1"}`
+		second = `{"bucket":"b","key":"k2","previous_retain_until":null,"retain_until":"2026-02-01T00:00:00Z","mode":"GOVERNANCE","run_id":"r1"}`
+		later  = `{"bucket":"b","key":"k1","previous_retain_until":"2026-02-01T00:00:00Z","previous_mode":"GOVERNANCE","retain_until":"2026-03-01T00:00:00Z","mode":"GOVERNANCE","run_id":"r2"}`
+	)
+	tests := []struct {
+		name     string
+		data     string
+		wantRuns []string
+		wantErr  string
+	}{
+		{name: "first entry of each key", data: first + "\n" + second + "\n" + later + "\n", wantRuns: []string{"r1", "r1"}},
+		{name: "interrupted last line", data: first + "\n" + second + "\n" + later[:40], wantRuns: []string{"r1", "r1"}},
+		{name: "empty"},
+		{name: "invalid line", data: first + "\n{\n" + second + "\n", wantErr: "line 2"},
+		{name: "no key", data: `{"bucket":"b","run_id":"r1"}` + "\n", wantErr: "empty key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := readRollback(strings.NewReader(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readRollback() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readRollback() error = %v", err)
+			}
+			var runs []string
+			for _, e := range entries {
+				runs = append(runs, e.RunID)
+			}
+			if strings.Join(runs, ",") != strings.Join(tt.wantRuns, ",") {
+				t.Errorf("readRollback() runs = %v, want %v", runs, tt.wantRuns)
+			}
+		})
+	}
+}
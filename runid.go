@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// crockfordBase32 is the alphabet ULIDs are written in
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// runIDPattern matches the IDs -run-id accepts, which end up in S3 keys,
+// object tags and the User-Agent
+var runIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// newRunID returns a ULID identifying one run: it sorts by the time the run
+// started, to the millisecond, and is told apart from others by 80 random bits
+func newRunID() string {
+	return newULID(time.Now(), rand.Reader)
+}
+
+// newULID returns the ULID of t with randomness read from entropy, falling
+// back to the nanoseconds of t when it can't be read
+func newULID(t time.Time, entropy io.Reader) string {
+	var b [16]byte
+	ms := uint64(t.UnixMilli())
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	if _, err := io.ReadFull(entropy, b[6:]); err != nil {
+		binary.BigEndian.PutUint64(b[8:], uint64(t.UnixNano()))
+	}
+
+	// 26 characters of 5 bits encode the 128 bits, the first holding 3
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockfordBase32[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// validateRunID checks a -run-id value
+func validateRunID(id string) error {
+	if !runIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid -run-id %q: must be 1 to 64 letters, digits, '.', '_' or '-'", id)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestNewRunID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newRunID()
+		if len(id) != 26 {
+			t.Fatalf("newRunID() = %q, want 26 characters", id)
+		}
+		if strings.Trim(id, crockfordBase32) != "" {
+			t.Fatalf("newRunID() = %q, want Crockford base32", id)
+		}
+		if err := validateRunID(id); err != nil {
+			t.Fatalf("validateRunID(newRunID()) error = %v", err)
+		}
+		if seen[id] {
+			t.Fatalf("newRunID() returned %q twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestNewULID(t *testing.T) {
+	at := time.UnixMilli(1469918176385)
+	if got, want := newULID(at, bytes.NewReader(make([]byte, 10))), "01ARYZ6S410000000000000000"; got != want {
+		t.Errorf("newULID() = %q, want %q", got, want)
+	}
+	if got := newULID(at, bytes.NewReader(bytes.Repeat([]byte{0xff}, 10))); got != "01ARYZ6S41ZZZZZZZZZZZZZZZZ" {
+		t.Errorf("newULID() = %q, want the random part all ones", got)
+	}
+	// Later runs sort after earlier ones
+	earlier := newULID(at, bytes.NewReader(bytes.Repeat([]byte{0xff}, 10)))
+	if later := newULID(at.Add(time.Millisecond), bytes.NewReader(make([]byte, 10))); later <= earlier {
+		t.Errorf("newULID() of a later time = %q, want it after %q", later, earlier)
+	}
+	// Unreadable entropy falls back to the time
+	if got := newULID(at, iotest.ErrReader(context.Canceled)); len(got) != 26 || !strings.HasPrefix(got, "01ARYZ6S41") {
+		t.Errorf("newULID() without entropy = %q, want a ULID of the time", got)
+	}
+}
+
+func TestValidateRunID(t *testing.T) {
+	tests := []struct {
+		id      string
+		wantErr bool
+	}{
+		{id: "01ARYZ6S41TSV4RRFFQ69G5FAV"},
+		{id: "nightly-2026.10.16_1"},
+		{id: "", wantErr: true},
+		{id: "has space", wantErr: true},
+		{id: "a/b", wantErr: true},
+		{id: strings.Repeat("a", 64)},
+		{id: strings.Repeat("a", 65), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if err := validateRunID(tt.id); (err != nil) != tt.wantErr {
+				t.Errorf("validateRunID(%q) error = %v, want error: %v", tt.id, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunIDAcrossOutputs(t *testing.T) {
+	tests := []struct {
+		name  string
+		runID string
+	}{
+		{name: "generated"},
+		{name: "given", runID: "nightly-2026-10-16"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+			bucket.objects["links/host1/data/ks/t/a.db"] = ""
+			bucket.objects["links/host1/data/ks/t/b.db"] = ""
+			opts := testOptions()
+			opts.runID = tt.runID
+			opts.report = filepath.Join(t.TempDir(), "report.jsonl")
+			opts.summaryKey = "monitoring/{cluster}/{run_id}.json"
+			uploader := &mockUploader{}
+			r := newRefresher(bucket.client(), opts, time.Now())
+			r.uploader = uploader
+			want := r.runID
+			if tt.runID != "" && want != tt.runID {
+				t.Fatalf("run id = %q, want -run-id %q", want, tt.runID)
+			}
+			if tt.runID == "" && len(want) != 26 {
+				t.Fatalf("run id = %q, want a generated ULID", want)
+			}
+
+			logged := captureLog("json", slog.LevelDebug, func() {
+				if err := r.runWithReport(context.Background()); err != nil {
+					t.Fatalf("runWithReport() error = %v", err)
+				}
+			})
+
+			lines := strings.Split(strings.TrimSpace(logged), "\n")
+			for _, line := range lines {
+				var record map[string]any
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("log line %q is not JSON: %v", line, err)
+				}
+				if record["run_id"] != want {
+					t.Errorf("log record %s has run_id %v, want %s", line, record["run_id"], want)
+				}
+			}
+			records := readReport(t, opts.report)
+			if len(records) != 2 {
+				t.Fatalf("report has %d records, want 2", len(records))
+			}
+			for _, rec := range records {
+				if rec["run_id"] != want {
+					t.Errorf("report record of %v has run_id %v, want %s", rec["key"], rec["run_id"], want)
+				}
+			}
+			if len(uploader.keys) != 1 || uploader.keys[0] != "test-bucket/monitoring/links/"+want+".json" {
+				t.Fatalf("uploaded %v, want the summary keyed by the run id", uploader.keys)
+			}
+			var summary map[string]any
+			if err := json.Unmarshal(uploader.bodies[0], &summary); err != nil {
+				t.Fatalf("invalid summary %s: %v", uploader.bodies[0], err)
+			}
+			if summary["run_id"] != want {
+				t.Errorf("summary run_id = %v, want %s", summary["run_id"], want)
+			}
+		})
+	}
+}
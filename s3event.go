@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// s3Event is an S3 event notification, as delivered to a Lambda function or
+// written by an S3 -> SNS/SQS subscription
+type s3Event struct {
+	Records []s3EventRecord `json:"Records"`
+}
+
+// s3EventRecord is a record of an S3 event notification
+type s3EventRecord struct {
+	EventSource string `json:"eventSource"`
+	EventName   string `json:"eventName"`
+	S3          struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key  string `json:"key"`
+			Size int64  `json:"size"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// readS3EventFile reads the S3 event notification at path, "-" for stdin
+func readS3EventFile(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// manifestsFromS3Event returns the manifests created according to the S3
+// event notification data, so that a manifest can be processed as soon as
+// Medusa uploads it. Records of other events, buckets, clusters or objects
+// are ignored, and invalid manifest keys are reported and dropped, returning
+// their count.
+func manifestsFromS3Event(data []byte, opts *options) ([]ManifestInfo, int, error) {
+	var event s3Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse S3 event: %w", err)
+	}
+	if event.Records == nil {
+		return nil, 0, errors.New("failed to parse S3 event: no Records")
+	}
+
+	var manifests []ManifestInfo
+	seen := make(map[string]bool)
+	invalid := 0
+	for _, rec := range event.Records {
+		if rec.EventSource != "aws:s3" || !strings.HasPrefix(rec.EventName, "ObjectCreated:") {
+			slog.Debug("Ignoring S3 event", "source", rec.EventSource, "event", rec.EventName)
+			continue
+		}
+		// Keys are URL-encoded in notifications, with spaces as +
+		key, err := url.QueryUnescape(rec.S3.Object.Key)
+		if err != nil {
+			slog.Warn("Ignoring S3 event with an invalid key", "key", rec.S3.Object.Key, "error", err.Error())
+			invalid++
+			continue
+		}
+		if rec.S3.Bucket.Name != opts.bucket {
+			slog.Warn("Ignoring S3 event of another bucket", "bucket", rec.S3.Bucket.Name, "key", key)
+			continue
+		}
+		if !isManifestKey(key) {
+			slog.Debug("Ignoring S3 event of a non-manifest object", "key", key)
+			continue
+		}
+		if err := validateManifestKey(key, opts.prefix, opts.pathDepth, false); err != nil {
+			slog.Warn("Skipping invalid manifest key", "manifest", key, "error", err.Error())
+			invalid++
+			continue
+		}
+		// Clusters often share a bucket, and its notifications
+		if path, _ := extractHostnamePath(key, opts.prefix, opts.pathDepth); path.Cluster != opts.cluster {
+			slog.Debug("Ignoring S3 event of another cluster", "manifest", key)
+			continue
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		manifests = append(manifests, ManifestInfo{Key: key, Prefix: opts.prefix, Depth: opts.pathDepth})
+	}
+	return manifests, invalid, nil
+}
+
+// loadS3Event returns the manifests created according to the -s3-event
+// notification
+func loadS3Event(opts *options) ([]ManifestInfo, int, error) {
+	data, err := readS3EventFile(opts.s3Event)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read S3 event: %w", err)
+	}
+	return manifestsFromS3Event(data, opts)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// s3EventRecordJSON returns a record of an S3 event notification as S3 sends it
+func s3EventRecordJSON(eventName, bucket, key string) string {
+	return fmt.Sprintf(`{
+      "eventVersion": "2.1",
+      "eventSource": "aws:s3",
+      "awsRegion": "eu-west-1",
+      "eventTime": "2025-06-01T02:14:07.512Z",
+      "eventName": %q,
+      "userIdentity": {"principalId": "AWS:AROAEXAMPLE:medusa"},
+      "requestParameters": {"sourceIPAddress": "10.0.3.17"},
+      "responseElements": {"x-amz-request-id": "C3D13FE58DE4C810", "x-amz-id-2": "FMyUVURIY8/IgAtTv8xRjskZQpcIZ9KG4V5Wp6S7S/JRWeUWerMUE5JgHvANOjpD"},
+      "s3": {
+        "s3SchemaVersion": "1.0",
+        "configurationId": "medusa-manifests",
+        "bucket": {"name": %q, "ownerIdentity": {"principalId": "A3NL1KOZZKExample"}, "arn": "arn:aws:s3:::%s"},
+        "object": {"key": %q, "size": 1024, "eTag": "d41d8cd98f00b204e9800998ecf8427e", "sequencer": "0055AED6DCD90281E5"}
+      }
+    }`, eventName, bucket, bucket, key)
+}
+
+// s3EventJSON returns an S3 event notification of records
+func s3EventJSON(records ...string) string {
+	return `{"Records": [` + strings.Join(records, ",") + `]}`
+}
+
+func TestManifestsFromS3Event(t *testing.T) {
+	tests := []struct {
+		name        string
+		prefix      string
+		event       string
+		want        []string
+		wantInvalid int
+		wantErr     bool
+	}{
+		{
+			name:  "single manifest",
+			event: s3EventJSON(s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/b1/meta/manifest.json")),
+			want:  []string{"links/host1/b1/meta/manifest.json"},
+		},
+		{
+			name: "multiple records",
+			event: s3EventJSON(
+				s3EventRecordJSON("ObjectCreated:CompleteMultipartUpload", "test-bucket", "links/host1/b1/data/ks/t/nb-1-big-Data.db"),
+				s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/b1/meta/manifest.json"),
+				s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host2/b1/meta/manifest.json.gz"),
+				s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/b1/meta/schema.cql"),
+			),
+			want: []string{"links/host1/b1/meta/manifest.json", "links/host2/b1/meta/manifest.json.gz"},
+		},
+		{
+			name: "other events and buckets ignored",
+			event: s3EventJSON(
+				s3EventRecordJSON("ObjectRemoved:Delete", "test-bucket", "links/host1/b1/meta/manifest.json"),
+				s3EventRecordJSON("ObjectCreated:Put", "other-bucket", "links/host2/b1/meta/manifest.json"),
+				s3EventRecordJSON("ObjectCreated:Copy", "test-bucket", "links/host3/b1/meta/manifest.json"),
+			),
+			want: []string{"links/host3/b1/meta/manifest.json"},
+		},
+		{
+			name:  "url-encoded key",
+			event: s3EventJSON(s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/nightly+2025-06-01%3A02/meta/manifest.json")),
+			want:  []string{"links/host1/nightly 2025-06-01:02/meta/manifest.json"},
+		},
+		{
+			name: "duplicate records",
+			event: s3EventJSON(
+				s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/b1/meta/manifest.json"),
+				s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/b1/meta/manifest.json"),
+			),
+			want: []string{"links/host1/b1/meta/manifest.json"},
+		},
+		{
+			name:   "manifest outside -prefix",
+			prefix: "backups/prod/",
+			event: s3EventJSON(
+				s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/b1/meta/manifest.json"),
+				s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "backups/prod/links/host1/b1/meta/manifest.json"),
+			),
+			want:        []string{"backups/prod/links/host1/b1/meta/manifest.json"},
+			wantInvalid: 1,
+		},
+		{
+			name: "other clusters ignored",
+			event: s3EventJSON(
+				s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "billing/host1/b1/meta/manifest.json"),
+				s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/b1/meta/manifest.json"),
+			),
+			want: []string{"links/host1/b1/meta/manifest.json"},
+		},
+		{
+			name:  "no manifests",
+			event: s3EventJSON(s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/b1/data/ks/t/nb-1-big-Data.db")),
+		},
+		{
+			name:    "not an S3 event",
+			event:   `{"detail-type": "Object Created"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid JSON",
+			event:   `{"Records": [`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.prefix = tt.prefix
+			manifests, invalid, err := manifestsFromS3Event([]byte(tt.event), opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("manifestsFromS3Event() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("manifestsFromS3Event() error = %v", err)
+			}
+			var keys []string
+			for _, m := range manifests {
+				keys = append(keys, m.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("manifestsFromS3Event() = %v, want %v", keys, tt.want)
+			}
+			if invalid != tt.wantInvalid {
+				t.Errorf("manifestsFromS3Event() invalid = %d, want %d", invalid, tt.wantInvalid)
+			}
+		})
+	}
+}
+
+func TestRunProcessesS3Event(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	// Not in the event, so left alone
+	bucket.objects["links/host2/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host2/data/ks/t/b.db"] = ""
+
+	path := filepath.Join(t.TempDir(), "event.json")
+	event := s3EventJSON(
+		s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/data/ks/t/a.db"),
+		s3EventRecordJSON("ObjectCreated:Put", "test-bucket", "links/host1/b1/meta/manifest.json"),
+	)
+	if err := os.WriteFile(path, []byte(event), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.s3Event = path
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if r.stats.actions[actionUpdated] != 1 {
+		t.Errorf("run() counts = %v, want 1 updated", r.stats.actions)
+	}
+	if _, ok := bucket.retention["links/host2/data/ks/t/b.db"]; ok {
+		t.Error("object of a manifest not in the event was updated")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"sort"
+)
+
+// hostSharing splits the objects a host's processed backups reference into
+// those shared by several backups and those unique to one
+type hostSharing struct {
+	Host          string  `json:"host"`
+	Backups       int     `json:"backups"`
+	SharedObjects int     `json:"shared_objects"`
+	SharedBytes   int64   `json:"shared_bytes"`
+	UniqueObjects int     `json:"unique_objects"`
+	UniqueBytes   int64   `json:"unique_bytes"`
+	AvgBackups    float64 `json:"avg_backups_per_object"` // rounded to two decimals
+}
+
+// objectRefs counts the backups referencing an object
+type objectRefs struct {
+	backups int
+	size    int64 // as recorded in the manifests
+}
+
+// sharingTracker counts, per host, how many processed backups reference each
+// object, from the manifests alone
+type sharingTracker struct {
+	hosts   map[string]map[string]*objectRefs // object refs by key, per host
+	backups map[string]int                    // processed backups per host
+}
+
+// newSharingTracker creates an empty sharingTracker
+func newSharingTracker() *sharingTracker {
+	return &sharingTracker{
+		hosts:   make(map[string]map[string]*objectRefs),
+		backups: make(map[string]int),
+	}
+}
+
+// record counts the objects of the processed manifest m, whose data files are
+// stored under hostnamePath. An object listed twice in a manifest counts once.
+func (t *sharingTracker) record(m ManifestInfo, manifest *Manifest, hostnamePath string) {
+	host, ok := manifestHostname(m)
+	if !ok {
+		return
+	}
+	refs := t.hosts[host]
+	if refs == nil {
+		refs = make(map[string]*objectRefs)
+		t.hosts[host] = refs
+	}
+	t.backups[host]++
+	counted := make(map[string]bool, len(manifest.Objects))
+	for _, obj := range manifest.Objects {
+		key := resolveObjectKey(hostnamePath, obj.Path)
+		if counted[key] {
+			continue
+		}
+		counted[key] = true
+		ref := refs[key]
+		if ref == nil {
+			ref = &objectRefs{}
+			refs[key] = ref
+		}
+		ref.backups++
+		if obj.Size > 0 {
+			ref.size = obj.Size
+		}
+	}
+}
+
+// sharing returns the split of every host with a processed backup, by host
+func (t *sharingTracker) sharing() []hostSharing {
+	var hosts []hostSharing
+	for host, refs := range t.hosts {
+		h := hostSharing{Host: host, Backups: t.backups[host]}
+		total := 0
+		for _, ref := range refs {
+			total += ref.backups
+			if ref.backups > 1 {
+				h.SharedObjects++
+				h.SharedBytes += ref.size
+			} else {
+				h.UniqueObjects++
+				h.UniqueBytes += ref.size
+			}
+		}
+		if len(refs) > 0 {
+			h.AvgBackups = math.Round(100*float64(total)/float64(len(refs))) / 100
+		}
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+// reportSharing logs how much the backups of each host share and records it
+// for the summary
+func (r *refresher) reportSharing() {
+	hosts := r.sharing.sharing()
+	for _, h := range hosts {
+		slog.Info("Backup object sharing", "host", h.Host, "backups", h.Backups, "shared_objects", h.SharedObjects, "shared_bytes", h.SharedBytes, "unique_objects", h.UniqueObjects, "unique_bytes", h.UniqueBytes, "avg_backups_per_object", h.AvgBackups)
+	}
+	r.stats.setSharingByHost(hosts)
+}
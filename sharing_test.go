@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunSharingByHost(t *testing.T) {
+	bucket := newFakeBucket()
+	// host1: a.db is in all three backups, b.db in two, c.db and d.db in one each
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db","size":100},{"path":"data/ks/t/b.db","size":20}]}]`
+	bucket.objects["links/host1/b2/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db","size":100},{"path":"data/ks/t/b.db","size":20},{"path":"data/ks/t/c.db","size":5}]}]`
+	bucket.objects["links/host1/b3/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db","size":100},{"path":"data/ks/t/d.db","size":7},{"path":"data/ks/t/d.db","size":7}]}]`
+	// host2 has the same paths, which are different objects
+	bucket.objects["links/host2/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db","size":100}]}]`
+	for _, key := range []string{"host1/data/ks/t/a.db", "host1/data/ks/t/b.db", "host1/data/ks/t/c.db", "host1/data/ks/t/d.db", "host2/data/ks/t/a.db"} {
+		bucket.objects["links/"+key] = ""
+	}
+
+	opts := testOptions()
+	opts.dryRun = true
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	want := []hostSharing{
+		{Host: "host1", Backups: 3, SharedObjects: 2, SharedBytes: 120, UniqueObjects: 2, UniqueBytes: 12, AvgBackups: 1.75},
+		{Host: "host2", Backups: 1, UniqueObjects: 1, UniqueBytes: 100, AvgBackups: 1},
+	}
+	if got := r.stats.summary(time.Now()).SharingByHost; !reflect.DeepEqual(got, want) {
+		t.Errorf("summary sharing_by_host = %+v, want %+v", got, want)
+	}
+	// The counts come from the manifests, without any extra listing
+	if bucket.headCalls != 0 || len(bucket.listed) != 1 {
+		t.Errorf("made %d HeadObject calls and listed %v, want only the discovery listing", bucket.headCalls, bucket.listed)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// -notify-on values
+const (
+	notifyAlways  = "always"
+	notifyFailure = "failure"
+)
+
+// slackTopErrorClasses is how many error classes a Slack message lists
+const slackTopErrorClasses = 5
+
+// slackMaxErrorLength truncates the run error quoted in a Slack message
+const slackMaxErrorLength = 300
+
+// Colors of the bar of a Slack message
+const (
+	slackColorSuccess = "#2eb67d"
+	slackColorFailure = "#e01e5a"
+)
+
+// slackMessage is a Slack incoming webhook payload. Text is the notification
+// fallback; the attachment carries the colored bar and the blocks.
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// slackAttachment is a colored attachment of Block Kit blocks
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+// slackBlock is a Block Kit section block
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text,omitempty"`
+	Fields []slackText `json:"fields,omitempty"`
+}
+
+// slackText is a Block Kit mrkdwn text object
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// mrkdwn returns a mrkdwn text object
+func mrkdwn(text string) slackText {
+	return slackText{Type: "mrkdwn", Text: text}
+}
+
+// slackSection returns a section block of mrkdwn text
+func slackSection(text string) slackBlock {
+	t := mrkdwn(text)
+	return slackBlock{Type: "section", Text: &t}
+}
+
+// slackEscape escapes the characters Slack treats as control sequences
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// topErrorClasses formats the limit error classes with the most failures,
+// most first, with how many others were left out
+func topErrorClasses(classes map[string]int, limit int) string {
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if classes[names[i]] != classes[names[j]] {
+			return classes[names[i]] > classes[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	var parts []string
+	for i, name := range names {
+		if i == limit {
+			parts = append(parts, fmt.Sprintf("and %d more", len(names)-limit))
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s: %d", name, classes[name]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// slackSummary returns the Slack message reporting a run of cluster
+// described by sum, which failed with runErr when not nil
+func slackSummary(cluster string, sum runSummary, dryRun bool, runErr error) slackMessage {
+	status, color := "succeeded", slackColorSuccess
+	if runErr != nil {
+		status, color = "failed", slackColorFailure
+	}
+	updated := fmt.Sprintf("*Objects updated*\n%d", sum.Updated+sum.Reduced)
+	if dryRun {
+		updated = fmt.Sprintf("*Objects to update (dry run)*\n%d", sum.WouldUpdate+sum.WouldReduce)
+	}
+	headline := fmt.Sprintf("Medusa retention refresh of %s %s", slackEscape(cluster), status)
+	blocks := []slackBlock{
+		slackSection("*" + headline + "*"),
+		{Type: "section", Fields: []slackText{
+			mrkdwn("*Cluster*\n" + slackEscape(cluster)),
+			mrkdwn(updated),
+			mrkdwn(fmt.Sprintf("*Failures*\n%d", sum.Errors)),
+			mrkdwn("*Duration*\n" + sum.Elapsed),
+		}},
+	}
+	if sum.Errors > 0 {
+		blocks = append(blocks, slackSection("*Top error classes*\n"+topErrorClasses(sum.ErrorsByClass, slackTopErrorClasses)))
+	}
+	if runErr != nil {
+		msg := []rune(runErr.Error())
+		if len(msg) > slackMaxErrorLength {
+			msg = append(msg[:slackMaxErrorLength], '…')
+		}
+		blocks = append(blocks, slackSection("*Error*\n"+slackEscape(string(msg))))
+	}
+	return slackMessage{Text: headline, Attachments: []slackAttachment{{Color: color, Blocks: blocks}}}
+}
+
+// postSlack posts msg to the Slack incoming webhook at webhookURL
+func postSlack(ctx context.Context, client *http.Client, webhookURL string, msg slackMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode Slack message: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post Slack message: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post Slack message: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to post Slack message: %s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+	return nil
+}
+
+// notifySlack posts the run's summary to -slack-webhook-url, unless
+// -notify-on failure and the run succeeded. Slack being unreachable doesn't
+// fail the run, it's only logged.
+func (r *refresher) notifySlack(ctx context.Context, runErr error) {
+	opts := r.opts
+	if opts.slackWebhookURL == "" || (opts.notifyOn == notifyFailure && runErr == nil) {
+		return
+	}
+	// The run's outcome is posted even when it was interrupted
+	notifyCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+	defer cancel()
+	msg := slackSummary(opts.cluster, r.stats.summary(time.Now()), opts.dryRun, runErr)
+	if err := postSlack(notifyCtx, http.DefaultClient, opts.slackWebhookURL, msg); err != nil {
+		slog.Warn("Failed to notify Slack", errorAttrs(err)...)
+		return
+	}
+	slog.Info("Notified Slack")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slackTexts returns every text of the blocks of msg, in order
+func slackTexts(msg slackMessage) []string {
+	var texts []string
+	for _, a := range msg.Attachments {
+		for _, b := range a.Blocks {
+			if b.Text != nil {
+				texts = append(texts, b.Text.Text)
+			}
+			for _, f := range b.Fields {
+				texts = append(texts, f.Text)
+			}
+		}
+	}
+	return texts
+}
+
+func TestSlackSummary(t *testing.T) {
+	tests := []struct {
+		name      string
+		sum       runSummary
+		dryRun    bool
+		runErr    error
+		wantColor string
+		want      []string
+		notWant   []string
+	}{
+		{
+			name:      "success",
+			sum:       runSummary{Updated: 40, Reduced: 2, Elapsed: "1m30s"},
+			wantColor: slackColorSuccess,
+			want:      []string{"*Medusa retention refresh of links succeeded*", "*Cluster*\nlinks", "*Objects updated*\n42", "*Failures*\n0", "*Duration*\n1m30s"},
+			notWant:   []string{"Top error classes", "*Error*"},
+		},
+		{
+			name: "failure",
+			sum: runSummary{Updated: 3, Errors: 28, Elapsed: "2s", ErrorsByClass: map[string]int{
+				"access_denied": 10, "throttled": 8, "other": 4, "not_found": 3, "canceled": 2, "timeout": 1,
+			}},
+			runErr:    errors.New("28 objects failed: <access denied>"),
+			wantColor: slackColorFailure,
+			want: []string{
+				"*Medusa retention refresh of links failed*",
+				"*Failures*\n28",
+				"*Top error classes*\naccess_denied: 10, throttled: 8, other: 4, not_found: 3, canceled: 2, and 1 more",
+				"*Error*\n28 objects failed: &lt;access denied&gt;",
+			},
+		},
+		{
+			name:      "dry run",
+			sum:       runSummary{WouldUpdate: 7, WouldReduce: 1, Elapsed: "1s"},
+			dryRun:    true,
+			wantColor: slackColorSuccess,
+			want:      []string{"*Objects to update (dry run)*\n8"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := slackSummary("links", tt.sum, tt.dryRun, tt.runErr)
+			if len(msg.Attachments) != 1 || msg.Attachments[0].Color != tt.wantColor {
+				t.Fatalf("attachments = %+v, want one colored %s", msg.Attachments, tt.wantColor)
+			}
+			if !strings.HasPrefix(msg.Text, "Medusa retention refresh of links") {
+				t.Errorf("fallback text = %q", msg.Text)
+			}
+			texts := strings.Join(slackTexts(msg), "\n---\n")
+			for _, want := range tt.want {
+				if !strings.Contains(texts, want) {
+					t.Errorf("message missing %q:\n%s", want, texts)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(texts, notWant) {
+					t.Errorf("message has %q:\n%s", notWant, texts)
+				}
+			}
+		})
+	}
+}
+
+func TestRunNotifiesSlack(t *testing.T) {
+	tests := []struct {
+		name     string
+		notifyOn string
+		fail     bool
+		wantPost bool
+	}{
+		{name: "always, success", notifyOn: notifyAlways, wantPost: true},
+		{name: "always, failure", notifyOn: notifyAlways, fail: true, wantPost: true},
+		{name: "failure, success", notifyOn: notifyFailure},
+		{name: "failure, failure", notifyOn: notifyFailure, fail: true, wantPost: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var posts []slackMessage
+			webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("got %s with Content-Type %q, want a JSON POST", req.Method, req.Header.Get("Content-Type"))
+				}
+				body, _ := io.ReadAll(req.Body)
+				var msg slackMessage
+				if err := json.Unmarshal(body, &msg); err != nil {
+					t.Errorf("invalid Slack payload %s: %v", body, err)
+				}
+				posts = append(posts, msg)
+			}))
+			defer webhook.Close()
+
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+			bucket.objects["links/host1/data/ks/t/a.db"] = ""
+			opts := testOptions()
+			opts.slackWebhookURL = webhook.URL
+			opts.notifyOn = tt.notifyOn
+			if tt.fail {
+				// A pin matching no backup fails the run after processing it
+				bucket.objects["ops/pins.txt"] = "links/host9/backup1\n"
+				opts.pinsFile = "s3://test-bucket/ops/pins.txt"
+			}
+			r := newRefresher(bucket.client(), opts, time.Now())
+			err := r.run(context.Background())
+			if (err != nil) != tt.fail {
+				t.Fatalf("run() error = %v, want failure %v", err, tt.fail)
+			}
+
+			if !tt.wantPost {
+				if len(posts) != 0 {
+					t.Errorf("posted %d messages, want none", len(posts))
+				}
+				return
+			}
+			if len(posts) != 1 {
+				t.Fatalf("posted %d messages, want 1", len(posts))
+			}
+			wantColor := slackColorSuccess
+			if tt.fail {
+				wantColor = slackColorFailure
+			}
+			if posts[0].Attachments[0].Color != wantColor {
+				t.Errorf("color = %s, want %s", posts[0].Attachments[0].Color, wantColor)
+			}
+			if texts := strings.Join(slackTexts(posts[0]), "\n"); !strings.Contains(texts, "*Objects updated*\n1") {
+				t.Errorf("message doesn't report the updated object:\n%s", texts)
+			}
+		})
+	}
+}
+
+func TestSlackFailureIsNotFatal(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, 0} {
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "invalid_payload", status)
+		}))
+		url := webhook.URL
+		if status == 0 {
+			// Slack is unreachable
+			webhook.Close()
+		}
+
+		opts := testOptions()
+		opts.slackWebhookURL = url
+		r := newRefresher(newFakeBucket().client(), opts, time.Now())
+		if err := r.run(context.Background()); err != nil {
+			t.Errorf("run() error = %v with Slack failing, want nil", err)
+		}
+		webhook.Close()
+	}
+}
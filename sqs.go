@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// SQSAPI receives the -sqs-queue-url messages and moves failed ones to
+// -sqs-dlq-url
+type SQSAPI interface {
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+}
+
+const (
+	// sqsWaitSeconds is how long a receive long-polls for messages, the
+	// most SQS allows
+	sqsWaitSeconds = 20
+	// defaultSQSMaxMessages is the -sqs-max-messages default, the most
+	// SQS returns per receive
+	defaultSQSMaxMessages = 10
+	// defaultSQSVisibility is the -sqs-visibility-timeout default
+	defaultSQSVisibility = 5 * time.Minute
+	// defaultSQSMaxReceives is the -sqs-max-receives default
+	defaultSQSMaxReceives = 5
+)
+
+// sqsTarget is the work an SQS message names: a manifest, or every backup of
+// a host
+type sqsTarget struct {
+	ManifestKey string `json:"manifest_key"`
+	Cluster     string `json:"cluster"`
+	Host        string `json:"host"`
+}
+
+// parseSQSMessage reads the target of a message body: a JSON object with
+// manifest_key, or cluster and host, or the same as plain text, a manifest
+// key or cluster/host
+func parseSQSMessage(body string) (sqsTarget, error) {
+	body = strings.TrimSpace(body)
+	var target sqsTarget
+	if strings.HasPrefix(body, "{") {
+		if err := json.Unmarshal([]byte(body), &target); err != nil {
+			return target, fmt.Errorf("failed to parse message: %w", err)
+		}
+	} else if isManifestKey(body) {
+		target.ManifestKey = body
+	} else if cluster, host, ok := strings.Cut(body, "/"); ok {
+		target.Cluster, target.Host = cluster, host
+	}
+	switch {
+	case target.ManifestKey != "" && (target.Cluster != "" || target.Host != ""):
+		return target, errors.New("message names both a manifest and a host")
+	case target.ManifestKey == "" && (target.Cluster == "" || target.Host == "" || strings.Contains(target.Host, "/")):
+		return target, fmt.Errorf("message %q names no manifest key or cluster/host", body)
+	}
+	return target, nil
+}
+
+// options returns the options of the run processing target, a copy of base
+// narrowed to the target's manifest or host
+func (t sqsTarget) options(base *options) (*options, error) {
+	opts := *base
+	if t.ManifestKey != "" {
+		if err := validateManifestKey(t.ManifestKey, opts.prefix, opts.pathDepth, opts.forceManifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest key: %w", err)
+		}
+		mp, _ := extractHostnamePath(t.ManifestKey, opts.prefix, opts.pathDepth)
+		opts.cluster, opts.manifestKey = mp.Cluster, t.ManifestKey
+		return &opts, nil
+	}
+	opts.cluster = t.Cluster
+	opts.hosts = hostFilter{pattern: regexp.MustCompile("^" + regexp.QuoteMeta(t.Host) + "$")}
+	return &opts, nil
+}
+
+// sqsConsumer processes the manifests and hosts named by the -sqs-queue-url
+// messages until interrupted
+type sqsConsumer struct {
+	client      SQSAPI
+	opts        *options
+	run         func(ctx context.Context, opts *options) error // processes a message's target
+	extendEvery time.Duration                                  // how often the visibility of received messages is extended
+	processed   int
+	failed      int
+}
+
+// newSQSConsumer creates a consumer running each message's target through
+// the refresh pipeline on s3Client
+func newSQSConsumer(client SQSAPI, s3Client S3API, opts *options) *sqsConsumer {
+	return &sqsConsumer{
+		client: client,
+		opts:   opts,
+		run: func(ctx context.Context, opts *options) error {
+			r := newRefresher(s3Client, opts, time.Now())
+			if err := r.run(ctx); err != nil {
+				return err
+			}
+			// Failed objects are retried with the redelivered message
+			if n := r.stats.summary(time.Now()).Errors; n > 0 {
+				return fmt.Errorf("failed to process %d objects", n)
+			}
+			return nil
+		},
+		extendEvery: opts.sqsVisibility / 2,
+	}
+}
+
+// consume long-polls the queue, processing each received message and deleting
+// it once processed. Failed messages are left for redelivery, or moved to
+// -sqs-dlq-url after -sqs-max-receives attempts. When ctx is canceled the
+// message being processed is finished and the rest of its batch released.
+func (c *sqsConsumer) consume(ctx context.Context) error {
+	slog.Info("Consuming SQS queue", "queue", c.opts.sqsQueueURL, "max_messages", c.opts.sqsMaxMessages)
+	for ctx.Err() == nil {
+		out, err := c.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:                    aws.String(c.opts.sqsQueueURL),
+			MaxNumberOfMessages:         int32(c.opts.sqsMaxMessages),
+			WaitTimeSeconds:             sqsWaitSeconds,
+			VisibilityTimeout:           c.visibilitySeconds(),
+			MessageSystemAttributeNames: []sqstypes.MessageSystemAttributeName{sqstypes.MessageSystemAttributeNameApproximateReceiveCount},
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return fmt.Errorf("failed to receive SQS messages: %w", err)
+		}
+		c.processBatch(ctx, out.Messages)
+	}
+	slog.Info("Stopped consuming SQS queue", "processed", c.processed, "failed", c.failed)
+	return nil
+}
+
+// visibilitySeconds returns -sqs-visibility-timeout in the whole seconds SQS
+// takes
+func (c *sqsConsumer) visibilitySeconds() int32 {
+	return int32((c.opts.sqsVisibility + time.Second - 1) / time.Second)
+}
+
+// processBatch processes received messages in turn, extending the visibility
+// of those not done yet so that long manifests aren't redelivered meanwhile
+func (c *sqsConsumer) processBatch(ctx context.Context, messages []sqstypes.Message) {
+	if len(messages) == 0 {
+		return
+	}
+	// In-flight messages are finished after an interrupt
+	workCtx := context.WithoutCancel(ctx)
+	pending := newPendingMessages(messages)
+	defer c.startVisibilityExtension(workCtx, pending)()
+
+	for i, msg := range messages {
+		if ctx.Err() != nil {
+			c.release(workCtx, messages[i:])
+			return
+		}
+		c.handle(workCtx, msg)
+		pending.done(msg)
+	}
+}
+
+// handle processes a message, deleting it on success
+func (c *sqsConsumer) handle(ctx context.Context, msg sqstypes.Message) {
+	id := aws.ToString(msg.MessageId)
+	target, err := parseSQSMessage(aws.ToString(msg.Body))
+	var opts *options
+	if err == nil {
+		opts, err = target.options(c.opts)
+	}
+	if err == nil {
+		slog.Info("Processing SQS message", "message_id", id, "manifest", target.ManifestKey, "cluster", opts.cluster, "host", target.Host)
+		err = c.run(ctx, opts)
+	}
+	if err == nil {
+		c.processed++
+		c.delete(ctx, msg)
+		return
+	}
+
+	c.failed++
+	receives, _ := strconv.Atoi(msg.Attributes[string(sqstypes.MessageSystemAttributeNameApproximateReceiveCount)])
+	slog.Error("Failed to process SQS message", append([]any{"message_id", id, "receives", receives}, errorAttrs(err)...)...)
+	if c.opts.sqsDLQURL != "" && receives >= c.opts.sqsMaxReceives {
+		c.deadLetter(ctx, msg, err)
+	}
+}
+
+// delete removes a processed message from the queue. A message that can't
+// be deleted is redelivered and processed again, which changes nothing.
+func (c *sqsConsumer) delete(ctx context.Context, msg sqstypes.Message) {
+	_, err := c.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(c.opts.sqsQueueURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		slog.Warn("Failed to delete SQS message", append([]any{"message_id", aws.ToString(msg.MessageId)}, errorAttrs(err)...)...)
+	}
+}
+
+// deadLetter moves a message that failed -sqs-max-receives times to
+// -sqs-dlq-url, with the error of its last attempt
+func (c *sqsConsumer) deadLetter(ctx context.Context, msg sqstypes.Message, cause error) {
+	_, err := c.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(c.opts.sqsDLQURL),
+		MessageBody: msg.Body,
+		MessageAttributes: map[string]sqstypes.MessageAttributeValue{
+			"error":      {DataType: aws.String("String"), StringValue: aws.String(cause.Error())},
+			"message_id": {DataType: aws.String("String"), StringValue: msg.MessageId},
+		},
+	})
+	if err != nil {
+		slog.Error("Failed to move SQS message to -sqs-dlq-url", append([]any{"message_id", aws.ToString(msg.MessageId)}, errorAttrs(err)...)...)
+		return
+	}
+	slog.Warn("Moved SQS message to -sqs-dlq-url", "message_id", aws.ToString(msg.MessageId))
+	c.delete(ctx, msg)
+}
+
+// release makes messages that weren't processed visible again, for another
+// consumer to pick up
+func (c *sqsConsumer) release(ctx context.Context, messages []sqstypes.Message) {
+	for _, msg := range messages {
+		if err := c.changeVisibility(ctx, msg, 0); err != nil {
+			slog.Warn("Failed to release SQS message", append([]any{"message_id", aws.ToString(msg.MessageId)}, errorAttrs(err)...)...)
+		}
+	}
+	slog.Info("Released unprocessed SQS messages", "messages", len(messages))
+}
+
+// changeVisibility sets the visibility timeout of a received message
+func (c *sqsConsumer) changeVisibility(ctx context.Context, msg sqstypes.Message, seconds int32) error {
+	_, err := c.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(c.opts.sqsQueueURL),
+		ReceiptHandle:     msg.ReceiptHandle,
+		VisibilityTimeout: seconds,
+	})
+	return err
+}
+
+// startVisibilityExtension extends the visibility of the pending messages
+// every extendEvery until the returned func is called
+func (c *sqsConsumer) startVisibilityExtension(ctx context.Context, pending *pendingMessages) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(c.extendEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, msg := range pending.list() {
+					if err := c.changeVisibility(ctx, msg, c.visibilitySeconds()); err != nil {
+						slog.Warn("Failed to extend SQS message visibility", append([]any{"message_id", aws.ToString(msg.MessageId)}, errorAttrs(err)...)...)
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// pendingMessages are the messages of a batch not processed yet
+type pendingMessages struct {
+	mu       sync.Mutex
+	messages []sqstypes.Message
+}
+
+func newPendingMessages(messages []sqstypes.Message) *pendingMessages {
+	return &pendingMessages{messages: append([]sqstypes.Message(nil), messages...)}
+}
+
+// done removes a processed message
+func (p *pendingMessages) done(msg sqstypes.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, m := range p.messages {
+		if aws.ToString(m.ReceiptHandle) == aws.ToString(msg.ReceiptHandle) {
+			p.messages = append(p.messages[:i], p.messages[i+1:]...)
+			return
+		}
+	}
+}
+
+// list returns the pending messages
+func (p *pendingMessages) list() []sqstypes.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]sqstypes.Message(nil), p.messages...)
+}
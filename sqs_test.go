@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	testQueueURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/medusa-retention"
+	testDLQURL   = "https://sqs.eu-west-1.amazonaws.com/123456789012/medusa-retention-dlq"
+)
+
+// mockSQS returns batches in turn, canceling the consumer once they're all
+// received, and records the calls made about each receipt handle
+type mockSQS struct {
+	mu         sync.Mutex
+	batches    [][]sqstypes.Message
+	cancel     context.CancelFunc
+	receives   []*sqs.ReceiveMessageInput
+	deleted    []string
+	visibility map[string][]int32 // visibility timeouts set, by receipt handle
+	sent       []*sqs.SendMessageInput
+}
+
+func (m *mockSQS) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.receives = append(m.receives, params)
+	if len(m.batches) == 0 {
+		m.cancel()
+		return nil, ctx.Err()
+	}
+	batch := m.batches[0]
+	m.batches = m.batches[1:]
+	return &sqs.ReceiveMessageOutput{Messages: batch}, nil
+}
+
+func (m *mockSQS) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, aws.ToString(params.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (m *mockSQS) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.visibility == nil {
+		m.visibility = make(map[string][]int32)
+	}
+	handle := aws.ToString(params.ReceiptHandle)
+	m.visibility[handle] = append(m.visibility[handle], params.VisibilityTimeout)
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (m *mockSQS) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, params)
+	return &sqs.SendMessageOutput{MessageId: aws.String("dlq-1")}, nil
+}
+
+// visibilityChanges returns the visibility timeouts set for handle
+func (m *mockSQS) visibilityChanges(handle string) []int32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]int32(nil), m.visibility[handle]...)
+}
+
+// sqsMessage returns a received message with the given receive count
+func sqsMessage(handle, body string, receives int) sqstypes.Message {
+	return sqstypes.Message{
+		MessageId:     aws.String("id-" + handle),
+		ReceiptHandle: aws.String(handle),
+		Body:          aws.String(body),
+		Attributes:    map[string]string{string(sqstypes.MessageSystemAttributeNameApproximateReceiveCount): strconv.Itoa(receives)},
+	}
+}
+
+// sqsOptions returns the options of a consumer of testQueueURL
+func sqsOptions() *options {
+	opts := testOptions()
+	opts.sqsQueueURL = testQueueURL
+	opts.sqsMaxMessages = 4
+	opts.sqsVisibility = defaultSQSVisibility
+	opts.sqsMaxReceives = defaultSQSMaxReceives
+	return opts
+}
+
+func TestParseSQSMessage(t *testing.T) {
+	tests := []struct {
+		body    string
+		want    sqsTarget
+		wantErr bool
+	}{
+		{body: "links/host1/b1/meta/manifest.json", want: sqsTarget{ManifestKey: "links/host1/b1/meta/manifest.json"}},
+		{body: "links/host1\n", want: sqsTarget{Cluster: "links", Host: "host1"}},
+		{body: `{"manifest_key": "links/host1/b1/meta/manifest.json.gz"}`, want: sqsTarget{ManifestKey: "links/host1/b1/meta/manifest.json.gz"}},
+		{body: `{"cluster": "links", "host": "host1"}`, want: sqsTarget{Cluster: "links", Host: "host1"}},
+		{body: `{"cluster": "links"}`, wantErr: true},
+		{body: `{"manifest_key": "links/host1/b1/meta/manifest.json", "host": "host1"}`, wantErr: true},
+		{body: "links/host1/b1", wantErr: true},
+		{body: "links", wantErr: true},
+		{body: `{"manifest_key": `, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSQSMessage(tt.body)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSQSMessage(%q) = %+v, want an error", tt.body, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseSQSMessage(%q) = %+v, %v, want %+v", tt.body, got, err, tt.want)
+		}
+	}
+}
+
+func TestSQSConsumerProcessesMessages(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host2/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host2/data/ks/t/b.db"] = ""
+	// Named by no message, so left alone
+	bucket.objects["links/host3/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/c.db"}]}]`
+	bucket.objects["links/host3/data/ks/t/c.db"] = ""
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := &mockSQS{cancel: cancel, batches: [][]sqstypes.Message{
+		{sqsMessage("m1", "links/host1/b1/meta/manifest.json", 1)},
+		{sqsMessage("m2", `{"cluster": "links", "host": "host2"}`, 1), sqsMessage("m3", "not a target", 1)},
+	}}
+	c := newSQSConsumer(queue, bucket.client(), sqsOptions())
+	if err := c.consume(ctx); err != nil {
+		t.Fatalf("consume() error = %v", err)
+	}
+
+	if want := []string{"m1", "m2"}; !reflect.DeepEqual(queue.deleted, want) {
+		t.Errorf("deleted %v, want %v, leaving the invalid message for redelivery", queue.deleted, want)
+	}
+	for key, want := range map[string]bool{
+		"links/host1/data/ks/t/a.db": true,
+		"links/host2/data/ks/t/b.db": true,
+		"links/host3/data/ks/t/c.db": false,
+	} {
+		if _, ok := bucket.retention[key]; ok != want {
+			t.Errorf("retention of %s set = %v, want %v", key, ok, want)
+		}
+	}
+	if c.processed != 2 || c.failed != 1 {
+		t.Errorf("processed %d and failed %d messages, want 2 and 1", c.processed, c.failed)
+	}
+	in := queue.receives[0]
+	if aws.ToString(in.QueueUrl) != testQueueURL || in.MaxNumberOfMessages != 4 || in.WaitTimeSeconds != sqsWaitSeconds || in.VisibilityTimeout != 300 {
+		t.Errorf("received with %+v", in)
+	}
+}
+
+func TestSQSConsumerDeadLetters(t *testing.T) {
+	tests := []struct {
+		name     string
+		dlq      string
+		receives int
+		wantDLQ  bool
+	}{
+		{name: "retried", dlq: testDLQURL, receives: defaultSQSMaxReceives - 1},
+		{name: "moved after max receives", dlq: testDLQURL, receives: defaultSQSMaxReceives, wantDLQ: true},
+		{name: "left to the queue's redrive policy", receives: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			queue := &mockSQS{cancel: cancel, batches: [][]sqstypes.Message{
+				{sqsMessage("m1", "links/host1/b1/meta/manifest.json", tt.receives)},
+			}}
+			opts := sqsOptions()
+			opts.sqsDLQURL = tt.dlq
+			c := newSQSConsumer(queue, newFakeBucket().client(), opts)
+			c.run = func(ctx context.Context, opts *options) error { return errors.New("AccessDenied") }
+			if err := c.consume(ctx); err != nil {
+				t.Fatalf("consume() error = %v", err)
+			}
+
+			if !tt.wantDLQ {
+				if len(queue.sent) != 0 || len(queue.deleted) != 0 {
+					t.Errorf("sent %d and deleted %v, want the message left in the queue", len(queue.sent), queue.deleted)
+				}
+				return
+			}
+			if len(queue.sent) != 1 || !reflect.DeepEqual(queue.deleted, []string{"m1"}) {
+				t.Fatalf("sent %d and deleted %v, want the message moved", len(queue.sent), queue.deleted)
+			}
+			sent := queue.sent[0]
+			if aws.ToString(sent.QueueUrl) != testDLQURL || aws.ToString(sent.MessageBody) != "links/host1/b1/meta/manifest.json" {
+				t.Errorf("sent %s to %s", aws.ToString(sent.MessageBody), aws.ToString(sent.QueueUrl))
+			}
+			if got := aws.ToString(sent.MessageAttributes["error"].StringValue); got != "AccessDenied" {
+				t.Errorf("dead letter error = %q, want the failure", got)
+			}
+		})
+	}
+}
+
+func TestSQSConsumerExtendsVisibility(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := &mockSQS{cancel: cancel, batches: [][]sqstypes.Message{
+		{sqsMessage("m1", "links/host1/b1/meta/manifest.json", 1), sqsMessage("m2", "links/host2/b1/meta/manifest.json", 1)},
+	}}
+	c := newSQSConsumer(queue, newFakeBucket().client(), sqsOptions())
+	c.extendEvery = time.Millisecond
+	// The first manifest is long, taking until both messages were extended
+	c.run = func(ctx context.Context, opts *options) error {
+		deadline := time.Now().Add(5 * time.Second)
+		for opts.manifestKey == "links/host1/b1/meta/manifest.json" && (len(queue.visibilityChanges("m1")) == 0 || len(queue.visibilityChanges("m2")) == 0) {
+			if time.Now().After(deadline) {
+				return errors.New("visibility not extended")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}
+	if err := c.consume(ctx); err != nil {
+		t.Fatalf("consume() error = %v", err)
+	}
+	if c.processed != 2 {
+		t.Fatalf("processed %d messages, want 2", c.processed)
+	}
+	for _, handle := range []string{"m1", "m2"} {
+		for _, timeout := range queue.visibilityChanges(handle) {
+			if timeout != 300 {
+				t.Errorf("visibility of %s extended by %ds, want -sqs-visibility-timeout", handle, timeout)
+			}
+		}
+	}
+	// Processed messages are no longer extended
+	n := len(queue.visibilityChanges("m1"))
+	time.Sleep(10 * time.Millisecond)
+	if len(queue.visibilityChanges("m1")) != n {
+		t.Error("visibility extended after the batch was processed")
+	}
+}
+
+func TestSQSConsumerShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := &mockSQS{cancel: cancel, batches: [][]sqstypes.Message{
+		{sqsMessage("m1", "links/host1/b1/meta/manifest.json", 1), sqsMessage("m2", "links/host2/b1/meta/manifest.json", 1)},
+		{sqsMessage("m3", "links/host3/b1/meta/manifest.json", 1)},
+	}}
+	c := newSQSConsumer(queue, newFakeBucket().client(), sqsOptions())
+	var processed []string
+	// Interrupted while processing the first message
+	c.run = func(runCtx context.Context, opts *options) error {
+		cancel()
+		if runCtx.Err() != nil {
+			return errors.New("in-flight message interrupted")
+		}
+		processed = append(processed, opts.manifestKey)
+		return nil
+	}
+	if err := c.consume(ctx); err != nil {
+		t.Fatalf("consume() error = %v", err)
+	}
+
+	if want := []string{"links/host1/b1/meta/manifest.json"}; !reflect.DeepEqual(processed, want) {
+		t.Errorf("processed %v, want the in-flight message only", processed)
+	}
+	if !reflect.DeepEqual(queue.deleted, []string{"m1"}) {
+		t.Errorf("deleted %v, want the finished message", queue.deleted)
+	}
+	if got := queue.visibilityChanges("m2"); !reflect.DeepEqual(got, []int32{0}) {
+		t.Errorf("visibility of the unprocessed message set to %v, want it released", got)
+	}
+	if len(queue.receives) != 1 {
+		t.Errorf("received %d times, want no receive after the interrupt", len(queue.receives))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sseCustomerKeyEnv holds the base64 SSE-C key when -sse-c-key isn't set
+const sseCustomerKeyEnv = "MEDUSA_SSE_C_KEY"
+
+// sseCustomerAlgorithm is the only algorithm S3 supports for SSE-C
+const sseCustomerAlgorithm = "AES256"
+
+// errSSECKeyRejected marks a request S3 denied although it carried the SSE-C
+// key: the object was encrypted with another key
+var errSSECKeyRejected = errors.New("SSE-C key rejected, the object may be encrypted with another key")
+
+// sseCustomerKey is the SSE-C key Medusa encrypts its uploads with, as the
+// base64 request headers S3 expects
+type sseCustomerKey struct {
+	key    string
+	keyMD5 string
+}
+
+// parseSSECustomerKey parses a base64 256-bit key, as in Medusa's sse_c_key
+func parseSSECustomerKey(encoded string) (*sseCustomerKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode SSE-C key: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("invalid SSE-C key: %d bytes, want a 256-bit key", len(raw))
+	}
+	sum := md5.Sum(raw)
+	return &sseCustomerKey{
+		key:    base64.StdEncoding.EncodeToString(raw),
+		keyMD5: base64.StdEncoding.EncodeToString(sum[:]),
+	}, nil
+}
+
+// loadSSECustomerKey reads the base64 key of the -sse-c-key file, or of the
+// MEDUSA_SSE_C_KEY environment variable without it. It returns nil when
+// neither is set.
+func loadSSECustomerKey(path string) (*sseCustomerKey, error) {
+	if path == "" {
+		encoded := os.Getenv(sseCustomerKeyEnv)
+		if encoded == "" {
+			return nil, nil
+		}
+		key, err := parseSSECustomerKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", sseCustomerKeyEnv, err)
+		}
+		return key, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -sse-c-key: %w", err)
+	}
+	key, err := parseSSECustomerKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("-sse-c-key %s: %w", path, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// testSSECKey is a base64 256-bit SSE-C key, and testSSECKeyMD5 its base64 MD5
+const (
+	testSSECKey    = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testSSECKeyMD5 = "hRasmdxgYDKV3nvbahU1MA=="
+)
+
+func TestLoadSSECustomerKey(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name    string
+		path    string
+		env     string
+		want    *sseCustomerKey
+		wantErr string
+	}{
+		{name: "none"},
+		{name: "file", path: write("key", testSSECKey+"\n"), want: &sseCustomerKey{key: testSSECKey, keyMD5: testSSECKeyMD5}},
+		{name: "environment", env: testSSECKey, want: &sseCustomerKey{key: testSSECKey, keyMD5: testSSECKeyMD5}},
+		{name: "file over environment", path: write("key", testSSECKey), env: "not base64", want: &sseCustomerKey{key: testSSECKey, keyMD5: testSSECKeyMD5}},
+		{name: "missing file", path: filepath.Join(dir, "missing"), wantErr: "failed to read -sse-c-key"},
+		{name: "not base64", path: write("bad", "not base64!"), wantErr: "failed to decode SSE-C key"},
+		{name: "short key", env: "c2hvcnQ=", wantErr: "MEDUSA_SSE_C_KEY: invalid SSE-C key: 5 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(sseCustomerKeyEnv, tt.env)
+			got, err := loadSSECustomerKey(tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadSSECustomerKey() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadSSECustomerKey() error = %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("loadSSECustomerKey() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBucketClientSSECustomerKey(t *testing.T) {
+	key := &sseCustomerKey{key: testSSECKey, keyMD5: testSSECKeyMD5}
+	var gets, heads []string
+	client := &MockS3Client{
+		GetObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			gets = append(gets, fmt.Sprintf("%s %s %s", aws.ToString(params.SSECustomerAlgorithm), aws.ToString(params.SSECustomerKey), aws.ToString(params.SSECustomerKeyMD5)))
+			return &s3.GetObjectOutput{}, nil
+		},
+		HeadObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			heads = append(heads, fmt.Sprintf("%s %s %s", aws.ToString(params.SSECustomerAlgorithm), aws.ToString(params.SSECustomerKey), aws.ToString(params.SSECustomerKeyMD5)))
+			return &s3.HeadObjectOutput{}, nil
+		},
+		PutObjectRetentionFunc: func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+			return &s3.PutObjectRetentionOutput{}, nil
+		},
+	}
+	wrapped := wrapBucketClient(client, commonOptions{bucket: "my-backups", sseCKey: key})
+	ctx := context.Background()
+	for _, in := range []*s3.GetObjectInput{
+		{Bucket: aws.String("my-backups"), Key: aws.String("prod/host1/b1/meta/manifest.json")},
+		{Bucket: aws.String("my-backups"), Key: aws.String("prod/host1/b1/meta/manifest.json.gz")},
+		{Bucket: aws.String("my-backups"), Key: aws.String("pins.yaml")},
+		{Bucket: aws.String("policies"), Key: aws.String("prod/host1/b1/meta/manifest.json")},
+	} {
+		if _, err := wrapped.GetObject(ctx, in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	headers := "AES256 " + testSSECKey + " " + testSSECKeyMD5
+	if want := []string{headers, headers, "  ", "  "}; strings.Join(gets, "|") != strings.Join(want, "|") {
+		t.Errorf("GetObject SSE-C headers = %q, want %q", gets, want)
+	}
+	if _, err := wrapped.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("my-backups"), Key: aws.String("prod/host1/data/ks/t/a.db")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(heads) != 1 || heads[0] != headers {
+		t.Errorf("HeadObject SSE-C headers = %q, want %q", heads, headers)
+	}
+	if _, err := wrapped.PutObjectRetention(ctx, &s3.PutObjectRetentionInput{Bucket: aws.String("my-backups"), Key: aws.String("prod/host1/data/ks/t/a.db")}); err != nil {
+		t.Errorf("PutObjectRetention() error = %v with -sse-c-key", err)
+	}
+}
+
+func TestSSECErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "key missing",
+			err:  &smithy.GenericAPIError{Code: "InvalidRequest", Message: "The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object."},
+			want: errorClassEncryption,
+		},
+		{
+			name: "wrong key",
+			err:  rejectedKey(&smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}),
+			want: errorClassEncryption,
+		},
+		{
+			name: "wrong key on head",
+			err:  fmt.Errorf("failed to head object: %w", rejectedKey(&smithy.GenericAPIError{Code: "Forbidden"})),
+			want: errorClassEncryption,
+		},
+		{
+			name: "not found with a key",
+			err:  rejectedKey(&smithy.GenericAPIError{Code: "NoSuchKey"}),
+			want: errorClassNotFound,
+		},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("%s: errorClass(%v) = %s, want %s", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRunReportsWrongSSECKeyPerManifest(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host2/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host2/data/ks/t/b.db"] = ""
+	client := bucket.client()
+	getObject := client.GetObjectFunc
+	client.GetObjectFunc = func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		// Refreshed markers are written by the tool, unencrypted
+		if aws.ToString(params.SSECustomerKey) != testSSECKey && !isMarkerKey(aws.ToString(params.Key)) {
+			t.Errorf("GetObject(%s) without the SSE-C key", aws.ToString(params.Key))
+		}
+		if strings.HasPrefix(aws.ToString(params.Key), "links/host2/") {
+			return nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+		}
+		return getObject(ctx, params, optFns...)
+	}
+	opts := testOptions()
+	opts.sseCKey = &sseCustomerKey{key: testSSECKey, keyMD5: testSSECKeyMD5}
+
+	var r *refresher
+	logged := captureLog("json", 0, func() {
+		r = newRefresher(wrapBucketClient(client, opts.commonOptions), opts, time.Now())
+		if err := r.run(context.Background()); err != nil {
+			t.Errorf("run() error = %v, want the run to go on", err)
+		}
+	})
+	sum := r.stats.summary(time.Now())
+	if sum.ManifestsProcessed != 1 || sum.ManifestsFailed != 1 {
+		t.Errorf("manifests processed %d, failed %d, want 1 and 1", sum.ManifestsProcessed, sum.ManifestsFailed)
+	}
+	if !strings.Contains(logged, `"error_class":"encryption"`) {
+		t.Errorf("logged %s, want the manifest's error classed as encryption", logged)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// staleNoBackups is the newest backup recorded for stale hosts without any
+const staleNoBackups = "none"
+
+// filterStaleHosts drops the manifests of hosts whose newest backup was taken
+// before cutoff, returning the stale hostnames with their newest backup's
+// time. Hosts with an undated backup are kept, since their age can't be told.
+func filterStaleHosts(manifests []ManifestInfo, cutoff time.Time) ([]ManifestInfo, map[string]time.Time) {
+	newest := make(map[string]time.Time)
+	undated := make(map[string]bool)
+	for _, m := range manifests {
+		hostname, ok := manifestHostname(m)
+		if !ok {
+			continue
+		}
+		taken, ok := backupTimestamp(m)
+		if !ok {
+			undated[hostname] = true
+			continue
+		}
+		if taken.After(newest[hostname]) {
+			newest[hostname] = taken
+		}
+	}
+
+	stale := make(map[string]time.Time)
+	for hostname, taken := range newest {
+		if !undated[hostname] && taken.Before(cutoff) {
+			stale[hostname] = taken
+		}
+	}
+	var kept []ManifestInfo
+	for _, m := range manifests {
+		if hostname, ok := manifestHostname(m); ok {
+			if _, ok := stale[hostname]; ok {
+				continue
+			}
+		}
+		kept = append(kept, m)
+	}
+	return kept, stale
+}
+
+// skipStaleHosts drops the backups of hosts whose newest backup is older than
+// -stale-host-days and records them for the summary. When discovering by
+// listing the default [cluster]/[hostname] layout, host directories without
+// any backup are reported as stale too.
+func (r *refresher) skipStaleHosts(ctx context.Context, manifests []ManifestInfo) ([]ManifestInfo, error) {
+	opts := r.opts
+	cutoff := r.now.AddDate(0, 0, -opts.staleHostDays)
+	kept, stale := filterStaleHosts(manifests, cutoff)
+
+	report := make(map[string]string, len(stale))
+	for hostname, taken := range stale {
+		report[hostname] = taken.UTC().Format(time.RFC3339)
+	}
+	empty, err := r.hostsWithoutBackups(ctx, manifests)
+	if err != nil {
+		return nil, err
+	}
+	for _, hostname := range empty {
+		report[hostname] = staleNoBackups
+	}
+
+	hostnames := make([]string, 0, len(report))
+	for hostname := range report {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		slog.Warn("Skipping stale host", "host", hostname, "newest_backup", report[hostname])
+	}
+	if len(report) > 0 {
+		slog.Info("Skipped hosts without a backup in -stale-host-days", "days", opts.staleHostDays, "hosts", len(report), "skipped_manifests", len(manifests)-len(kept))
+	}
+	r.stats.setStaleHosts(report)
+	return kept, nil
+}
+
+// hostsWithoutBackups lists the host directories that hold none of manifests,
+// narrowed to the hosts -hostname-regex and -dc select. They can only be told
+// when discovering by listing the default [cluster]/[hostname] layout, and
+// none are returned otherwise.
+func (r *refresher) hostsWithoutBackups(ctx context.Context, manifests []ManifestInfo) ([]string, error) {
+	opts := r.opts
+	if opts.manifestKey != "" || opts.manifestsFile != "" || opts.s3Event != "" || opts.localManifests != "" || opts.pathDepth.segments() != defaultPathDepth {
+		return nil, nil
+	}
+	hostnames, err := listHostnames(ctx, r.client, opts.bucket, opts.prefix, opts.cluster)
+	if err != nil {
+		return nil, err
+	}
+	withBackups := make(map[string]bool)
+	for _, m := range manifests {
+		if hostname, ok := manifestHostname(m); ok {
+			withBackups[hostname] = true
+		}
+	}
+	var empty []string
+	for _, hostname := range hostnames {
+		if withBackups[hostname] {
+			continue
+		}
+		if opts.hosts.active() {
+			if _, ok := opts.hosts.match(hostname); !ok {
+				continue
+			}
+		}
+		empty = append(empty, hostname)
+	}
+	return empty, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterStaleHosts(t *testing.T) {
+	cutoff := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	manifest := func(host string, taken time.Time) ManifestInfo {
+		return ManifestInfo{Key: fmt.Sprintf("links/%s/medusa-backup-schedule-%d/meta/manifest.json", host, taken.Unix())}
+	}
+
+	manifests := []ManifestInfo{
+		// Newest backup exactly at the cutoff is not stale
+		manifest("boundary", cutoff),
+		manifest("boundary", cutoff.AddDate(-1, 0, 0)),
+		manifest("just-stale", cutoff.Add(-time.Second)),
+		manifest("active", cutoff.AddDate(0, 0, 20)),
+		manifest("decommissioned", cutoff.AddDate(-3, 0, 0)),
+		manifest("decommissioned", cutoff.AddDate(-2, 0, 0)),
+		// An undated backup could be recent
+		manifest("undated", cutoff.AddDate(-2, 0, 0)),
+		{Key: "links/undated/adhoc/meta/manifest.json"},
+	}
+
+	kept, stale := filterStaleHosts(manifests, cutoff)
+	wantStale := map[string]time.Time{
+		"just-stale":     cutoff.Add(-time.Second),
+		"decommissioned": cutoff.AddDate(-2, 0, 0),
+	}
+	if !reflect.DeepEqual(stale, wantStale) {
+		t.Errorf("filterStaleHosts() stale = %v, want %v", stale, wantStale)
+	}
+	wantKept := []string{
+		manifests[0].Key, manifests[1].Key, manifests[3].Key, manifests[6].Key, manifests[7].Key,
+	}
+	if got := manifestKeys(kept); !reflect.DeepEqual(got, wantKept) {
+		t.Errorf("filterStaleHosts() kept = %v, want %v", got, wantKept)
+	}
+}
+
+func TestRunSkipsStaleHosts(t *testing.T) {
+	now := time.Now()
+	bucket := newFakeBucket()
+	recent := fmt.Sprintf("links/host1/medusa-backup-schedule-%d/meta/manifest.json", now.AddDate(0, 0, -1).Unix())
+	old := fmt.Sprintf("links/host2/medusa-backup-schedule-%d/meta/manifest.json", now.AddDate(-2, 0, 0).Unix())
+	bucket.objects[recent] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects[old] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host2/data/ks/t/b.db"] = ""
+	// host3's backups were all purged, only data files are left
+	bucket.objects["links/host3/data/ks/t/c.db"] = ""
+
+	opts := testOptions()
+	opts.staleHostDays = 30
+	r := newRefresher(bucket.client(), opts, now)
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if got, want := bucket.putKeys(), []string{"links/host1/data/ks/t/a.db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("updated %v, want %v", got, want)
+	}
+	sum := r.stats.summary(time.Now())
+	wantStale := map[string]string{
+		"host2": time.Unix(now.AddDate(-2, 0, 0).Unix(), 0).UTC().Format(time.RFC3339),
+		"host3": staleNoBackups,
+	}
+	if !reflect.DeepEqual(sum.StaleHosts, wantStale) {
+		t.Errorf("summary stale_hosts = %v, want %v", sum.StaleHosts, wantStale)
+	}
+	if sum.ManifestsFound != 1 {
+		t.Errorf("summary manifests_found = %d, want 1", sum.ManifestsFound)
+	}
+}
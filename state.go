@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// DynamoDBAPI reads and records the -state-dynamodb-table items
+type DynamoDBAPI interface {
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+}
+
+const (
+	// stateReadBatch is the most keys BatchGetItem reads at a time
+	stateReadBatch = 100
+	// stateWriteBatch is how many backups are recorded per TransactWriteItems call
+	stateWriteBatch = 25
+	// stateReadAttempts is how many times keys DynamoDB leaves unprocessed are read
+	stateReadAttempts = 3
+)
+
+// Attributes of the -state-dynamodb-table items
+const (
+	stateCluster     = "cluster" // partition key
+	stateBackup      = "backup"  // sort key, [hostname]/[backup_name] below the cluster
+	stateRetainUntil = "retain_until"
+	stateMode        = "mode"
+	stateRunID       = "run_id"
+	stateUpdatedAt   = "updated_at"
+)
+
+// backupState is the -state-dynamodb-table item of a backup: the retention
+// every one of its objects reached
+type backupState struct {
+	cluster     string
+	backup      string
+	retainUntil time.Time
+	mode        types.ObjectLockRetentionMode
+}
+
+// backupStateKey returns the cluster and backup identifying m's item
+func backupStateKey(m ManifestInfo) (string, string, error) {
+	mp, err := m.path()
+	if err != nil {
+		return "", "", err
+	}
+	host := strings.TrimPrefix(mp.HostnamePath, m.Prefix+mp.Cluster+"/")
+	return mp.Cluster, host + mp.Backup, nil
+}
+
+// stateItemKey returns the primary key of an item
+func stateItemKey(cluster, backup string) map[string]dbtypes.AttributeValue {
+	return map[string]dbtypes.AttributeValue{
+		stateCluster: &dbtypes.AttributeValueMemberS{Value: cluster},
+		stateBackup:  &dbtypes.AttributeValueMemberS{Value: backup},
+	}
+}
+
+// stateString returns the string attribute name of an item, "" when absent
+func stateString(item map[string]dbtypes.AttributeValue, name string) string {
+	if v, ok := item[name].(*dbtypes.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+// stateTable records in -state-dynamodb-table the retention each processed
+// backup reached, so that later runs can skip the backups still retained long
+// enough
+type stateTable struct {
+	client   DynamoDBAPI
+	table    string
+	runID    string
+	retained *backupRetention
+	// overwrite records earlier retain-untils over later ones, for runs
+	// that shorten retention
+	overwrite bool
+
+	mu       sync.Mutex
+	pending  []backupState // backups not recorded yet
+	failures int           // backups that couldn't be recorded
+}
+
+// newStateTable creates a stateTable recording the run's backups in table
+func newStateTable(client DynamoDBAPI, table, runID string) *stateTable {
+	return &stateTable{
+		client:   client,
+		table:    table,
+		runID:    runID,
+		retained: newBackupRetention(),
+	}
+}
+
+// backupRetention tracks the retention the objects of each manifest reached.
+// It is safe for concurrent use.
+type backupRetention struct {
+	mu     sync.Mutex
+	until  map[string]time.Time // earliest retain-until of each manifest's objects
+	weak   map[string]bool      // manifests with an object in GOVERNANCE mode
+	failed map[string]bool      // manifests with an object not retained long enough
+}
+
+func newBackupRetention() *backupRetention {
+	return &backupRetention{
+		until:  make(map[string]time.Time),
+		weak:   make(map[string]bool),
+		failed: make(map[string]bool),
+	}
+}
+
+// record adds the outcome of an object of manifest
+func (b *backupRetention) record(manifest string, res objectResult) {
+	if manifest == "" {
+		return
+	}
+	until, mode := res.retainUntil, res.mode
+	if until.IsZero() && res.previous != nil && res.previous.RetainUntil != nil {
+		until, mode = *res.previous.RetainUntil, res.previous.Mode
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !confirms(res.action) || until.IsZero() {
+		b.failed[manifest] = true
+		return
+	}
+	if current, ok := b.until[manifest]; !ok || until.Before(current) {
+		b.until[manifest] = until
+	}
+	if mode != types.ObjectLockRetentionModeCompliance {
+		b.weak[manifest] = true
+	}
+}
+
+// reached returns the retention every object of manifest reached: the
+// earliest retain-until, in COMPLIANCE mode only when every object is. ok is
+// false when an object wasn't retained, or none was recorded.
+func (b *backupRetention) reached(manifest string) (time.Time, types.ObjectLockRetentionMode, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.until[manifest]
+	if !ok || b.failed[manifest] {
+		return time.Time{}, "", false
+	}
+	if b.weak[manifest] {
+		return until, types.ObjectLockRetentionModeGovernance, true
+	}
+	return until, types.ObjectLockRetentionModeCompliance, true
+}
+
+// read returns the recorded state of manifests, by manifest key
+func (s *stateTable) read(ctx context.Context, manifests []ManifestInfo) (map[string]backupState, error) {
+	byItem := make(map[[2]string]string, len(manifests))
+	var keys []map[string]dbtypes.AttributeValue
+	for _, m := range manifests {
+		cluster, backup, err := backupStateKey(m)
+		if err != nil {
+			continue
+		}
+		if _, ok := byItem[[2]string{cluster, backup}]; !ok {
+			keys = append(keys, stateItemKey(cluster, backup))
+		}
+		byItem[[2]string{cluster, backup}] = m.Key
+	}
+
+	states := make(map[string]backupState)
+	for start := 0; start < len(keys); start += stateReadBatch {
+		batch := keys[start:min(start+stateReadBatch, len(keys))]
+		for attempt := 1; len(batch) > 0; attempt++ {
+			if attempt > stateReadAttempts {
+				return nil, fmt.Errorf("failed to read %d items: left unprocessed", len(batch))
+			}
+			out, err := s.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]dbtypes.KeysAndAttributes{s.table: {Keys: batch, ConsistentRead: aws.Bool(true)}},
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range out.Responses[s.table] {
+				cluster, backup := stateString(item, stateCluster), stateString(item, stateBackup)
+				until, err := time.Parse(time.RFC3339, stateString(item, stateRetainUntil))
+				if err != nil {
+					slog.Warn("Ignoring -state-dynamodb-table item without a valid retain_until", "cluster", cluster, "backup", backup)
+					continue
+				}
+				states[byItem[[2]string{cluster, backup}]] = backupState{
+					cluster:     cluster,
+					backup:      backup,
+					retainUntil: until,
+					mode:        types.ObjectLockRetentionMode(stateString(item, stateMode)),
+				}
+			}
+			batch = out.UnprocessedKeys[s.table].Keys
+		}
+	}
+	return states, nil
+}
+
+// record adds the outcome of an object of manifest
+func (s *stateTable) record(manifest string, res objectResult) {
+	s.retained.record(manifest, res)
+}
+
+// backupDone queues m to be recorded when every one of its objects was
+// retained, returning whether a batch is ready to write
+func (s *stateTable) backupDone(m ManifestInfo) bool {
+	until, mode, ok := s.retained.reached(m.Key)
+	if !ok {
+		return false
+	}
+	cluster, backup, err := backupStateKey(m)
+	if err != nil {
+		return false
+	}
+	return s.queue(backupState{cluster: cluster, backup: backup, retainUntil: until.UTC(), mode: mode})
+}
+
+// queue adds b to the backups to record, returning whether a batch is ready
+// to write
+func (s *stateTable) queue(b backupState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, b)
+	return len(s.pending) >= stateWriteBatch
+}
+
+// flush records the queued backups, stateWriteBatch at a time. A backup is
+// only recorded when it reached a later retain-until than the recorded one.
+// Failures are logged and counted: the backups are processed again by the
+// next run.
+func (s *stateTable) flush(ctx context.Context) {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	for start := 0; start < len(pending); start += stateWriteBatch {
+		batch := pending[start:min(start+stateWriteBatch, len(pending))]
+		if err := s.write(ctx, batch); err != nil {
+			s.mu.Lock()
+			s.failures += len(batch)
+			s.mu.Unlock()
+			slog.Warn("Failed to record backups in -state-dynamodb-table, they'll be processed again by the next run", append([]any{"backups", len(batch)}, errorAttrs(err)...)...)
+		}
+	}
+}
+
+// condition returns the condition of the writes, which keep a recorded later
+// retain-until unless the table is overwritten
+func (s *stateTable) condition() *string {
+	if s.overwrite {
+		return nil
+	}
+	return aws.String("attribute_not_exists(#retain_until) OR #retain_until <= :retain_until")
+}
+
+// write records a batch of backups in a transaction. When the transaction is
+// canceled, the backups already recorded with a later retain-until are
+// dropped and the rest written again.
+func (s *stateTable) write(ctx context.Context, batch []backupState) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	for retried := false; ; retried = true {
+		items := make([]dbtypes.TransactWriteItem, len(batch))
+		for i, b := range batch {
+			items[i] = dbtypes.TransactWriteItem{Update: &dbtypes.Update{
+				TableName:           aws.String(s.table),
+				Key:                 stateItemKey(b.cluster, b.backup),
+				UpdateExpression:    aws.String("SET #retain_until = :retain_until, #mode = :mode, #run_id = :run_id, #updated_at = :updated_at"),
+				ConditionExpression: s.condition(),
+				ExpressionAttributeNames: map[string]string{
+					"#retain_until": stateRetainUntil,
+					"#mode":         stateMode,
+					"#run_id":       stateRunID,
+					"#updated_at":   stateUpdatedAt,
+				},
+				ExpressionAttributeValues: map[string]dbtypes.AttributeValue{
+					":retain_until": &dbtypes.AttributeValueMemberS{Value: b.retainUntil.Format(time.RFC3339)},
+					":mode":         &dbtypes.AttributeValueMemberS{Value: string(b.mode)},
+					":run_id":       &dbtypes.AttributeValueMemberS{Value: s.runID},
+					":updated_at":   &dbtypes.AttributeValueMemberS{Value: now},
+				},
+			}}
+		}
+		_, err := s.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		if err == nil {
+			slog.Debug("Recorded backups in -state-dynamodb-table", "backups", len(batch))
+			return nil
+		}
+		var canceled *dbtypes.TransactionCanceledException
+		if retried || !errors.As(err, &canceled) || len(canceled.CancellationReasons) != len(batch) {
+			return err
+		}
+		var retry []backupState
+		for i, reason := range canceled.CancellationReasons {
+			if aws.ToString(reason.Code) == "ConditionalCheckFailed" {
+				slog.Debug("Backup already recorded with a later retain-until", "cluster", batch[i].cluster, "backup", batch[i].backup)
+				continue
+			}
+			retry = append(retry, batch[i])
+		}
+		if len(retry) == 0 {
+			return nil
+		}
+		batch = retry
+	}
+}
+
+// openState starts recording backups in -state-dynamodb-table
+func (r *refresher) openState(ctx context.Context) error {
+	if r.dynamodb == nil {
+		client, err := newDynamoDBClient(ctx, r.opts.commonOptions)
+		if err != nil {
+			return err
+		}
+		r.dynamodb = client
+	}
+	r.state = newStateTable(r.dynamodb, r.opts.stateTable, r.runID)
+	r.state.overwrite = r.opts.allowReduce && r.opts.bypassGovernance
+	return nil
+}
+
+// skipRecordedBackups leaves out the manifests whose backup
+// -state-dynamodb-table shows retained at least as long as now required, in
+// a mode at least as strict, and no longer than -allow-reduce allows. When the table can't be read every backup is
+// processed.
+func (r *refresher) skipRecordedBackups(ctx context.Context, manifests []ManifestInfo) []ManifestInfo {
+	states, err := r.state.read(ctx, manifests)
+	if err != nil {
+		slog.Warn("Failed to read -state-dynamodb-table, processing every backup", errorAttrs(err)...)
+		return manifests
+	}
+	kept := manifests[:0]
+	skipped := 0
+	for _, m := range manifests {
+		state, ok := states[m.Key]
+		if ok && r.retainedEnough(m, state.retainUntil, state.mode, 0) {
+			slog.Debug("Skipped backup retained long enough per -state-dynamodb-table", "manifest", m.Key, "retain_until", state.retainUntil)
+			skipped++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	if skipped > 0 {
+		slog.Info("Skipped backups retained long enough per -state-dynamodb-table", "skipped", skipped, "remaining", len(kept))
+		r.stats.addManifestsUpToDate(skipped)
+	}
+	return kept
+}
+
+// retainedEnough reports whether the objects of m, retained until until in
+// mode, already are as the run requires: at least grace longer than the date
+// its target requires, in a mode at least as strict, and not beyond its
+// target when -allow-reduce and -bypass-governance reduce it
+func (r *refresher) retainedEnough(m ManifestInfo, until time.Time, mode types.ObjectLockRetentionMode, grace time.Duration) bool {
+	target := r.defaultTarget()
+	if t, found := r.manifestTargets[m.Key]; found {
+		target = t
+	}
+	if r.opts.allowReduce && r.opts.bypassGovernance && needsRetentionReduction(&ObjectRetention{RetainUntil: &until, Mode: mode}, target.retainUntil) {
+		return false
+	}
+	strict := mode == r.opts.mode || mode == types.ObjectLockRetentionModeCompliance
+	return strict && !until.Add(-grace).Before(target.requiredUntil)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// mockDynamoDB holds the items of one table. Each write is canceled with the
+// next entry of cancellations, if any.
+type mockDynamoDB struct {
+	mu            sync.Mutex
+	items         map[string]map[string]dbtypes.AttributeValue // by cluster/backup
+	getErr        error
+	writeErr      error
+	cancellations [][]string // cancellation reason codes of each write
+	gets          int
+	writes        [][]dbtypes.TransactWriteItem
+}
+
+func (m *mockDynamoDB) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gets++
+	if m.getErr != nil {
+		return nil, m.getErr
+	}
+	out := &dynamodb.BatchGetItemOutput{Responses: make(map[string][]map[string]dbtypes.AttributeValue)}
+	for table, request := range params.RequestItems {
+		for _, key := range request.Keys {
+			if item, ok := m.items[stateString(key, stateCluster)+"/"+stateString(key, stateBackup)]; ok {
+				out.Responses[table] = append(out.Responses[table], item)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (m *mockDynamoDB) TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes = append(m.writes, params.TransactItems)
+	if m.writeErr != nil {
+		return nil, m.writeErr
+	}
+	if len(m.cancellations) > 0 {
+		codes := m.cancellations[0]
+		m.cancellations = m.cancellations[1:]
+		reasons := make([]dbtypes.CancellationReason, len(codes))
+		for i, code := range codes {
+			reasons[i].Code = aws.String(code)
+		}
+		return nil, &dbtypes.TransactionCanceledException{Message: aws.String("Transaction cancelled"), CancellationReasons: reasons}
+	}
+	if m.items == nil {
+		m.items = make(map[string]map[string]dbtypes.AttributeValue)
+	}
+	for _, item := range params.TransactItems {
+		update := item.Update
+		rec := map[string]dbtypes.AttributeValue{stateCluster: update.Key[stateCluster], stateBackup: update.Key[stateBackup]}
+		for name, attr := range update.ExpressionAttributeNames {
+			rec[attr] = update.ExpressionAttributeValues[":"+name[1:]]
+		}
+		m.items[stateString(rec, stateCluster)+"/"+stateString(rec, stateBackup)] = rec
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// recorded returns the backups written, in order
+func (m *mockDynamoDB) recorded() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var backups []string
+	for _, items := range m.writes {
+		for _, item := range items {
+			backups = append(backups, stateString(item.Update.Key, stateCluster)+"/"+stateString(item.Update.Key, stateBackup))
+		}
+	}
+	return backups
+}
+
+// stateItem returns an item recording backup retained until until
+func stateItem(cluster, backup string, until time.Time, mode types.ObjectLockRetentionMode) map[string]dbtypes.AttributeValue {
+	item := stateItemKey(cluster, backup)
+	item[stateRetainUntil] = &dbtypes.AttributeValueMemberS{Value: until.UTC().Format(time.RFC3339)}
+	item[stateMode] = &dbtypes.AttributeValueMemberS{Value: string(mode)}
+	return item
+}
+
+// stateBucket returns a bucket of four backups: host1's recorded retained long
+// enough, host2's recorded retained too short, host3's unrecorded, and host4's
+// unrecorded with a missing object
+func stateBucket() *fakeBucket {
+	bucket := newFakeBucket()
+	for _, host := range []string{"host1", "host2", "host3", "host4"} {
+		bucket.objects["links/"+host+"/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+		bucket.objects["links/"+host+"/data/ks/t/a.db"] = ""
+	}
+	bucket.objects["links/host4/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/gone.db"}]}]`
+	return bucket
+}
+
+func TestRunSkipsRecordedBackups(t *testing.T) {
+	bucket := stateBucket()
+	db := &mockDynamoDB{items: map[string]map[string]dbtypes.AttributeValue{
+		"links/host1/b1": stateItem("links", "host1/b1", time.Now().AddDate(0, 0, 20), types.ObjectLockRetentionModeGovernance),
+		"links/host2/b1": stateItem("links", "host2/b1", time.Now().AddDate(0, 0, 3), types.ObjectLockRetentionModeGovernance),
+	}}
+	opts := testOptions()
+	opts.stateTable = "medusa-retention"
+	r := newRefresher(bucket.client(), opts, time.Now())
+	r.dynamodb = db
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if _, ok := bucket.retention["links/host1/data/ks/t/a.db"]; ok {
+		t.Error("backup recorded as retained long enough was processed")
+	}
+	for _, host := range []string{"host2", "host3", "host4"} {
+		if _, ok := bucket.retention["links/"+host+"/data/ks/t/a.db"]; !ok {
+			t.Errorf("backup of %s not processed", host)
+		}
+	}
+	if got := r.stats.summary(time.Now()).ManifestsUpToDate; got != 1 {
+		t.Errorf("summary manifests_up_to_date = %d, want 1", got)
+	}
+
+	// host4's backup has a missing object, so isn't recorded
+	got := db.recorded()
+	sort.Strings(got)
+	if want := []string{"links/host2/b1", "links/host3/b1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("recorded %v, want %v", got, want)
+	}
+	update := db.writes[0][0].Update
+	if aws.ToString(update.TableName) != "medusa-retention" || aws.ToString(update.ConditionExpression) == "" {
+		t.Errorf("recorded %+v, want a conditional update", update)
+	}
+	item := db.items["links/host3/b1"]
+	until, err := time.Parse(time.RFC3339, stateString(item, stateRetainUntil))
+	if err != nil || until.Before(time.Now().AddDate(0, 0, 29)) {
+		t.Errorf("recorded retain_until %q, want the -max-retention date", stateString(item, stateRetainUntil))
+	}
+	if stateString(item, stateRunID) != r.runID || stateString(item, stateMode) != string(types.ObjectLockRetentionModeGovernance) {
+		t.Errorf("recorded %v, want the run ID and mode", item)
+	}
+}
+
+func TestRunReducesRecordedBackups(t *testing.T) {
+	overExtended := time.Now().AddDate(1, 0, 0)
+	bucket := stateBucket()
+	bucket.retention["links/host1/data/ks/t/a.db"] = overExtended
+	db := &mockDynamoDB{items: map[string]map[string]dbtypes.AttributeValue{
+		"links/host1/b1": stateItem("links", "host1/b1", overExtended, types.ObjectLockRetentionModeGovernance),
+	}}
+	opts := testOptions()
+	opts.stateTable = "medusa-retention"
+	opts.allowReduce, opts.bypassGovernance = true, true
+	r := newRefresher(bucket.client(), opts, time.Now())
+	r.dynamodb = db
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	sum := r.stats.summary(time.Now())
+	if sum.ManifestsUpToDate != 0 || sum.Reduced != 1 {
+		t.Errorf("manifests_up_to_date = %d, reduced = %d, want the recorded backup reduced", sum.ManifestsUpToDate, sum.Reduced)
+	}
+	if got := bucket.retention["links/host1/data/ks/t/a.db"]; !got.Equal(r.retainUntil) {
+		t.Errorf("retention = %v, want it reduced to %v", got, r.retainUntil)
+	}
+	if update := db.writes[0][0].Update; update.ConditionExpression != nil {
+		t.Errorf("recorded with condition %q, want the reduced date to overwrite the recorded one", aws.ToString(update.ConditionExpression))
+	}
+	until, err := time.Parse(time.RFC3339, stateString(db.items["links/host1/b1"], stateRetainUntil))
+	if err != nil || until.After(r.retainUntil) {
+		t.Errorf("recorded retain_until %q, want the reduced date", stateString(db.items["links/host1/b1"], stateRetainUntil))
+	}
+}
+
+func TestStateRequiresStrictMode(t *testing.T) {
+	bucket := stateBucket()
+	db := &mockDynamoDB{items: map[string]map[string]dbtypes.AttributeValue{
+		"links/host1/b1": stateItem("links", "host1/b1", time.Now().AddDate(0, 0, 20), types.ObjectLockRetentionModeGovernance),
+	}}
+	opts := testOptions()
+	opts.stateTable = "medusa-retention"
+	opts.mode = types.ObjectLockRetentionModeCompliance
+	opts.dryRun = true
+	r := newRefresher(bucket.client(), opts, time.Now())
+	r.dynamodb = db
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	// GOVERNANCE retention doesn't satisfy -mode compliance
+	if got := r.stats.summary(time.Now()).ManifestsUpToDate; got != 0 {
+		t.Errorf("summary manifests_up_to_date = %d, want 0", got)
+	}
+	if len(db.writes) != 0 {
+		t.Errorf("recorded %v in a dry run", db.recorded())
+	}
+}
+
+func TestStateConditionalWrite(t *testing.T) {
+	tests := []struct {
+		name          string
+		cancellations [][]string
+		wantWrites    int
+		wantFailures  int
+	}{
+		{name: "written"},
+		{name: "later retain-until kept", cancellations: [][]string{{"ConditionalCheckFailed", "None"}}, wantWrites: 2},
+		{name: "all recorded later", cancellations: [][]string{{"ConditionalCheckFailed", "ConditionalCheckFailed"}}, wantWrites: 1},
+		{name: "canceled twice", cancellations: [][]string{{"None", "TransactionConflict"}, {"None", "TransactionConflict"}}, wantWrites: 2, wantFailures: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &mockDynamoDB{cancellations: tt.cancellations}
+			s := newStateTable(db, "medusa-retention", "run")
+			until := time.Now().AddDate(0, 0, 30)
+			for _, host := range []string{"host1", "host2"} {
+				m := ManifestInfo{Key: "links/" + host + "/b1/meta/manifest.json"}
+				s.record(m.Key, objectResult{action: actionUpdated, retainUntil: until, mode: types.ObjectLockRetentionModeGovernance})
+				s.backupDone(m)
+			}
+			s.flush(context.Background())
+
+			if tt.wantWrites == 0 {
+				tt.wantWrites = 1
+			}
+			if len(db.writes) != tt.wantWrites {
+				t.Fatalf("made %d writes, want %d", len(db.writes), tt.wantWrites)
+			}
+			if tt.cancellations != nil && tt.wantWrites > 1 && tt.wantFailures == 0 {
+				// Only the backup whose condition held is written again
+				if retried := db.writes[1]; len(retried) != 1 || stateString(retried[0].Update.Key, stateBackup) != "host2/b1" {
+					t.Errorf("retried %v, want host2's backup only", retried)
+				}
+				if _, ok := db.items["links/host2/b1"]; !ok {
+					t.Error("host2's backup not recorded")
+				}
+			}
+			if s.failures != tt.wantFailures {
+				t.Errorf("failures = %d, want %d", s.failures, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestStateWritesInBatches(t *testing.T) {
+	db := &mockDynamoDB{}
+	s := newStateTable(db, "medusa-retention", "run")
+	until := time.Now().AddDate(0, 0, 30)
+	ready := 0
+	for i := 0; i < stateWriteBatch+5; i++ {
+		m := ManifestInfo{Key: fmt.Sprintf("links/host%d/b1/meta/manifest.json", i)}
+		s.record(m.Key, objectResult{action: actionSkipped, previous: &ObjectRetention{RetainUntil: &until, Mode: types.ObjectLockRetentionModeCompliance}})
+		if s.backupDone(m) {
+			ready++
+			s.flush(context.Background())
+		}
+	}
+	s.flush(context.Background())
+	if ready != 1 || len(db.writes) != 2 || len(db.writes[0]) != stateWriteBatch || len(db.writes[1]) != 5 {
+		t.Errorf("wrote batches of %v after %d ready, want %d and 5", len(db.writes), ready, stateWriteBatch)
+	}
+	if mode := stateString(db.items["links/host0/b1"], stateMode); mode != string(types.ObjectLockRetentionModeCompliance) {
+		t.Errorf("recorded mode %s, want the objects' COMPLIANCE", mode)
+	}
+}
+
+func TestStateDegradesOnErrors(t *testing.T) {
+	bucket := stateBucket()
+	db := &mockDynamoDB{getErr: errors.New("ProvisionedThroughputExceededException"), writeErr: errors.New("ResourceNotFoundException")}
+	opts := testOptions()
+	opts.stateTable = "medusa-retention"
+	r := newRefresher(bucket.client(), opts, time.Now())
+	r.dynamodb = db
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v, want the table's failures ignored", err)
+	}
+	// Every backup is processed without the table
+	for _, host := range []string{"host1", "host2", "host3", "host4"} {
+		if _, ok := bucket.retention["links/"+host+"/data/ks/t/a.db"]; !ok {
+			t.Errorf("backup of %s not processed", host)
+		}
+	}
+	if db.gets != 1 || len(db.writes) != 1 || r.state.failures != 3 {
+		t.Errorf("made %d reads and %d writes with %d failures, want 1, 1 and 3", db.gets, len(db.writes), r.state.failures)
+	}
+}
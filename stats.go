@@ -0,0 +1,804 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runStats accumulates the counters reported at the end of a run. It is safe
+// for concurrent use.
+type runStats struct {
+	mu                 sync.Mutex
+	start              time.Time
+	manifestsFound     int
+	manifestsProcessed int
+	manifestsFailed    int
+	manifestsCapped    int
+	manifestsExpired   int
+	manifestsUpToDate  int            // backups -state-dynamodb-table or their refreshed marker shows retained long enough
+	firehoseFailed     int            // events that couldn't be delivered to -firehose-stream
+	manifestSchemas    map[string]int // loaded manifests per schema version
+	objectsReferenced  int
+	uniqueObjects      map[string]struct{}
+	metaObjects        int
+	actions            map[objectAction]int
+	errorsByClass      map[string]int
+	firstError         string // first object error, with its key
+	skippedByFilter    map[string]int
+	storageClasses     map[string]int
+	unknownModified    int            // objects processed without a known LastModified despite -older-than/-newer-than
+	sizeMismatches     map[string]int // -verify-size mismatches per manifest
+	sizesUnverified    int            // objects -verify-size couldn't check
+	md5Mismatches      map[string]int // -verify-md5 mismatches per manifest
+	md5Unverifiable    int            // objects -verify-md5 couldn't check, such as multipart uploads
+	orphanedObjects    int
+	orphanedBytes      int64
+	tableBytes         map[tableKey]int64 // bytes of the unique objects per keyspace, table and index
+	topTables          int                // tables listed in the summary, 0 for all
+	limitReached       bool
+	latestBackups      map[string]string
+	hostDCs            map[string]string // datacenter of each selected host, with -dc or a dc group in -hostname-regex
+	staleHosts         map[string]string // newest backup of each host skipped by -stale-host-days
+	newestBackups      []hostFreshness   // newest backup of each host, sorted by hostname
+	clusterStale       bool              // no host has a backup within -max-backup-age
+	backupsPinned      int               // backups matched by -pins-file
+	unmatchedPins      []string          // -pins-file entries matching no discovered backup
+	droppedTables      []droppedTable    // tables missing from the newest backup of their host
+	extraObjects       map[string]int    // objects processed per -extra-prefixes entry
+	extraActions       map[string]int    // outcomes of the -extra-prefixes objects
+	extraFailed        int               // -extra-prefixes listings that failed
+	backupCoverage     []backupCoverage  // retention coverage of each processed backup
+	sharingByHost      []hostSharing     // objects shared across each host's backups
+	totalObjects       int               // objects the run will process, 0 when unknown
+	inFlight           int               // objects being processed
+	currentManifest    string            // manifest being processed, "" between manifests
+	canary             *canaryStats      // -canary phase, nil without -canary
+}
+
+func newRunStats(start time.Time) *runStats {
+	return &runStats{
+		start:           start,
+		uniqueObjects:   make(map[string]struct{}),
+		actions:         make(map[objectAction]int),
+		errorsByClass:   make(map[string]int),
+		skippedByFilter: make(map[string]int),
+		storageClasses:  make(map[string]int),
+		sizeMismatches:  make(map[string]int),
+		md5Mismatches:   make(map[string]int),
+		tableBytes:      make(map[tableKey]int64),
+		extraObjects:    make(map[string]int),
+		extraActions:    make(map[string]int),
+		manifestSchemas: make(map[string]int),
+	}
+}
+
+// addManifestsFound counts manifests selected for processing
+func (s *runStats) addManifestsFound(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifestsFound += n
+}
+
+// addManifestsCapped counts manifests left out by -max-manifests
+func (s *runStats) addManifestsCapped(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifestsCapped += n
+}
+
+// addManifestsUpToDate counts backups skipped per -state-dynamodb-table or their refreshed marker
+func (s *runStats) addManifestsUpToDate(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifestsUpToDate += n
+}
+
+// setFirehoseFailed records how many events couldn't be delivered to
+// -firehose-stream
+func (s *runStats) setFirehoseFailed(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.firehoseFailed = n
+}
+
+// addManifestsExpired counts backups skipped for being past their retention
+func (s *runStats) addManifestsExpired(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifestsExpired += n
+}
+
+// setLatestBackups records the backup chosen per hostname by -latest-only
+func (s *runStats) setLatestBackups(chosen map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latestBackups = chosen
+}
+
+// setHostDCs records the datacenter of each selected host
+func (s *runStats) setHostDCs(dcs map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hostDCs = dcs
+}
+
+// setStaleHosts records the hosts skipped by -stale-host-days with their newest backup
+func (s *runStats) setStaleHosts(hosts map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.staleHosts = hosts
+}
+
+// setFreshness records the newest backup of each host, and whether no backup
+// of the cluster is within -max-backup-age
+func (s *runStats) setFreshness(hosts []hostFreshness, clusterStale bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.newestBackups = hosts
+	s.clusterStale = clusterStale
+}
+
+// freshness returns the newest backup of each host
+func (s *runStats) freshness() []hostFreshness {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.newestBackups)
+}
+
+// isStaleHost reports whether -stale-host-days skipped hostname
+func (s *runStats) isStaleHost(hostname string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.staleHosts[hostname]
+	return ok
+}
+
+// staleBackups returns the hosts whose newest backup is older than
+// -max-backup-age, and whether the whole cluster's is
+func (s *runStats) staleBackups() ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hosts []string
+	for _, h := range s.newestBackups {
+		if h.Stale {
+			hosts = append(hosts, h.Host)
+		}
+	}
+	return hosts, s.clusterStale
+}
+
+// setPins records how many backups -pins-file matched, and its entries matching none
+func (s *runStats) setPins(pinned int, unmatched []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backupsPinned = pinned
+	s.unmatchedPins = unmatched
+}
+
+// setDroppedTables records the tables missing from the newest backup of their host
+func (s *runStats) setDroppedTables(tables []droppedTable) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.droppedTables = tables
+}
+
+// manifestDone counts a manifest whose objects were processed, or that failed to load
+func (s *runStats) manifestDone(failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if failed {
+		s.manifestsFailed++
+	} else {
+		s.manifestsProcessed++
+	}
+}
+
+// manifestLoaded counts a loaded manifest by its schema version
+func (s *runStats) manifestLoaded(schema string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.manifestSchemas[schema]++
+}
+
+// objectReferenced counts a reference to key. Data files shared across
+// backups are referenced once per manifest but counted once as unique.
+func (s *runStats) objectReferenced(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objectsReferenced++
+	s.uniqueObjects[key] = struct{}{}
+}
+
+// manifestObjectReferenced counts a reference to the manifest object obj
+// stored at key. Its size is added to the retained bytes of its table the
+// first time key is referenced, so data files shared across backups are
+// counted once.
+func (s *runStats) manifestObjectReferenced(key string, obj ManifestObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objectsReferenced++
+	if _, ok := s.uniqueObjects[key]; ok {
+		return
+	}
+	s.uniqueObjects[key] = struct{}{}
+	s.tableBytes[tableKey{keyspace: obj.Keyspace, table: obj.ColumnFamily, index: obj.Index}] += obj.Size
+}
+
+// setBackupCoverage records the retention coverage of the processed backups
+func (s *runStats) setBackupCoverage(backups []backupCoverage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backupCoverage = backups
+}
+
+// setSharingByHost records how much the backups of each host share
+func (s *runStats) setSharingByHost(hosts []hostSharing) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sharingByHost = hosts
+}
+
+// extraPrefixObject counts an object processed under the -extra-prefixes
+// entry prefix, which ended with action
+func (s *runStats) extraPrefixObject(prefix string, action objectAction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extraObjects[prefix]++
+	s.extraActions[string(action)]++
+}
+
+// extraPrefixFailed counts an -extra-prefixes listing of a host that failed
+func (s *runStats) extraPrefixFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extraFailed++
+}
+
+// objectStarted counts an object whose processing started
+func (s *runStats) objectStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight++
+}
+
+// objectFinished counts an object whose processing ended
+func (s *runStats) objectFinished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+}
+
+// setCurrentManifest records the manifest being processed, "" when none is
+func (s *runStats) setCurrentManifest(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.currentManifest = key
+}
+
+// live returns the counters exposed by -metrics-listen as of now
+func (s *runStats) live() liveStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	actions := make(map[string]int, len(s.actions))
+	for action, n := range s.actions {
+		actions[string(action)] = n
+	}
+	return liveStats{
+		inFlight:           s.inFlight,
+		currentManifest:    s.currentManifest,
+		actions:            actions,
+		errorsByClass:      copyCounts(s.errorsByClass),
+		manifestsProcessed: s.manifestsProcessed,
+		manifestsFailed:    s.manifestsFailed,
+	}
+}
+
+// metaObject counts an object of a backup's meta/ directory
+func (s *runStats) metaObject() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metaObjects++
+}
+
+// objectFiltered counts an object skipped by the filter named reason
+func (s *runStats) objectFiltered(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skippedByFilter[reason]++
+}
+
+// setTotalObjects records how many objects the run will process, when known up front
+func (s *runStats) setTotalObjects(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totalObjects = n
+}
+
+// progress returns the progress counters as of now
+func (s *runStats) progress(now time.Time) progressSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects := 0
+	for _, n := range s.actions {
+		objects += n
+	}
+	return progressSnapshot{
+		objects:        objects,
+		totalObjects:   s.totalObjects,
+		manifests:      s.manifestsProcessed + s.manifestsFailed,
+		totalManifests: s.manifestsFound,
+		elapsed:        now.Sub(s.start),
+	}
+}
+
+// record counts the outcome of processing an object
+func (s *runStats) record(action objectAction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actions[action]++
+	if s.canary != nil && s.canary.counting {
+		s.canary.actions[action]++
+	}
+}
+
+// startCanary counts the outcomes recorded from now on as those of the
+// -canary manifest too
+func (s *runStats) startCanary(manifest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.canary = &canaryStats{manifest: manifest, status: canaryRunning, actions: make(map[objectAction]int), counting: true}
+}
+
+// endCanary stops counting the outcomes of the -canary manifest, recording
+// the outcome of the canary phase
+func (s *runStats) endCanary(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.canary.counting = false
+	s.canary.status = status
+}
+
+// lastModifiedUnknown counts an object processed because its LastModified couldn't be determined
+func (s *runStats) lastModifiedUnknown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unknownModified++
+}
+
+// sizeMismatch counts an object of manifest whose size differs from the manifest's
+func (s *runStats) sizeMismatch(manifest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sizeMismatches[manifest]++
+}
+
+// manifestSizeMismatches returns how many objects of manifest had a size mismatch
+func (s *runStats) manifestSizeMismatches(manifest string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sizeMismatches[manifest]
+}
+
+// sizeUnverified counts an object whose size -verify-size couldn't check
+func (s *runStats) sizeUnverified() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sizesUnverified++
+}
+
+// md5Mismatch counts an object of manifest whose ETag differs from the manifest's MD5
+func (s *runStats) md5Mismatch(manifest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.md5Mismatches[manifest]++
+}
+
+// manifestMD5Mismatches returns how many objects of manifest had an MD5 mismatch
+func (s *runStats) manifestMD5Mismatches(manifest string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.md5Mismatches[manifest]
+}
+
+// totalMD5Mismatches returns how many objects had an MD5 mismatch
+func (s *runStats) totalMD5Mismatches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sumCounts(s.md5Mismatches)
+}
+
+// md5Unverified counts an object whose MD5 -verify-md5 couldn't check
+func (s *runStats) md5Unverified() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.md5Unverifiable++
+}
+
+// addOrphans counts data files of a host that no backup references
+func (s *runStats) addOrphans(n int, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orphanedObjects += n
+	s.orphanedBytes += bytes
+}
+
+// recordStorageClass counts a processed object by its storage class
+func (s *runStats) recordStorageClass(class string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storageClasses[class]++
+}
+
+// recordFirstError keeps the first object error of the run
+func (s *runStats) recordFirstError(key string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.firstError == "" {
+		s.firstError = key + ": " + err.Error()
+	}
+}
+
+// recordErrorClass counts an object error by its class
+func (s *runStats) recordErrorClass(class string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorsByClass[class]++
+}
+
+// hitLimit records that -limit stopped the run early, reporting whether
+// this is the first time
+func (s *runStats) hitLimit() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := !s.limitReached
+	s.limitReached = true
+	return first
+}
+
+// count returns how many objects ended with action
+func (s *runStats) count(action objectAction) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.actions[action]
+}
+
+// runSummary is a snapshot of the run counters
+type runSummary struct {
+	ManifestsFound        int               `json:"manifests_found"`
+	ManifestsProcessed    int               `json:"manifests_processed"`
+	ManifestsFailed       int               `json:"manifests_failed"`
+	ManifestsCapped       int               `json:"manifests_capped"`
+	ManifestsExpired      int               `json:"manifests_expired"`
+	ManifestsUpToDate     int               `json:"manifests_up_to_date"`
+	FirehoseFailed        int               `json:"firehose_failed_events"`
+	ManifestsBySchema     map[string]int    `json:"manifests_by_schema"`
+	ObjectsReferenced     int               `json:"objects_referenced"`
+	UniqueObjects         int               `json:"unique_objects"`
+	MetaObjects           int               `json:"meta_objects"`
+	AlreadyCompliant      int               `json:"already_compliant"`
+	Updated               int               `json:"updated"`
+	WouldUpdate           int               `json:"would_update"`
+	Reduced               int               `json:"reduced"`
+	WouldReduce           int               `json:"would_reduce"`
+	Missing               int               `json:"missing"`
+	Errors                int               `json:"errors"`
+	Excluded              int               `json:"excluded"`
+	SkippedStorageClass   int               `json:"skipped_storage_class"`
+	SkippedMismatched     int               `json:"skipped_mismatched"`
+	Planned               int               `json:"planned"`
+	NotRestorable         int               `json:"not_restorable"`
+	ErrorsByClass         map[string]int    `json:"errors_by_class"`
+	FirstError            string            `json:"first_error,omitempty"`
+	SkippedByFilter       map[string]int    `json:"skipped_by_filter"`
+	LastModifiedUnknown   int               `json:"last_modified_unknown"`
+	ObjectsByStorageClass map[string]int    `json:"objects_by_storage_class"`
+	SizeMismatches        int               `json:"size_mismatches"`
+	SizeMismatchManifests map[string]int    `json:"size_mismatches_by_manifest"`
+	SizeUnverified        int               `json:"size_unverified"`
+	MD5Mismatches         int               `json:"md5_mismatches"`
+	MD5MismatchManifests  map[string]int    `json:"md5_mismatches_by_manifest"`
+	MD5Unverifiable       int               `json:"md5_unverifiable"`
+	OrphanedObjects       int               `json:"orphaned_objects"`
+	OrphanedBytes         int64             `json:"orphaned_bytes"`
+	RetainedBytesByTable  []tableBytes      `json:"retained_bytes_by_table"`
+	LimitReached          bool              `json:"limit_reached"`
+	LatestBackups         map[string]string `json:"latest_backups,omitempty"`
+	HostDCs               map[string]string `json:"host_dcs,omitempty"`
+	StaleHosts            map[string]string `json:"stale_hosts,omitempty"`
+	NewestBackupAges      map[string]string `json:"newest_backup_ages,omitempty"`
+	StaleBackupHosts      []string          `json:"stale_backup_hosts,omitempty"`
+	ClusterBackupStale    bool              `json:"cluster_backup_stale"`
+	BackupsPinned         int               `json:"backups_pinned"`
+	UnmatchedPins         []string          `json:"unmatched_pins,omitempty"`
+	DroppedTables         []droppedTable    `json:"dropped_tables,omitempty"`
+	ExtraPrefixObjects    map[string]int    `json:"extra_prefix_objects"`
+	ExtraPrefixActions    map[string]int    `json:"extra_prefix_actions"`
+	ExtraPrefixesFailed   int               `json:"extra_prefixes_failed"`
+	BackupCoverage        []backupCoverage  `json:"backup_coverage,omitempty"`
+	SharingByHost         []hostSharing     `json:"sharing_by_host,omitempty"`
+	Canary                *canarySummary    `json:"canary,omitempty"`
+	Elapsed               string            `json:"elapsed"`
+}
+
+// summary returns the counters of the run as of now
+func (s *runStats) summary(now time.Time) runSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ages map[string]string
+	var staleHosts []string
+	if len(s.newestBackups) > 0 {
+		ages = make(map[string]string, len(s.newestBackups))
+	}
+	for _, h := range s.newestBackups {
+		ages[h.Host] = h.age()
+		if h.Stale {
+			staleHosts = append(staleHosts, h.Host)
+		}
+	}
+
+	return runSummary{
+		ManifestsFound:        s.manifestsFound,
+		ManifestsProcessed:    s.manifestsProcessed,
+		ManifestsFailed:       s.manifestsFailed,
+		ManifestsCapped:       s.manifestsCapped,
+		ManifestsExpired:      s.manifestsExpired,
+		ManifestsUpToDate:     s.manifestsUpToDate,
+		FirehoseFailed:        s.firehoseFailed,
+		ManifestsBySchema:     copyCounts(s.manifestSchemas),
+		ObjectsReferenced:     s.objectsReferenced,
+		UniqueObjects:         len(s.uniqueObjects),
+		MetaObjects:           s.metaObjects,
+		AlreadyCompliant:      s.actions[actionSkipped],
+		Updated:               s.actions[actionUpdated],
+		WouldUpdate:           s.actions[actionWouldUpdate],
+		Reduced:               s.actions[actionReduced],
+		WouldReduce:           s.actions[actionWouldReduce],
+		Missing:               s.actions[actionMissing],
+		Errors:                s.actions[actionError],
+		Excluded:              s.actions[actionExcluded],
+		SkippedStorageClass:   s.actions[actionSkippedStorageClass],
+		SkippedMismatched:     s.actions[actionSkippedMismatched],
+		Planned:               s.actions[actionPlanned],
+		NotRestorable:         s.actions[actionNotRestorable],
+		ErrorsByClass:         copyCounts(s.errorsByClass),
+		FirstError:            s.firstError,
+		SkippedByFilter:       copyCounts(s.skippedByFilter),
+		LastModifiedUnknown:   s.unknownModified,
+		ObjectsByStorageClass: copyCounts(s.storageClasses),
+		SizeMismatches:        sumCounts(s.sizeMismatches),
+		SizeMismatchManifests: copyCounts(s.sizeMismatches),
+		SizeUnverified:        s.sizesUnverified,
+		MD5Mismatches:         sumCounts(s.md5Mismatches),
+		MD5MismatchManifests:  copyCounts(s.md5Mismatches),
+		MD5Unverifiable:       s.md5Unverifiable,
+		OrphanedObjects:       s.orphanedObjects,
+		OrphanedBytes:         s.orphanedBytes,
+		RetainedBytesByTable:  topTableBytes(s.tableBytes, s.topTables),
+		LimitReached:          s.limitReached,
+		LatestBackups:         copyStrings(s.latestBackups),
+		HostDCs:               copyStrings(s.hostDCs),
+		StaleHosts:            copyStrings(s.staleHosts),
+		NewestBackupAges:      ages,
+		StaleBackupHosts:      staleHosts,
+		ClusterBackupStale:    s.clusterStale,
+		BackupsPinned:         s.backupsPinned,
+		UnmatchedPins:         slices.Clone(s.unmatchedPins),
+		DroppedTables:         slices.Clone(s.droppedTables),
+		ExtraPrefixObjects:    copyCounts(s.extraObjects),
+		ExtraPrefixActions:    copyCounts(s.extraActions),
+		ExtraPrefixesFailed:   s.extraFailed,
+		BackupCoverage:        slices.Clone(s.backupCoverage),
+		SharingByHost:         slices.Clone(s.sharingByHost),
+		Canary:                s.canary.summary(),
+		Elapsed:               now.Sub(s.start).Round(time.Millisecond).String(),
+	}
+}
+
+// log logs the summary of the run, with extra attributes
+func (sum runSummary) log(extra ...any) {
+	attrs := []any{
+		"manifests_found", sum.ManifestsFound,
+		"manifests_processed", sum.ManifestsProcessed,
+		"manifests_failed", sum.ManifestsFailed,
+		"manifests_capped", sum.ManifestsCapped,
+		"manifests_expired", sum.ManifestsExpired,
+		"manifests_up_to_date", sum.ManifestsUpToDate,
+		"firehose_failed_events", sum.FirehoseFailed,
+		countsGroup("manifests_by_schema", sum.ManifestsBySchema),
+		"objects_referenced", sum.ObjectsReferenced,
+		"unique_objects", sum.UniqueObjects,
+		"meta_objects", sum.MetaObjects,
+		"already_compliant", sum.AlreadyCompliant,
+		"updated", sum.Updated,
+		"would_update", sum.WouldUpdate,
+		"reduced", sum.Reduced,
+		"would_reduce", sum.WouldReduce,
+		"missing", sum.Missing,
+		"errors", sum.Errors,
+		"excluded", sum.Excluded,
+		"skipped_storage_class", sum.SkippedStorageClass,
+		"skipped_mismatched", sum.SkippedMismatched,
+		"planned", sum.Planned,
+		"not_restorable", sum.NotRestorable,
+		countsGroup("errors_by_class", sum.ErrorsByClass),
+		countsGroup("skipped_by_filter", sum.SkippedByFilter),
+		"last_modified_unknown", sum.LastModifiedUnknown,
+		countsGroup("objects_by_storage_class", sum.ObjectsByStorageClass),
+		"size_mismatches", sum.SizeMismatches,
+		"size_unverified", sum.SizeUnverified,
+		"md5_mismatches", sum.MD5Mismatches,
+		"md5_unverifiable", sum.MD5Unverifiable,
+		"orphaned_objects", sum.OrphanedObjects,
+		"orphaned_bytes", sum.OrphanedBytes,
+		tableBytesGroup("retained_bytes_by_table", sum.RetainedBytesByTable),
+		"limit_reached", sum.LimitReached,
+		stringsGroup("latest_backups", sum.LatestBackups),
+		stringsGroup("host_dcs", sum.HostDCs),
+		stringsGroup("stale_hosts", sum.StaleHosts),
+		stringsGroup("newest_backup_ages", sum.NewestBackupAges),
+		"stale_backup_hosts", sum.StaleBackupHosts,
+		"cluster_backup_stale", sum.ClusterBackupStale,
+		"backups_pinned", sum.BackupsPinned,
+		"unmatched_pins", sum.UnmatchedPins,
+		droppedTablesGroup("dropped_tables", sum.DroppedTables),
+		countsGroup("extra_prefix_objects", sum.ExtraPrefixObjects),
+		countsGroup("extra_prefix_actions", sum.ExtraPrefixActions),
+		"extra_prefixes_failed", sum.ExtraPrefixesFailed,
+		"backups_below_full_coverage", backupsBelowFullCoverage(sum.BackupCoverage),
+		sharingGroup("sharing_by_host", sum.SharingByHost),
+		canaryGroup("canary", sum.Canary),
+		"elapsed", sum.Elapsed,
+	}
+	slog.Info("Run summary", append(attrs, extra...)...)
+}
+
+// copyCounts returns a copy of counts
+func copyCounts(counts map[string]int) map[string]int {
+	c := make(map[string]int, len(counts))
+	for name, n := range counts {
+		c[name] = n
+	}
+	return c
+}
+
+// copyStrings returns a copy of values, nil when empty
+func copyStrings(values map[string]string) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(values))
+	for name, v := range values {
+		c[name] = v
+	}
+	return c
+}
+
+// sumCounts returns the total of counts
+func sumCounts(counts map[string]int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
+
+// stringsGroup returns values as a log group ordered by name
+func stringsGroup(name string, values map[string]string) slog.Attr {
+	names := make([]string, 0, len(values))
+	for n := range values {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	attrs := make([]any, 0, len(names))
+	for _, n := range names {
+		attrs = append(attrs, slog.String(n, values[n]))
+	}
+	return slog.Group(name, attrs...)
+}
+
+// countsGroup returns counts as a log group ordered by name
+func countsGroup(name string, counts map[string]int) slog.Attr {
+	names := make([]string, 0, len(counts))
+	for n := range counts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	attrs := make([]any, 0, len(names))
+	for _, n := range names {
+		attrs = append(attrs, slog.Int(n, counts[n]))
+	}
+	return slog.Group(name, attrs...)
+}
+
+// tableKey identifies a table, or one of its secondary indexes when index is set
+type tableKey struct {
+	keyspace, table, index string
+}
+
+// tableBytes is the size of the unique objects of one table, or of one of its
+// secondary indexes, retained by a run
+type tableBytes struct {
+	Keyspace string `json:"keyspace"`
+	Table    string `json:"table"`
+	Index    string `json:"index,omitempty"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// topTableBytes returns the n tables and indexes with the most bytes, largest
+// first and by name on ties, or all of them when n is 0
+func topTableBytes(bytes map[tableKey]int64, n int) []tableBytes {
+	tables := []tableBytes{}
+	for k, b := range bytes {
+		tables = append(tables, tableBytes{Keyspace: k.keyspace, Table: k.table, Index: k.index, Bytes: b})
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Bytes != tables[j].Bytes {
+			return tables[i].Bytes > tables[j].Bytes
+		}
+		if tables[i].Keyspace != tables[j].Keyspace {
+			return tables[i].Keyspace < tables[j].Keyspace
+		}
+		if tables[i].Table != tables[j].Table {
+			return tables[i].Table < tables[j].Table
+		}
+		return tables[i].Index < tables[j].Index
+	})
+	if n > 0 && len(tables) > n {
+		tables = tables[:n]
+	}
+	return tables
+}
+
+// tableBytesGroup returns tables as a log group of keyspace.table attributes,
+// keyspace.table.index for secondary indexes, in order
+func tableBytesGroup(name string, tables []tableBytes) slog.Attr {
+	attrs := make([]any, 0, len(tables))
+	for _, t := range tables {
+		key := t.Keyspace + "." + t.Table
+		if t.Index != "" {
+			key += "." + t.Index
+		}
+		attrs = append(attrs, slog.Int64(key, t.Bytes))
+	}
+	return slog.Group(name, attrs...)
+}
+
+// droppedTablesGroup returns tables as a log group of host/keyspace.table
+// attributes with their bytes, in order
+func droppedTablesGroup(name string, tables []droppedTable) slog.Attr {
+	attrs := make([]any, 0, len(tables))
+	for _, t := range tables {
+		attrs = append(attrs, slog.Int64(t.Host+"/"+t.Keyspace+"."+t.Table, t.Bytes))
+	}
+	return slog.Group(name, attrs...)
+}
+
+// backupsBelowFullCoverage counts the backups the run didn't fully protect
+func backupsBelowFullCoverage(backups []backupCoverage) int {
+	n := 0
+	for _, b := range backups {
+		if b.Confirmed < b.Referenced {
+			n++
+		}
+	}
+	return n
+}
+
+// sharingGroup returns hosts as a log group with a group of counts per host, in order
+func sharingGroup(name string, hosts []hostSharing) slog.Attr {
+	attrs := make([]any, 0, len(hosts))
+	for _, h := range hosts {
+		attrs = append(attrs, slog.Group(h.Host,
+			"shared_objects", h.SharedObjects,
+			"shared_bytes", h.SharedBytes,
+			"unique_objects", h.UniqueObjects,
+			"unique_bytes", h.UniqueBytes,
+			"avg_backups_per_object", h.AvgBackups,
+		))
+	}
+	return slog.Group(name, attrs...)
+}
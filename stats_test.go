@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// statsBucket returns a client for three backups of one host: b1 and b2 share
+// a.db, b1 references a missing and an unreadable object, b3 is corrupt
+func statsBucket() *MockS3Client {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"},{"path":"data/ks/t/missing.db"},{"path":"data/ks/t/denied.db"}]}]`
+	bucket.objects["links/host1/b2/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/c.db"}]}]`
+	bucket.objects["links/host1/b3/meta/manifest.json"] = `not json`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	bucket.objects["links/host1/data/ks/t/c.db"] = ""
+	bucket.objects["links/host1/data/ks/t/denied.db"] = ""
+	bucket.retention["links/host1/data/ks/t/b.db"] = time.Now().AddDate(0, 0, 60)
+
+	client := bucket.client()
+	getRetention := client.GetObjectRetentionFunc
+	client.GetObjectRetentionFunc = func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+		if aws.ToString(params.Key) == "links/host1/data/ks/t/denied.db" {
+			return nil, errors.New("AccessDenied: Access Denied")
+		}
+		return getRetention(ctx, params, optFns...)
+	}
+	return client
+}
+
+func TestRunStats(t *testing.T) {
+	r := newRefresher(statsBucket(), testOptions(), time.Now())
+	out := captureLog("json", slog.LevelInfo, func() {
+		if err := r.run(context.Background()); err != nil {
+			t.Fatalf("run() error = %v", err)
+		}
+	})
+
+	s := r.stats
+	counters := []struct {
+		name string
+		got  int
+		want int
+	}{
+		{"manifests found", s.manifestsFound, 3},
+		{"manifests processed", s.manifestsProcessed, 2},
+		{"manifests failed", s.manifestsFailed, 1},
+		{"objects referenced", s.objectsReferenced, 6},
+		{"unique objects", len(s.uniqueObjects), 5},
+		// a.db is updated through b1 and already compliant when b2 references it
+		{"already compliant", s.actions[actionSkipped], 2},
+		{"updated", s.actions[actionUpdated], 2},
+		{"would update", s.actions[actionWouldUpdate], 0},
+		{"missing", s.actions[actionMissing], 1},
+		{"errors", s.actions[actionError], 1},
+		{"access denied errors", s.errorsByClass[errorClassAccessDenied], 1},
+	}
+	for _, c := range counters {
+		if c.got != c.want {
+			t.Errorf("%s = %d, want %d", c.name, c.got, c.want)
+		}
+	}
+
+	var summary map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.Contains(line, `"msg":"Run summary"`) {
+			if err := json.Unmarshal([]byte(line), &summary); err != nil {
+				t.Fatalf("summary %q is not JSON: %v", line, err)
+			}
+		}
+	}
+	if summary == nil {
+		t.Fatalf("no run summary logged:\n%s", out)
+	}
+	if summary["unique_objects"] != float64(5) || summary["missing"] != float64(1) {
+		t.Errorf("summary = %v", summary)
+	}
+	if byClass, _ := summary["errors_by_class"].(map[string]any); byClass[errorClassAccessDenied] != float64(1) {
+		t.Errorf("summary errors_by_class = %v", summary["errors_by_class"])
+	}
+	if _, ok := summary["elapsed"]; !ok {
+		t.Errorf("summary has no elapsed time: %v", summary)
+	}
+}
+
+func TestRunStatsDryRun(t *testing.T) {
+	opts := testOptions()
+	opts.dryRun = true
+	r := newRefresher(statsBucket(), opts, time.Now())
+	captureLog("text", slog.LevelInfo, func() {
+		if err := r.run(context.Background()); err != nil {
+			t.Fatalf("run() error = %v", err)
+		}
+	})
+
+	// Nothing is written, so a.db would be updated through both manifests
+	if got := r.stats.actions[actionWouldUpdate]; got != 3 {
+		t.Errorf("would update = %d, want 3", got)
+	}
+	if got := r.stats.actions[actionUpdated]; got != 0 {
+		t.Errorf("updated = %d in dry-run mode", got)
+	}
+}
+
+func TestRunInterruptedStillLogsSummary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := newRefresher(statsBucket(), testOptions(), time.Now())
+	var err error
+	out := captureLog("text", slog.LevelInfo, func() {
+		err = r.run(ctx)
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("run() error = %v, want context.Canceled", err)
+	}
+	if r.stats.manifestsProcessed != 0 {
+		t.Errorf("processed %d manifests after cancellation", r.stats.manifestsProcessed)
+	}
+	if !strings.Contains(out, "Run summary") {
+		t.Errorf("no run summary logged after interruption:\n%s", out)
+	}
+}
+
+func TestRunStatsConcurrentUpdates(t *testing.T) {
+	s := newRunStats(time.Now())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.objectReferenced("links/host1/data/ks/t/a.db")
+			s.record(actionUpdated)
+			s.recordErrorClass(errorClassThrottled)
+		}()
+	}
+	wg.Wait()
+
+	if s.objectsReferenced != 50 || len(s.uniqueObjects) != 1 || s.count(actionUpdated) != 50 || s.errorsByClass[errorClassThrottled] != 50 {
+		t.Errorf("stats = %d referenced, %d unique, %d updated, %d throttled; want 50, 1, 50, 50",
+			s.objectsReferenced, len(s.uniqueObjects), s.count(actionUpdated), s.errorsByClass[errorClassThrottled])
+	}
+}
+
+func TestRunRetainedBytesByTable(t *testing.T) {
+	bucket := newFakeBucket()
+	// users.db is shared by both backups and must only be counted once
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"app","columnfamily":"users","objects":[{"path":"data/app/users/1.db","size":300}]},{"keyspace":"app","columnfamily":"events","objects":[{"path":"data/app/events/1.db","size":100}]}]`
+	bucket.objects["links/host1/b2/meta/manifest.json"] = `[{"keyspace":"app","columnfamily":"users","objects":[{"path":"data/app/users/1.db","size":300},{"path":"data/app/users/2.db","size":50}]},{"keyspace":"system","columnfamily":"local","objects":[{"path":"data/system/local/1.db","size":400}]}]`
+	bucket.objects["links/host2/b1/meta/manifest.json"] = `[{"keyspace":"app","columnfamily":"events","objects":[{"path":"data/app/events/1.db","size":250}]}]`
+	for _, key := range []string{"links/host1/data/app/users/1.db", "links/host1/data/app/users/2.db", "links/host1/data/app/events/1.db", "links/host1/data/system/local/1.db", "links/host2/data/app/events/1.db"} {
+		bucket.objects[key] = ""
+	}
+
+	tests := []struct {
+		name      string
+		topTables int
+		want      []tableBytes
+	}{
+		{
+			name: "all tables",
+			want: []tableBytes{
+				{Keyspace: "system", Table: "local", Bytes: 400},
+				// The same path on another host is a different object
+				{Keyspace: "app", Table: "events", Bytes: 350},
+				{Keyspace: "app", Table: "users", Bytes: 350},
+			},
+		},
+		{
+			name:      "top tables",
+			topTables: 2,
+			want: []tableBytes{
+				{Keyspace: "system", Table: "local", Bytes: 400},
+				{Keyspace: "app", Table: "events", Bytes: 350},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.dryRun = true
+			opts.topTables = tt.topTables
+			r := newRefresher(bucket.client(), opts, time.Now())
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			sum := r.stats.summary(time.Now())
+			if !reflect.DeepEqual(sum.RetainedBytesByTable, tt.want) {
+				t.Errorf("summary retained_bytes_by_table = %+v, want %+v", sum.RetainedBytesByTable, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunSecondaryIndexes(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[` +
+		`{"keyspace":"app","columnfamily":"users-cb752354d0f211f0bde0457410cd7650","objects":[` +
+		`{"path":"data/app/users-cb752354d0f211f0bde0457410cd7650/nb-1-big-Data.db","size":300},` +
+		`{"path":"data/app/users-cb752354d0f211f0bde0457410cd7650/.users_email_idx/nb-1-big-Data.db","size":40}]},` +
+		`{"keyspace":"app","columnfamily":".users_email_idx","objects":[` +
+		`{"path":"data/app/users-cb752354d0f211f0bde0457410cd7650/.users_email_idx/nb-2-big-Data.db","size":20}]},` +
+		`{"keyspace":"app","columnfamily":"events-0cc175b9c0f1b6a831c399e269772661","objects":[` +
+		`{"path":"data/app/events-0cc175b9c0f1b6a831c399e269772661/.events_kind_idx/nb-1-big-Data.db","size":70}]}]`
+	for _, key := range []string{
+		"links/host1/data/app/users-cb752354d0f211f0bde0457410cd7650/nb-1-big-Data.db",
+		"links/host1/data/app/users-cb752354d0f211f0bde0457410cd7650/.users_email_idx/nb-1-big-Data.db",
+		"links/host1/data/app/users-cb752354d0f211f0bde0457410cd7650/.users_email_idx/nb-2-big-Data.db",
+		"links/host1/data/app/events-0cc175b9c0f1b6a831c399e269772661/.events_kind_idx/nb-1-big-Data.db",
+	} {
+		bucket.objects[key] = ""
+	}
+
+	opts := testOptions()
+	opts.filter.includeTables = stringList{"users"}
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	// -include-table users covers the SSTables of the users indexes
+	wantKeys := []string{
+		"links/host1/data/app/users-cb752354d0f211f0bde0457410cd7650/nb-1-big-Data.db",
+		"links/host1/data/app/users-cb752354d0f211f0bde0457410cd7650/.users_email_idx/nb-1-big-Data.db",
+		"links/host1/data/app/users-cb752354d0f211f0bde0457410cd7650/.users_email_idx/nb-2-big-Data.db",
+	}
+	if got := bucket.putKeys(); !reflect.DeepEqual(got, wantKeys) {
+		t.Errorf("updated %v, want %v", got, wantKeys)
+	}
+	want := []tableBytes{
+		{Keyspace: "app", Table: "users-cb752354d0f211f0bde0457410cd7650", Bytes: 300},
+		{Keyspace: "app", Table: "users-cb752354d0f211f0bde0457410cd7650", Index: "users_email_idx", Bytes: 60},
+	}
+	if got := r.stats.summary(time.Now()).RetainedBytesByTable; !reflect.DeepEqual(got, want) {
+		t.Errorf("summary retained_bytes_by_table = %+v, want %+v", got, want)
+	}
+}
+
+func TestTopTableBytes(t *testing.T) {
+	bytes := map[tableKey]int64{
+		{keyspace: "ks1", table: "a"}:                 10,
+		{keyspace: "ks1", table: "b"}:                 30,
+		{keyspace: "ks1", table: "b", index: "b_idx"}: 30,
+		{keyspace: "ks2", table: "a"}:                 30,
+		{keyspace: "ks2", table: "c"}:                 5,
+	}
+
+	want := []tableBytes{
+		{Keyspace: "ks1", Table: "b", Bytes: 30},
+		{Keyspace: "ks1", Table: "b", Index: "b_idx", Bytes: 30},
+		{Keyspace: "ks2", Table: "a", Bytes: 30},
+		{Keyspace: "ks1", Table: "a", Bytes: 10},
+		{Keyspace: "ks2", Table: "c", Bytes: 5},
+	}
+	if got := topTableBytes(bytes, 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("topTableBytes(0) = %+v, want %+v", got, want)
+	}
+	if got := topTableBytes(bytes, 3); !reflect.DeepEqual(got, want[:3]) {
+		t.Errorf("topTableBytes(3) = %+v, want %+v", got, want[:3])
+	}
+	if got := topTableBytes(nil, 10); got == nil || len(got) != 0 {
+		t.Errorf("topTableBytes(nil) = %#v, want an empty list", got)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// parseStorageClasses normalizes a -skip-storage-classes list to upper case
+// and rejects classes S3 doesn't know
+func parseStorageClasses(values []string) ([]types.ObjectStorageClass, error) {
+	known := types.ObjectStorageClass("").Values()
+	var classes []types.ObjectStorageClass
+	for _, v := range values {
+		class := types.ObjectStorageClass(strings.ToUpper(v))
+		if !slices.Contains(known, class) {
+			return nil, fmt.Errorf("unknown storage class %q", v)
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// storageClass returns the storage class of key, from the discovery listing
+// when it saw the object. Otherwise the object is only looked up with
+// HeadObject when -skip-storage-classes needs the answer, and "" is returned
+// when the class stays unknown. S3 omits the class of STANDARD objects.
+func (r *refresher) storageClass(ctx context.Context, key string) (types.ObjectStorageClass, error) {
+	info, ok, err := r.lookupObject(ctx, key, len(r.opts.skipStorageClasses) > 0)
+	if err != nil || !ok {
+		return "", err
+	}
+	return storageClassOrStandard(info.StorageClass), nil
+}
+
+// storageClassOrStandard fills in the STANDARD class S3 leaves out
+func storageClassOrStandard(class types.ObjectStorageClass) types.ObjectStorageClass {
+	if class == "" {
+		return types.ObjectStorageClassStandard
+	}
+	return class
+}
+
+// skipsStorageClass reports whether -skip-storage-classes lists class
+func (r *refresher) skipsStorageClass(class types.ObjectStorageClass) bool {
+	return class != "" && slices.Contains(r.opts.skipStorageClasses, class)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestParseStorageClasses(t *testing.T) {
+	got, err := parseStorageClasses([]string{"glacier", "DEEP_ARCHIVE"})
+	if err != nil {
+		t.Fatalf("parseStorageClasses() error = %v", err)
+	}
+	want := []types.ObjectStorageClass{types.ObjectStorageClassGlacier, types.ObjectStorageClassDeepArchive}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStorageClasses() = %v, want %v", got, want)
+	}
+	if _, err := parseStorageClasses([]string{"COLD"}); err == nil {
+		t.Error("parseStorageClasses() accepted an unknown class")
+	}
+}
+
+// archivedBucket returns a bucket with one manifest referencing objects in
+// the STANDARD, GLACIER and DEEP_ARCHIVE storage classes
+func archivedBucket() *fakeBucket {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"},{"path":"data/ks/t/c.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	bucket.objects["links/host1/data/ks/t/c.db"] = ""
+	bucket.classes["links/host1/data/ks/t/b.db"] = types.ObjectStorageClassGlacier
+	bucket.classes["links/host1/data/ks/t/c.db"] = types.ObjectStorageClassDeepArchive
+	return bucket
+}
+
+func TestRunSkipStorageClasses(t *testing.T) {
+	tests := []struct {
+		name        string
+		skip        []types.ObjectStorageClass
+		wantUpdated []string
+		wantSkipped int
+	}{
+		{
+			name:        "no skipping",
+			wantUpdated: []string{"links/host1/data/ks/t/a.db", "links/host1/data/ks/t/b.db", "links/host1/data/ks/t/c.db"},
+		},
+		{
+			name:        "skip archived classes",
+			skip:        []types.ObjectStorageClass{types.ObjectStorageClassGlacier, types.ObjectStorageClassDeepArchive},
+			wantUpdated: []string{"links/host1/data/ks/t/a.db"},
+			wantSkipped: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := archivedBucket()
+			opts := testOptions()
+			opts.skipStorageClasses = tt.skip
+			opts.report = filepath.Join(t.TempDir(), "report.jsonl")
+
+			r := newRefresher(bucket.client(), opts, time.Now())
+			if err := r.withReport(func() error { return r.run(context.Background()) }); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			if got := bucket.putKeys(); !reflect.DeepEqual(got, tt.wantUpdated) {
+				t.Errorf("run() updated %v, want %v", got, tt.wantUpdated)
+			}
+			if bucket.headCalls != 0 {
+				t.Errorf("run() made %d HeadObject calls, want the listing to be used", bucket.headCalls)
+			}
+			sum := r.stats.summary(time.Now())
+			if sum.SkippedStorageClass != tt.wantSkipped {
+				t.Errorf("summary skipped_storage_class = %d, want %d", sum.SkippedStorageClass, tt.wantSkipped)
+			}
+			wantClasses := map[string]int{"STANDARD": 1, "GLACIER": 1, "DEEP_ARCHIVE": 1}
+			if !reflect.DeepEqual(sum.ObjectsByStorageClass, wantClasses) {
+				t.Errorf("summary objects_by_storage_class = %v, want %v", sum.ObjectsByStorageClass, wantClasses)
+			}
+
+			for _, rec := range readReport(t, opts.report) {
+				if rec["action"] == string(actionSkippedStorageClass) && rec["storage_class"] != string(bucket.classes[rec["key"].(string)]) {
+					t.Errorf("record %v lacks the storage class", rec)
+				}
+			}
+		})
+	}
+}
+
+func TestStorageClassHeadObject(t *testing.T) {
+	tests := []struct {
+		name          string
+		skip          []types.ObjectStorageClass
+		wantHeadCalls int
+		wantUpdated   []string
+	}{
+		{
+			name:        "not needed without -skip-storage-classes",
+			wantUpdated: []string{"links/host1/data/ks/t/a.db", "links/host1/data/ks/t/b.db", "links/host1/data/ks/t/c.db"},
+		},
+		{
+			name:          "looked up for unlisted objects",
+			skip:          []types.ObjectStorageClass{types.ObjectStorageClassGlacier},
+			wantHeadCalls: 3,
+			wantUpdated:   []string{"links/host1/data/ks/t/a.db", "links/host1/data/ks/t/c.db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := archivedBucket()
+			opts := testOptions()
+			opts.manifestKey = "links/host1/b1/meta/manifest.json"
+			opts.skipStorageClasses = tt.skip
+
+			r := newRefresher(bucket.client(), opts, time.Now())
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			if bucket.headCalls != tt.wantHeadCalls {
+				t.Errorf("run() made %d HeadObject calls, want %d", bucket.headCalls, tt.wantHeadCalls)
+			}
+			if got := bucket.putKeys(); !reflect.DeepEqual(got, tt.wantUpdated) {
+				t.Errorf("run() updated %v, want %v", got, tt.wantUpdated)
+			}
+		})
+	}
+}
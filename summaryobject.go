@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Placeholders of -summary-s3-key and -summary-latest-key
+const (
+	placeholderCluster = "{cluster}"
+	placeholderDate    = "{date}" // YYYY-MM-DD in UTC
+	placeholderRunID   = "{run_id}"
+)
+
+// summaryObject is the JSON uploaded to -summary-s3-key: the -webhook-url
+// payload with the run's status
+type summaryObject struct {
+	webhookPayload
+	Status string `json:"status"` // succeeded or failed
+}
+
+// expandSummaryKey fills in the placeholders of a -summary-s3-key template
+func expandSummaryKey(template, cluster, runID string, now time.Time) string {
+	return strings.NewReplacer(
+		placeholderCluster, cluster,
+		placeholderDate, now.UTC().Format(time.DateOnly),
+		placeholderRunID, runID,
+	).Replace(template)
+}
+
+// validateSummaryKey checks a -summary-s3-key or -summary-latest-key
+// template: a key in -bucket, or an s3://bucket/key URI, using only the
+// known placeholders
+func validateSummaryKey(flagName, template string) error {
+	key := expandSummaryKey(template, "cluster", "run", time.Now())
+	if strings.ContainsAny(key, "{}") {
+		return fmt.Errorf("invalid -%s %q: placeholders are %s, %s and %s", flagName, template, placeholderCluster, placeholderDate, placeholderRunID)
+	}
+	if strings.HasPrefix(key, "s3://") {
+		if _, _, err := parseS3URI(key); err != nil {
+			return fmt.Errorf("invalid -%s: %w", flagName, err)
+		}
+		return nil
+	}
+	if err := validateObjectKey(key); err != nil {
+		return fmt.Errorf("invalid -%s: %w", flagName, err)
+	}
+	return nil
+}
+
+// summaryLocation returns the bucket and key a -summary-s3-key template
+// expands to, in -bucket unless it is an s3:// URI
+func (r *refresher) summaryLocation(template string, now time.Time) (string, string, error) {
+	key := expandSummaryKey(template, r.opts.cluster, r.runID, now)
+	if strings.HasPrefix(key, "s3://") {
+		return parseS3URI(key)
+	}
+	return r.opts.bucket, key, nil
+}
+
+// uploadSummary uploads the run's summary to -summary-s3-key, and to
+// -summary-latest-key when set, returning runErr, or the upload's error when
+// the run succeeded, since monitoring relies on the object. A failed upload
+// after a failed run is only logged.
+func (r *refresher) uploadSummary(ctx context.Context, runErr error) error {
+	opts := r.opts
+	if opts.summaryKey == "" {
+		return runErr
+	}
+	// The summary is uploaded even when the run was interrupted
+	uploadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+	defer cancel()
+
+	err := func() error {
+		if r.uploader == nil {
+			client, err := newS3Client(uploadCtx, opts.commonOptions)
+			if err != nil {
+				return err
+			}
+			r.uploader = client
+		}
+		// -summary-s3-key defaults to -bucket, whose calls carry its
+		// -requester-pays and -expected-bucket-owner
+		uploader := wrapBucketWriter(r.uploader, opts.commonOptions)
+		now := time.Now()
+		summary := summaryObject{webhookPayload: r.webhookPayload(runErr, now), Status: "succeeded"}
+		if runErr != nil {
+			summary.Status = "failed"
+		}
+		body, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode run summary: %w", err)
+		}
+		for _, template := range []string{opts.summaryKey, opts.summaryLatestKey} {
+			if template == "" {
+				continue
+			}
+			bucket, key, err := r.summaryLocation(template, now)
+			if err != nil {
+				return err
+			}
+			_, err = uploader.PutObject(uploadCtx, &s3.PutObjectInput{
+				Bucket:      aws.String(bucket),
+				Key:         aws.String(key),
+				Body:        bytes.NewReader(body),
+				ContentType: aws.String("application/json"),
+				// Object Lock requires an integrity checksum on PutObject
+				ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to upload run summary to s3://%s/%s: %w", bucket, key, err)
+			}
+			slog.Info("Uploaded run summary", "uri", "s3://"+bucket+"/"+key)
+		}
+		return nil
+	}()
+	if err == nil {
+		return runErr
+	}
+	if runErr == nil {
+		return err
+	}
+	slog.Error("Failed to upload run summary", errorAttrs(err)...)
+	return runErr
+}
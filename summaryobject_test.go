@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestExpandSummaryKey(t *testing.T) {
+	now := time.Date(2025, 6, 1, 23, 30, 0, 0, time.FixedZone("PDT", -7*3600))
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: "monitoring/retention.json", want: "monitoring/retention.json"},
+		{template: "monitoring/{cluster}/{date}.json", want: "monitoring/links/2025-06-02.json"},
+		{template: "s3://ops/{cluster}/{date}/{run_id}.json", want: "s3://ops/links/2025-06-02/0123abcd.json"},
+	}
+	for _, tt := range tests {
+		if got := expandSummaryKey(tt.template, "links", "0123abcd", now); got != tt.want {
+			t.Errorf("expandSummaryKey(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestValidateSummaryKey(t *testing.T) {
+	for _, template := range []string{"monitoring/{cluster}/{date}.json", "s3://ops/{cluster}/latest.json"} {
+		if err := validateSummaryKey("summary-s3-key", template); err != nil {
+			t.Errorf("validateSummaryKey(%q) error = %v", template, err)
+		}
+	}
+	for _, template := range []string{"monitoring/{host}.json", "monitoring/{cluster}/", "s3://ops", "s3:///key"} {
+		if err := validateSummaryKey("summary-s3-key", template); err == nil {
+			t.Errorf("validateSummaryKey(%q) succeeded, want an error", template)
+		}
+	}
+}
+
+func TestRunUploadsSummary(t *testing.T) {
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+
+	tests := []struct {
+		name       string
+		fail       bool
+		failures   int
+		wantStatus string
+		wantErr    string
+	}{
+		{name: "success", wantStatus: "succeeded"},
+		{name: "failed run", fail: true, wantStatus: "failed", wantErr: "pins in -pins-file match no discovered backup"},
+		{name: "upload fails the run", failures: 1, wantErr: "failed to upload run summary to s3://test-bucket/monitoring/links/"},
+		{name: "failed run keeps its error", fail: true, failures: 1, wantErr: "pins in -pins-file match no discovered backup"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.summaryKey = "monitoring/{cluster}/{date}.json"
+			opts.summaryLatestKey = "s3://ops-bucket/retention/{cluster}/latest.json"
+			opts.requesterPays, opts.expectedOwner = true, "123456789012"
+			delete(bucket.objects, "ops/pins.txt")
+			if tt.fail {
+				// A pin matching no backup fails the run
+				bucket.objects["ops/pins.txt"] = "links/host9/backup1\n"
+				opts.pinsFile = "s3://test-bucket/ops/pins.txt"
+			}
+			uploader := &mockUploader{failures: tt.failures}
+			r := newRefresher(bucket.client(), opts, time.Now())
+			r.uploader = uploader
+			err := r.run(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("run() error = %v, want %q", err, tt.wantErr)
+			}
+			if tt.wantStatus == "" {
+				return
+			}
+
+			wantKeys := []string{
+				"test-bucket/monitoring/links/" + time.Now().UTC().Format(time.DateOnly) + ".json",
+				"ops-bucket/retention/links/latest.json",
+			}
+			if strings.Join(uploader.keys, " ") != strings.Join(wantKeys, " ") {
+				t.Fatalf("uploaded %v, want %v", uploader.keys, wantKeys)
+			}
+			if string(uploader.bodies[0]) != string(uploader.bodies[1]) {
+				t.Errorf("latest summary differs from the run's")
+			}
+			if ct := uploader.inputs[0].ContentType; ct == nil || *ct != "application/json" {
+				t.Errorf("summary uploaded as %v, want application/json", ct)
+			}
+			for i, in := range uploader.inputs {
+				if in.ChecksumAlgorithm != types.ChecksumAlgorithmSha256 {
+					t.Errorf("%s uploaded with checksum %q, want SHA256 for Object Lock", uploader.keys[i], in.ChecksumAlgorithm)
+				}
+				if in.RequestPayer != types.RequestPayerRequester {
+					t.Errorf("%s uploaded with request payer %q, want -requester-pays", uploader.keys[i], in.RequestPayer)
+				}
+			}
+			if owner := aws.ToString(uploader.inputs[0].ExpectedBucketOwner); owner != "123456789012" {
+				t.Errorf("summary uploaded to -bucket expecting owner %q, want -expected-bucket-owner", owner)
+			}
+			if owner := uploader.inputs[1].ExpectedBucketOwner; owner != nil {
+				t.Errorf("latest summary uploaded to another bucket expecting owner %q, want none", *owner)
+			}
+			var summary map[string]any
+			if err := json.Unmarshal(uploader.bodies[0], &summary); err != nil {
+				t.Fatalf("invalid summary %s: %v", uploader.bodies[0], err)
+			}
+			for member, want := range map[string]any{
+				"status":  tt.wantStatus,
+				"success": tt.wantStatus == "succeeded",
+				"cluster": "links",
+				"bucket":  "test-bucket",
+				"run_id":  r.runID,
+			} {
+				if summary[member] != want {
+					t.Errorf("summary %s = %v, want %v", member, summary[member], want)
+				}
+			}
+			if tt.wantStatus == "succeeded" && summary["updated"] != float64(1) {
+				t.Errorf("summary updated = %v, want 1", summary["updated"])
+			}
+			if tt.fail && !strings.Contains(summary["error"].(string), "pins-file") {
+				t.Errorf("summary error = %v, want the run's", summary["error"])
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Tags -tag-objects writes on the objects whose retention it changed
+const (
+	tagUntil = "retention-refresher:until"  // retain-until set, RFC3339
+	tagMode  = "retention-refresher:mode"   // Object Lock mode set
+	tagRunID = "retention-refresher:run-id" // run that set them
+)
+
+// maxObjectTags is the most tags S3 allows on an object
+const maxObjectTags = 10
+
+// objectTagger writes the -tag-objects tags and reads them for -trust-tags.
+// Permission errors disable the operation they hit for the rest of the run.
+// It is safe for concurrent use.
+type objectTagger struct {
+	client S3API
+	bucket string
+	runID  string
+	write  bool // -tag-objects
+	trust  bool // -trust-tags
+
+	readDenied  atomic.Bool
+	writeDenied atomic.Bool
+}
+
+// newObjectTagger returns the tagger of opts, nil when neither -tag-objects
+// nor -trust-tags is set
+func newObjectTagger(client S3API, opts *options, runID string) *objectTagger {
+	if !opts.tagObjects && !opts.trustTags {
+		return nil
+	}
+	return &objectTagger{client: client, bucket: opts.bucket, runID: runID, write: opts.tagObjects && !opts.dryRun, trust: opts.trustTags}
+}
+
+// read returns the tags of key. ok is false when they couldn't be read.
+func (t *objectTagger) read(ctx context.Context, key string) ([]types.Tag, bool) {
+	if t.readDenied.Load() {
+		return nil, false
+	}
+	out, err := t.client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(t.bucket), Key: aws.String(key)})
+	if err != nil {
+		if errorClass(err) == errorClassAccessDenied {
+			if t.readDenied.CompareAndSwap(false, true) {
+				slog.Warn("Not allowed to read object tags, neither trusting nor writing them for the rest of the run", append([]any{"key", key}, errorAttrs(err)...)...)
+			}
+		} else if errorClass(err) != errorClassNotFound {
+			slog.Debug("Failed to read object tags", append([]any{"key", key}, errorAttrs(err)...)...)
+		}
+		return nil, false
+	}
+	return out.TagSet, true
+}
+
+// tagValue returns the value of the tag named key, "" when absent
+func tagValue(tags []types.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.ToString(tag.Key) == key {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// tagged returns the retention the -tag-objects tags of tags record, nil when
+// they don't record any
+func tagged(tags []types.Tag) *ObjectRetention {
+	until, err := time.Parse(time.RFC3339, tagValue(tags, tagUntil))
+	mode := types.ObjectLockRetentionMode(tagValue(tags, tagMode))
+	if err != nil || (mode != types.ObjectLockRetentionModeGovernance && mode != types.ObjectLockRetentionModeCompliance) {
+		return nil
+	}
+	return &ObjectRetention{RetainUntil: &until, Mode: mode}
+}
+
+// retainedPerTags returns the retention the tags of key show, when they show
+// it long enough, in a mode strict enough, and, with -allow-reduce, not too
+// long for target. tags are those read, known when they could be.
+func (r *refresher) retainedPerTags(ctx context.Context, key string, target retentionTarget) (current *ObjectRetention, tags []types.Tag, known bool) {
+	if tags, known = r.tags.read(ctx, key); !known {
+		return nil, nil, false
+	}
+	current = tagged(tags)
+	switch {
+	case current == nil, needsRetentionUpdate(current.RetainUntil, target.requiredUntil):
+		return nil, tags, true
+	case r.opts.mode == types.ObjectLockRetentionModeCompliance && current.Mode != r.opts.mode:
+		return nil, tags, true
+	case r.opts.allowReduce && r.opts.bypassGovernance && needsRetentionReduction(current, target.retainUntil):
+		return nil, tags, true
+	}
+	return current, tags, true
+}
+
+// withRetentionTags returns tags with the -tag-objects tags set to until, mode
+// and runID, keeping the object's other tags. ok is false when the object has
+// too many tags to add them.
+func withRetentionTags(tags []types.Tag, until time.Time, mode types.ObjectLockRetentionMode, runID string) ([]types.Tag, bool) {
+	set := []types.Tag{
+		{Key: aws.String(tagUntil), Value: aws.String(until.UTC().Format(time.RFC3339))},
+		{Key: aws.String(tagMode), Value: aws.String(string(mode))},
+		{Key: aws.String(tagRunID), Value: aws.String(runID)},
+	}
+	for _, tag := range tags {
+		switch aws.ToString(tag.Key) {
+		case tagUntil, tagMode, tagRunID:
+			continue
+		}
+		set = append(set, tag)
+	}
+	return set, len(set) <= maxObjectTags
+}
+
+// tag records until, mode and the run in the tags of key, whose tags are
+// tags when known. Failures are only logged: the retention is set either way.
+func (t *objectTagger) tag(ctx context.Context, manifest, key string, tags []types.Tag, known bool, until time.Time, mode types.ObjectLockRetentionMode) {
+	if !t.write || t.writeDenied.Load() {
+		return
+	}
+	if !known {
+		// Putting tags replaces them all, so the object's are read first
+		if tags, known = t.read(ctx, key); !known {
+			slog.Debug("Not tagging object whose tags couldn't be read", "manifest", manifest, "key", key)
+			return
+		}
+	}
+	set, ok := withRetentionTags(tags, until, mode, t.runID)
+	if !ok {
+		slog.Warn("Not tagging object with too many tags", "manifest", manifest, "key", key, "tags", len(tags))
+		return
+	}
+	_, err := t.client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(t.bucket),
+		Key:     aws.String(key),
+		Tagging: &types.Tagging{TagSet: set},
+	})
+	if err == nil {
+		return
+	}
+	if errorClass(err) == errorClassAccessDenied {
+		if t.writeDenied.CompareAndSwap(false, true) {
+			slog.Warn("Not allowed to tag objects, no longer tagging them", append([]any{"manifest", manifest, "key", key}, errorAttrs(err)...)...)
+		}
+		return
+	}
+	slog.Warn("Failed to tag object", append([]any{"manifest", manifest, "key", key}, errorAttrs(err)...)...)
+}
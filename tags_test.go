@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// taggedBucket is a fakeBucket whose client also serves object tags
+type taggedBucket struct {
+	*fakeBucket
+	tagsMu         sync.Mutex
+	tags           map[string][]types.Tag // key -> tag set
+	retentionGets  int
+	getTaggingErr  error // returned by GetObjectTagging when set
+	putTaggingErr  error // returned by PutObjectTagging when set
+	putTaggingKeys []string
+}
+
+// newTaggedBucket returns a bucket with one backup of two objects, and its client
+func newTaggedBucket() (*taggedBucket, *MockS3Client) {
+	bucket := &taggedBucket{fakeBucket: newFakeBucket(), tags: make(map[string][]types.Tag)}
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	client := bucket.client()
+	getRetention := client.GetObjectRetentionFunc
+	client.GetObjectRetentionFunc = func(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+		bucket.tagsMu.Lock()
+		bucket.retentionGets++
+		bucket.tagsMu.Unlock()
+		return getRetention(ctx, params, optFns...)
+	}
+	client.GetObjectTaggingFunc = func(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+		bucket.tagsMu.Lock()
+		defer bucket.tagsMu.Unlock()
+		if bucket.getTaggingErr != nil {
+			return nil, bucket.getTaggingErr
+		}
+		return &s3.GetObjectTaggingOutput{TagSet: bucket.tags[aws.ToString(params.Key)]}, nil
+	}
+	client.PutObjectTaggingFunc = func(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+		bucket.tagsMu.Lock()
+		defer bucket.tagsMu.Unlock()
+		if bucket.putTaggingErr != nil {
+			return nil, bucket.putTaggingErr
+		}
+		key := aws.ToString(params.Key)
+		bucket.putTaggingKeys = append(bucket.putTaggingKeys, key)
+		bucket.tags[key] = params.Tagging.TagSet
+		return &s3.PutObjectTaggingOutput{}, nil
+	}
+	return bucket, client
+}
+
+// retentionTags returns the -tag-objects tags of until and mode
+func retentionTags(until time.Time, mode types.ObjectLockRetentionMode) []types.Tag {
+	tags, _ := withRetentionTags(nil, until, mode, "earlier-run")
+	return tags
+}
+
+func TestWithRetentionTags(t *testing.T) {
+	until := time.Date(2026, 11, 15, 10, 30, 0, 0, time.UTC)
+	existing := []types.Tag{
+		{Key: aws.String("team"), Value: aws.String("storage")},
+		{Key: aws.String(tagUntil), Value: aws.String("2026-10-01T00:00:00Z")},
+		{Key: aws.String(tagRunID), Value: aws.String("earlier-run")},
+	}
+	set, ok := withRetentionTags(existing, until, types.ObjectLockRetentionModeCompliance, "run-1")
+	if !ok || len(set) != 4 {
+		t.Fatalf("withRetentionTags() = %v, %v, want the 3 retention tags and the team one", set, ok)
+	}
+	want := map[string]string{tagUntil: "2026-11-15T10:30:00Z", tagMode: "COMPLIANCE", tagRunID: "run-1", "team": "storage"}
+	for key, value := range want {
+		if got := tagValue(set, key); got != value {
+			t.Errorf("tag %s = %q, want %q", key, got, value)
+		}
+	}
+	got := tagged(set)
+	if got == nil || !got.RetainUntil.Equal(until) || got.Mode != types.ObjectLockRetentionModeCompliance {
+		t.Errorf("tagged() = %+v, want COMPLIANCE until %s", got, until)
+	}
+
+	var full []types.Tag
+	for i := 0; i < 8; i++ {
+		full = append(full, types.Tag{Key: aws.String(strings.Repeat("k", i+1)), Value: aws.String("v")})
+	}
+	if _, ok := withRetentionTags(full, until, types.ObjectLockRetentionModeGovernance, "run-1"); ok {
+		t.Error("withRetentionTags() of an object with 8 tags = ok, want too many")
+	}
+}
+
+func TestTagged(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []types.Tag
+		want bool
+	}{
+		{name: "no tags"},
+		{name: "bad date", tags: []types.Tag{{Key: aws.String(tagUntil), Value: aws.String("soon")}, {Key: aws.String(tagMode), Value: aws.String("GOVERNANCE")}}},
+		{name: "no mode", tags: []types.Tag{{Key: aws.String(tagUntil), Value: aws.String("2026-11-15T10:30:00Z")}}},
+		{name: "retention tags", tags: retentionTags(time.Now(), types.ObjectLockRetentionModeGovernance), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tagged(tt.tags); (got != nil) != tt.want {
+				t.Errorf("tagged() = %+v, want a retention: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunTagsObjects(t *testing.T) {
+	bucket, client := newTaggedBucket()
+	bucket.tags["links/host1/data/ks/t/a.db"] = []types.Tag{{Key: aws.String("team"), Value: aws.String("storage")}}
+	// b.db is retained long enough and left untagged
+	bucket.retention["links/host1/data/ks/t/b.db"] = time.Now().AddDate(0, 0, 20)
+	opts := testOptions()
+	opts.tagObjects = true
+
+	r := newRefresher(client, opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	tags := bucket.tags["links/host1/data/ks/t/a.db"]
+	set := bucket.retention["links/host1/data/ks/t/a.db"]
+	if got := tagged(tags); got == nil || !got.RetainUntil.Equal(set.Truncate(time.Second)) || got.Mode != types.ObjectLockRetentionModeGovernance {
+		t.Errorf("tags = %v, want the GOVERNANCE retain-until set, %s", tags, set)
+	}
+	if got := tagValue(tags, tagRunID); got != r.runID {
+		t.Errorf("run-id tag = %q, want %q", got, r.runID)
+	}
+	if got := tagValue(tags, "team"); got != "storage" {
+		t.Errorf("team tag = %q, want the object's tag kept", got)
+	}
+	if len(bucket.putTaggingKeys) != 1 {
+		t.Errorf("tagged %v, want only the updated object", bucket.putTaggingKeys)
+	}
+}
+
+func TestRunDryRunTagsNothing(t *testing.T) {
+	bucket, client := newTaggedBucket()
+	opts := testOptions()
+	opts.tagObjects, opts.dryRun = true, true
+	if err := newRefresher(client, opts, time.Now()).run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(bucket.putTaggingKeys) != 0 {
+		t.Errorf("dry run tagged %v", bucket.putTaggingKeys)
+	}
+}
+
+func TestRunTrustsTags(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		tags        []types.Tag
+		opts        func(opts *options)
+		wantTrusted bool
+	}{
+		{
+			name:        "retained long enough",
+			tags:        retentionTags(now.AddDate(0, 0, 20), types.ObjectLockRetentionModeGovernance),
+			wantTrusted: true,
+		},
+		{
+			name: "retained too short",
+			tags: retentionTags(now.AddDate(0, 0, 3), types.ObjectLockRetentionModeGovernance),
+		},
+		{
+			name: "untagged",
+		},
+		{
+			name: "compliance required",
+			tags: retentionTags(now.AddDate(0, 0, 20), types.ObjectLockRetentionModeGovernance),
+			opts: func(opts *options) { opts.mode = types.ObjectLockRetentionModeCompliance },
+		},
+		{
+			name: "reduction allowed",
+			tags: retentionTags(now.AddDate(0, 0, 90), types.ObjectLockRetentionModeGovernance),
+			opts: func(opts *options) { opts.allowReduce, opts.bypassGovernance = true, true },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, client := newTaggedBucket()
+			for _, key := range []string{"links/host1/data/ks/t/a.db", "links/host1/data/ks/t/b.db"} {
+				bucket.tags[key] = tt.tags
+			}
+			opts := testOptions()
+			opts.trustTags, opts.yes = true, true
+			if tt.opts != nil {
+				tt.opts(opts)
+			}
+			r := newRefresher(client, opts, now)
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+			if trusted := bucket.retentionGets == 0; trusted != tt.wantTrusted {
+				t.Errorf("checked the retention %d times, want the tags trusted: %v", bucket.retentionGets, tt.wantTrusted)
+			}
+			if tt.wantTrusted && len(bucket.puts) != 0 {
+				t.Errorf("run() updated %v of objects whose tags were trusted", bucket.putKeys())
+			}
+			if tt.wantTrusted && r.stats.summary(time.Now()).AlreadyCompliant != 2 {
+				t.Errorf("already_compliant = %d, want both objects", r.stats.summary(time.Now()).AlreadyCompliant)
+			}
+		})
+	}
+}
+
+func TestRunTagPermissionDenied(t *testing.T) {
+	denied := &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+	tests := []struct {
+		name        string
+		getErr      error
+		putErr      error
+		wantWarning string
+	}{
+		{name: "reading denied", getErr: denied, wantWarning: "Not allowed to read object tags"},
+		{name: "tagging denied", putErr: denied, wantWarning: "Not allowed to tag objects"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, client := newTaggedBucket()
+			bucket.getTaggingErr, bucket.putTaggingErr = tt.getErr, tt.putErr
+			opts := testOptions()
+			opts.tagObjects, opts.trustTags = true, true
+			r := newRefresher(client, opts, time.Now())
+			logged := captureLog("text", slog.LevelWarn, func() {
+				if err := r.run(context.Background()); err != nil {
+					t.Fatalf("run() error = %v", err)
+				}
+			})
+			if len(bucket.puts) != 2 {
+				t.Errorf("updated %v, want both objects despite the tag errors", bucket.putKeys())
+			}
+			if summary := r.stats.summary(time.Now()); summary.Errors != 0 {
+				t.Errorf("errors = %d, want tag errors not to fail objects", summary.Errors)
+			}
+			if got := strings.Count(logged, tt.wantWarning); got != 1 {
+				t.Errorf("logged %q %d times, want once:\n%s", tt.wantWarning, got, logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"sync"
+	"unicode/utf8"
+)
+
+// kubernetesTerminationLog is where Kubernetes reads a container's
+// termination message from, shown by kubectl describe
+const kubernetesTerminationLog = "/dev/termination-log"
+
+// terminationLogLimit is the most bytes of the termination message Kubernetes
+// keeps
+const terminationLogLimit = 4096
+
+// Process outcomes written to -termination-log
+const (
+	statusSucceeded   = "succeeded"
+	statusFailed      = "failed"
+	statusInterrupted = "interrupted"
+)
+
+// defaultTerminationLog returns the -termination-log default:
+// kubernetesTerminationLog when running in a Kubernetes pod, none otherwise
+func defaultTerminationLog() string {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return kubernetesTerminationLog
+	}
+	return ""
+}
+
+// terminationCounts are the counters of the last run written to
+// -termination-log
+type terminationCounts struct {
+	ManifestsProcessed int `json:"manifests_processed"`
+	ManifestsFailed    int `json:"manifests_failed"`
+	AlreadyCompliant   int `json:"already_compliant"`
+	Updated            int `json:"updated"`
+	WouldUpdate        int `json:"would_update"`
+	Missing            int `json:"missing"`
+	Errors             int `json:"errors"`
+}
+
+// terminationSummary is the compact JSON written to -termination-log
+type terminationSummary struct {
+	Status   string             `json:"status"`
+	ExitCode int                `json:"exit_code"`
+	RunID    string             `json:"run_id,omitempty"`
+	Counts   *terminationCounts `json:"counts,omitempty"`
+	Error    string             `json:"error,omitempty"` // the process's error, or the run's first object error
+}
+
+// encode returns the summary as JSON of at most limit bytes, shortening the
+// error as needed
+func (s terminationSummary) encode(limit int) ([]byte, error) {
+	data, err := json.Marshal(s)
+	if err != nil || len(data) <= limit {
+		return data, err
+	}
+	// Escaping makes the error's length in JSON unpredictable, so search for
+	// the longest prefix that fits
+	full := s.Error
+	var fits []byte
+	low, high := 0, len(full)-1
+	for low <= high {
+		keep := (low + high) / 2
+		for keep > 0 && !utf8.RuneStart(full[keep]) {
+			keep--
+		}
+		s.Error = full[:keep] + "…"
+		if data, err = json.Marshal(s); err != nil {
+			return nil, err
+		}
+		if len(data) <= limit {
+			fits, low = data, (low+high)/2+1
+		} else {
+			high = keep - 1
+		}
+	}
+	if fits == nil {
+		return nil, fmt.Errorf("summary of %d bytes exceeds %d", len(data), limit)
+	}
+	return fits, nil
+}
+
+// terminationLog collects what -termination-log reports of the process. It
+// is safe for concurrent use.
+type terminationLog struct {
+	mu      sync.Mutex
+	path    string
+	runID   string
+	summary *runSummary // of the last run, nil before any ended
+}
+
+// termination is the process's -termination-log, which every exit path writes
+var termination = &terminationLog{path: defaultTerminationLog()}
+
+// setPath sets where the summary is written, "" for nowhere
+func (t *terminationLog) setPath(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+}
+
+// setSummary records the summary of a run, replacing the previous run's, for
+// -interval passes and -sqs-queue-url messages
+func (t *terminationLog) setSummary(runID string, sum runSummary) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.runID, t.summary = runID, &sum
+}
+
+// write writes the outcome of the process, which exits with code after err,
+// interrupted when ctx was canceled
+func (t *terminationLog) write(ctx context.Context, code int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.path == "" {
+		return
+	}
+	s := terminationSummary{Status: statusSucceeded, ExitCode: code, RunID: t.runID}
+	switch {
+	case ctx.Err() != nil:
+		s.Status = statusInterrupted
+	case err != nil:
+		s.Status = statusFailed
+	}
+	if sum := t.summary; sum != nil {
+		s.Counts = &terminationCounts{
+			ManifestsProcessed: sum.ManifestsProcessed,
+			ManifestsFailed:    sum.ManifestsFailed,
+			AlreadyCompliant:   sum.AlreadyCompliant,
+			Updated:            sum.Updated,
+			WouldUpdate:        sum.WouldUpdate,
+			Missing:            sum.Missing,
+			Errors:             sum.Errors,
+		}
+		s.Error = sum.FirstError
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	data, encErr := s.encode(terminationLogLimit)
+	if encErr == nil {
+		encErr = os.WriteFile(t.path, data, 0o644)
+	}
+	if encErr != nil {
+		slog.Warn("Failed to write -termination-log", "path", t.path, "error", encErr.Error())
+	}
+}
+
+// runMain runs the command and returns the process's exit code. It is the
+// only way out of the process: errors and panics alike are logged and
+// written to -termination-log.
+func runMain(ctx context.Context, command func(ctx context.Context) error) (code int) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		err := fmt.Errorf("panic: %v", p)
+		slog.Error(err.Error(), "stack", string(debug.Stack()))
+		code = exitCode(err)
+		termination.write(ctx, code, err)
+	}()
+
+	err := command(ctx)
+	if err != nil {
+		slog.Error(err.Error())
+		code = exitCode(err)
+	} else {
+		slog.Info("Done")
+	}
+	termination.write(ctx, code, err)
+	return code
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// withTerminationLog points -termination-log at a file of the test, returning
+// its path
+func withTerminationLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "termination-log")
+	previous := termination
+	termination = &terminationLog{path: path}
+	t.Cleanup(func() { termination = previous })
+	return path
+}
+
+func TestRunMainWritesTerminationLog(t *testing.T) {
+	tests := []struct {
+		name       string
+		listErr    error
+		cancel     bool
+		panics     bool
+		wantCode   int
+		wantStatus string
+		wantCounts *terminationCounts
+		wantErr    string
+	}{
+		{
+			name:       "success",
+			wantStatus: statusSucceeded,
+			wantCounts: &terminationCounts{ManifestsProcessed: 1, Updated: 1, Missing: 1},
+		},
+		{
+			name:       "failure",
+			listErr:    errors.New("AccessDenied: Access Denied"),
+			wantCode:   1,
+			wantStatus: statusFailed,
+			wantCounts: &terminationCounts{},
+			wantErr:    "AccessDenied: Access Denied",
+		},
+		{
+			name:       "interrupted",
+			cancel:     true,
+			wantCode:   1,
+			wantStatus: statusInterrupted,
+			wantCounts: &terminationCounts{},
+			wantErr:    "run interrupted",
+		},
+		{
+			name:       "panic",
+			panics:     true,
+			wantCode:   1,
+			wantStatus: statusFailed,
+			wantErr:    "panic: assignment to entry in nil map",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := withTerminationLog(t)
+			bucket := newFakeBucket()
+			bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/gone.db"}]}]`
+			bucket.objects["links/host1/data/ks/t/a.db"] = ""
+			client := bucket.client()
+			if tt.listErr != nil {
+				client.ListObjectsV2Func = func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+					return nil, tt.listErr
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			var r *refresher
+			code := runMain(ctx, func(ctx context.Context) error {
+				if tt.panics {
+					var m map[string]int
+					m["boom"]++
+				}
+				r = newRefresher(client, testOptions(), time.Now())
+				return r.run(ctx)
+			})
+			if code != tt.wantCode {
+				t.Errorf("runMain() = %d, want %d", code, tt.wantCode)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("termination log not written: %v", err)
+			}
+			var got terminationSummary
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("termination log %q is not JSON: %v", data, err)
+			}
+			if got.Status != tt.wantStatus || got.ExitCode != tt.wantCode {
+				t.Errorf("termination log = %s, want status %s and exit code %d", data, tt.wantStatus, tt.wantCode)
+			}
+			if !strings.Contains(got.Error, tt.wantErr) || (tt.wantErr == "") != (got.Error == "") {
+				t.Errorf("termination log error = %q, want %q", got.Error, tt.wantErr)
+			}
+			switch {
+			case tt.wantCounts == nil && got.Counts != nil:
+				t.Errorf("termination log counts = %+v, want none without a run", got.Counts)
+			case tt.wantCounts != nil && (got.Counts == nil || *got.Counts != *tt.wantCounts):
+				t.Errorf("termination log counts = %+v, want %+v", got.Counts, tt.wantCounts)
+			}
+			if r != nil && got.RunID != r.runID {
+				t.Errorf("termination log run_id = %q, want %q", got.RunID, r.runID)
+			}
+		})
+	}
+}
+
+func TestTerminationLogFirstObjectError(t *testing.T) {
+	path := withTerminationLog(t)
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	client := bucket.client()
+	client.PutObjectRetentionFunc = func(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+		return nil, errors.New("AccessDenied: Access Denied")
+	}
+	code := runMain(context.Background(), func(ctx context.Context) error {
+		return newRefresher(client, testOptions(), time.Now()).run(ctx)
+	})
+	if code != 0 {
+		t.Fatalf("runMain() = %d, want 0 for a run with object errors", code)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got terminationSummary
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != statusSucceeded || got.Counts == nil || got.Counts.Errors != 1 || !strings.HasPrefix(got.Error, "links/host1/data/ks/t/a.db: ") {
+		t.Errorf("termination log = %s, want the first object error", data)
+	}
+}
+
+func TestTerminationSummaryTruncated(t *testing.T) {
+	s := terminationSummary{
+		Status:   statusFailed,
+		ExitCode: 1,
+		Counts:   &terminationCounts{Errors: 12000},
+		Error:    "failed to list objects: " + strings.Repeat("é\"<", 3000),
+	}
+	data, err := s.encode(terminationLogLimit)
+	if err != nil {
+		t.Fatalf("encode() error = %v", err)
+	}
+	if len(data) > terminationLogLimit {
+		t.Errorf("encode() = %d bytes, want at most %d", len(data), terminationLogLimit)
+	}
+	var got terminationSummary
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("encode() = %q, not JSON: %v", data, err)
+	}
+	if !utf8.ValidString(got.Error) || !strings.HasPrefix(got.Error, "failed to list objects: é") || !strings.HasSuffix(got.Error, "…") {
+		t.Errorf("truncated error = %q", got.Error)
+	}
+	if got.Counts == nil || got.Counts.Errors != 12000 {
+		t.Errorf("truncated summary lost its counts: %s", data)
+	}
+}
+
+func TestDefaultTerminationLog(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.96.0.1")
+	if got := defaultTerminationLog(); got != kubernetesTerminationLog {
+		t.Errorf("defaultTerminationLog() = %q in Kubernetes, want %q", got, kubernetesTerminationLog)
+	}
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if got := defaultTerminationLog(); got != "" {
+		t.Errorf("defaultTerminationLog() = %q outside Kubernetes, want none", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// tlsVersions are the values -tls-min-version accepts
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a -tls-min-version value, 0 for the SDK default
+func parseTLSVersion(value string) (uint16, error) {
+	if value == "" {
+		return 0, nil
+	}
+	version, ok := tlsVersions[value]
+	if !ok {
+		return 0, fmt.Errorf("invalid -tls-min-version %q: must be 1.2 or 1.3", value)
+	}
+	return version, nil
+}
+
+// loadCABundle returns the system's trusted certificates plus those of the
+// PEM file at path, which must hold at least one certificate and nothing else
+func loadCABundle(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -ca-bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	certs := 0
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			if len(bytes.TrimSpace(rest)) > 0 {
+				return nil, fmt.Errorf("failed to parse -ca-bundle %s: data after certificate %d isn't PEM", path, certs)
+			}
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("failed to parse -ca-bundle %s: block %d is a %s, not a CERTIFICATE", path, certs+1, block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse -ca-bundle %s: certificate %d: %w", path, certs+1, err)
+		}
+		pool.AddCert(cert)
+		certs++
+	}
+	if certs == 0 {
+		return nil, fmt.Errorf("failed to parse -ca-bundle %s: no PEM certificate found", path)
+	}
+	return pool, nil
+}
+
+// newAWSHTTPClient returns the HTTP client of the AWS SDK clients for the
+// -ca-bundle, -tls-min-version, -proxy-url and -no-proxy flags, nil for the
+// SDK's default one
+func newAWSHTTPClient(c commonOptions) (*awshttp.BuildableClient, error) {
+	if c.caBundle == "" && c.tlsMinVersion == "" && c.proxyURL == "" {
+		return nil, nil
+	}
+	version, err := parseTLSVersion(c.tlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	var pool *x509.CertPool
+	if c.caBundle != "" {
+		if pool, err = loadCABundle(c.caBundle); err != nil {
+			return nil, err
+		}
+	}
+	return awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		if pool != nil {
+			tr.TLSClientConfig.RootCAs = pool
+		}
+		if version != 0 {
+			tr.TLSClientConfig.MinVersion = version
+		}
+		if c.proxyURL != "" {
+			tr.Proxy = proxyFunc(c.proxyURL, c.noProxy)
+			tr.OnProxyConnectResponse = proxyConnectError
+		}
+	}), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+// writeCABundle writes the PEM blocks to a file of the test, returning its
+// path
+func writeCABundle(t *testing.T, blocks ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, []byte(strings.Join(blocks, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// certPEM returns the PEM encoding of cert
+func certPEM(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+func TestLoadCABundle(t *testing.T) {
+	first := httptest.NewTLSServer(http.NotFoundHandler())
+	defer first.Close()
+	second := httptest.NewTLSServer(http.NotFoundHandler())
+	defer second.Close()
+
+	tests := []struct {
+		name    string
+		blocks  []string
+		wantErr string
+	}{
+		{name: "one certificate", blocks: []string{certPEM(first.Certificate())}},
+		{name: "several certificates", blocks: []string{certPEM(first.Certificate()), certPEM(second.Certificate())}},
+		{name: "empty", wantErr: "no PEM certificate found"},
+		{name: "not PEM", blocks: []string{"not a certificate"}, wantErr: "data after certificate 0 isn't PEM"},
+		{name: "trailing garbage", blocks: []string{certPEM(first.Certificate()), "garbage"}, wantErr: "data after certificate 1 isn't PEM"},
+		{
+			name:    "private key",
+			blocks:  []string{string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("secret")}))},
+			wantErr: "block 1 is a PRIVATE KEY",
+		},
+		{
+			name:    "corrupt certificate",
+			blocks:  []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("corrupt")}))},
+			wantErr: "certificate 1:",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := loadCABundle(writeCABundle(t, tt.blocks...))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadCABundle() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadCABundle() error = %v", err)
+			}
+			for _, srv := range []*httptest.Server{first, second}[:len(tt.blocks)] {
+				if _, err := srv.Certificate().Verify(x509.VerifyOptions{Roots: pool}); err != nil {
+					t.Errorf("certificate of %s not trusted: %v", srv.URL, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewS3ClientTransport(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		opts        commonOptions
+		wantMin     uint16
+		wantTrusted bool
+	}{
+		{name: "defaults"},
+		{name: "ca bundle", opts: commonOptions{caBundle: writeCABundle(t, certPEM(srv.Certificate()))}, wantTrusted: true},
+		{name: "tls min version", opts: commonOptions{tlsMinVersion: "1.3"}, wantMin: tls.VersionTLS13},
+		{
+			name:        "both",
+			opts:        commonOptions{caBundle: writeCABundle(t, certPEM(srv.Certificate())), tlsMinVersion: "1.2"},
+			wantMin:     tls.VersionTLS12,
+			wantTrusted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.region = "eu-west-1"
+			client, err := newS3Client(context.Background(), tt.opts)
+			if err != nil {
+				t.Fatalf("newS3Client() error = %v", err)
+			}
+			httpClient, ok := client.Options().HTTPClient.(*awshttp.BuildableClient)
+			if !ok {
+				t.Fatalf("HTTPClient = %T, want a *BuildableClient", client.Options().HTTPClient)
+			}
+			tlsConfig := httpClient.GetTransport().TLSClientConfig
+			if tt.wantMin != 0 && (tlsConfig == nil || tlsConfig.MinVersion != tt.wantMin) {
+				t.Fatalf("TLS config = %+v, want MinVersion %x", tlsConfig, tt.wantMin)
+			}
+			resp, err := httpClient.Do(httptestRequest(t, srv.URL))
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.wantTrusted {
+				t.Errorf("request to the -ca-bundle signed server error = %v, want trusted: %v", err, tt.wantTrusted)
+			}
+		})
+	}
+}
+
+// httptestRequest returns a GET request to url
+func httptestRequest(t *testing.T, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the spans' instrumentation scope and the traced service
+const tracerName = "medusa-retention-refresher"
+
+// tracer returns the tracer of the global provider, which is a no-op unless
+// setupTracing or a test installed one
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// otlpTracesPath is the collector path spans are sent to when -otel-endpoint
+// has none
+const otlpTracesPath = "/v1/traces"
+
+// setupTracing exports spans to the OTLP/HTTP collector at endpoint, e.g.
+// http://localhost:4318, and returns a func flushing the spans left when the
+// command ends. Without an endpoint spans aren't recorded.
+func setupTracing(ctx context.Context, endpoint string) (func(), error) {
+	if endpoint == "" {
+		return func() {}, nil
+	}
+	if u, err := url.Parse(endpoint); err == nil && strings.Trim(u.Path, "/") == "" {
+		u.Path = otlpTracesPath
+		endpoint = u.String()
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", tracerName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return func() {
+		// The spans are flushed even when the run was interrupted
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), pushTimeout)
+		defer cancel()
+		if err := provider.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Failed to export traces", errorAttrs(err)...)
+		}
+	}, nil
+}
+
+// endSpan records err, when not nil, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("error.type", errorClass(err)))
+	}
+	span.End()
+}
+
+// noopSpan is the span of objects and calls left out of traces
+var noopSpan = trace.SpanFromContext(context.Background())
+
+// untracedKey marks the context of an object -otel-object-sample-rate left
+// out, whose S3 calls get no spans
+type untracedKey struct{}
+
+// objectSampled reports whether key is traced at the -otel-object-sample-rate.
+// The choice hashes the key, so every call made for an object agrees.
+func (r *refresher) objectSampled(key string) bool {
+	rate := r.opts.otelSampleRate
+	if rate <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return float64(h.Sum64()) < rate*math.MaxUint64
+}
+
+// objectContext returns ctx for the S3 calls made for key, which aren't
+// traced when the object isn't sampled
+func (r *refresher) objectContext(ctx context.Context, key string) context.Context {
+	if r.objectSampled(key) {
+		return ctx
+	}
+	return context.WithValue(ctx, untracedKey{}, true)
+}
+
+// startObjectSpan starts the span of processing key when the object is
+// sampled. Otherwise the returned span is a no-op and the returned context
+// stops the object's S3 calls from being traced.
+func (r *refresher) startObjectSpan(ctx context.Context, manifest, key string) (context.Context, trace.Span) {
+	if !r.objectSampled(key) {
+		return context.WithValue(trace.ContextWithSpan(ctx, noopSpan), untracedKey{}, true), noopSpan
+	}
+	return tracer().Start(ctx, "object", trace.WithAttributes(
+		attribute.String("manifest", manifest),
+		attribute.String("aws.s3.key", key),
+	))
+}
+
+// tracingS3 wraps an S3API with a span around each call, carrying the bucket,
+// key, size and error of the request
+type tracingS3 struct {
+	S3API
+}
+
+// traceS3 instruments client, unless it already is
+func traceS3(client S3API) S3API {
+	if _, ok := client.(tracingS3); ok {
+		return client
+	}
+	return tracingS3{client}
+}
+
+// startS3Span starts the span of an S3 operation on key, nil for listings.
+// Calls made for an object left out of the sample get a no-op span.
+func startS3Span(ctx context.Context, op string, bucket, key *string) (context.Context, trace.Span) {
+	if ctx.Value(untracedKey{}) != nil {
+		return ctx, noopSpan
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "S3"),
+		attribute.String("rpc.method", op),
+		attribute.String("aws.s3.bucket", aws.ToString(bucket)),
+	}
+	if key != nil {
+		attrs = append(attrs, attribute.String("aws.s3.key", aws.ToString(key)))
+	}
+	return tracer().Start(ctx, "S3."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// setBytes records the object size a response reported
+func setBytes(span trace.Span, size *int64) {
+	if size != nil {
+		span.SetAttributes(attribute.Int64("aws.s3.bytes", *size))
+	}
+}
+
+func (c tracingS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	ctx, span := startS3Span(ctx, "GetObject", params.Bucket, params.Key)
+	out, err := c.S3API.GetObject(ctx, params, optFns...)
+	if err == nil {
+		setBytes(span, out.ContentLength)
+	}
+	endSpan(span, err)
+	return out, err
+}
+
+func (c tracingS3) GetObjectRetention(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error) {
+	ctx, span := startS3Span(ctx, "GetObjectRetention", params.Bucket, params.Key)
+	out, err := c.S3API.GetObjectRetention(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c tracingS3) PutObjectRetention(ctx context.Context, params *s3.PutObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.PutObjectRetentionOutput, error) {
+	ctx, span := startS3Span(ctx, "PutObjectRetention", params.Bucket, params.Key)
+	out, err := c.S3API.PutObjectRetention(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c tracingS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	ctx, span := startS3Span(ctx, "ListObjectsV2", params.Bucket, nil)
+	span.SetAttributes(attribute.String("aws.s3.prefix", aws.ToString(params.Prefix)))
+	out, err := c.S3API.ListObjectsV2(ctx, params, optFns...)
+	if err == nil {
+		var size int64
+		for _, obj := range out.Contents {
+			size += aws.ToInt64(obj.Size)
+		}
+		span.SetAttributes(attribute.Int("aws.s3.objects", len(out.Contents)), attribute.Int64("aws.s3.bytes", size))
+	}
+	endSpan(span, err)
+	return out, err
+}
+
+func (c tracingS3) GetObjectLegalHold(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error) {
+	ctx, span := startS3Span(ctx, "GetObjectLegalHold", params.Bucket, params.Key)
+	out, err := c.S3API.GetObjectLegalHold(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c tracingS3) PutObjectLegalHold(ctx context.Context, params *s3.PutObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.PutObjectLegalHoldOutput, error) {
+	ctx, span := startS3Span(ctx, "PutObjectLegalHold", params.Bucket, params.Key)
+	out, err := c.S3API.PutObjectLegalHold(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c tracingS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	ctx, span := startS3Span(ctx, "HeadObject", params.Bucket, params.Key)
+	out, err := c.S3API.HeadObject(ctx, params, optFns...)
+	if err == nil {
+		setBytes(span, out.ContentLength)
+	}
+	endSpan(span, err)
+	return out, err
+}
+
+func (c tracingS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	ctx, span := startS3Span(ctx, "PutObject", params.Bucket, params.Key)
+	out, err := c.S3API.PutObject(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c tracingS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	ctx, span := startS3Span(ctx, "GetObjectTagging", params.Bucket, params.Key)
+	out, err := c.S3API.GetObjectTagging(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c tracingS3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	ctx, span := startS3Span(ctx, "PutObjectTagging", params.Bucket, params.Key)
+	out, err := c.S3API.PutObjectTagging(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordSpans installs a tracer provider recording the test's spans in memory
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	return exporter
+}
+
+// spanAttr returns the value of a span attribute, "" when it isn't set
+func spanAttr(span tracetest.SpanStub, key string) string {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+// spanTree indexes recorded spans by name and by parent
+type spanTree struct {
+	spans    tracetest.SpanStubs
+	children map[string][]tracetest.SpanStub // by parent span ID
+}
+
+func newSpanTree(spans tracetest.SpanStubs) *spanTree {
+	tree := &spanTree{spans: spans, children: make(map[string][]tracetest.SpanStub)}
+	for _, span := range spans {
+		if span.Parent.IsValid() {
+			id := span.Parent.SpanID().String()
+			tree.children[id] = append(tree.children[id], span)
+		}
+	}
+	return tree
+}
+
+// named returns the spans called name
+func (tree *spanTree) named(name string) []tracetest.SpanStub {
+	var spans []tracetest.SpanStub
+	for _, span := range tree.spans {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// child returns the child span of parent called name with the given key
+// attribute, if any
+func (tree *spanTree) child(parent tracetest.SpanStub, name, key string) (tracetest.SpanStub, bool) {
+	for _, span := range tree.children[parent.SpanContext.SpanID().String()] {
+		if span.Name == name && (key == "" || spanAttr(span, "aws.s3.key") == key) {
+			return span, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func TestRunTracing(t *testing.T) {
+	exporter := recordSpans(t)
+	bucket := newFakeBucket()
+	manifestKey := "links/host1/b1/meta/manifest.json"
+	bucket.objects[manifestKey] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/gone.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = "data"
+	bucket.retention["links/host1/data/ks/t/a.db"] = time.Now().Add(24 * time.Hour)
+
+	opts := testOptions()
+	opts.otelSampleRate = 1
+	if err := newRefresher(bucket.client(), opts, time.Now()).run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	tree := newSpanTree(exporter.GetSpans())
+
+	runs := tree.named("run")
+	if len(runs) != 1 || runs[0].Parent.IsValid() {
+		t.Fatalf("got %d run spans, want a single root", len(runs))
+	}
+	run := runs[0]
+	if spanAttr(run, "cluster") != "links" || spanAttr(run, "aws.s3.bucket") != "test-bucket" {
+		t.Errorf("run span attributes = %v", run.Attributes)
+	}
+	if list, ok := tree.child(run, "S3.ListObjectsV2", ""); !ok || spanAttr(list, "aws.s3.bytes") == "" {
+		t.Errorf("run span has no discovery listing with its size: %+v", list.Attributes)
+	}
+
+	manifest, ok := tree.child(run, "manifest", "")
+	if !ok || spanAttr(manifest, "manifest") != manifestKey || spanAttr(manifest, "objects") != "2" {
+		t.Fatalf("run span has no manifest span: %+v", manifest.Attributes)
+	}
+	if _, ok := tree.child(manifest, "S3.GetObject", manifestKey); !ok {
+		t.Errorf("manifest span has no download of the manifest")
+	}
+
+	tests := []struct {
+		key        string
+		action     string
+		wantS3     []string
+		failedCall string
+	}{
+		{key: "links/host1/data/ks/t/a.db", action: string(actionUpdated), wantS3: []string{"S3.GetObjectRetention", "S3.PutObjectRetention"}},
+		{key: "links/host1/data/ks/t/gone.db", action: string(actionMissing), failedCall: "S3.GetObjectRetention"},
+	}
+	for _, tt := range tests {
+		object, ok := tree.child(manifest, "object", tt.key)
+		if !ok {
+			t.Errorf("manifest span has no object span of %s", tt.key)
+			continue
+		}
+		if spanAttr(object, "action") != tt.action || spanAttr(object, "manifest") != manifestKey {
+			t.Errorf("object span of %s attributes = %v, want action %s", tt.key, object.Attributes, tt.action)
+		}
+		for _, name := range tt.wantS3 {
+			call, ok := tree.child(object, name, tt.key)
+			if !ok {
+				t.Errorf("object span of %s has no %s span", tt.key, name)
+				continue
+			}
+			if spanAttr(call, "aws.s3.bucket") != "test-bucket" || call.Status.Code == codes.Error {
+				t.Errorf("%s span of %s = %v, %v", name, tt.key, call.Attributes, call.Status)
+			}
+		}
+		if tt.failedCall != "" {
+			call, ok := tree.child(object, tt.failedCall, tt.key)
+			if !ok || call.Status.Code != codes.Error || spanAttr(call, "error.type") == "" || len(call.Events) == 0 {
+				t.Errorf("%s span of %s = %v, %v, want the recorded error", tt.failedCall, tt.key, call.Attributes, call.Status)
+			}
+		}
+	}
+}
+
+func TestRunTracingFailure(t *testing.T) {
+	exporter := recordSpans(t)
+	bucket := newFakeBucket()
+	// A pin matching no backup fails the run
+	bucket.objects["ops/pins.txt"] = "links/host9/backup1\n"
+	opts := testOptions()
+	opts.pinsFile = "s3://test-bucket/ops/pins.txt"
+	if err := newRefresher(bucket.client(), opts, time.Now()).run(context.Background()); err == nil {
+		t.Fatal("run() succeeded, want the unmatched pin failure")
+	}
+	runs := newSpanTree(exporter.GetSpans()).named("run")
+	if len(runs) != 1 || runs[0].Status.Code != codes.Error || spanAttr(runs[0], "error.type") == "" {
+		t.Errorf("run spans = %+v, want the failed run", runs)
+	}
+}
+
+func TestUnsampledObjectsAreNotTraced(t *testing.T) {
+	exporter := recordSpans(t)
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = "data"
+
+	opts := testOptions()
+	opts.verifySize = true
+	if err := newRefresher(bucket.client(), opts, time.Now()).run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	tree := newSpanTree(exporter.GetSpans())
+	if len(tree.named("run")) != 1 || len(tree.named("manifest")) != 1 {
+		t.Errorf("recorded %d spans, want the run and manifest spans", len(tree.spans))
+	}
+	if objects := tree.named("object"); len(objects) != 0 {
+		t.Errorf("recorded %d object spans at sample rate 0", len(objects))
+	}
+	for _, span := range tree.spans {
+		if spanAttr(span, "aws.s3.key") == "links/host1/data/ks/t/a.db" {
+			t.Errorf("recorded %s span of an unsampled object", span.Name)
+		}
+	}
+}
+
+func TestObjectSampled(t *testing.T) {
+	for _, tt := range []struct {
+		rate     float64
+		min, max int
+	}{
+		{rate: 0, min: 0, max: 0},
+		{rate: 0.1, min: 50, max: 150},
+		{rate: 0.5, min: 400, max: 600},
+		{rate: 1, min: 1000, max: 1000},
+	} {
+		opts := testOptions()
+		opts.otelSampleRate = tt.rate
+		r := newRefresher(newFakeBucket().client(), opts, time.Now())
+		sampled := 0
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("links/host1/data/ks/t/nb-%d-big-Data.db", i)
+			if r.objectSampled(key) {
+				sampled++
+			}
+			if r.objectSampled(key) != r.objectSampled(key) {
+				t.Fatalf("sampling of %s isn't stable", key)
+			}
+		}
+		if sampled < tt.min || sampled > tt.max {
+			t.Errorf("rate %v sampled %d of 1000 objects, want %d to %d", tt.rate, sampled, tt.min, tt.max)
+		}
+	}
+}
+
+func TestTraceS3(t *testing.T) {
+	client := traceS3(newFakeBucket().client())
+	if traceS3(client) != client {
+		t.Error("traceS3() wrapped an instrumented client again")
+	}
+}
+
+func TestSetupTracingExports(t *testing.T) {
+	paths := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case paths <- req.URL.Path:
+		default:
+		}
+	}))
+	defer collector.Close()
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	shutdown, err := setupTracing(context.Background(), collector.URL)
+	if err != nil {
+		t.Fatalf("setupTracing() error = %v", err)
+	}
+	_, span := tracer().Start(context.Background(), "run")
+	span.End()
+	shutdown()
+	select {
+	case path := <-paths:
+		if path != otlpTracesPath {
+			t.Errorf("spans sent to %s, want %s", path, otlpTracesPath)
+		}
+	default:
+		t.Error("no spans sent to the collector")
+	}
+}
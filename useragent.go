@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// userAgentProduct names the tool in the User-Agent of its AWS requests, so
+// CloudTrail can be filtered for them
+const userAgentProduct = "medusa-retention-refresher"
+
+// version is the release version, set by the release build with
+// -ldflags "-X main.version=..."
+var version string
+
+// buildVersion returns the version of the binary: the release version, else
+// the module version or VCS revision it was built from, else "dev"
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+			return setting.Value[:12]
+		}
+	}
+	return "dev"
+}
+
+// runIDKey is the context key of the ID of the run making a request
+type runIDKey struct{}
+
+// withRunID returns ctx carrying runID, which the User-Agent of the AWS
+// requests made with it includes
+func withRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+// validateUserAgentExtra checks the -user-agent-extra tokens, which must be
+// printable ASCII
+func validateUserAgentExtra(extra string) error {
+	for _, r := range extra {
+		if r < ' ' || r > '~' {
+			return fmt.Errorf("invalid -user-agent-extra %q: only printable ASCII is allowed", extra)
+		}
+	}
+	return nil
+}
+
+// userAgentSuffix returns what the User-Agent of a request made with ctx
+// ends with: the tool and its version, the run ID when known, then extra
+func userAgentSuffix(ctx context.Context, extra string) string {
+	tokens := []string{userAgentProduct + "/" + buildVersion()}
+	if runID, ok := ctx.Value(runIDKey{}).(string); ok && runID != "" {
+		tokens = append(tokens, "run/"+runID)
+	}
+	tokens = append(tokens, strings.Fields(extra)...)
+	return strings.Join(tokens, " ")
+}
+
+// addUserAgent returns the API option appending userAgentSuffix with the
+// -user-agent-extra tokens to the User-Agent the SDK builds
+func addUserAgent(extra string) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Build.Add(middleware.BuildMiddlewareFunc("MedusaRetentionRefresherUserAgent", func(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (middleware.BuildOutput, middleware.Metadata, error) {
+			if req, ok := in.Request.(*smithyhttp.Request); ok {
+				suffix := userAgentSuffix(ctx, extra)
+				if current := req.Header.Get("User-Agent"); current != "" {
+					suffix = current + " " + suffix
+				}
+				req.Header.Set("User-Agent", suffix)
+			}
+			return next.HandleBuild(ctx, in)
+		}), middleware.After)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// recordingHTTPClient answers every request with an empty 200, recording
+// their User-Agent
+type recordingHTTPClient struct {
+	mu         sync.Mutex
+	userAgents []string
+}
+
+func (c *recordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.userAgents = append(c.userAgents, req.Header.Get("User-Agent"))
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestUserAgent(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	previous := version
+	version = "1.4.0"
+	t.Cleanup(func() { version = previous })
+
+	tests := []struct {
+		name       string
+		runID      string
+		extra      string
+		wantSuffix string
+	}{
+		{name: "without run", wantSuffix: " medusa-retention-refresher/1.4.0"},
+		{name: "run", runID: "5f0c2a9e41d7b836", wantSuffix: " medusa-retention-refresher/1.4.0 run/5f0c2a9e41d7b836"},
+		{name: "extra tokens", runID: "5f0c2a9e41d7b836", extra: " team/storage  ticket/OPS-42", wantSuffix: " medusa-retention-refresher/1.4.0 run/5f0c2a9e41d7b836 team/storage ticket/OPS-42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadAWSConfig(context.Background(), commonOptions{region: "eu-west-1", userAgentExtra: tt.extra})
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder := &recordingHTTPClient{}
+			client := s3.NewFromConfig(cfg, func(o *s3.Options) { o.HTTPClient = recorder })
+			ctx := context.Background()
+			if tt.runID != "" {
+				ctx = withRunID(ctx, tt.runID)
+			}
+			_, err = client.PutObjectRetention(ctx, &s3.PutObjectRetentionInput{Bucket: aws.String("my-backups"), Key: aws.String("prod/host1/data/ks/t/a.db")})
+			if err != nil {
+				t.Fatalf("PutObjectRetention() error = %v", err)
+			}
+			if len(recorder.userAgents) != 1 {
+				t.Fatalf("%d requests sent, want 1", len(recorder.userAgents))
+			}
+			ua := recorder.userAgents[0]
+			if !strings.HasPrefix(ua, "aws-sdk-go-v2/") || !strings.HasSuffix(ua, tt.wantSuffix) {
+				t.Errorf("User-Agent = %q, want the SDK's ending with %q", ua, tt.wantSuffix)
+			}
+		})
+	}
+}
+
+func TestRunCarriesRunID(t *testing.T) {
+	var got []string
+	client := newFakeBucket().client()
+	list := client.ListObjectsV2Func
+	client.ListObjectsV2Func = func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+		runID, _ := ctx.Value(runIDKey{}).(string)
+		got = append(got, runID)
+		return list(ctx, params, optFns...)
+	}
+	r := newRefresher(client, testOptions(), time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 || got[0] != r.runID {
+		t.Errorf("listing made with run ID %q, want %q", got, r.runID)
+	}
+}
+
+func TestBuildVersion(t *testing.T) {
+	previous := version
+	t.Cleanup(func() { version = previous })
+	version = "1.4.0"
+	if got := buildVersion(); got != "1.4.0" {
+		t.Errorf("buildVersion() = %q, want the release version", got)
+	}
+	version = ""
+	if got := buildVersion(); got == "" || strings.ContainsAny(got, " /") {
+		t.Errorf("buildVersion() = %q, want a build info version", got)
+	}
+}
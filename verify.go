@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+)
+
+// sizeMismatched reports whether -verify-size found that key's size differs
+// from the size recorded in its manifest, logging the mismatch as a backup
+// integrity warning. Objects the manifest records no size for, and objects
+// whose size can't be looked up, are counted as unverified and not mismatched.
+// Missing objects are left to the retention check to report.
+func (r *refresher) sizeMismatched(ctx context.Context, manifest, key string, want int64) bool {
+	if !r.opts.verifySize {
+		return false
+	}
+	if want <= 0 {
+		slog.Debug("Manifest records no size, not verifying object", "manifest", manifest, "key", key)
+		r.stats.sizeUnverified()
+		return false
+	}
+	info, ok, err := r.lookupObject(ctx, key, true)
+	if err != nil {
+		slog.Warn("Could not look up object size", append([]any{"manifest", manifest, "key", key}, errorAttrs(err)...)...)
+		r.stats.sizeUnverified()
+		return false
+	}
+	if !ok || info.Size == want {
+		return false
+	}
+	slog.Warn("Backup integrity: object size doesn't match manifest", "manifest", manifest, "key", key, "manifest_size", want, "actual_size", info.Size)
+	r.stats.sizeMismatch(manifest)
+	return true
+}
+
+// manifestMD5 normalizes the MD5 a manifest records to lower-case hex.
+// Medusa writes hex digests, but base64 ones are accepted as well.
+func manifestMD5(md5 string) (string, bool) {
+	if len(md5) == 32 {
+		if _, err := hex.DecodeString(md5); err == nil {
+			return strings.ToLower(md5), true
+		}
+	}
+	if sum, err := base64.StdEncoding.DecodeString(md5); err == nil && len(sum) == 16 {
+		return hex.EncodeToString(sum), true
+	}
+	return "", false
+}
+
+// etagMD5 returns the MD5 an ETag holds. The ETags of multipart uploads,
+// suffixed with -<parts>, are not an MD5 of the object and can't be compared.
+func etagMD5(etag string) (string, bool) {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 32 || strings.Contains(etag, "-") {
+		return "", false
+	}
+	return strings.ToLower(etag), true
+}
+
+// md5Mismatched reports whether -verify-md5 found that key's ETag differs
+// from the MD5 recorded in its manifest, logging the mismatch as a backup
+// integrity warning. Objects that can't be compared, such as multipart
+// uploads, are counted as unverifiable and not mismatched.
+func (r *refresher) md5Mismatched(ctx context.Context, manifest, key, md5 string) bool {
+	if !r.opts.verifyMD5 {
+		return false
+	}
+	want, ok := manifestMD5(md5)
+	if !ok {
+		slog.Debug("Manifest records no usable MD5, not verifying object", "manifest", manifest, "key", key)
+		r.stats.md5Unverified()
+		return false
+	}
+	info, ok, err := r.lookupObject(ctx, key, true)
+	if err != nil {
+		slog.Warn("Could not look up object ETag", append([]any{"manifest", manifest, "key", key}, errorAttrs(err)...)...)
+		r.stats.md5Unverified()
+		return false
+	}
+	if !ok {
+		return false
+	}
+	got, ok := etagMD5(info.ETag)
+	if !ok {
+		slog.Debug("ETag is not an MD5, not verifying object", "manifest", manifest, "key", key, "etag", info.ETag)
+		r.stats.md5Unverified()
+		return false
+	}
+	if got == want {
+		return false
+	}
+	slog.Warn("Backup integrity: object ETag doesn't match manifest MD5", "manifest", manifest, "key", key, "manifest_md5", want, "etag", info.ETag)
+	r.stats.md5Mismatch(manifest)
+	return true
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunVerifySize(t *testing.T) {
+	const manifest = "links/host1/b1/meta/manifest.json"
+
+	tests := []struct {
+		name             string
+		skipMismatched   bool
+		manifestKey      bool // look objects up with HeadObject instead of the discovery listing
+		wantUpdated      []string
+		wantMismatches   map[string]int
+		wantUnverified   int
+		wantSkippedCount int
+	}{
+		{
+			name:           "mismatch warned and still refreshed",
+			wantUpdated:    []string{"links/host1/data/ks/t/match.db", "links/host1/data/ks/t/mismatch.db", "links/host1/data/ks/t/nosize.db"},
+			wantMismatches: map[string]int{manifest: 1},
+			wantUnverified: 1,
+		},
+		{
+			name:             "skip-mismatched",
+			skipMismatched:   true,
+			wantUpdated:      []string{"links/host1/data/ks/t/match.db", "links/host1/data/ks/t/nosize.db"},
+			wantMismatches:   map[string]int{manifest: 1},
+			wantUnverified:   1,
+			wantSkippedCount: 1,
+		},
+		{
+			name:             "sizes from HeadObject",
+			skipMismatched:   true,
+			manifestKey:      true,
+			wantUpdated:      []string{"links/host1/data/ks/t/match.db", "links/host1/data/ks/t/nosize.db"},
+			wantMismatches:   map[string]int{manifest: 1},
+			wantUnverified:   1,
+			wantSkippedCount: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects[manifest] = `[{"keyspace":"ks","columnfamily":"t","objects":[` +
+				`{"path":"data/ks/t/match.db","size":5},` +
+				`{"path":"data/ks/t/mismatch.db","size":500},` +
+				`{"path":"data/ks/t/nosize.db"}]}]`
+			bucket.objects["links/host1/data/ks/t/match.db"] = "12345"
+			bucket.objects["links/host1/data/ks/t/mismatch.db"] = "12345"
+			bucket.objects["links/host1/data/ks/t/nosize.db"] = "12345"
+
+			opts := testOptions()
+			opts.verifySize = true
+			opts.skipMismatched = tt.skipMismatched
+			if tt.manifestKey {
+				opts.manifestKey = manifest
+			}
+			r := newRefresher(bucket.client(), opts, time.Now())
+			if err := r.run(context.Background()); err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			if got := bucket.putKeys(); !reflect.DeepEqual(got, tt.wantUpdated) {
+				t.Errorf("run() updated %v, want %v", got, tt.wantUpdated)
+			}
+			sum := r.stats.summary(time.Now())
+			if !reflect.DeepEqual(sum.SizeMismatchManifests, tt.wantMismatches) || sum.SizeMismatches != 1 {
+				t.Errorf("summary size_mismatches = %d, by manifest %v, want 1, %v", sum.SizeMismatches, sum.SizeMismatchManifests, tt.wantMismatches)
+			}
+			if sum.SizeUnverified != tt.wantUnverified {
+				t.Errorf("summary size_unverified = %d, want %d", sum.SizeUnverified, tt.wantUnverified)
+			}
+			if sum.SkippedMismatched != tt.wantSkippedCount {
+				t.Errorf("summary skipped_mismatched = %d, want %d", sum.SkippedMismatched, tt.wantSkippedCount)
+			}
+			if !tt.manifestKey && bucket.headCalls != 0 {
+				t.Errorf("run() made %d HeadObject calls, want sizes from the listing", bucket.headCalls)
+			}
+		})
+	}
+}
+
+func TestManifestMD5(t *testing.T) {
+	tests := []struct {
+		md5    string
+		want   string
+		wantOK bool
+	}{
+		{md5: "5d05c4c7ecafccdf1b4f1d06c4c3032e", want: "5d05c4c7ecafccdf1b4f1d06c4c3032e", wantOK: true},
+		{md5: "5D05C4C7ECAFCCDF1B4F1D06C4C3032E", want: "5d05c4c7ecafccdf1b4f1d06c4c3032e", wantOK: true},
+		{md5: "XQXEx+yvzN8bTx0GxMMDLg==", want: "5d05c4c7ecafccdf1b4f1d06c4c3032e", wantOK: true},
+		{md5: ""},
+		{md5: "not-an-md5"},
+	}
+
+	for _, tt := range tests {
+		got, ok := manifestMD5(tt.md5)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("manifestMD5(%q) = %q, %v, want %q, %v", tt.md5, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestEtagMD5(t *testing.T) {
+	tests := []struct {
+		etag   string
+		want   string
+		wantOK bool
+	}{
+		{etag: `"5d05c4c7ecafccdf1b4f1d06c4c3032e"`, want: "5d05c4c7ecafccdf1b4f1d06c4c3032e", wantOK: true},
+		{etag: "5d05c4c7ecafccdf1b4f1d06c4c3032e", want: "5d05c4c7ecafccdf1b4f1d06c4c3032e", wantOK: true},
+		{etag: `"d41d8cd98f00b204e9800998ecf8427e-12"`},
+		{etag: ""},
+	}
+
+	for _, tt := range tests {
+		got, ok := etagMD5(tt.etag)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("etagMD5(%q) = %q, %v, want %q, %v", tt.etag, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestRunVerifyMD5(t *testing.T) {
+	const manifest = "links/host1/b1/meta/manifest.json"
+	// 827ccb0eea8a706c4c34a16891f84e7b is the MD5 of "12345"
+	manifestBody := `[{"keyspace":"ks","columnfamily":"t","objects":[` +
+		`{"path":"data/ks/t/match.db","MD5":"827ccb0eea8a706c4c34a16891f84e7b"},` +
+		`{"path":"data/ks/t/mismatch.db","MD5":"5d05c4c7ecafccdf1b4f1d06c4c3032e"},` +
+		`{"path":"data/ks/t/multipart.db","MD5":"5d05c4c7ecafccdf1b4f1d06c4c3032e"},` +
+		`{"path":"data/ks/t/nomd5.db"}]}]`
+
+	tests := []struct {
+		name           string
+		skipMismatched bool
+		strict         bool
+		wantUpdated    []string
+		wantErr        bool
+	}{
+		{
+			name:        "mismatch warned and still refreshed",
+			wantUpdated: []string{"links/host1/data/ks/t/match.db", "links/host1/data/ks/t/mismatch.db", "links/host1/data/ks/t/multipart.db", "links/host1/data/ks/t/nomd5.db"},
+		},
+		{
+			name:           "skip-mismatched",
+			skipMismatched: true,
+			wantUpdated:    []string{"links/host1/data/ks/t/match.db", "links/host1/data/ks/t/multipart.db", "links/host1/data/ks/t/nomd5.db"},
+		},
+		{
+			name:        "strict-md5",
+			strict:      true,
+			wantUpdated: []string{"links/host1/data/ks/t/match.db", "links/host1/data/ks/t/mismatch.db", "links/host1/data/ks/t/multipart.db", "links/host1/data/ks/t/nomd5.db"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newFakeBucket()
+			bucket.objects[manifest] = manifestBody
+			for _, name := range []string{"match", "mismatch", "multipart", "nomd5"} {
+				bucket.objects["links/host1/data/ks/t/"+name+".db"] = "12345"
+			}
+			bucket.etags["links/host1/data/ks/t/multipart.db"] = `"d41d8cd98f00b204e9800998ecf8427e-3"`
+
+			opts := testOptions()
+			opts.verifyMD5 = true
+			opts.skipMismatched = tt.skipMismatched
+			opts.strictMD5 = tt.strict
+			r := newRefresher(bucket.client(), opts, time.Now())
+			err := r.run(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got := bucket.putKeys(); !reflect.DeepEqual(got, tt.wantUpdated) {
+				t.Errorf("run() updated %v, want %v", got, tt.wantUpdated)
+			}
+			sum := r.stats.summary(time.Now())
+			if sum.MD5Mismatches != 1 || sum.MD5MismatchManifests[manifest] != 1 {
+				t.Errorf("summary md5_mismatches = %d, by manifest %v, want 1 for %s", sum.MD5Mismatches, sum.MD5MismatchManifests, manifest)
+			}
+			// The multipart upload and the object without an MD5
+			if sum.MD5Unverifiable != 2 {
+				t.Errorf("summary md5_unverifiable = %d, want 2", sum.MD5Unverifiable)
+			}
+		})
+	}
+}
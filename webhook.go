@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// webhookAttempts is how many times a webhook is posted to before giving up
+// on 5xx responses and network errors
+const webhookAttempts = 4
+
+// webhookBackoff is the wait before the second attempt, doubled before each
+// following one
+var webhookBackoff = time.Second
+
+// repeatedString is a flag.Value collecting each value of repeated flags as
+// is, for values that may contain commas
+type repeatedString []string
+
+func (l *repeatedString) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *repeatedString) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseWebhookHeaders parses -webhook-header entries of the form name=value
+func parseWebhookHeaders(entries []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, entry := range entries {
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t:") {
+			return nil, fmt.Errorf("invalid -webhook-header %q: expected name=value", entry)
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// webhookPayload is the JSON posted to -webhook-url: the run_summary event of
+// -output ndjson with the run's cluster, bucket and outcome
+type webhookPayload struct {
+	summaryEvent
+	Cluster string `json:"cluster"`
+	Bucket  string `json:"bucket"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// webhookPayload returns the payload describing the run as of now, which
+// failed with runErr when not nil
+func (r *refresher) webhookPayload(runErr error, now time.Time) webhookPayload {
+	payload := webhookPayload{
+		summaryEvent: summaryEvent{Event: eventRunSummary, RunID: r.runID, Time: now.UTC(), runSummary: r.stats.summary(now)},
+		Cluster:      r.opts.cluster,
+		Bucket:       r.opts.bucket,
+		Success:      runErr == nil,
+	}
+	if runErr != nil {
+		payload.Error = runErr.Error()
+	}
+	return payload
+}
+
+// errWebhookRejected marks webhook responses that retrying won't change
+var errWebhookRejected = errors.New("webhook rejected the payload")
+
+// postWebhookOnce posts body to target once
+func postWebhookOnce(ctx context.Context, client *http.Client, target string, header http.Header, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errWebhookRejected, err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	if resp.StatusCode/100 != 5 {
+		return fmt.Errorf("%w: %w", errWebhookRejected, err)
+	}
+	return err
+}
+
+// postWebhook posts body to target, retrying 5xx responses and network
+// errors with exponential backoff up to webhookAttempts times
+func postWebhook(ctx context.Context, client *http.Client, target string, header http.Header, body []byte) error {
+	wait := webhookBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = postWebhookOnce(ctx, client, target, header, body); err == nil {
+			return nil
+		}
+		if errors.Is(err, errWebhookRejected) || attempt == webhookAttempts {
+			break
+		}
+		slog.Debug("Retrying webhook", "url", redactURL(target), "attempt", attempt, "error", err.Error())
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to post webhook %s: %w", redactURL(target), ctx.Err())
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+	return fmt.Errorf("failed to post webhook %s: %w", redactURL(target), err)
+}
+
+// redactURL returns target without its credentials and query, which may hold
+// secrets, for logging
+func redactURL(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "invalid URL"
+	}
+	u.User, u.RawQuery, u.Fragment = nil, "", ""
+	return u.String()
+}
+
+// notifyWebhooks posts the run's summary to every -webhook-url, returning
+// runErr, or with -webhook-required the first webhook's error when the run
+// succeeded. Other failures are logged as warnings.
+func (r *refresher) notifyWebhooks(ctx context.Context, runErr error) error {
+	opts := r.opts
+	if len(opts.webhookURLs) == 0 {
+		return runErr
+	}
+	// The run's outcome is posted even when it was interrupted
+	postCtx := context.WithoutCancel(ctx)
+	body, err := json.Marshal(r.webhookPayload(runErr, time.Now()))
+	if err != nil {
+		slog.Warn("Failed to encode webhook payload", "error", err.Error())
+		return runErr
+	}
+
+	var failed error
+	client := &http.Client{Timeout: pushTimeout}
+	for _, target := range opts.webhookURLs {
+		if err := postWebhook(postCtx, client, target, opts.webhookHeader, body); err != nil {
+			slog.Warn("Failed to notify webhook", errorAttrs(err)...)
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		slog.Info("Notified webhook", "url", redactURL(target))
+	}
+	if runErr == nil && failed != nil && opts.webhookRequired {
+		return failed
+	}
+	return runErr
+}
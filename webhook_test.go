@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer is a webhook endpoint answering with the given statuses in
+// turn, then 200, and recording the requests it got
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.headers = append(s.headers, req.Header.Clone())
+		s.bodies = append(s.bodies, body)
+		if len(s.statuses) > 0 {
+			status := s.statuses[0]
+			s.statuses = s.statuses[1:]
+			http.Error(w, http.StatusText(status), status)
+		}
+	}))
+	return s
+}
+
+func (s *webhookServer) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+// fastWebhookRetries makes webhook retries immediate for the test
+func fastWebhookRetries(t *testing.T) {
+	backoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	t.Cleanup(func() { webhookBackoff = backoff })
+}
+
+func TestRunPostsWebhooks(t *testing.T) {
+	first, second := newWebhookServer(), newWebhookServer()
+	defer first.Close()
+	defer second.Close()
+
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/b1/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/a.db"},{"path":"data/ks/t/b.db"}]}]`
+	bucket.objects["links/host1/data/ks/t/a.db"] = ""
+	bucket.objects["links/host1/data/ks/t/b.db"] = ""
+	opts := testOptions()
+	opts.webhookURLs = repeatedString{first.URL + "/hooks/refresher", second.URL}
+	header, err := parseWebhookHeaders([]string{"Authorization=Bearer s3cr3t", "X-Source=medusa,nightly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.webhookHeader = header
+	r := newRefresher(bucket.client(), opts, time.Now())
+	if err := r.run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	for _, s := range []*webhookServer{first, second} {
+		if s.requests() != 1 {
+			t.Fatalf("webhook got %d requests, want 1", s.requests())
+		}
+		h := s.headers[0]
+		if h.Get("Content-Type") != "application/json" || h.Get("Authorization") != "Bearer s3cr3t" || h.Get("X-Source") != "medusa,nightly" {
+			t.Errorf("webhook headers = %v", h)
+		}
+		var payload map[string]any
+		if err := json.Unmarshal(s.bodies[0], &payload); err != nil {
+			t.Fatalf("invalid webhook payload %s: %v", s.bodies[0], err)
+		}
+		// Same members as the run_summary event of -output ndjson
+		for key, want := range map[string]any{
+			"event":               eventRunSummary,
+			"cluster":             "links",
+			"bucket":              "test-bucket",
+			"success":             true,
+			"updated":             float64(2),
+			"manifests_processed": float64(1),
+		} {
+			if payload[key] != want {
+				t.Errorf("payload %s = %v, want %v", key, payload[key], want)
+			}
+		}
+		for _, key := range []string{"run_id", "time", "elapsed"} {
+			if _, ok := payload[key]; !ok {
+				t.Errorf("payload has no %s", key)
+			}
+		}
+		if _, ok := payload["error"]; ok {
+			t.Errorf("successful run's payload has an error: %v", payload["error"])
+		}
+	}
+}
+
+func TestPostWebhookRetries(t *testing.T) {
+	fastWebhookRetries(t)
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantRequests int
+		wantErr      string
+	}{
+		{name: "succeeds after 5xx", statuses: []int{503, 502}, wantRequests: 3},
+		{name: "gives up after every attempt fails", statuses: []int{500, 500, 500, 500, 500}, wantRequests: webhookAttempts, wantErr: "500 Internal Server Error"},
+		{name: "4xx isn't retried", statuses: []int{400}, wantRequests: 1, wantErr: "400 Bad Request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newWebhookServer(tt.statuses...)
+			defer s.Close()
+			err := postWebhook(context.Background(), http.DefaultClient, s.URL, nil, []byte(`{}`))
+			if s.requests() != tt.wantRequests {
+				t.Errorf("webhook got %d requests, want %d", s.requests(), tt.wantRequests)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("postWebhook() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("postWebhook() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWebhookRequired(t *testing.T) {
+	fastWebhookRetries(t)
+	for _, required := range []bool{false, true} {
+		s := newWebhookServer(500, 500, 500, 500)
+		opts := testOptions()
+		opts.webhookURLs = repeatedString{s.URL + "?token=s3cr3t"}
+		opts.webhookRequired = required
+		r := newRefresher(newFakeBucket().client(), opts, time.Now())
+		err := r.run(context.Background())
+		s.Close()
+
+		if !required {
+			if err != nil {
+				t.Errorf("run() error = %v, want the failed webhook only logged", err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "failed to post webhook") {
+			t.Fatalf("run() error = %v with -webhook-required, want the webhook failure", err)
+		}
+		if strings.Contains(err.Error(), "s3cr3t") {
+			t.Errorf("error %q leaks the webhook URL's query", err)
+		}
+	}
+}
+
+func TestParseWebhookHeaders(t *testing.T) {
+	header, err := parseWebhookHeaders([]string{"Authorization=Bearer a=b", "x-team = data", "X-Team=ops"})
+	if err != nil {
+		t.Fatalf("parseWebhookHeaders() error = %v", err)
+	}
+	if header.Get("Authorization") != "Bearer a=b" || strings.Join(header.Values("X-Team"), ",") != "data,ops" {
+		t.Errorf("parseWebhookHeaders() = %v", header)
+	}
+	for _, entry := range []string{"Authorization", "=value", "Bad Name=value", "X-Team: data"} {
+		if _, err := parseWebhookHeaders([]string{entry}); err == nil {
+			t.Errorf("parseWebhookHeaders(%q) succeeded, want an error", entry)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+)
+
+// keyReference is a backup referencing a queried object, with the retention
+// it requires of the object
+type keyReference struct {
+	Backup        string     `json:"backup"` // [cluster]/[hostname]/[backup_name]
+	Manifest      string     `json:"manifest"`
+	Taken         *time.Time `json:"taken"` // nil when the backup is undated
+	Age           string     `json:"age,omitempty"`
+	RequiredUntil time.Time  `json:"required_until"`
+	RetainUntil   time.Time  `json:"retain_until"`
+}
+
+// keyReferences lists the backups referencing an object key, newest first
+type keyReferences struct {
+	Key     string         `json:"key"`
+	Backups []keyReference `json:"backups"`
+}
+
+// formatAge formats a backup age in days and hours, e.g. 12d5h
+func formatAge(age time.Duration) string {
+	if age < 0 {
+		age = 0
+	}
+	hours := int(age.Hours())
+	return fmt.Sprintf("%dd%dh", hours/24, hours%24)
+}
+
+// whoRetains walks the discovered manifests and returns, for each of keys in
+// order, the backups referencing it. It reads no retention. Manifests that
+// can't be read are reported, and the result may then miss references.
+func (r *refresher) whoRetains(ctx context.Context, keys []string) ([]keyReferences, error) {
+	manifests, err := resolveManifests(ctx, r.client, r.opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	sortManifestsNewestFirst(manifests)
+
+	refs := make(map[string][]keyReference, len(keys))
+	for _, key := range keys {
+		refs[key] = nil
+	}
+	failed := 0
+	for _, m := range manifests {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		manifest, err := r.fetchManifest(ctx, m.Key)
+		if err != nil {
+			slog.Error("Error downloading manifest", append([]any{"manifest", m.Key}, errorAttrs(err)...)...)
+			failed++
+			continue
+		}
+		mp, err := m.path()
+		if err != nil {
+			slog.Error("Invalid manifest path", "manifest", m.Key)
+			failed++
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, obj := range manifest.Objects {
+			key := resolveObjectKey(mp.HostnamePath, obj.Path)
+			if _, queried := refs[key]; !queried || seen[key] {
+				continue
+			}
+			seen[key] = true
+			refs[key] = append(refs[key], r.keyReference(m, mp))
+		}
+	}
+	if failed > 0 {
+		slog.Warn("Some manifests couldn't be read, their references are missing", "failed", failed)
+	}
+
+	results := make([]keyReferences, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, keyReferences{Key: key, Backups: refs[key]})
+	}
+	return results, nil
+}
+
+// keyReference describes the backup m as a reference of an object
+func (r *refresher) keyReference(m ManifestInfo, mp manifestPath) keyReference {
+	target, _ := r.backupTarget(m)
+	ref := keyReference{
+		Backup:        mp.id(),
+		Manifest:      m.Key,
+		RequiredUntil: target.requiredUntil.UTC(),
+		RetainUntil:   target.retainUntil.UTC(),
+	}
+	if ts, ok := backupTimestamp(m); ok {
+		taken := ts.UTC()
+		ref.Taken = &taken
+		ref.Age = formatAge(r.now.Sub(ts))
+	}
+	return ref
+}
+
+// writeKeyReferences writes results as an aligned table, a row per
+// referencing backup, or a JSON array
+func writeKeyReferences(w io.Writer, results []keyReferences, format string) error {
+	if format == "json" {
+		for i := range results {
+			if results[i].Backups == nil {
+				results[i].Backups = []keyReference{}
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tBACKUP\tAGE\tREQUIRED UNTIL\tRETAIN UNTIL")
+	for _, res := range results {
+		if len(res.Backups) == 0 {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\n", res.Key)
+			continue
+		}
+		for _, ref := range res.Backups {
+			age := ref.Age
+			if age == "" {
+				age = "undated"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", res.Key, ref.Backup, age,
+				ref.RequiredUntil.Format(time.RFC3339), ref.RetainUntil.Format(time.RFC3339))
+		}
+	}
+	return tw.Flush()
+}
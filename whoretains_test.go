@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWhoRetains(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	bucket := newFakeBucket()
+	bucket.objects["links/host1/backup-1748649600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"},{"path":"data/ks/t/new.db"}]}]`
+	bucket.objects["links/host1/backup-1748044800/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"}]}]`
+	bucket.objects["links/host1/adhoc/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"links/host1/data/ks/t/shared.db"}]}]`
+	bucket.objects["links/host2/backup-1748649600/meta/manifest.json"] = `[{"keyspace":"ks","columnfamily":"t","objects":[{"path":"data/ks/t/shared.db"}]}]`
+
+	opts := testOptions()
+	opts.anchor = anchorBackup
+	r := newRefresher(bucket.client(), opts, now)
+	keys := []string{"links/host1/data/ks/t/shared.db", "links/host1/data/ks/t/new.db", "links/host1/data/ks/t/gone.db"}
+	results, err := r.whoRetains(context.Background(), keys)
+	if err != nil {
+		t.Fatalf("whoRetains() error = %v", err)
+	}
+	if len(results) != len(keys) {
+		t.Fatalf("whoRetains() returned %d keys, want %d", len(results), len(keys))
+	}
+	if bucket.listCalls == 0 || len(bucket.puts) != 0 {
+		t.Errorf("whoRetains() made %d list calls and %d retention updates, want discovery only", bucket.listCalls, len(bucket.puts))
+	}
+
+	// Referenced by three backups of host1, newest first; host2's copy is another object
+	shared := results[0]
+	wantBackups := []string{"links/host1/backup-1748649600", "links/host1/backup-1748044800", "links/host1/adhoc"}
+	if len(shared.Backups) != len(wantBackups) {
+		t.Fatalf("shared.db referenced by %+v, want %v", shared.Backups, wantBackups)
+	}
+	for i, want := range wantBackups {
+		if shared.Backups[i].Backup != want {
+			t.Errorf("shared.db reference %d = %s, want %s", i, shared.Backups[i].Backup, want)
+		}
+	}
+	newest := shared.Backups[0]
+	taken := time.Unix(1748649600, 0).UTC()
+	if newest.Taken == nil || !newest.Taken.Equal(taken) || newest.Age != "1d0h" {
+		t.Errorf("newest backup taken %v, age %q, want %v and 1d0h", newest.Taken, newest.Age, taken)
+	}
+	// -anchor backup counts from each backup's timestamp
+	if !newest.RequiredUntil.Equal(taken.AddDate(0, 0, 7)) || !newest.RetainUntil.Equal(taken.AddDate(0, 0, 30)) {
+		t.Errorf("newest backup requires %v, retains until %v", newest.RequiredUntil, newest.RetainUntil)
+	}
+	// Undated backups count from now
+	if undated := shared.Backups[2]; undated.Taken != nil || undated.Age != "" || !undated.RetainUntil.Equal(now.AddDate(0, 0, 30)) {
+		t.Errorf("undated backup = %+v, want no age and retention from now", undated)
+	}
+
+	if got := results[1].Backups; len(got) != 1 || got[0].Backup != "links/host1/backup-1748649600" {
+		t.Errorf("new.db referenced by %+v, want the newest backup only", got)
+	}
+	if got := results[2].Backups; len(got) != 0 {
+		t.Errorf("gone.db referenced by %+v, want none", got)
+	}
+}
+
+func TestWriteKeyReferences(t *testing.T) {
+	taken := time.Date(2025, 5, 31, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC)
+	results := []keyReferences{
+		{Key: "links/host1/data/a.db", Backups: []keyReference{
+			{Backup: "links/host1/b2", Taken: &taken, Age: "1d0h", RequiredUntil: until, RetainUntil: until},
+			{Backup: "links/host1/b1", RequiredUntil: until, RetainUntil: until},
+		}},
+		{Key: "links/host1/data/b.db"},
+	}
+
+	var table bytes.Buffer
+	if err := writeKeyReferences(&table, results, "table"); err != nil {
+		t.Fatalf("writeKeyReferences() error = %v", err)
+	}
+	want := "KEY                    BACKUP          AGE      REQUIRED UNTIL        RETAIN UNTIL\n" +
+		"links/host1/data/a.db  links/host1/b2  1d0h     2025-06-30T00:00:00Z  2025-06-30T00:00:00Z\n" +
+		"links/host1/data/a.db  links/host1/b1  undated  2025-06-30T00:00:00Z  2025-06-30T00:00:00Z\n" +
+		"links/host1/data/b.db  -               -        -                     -\n"
+	if table.String() != want {
+		t.Errorf("table =\n%s\nwant\n%s", table.String(), want)
+	}
+
+	var out bytes.Buffer
+	if err := writeKeyReferences(&out, results, "json"); err != nil {
+		t.Fatalf("writeKeyReferences() error = %v", err)
+	}
+	var got []map[string]any
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("invalid json %s: %v", out.String(), err)
+	}
+	if backups, ok := got[1]["backups"].([]any); !ok || len(backups) != 0 {
+		t.Errorf("unreferenced key backups = %v, want an empty array", got[1]["backups"])
+	}
+}